@@ -0,0 +1,45 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package keystore
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+// dbKeyDomain separates the database encryption key from any other use of the account key
+var dbKeyDomain = []byte("turbo-geth database encryption")
+
+// DatabaseEncryptionKey derives the key for ethdb.NewEncryptedDatabase from the account key
+// stored in the keyfile, protected by the passphrase.
+func DatabaseEncryptionKey(keyfile, passphrase string) ([]byte, error) {
+	keyjson, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := DecryptKey(keyjson, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(dbKeyDomain)
+	h.Write(crypto.FromECDSA(key.PrivateKey))
+	zeroKey(key.PrivateKey)
+	return h.Sum(nil), nil
+}
@@ -106,6 +106,8 @@ var (
 		utils.CacheTrieFlag,
 		utils.CacheGCFlag,
 		utils.TrieCacheGenFlag,
+		utils.TrieSnapshotBlocksFlag,
+		utils.HistoryBatchingFlag,
 		utils.DownloadOnlyFlag,
 		utils.StorageModeFlag,
 		utils.ArchiveSyncInterval,
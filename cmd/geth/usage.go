@@ -145,6 +145,8 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.CacheGCFlag,
 			utils.CacheNoPrefetchFlag,
 			utils.TrieCacheGenFlag,
+			utils.TrieSnapshotBlocksFlag,
+			utils.HistoryBatchingFlag,
 			utils.DatabaseFlag,
 		},
 	},
@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	accountCmd.AddCommand(accountDecodeCmd)
+	accountCmd.AddCommand(accountEncodeCmd)
+	rootCmd.AddCommand(accountCmd)
+}
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "Converts the accounts between the storage encoding and JSON",
+}
+
+var accountDecodeCmd = &cobra.Command{
+	Use:   "decode <hex>",
+	Short: "Prints the JSON form of the account given in the storage encoding",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := accounts.DecodeForStorageString(args[0])
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(accounts.NewAccountJSON(a), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	},
+}
+
+var accountEncodeCmd = &cobra.Command{
+	Use:   "encode <json>",
+	Short: "Prints the storage encoding (in hex) of the account given in the JSON form",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		enc, err := accounts.EncodeFromJSON([]byte(args[0]))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%x\n", enc)
+		return nil
+	},
+}
@@ -0,0 +1,48 @@
+package commands
+
+import (
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	compressBuckets []string
+	compressCodec   string
+)
+
+func init() {
+	withChaindata(compressValuesCmd)
+	compressValuesCmd.Flags().StringSliceVar(&compressBuckets, "buckets", []string{
+		string(dbutils.CodeBucket),
+		string(dbutils.AccountsHistoryBucket),
+		string(dbutils.StorageHistoryBucket),
+	}, "buckets to compress")
+	compressValuesCmd.Flags().StringVar(&compressCodec, "codec", "snappy", "compression codec")
+	rootCmd.AddCommand(compressValuesCmd)
+}
+
+var compressValuesCmd = &cobra.Command{
+	Use:   "compressValues",
+	Short: "Switches the buckets to the compressed values, compressing the existing ones (the node must be stopped)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		codec, err := ethdb.ParseValueCodec(compressCodec)
+		if err != nil {
+			return err
+		}
+		db, err := ethdb.NewBoltDatabase(chaindata)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		ctx := getContext()
+		for _, bucket := range compressBuckets {
+			if err = db.EnableValueCompression(ctx, []byte(bucket), codec); err != nil {
+				return err
+			}
+			log.Info("Compressed values", "bucket", bucket, "codec", codec)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,22 @@
+package commands
+
+import (
+	"github.com/ledgerwatch/turbo-geth/cmd/state/stateless"
+	"github.com/spf13/cobra"
+)
+
+var defragContracts int
+
+func init() {
+	withChaindata(defragStorageCmd)
+	defragStorageCmd.Flags().IntVar(&defragContracts, "contracts", 100, "number of the contracts with the largest storage to defragment")
+	rootCmd.AddCommand(defragStorageCmd)
+}
+
+var defragStorageCmd = &cobra.Command{
+	Use:   "defragStorage",
+	Short: "Rewrites the storage of the largest contracts contiguously and removes the storage of their previous incarnations",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return stateless.DefragStorage(chaindata, defragContracts)
+	},
+}
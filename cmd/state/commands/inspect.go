@@ -0,0 +1,21 @@
+package commands
+
+import (
+	"os"
+
+	"github.com/ledgerwatch/turbo-geth/cmd/state/stateless"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	withChaindata(inspectCmd)
+	rootCmd.AddCommand(inspectCmd)
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Interactively lists the entries of the database buckets, decoding the known formats of the keys and values",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return stateless.InspectBuckets(chaindata, os.Stdin, os.Stdout)
+	},
+}
@@ -0,0 +1,28 @@
+package commands
+
+import (
+	"github.com/ledgerwatch/turbo-geth/cmd/state/stateless"
+	"github.com/spf13/cobra"
+)
+
+var (
+	traceFile    string
+	cacheGens    uint32
+	resolveReads bool
+)
+
+func init() {
+	withChaindata(replayTraceCmd)
+	replayTraceCmd.Flags().StringVar(&traceFile, "trace", "access.trace", "path to the access trace recorded by state.RecordingReader")
+	replayTraceCmd.Flags().Uint32Var(&cacheGens, "cachegens", 0, "limit of the trie cache generations (0 for the default)")
+	replayTraceCmd.Flags().BoolVar(&resolveReads, "resolve-reads", true, "resolve the read items into the trie, as the block processing does")
+	rootCmd.AddCommand(replayTraceCmd)
+}
+
+var replayTraceCmd = &cobra.Command{
+	Use:   "replayTrace",
+	Short: "Replays the recorded state access trace and reports the latencies of the reads",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return stateless.ReplayTrace(getContext(), chaindata, traceFile, cacheGens, resolveReads)
+	},
+}
@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"github.com/ledgerwatch/turbo-geth/cmd/state/stateless"
+	"github.com/spf13/cobra"
+)
+
+var (
+	witnessAddr    string
+	witnessTLSCert string
+	witnessTLSKey  string
+)
+
+func init() {
+	withChaindata(witnessServerCmd)
+	witnessServerCmd.Flags().StringVar(&witnessDatabase, "witnessDbFile", "", "path to the database of the witnesses written by the stateless command")
+	witnessServerCmd.Flags().Uint32Var(&triesize, "triesize", 1024*1024, "trie size limit the witnesses were written with, unless the request asks for another one")
+	witnessServerCmd.Flags().StringVar(&witnessAddr, "addr", "localhost:8547", "address to listen on")
+	witnessServerCmd.Flags().StringVar(&witnessTLSCert, "tlsCert", "", "certificate file to serve HTTPS (empty string -- serve HTTP)")
+	witnessServerCmd.Flags().StringVar(&witnessTLSKey, "tlsKey", "", "key file of the certificate")
+	if err := witnessServerCmd.MarkFlagRequired("witnessDbFile"); err != nil {
+		panic(err)
+	}
+	rootCmd.AddCommand(witnessServerCmd)
+}
+
+var witnessServerCmd = &cobra.Command{
+	Use:   "witnessServer",
+	Short: "Serves the witnesses of the witness DB over HTTP at /witness/{blockHash} and /witness/range?from=&to=",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return stateless.ServeWitnesses(getContext(), witnessDatabase, chaindata, triesize, witnessAddr, witnessTLSCert, witnessTLSKey)
+	},
+}
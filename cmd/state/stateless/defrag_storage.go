@@ -0,0 +1,31 @@
+package stateless
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// DefragStorage runs the storage defragmentation for the n contracts with the largest storage in the chaindata.
+// The node must not be running on the same database
+func DefragStorage(chaindata string, n int) error {
+	ethDb, err := ethdb.NewBoltDatabase(chaindata)
+	if err != nil {
+		return err
+	}
+	defer ethDb.Close()
+	startTime := time.Now()
+	var rewritten, purged int
+	if err = state.DefragmentLargestContracts(ethDb, n, func(cs state.ContractSize, res *state.DefragResult) {
+		fmt.Printf("%x: %d slots, %d bytes, rewritten %d, purged %d (incarnations %v, kept %v)\n",
+			cs.AddrHash, cs.Slots, cs.Bytes, res.Rewritten, res.Purged, res.PurgedIncarnations, res.KeptIncarnations)
+		rewritten += res.Rewritten
+		purged += res.Purged
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("Rewritten %d, purged %d storage items in %v\n", rewritten, purged, time.Since(startTime))
+	return nil
+}
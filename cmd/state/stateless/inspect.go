@@ -0,0 +1,84 @@
+package stateless
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+const inspectHelp = `Commands:
+  <bucket> [prefix in hex] [limit]  list the entries of the bucket (for example: AT 00ab 10)
+  help                              print this help
+  exit                              quit
+`
+
+// InspectBuckets reads the inspection commands from in and writes the entries of the buckets of the chaindata,
+// decoded by ethdb.Inspect, to out. The node must not be running on the same database
+func InspectBuckets(chaindata string, in io.Reader, out io.Writer) error {
+	ethDb, err := ethdb.NewBoltDatabase(chaindata)
+	if err != nil {
+		return err
+	}
+	defer ethDb.Close()
+	return inspectLoop(ethDb, in, out)
+}
+
+func inspectLoop(db ethdb.Getter, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	fmt.Fprint(out, "> ")
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "exit" || fields[0] == "quit":
+			return nil
+		case fields[0] == "help":
+			fmt.Fprint(out, inspectHelp)
+		default:
+			if err := inspectCommand(db, fields, out); err != nil {
+				fmt.Fprintf(out, "error: %v\n", err)
+			}
+		}
+		fmt.Fprint(out, "> ")
+	}
+	return scanner.Err()
+}
+
+func inspectCommand(db ethdb.Getter, fields []string, out io.Writer) error {
+	if len(fields) > 3 {
+		return fmt.Errorf("too many arguments, try help")
+	}
+	bucket := []byte(fields[0])
+	var prefix []byte
+	if len(fields) > 1 {
+		var err error
+		if prefix, err = hex.DecodeString(strings.TrimPrefix(fields[1], "0x")); err != nil {
+			return fmt.Errorf("invalid prefix: %w", err)
+		}
+	}
+	limit := 20
+	if len(fields) > 2 {
+		var err error
+		if limit, err = strconv.Atoi(fields[2]); err != nil || limit < 0 {
+			return fmt.Errorf("invalid limit %q", fields[2])
+		}
+	}
+	entries, err := ethdb.Inspect(db, bucket, prefix, limit)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Decoded != "" {
+			fmt.Fprintf(out, "%x => %s\n", e.Key, e.Decoded)
+		} else {
+			fmt.Fprintf(out, "%x => %x\n", e.Key, e.Value)
+		}
+	}
+	fmt.Fprintf(out, "%d entries\n", len(entries))
+	return nil
+}
@@ -0,0 +1,68 @@
+package stateless
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// ReplayTrace replays the access trace recorded by state.RecordingReader against the TrieDbState opened at the
+// head of the chaindata, with the given cache settings, and prints the latency distributions of the reads
+func ReplayTrace(ctx context.Context, chaindata string, traceFile string, cacheGens uint32, resolveReads bool) error {
+	f, err := os.Open(traceFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	trace, err := state.ReadAccessTrace(f)
+	if err != nil {
+		return fmt.Errorf("reading trace %s: %w", traceFile, err)
+	}
+
+	ethDb, err := ethdb.NewBoltDatabase(chaindata)
+	if err != nil {
+		return err
+	}
+	defer ethDb.Close()
+	hash := rawdb.ReadHeadBlockHash(ethDb)
+	number := rawdb.ReadHeaderNumber(ethDb, hash)
+	var blockNr uint64
+	var root common.Hash
+	if number != nil {
+		blockNr = *number
+		root = rawdb.ReadHeader(ethDb, hash, blockNr).Root
+	}
+	tds, err := state.NewTrieDbState(root, ethDb, blockNr)
+	if err != nil {
+		return err
+	}
+	if cacheGens > 0 {
+		tds.SetCacheGenLimit(cacheGens)
+	}
+	tds.SetResolveReads(resolveReads)
+	loaded, err := tds.LoadTrieSnapshot()
+	if err != nil {
+		return err
+	}
+	if !loaded {
+		if err = tds.Rebuild(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Replaying %d accesses at block %d\n", len(trace), blockNr)
+	startTime := time.Now()
+	rep, err := state.ReplayAccessTrace(ctx, tds, trace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Replay took %v\n", time.Since(startTime))
+	rep.Print(os.Stdout)
+	return nil
+}
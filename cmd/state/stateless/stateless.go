@@ -157,7 +157,6 @@ func Stateless(
 	useStatelessResolver bool,
 	witnessDatabasePath string) {
 
-	state.MaxTrieCacheGen = triesize
 	startTime := time.Now()
 	sigs := make(chan os.Signal, 1)
 	interruptCh := make(chan bool, 1)
@@ -221,6 +220,7 @@ func Stateless(
 	if blockNum > 1 {
 		tds.Rebuild()
 	}
+	tds.SetCacheGenLimit(triesize)
 	tds.SetResolveReads(false)
 	tds.SetNoHistory(true)
 	interrupt := false
@@ -321,7 +321,7 @@ func Stateless(
 			}
 
 			if len(resolveWitnesses) > 0 {
-				witnessDBWriter.MustUpsert(blockNum, state.MaxTrieCacheGen, resolveWitnesses)
+				witnessDBWriter.MustUpsert(blockNum, tds.CacheGenLimit(), resolveWitnesses)
 			}
 		}
 
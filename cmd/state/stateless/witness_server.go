@@ -0,0 +1,227 @@
+package stateless
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"golang.org/x/crypto/sha3"
+)
+
+// Maximum number of blocks in one range request
+const maxWitnessRange = 1024
+
+// WitnessServer serves the witnesses stored by WitnessDBWriter over HTTP:
+//
+//	/witness/{blockHash}       witness of the canonical block, identified by its hash in the chaindata
+//	/witness/range?from=&to=   witnesses of the blocks from..to (inclusive), streamed as the frames of the block
+//	                           number (uint64 big endian), the length of the witness (uint32 big endian)
+//	                           and the witness. The blocks without the witness are skipped
+//
+// Both take the optional triesize parameter, selecting the witnesses written with another trie size limit.
+// The responses carry ETags derived from the witnesses, so that the clients can revalidate them with
+// If-None-Match instead of downloading them again. The witness of a single block also supports the byte ranges
+type WitnessServer struct {
+	reader      *WitnessDBReader
+	chainDb     ethdb.Getter // Numbers and canonical hashes of the blocks
+	maxTrieSize uint32
+}
+
+// NewWitnessServer creates the server of the witnesses written with the trie size limit maxTrieSize,
+// unless the requests ask for another one
+func NewWitnessServer(reader *WitnessDBReader, chainDb ethdb.Getter, maxTrieSize uint32) *WitnessServer {
+	return &WitnessServer{reader: reader, chainDb: chainDb, maxTrieSize: maxTrieSize}
+}
+
+func (s *WitnessServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/witness/")
+	if path == r.URL.Path || path == "" || strings.Contains(path, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	trieSize := s.maxTrieSize
+	if v := r.URL.Query().Get("triesize"); v != "" {
+		size, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid triesize: %v", err), http.StatusBadRequest)
+			return
+		}
+		trieSize = uint32(size)
+	}
+	if path == "range" {
+		s.serveRange(w, r, trieSize)
+	} else {
+		s.serveBlock(w, r, path, trieSize)
+	}
+}
+
+func (s *WitnessServer) serveBlock(w http.ResponseWriter, r *http.Request, hashHex string, trieSize uint32) {
+	h, err := hex.DecodeString(strings.TrimPrefix(hashHex, "0x"))
+	if err != nil || len(h) != common.HashLength {
+		http.Error(w, fmt.Sprintf("invalid block hash %q", hashHex), http.StatusBadRequest)
+		return
+	}
+	hash := common.BytesToHash(h)
+	number := rawdb.ReadHeaderNumber(s.chainDb, hash)
+	if number == nil {
+		http.Error(w, fmt.Sprintf("unknown block %x", h), http.StatusNotFound)
+		return
+	}
+	// The witnesses are stored by the block number, so they are the ones of the canonical blocks only
+	if rawdb.ReadCanonicalHash(s.chainDb, *number) != hash {
+		http.Error(w, fmt.Sprintf("block %x is not canonical", h), http.StatusNotFound)
+		return
+	}
+	witness, err := s.reader.GetWitnessesForBlock(*number, trieSize)
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		log.Warn("Reading witness failed", "block", *number, "error", err)
+		http.Error(w, "reading witness failed", http.StatusInternalServerError)
+		return
+	}
+	if len(witness) == 0 {
+		http.Error(w, fmt.Sprintf("no witness of block %d", *number), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, crypto.Keccak256(witness)))
+	w.Header().Set("X-Block-Number", strconv.FormatUint(*number, 10))
+	// Handles If-None-Match against the ETag, and the byte ranges
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(witness))
+}
+
+func (s *WitnessServer) serveRange(w http.ResponseWriter, r *http.Request, trieSize uint32) {
+	query := r.URL.Query()
+	from, err := strconv.ParseUint(query.Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+		return
+	}
+	to, err := strconv.ParseUint(query.Get("to"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+		return
+	}
+	if to < from || to-from >= maxWitnessRange {
+		http.Error(w, fmt.Sprintf("invalid range %d-%d, at most %d blocks are served at once", from, to, maxWitnessRange), http.StatusBadRequest)
+		return
+	}
+
+	// The first pass finds the blocks with the witnesses and derives the ETag from their hashes,
+	// the second one streams the witnesses without holding all of them in memory
+	var blocks []uint64
+	hasher := sha3.NewLegacyKeccak256()
+	var frame [8]byte
+	for blockNr := from; ; blockNr++ {
+		witness, err := s.reader.GetWitnessesForBlock(blockNr, trieSize)
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			log.Warn("Reading witness failed", "block", blockNr, "error", err)
+			http.Error(w, "reading witness failed", http.StatusInternalServerError)
+			return
+		}
+		if len(witness) > 0 {
+			blocks = append(blocks, blockNr)
+			binary.BigEndian.PutUint64(frame[:], blockNr)
+			hasher.Write(frame[:])
+			hasher.Write(crypto.Keccak256(witness))
+		}
+		if blockNr == to {
+			break
+		}
+	}
+	etag := fmt.Sprintf(`"%x"`, hasher.Sum(nil))
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	var header [12]byte
+	for _, blockNr := range blocks {
+		witness, err := s.reader.GetWitnessesForBlock(blockNr, trieSize)
+		if err != nil || len(witness) == 0 {
+			// The status is sent already, the truncated stream tells the client that the range is incomplete
+			log.Warn("Reading witness failed", "block", blockNr, "error", err)
+			return
+		}
+		binary.BigEndian.PutUint64(header[:], blockNr)
+		binary.BigEndian.PutUint32(header[8:], uint32(len(witness)))
+		if _, err = w.Write(header[:]); err != nil {
+			return
+		}
+		if _, err = w.Write(witness); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// etagMatch tells whether the value of If-None-Match matches the ETag, comparing weakly as RFC 7232 requires
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeWitnesses serves the witnesses of the witness DB (see WitnessServer) on the address until the context
+// is cancelled, over HTTPS if the certificate and key files are given. The chaindata is opened for the lookups
+// of the block numbers only, and the witnesses are read as they were written with the trie size limit triesize
+func ServeWitnesses(ctx context.Context, witnessDbPath, chaindata string, triesize uint32, addr, certFile, keyFile string) error {
+	witnessDb, err := ethdb.NewBoltDatabase(witnessDbPath)
+	if err != nil {
+		return err
+	}
+	defer witnessDb.Close()
+	chainDb, err := ethdb.NewBoltDatabase(chaindata)
+	if err != nil {
+		return err
+	}
+	defer chainDb.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/witness/", NewWitnessServer(NewWitnessDBReader(witnessDb), chainDb, triesize))
+	srv := &http.Server{Addr: addr, Handler: mux}
+	errc := make(chan error, 1)
+	go func() {
+		if certFile != "" || keyFile != "" {
+			errc <- srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			errc <- srv.ListenAndServe()
+		}
+	}()
+	log.Info("Serving witnesses", "addr", addr, "tls", certFile != "" || keyFile != "", "triesize", triesize)
+	select {
+	case err = <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,104 @@
+package stateless
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestWitnessServer(t *testing.T) {
+	witnessDb, chainDb := ethdb.NewMemDatabase(), ethdb.NewMemDatabase()
+	const trieSize = 1024
+	witnesses := map[uint64][]byte{1: {0x01, 0x02, 0x03}, 2: {0x04}, 4: {0x05, 0x06}}
+	for blockNr, witness := range witnesses {
+		if err := witnessDb.Put(witnessesBucket, deriveDbKey(blockNr, trieSize), witness); err != nil {
+			t.Fatal(err)
+		}
+		rawdb.WriteHeaderNumber(chainDb, common.Hash{byte(blockNr)}, blockNr)
+		rawdb.WriteCanonicalHash(chainDb, common.Hash{byte(blockNr)}, blockNr)
+	}
+	rawdb.WriteHeaderNumber(chainDb, common.Hash{3}, 3)
+	rawdb.WriteCanonicalHash(chainDb, common.Hash{3}, 3)
+	// Block of a side chain, with the number of a block with the witness
+	rawdb.WriteHeaderNumber(chainDb, common.Hash{0x14}, 4)
+	srv := httptest.NewServer(NewWitnessServer(NewWitnessDBReader(witnessDb), chainDb, trieSize))
+	defer srv.Close()
+
+	get := func(path string, header http.Header) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	resp, body := get("/witness/"+common.Hash{1}.Hex(), nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, witnesses[1]) {
+		t.Fatalf("expected the witness of block 1, got %d %x", resp.StatusCode, body)
+	}
+	etag := resp.Header.Get("ETag")
+	if resp, _ = get("/witness/"+common.Hash{1}.Hex(), http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected the unchanged witness not to be sent, got %d", resp.StatusCode)
+	}
+	if resp, body = get("/witness/"+common.Hash{1}.Hex(), http.Header{"Range": {"bytes=1-"}}); resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, witnesses[1][1:]) {
+		t.Errorf("expected the tail of the witness, got %d %x", resp.StatusCode, body)
+	}
+	for path, status := range map[string]int{
+		"/witness/" + common.Hash{3}.Hex():    http.StatusNotFound,   // Block without the witness
+		"/witness/" + common.Hash{9}.Hex():    http.StatusNotFound,   // Unknown block
+		"/witness/" + common.Hash{0x14}.Hex(): http.StatusNotFound,   // Non-canonical block
+		"/witness/0x1234":                     http.StatusBadRequest, // Not a hash
+		"/witness/range?from=3&to=1":          http.StatusBadRequest,
+		"/witness/range?from=0&to=5000":       http.StatusBadRequest,
+	} {
+		if resp, _ = get(path, nil); resp.StatusCode != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, resp.StatusCode)
+		}
+	}
+
+	resp, body = get("/witness/range?from=2&to=5", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the range, got %d", resp.StatusCode)
+	}
+	var blocks []uint64
+	for len(body) > 0 {
+		if len(body) < 12 {
+			t.Fatalf("truncated frame %x", body)
+		}
+		blockNr, size := binary.BigEndian.Uint64(body), binary.BigEndian.Uint32(body[8:])
+		if !bytes.Equal(body[12:12+size], witnesses[blockNr]) {
+			t.Errorf("block %d: expected witness %x, got %x", blockNr, witnesses[blockNr], body[12:12+size])
+		}
+		blocks = append(blocks, blockNr)
+		body = body[12+size:]
+	}
+	if len(blocks) != 2 || blocks[0] != 2 || blocks[1] != 4 {
+		t.Errorf("expected the witnesses of blocks 2 and 4, got %v", blocks)
+	}
+	etag = resp.Header.Get("ETag")
+	if resp, _ = get("/witness/range?from=2&to=5", http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected the unchanged range not to be sent, got %d", resp.StatusCode)
+	}
+	if resp, _ = get("/witness/range?from=1&to=5", http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected another range to be sent, got %d", resp.StatusCode)
+	}
+}
@@ -40,7 +40,6 @@ import (
 	"github.com/ledgerwatch/turbo-geth/consensus/clique"
 	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
 	"github.com/ledgerwatch/turbo-geth/core"
-	"github.com/ledgerwatch/turbo-geth/core/state"
 	"github.com/ledgerwatch/turbo-geth/core/vm"
 	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/eth"
@@ -427,6 +426,14 @@ var (
 		Name:  "trie-cache-gens",
 		Usage: "Number of trie node generations to keep in memory",
 	}
+	TrieSnapshotBlocksFlag = cli.Uint64Flag{
+		Name:  "trie-snapshot-blocks",
+		Usage: "Number of blocks between the snapshots of the upper levels of the trie, used for fast restart (0 = disabled)",
+	}
+	HistoryBatchingFlag = cli.BoolFlag{
+		Name:  "history-batching",
+		Usage: "Write the history records of each block in one pass when the block is committed",
+	}
 	StorageModeFlag = cli.StringFlag{
 		Name: "storage-mode",
 		Usage: `Configures the storage mode of the app:
@@ -1567,9 +1574,14 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 			cfg.Miner.GasPrice = big.NewInt(1)
 		}
 	}
-	// TODO(fjl): move trie cache generations into config
 	if gen := ctx.GlobalInt(TrieCacheGenFlag.Name); gen > 0 {
-		state.MaxTrieCacheGen = uint32(gen)
+		cfg.TrieCacheGens = uint32(gen)
+	}
+	if ctx.GlobalIsSet(TrieSnapshotBlocksFlag.Name) {
+		cfg.TrieSnapshotBlocks = ctx.GlobalUint64(TrieSnapshotBlocksFlag.Name)
+	}
+	if ctx.GlobalIsSet(HistoryBatchingFlag.Name) {
+		cfg.HistoryBatching = ctx.GlobalBool(HistoryBatchingFlag.Name)
 	}
 }
 
@@ -1710,6 +1722,9 @@ func MakeChain(ctx *cli.Context, stack *node.Node) (chain *core.BlockChain, chai
 		TrieDirtyLimit:      eth.DefaultConfig.TrieDirtyCache,
 		TrieTimeLimit:       eth.DefaultConfig.TrieTimeout,
 	}
+	if gen := ctx.GlobalInt(TrieCacheGenFlag.Name); gen > 0 {
+		cache.TrieCacheGens = uint32(gen)
+	}
 	if ctx.GlobalIsSet(CacheFlag.Name) || ctx.GlobalIsSet(CacheTrieFlag.Name) {
 		cache.TrieCleanLimit = ctx.GlobalInt(CacheFlag.Name) * ctx.GlobalInt(CacheTrieFlag.Name) / 100
 	}
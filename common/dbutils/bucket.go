@@ -28,18 +28,101 @@ var (
 	//value - list of block where it's changed
 	StorageHistoryBucket = []byte("hST")
 
+	// key - address hash
+	// value - roaring bitmap of the blocks changing the account, see ethdb.MergeHistoryBitmaps
+	AccountsHistoryBitmapBucket = []byte("hATB")
+
+	// key - address hash + incarnation + storage key hash
+	// value - roaring bitmap of the blocks changing the storage item, see ethdb.MergeHistoryBitmaps
+	StorageHistoryBitmapBucket = []byte("hSTB")
+
 	//key - contract code hash
 	//value - contract code
 	CodeBucket = []byte("CODE")
 
+	//key - contract code hash
+	//value - contract code size (uint32 big endian)
+	CodeSizeBucket = []byte("CODESIZE")
+
 	//key - addressHash+incarnation
 	//value - code hash
 	ContractCodeBucket = []byte("contractCode")
 
+	// key - name of the bucket stored with the prefix-compressed keys (see ethdb.BoltDatabase.EnableKeyPrefixCompression)
+	// value - length of the compressed prefix (uint32 big endian)
+	PrefixCompressionBucket = []byte("PCB")
+
+	// key - name of the bucket stored with the compressed values (see ethdb.BoltDatabase.EnableValueCompression)
+	// value - codec + migration completed flag + last migrated key
+	ValueCompressionBucket = []byte("VCB")
+
+	// key - token address + holder address
+	// value - balance of the holder (without leading zeros), see state.TokenIndexer
+	TokenBalanceBucket = []byte("TKB")
+
+	// key - encoded timestamp(block number)
+	// value - state root after the block + number of account changes (uint32) + number of storage changes (uint32)
+	StateRootIndexBucket = []byte("SRI")
+
+	// key - encoded timestamp(block number), the first block processed with the binary trie
+	// value - hexary root + binary root of the state before that block, see state.TrieDbState.ApplyTrieLayout
+	TrieLayoutBucket = []byte("TLB")
+
+	// key - encoded timestamp(block number)
+	// value - snapshot of the upper levels of the state trie after the block, see state.TrieDbState.SnapshotTrie
+	TrieSnapshotBucket = []byte("TSB")
+
+	// key - addressHash+incarnation
+	// value - number of storage items (uint64 big endian) + total size of their keys and values (uint64 big endian),
+	// see state.TopContractsBySize
+	StateSizeBucket = []byte("SSZ")
+
 	// key - encoded timestamp(block number) + history bucket(hAT/hST)
 	// value - encoded ChangeSet{k - addrHash|compositeKey(for storage) v - account(encoded) | originalValue(common.Hash)}
 	ChangeSetBucket = []byte("ChangeSet")
 
+	// key - encoded timestamp(block number) + transaction index (uint32 big endian) + history bucket(hAT/hST)
+	// value - encoded ChangeSet{k - addrHash|compositeKey(for storage) v - account(encoded) | value} of the values
+	// written by the transaction, see state.TxDiff
+	TxChangeSetBucket = []byte("TCS")
+
+	// key - addressHash
+	// value - number of the last block that read or wrote the account (uint64 big endian), see state.UntouchedAccounts
+	LastTouchBucket = []byte("LTB")
+
+	// key - addressHash
+	// value - number of the block after which the account expired (uint64 big endian) + its incarnation (uint64 big endian),
+	// see state.TrieDbState.ExpireAccounts
+	ExpiredAccountsBucket = []byte("EXP")
+
+	// key - encoded timestamp(block number)
+	// value - concatenated state roots (32 bytes each) preceding the expiries of the accounts after the block,
+	// against which the resurrections are verified, see state.TrieDbState.ResurrectAccount
+	ExpiryRootBucket = []byte("EXR")
+
+	// key - addressHash, or addressHash+incarnation+storage hashed key
+	// value - account (encoded for storage) or storage value of the forked chain, prefixed by 1, or 0 if it is absent
+	// in the forked chain or deleted locally, see state.ForkReader
+	ForkBucket = []byte("FRK")
+
+	// key - addressHash
+	// value - address + score (uint64, big endian) of the frequently touched account, see state.TrieDbState.SetFrequentActors
+	FrequentActorsBucket = []byte("FAT")
+
+	// key - addressHash
+	// value - number of the last block that read the code of the contract (uint64 big endian) + incarnation of
+	// the contract (uint64 big endian), see state.TrieDbState.SetCodeReads
+	CodeReadBucket = []byte("CRB")
+
+	// key - encoded timestamp(block number) + length of the bucket name (1 byte) + bucket name + key
+	// value - 1 if the key existed before its first change in the block, 0 otherwise + the previous value,
+	// see state.recordUndo
+	IndexUndoBucket = []byte("IUB")
+
+	// key - name of the custom bucket registered by the application, see RegisterBucket
+	// value - number of the migrations applied to the bucket (uint64 big endian), see ethdb.MigrateCustomBuckets
+	CustomBucketVersionBucket = []byte("CBV")
+
 	// databaseVerisionKey tracks the current database version.
 	DatabaseVerisionKey = []byte("DatabaseVersion")
 
@@ -79,4 +162,21 @@ var (
 	// last block that was pruned
 	// it's saved one in 5 minutes
 	LastPrunedBlockKey = []byte("LastPrunedBlock")
+
+	// block number (uint64 big endian) + state root, written by TrieDbState.Close on clean shutdown
+	StateCleanShutdownKey = []byte("StateCleanShutdown")
+
+	// block number (uint64 big endian) + checksum of the flat state after the block, see state.ComputeStateChecksum
+	StateChecksumKey = []byte("StateChecksum")
+
+	// block number (uint64 big endian) of the last block applied to the read replica (see state.ReplicaApplier)
+	ReplicaProgressKey = []byte("ReplicaProgress")
+
+	// block number (uint64 big endian) of the last block merged into the history bitmaps (see ethdb.MergeHistoryBitmaps)
+	HistoryBitmapProgressKey = []byte("HistoryBitmapProgress")
+
+	// concatenated code hashes in the code cache and in the code size cache of TrieDbState, least recently used first,
+	// written by TrieDbState.PersistCodeCacheKeys on shutdown and read by TrieDbState.WarmCodeCaches on start
+	CodeCacheKeysKey     = []byte("CodeCacheKeys")
+	CodeSizeCacheKeysKey = []byte("CodeSizeCacheKeys")
 )
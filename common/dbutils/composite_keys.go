@@ -113,11 +113,23 @@ func GenerateStoragePrefix(addressHash common.Hash, incarnation uint64) []byte {
 
 	//todo pool
 	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, incarnation^^uint64(0))
+	EncodeIncarnation(buf, incarnation)
 	prefix = append(prefix, buf...)
 	return prefix
 }
 
+// EncodeIncarnation writes the incarnation into the first 8 bytes of buf, in the form used in the storage keys.
+// Incarnation is inverted (all bits are flipped) before being written as big endian, so that the latest
+// incarnation of a contract comes first when the storage of the account is walked in the ascending order
+func EncodeIncarnation(buf []byte, incarnation uint64) {
+	binary.BigEndian.PutUint64(buf, ^incarnation)
+}
+
+// DecodeIncarnation is the inverse of EncodeIncarnation
+func DecodeIncarnation(buf []byte) uint64 {
+	return ^binary.BigEndian.Uint64(buf)
+}
+
 // Key + blockNum
 func CompositeKeySuffix(key []byte, timestamp uint64) (composite, encodedTS []byte) {
 	encodedTS = EncodeTimestamp(timestamp)
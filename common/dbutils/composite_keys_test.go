@@ -1,6 +1,9 @@
 package dbutils
 
 import (
+	"bytes"
+	"math"
+	"math/rand"
 	"testing"
 
 	"github.com/ledgerwatch/turbo-geth/common"
@@ -42,3 +45,28 @@ func TestHeaderTypeDetection(t *testing.T) {
 	assert.False(t, IsHeaderHashKey(notRelatedInput))
 
 }
+
+func TestIncarnationEncoding(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	values := []uint64{0, 1, 2, math.MaxUint64 - 1, math.MaxUint64}
+	for i := 0; i < 1000; i++ {
+		values = append(values, rng.Uint64())
+	}
+	buf := make([]byte, 8)
+	other := make([]byte, 8)
+	for i, inc := range values {
+		EncodeIncarnation(buf, inc)
+		assert.Equal(t, inc, DecodeIncarnation(buf))
+		// Higher incarnations must sort first
+		prev := values[(i+1)%len(values)]
+		EncodeIncarnation(other, prev)
+		if inc > prev {
+			assert.True(t, bytes.Compare(buf, other) < 0, "incarnation %d must sort before %d", inc, prev)
+		} else if inc < prev {
+			assert.True(t, bytes.Compare(buf, other) > 0, "incarnation %d must sort after %d", inc, prev)
+		}
+	}
+	// Storage prefix uses the same encoding
+	prefix := GenerateStoragePrefix(common.Hash{}, 5)
+	assert.Equal(t, uint64(5), DecodeIncarnation(prefix[common.HashLength:]))
+}
@@ -0,0 +1,100 @@
+package dbutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// BucketStore is the part of the database given to the migrations of the custom buckets
+type BucketStore interface {
+	Get(bucket, key []byte) ([]byte, error)
+	Put(bucket, key, value []byte) error
+	Delete(bucket, key []byte) error
+	Walk(bucket, startkey []byte, fixedbits uint, walker func([]byte, []byte) (bool, error)) error
+}
+
+// BucketMigration converts the entries of the custom bucket written by the previous version of the application.
+// It is applied atomically, together with the new version of the bucket, see ethdb.MigrateCustomBuckets
+type BucketMigration func(db BucketStore) error
+
+// CustomBucket is the bucket of the application embedding turbo-geth (for example, its own index of the state),
+// which is registered with RegisterBucket to be written in the same batches as the state of the blocks
+// (see state.TrieDbState.PutCustom)
+type CustomBucket struct {
+	Name []byte
+	// Applied in order, the version of the bucket in the database is the number of the migrations applied to it
+	Migrations []BucketMigration
+	// Human readable form of the entries for ethdb.Inspect, optional
+	Decode func(k, v []byte) (string, error)
+}
+
+// Buckets of turbo-geth itself, which cannot be registered as the custom buckets
+var builtinBuckets = [][]byte{
+	AccountsBucket, AccountsHistoryBucket, StorageBucket, StorageHistoryBucket, AccountsHistoryBitmapBucket,
+	StorageHistoryBitmapBucket, CodeBucket, CodeSizeBucket, ContractCodeBucket, PrefixCompressionBucket,
+	ValueCompressionBucket, TokenBalanceBucket, StateRootIndexBucket, TrieLayoutBucket, TrieSnapshotBucket,
+	StateSizeBucket, ChangeSetBucket, TxChangeSetBucket, LastTouchBucket, ExpiredAccountsBucket, ExpiryRootBucket,
+	ForkBucket, FrequentActorsBucket, CustomBucketVersionBucket, CodeReadBucket, IndexUndoBucket,
+	DatabaseVerisionKey, HeadHeaderKey, HeadBlockKey, HeadFastBlockKey, FastTrieProgressKey,
+	HeaderPrefix, HeaderTDSuffix, HeaderHashSuffix, HeaderNumberPrefix, BlockBodyPrefix, BlockReceiptsPrefix,
+	TxLookupPrefix, BloomBitsPrefix, PreimagePrefix, ConfigPrefix, BloomBitsIndexPrefix,
+	LastPrunedBlockKey, StateCleanShutdownKey, StateChecksumKey, ReplicaProgressKey, HistoryBitmapProgressKey,
+	CodeCacheKeysKey, CodeSizeCacheKeysKey,
+}
+
+var (
+	customBucketsMu sync.RWMutex
+	customBuckets   = make(map[string]CustomBucket)
+)
+
+// RegisterBucket registers the custom bucket of the application. It fails if the name is taken by turbo-geth
+// or by another custom bucket. The buckets are meant to be registered on start, before the database is opened
+func RegisterBucket(b CustomBucket) error {
+	if len(b.Name) == 0 {
+		return errors.New("custom bucket without name")
+	}
+	for _, builtin := range builtinBuckets {
+		if bytes.Equal(b.Name, builtin) {
+			return fmt.Errorf("bucket %q is reserved", b.Name)
+		}
+	}
+	customBucketsMu.Lock()
+	defer customBucketsMu.Unlock()
+	if _, ok := customBuckets[string(b.Name)]; ok {
+		return fmt.Errorf("bucket %q is already registered", b.Name)
+	}
+	b.Name = append([]byte{}, b.Name...)
+	customBuckets[string(b.Name)] = b
+	return nil
+}
+
+// IsCustomBucket tells whether the bucket was registered with RegisterBucket
+func IsCustomBucket(name []byte) bool {
+	customBucketsMu.RLock()
+	defer customBucketsMu.RUnlock()
+	_, ok := customBuckets[string(name)]
+	return ok
+}
+
+// GetCustomBucket returns the registered custom bucket, and false if there is none with the given name
+func GetCustomBucket(name []byte) (CustomBucket, bool) {
+	customBucketsMu.RLock()
+	defer customBucketsMu.RUnlock()
+	b, ok := customBuckets[string(name)]
+	return b, ok
+}
+
+// CustomBuckets returns the registered custom buckets, sorted by their names
+func CustomBuckets() []CustomBucket {
+	customBucketsMu.RLock()
+	defer customBucketsMu.RUnlock()
+	buckets := make([]CustomBucket, 0, len(customBuckets))
+	for _, b := range customBuckets {
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return bytes.Compare(buckets[i].Name, buckets[j].Name) < 0 })
+	return buckets
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// BlockTxExecutor executes the transactions of a block outside of the block processing,
+// implementing state.TxExecutor (see state.TraceTx)
+type BlockTxExecutor struct {
+	config *params.ChainConfig
+	chain  ChainContext
+	block  *types.Block
+	signer types.Signer
+}
+
+// NewBlockTxExecutor creates the executor of the transactions of the block
+func NewBlockTxExecutor(config *params.ChainConfig, chain ChainContext, block *types.Block) *BlockTxExecutor {
+	return &BlockTxExecutor{
+		config: config,
+		chain:  chain,
+		block:  block,
+		signer: types.MakeSigner(config, block.Number()),
+	}
+}
+
+func (e *BlockTxExecutor) TxCount() int {
+	return len(e.block.Transactions())
+}
+
+func (e *BlockTxExecutor) Context() context.Context {
+	return e.config.WithEIPsFlags(context.Background(), e.block.Number())
+}
+
+func (e *BlockTxExecutor) ExecuteTx(ibs *state.IntraBlockState, txIdx int, cfg vm.Config) (*state.TxResult, error) {
+	tx := e.block.Transactions()[txIdx]
+	msg, err := tx.AsMessage(e.signer)
+	if err != nil {
+		return nil, err
+	}
+	ibs.Prepare(tx.Hash(), e.block.Hash(), txIdx)
+	vmenv := vm.NewEVM(NewEVMContext(msg, e.block.Header(), e.chain, nil), ibs, e.config, cfg)
+	ret, gas, failed, err := ApplyMessage(vmenv, msg, new(GasPool).AddGas(msg.Gas()))
+	if err != nil {
+		return nil, fmt.Errorf("transaction %x failed: %v", tx.Hash(), err)
+	}
+	return &state.TxResult{ReturnData: ret, UsedGas: gas, Failed: failed}, nil
+}
@@ -87,6 +87,7 @@ const (
 	maxTimeFutureBlocks = 30
 	badBlockLimit       = 10
 	triesInMemory       = 128
+	exportQueueBlocks   = 1024 // Blocks of the state changes waiting for the export sink, see SetStateExporter
 
 	// BlockChainVersion ensures that an incompatible database forces a resync from scratch.
 	//
@@ -119,6 +120,10 @@ type CacheConfig struct {
 	TrieCleanNoPrefetch bool          // Whether to disable heuristic state prefetching for followup blocks
 	TrieDirtyLimit      int           // Memory limit (MB) at which to start flushing dirty trie nodes to disk
 	TrieTimeLimit       time.Duration // Time limit after which to flush the current in-memory trie to disk
+	TrieCacheGens       uint32        // Number of trie node generations to keep in memory (state.DefaultTrieCacheGen if zero)
+	TrieSnapshotBlocks  uint64        // Blocks between the snapshots of the trie used for fast restart, disabled if zero
+	TrieSnapshotDepth   int           // Depth of the trie snapshots in nibbles (state.DefaultTrieSnapshotDepth if zero)
+	HistoryBatching     bool          // Whether to write the history records of a block in one pass, see state.TrieDbState.SetHistoryBatching
 
 	BlocksBeforePruning uint64
 	BlocksToPrune       uint64
@@ -173,6 +178,20 @@ type BlockChain struct {
 	txLookupCache *lru.Cache // Cache for the most recent transaction lookup data.
 	futureBlocks  *lru.Cache // future blocks are blocks added for later processing
 
+	changeStreamer *state.ChangeStreamer // Receives the changes of the committed blocks for the read replicas
+	stateExporter  state.ExportSink      // Receives the changes of the state made by the blocks, if set
+	tokenLayouts   []state.TokenLayout   // Tokens whose balances are indexed, see state.TokenIndexer
+	prefetchBlocks uint64                // Recent blocks used to predict the touches, see SetTouchPrefetch
+	touchStats     bool                  // Touches of the state trie are counted per contract, see SetTouchStats
+	txChanges      bool                  // Changes made by every transaction are recorded, see SetTxChanges
+	lastTouches    bool                  // Last block touching every account is recorded, see SetLastTouches
+	codeReads      bool                  // Last block reading the code of every contract is recorded, see SetCodeReads
+	bitmapInterval uint64                // Blocks between the merges of the history bitmaps, see SetHistoryBitmaps
+	stateChecksum  bool                  // Checksum of the flat state is maintained, see SetStateChecksum
+	crossValidate  bool                  // Tries of both layouts are updated and compared, see SetCrossValidation
+	frequentActors int                   // Size of the table of the address hashes of frequent actors, see SetFrequentActors
+	commitHooks    []state.CommitHook    // Invoked for every committed block, see OnCommit
+
 	quit    chan struct{} // blockchain quit channel
 	running int32         // running must be called atomically
 	// procInterrupt must be atomically called
@@ -349,6 +368,158 @@ func (bc *BlockChain) EnablePreimages(ep bool) {
 	bc.enablePreimages = ep
 }
 
+// SetStateExporter sets the sink publishing the changes of the accounts, storage and code made by
+// the blocks, for the external data pipelines, and the reverts of the blocks unwound by the reorgs
+// (see state.TrieDbState.SetStateExporter). The changes are published in the background once the blocks
+// are committed, and the failures of the sink are logged without stopping the import. nil disables the export
+func (bc *BlockChain) SetStateExporter(sink state.ExportSink) {
+	if s, ok := bc.stateExporter.(*state.AsyncSink); ok {
+		s.Close()
+	}
+	bc.stateExporter = nil
+	if sink != nil {
+		bc.stateExporter = state.NewAsyncSink(sink, exportQueueBlocks)
+	}
+	if bc.trieDbState != nil {
+		bc.trieDbState.SetStateExporter(bc.stateExporter)
+	}
+}
+
+// EnableTokenIndex turns on the indexing of the balances of the given tokens by holder. The holders
+// are recovered from the SHA3 preimages, so their recording is enabled in the VM as well
+func (bc *BlockChain) EnableTokenIndex(layouts []state.TokenLayout) {
+	bc.tokenLayouts = layouts
+	if len(layouts) > 0 {
+		bc.vmConfig.EnablePreimageRecording = true
+	}
+}
+
+// SetTouchPrefetch makes the state trie resolve the accounts and the storage items changed by the last
+// `blocks` blocks in the background before each block is executed (see state.TrieDbState.PrefetchRecentTouches)
+func (bc *BlockChain) SetTouchPrefetch(blocks uint64) {
+	bc.prefetchBlocks = blocks
+	if bc.trieDbState != nil {
+		bc.trieDbState.SetTouchPrefetch(blocks)
+	}
+}
+
+// SetTouchStats enables counting the touches of the state trie per contract and per origin
+// (see state.TrieDbState.BlockTouchStats)
+func (bc *BlockChain) SetTouchStats(enabled bool) {
+	bc.touchStats = enabled
+	if bc.trieDbState != nil {
+		bc.trieDbState.SetTouchStats(enabled)
+	}
+}
+
+// SetTxChanges enables recording the changes made by every transaction of the committed blocks,
+// which can be queried by state.TxDiff
+func (bc *BlockChain) SetTxChanges(enabled bool) {
+	bc.txChanges = enabled
+	if bc.trieDbState != nil {
+		bc.trieDbState.SetTxChanges(enabled)
+	}
+}
+
+// SetLastTouches enables recording the last block touching every account, the basis of the state expiry
+// experiments (see state.UntouchedAccounts)
+func (bc *BlockChain) SetLastTouches(enabled bool) {
+	bc.lastTouches = enabled
+	if bc.trieDbState != nil {
+		bc.trieDbState.SetLastTouches(enabled)
+	}
+}
+
+// SetCodeReads enables recording the last block reading the code of every contract, which finds the dead code
+// (see state.NeverReadContracts and state.UnreadContracts)
+func (bc *BlockChain) SetCodeReads(enabled bool) {
+	bc.codeReads = enabled
+	if bc.trieDbState != nil {
+		bc.trieDbState.SetCodeReads(enabled)
+	}
+}
+
+// SetStateChecksum enables maintaining the checksum of the flat state (see state.ComputeStateChecksum) at every
+// commit, which is initialised after the first commit of the database, and after the state is unwound
+func (bc *BlockChain) SetStateChecksum(enabled bool) {
+	bc.stateChecksum = enabled
+	if bc.trieDbState != nil {
+		bc.trieDbState.SetStateChecksum(enabled)
+	}
+}
+
+// initStateChecksum computes the checksum of the flat state after the committed block, if it is enabled
+// and there is no valid checksum to maintain
+func (bc *BlockChain) initStateChecksum(blockNr uint64) error {
+	if !bc.stateChecksum {
+		return nil
+	}
+	if checksumBlockNr, _, ok := state.ReadStateChecksum(bc.db); ok && checksumBlockNr == blockNr {
+		return nil
+	}
+	_, err := state.InitStateChecksum(bc.db, blockNr)
+	return err
+}
+
+// SetCrossValidation enables applying the updates of every block to the tries of both layouts (hexary and binary),
+// and alerting when they diverge (see state.TrieDbState.SetCrossValidation)
+func (bc *BlockChain) SetCrossValidation(enabled bool) {
+	bc.crossValidate = enabled
+	if bc.trieDbState != nil {
+		bc.trieDbState.SetCrossValidation(enabled)
+	}
+}
+
+// SetFrequentActors enables the table of the address hashes of the given number of the most frequently touched
+// accounts, which saves hashing their addresses (see state.TrieDbState.SetFrequentActors). Zero disables it
+func (bc *BlockChain) SetFrequentActors(size int) error {
+	bc.frequentActors = size
+	if bc.trieDbState != nil {
+		return bc.trieDbState.SetFrequentActors(size)
+	}
+	return nil
+}
+
+// OnCommit registers the hook adding the writes of an external subsystem to the batch of every committed block
+// (see state.TrieDbState.OnCommit), so that they are committed or rolled back together with the block
+func (bc *BlockChain) OnCommit(hook state.CommitHook) {
+	bc.commitHooks = append(bc.commitHooks, hook)
+	if bc.trieDbState != nil {
+		bc.trieDbState.OnCommit(hook)
+	}
+}
+
+// SetHistoryBitmaps enables merging the change blocks of the history into the roaring bitmaps
+// (see ethdb.MergeHistoryBitmaps) after the commits, once per the given number of blocks. Zero disables it
+func (bc *BlockChain) SetHistoryBitmaps(interval uint64) {
+	bc.bitmapInterval = interval
+}
+
+// mergeHistoryBitmaps merges the committed blocks up to blockNr into the history bitmaps, if enabled and
+// if enough blocks have been committed since the last merge
+func (bc *BlockChain) mergeHistoryBitmaps(blockNr uint64) error {
+	if bc.bitmapInterval == 0 {
+		return nil
+	}
+	progress, err := ethdb.HistoryBitmapProgress(bc.db)
+	if err != nil {
+		return err
+	}
+	if blockNr < progress+bc.bitmapInterval {
+		return nil
+	}
+	return ethdb.MergeHistoryBitmaps(bc.db, blockNr)
+}
+
+// SetChangeStreamer sets the destination of the changes of the state made by the committed blocks,
+// which keeps the read replicas in sync (see state.ReplicaApplier)
+func (bc *BlockChain) SetChangeStreamer(s *state.ChangeStreamer) {
+	bc.changeStreamer = s
+	if bc.trieDbState != nil {
+		bc.trieDbState.SetChangeStreamer(s)
+	}
+}
+
 func (bc *BlockChain) GetTrieDbState() (*state.TrieDbState, error) {
 	if bc.trieDbState == nil {
 		var err error
@@ -374,10 +545,56 @@ func (bc *BlockChain) GetTrieDbStateByBlock(root common.Hash, blockNr uint64) (*
 		tds.SetNoHistory(bc.NoHistory())
 		tds.SetResolveReads(bc.resolveReads)
 		tds.EnablePreimages(bc.enablePreimages)
-		if err := tds.Rebuild(); err != nil {
-			log.Error("Rebuiling aborted", "error", err)
+		tds.SetChangeStreamer(bc.changeStreamer)
+		tds.SetHistoryBatching(bc.cacheConfig.HistoryBatching)
+		tds.SetBinaryTrieBlock(bc.chainConfig.BinaryTrieBlock)
+		tds.SetTouchPrefetch(bc.prefetchBlocks)
+		tds.SetTouchStats(bc.touchStats)
+		tds.SetTxChanges(bc.txChanges)
+		tds.SetLastTouches(bc.lastTouches)
+		tds.SetCodeReads(bc.codeReads)
+		tds.SetStateChecksum(bc.stateChecksum)
+		tds.SetCrossValidation(bc.crossValidate)
+		tds.SetStateExporter(bc.stateExporter)
+		tds.SetCommitter(func() error {
+			_, err := bc.commitDb()
+			return err
+		})
+		for _, hook := range bc.commitHooks {
+			tds.OnCommit(hook)
+		}
+		// Bookkeeping of the block, written into its batch after the state
+		for _, write := range []func(*state.DbStateWriter) error{
+			(*state.DbStateWriter).WriteRootIndex,
+			(*state.DbStateWriter).WriteTxChanges,
+			(*state.DbStateWriter).WriteLastTouches,
+			(*state.DbStateWriter).WriteCodeReads,
+			(*state.DbStateWriter).WriteStateChecksum,
+			(*state.DbStateWriter).WriteFrequentActors,
+			(*state.DbStateWriter).WriteTrieSnapshot,
+		} {
+			tds.OnCommit(tds.WriterHook(write))
+		}
+		if err := tds.SetFrequentActors(bc.frequentActors); err != nil {
+			log.Error("Loading frequent actors aborted", "error", err)
 			return nil, err
 		}
+		if bc.cacheConfig.TrieCacheGens > 0 {
+			tds.SetCacheGenLimit(bc.cacheConfig.TrieCacheGens)
+		}
+		tds.SetTrieSnapshots(bc.cacheConfig.TrieSnapshotBlocks, bc.cacheConfig.TrieSnapshotDepth)
+		loaded, err := tds.LoadTrieSnapshot()
+		if err != nil {
+			log.Error("Loading trie snapshot aborted", "error", err)
+			return nil, err
+		}
+		if !loaded {
+			if err := tds.Rebuild(); err != nil {
+				log.Error("Rebuiling aborted", "error", err)
+				return nil, err
+			}
+		}
+		tds.WarmCodeCaches()
 		log.Info("Creation complete.")
 		return tds, nil
 	}
@@ -910,6 +1127,16 @@ func (bc *BlockChain) Stop() {
 	if bc.pruner != nil {
 		bc.pruner.Stop()
 	}
+	if bc.trieDbState != nil {
+		// Persists the keys of the code caches and the snapshot of the trie for the next start, and commits
+		// them through commitDb. The exporter is closed afterwards, so that it receives the changes of the commit
+		if err := bc.trieDbState.Close(context.Background()); err != nil {
+			log.Warn("Failed to close the state", "err", err)
+		}
+	}
+	if s, ok := bc.stateExporter.(*state.AsyncSink); ok {
+		s.Close()
+	}
 	log.Info("Blockchain manager stopped")
 }
 
@@ -1269,11 +1496,31 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 
 	if tds != nil {
 		tds.SetBlockNr(block.NumberU64())
+		tds.SetBlockHashes(block.Hash(), block.ParentHash())
 	}
 
 	ctx := bc.WithContext(context.Background(), block.Number())
 	if stateDb != nil {
-		if err := stateDb.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		var stateWriter state.StateWriter = tds.DbStateWriter()
+		if bc.stateExporter != nil || len(bc.tokenLayouts) > 0 {
+			writers := []state.StateWriter{stateWriter}
+			if bc.stateExporter != nil {
+				writers = append(writers, tds.ExportWriter())
+			}
+			if len(bc.tokenLayouts) > 0 {
+				// Taken before CommitBlock, which holds the lock of the IntraBlockState
+				preimages := stateDb.Preimages()
+				writers = append(writers, state.NewTokenIndexer(bc.db, bc.tokenLayouts, func(hash common.Hash) []byte {
+					if p, ok := preimages[hash]; ok {
+						return p
+					}
+					return rawdb.ReadPreimage(bc.db, hash)
+				}, block.NumberU64()))
+			}
+			stateWriter = state.NewTeeWriter(writers...)
+		}
+		// The bookkeeping of the block is written by the commit hooks, see GetTrieDbStateByBlock
+		if err := tds.CommitBlock(ctx, stateDb, stateWriter); err != nil {
 			return NonStatTy, err
 		}
 	}
@@ -1594,7 +1841,7 @@ func (bc *BlockChain) insertChain(ctx context.Context, chain types.Blocks, verif
 
 		if parent != nil && root != parentRoot && !bc.cacheConfig.DownloadOnly {
 			log.Info("Rewinding from", "block", bc.CurrentBlock().NumberU64(), "to block", readBlockNr)
-			if _, err = bc.db.Commit(); err != nil {
+			if _, err = bc.commitDb(); err != nil {
 				log.Error("Could not commit chainDb before rewinding", "error", err)
 				bc.db.Rollback()
 				bc.trieDbState = nil
@@ -1622,7 +1869,7 @@ func (bc *BlockChain) insertChain(ctx context.Context, chain types.Blocks, verif
 				return 0, err
 			}
 
-			if _, err = bc.db.Commit(); err != nil {
+			if _, err = bc.commitDb(); err != nil {
 				log.Error("Could not commit chainDb after rewinding", "error", err)
 				bc.db.Rollback()
 				bc.trieDbState = nil
@@ -1634,6 +1881,15 @@ func (bc *BlockChain) insertChain(ctx context.Context, chain types.Blocks, verif
 		var usedGas uint64
 		var logs []*types.Log
 		if !bc.cacheConfig.DownloadOnly {
+			if err = bc.trieDbState.ApplyTrieLayout(block.NumberU64()); err != nil {
+				bc.db.Rollback()
+				log.Error("Could not switch the trie layout", "block", block.NumberU64(), "error", err)
+				bc.trieDbState = nil
+				return k, err
+			}
+			if err = bc.trieDbState.PrefetchRecentTouches(); err != nil {
+				log.Warn("Could not prefetch the recent touches", "block", block.NumberU64(), "error", err)
+			}
 			stateDB = state.New(bc.trieDbState)
 			// Process block using the parent state as reference point.
 			//t0 := time.Now()
@@ -1727,12 +1983,18 @@ func (bc *BlockChain) insertChain(ctx context.Context, chain types.Blocks, verif
 		stats.report(chain, i, bc.db)
 		if stats.needToCommit(chain, bc.db, i) {
 			var written uint64
-			if written, err = bc.db.Commit(); err != nil {
+			if written, err = bc.commitDb(); err != nil {
 				log.Error("Could not commit chainDb", "error", err)
 				bc.db.Rollback()
 				bc.trieDbState = nil
 				return 0, err
 			}
+			if err = bc.mergeHistoryBitmaps(block.NumberU64()); err != nil {
+				log.Warn("Could not merge the history bitmaps", "error", err)
+			}
+			if err = bc.initStateChecksum(block.NumberU64()); err != nil {
+				log.Warn("Could not compute the checksum of the state", "error", err)
+			}
 			if bc.trieDbState != nil {
 				bc.trieDbState.PruneTries(false)
 			}
@@ -1743,6 +2005,22 @@ func (bc *BlockChain) insertChain(ctx context.Context, chain types.Blocks, verif
 	return 0, nil
 }
 
+// commitDb commits the pending writes of the chain database, and then streams the changes of the state
+// committed by them to the read replicas (see SetChangeStreamer) and to the state exporter (see SetStateExporter),
+// the reverts of the unwound blocks included
+func (bc *BlockChain) commitDb() (uint64, error) {
+	written, err := bc.db.Commit()
+	if err != nil {
+		return 0, err
+	}
+	if bc.trieDbState != nil {
+		if err := bc.trieDbState.EmitChanges(); err != nil {
+			log.Warn("Could not stream the changes to the replicas", "error", err)
+		}
+	}
+	return written, nil
+}
+
 // statsReportLimit is the time limit during import and export after which we
 // always print out progress. This avoids the user wondering what's going on.
 const statsReportLimit = 8 * time.Second
@@ -1951,7 +2229,7 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 		rawdb.DeleteCanonicalHash(bc.db, i)
 	}
 
-	if _, err := bc.db.Commit(); err != nil {
+	if _, err := bc.commitDb(); err != nil {
 		return err
 	}
 	// If any logs need to be fired, do it now. In theory we could avoid creating
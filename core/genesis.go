@@ -272,7 +272,11 @@ func (g *Genesis) ToBlock(db ethdb.Database) (*types.Block, *state.IntraBlockSta
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	root := roots[len(roots)-1]
+	return types.NewBlock(g.header(roots[len(roots)-1]), nil, nil, nil), statedb, tds, nil
+}
+
+// header returns the header of the genesis block with the given state root
+func (g *Genesis) header(root common.Hash) *types.Header {
 	head := &types.Header{
 		Number:     new(big.Int).SetUint64(g.Number),
 		Nonce:      types.EncodeNonce(g.Nonce),
@@ -292,8 +296,7 @@ func (g *Genesis) ToBlock(db ethdb.Database) (*types.Block, *state.IntraBlockSta
 	if g.Difficulty == nil {
 		head.Difficulty = params.GenesisDifficulty
 	}
-
-	return types.NewBlock(head, nil, nil, nil), statedb, tds, nil
+	return head
 }
 
 // Commit writes the block and state of a genesis specification to the database.
@@ -323,6 +326,44 @@ func (g *Genesis) Commit(db ethdb.Database) (*types.Block, *state.IntraBlockStat
 		return nil, nil, err
 	}
 	//fmt.Printf("Generated genesis\n")
+	g.writeBlock(db, block, config)
+	return block, statedb, nil
+}
+
+// CommitStreaming is the same as Commit, but the state is written straight into the flat buckets, and
+// the state root is computed without constructing the trie (see state.WriteGenesisState). With binary set,
+// the root is the one of the binary trie, so that the network can be launched on the binary trie layout
+func (g *Genesis) CommitStreaming(db ethdb.Database, binary bool) (*types.Block, error) {
+	if g.Number != 0 {
+		return nil, fmt.Errorf("can't commit genesis block with number > 0")
+	}
+	config := g.Config
+	if config == nil {
+		config = params.AllEthashProtocolChanges
+	}
+	if err := config.CheckConfigForkOrder(); err != nil {
+		return nil, err
+	}
+	alloc := make(map[common.Address]state.GenesisAccount, len(g.Alloc))
+	for addr, account := range g.Alloc {
+		alloc[addr] = state.GenesisAccount{Code: account.Code, Storage: account.Storage, Balance: account.Balance, Nonce: account.Nonce}
+	}
+	batch := db.NewBatch()
+	root, err := state.WriteGenesisState(batch, alloc, binary)
+	if err != nil {
+		batch.Rollback()
+		return nil, fmt.Errorf("cannot write state: %v", err)
+	}
+	if _, err := batch.Commit(); err != nil {
+		return nil, err
+	}
+	block := types.NewBlock(g.header(root), nil, nil, nil)
+	g.writeBlock(db, block, config)
+	return block, nil
+}
+
+// writeBlock writes the genesis block as the canonical head block, with the chain configuration
+func (g *Genesis) writeBlock(db ethdb.Database, block *types.Block, config *params.ChainConfig) {
 	rawdb.WriteTd(db, block.Hash(), block.NumberU64(), g.Difficulty)
 	rawdb.WriteBlock(db, block)
 	rawdb.WriteReceipts(db, block.Hash(), block.NumberU64(), nil)
@@ -331,7 +372,6 @@ func (g *Genesis) Commit(db ethdb.Database) (*types.Block, *state.IntraBlockStat
 	rawdb.WriteHeadFastBlockHash(db, block.Hash())
 	rawdb.WriteHeadHeaderHash(db, block.Hash())
 	rawdb.WriteChainConfig(db, block.Hash(), config)
-	return block, statedb, nil
 }
 
 // MustCommit writes the genesis block and state to db, panicking on error.
@@ -165,3 +165,43 @@ func TestSetupGenesis(t *testing.T) {
 		}
 	}
 }
+
+func TestCommitStreaming(t *testing.T) {
+	// Mainnet genesis has many accounts and no storage, the custom one has contracts
+	custom := &Genesis{
+		Config: params.TestChainConfig,
+		Alloc: GenesisAlloc{
+			common.HexToAddress("0x1"): {Balance: big.NewInt(1)},
+			common.HexToAddress("0x2"): {
+				Balance: big.NewInt(2),
+				Code:    []byte{0x60, 0x00},
+				Storage: map[common.Hash]common.Hash{{1}: {2}, {3}: {31: 4}},
+			},
+		},
+	}
+	for _, g := range []*Genesis{DefaultGenesisBlock(), custom} {
+		expected, _, _, err := g.ToBlock(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := ethdb.NewMemDatabase()
+		block, err := g.CommitStreaming(db, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Hash() != expected.Hash() {
+			t.Errorf("expected genesis hash %x, got %x", expected.Hash(), block.Hash())
+		}
+		if stored := rawdb.ReadCanonicalHash(db, 0); stored != block.Hash() {
+			t.Errorf("expected canonical hash %x, got %x", block.Hash(), stored)
+		}
+
+		binBlock, err := g.CommitStreaming(ethdb.NewMemDatabase(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binBlock.Root() == block.Root() {
+			t.Errorf("expected different binary and hexary roots")
+		}
+	}
+}
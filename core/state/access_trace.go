@@ -0,0 +1,325 @@
+package state
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+// AccessKind is the kind of the state access recorded by RecordingReader
+type AccessKind byte
+
+const (
+	AccessAccount AccessKind = iota
+	AccessStorage
+	AccessCode
+	AccessCodeSize
+	// AccessBlock marks the start of a block, see RecordingReader.StartBlock
+	AccessBlock
+	numAccessKinds
+)
+
+var accessKindNames = [numAccessKinds]string{"account", "storage", "code", "codeSize", "block"}
+
+func (k AccessKind) String() string {
+	if k < numAccessKinds {
+		return accessKindNames[k]
+	}
+	return fmt.Sprintf("AccessKind(%d)", byte(k))
+}
+
+// Access is one entry of the access trace. Only the fields relevant to the kind are set
+type Access struct {
+	Kind        AccessKind
+	Address     common.Address
+	Incarnation uint64
+	Key         common.Hash
+	CodeHash    common.Hash
+	BlockNr     uint64
+}
+
+// RecordingReader passes the reads to the underlying StateReader and records them,
+// so that they can be replayed later by ReplayAccessTrace
+type RecordingReader struct {
+	r     StateReader
+	mu    sync.Mutex
+	trace []Access
+}
+
+func NewRecordingReader(r StateReader) *RecordingReader {
+	return &RecordingReader{r: r}
+}
+
+func (rr *RecordingReader) record(a Access) {
+	rr.mu.Lock()
+	rr.trace = append(rr.trace, a)
+	rr.mu.Unlock()
+}
+
+// StartBlock records the boundary of the block, at which the replay resolves and prunes the trie
+func (rr *RecordingReader) StartBlock(blockNr uint64) {
+	rr.record(Access{Kind: AccessBlock, BlockNr: blockNr})
+}
+
+func (rr *RecordingReader) ReadAccountData(address common.Address) (*accounts.Account, error) {
+	rr.record(Access{Kind: AccessAccount, Address: address})
+	return rr.r.ReadAccountData(address)
+}
+
+func (rr *RecordingReader) ReadAccountStorage(address common.Address, incarnation uint64, key *common.Hash) ([]byte, error) {
+	rr.record(Access{Kind: AccessStorage, Address: address, Incarnation: incarnation, Key: *key})
+	return rr.r.ReadAccountStorage(address, incarnation, key)
+}
+
+func (rr *RecordingReader) ReadAccountCode(address common.Address, codeHash common.Hash) ([]byte, error) {
+	rr.record(Access{Kind: AccessCode, Address: address, CodeHash: codeHash})
+	return rr.r.ReadAccountCode(address, codeHash)
+}
+
+func (rr *RecordingReader) ReadAccountCodeSize(address common.Address, codeHash common.Hash) (int, error) {
+	rr.record(Access{Kind: AccessCodeSize, Address: address, CodeHash: codeHash})
+	return rr.r.ReadAccountCodeSize(address, codeHash)
+}
+
+// Trace returns the accesses recorded so far, in the order they happened
+func (rr *RecordingReader) Trace() []Access {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return append([]Access(nil), rr.trace...)
+}
+
+// Version of the encoding of the access traces
+const accessTraceVersion byte = 1
+
+// WriteAccessTrace writes the trace in the format read by ReadAccessTrace
+func WriteAccessTrace(w io.Writer, trace []Access) error {
+	bw := bufio.NewWriter(w)
+	if err := bw.WriteByte(accessTraceVersion); err != nil {
+		return err
+	}
+	var num [binary.MaxVarintLen64]byte
+	for _, a := range trace {
+		if err := bw.WriteByte(byte(a.Kind)); err != nil {
+			return err
+		}
+		var err error
+		switch a.Kind {
+		case AccessAccount:
+			_, err = bw.Write(a.Address[:])
+		case AccessStorage:
+			if _, err = bw.Write(a.Address[:]); err != nil {
+				return err
+			}
+			if _, err = bw.Write(num[:binary.PutUvarint(num[:], a.Incarnation)]); err != nil {
+				return err
+			}
+			_, err = bw.Write(a.Key[:])
+		case AccessCode, AccessCodeSize:
+			if _, err = bw.Write(a.Address[:]); err != nil {
+				return err
+			}
+			_, err = bw.Write(a.CodeHash[:])
+		case AccessBlock:
+			_, err = bw.Write(num[:binary.PutUvarint(num[:], a.BlockNr)])
+		default:
+			err = fmt.Errorf("unknown access kind %d", a.Kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadAccessTrace reads the trace written by WriteAccessTrace
+func ReadAccessTrace(r io.Reader) ([]Access, error) {
+	br := bufio.NewReader(r)
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != accessTraceVersion {
+		return nil, fmt.Errorf("unsupported access trace version %d", version)
+	}
+	var trace []Access
+	for {
+		kind, err := br.ReadByte()
+		if err == io.EOF {
+			return trace, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		a := Access{Kind: AccessKind(kind)}
+		switch a.Kind {
+		case AccessAccount:
+			_, err = io.ReadFull(br, a.Address[:])
+		case AccessStorage:
+			if _, err = io.ReadFull(br, a.Address[:]); err != nil {
+				break
+			}
+			if a.Incarnation, err = binary.ReadUvarint(br); err != nil {
+				break
+			}
+			_, err = io.ReadFull(br, a.Key[:])
+		case AccessCode, AccessCodeSize:
+			if _, err = io.ReadFull(br, a.Address[:]); err != nil {
+				break
+			}
+			_, err = io.ReadFull(br, a.CodeHash[:])
+		case AccessBlock:
+			a.BlockNr, err = binary.ReadUvarint(br)
+		default:
+			err = fmt.Errorf("unknown access kind %d", kind)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("access %d: %w", len(trace), err)
+		}
+		trace = append(trace, a)
+	}
+}
+
+// LatencyDistribution collects the latencies of the replayed operations
+type LatencyDistribution struct {
+	durations []time.Duration
+	sorted    bool
+	total     time.Duration
+}
+
+func (d *LatencyDistribution) add(t time.Duration) {
+	d.durations = append(d.durations, t)
+	d.sorted = false
+	d.total += t
+}
+
+func (d *LatencyDistribution) Count() int {
+	return len(d.durations)
+}
+
+func (d *LatencyDistribution) Total() time.Duration {
+	return d.total
+}
+
+func (d *LatencyDistribution) Mean() time.Duration {
+	if len(d.durations) == 0 {
+		return 0
+	}
+	return d.total / time.Duration(len(d.durations))
+}
+
+// Percentile returns the latency below which the fraction p (0..1) of the operations fall
+func (d *LatencyDistribution) Percentile(p float64) time.Duration {
+	if len(d.durations) == 0 {
+		return 0
+	}
+	if !d.sorted {
+		sort.Slice(d.durations, func(i, j int) bool { return d.durations[i] < d.durations[j] })
+		d.sorted = true
+	}
+	i := int(p * float64(len(d.durations)))
+	if i >= len(d.durations) {
+		i = len(d.durations) - 1
+	}
+	return d.durations[i]
+}
+
+// ReplayReport is the result of ReplayAccessTrace
+type ReplayReport struct {
+	// Latencies of the reads, by kind
+	Reads [AccessBlock]LatencyDistribution
+	// Latencies of the work done at the block boundaries (resolution and pruning of the trie of TrieDbState)
+	Blocks LatencyDistribution
+}
+
+// Print writes the summary of the report, one line per kind of access
+func (rep *ReplayReport) Print(w io.Writer) {
+	line := func(name string, d *LatencyDistribution) {
+		if d.Count() == 0 {
+			return
+		}
+		fmt.Fprintf(w, "%-9s count=%d total=%v mean=%v p50=%v p90=%v p99=%v max=%v\n", name, d.Count(), d.Total(), d.Mean(),
+			d.Percentile(0.5), d.Percentile(0.9), d.Percentile(0.99), d.Percentile(1))
+	}
+	for kind := range rep.Reads {
+		line(AccessKind(kind).String(), &rep.Reads[kind])
+	}
+	line(AccessBlock.String(), &rep.Blocks)
+}
+
+// ReplayAccessTrace performs the reads of the trace against the reader and measures their latencies.
+// If the reader is a TrieDbState, the reads of each block are resolved into its trie at the end of the
+// block, and the trie is pruned afterwards, so that the caching and the pruning settings of the TrieDbState
+// (e.g. SetResolveReads, SetCacheGenLimit) are in effect, as they would be when processing the blocks
+func ReplayAccessTrace(ctx context.Context, r StateReader, trace []Access) (*ReplayReport, error) {
+	rep := &ReplayReport{}
+	tds, _ := r.(*TrieDbState)
+	inBlock := false
+	endBlock := func() error {
+		if tds == nil || !inBlock {
+			return nil
+		}
+		start := time.Now()
+		if _, err := tds.ResolveStateTrie(false); err != nil {
+			return err
+		}
+		tds.clearUpdates()
+		tds.PruneTries(false)
+		rep.Blocks.add(time.Since(start))
+		return nil
+	}
+	if tds != nil && (len(trace) == 0 || trace[0].Kind != AccessBlock) {
+		// Reads recorded before the first block boundary
+		tds.StartNewBuffer()
+		inBlock = true
+	}
+	for i := range trace {
+		a := &trace[i]
+		if a.Kind == AccessBlock {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := endBlock(); err != nil {
+				return nil, err
+			}
+			if tds != nil {
+				tds.SetBlockNr(a.BlockNr)
+				tds.StartNewBuffer()
+				inBlock = true
+			}
+			continue
+		}
+		var err error
+		start := time.Now()
+		switch a.Kind {
+		case AccessAccount:
+			_, err = r.ReadAccountData(a.Address)
+		case AccessStorage:
+			_, err = r.ReadAccountStorage(a.Address, a.Incarnation, &a.Key)
+		case AccessCode:
+			_, err = r.ReadAccountCode(a.Address, a.CodeHash)
+		case AccessCodeSize:
+			_, err = r.ReadAccountCodeSize(a.Address, a.CodeHash)
+		default:
+			err = fmt.Errorf("unknown access kind %d", a.Kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("replaying access %d (%s): %w", i, a.Kind, err)
+		}
+		rep.Reads[a.Kind].add(time.Since(start))
+	}
+	if err := endBlock(); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
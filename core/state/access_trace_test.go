@@ -0,0 +1,94 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestAccessTraceReplay(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	ctx := context.Background()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := common.HexToAddress("0xc")
+	ibs := New(tds)
+	tds.StartNewBuffer()
+	for i := 0; i < 10; i++ {
+		ibs.AddBalance(common.BytesToAddress([]byte{byte(i + 1)}), big.NewInt(int64(i+1)))
+	}
+	ibs.CreateAccount(contract, true)
+	ibs.SetCode(contract, []byte{0x60, 0x00})
+	ibs.SetState(contract, common.Hash{1}, common.Hash{31: 1})
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = tds.CommitBlock(ctx, ibs, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := NewRecordingReader(tds)
+	for blockNr := uint64(2); blockNr <= 3; blockNr++ {
+		rr.StartBlock(blockNr)
+		ibs = New(rr)
+		for i := 0; i < 10; i++ {
+			ibs.GetBalance(common.BytesToAddress([]byte{byte(i + 1)}))
+		}
+		ibs.GetCode(contract)
+		ibs.GetState(contract, common.Hash{1})
+	}
+	var buf bytes.Buffer
+	if err = WriteAccessTrace(&buf, rr.Trace()); err != nil {
+		t.Fatal(err)
+	}
+	trace, err := ReadAccessTrace(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace) != len(rr.Trace()) || trace[0].Kind != AccessBlock || trace[0].BlockNr != 2 {
+		t.Fatalf("unexpected trace read back: %d accesses, first %+v", len(trace), trace[0])
+	}
+	if _, err = ReadAccessTrace(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Errorf("expected the truncated trace to be rejected")
+	}
+
+	replayed, err := NewTrieDbState(tds.LastRoot(), db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed.SetResolveReads(true)
+	rep, err := ReplayAccessTrace(ctx, replayed, trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := rep.Reads[AccessAccount].Count(); n != 22 {
+		t.Errorf("expected 22 account reads, got %d", n)
+	}
+	if rep.Reads[AccessStorage].Count() != 2 || rep.Reads[AccessCode].Count() != 2 {
+		t.Errorf("expected 2 storage and 2 code reads, got %d and %d", rep.Reads[AccessStorage].Count(), rep.Reads[AccessCode].Count())
+	}
+	if rep.Blocks.Count() != 2 {
+		t.Errorf("expected 2 blocks, got %d", rep.Blocks.Count())
+	}
+	if replayed.GetBlockNr() != 3 {
+		t.Errorf("expected the replay to advance to block 3, got %d", replayed.GetBlockNr())
+	}
+	if _, ok := replayed.GetAccount(common.BytesToHash(crypto.Keccak256(contract[:]))); !ok {
+		t.Errorf("expected the contract account to be resolved into the trie")
+	}
+	d := &rep.Reads[AccessAccount]
+	if d.Percentile(0.5) > d.Percentile(1) || d.Percentile(1) == 0 {
+		t.Errorf("unexpected latency distribution: p50 %v, max %v", d.Percentile(0.5), d.Percentile(1))
+	}
+}
@@ -0,0 +1,71 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// AddressLocker serializes the execution of transactions touching the same addresses, while letting
+// the transactions with disjoint sets of addresses run concurrently (for example, against the copies
+// of TrieDbState when the miner or the transaction pool simulate candidate transactions).
+// All addresses of a set are acquired atomically, so there is no lock ordering to care about and
+// no possibility of deadlock between the sets.
+type AddressLocker struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	locked map[common.Address]struct{}
+}
+
+func NewAddressLocker() *AddressLocker {
+	l := &AddressLocker{locked: make(map[common.Address]struct{})}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *AddressLocker) available(addrs []common.Address) bool {
+	for _, addr := range addrs {
+		if _, ok := l.locked[addr]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *AddressLocker) acquire(addrs []common.Address) {
+	for _, addr := range addrs {
+		l.locked[addr] = struct{}{}
+	}
+}
+
+// Lock blocks until none of the addresses are locked by others, and then locks all of them.
+// Duplicates in addrs are allowed
+func (l *AddressLocker) Lock(addrs ...common.Address) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for !l.available(addrs) {
+		l.cond.Wait()
+	}
+	l.acquire(addrs)
+}
+
+// TryLock locks all the addresses if none of them is locked, otherwise returns false without blocking
+func (l *AddressLocker) TryLock(addrs ...common.Address) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.available(addrs) {
+		return false
+	}
+	l.acquire(addrs)
+	return true
+}
+
+// Unlock releases the addresses previously locked by Lock or TryLock
+func (l *AddressLocker) Unlock(addrs ...common.Address) {
+	l.mu.Lock()
+	for _, addr := range addrs {
+		delete(l.locked, addr)
+	}
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
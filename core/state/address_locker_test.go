@@ -0,0 +1,46 @@
+package state
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+func TestAddressLocker(t *testing.T) {
+	l := NewAddressLocker()
+	a := common.HexToAddress("0x1")
+	b := common.HexToAddress("0x2")
+	c := common.HexToAddress("0x3")
+
+	l.Lock(a, b)
+	if l.TryLock(b, c) {
+		t.Fatal("expected overlapping set to be locked")
+	}
+	if !l.TryLock(c) {
+		t.Fatal("expected disjoint set to be available")
+	}
+	l.Unlock(c)
+
+	// Conflicting transactions are serialized
+	var counter int
+	var wg sync.WaitGroup
+	l.Unlock(a, b)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addrs := []common.Address{a, c}
+			if i%2 == 0 {
+				addrs = []common.Address{b, a}
+			}
+			l.Lock(addrs...)
+			counter++
+			l.Unlock(addrs...)
+		}(i)
+	}
+	wg.Wait()
+	if counter != 50 {
+		t.Errorf("expected 50 increments, got %d", counter)
+	}
+}
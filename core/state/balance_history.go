@@ -0,0 +1,149 @@
+package state
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// BalancePoint is the balance of the account after the block, see BalanceHistory
+type BalancePoint struct {
+	BlockNr uint64
+	Balance *big.Int // Zero when the account does not exist
+}
+
+// BalanceHistory returns the balances of the account after the blocks fromBlock, fromBlock+step, ... up to toBlock,
+// which is not to be after the last committed block. Rather than looking up every block with GetAsOf, it seeks
+// the next block changing the account in the history bitmap of the account (up to the last merged block, see
+// ethdb.MergeHistoryBitmaps) or in its history, and reads the value of the account once per such change,
+// so the sampled blocks between the changes cost one seek each
+func BalanceHistory(db ethdb.Getter, address common.Address, fromBlock, toBlock, step uint64) ([]BalancePoint, error) {
+	if step == 0 {
+		return nil, errors.New("balance history: zero step")
+	}
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return nil, err
+	}
+	f, err := newAccountChangeFinder(db, addrHash)
+	if err != nil {
+		return nil, err
+	}
+	var points []BalancePoint
+	var lastChange uint64
+	var lastBalance *big.Int
+	for blockNr := fromBlock; blockNr <= toBlock; blockNr += step {
+		// Value after the block is the one before the next change, or the current one if there is none
+		change, ok, err := f.next(blockNr)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			change = 0
+		}
+		if lastBalance == nil || change != lastChange {
+			var enc []byte
+			if ok {
+				enc, err = f.valueBefore(change)
+			} else {
+				enc, err = db.Get(dbutils.AccountsBucket, addrHash[:])
+			}
+			if err != nil && err != ethdb.ErrKeyNotFound {
+				return nil, err
+			}
+			if lastBalance, err = decodeBalance(enc); err != nil {
+				return nil, err
+			}
+			lastChange = change
+		}
+		points = append(points, BalancePoint{BlockNr: blockNr, Balance: new(big.Int).Set(lastBalance)})
+		if blockNr+step < blockNr {
+			break
+		}
+	}
+	return points, nil
+}
+
+func decodeBalance(enc []byte) (*big.Int, error) {
+	if len(enc) == 0 {
+		return new(big.Int), nil
+	}
+	var acc accounts.Account
+	if err := acc.DecodeForStorage(enc); err != nil {
+		return nil, err
+	}
+	return &acc.Balance, nil
+}
+
+// accountChangeFinder finds the blocks changing the account, and the values of the account before them
+type accountChangeFinder struct {
+	db       ethdb.Getter
+	addrHash common.Hash
+	progress uint64               // Last block merged into the history bitmaps
+	bitmap   *ethdb.RoaringBitmap // Blocks changing the account up to progress
+	index    ethdb.HistoryIndex   // Only in the thin history, blocks changing the account
+}
+
+func newAccountChangeFinder(db ethdb.Getter, addrHash common.Hash) (*accountChangeFinder, error) {
+	f := &accountChangeFinder{db: db, addrHash: addrHash}
+	var err error
+	if f.progress, err = ethdb.HistoryBitmapProgress(db); err != nil {
+		return nil, err
+	}
+	if f.progress > 0 {
+		if f.bitmap, err = ethdb.ReadHistoryBitmap(db, dbutils.AccountsHistoryBucket, addrHash[:]); err != nil {
+			return nil, err
+		}
+	}
+	if debug.IsThinHistory() {
+		v, err := db.Get(dbutils.AccountsHistoryBucket, addrHash[:])
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return nil, err
+		}
+		if err = f.index.Decode(v); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// next returns the first block changing the account after the given block, and false if there is none
+func (f *accountChangeFinder) next(blockNr uint64) (uint64, bool, error) {
+	if f.bitmap != nil && blockNr < f.progress {
+		if change, ok := f.bitmap.Seek(blockNr + 1); ok && change <= f.progress {
+			return change, true, nil
+		}
+		blockNr = f.progress
+	}
+	if debug.IsThinHistory() {
+		change, ok := f.index.Search(blockNr + 1)
+		return change, ok, nil
+	}
+	var change uint64
+	var found bool
+	start, _ := dbutils.CompositeKeySuffix(f.addrHash[:], blockNr+1)
+	err := f.db.Walk(dbutils.AccountsHistoryBucket, start, 8*common.HashLength, func(k, _ []byte) (bool, error) {
+		change, _ = dbutils.DecodeTimestamp(k[common.HashLength:])
+		found = true
+		return false, nil
+	})
+	return change, found, err
+}
+
+// valueBefore returns the account encoded for storage before it was changed by the block, empty if it did not exist
+func (f *accountChangeFinder) valueBefore(change uint64) ([]byte, error) {
+	if debug.IsThinHistory() {
+		cs, err := f.db.Get(dbutils.ChangeSetBucket, dbutils.CompositeChangeSetKey(dbutils.EncodeTimestamp(change), dbutils.AccountsHistoryBucket))
+		if err != nil {
+			return nil, err
+		}
+		return dbutils.FindLast(cs, f.addrHash[:])
+	}
+	composite, _ := dbutils.CompositeKeySuffix(f.addrHash[:], change)
+	return f.db.Get(dbutils.AccountsHistoryBucket, composite)
+}
@@ -0,0 +1,82 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestBalanceHistory(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, other := common.HexToAddress("0xa"), common.HexToAddress("0xb")
+	// Balance of the account is changed in the blocks 2, 3, 5 and 8 out of 1..9
+	changes := map[uint64]int64{2: 10, 3: 5, 5: 20, 8: 1}
+	for blockNr := uint64(1); blockNr <= 9; blockNr++ {
+		amount, changed := changes[blockNr]
+		commitTestBlock(t, tds, blockNr, func(ibs *IntraBlockState) {
+			ibs.AddBalance(other, big.NewInt(1))
+			if changed {
+				ibs.AddBalance(a, big.NewInt(amount))
+			}
+		})
+	}
+
+	// Expected balances after every block, as given by GetAsOf
+	addrHash := crypto.Keccak256Hash(a[:])
+	expected := make(map[uint64]*big.Int)
+	for blockNr := uint64(0); blockNr <= 9; blockNr++ {
+		enc, err := db.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, addrHash[:], blockNr+1)
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			t.Fatal(err)
+		}
+		if expected[blockNr], err = decodeBalance(enc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected[4].Int64() != 15 || expected[9].Int64() != 36 {
+		t.Fatalf("unexpected balances from GetAsOf: %v %v", expected[4], expected[9])
+	}
+
+	check := func(fromBlock, toBlock, step uint64) {
+		points, err := BalanceHistory(db, a, fromBlock, toBlock, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockNr := fromBlock
+		for _, p := range points {
+			if p.BlockNr != blockNr {
+				t.Fatalf("expected the point of block %d, got %d", blockNr, p.BlockNr)
+			}
+			if p.Balance.Cmp(expected[blockNr]) != 0 {
+				t.Errorf("block %d: expected balance %d, got %d", blockNr, expected[blockNr], p.Balance)
+			}
+			blockNr += step
+		}
+		if blockNr <= toBlock {
+			t.Errorf("points from %d to %d by %d end before block %d", fromBlock, toBlock, step, blockNr)
+		}
+	}
+	check(0, 9, 1)
+	check(1, 9, 3)
+	check(4, 4, 1)
+	check(6, 7, 5)
+
+	// Same with the changes up to block 6 looked up in the history bitmaps
+	if err = ethdb.MergeHistoryBitmaps(db, 6); err != nil {
+		t.Fatal(err)
+	}
+	check(0, 9, 1)
+	check(2, 8, 2)
+
+	if _, err = BalanceHistory(db, a, 0, 9, 0); err == nil {
+		t.Errorf("expected zero step to fail")
+	}
+}
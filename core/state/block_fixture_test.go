@@ -0,0 +1,30 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// commitTestBlock executes the changes as the block blockNr on top of the state and commits the block. It returns
+// the root of the state trie after the block, and the writer of the block for the bookkeeping done after the commit
+func commitTestBlock(t *testing.T, tds *TrieDbState, blockNr uint64, change func(ibs *IntraBlockState)) (common.Hash, *DbStateWriter) {
+	ctx := context.Background()
+	ibs := New(tds)
+	tds.StartNewBuffer()
+	change(ibs)
+	if err := ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	roots, err := tds.ComputeTrieRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(blockNr)
+	dsw := tds.DbStateWriter()
+	if err := ibs.CommitBlock(ctx, dsw); err != nil {
+		t.Fatal(err)
+	}
+	return roots[len(roots)-1], dsw
+}
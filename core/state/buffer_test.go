@@ -0,0 +1,521 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestCompactStorageUpdates(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := tds.TrieStateWriter()
+	ctx := context.Background()
+	addr := common.HexToAddress("0x1234")
+	key1 := common.HexToHash("0x01")
+	key2 := common.HexToHash("0x02")
+	one := common.HexToHash("0x01")
+	two := common.HexToHash("0x02")
+	acc := accounts.NewAccount()
+
+	tds.StartNewBuffer()
+	if err = w.UpdateAccountData(ctx, addr, &accounts.Account{}, &acc); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteAccountStorage(ctx, addr, 0, &key1, &common.Hash{}, &one); err != nil {
+		t.Fatal(err)
+	}
+	tds.StartNewBuffer()
+	// Repeated write of the same value, and a new write
+	if err = w.WriteAccountStorage(ctx, addr, 0, &key1, &common.Hash{}, &one); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteAccountStorage(ctx, addr, 0, &key2, &common.Hash{}, &two); err != nil {
+		t.Fatal(err)
+	}
+	tds.StartNewBuffer()
+
+	addrHash, _ := common.HashData(addr[:])
+	if n := len(tds.buffers[1].storageUpdates[addrHash]); n != 1 {
+		t.Errorf("expected 1 storage update in the second buffer after compaction, got %d", n)
+	}
+	if n := len(tds.aggregateBuffer.storageUpdates[addrHash]); n != 2 {
+		t.Errorf("expected 2 storage updates in the aggregate buffer, got %d", n)
+	}
+	roots, err := tds.ComputeTrieRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 3 || roots[0] == roots[1] || roots[1] != roots[2] {
+		t.Errorf("unexpected roots: %x", roots)
+	}
+}
+
+func TestBufferSortedKeys(t *testing.T) {
+	var b Buffer
+	b.initialise()
+	for i := 10; i > 0; i-- {
+		acc := accounts.NewAccount()
+		addrHash := common.BytesToHash([]byte{byte(i)})
+		b.accountUpdates[addrHash] = &acc
+		m := make(map[common.Hash][]byte)
+		for j := 5; j > 0; j-- {
+			m[common.BytesToHash([]byte{byte(j)})] = []byte{byte(i), byte(j)}
+		}
+		b.storageUpdates[addrHash] = m
+	}
+	sortedAccounts := b.SortedAccounts()
+	if len(sortedAccounts) != 10 {
+		t.Fatalf("expected 10 accounts, got %d", len(sortedAccounts))
+	}
+	for i, addrHash := range sortedAccounts {
+		if addrHash != common.BytesToHash([]byte{byte(i + 1)}) {
+			t.Errorf("unexpected account at position %d: %x", i, addrHash)
+		}
+	}
+	addrHashes, keyHashes := b.SortedStorage()
+	for i, addrHash := range addrHashes {
+		if addrHash != common.BytesToHash([]byte{byte(i + 1)}) {
+			t.Errorf("unexpected storage account at position %d: %x", i, addrHash)
+		}
+		for j, keyHash := range keyHashes[i] {
+			if keyHash != common.BytesToHash([]byte{byte(j + 1)}) {
+				t.Errorf("unexpected storage key at position %d for %x: %x", j, addrHash, keyHash)
+			}
+		}
+	}
+}
+
+func TestTypedTouches(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetResolveReads(true)
+	w := tds.TrieStateWriter()
+	ctx := context.Background()
+	addr1 := common.HexToAddress("0x1234")
+	addr2 := common.HexToAddress("0x5678")
+	key := common.HexToHash("0x01")
+	value := common.HexToHash("0x01")
+	acc := accounts.NewAccount()
+
+	tds.StartNewBuffer()
+	if err = w.UpdateAccountData(ctx, addr1, &accounts.Account{}, &acc); err != nil {
+		t.Fatal(err)
+	}
+	tds.StartNewBuffer()
+	if err = w.WriteAccountStorage(ctx, addr1, 0, &key, &common.Hash{}, &value); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ReadAccountData(addr2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ResolveStateTrie(false); err != nil {
+		t.Fatal(err)
+	}
+
+	addrHash1, _ := common.HashData(addr1[:])
+	addrHash2, _ := common.HashData(addr2[:])
+	keyHash, _ := common.HashData(key[:])
+	expected := []trie.Touch{
+		{Key: addrHash1[:], Kind: trie.TouchAccount, Access: trie.TouchWrite, BufferIndex: 0},
+		{Key: addrHash2[:], Kind: trie.TouchAccount, Access: trie.TouchRead, BufferIndex: 1},
+		{Key: dbutils.GenerateCompositeTrieKey(addrHash1, keyHash), Kind: trie.TouchStorage, Access: trie.TouchWrite, BufferIndex: 1},
+	}
+	touches := tds.ExtractTypedTouches()
+	if len(touches) != len(expected) {
+		t.Fatalf("expected %d touches, got %d", len(expected), len(touches))
+	}
+	for i, touch := range touches {
+		e := expected[i]
+		if !bytes.Equal(touch.Key, e.Key) || touch.Kind != e.Kind || touch.Access != e.Access || touch.BufferIndex != e.BufferIndex {
+			t.Errorf("unexpected touch %d: %+v, expected %+v", i, touch, e)
+		}
+	}
+	if touches = tds.ExtractTypedTouches(); len(touches) != 0 {
+		t.Errorf("expected touches to be cleared, got %d", len(touches))
+	}
+}
+
+func TestPushPopBuffer(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := tds.TrieStateWriter()
+	ctx := context.Background()
+	addr := common.HexToAddress("0x1234")
+	key1 := common.HexToHash("0x01")
+	key2 := common.HexToHash("0x02")
+	one := common.HexToHash("0x01")
+	acc := accounts.NewAccount()
+	addrHash, _ := common.HashData(addr[:])
+
+	tds.StartNewBuffer()
+	if err = w.UpdateAccountData(ctx, addr, &accounts.Account{}, &acc); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteAccountStorage(ctx, addr, 0, &key1, &common.Hash{}, &one); err != nil {
+		t.Fatal(err)
+	}
+
+	tds.PushBuffer("bundle")
+	if err = w.WriteAccountStorage(ctx, addr, 0, &key2, &common.Hash{}, &one); err != nil {
+		t.Fatal(err)
+	}
+	tds.StartNewBuffer()
+	if len(tds.buffers) != 3 {
+		t.Fatalf("expected 3 buffers, got %d", len(tds.buffers))
+	}
+	name, err := tds.PopBuffer(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "bundle" {
+		t.Errorf("unexpected savepoint name %q", name)
+	}
+	if len(tds.buffers) != 1 || tds.currentBuffer != tds.buffers[0] {
+		t.Fatalf("expected only the first buffer to remain, got %d", len(tds.buffers))
+	}
+	if n := len(tds.aggregateBuffer.storageUpdates[addrHash]); n != 0 {
+		t.Errorf("expected discarded storage updates not to be in the aggregate buffer, got %d", n)
+	}
+	if _, err = tds.PopBuffer(false); err == nil {
+		t.Errorf("expected error when popping without savepoints")
+	}
+
+	tds.PushBuffer("kept")
+	if err = w.WriteAccountStorage(ctx, addr, 0, &key2, &common.Hash{}, &one); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.PopBuffer(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := tds.t.Get(dbutils.GenerateCompositeTrieKey(addrHash, hashOf(key2))); !ok || len(v) == 0 {
+		t.Errorf("expected the storage item written in the kept buffer to be in the trie")
+	}
+}
+
+func hashOf(key common.Hash) common.Hash {
+	h, _ := common.HashData(key[:])
+	return h
+}
+
+func TestRootAfterBuffer(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := tds.TrieStateWriter()
+	ctx := context.Background()
+	addr1 := common.HexToAddress("0x1234")
+	addr2 := common.HexToAddress("0x5678")
+	key := common.HexToHash("0x01")
+	one := common.HexToHash("0x01")
+	acc1 := accounts.NewAccount()
+	acc2 := accounts.NewAccount()
+	acc2.Balance.SetUint64(100)
+
+	tds.StartNewBuffer()
+	if err = w.UpdateAccountData(ctx, addr1, &accounts.Account{}, &acc1); err != nil {
+		t.Fatal(err)
+	}
+	tds.StartNewBuffer()
+	if err = w.WriteAccountStorage(ctx, addr1, 0, &key, &common.Hash{}, &one); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.UpdateAccountData(ctx, addr2, &accounts.Account{}, &acc2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ResolveStateTrie(false); err != nil {
+		t.Fatal(err)
+	}
+
+	var intermediate []common.Hash
+	for i := range tds.buffers {
+		root, err1 := tds.RootAfterBuffer(i)
+		if err1 != nil {
+			t.Fatal(err1)
+		}
+		intermediate = append(intermediate, root)
+	}
+	if _, err = tds.RootAfterBuffer(len(tds.buffers)); err == nil {
+		t.Errorf("expected error for out of range buffer index")
+	}
+	roots, err := tds.UpdateStateTrie()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != len(intermediate) {
+		t.Fatalf("expected %d roots, got %d", len(intermediate), len(roots))
+	}
+	for i := range roots {
+		if roots[i] != intermediate[i] {
+			t.Errorf("root after buffer %d: expected %x, got %x", i, roots[i], intermediate[i])
+		}
+	}
+}
+
+func TestCalcTrieRootsAutoResolve(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ibs := New(tds)
+	for i := 0; i < 100; i++ {
+		ibs.AddBalance(common.BytesToAddress([]byte{byte(i)}), big.NewInt(int64(i+1)))
+	}
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	root := tds.LastRoot()
+
+	modify := func() *TrieDbState {
+		tds1, err1 := NewTrieDbState(root, db, 1)
+		if err1 != nil {
+			t.Fatal(err1)
+		}
+		ibs1 := New(tds1)
+		ibs1.AddBalance(common.BytesToAddress([]byte{5}), big.NewInt(1000))
+		tds1.StartNewBuffer()
+		if err1 = ibs1.FinalizeTx(ctx, tds1.TrieStateWriter()); err1 != nil {
+			t.Fatal(err1)
+		}
+		// Merge the current buffer into the aggregate one without resolving
+		tds1.StartNewBuffer()
+		return tds1
+	}
+
+	expectedTds := modify()
+	roots, err := expectedTds.ComputeTrieRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := roots[len(roots)-1]
+
+	tds2 := modify()
+	tds2.SetAutoResolve(false)
+	_, err = tds2.CalcTrieRoots(false)
+	if _, ok := err.(*NotResolvedError); !ok {
+		t.Fatalf("expected NotResolvedError, got %v", err)
+	}
+
+	tds3 := modify()
+	tds3.SetReuseResolution(true)
+	for i := 0; i < 2; i++ {
+		got, err := tds3.CalcTrieRoots(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expected {
+			t.Errorf("expected root %x, got %x", expected, got)
+		}
+	}
+}
+
+func TestPendingChanges(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.EnablePreimages(true)
+	w := tds.TrieStateWriter()
+	ctx := context.Background()
+	addr1 := common.HexToAddress("0x1234")
+	addr2 := common.HexToAddress("0x1235")
+	key := common.HexToHash("0x01")
+	one := common.HexToHash("0x01")
+	acc := accounts.NewAccount()
+	acc.Nonce = 5
+	addrHash1, _ := common.HashData(addr1[:])
+	addrHash2, _ := common.HashData(addr2[:])
+
+	tds.StartNewBuffer()
+	if err = w.UpdateAccountData(ctx, addr1, &accounts.Account{}, &acc); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.CreateContract(addr1); err != nil {
+		t.Fatal(err)
+	}
+	tds.StartNewBuffer()
+	if err = w.WriteAccountStorage(ctx, addr1, 1, &key, &common.Hash{}, &one); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.DeleteAccount(ctx, addr2, &accounts.Account{}); err != nil {
+		t.Fatal(err)
+	}
+
+	pc := tds.PendingChanges()
+	if a := pc.Accounts[addrHash1]; a == nil || a.Nonce != 5 {
+		t.Errorf("unexpected pending account: %+v", a)
+	}
+	if a, ok := pc.Accounts[addrHash2]; !ok || a != nil {
+		t.Errorf("expected deleted account to be pending as nil")
+	}
+	if len(pc.Created) != 1 || pc.Created[0] != addrHash1 {
+		t.Errorf("unexpected created accounts: %x", pc.Created)
+	}
+	if len(pc.Deleted) != 1 || pc.Deleted[0] != addrHash2 {
+		t.Errorf("unexpected deleted accounts: %x", pc.Deleted)
+	}
+	if v := pc.Storage[addrHash1][hashOf(key)]; !bytes.Equal(v, []byte{1}) {
+		t.Errorf("unexpected pending storage value: %x", v)
+	}
+	if pc.Preimages[addrHash1] != addr1 {
+		t.Errorf("expected the preimage of the created contract, got %x", pc.Preimages[addrHash1])
+	}
+	// The snapshot is detached from the buffers
+	pc.Accounts[addrHash1].Nonce = 6
+	if tds.PendingChanges().Accounts[addrHash1].Nonce != 5 {
+		t.Errorf("modification of the snapshot affected the buffers")
+	}
+}
+
+func TestBlockResolverStats(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	contract := common.HexToAddress("0xc")
+	ibs := New(tds)
+	for i := 0; i < 100; i++ {
+		ibs.AddBalance(common.BytesToAddress([]byte{byte(i)}), big.NewInt(int64(i+1)))
+	}
+	ibs.CreateAccount(contract, true)
+	for i := 0; i < 10; i++ {
+		ibs.SetState(contract, common.Hash{byte(i)}, common.Hash{31: 1})
+	}
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := tds.BlockResolverStats(); stats.Requests() != 0 {
+		t.Errorf("expected no resolution for the block built from scratch, got %+v", stats)
+	}
+
+	// Fresh trie has to be resolved from the database
+	tds, err = NewTrieDbState(tds.LastRoot(), db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ibs = New(tds)
+	ibs.AddBalance(common.BytesToAddress([]byte{5}), big.NewInt(1000))
+	ibs.SetState(contract, common.Hash{1}, common.Hash{31: 2})
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(2)
+	stats := tds.BlockResolverStats()
+	if stats.AccountRequests == 0 || stats.AccountSubtries == 0 || stats.AccountKeys == 0 || stats.AccountBytes == 0 {
+		t.Errorf("expected the accounts to be resolved, got %+v", stats)
+	}
+	if stats.StorageRequests == 0 || stats.StorageSubtries == 0 || stats.StorageKeys == 0 || stats.StorageBytes == 0 {
+		t.Errorf("expected the storage to be resolved, got %+v", stats)
+	}
+	if stats.AccountKeys > 101 || stats.StorageKeys > 10 {
+		t.Errorf("more keys visited than there are in the state: %+v", stats)
+	}
+	// Statistics are per block
+	tds.SetBlockNr(3)
+	if stats := tds.BlockResolverStats(); stats.Requests() != 0 {
+		t.Errorf("expected the statistics to be reset for the next block, got %+v", stats)
+	}
+}
+
+func TestBufferMergeAccounts(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := tds.TrieStateWriter()
+	ctx := context.Background()
+	addr := common.HexToAddress("0x1234")
+	addrHash, _ := common.HashData(addr[:])
+	acc := accounts.NewAccount()
+	acc.Balance.SetUint64(100)
+
+	tds.StartNewBuffer()
+	if err = w.UpdateAccountData(ctx, addr, &accounts.Account{}, &acc); err != nil {
+		t.Fatal(err)
+	}
+	tds.StartNewBuffer()
+	aggregated := tds.aggregateBuffer.accountUpdates[addrHash]
+	if aggregated == nil || aggregated == tds.buffers[0].accountUpdates[addrHash] {
+		t.Fatalf("expected the aggregate buffer to hold its own copy of the account")
+	}
+	// Transfer, only the balance and the nonce change
+	var transferred accounts.Account
+	transferred.Copy(&acc)
+	transferred.Balance.SetUint64(40)
+	transferred.Nonce = 1
+	if err = w.UpdateAccountData(ctx, addr, &acc, &transferred); err != nil {
+		t.Fatal(err)
+	}
+	tds.StartNewBuffer()
+	if a := tds.aggregateBuffer.accountUpdates[addrHash]; a != aggregated || a.Balance.Uint64() != 40 || a.Nonce != 1 {
+		t.Errorf("expected the transfer merged into the aggregated account, got %+v", a)
+	}
+	if a := tds.buffers[0].accountUpdates[addrHash]; a.Balance.Uint64() != 100 || a.Nonce != 0 {
+		t.Errorf("expected the first buffer to keep its value, got %+v", a)
+	}
+	// Other changes are copied in full
+	var withCode accounts.Account
+	withCode.Copy(&transferred)
+	withCode.CodeHash = common.HexToHash("0xc0de")
+	if err = w.UpdateAccountData(ctx, addr, &transferred, &withCode); err != nil {
+		t.Fatal(err)
+	}
+	tds.StartNewBuffer()
+	if a := tds.aggregateBuffer.accountUpdates[addrHash]; a.CodeHash != withCode.CodeHash || a.Balance.Uint64() != 40 {
+		t.Errorf("expected the aggregated account to be updated, got %+v", a)
+	}
+	if err = w.DeleteAccount(ctx, addr, &withCode); err != nil {
+		t.Fatal(err)
+	}
+	tds.StartNewBuffer()
+	if a, ok := tds.aggregateBuffer.accountUpdates[addrHash]; !ok || a != nil {
+		t.Errorf("expected the deletion in the aggregate buffer, got %+v", a)
+	}
+}
@@ -0,0 +1,175 @@
+package state
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// ReadAccountCodeBatch returns the codes for the given code hashes (nil for the empty code hash), in the same order.
+// Codes missing from the code cache are read from the database in the order of their hashes, and added to the cache
+func (tds *TrieDbState) ReadAccountCodeBatch(hashes []common.Hash) ([][]byte, error) {
+	codes := make([][]byte, len(hashes))
+	var missing []int
+	for i, codeHash := range hashes {
+		if bytes.Equal(codeHash[:], emptyCodeHash) {
+			continue
+		}
+		if cached, ok := tds.codeCache.Get(codeHash); ok {
+			codes[i] = cached.([]byte)
+			continue
+		}
+		missing = append(missing, i)
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return bytes.Compare(hashes[missing[i]][:], hashes[missing[j]][:]) < 0
+	})
+	for j, i := range missing {
+		codeHash := hashes[i]
+		if j > 0 && hashes[missing[j-1]] == codeHash {
+			codes[i] = codes[missing[j-1]]
+			continue
+		}
+		code, err := tds.db.Get(dbutils.CodeBucket, codeHash[:])
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return nil, err
+		}
+		if err == nil {
+			tds.codeSizeCache.Add(codeHash, len(code))
+			tds.codeCache.Add(codeHash, code)
+		}
+		codes[i] = code
+	}
+	return codes, nil
+}
+
+// SetCodePrefetch enables loading of the codes of the touched contracts into the code cache, as soon as their
+// accounts are resolved from the database (see ResolveStateTrie). The codes are loaded in the background
+func (tds *TrieDbState) SetCodePrefetch(p bool) {
+	tds.codePrefetch = p
+}
+
+// codePrefetchHook returns the resolver hook that collects the code hashes of the given accounts into hashes
+func codePrefetchHook(touched map[common.Hash]struct{}, hashes *[]common.Hash) func(addrHash []byte, codeHash common.Hash) {
+	return func(addrHash []byte, codeHash common.Hash) {
+		if _, ok := touched[common.BytesToHash(addrHash)]; ok {
+			*hashes = append(*hashes, codeHash)
+		}
+	}
+}
+
+// prefetchCodes loads the codes into the code cache in the background. Close waits for it to finish
+func (tds *TrieDbState) prefetchCodes(hashes []common.Hash) {
+	if len(hashes) == 0 {
+		return
+	}
+	tds.background.Add(1)
+	go func() {
+		defer tds.background.Done()
+		_, _ = tds.ReadAccountCodeBatch(hashes)
+	}()
+}
+
+// PersistCodeCacheKeys writes the code hashes in the code cache and in the code size cache (but not the codes)
+// to the database, so that WarmCodeCaches can load them again after the restart
+func (tds *TrieDbState) PersistCodeCacheKeys() error {
+	if err := putCodeCacheKeys(tds.db, dbutils.CodeCacheKeysKey, tds.codeCache.Keys()); err != nil {
+		return err
+	}
+	return putCodeCacheKeys(tds.db, dbutils.CodeSizeCacheKeysKey, tds.codeSizeCache.Keys())
+}
+
+func putCodeCacheKeys(db ethdb.Putter, key []byte, keys []interface{}) error {
+	enc := make([]byte, 0, len(keys)*common.HashLength)
+	for _, k := range keys {
+		codeHash := k.(common.Hash)
+		enc = append(enc, codeHash[:]...)
+	}
+	return db.Put(key, key, enc)
+}
+
+func getCodeCacheKeys(db ethdb.Getter, key []byte) ([]common.Hash, error) {
+	enc, err := db.Get(key, key)
+	if err == ethdb.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]common.Hash, len(enc)/common.HashLength)
+	for i := range hashes {
+		copy(hashes[i][:], enc[i*common.HashLength:])
+	}
+	return hashes, nil
+}
+
+// WarmCodeCaches repopulates the code cache and the code size cache in the background with the codes whose
+// hashes were written by PersistCodeCacheKeys, preserving their order of recency. The entries added to
+// the caches in the meantime are kept. Close waits for it to finish
+func (tds *TrieDbState) WarmCodeCaches() {
+	tds.background.Add(1)
+	go func() {
+		defer tds.background.Done()
+		if err := tds.warmCodeCaches(); err != nil {
+			tds.getLogger().Warn("Warming of the code caches failed", "err", err)
+		}
+	}()
+}
+
+func (tds *TrieDbState) warmCodeCaches() error {
+	codeHashes, err := getCodeCacheKeys(tds.db, dbutils.CodeCacheKeysKey)
+	if err != nil {
+		return err
+	}
+	sizeHashes, err := getCodeCacheKeys(tds.db, dbutils.CodeSizeCacheKeysKey)
+	if err != nil {
+		return err
+	}
+	if len(codeHashes) == 0 && len(sizeHashes) == 0 {
+		return nil
+	}
+	// Only the codes of the code cache are kept in memory, for the rest just the sizes
+	inCodeCache := make(map[common.Hash]struct{}, len(codeHashes))
+	for _, codeHash := range codeHashes {
+		inCodeCache[codeHash] = struct{}{}
+	}
+	all := make([]common.Hash, 0, len(codeHashes)+len(sizeHashes))
+	all = append(all, codeHashes...)
+	all = append(all, sizeHashes...)
+	sort.Slice(all, func(i, j int) bool {
+		return bytes.Compare(all[i][:], all[j][:]) < 0
+	})
+	codes := make(map[common.Hash][]byte, len(codeHashes))
+	sizes := make(map[common.Hash]int, len(all))
+	for i, codeHash := range all {
+		if i > 0 && all[i-1] == codeHash {
+			continue
+		}
+		code, err := tds.db.Get(dbutils.CodeBucket, codeHash[:])
+		if err == ethdb.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sizes[codeHash] = len(code)
+		if _, ok := inCodeCache[codeHash]; ok {
+			codes[codeHash] = code
+		}
+	}
+	for _, codeHash := range sizeHashes {
+		if size, ok := sizes[codeHash]; ok {
+			tds.codeSizeCache.ContainsOrAdd(codeHash, size)
+		}
+	}
+	for _, codeHash := range codeHashes {
+		if code, ok := codes[codeHash]; ok {
+			tds.codeCache.ContainsOrAdd(codeHash, code)
+		}
+	}
+	tds.getLogger().Info("Warmed code caches", "codes", len(codes), "sizes", len(sizes))
+	return nil
+}
@@ -0,0 +1,151 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+const codeReadValueLen = 16
+
+// SetCodeReads enables the bookkeeping of the last block reading the code of every contract in the CodeReadBucket,
+// which finds the dead code (see NeverReadContracts and UnreadContracts). Like the code reads recorded for
+// the witnesses, the code is read when it is executed or copied (ReadAccountCode), but not when only its size is
+// looked up. The reads are written out by DbStateWriter.WriteCodeReads
+func (tds *TrieDbState) SetCodeReads(enabled bool) {
+	tds.touchMu.Lock()
+	defer tds.touchMu.Unlock()
+	if enabled {
+		if tds.codeReads == nil {
+			tds.codeReads = make(map[common.Hash]struct{})
+		}
+	} else {
+		tds.codeReads = nil
+	}
+}
+
+// recordCodeRead adds the contract to the code reads of the current block, if they are recorded
+func (tds *TrieDbState) recordCodeRead(address common.Address) error {
+	tds.touchMu.Lock()
+	defer tds.touchMu.Unlock()
+	if tds.codeReads == nil {
+		return nil
+	}
+	addrHash, err := tds.hashAddress(address)
+	if err != nil {
+		return err
+	}
+	tds.codeReads[addrHash] = struct{}{}
+	return nil
+}
+
+// WriteCodeReads records the current block, together with the current incarnation, as the last code read of
+// the contracts whose code was read since the last invocation (see SetCodeReads). The incarnation tells the reads
+// of the re-created contract from the reads of its earlier incarnations. It is meant to be called after CommitBlock
+func (dsw *DbStateWriter) WriteCodeReads() error {
+	tds := dsw.tds
+	tds.touchMu.Lock()
+	reads := tds.codeReads
+	if reads != nil {
+		tds.codeReads = make(map[common.Hash]struct{})
+	}
+	tds.touchMu.Unlock()
+	for addrHash := range reads {
+		incarnation, err := tds.flatIncarnation(addrHash)
+		if err != nil {
+			return err
+		}
+		// The last read before the block is restored on the unwinds (see unwindUndoLog)
+		if err = recordUndo(dsw.db, tds.blockNr, dbutils.CodeReadBucket, addrHash[:]); err != nil {
+			return err
+		}
+		if incarnation == 0 {
+			// Self-destructed by the block
+			if err = dsw.db.Delete(dbutils.CodeReadBucket, addrHash[:]); err != nil && err != ethdb.ErrKeyNotFound {
+				return err
+			}
+			continue
+		}
+		v := make([]byte, codeReadValueLen)
+		binary.BigEndian.PutUint64(v, tds.blockNr)
+		binary.BigEndian.PutUint64(v[8:], incarnation)
+		if err = dsw.db.Put(dbutils.CodeReadBucket, common.CopyBytes(addrHash[:]), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnreadContract is the contract reported by NeverReadContracts and UnreadContracts
+type UnreadContract struct {
+	AddrHash    common.Hash
+	Incarnation uint64
+	CodeHash    common.Hash
+	LastRead    uint64 // Last block reading the code of the current incarnation, zero if it has never been read
+	Read        bool   // Whether the code of the current incarnation has been read since the bookkeeping was enabled
+}
+
+// NeverReadContracts returns (at most limit, all if limit is zero) existing contracts whose code has not been
+// read since their deployment, as recorded when the bookkeeping is enabled by SetCodeReads, in the ascending order
+// of the address hashes. The contracts deployed before the bookkeeping was enabled count as never read
+// until their code is read
+func NeverReadContracts(db ethdb.Getter, limit int) ([]UnreadContract, error) {
+	return unreadContracts(db, limit, func(c *UnreadContract) bool {
+		return !c.Read
+	})
+}
+
+// UnreadContracts returns (at most limit, all if limit is zero) existing contracts whose code has not been read
+// for at least n blocks before the block blockNr, including the ones never read (see NeverReadContracts),
+// in the ascending order of the address hashes
+func UnreadContracts(db ethdb.Getter, blockNr, n uint64, limit int) ([]UnreadContract, error) {
+	if blockNr < n {
+		return nil, nil
+	}
+	return unreadContracts(db, limit, func(c *UnreadContract) bool {
+		return !c.Read || c.LastRead+n <= blockNr
+	})
+}
+
+// unreadContracts walks over the contracts with their last code reads, and reports the ones matching the filter
+func unreadContracts(db ethdb.Getter, limit int, filter func(c *UnreadContract) bool) ([]UnreadContract, error) {
+	var unread []UnreadContract
+	err := db.Walk(dbutils.AccountsBucket, nil, 0, func(k, v []byte) (bool, error) {
+		if len(k) != common.HashLength {
+			return true, nil
+		}
+		var acc accounts.Account
+		if err := acc.DecodeForStorage(v); err != nil {
+			return false, err
+		}
+		if acc.Incarnation == 0 || acc.IsEmptyCodeHash() {
+			return true, nil
+		}
+		c := UnreadContract{AddrHash: common.BytesToHash(k), Incarnation: acc.Incarnation, CodeHash: acc.CodeHash}
+		r, err := db.Get(dbutils.CodeReadBucket, k)
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return false, err
+		}
+		if len(r) > 0 {
+			if len(r) != codeReadValueLen {
+				return false, fmt.Errorf("invalid code read of %x: length %d", k, len(r))
+			}
+			if binary.BigEndian.Uint64(r[8:]) == acc.Incarnation {
+				c.LastRead = binary.BigEndian.Uint64(r)
+				c.Read = true
+			}
+		}
+		if filter(&c) {
+			unread = append(unread, c)
+		}
+		return limit == 0 || len(unread) < limit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unread, nil
+}
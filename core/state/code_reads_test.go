@@ -0,0 +1,85 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestUnreadContracts(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetCodeReads(true)
+	block := func(blockNr uint64, change func(ibs *IntraBlockState)) {
+		_, dsw := commitTestBlock(t, tds, blockNr, change)
+		if err := dsw.WriteCodeReads(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used, dead := common.HexToAddress("0xc1"), common.HexToAddress("0xc2")
+	usedHash, deadHash := crypto.Keccak256Hash(used[:]), crypto.Keccak256Hash(dead[:])
+	block(1, func(ibs *IntraBlockState) {
+		ibs.CreateAccount(used, true)
+		ibs.SetCode(used, []byte{0x60, 0x00, 0x60, 0x00, 0xf3})
+		ibs.CreateAccount(dead, true)
+		ibs.SetCode(dead, []byte{0x60, 0x01, 0x60, 0x00, 0xf3})
+	})
+	block(2, func(ibs *IntraBlockState) {
+		ibs.GetCode(used)
+		// Looking up the size is not reading the code
+		ibs.GetCodeSize(dead)
+	})
+	block(3, func(ibs *IntraBlockState) {})
+
+	never, err := NeverReadContracts(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(never) != 1 || never[0].AddrHash != deadHash || never[0].Read {
+		t.Errorf("expected only the second contract never read, got %+v", never)
+	}
+	unread, err := UnreadContracts(db, 3, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unread) != 2 {
+		t.Fatalf("expected both contracts unread for 1 block, got %+v", unread)
+	}
+	for _, c := range unread {
+		if c.AddrHash == usedHash && (!c.Read || c.LastRead != 2) {
+			t.Errorf("expected the first contract read by block 2, got %+v", c)
+		}
+	}
+	if unread, _ = UnreadContracts(db, 3, 2, 0); len(unread) != 1 || unread[0].AddrHash != deadHash {
+		t.Errorf("expected only the second contract unread for 2 blocks, got %+v", unread)
+	}
+
+	block(4, func(ibs *IntraBlockState) {
+		ibs.GetCode(used)
+	})
+
+	// Unwinding restores the read before the unwound blocks
+	if err = tds.UnwindTo(3); err != nil {
+		t.Fatal(err)
+	}
+	if unread, _ = UnreadContracts(db, 3, 0, 0); len(unread) != 2 {
+		t.Errorf("expected both contracts after the unwind, got %+v", unread)
+	}
+	for _, c := range unread {
+		if c.AddrHash == usedHash && (!c.Read || c.LastRead != 2) {
+			t.Errorf("expected the read of the first contract by block 2 after the unwind, got %+v", c)
+		}
+	}
+	// So does the truncation
+	if err = TruncateAbove(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	if never, _ = NeverReadContracts(db, 0); len(never) != 2 {
+		t.Errorf("expected both contracts never read after the truncation, got %+v", never)
+	}
+}
@@ -0,0 +1,33 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// writeCodeSize records the size of the code in the CodeSizeBucket, so that EXTCODESIZE does not need to load it
+func writeCodeSize(db ethdb.Putter, codeHash common.Hash, code []byte) error {
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], uint32(len(code)))
+	return db.Put(dbutils.CodeSizeBucket, codeHash[:], v[:])
+}
+
+// readCodeSize looks up the size of the code in the CodeSizeBucket. The second return value is false
+// if the size has not been recorded (code written before the bucket existed), and the code needs to be loaded instead
+func readCodeSize(db ethdb.Getter, codeHash common.Hash) (int, bool, error) {
+	v, err := db.Get(dbutils.CodeSizeBucket, codeHash[:])
+	if err == ethdb.ErrKeyNotFound || (err == nil && v == nil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(v) != 4 {
+		return 0, false, fmt.Errorf("invalid code size record for %x: %d bytes", codeHash, len(v))
+	}
+	return int(binary.BigEndian.Uint32(v)), true, nil
+}
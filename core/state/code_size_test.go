@@ -0,0 +1,54 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestCodeSizeBucket(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	addr := common.HexToAddress("0x1234")
+	code := []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+	ibs := New(tds)
+	ibs.CreateAccount(addr, true)
+	ibs.SetCode(addr, code)
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+
+	codeHash := crypto.Keccak256Hash(code)
+	if size, found, err := readCodeSize(db, codeHash); err != nil || !found || size != len(code) {
+		t.Fatalf("expected recorded code size %d, got %d (found %t, error %v)", len(code), size, found, err)
+	}
+
+	// The size must be served from the bucket alone
+	if err = db.Delete(dbutils.CodeBucket, codeHash[:]); err != nil {
+		t.Fatal(err)
+	}
+	tds.codeSizeCache.Purge()
+	tds.codeCache.Purge()
+	if size, err := tds.ReadAccountCodeSize(addr, codeHash); err != nil || size != len(code) {
+		t.Errorf("expected code size %d, got %d, error %v", len(code), size, err)
+	}
+	if size, err := NewDbState(db, 1).ReadAccountCodeSize(addr, codeHash); err != nil || size != len(code) {
+		t.Errorf("expected historical code size %d, got %d, error %v", len(code), size, err)
+	}
+}
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// CommitHook adds the writes of an external subsystem (an index, an exporter) to the batch of the block, see OnCommit
+type CommitHook func(blockNr uint64, batch ethdb.Batch) error
+
+// OnCommit registers the hook invoked for every block finished by DbStateWriter, after the state changes of the block
+// (and the writes into the custom buckets, see PutCustom) are written into the batch. The writes of the hook go into
+// the same batch, so that they are committed or rolled back together with the state of the block, and are
+// streamed to the replicas with it. The error of the hook fails the commit of the block.
+// The hooks are invoked in the order of their registration, and are meant to be registered before the blocks are processed
+func (tds *TrieDbState) OnCommit(hook CommitHook) {
+	tds.commitHooks = append(tds.commitHooks, hook)
+}
+
+// commitWriter holds the writer that finishes the block while the commit hooks run, for the hooks made by
+// WriterHook. It is shared by the copies of TrieDbState sharing the hooks (see WithNewBuffer), so the mutex
+// keeps the commits of the copies from seeing each other's writers
+type commitWriter struct {
+	mu  sync.Mutex
+	dsw *DbStateWriter
+}
+
+// WriterHook makes the commit hook out of the bookkeeping of DbStateWriter done at the end of the block (like
+// WriteRootIndex), so that it can be registered with OnCommit. The bookkeeping is invoked with the writer that
+// finishes the block, whichever of the copies of the TrieDbState it belongs to
+func (tds *TrieDbState) WriterHook(write func(dsw *DbStateWriter) error) CommitHook {
+	if tds.committing == nil {
+		tds.committing = &commitWriter{}
+	}
+	cw := tds.committing
+	return func(blockNr uint64, _ ethdb.Batch) error {
+		if cw.dsw == nil || cw.dsw.tds.blockNr != blockNr {
+			return fmt.Errorf("no writer finishing block %d", blockNr)
+		}
+		return write(cw.dsw)
+	}
+}
+
+func (dsw *DbStateWriter) runCommitHooks() error {
+	if cw := dsw.tds.committing; cw != nil {
+		cw.mu.Lock()
+		cw.dsw = dsw
+		defer func() {
+			cw.dsw = nil
+			cw.mu.Unlock()
+		}()
+	}
+	for i, hook := range dsw.tds.commitHooks {
+		if err := hook(dsw.tds.blockNr, dsw.db); err != nil {
+			return fmt.Errorf("commit hook %d of block %d: %w", i, dsw.tds.blockNr, err)
+		}
+	}
+	return nil
+}
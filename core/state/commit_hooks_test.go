@@ -0,0 +1,117 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestOnCommit(t *testing.T) {
+	ctx := context.Background()
+	bucket := []byte("test-hook-index")
+	db := ethdb.NewMemDatabase()
+
+	commitBlock := func(blockNr uint64, hook CommitHook) error {
+		batch := db.NewBatch()
+		tds, err := NewTrieDbState(common.Hash{}, batch, blockNr-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tds.OnCommit(hook)
+		ibs := New(tds)
+		tds.StartNewBuffer()
+		ibs.AddBalance(common.HexToAddress("0xa"), big.NewInt(int64(blockNr)))
+		if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tds.ComputeTrieRoots(); err != nil {
+			t.Fatal(err)
+		}
+		tds.SetBlockNr(blockNr)
+		if err = tds.CommitBlock(ctx, ibs, tds.DbStateWriter()); err != nil {
+			batch.Rollback()
+			return err
+		}
+		_, err = batch.Commit()
+		return err
+	}
+
+	var hooked []uint64
+	if err := commitBlock(1, func(blockNr uint64, batch ethdb.Batch) error {
+		hooked = append(hooked, blockNr)
+		var v [8]byte
+		binary.BigEndian.PutUint64(v[:], blockNr)
+		return batch.Put(bucket, []byte("last"), v[:])
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(hooked) != 1 || hooked[0] != 1 {
+		t.Errorf("expected the hook invoked for block 1, got %v", hooked)
+	}
+	if v, err := db.Get(bucket, []byte("last")); err != nil || binary.BigEndian.Uint64(v) != 1 {
+		t.Errorf("expected the write of the hook committed with the block, got %x, error %v", v, err)
+	}
+
+	// Failing hook rolls back the block together with its own writes
+	if err := commitBlock(2, func(blockNr uint64, batch ethdb.Batch) error {
+		if err := batch.Put(bucket, []byte("last"), []byte{2}); err != nil {
+			return err
+		}
+		return errors.New("index unavailable")
+	}); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+	if v, err := db.Get(bucket, []byte("last")); err != nil || binary.BigEndian.Uint64(v) != 1 {
+		t.Errorf("expected the write of the failed hook rolled back, got %x, error %v", v, err)
+	}
+	for _, blockNr := range []uint64{1, 2} {
+		var changeSets int
+		ts := dbutils.EncodeTimestamp(blockNr)
+		if err := db.Walk(dbutils.ChangeSetBucket, ts, 8*uint(len(ts)), func(k, v []byte) (bool, error) {
+			changeSets++
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if committed := changeSets > 0; committed != (blockNr == 1) {
+			t.Errorf("block %d: expected committed %t, found %d change sets", blockNr, blockNr == 1, changeSets)
+		}
+	}
+}
+
+func TestWriterHook(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var writers []*DbStateWriter
+	tds.OnCommit(tds.WriterHook(func(dsw *DbStateWriter) error {
+		writers = append(writers, dsw)
+		return dsw.WriteRootIndex()
+	}))
+	_, dsw := commitTestBlock(t, tds, 1, func(ibs *IntraBlockState) {
+		ibs.AddBalance(common.HexToAddress("0xa"), big.NewInt(1))
+	})
+	if len(writers) != 1 || writers[0] != dsw {
+		t.Fatalf("expected the hook invoked with the writer of block 1, got %v", writers)
+	}
+	if entry, err := ReadRootIndex(db, 1); err != nil || entry == nil || entry.Root != tds.LastRoot() || entry.AccountChanges != 1 {
+		t.Errorf("unexpected root index entry for block 1: %+v, error %v", entry, err)
+	}
+
+	// The copy sharing the hooks passes its own writer
+	cpy := tds.WithNewBuffer()
+	_, dsw = commitTestBlock(t, cpy, 2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(common.HexToAddress("0xb"), big.NewInt(1))
+	})
+	if len(writers) != 2 || writers[1] != dsw || dsw.tds != cpy {
+		t.Errorf("expected the hook invoked with the writer of the copy")
+	}
+}
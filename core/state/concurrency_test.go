@@ -0,0 +1,84 @@
+package state
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// TestConcurrentReadsDuringCommit is meant to be run with the race detector
+func TestConcurrentReadsDuringCommit(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetResolveReads(true)
+	contract := common.HexToAddress("0xc")
+	block := func(blockNr uint64, change func(ibs *IntraBlockState)) {
+		commitTestBlock(t, tds, blockNr, change)
+		tds.PruneTries(false)
+	}
+	block(1, func(ibs *IntraBlockState) {
+		for i := 0; i < 100; i++ {
+			ibs.AddBalance(common.BytesToAddress([]byte{byte(i + 1)}), big.NewInt(1))
+		}
+		ibs.CreateAccount(contract, true)
+		for i := 0; i < 16; i++ {
+			ibs.SetState(contract, common.Hash{byte(i)}, common.Hash{31: 1})
+		}
+	})
+
+	done := make(chan struct{})
+	var wg, started sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		reader := tds.WithNewBuffer()
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				if i == 1 {
+					started.Done()
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+				acc, err := reader.ReadAccountData(common.BytesToAddress([]byte{byte(i%100 + 1)}))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if acc == nil || acc.Balance.Sign() == 0 {
+					t.Errorf("unexpected account %d: %+v", i%100+1, acc)
+					return
+				}
+				key := common.Hash{byte(i % 16)}
+				if _, err = reader.ReadAccountStorage(contract, 1, &key); err != nil {
+					t.Error(err)
+					return
+				}
+				_ = reader.LastRoot()
+			}
+		}()
+	}
+	// Readers are running before the first commit
+	started.Wait()
+	for blockNr := uint64(2); blockNr <= 100; blockNr++ {
+		block(blockNr, func(ibs *IntraBlockState) {
+			ibs.AddBalance(common.BytesToAddress([]byte{byte(blockNr%100 + 1)}), big.NewInt(1))
+			ibs.SetState(contract, common.Hash{byte(blockNr % 16)}, common.Hash{31: byte(blockNr)})
+		})
+		if _, err = tds.makeBlockWitness(false, trie.NewResolveSet(0), nil, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
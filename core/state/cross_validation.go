@@ -0,0 +1,204 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// Divergences of one block beyond that are counted, but not logged one by one
+const maxLoggedDivergences = 16
+
+// TrieDivergence is the alert raised by the cross-validation of the trie layouts (see SetCrossValidation),
+// when the tries of the two layouts disagree about the presence or the value of an item after the block
+type TrieDivergence struct {
+	BlockNr uint64
+	// Address hash when the accounts diverge (their storage sub-tries are not compared then),
+	// address hash + storage key hash when the storage items diverge
+	Prefix  []byte
+	Primary []byte // Value in the trie of the current layout (accounts without the storage root), nil if absent
+	Shadow  []byte // Value in the trie of the other layout, nil if absent
+}
+
+func (d TrieDivergence) String() string {
+	return fmt.Sprintf("block %d, prefix %x: primary %x, shadow %x", d.BlockNr, d.Prefix, d.Primary, d.Shadow)
+}
+
+type crossValidator struct {
+	shadow      *trie.Trie       // Full trie of the other layout, built from the flat state when nil
+	divergences []TrieDivergence // Found in the last validated block
+}
+
+// SetCrossValidation enables the safety net of the binary trie experiment: the updates of every block are applied
+// both to the trie of the current layout and to the full trie of the other layout (hexary when the current
+// one is binary and vice versa), which are then compared on all the accounts and storage items updated by
+// the block. Every disagreement is logged as an error with its divergent prefix, and can be read with
+// LastTrieDivergences. The trie of the other layout is built from the flat state before the first validated block,
+// and re-built after the state is modified outside of the blocks (unwinding, expiry, layout switch)
+func (tds *TrieDbState) SetCrossValidation(enabled bool) {
+	tds.tMu.Lock()
+	defer tds.tMu.Unlock()
+	if enabled {
+		if tds.crossValidation == nil {
+			tds.crossValidation = &crossValidator{}
+		}
+	} else {
+		tds.crossValidation = nil
+	}
+}
+
+// LastTrieDivergences returns the divergences of the trie layouts found in the last validated block
+// (see SetCrossValidation), sorted by their prefixes
+func (tds *TrieDbState) LastTrieDivergences() []TrieDivergence {
+	tds.tMu.RLock()
+	defer tds.tMu.RUnlock()
+	if tds.crossValidation == nil {
+		return nil
+	}
+	return tds.crossValidation.divergences
+}
+
+// resetCrossValidation drops the trie of the other layout, after the state is modified outside of the blocks
+func (tds *TrieDbState) resetCrossValidation() {
+	if tds.crossValidation != nil {
+		tds.crossValidation.shadow = nil
+	}
+}
+
+// crossValidate applies the buffers of the block to the trie of the other layout in the same way as updateTrieRoots,
+// and compares the items updated by the block in both tries. It is invoked under the write lock of tMu,
+// after updateTrieRoots and before the buffers are cleared
+func (tds *TrieDbState) crossValidate() error {
+	cv := tds.crossValidation
+	if cv == nil || tds.aggregateBuffer == nil {
+		return nil
+	}
+	t, err := tds.concreteTrie()
+	if err != nil {
+		return err
+	}
+	if cv.shadow == nil {
+		// Flat state is not yet updated by the block
+		if cv.shadow, err = trieFromFlat(tds.db, !t.IsBinary()); err != nil {
+			return err
+		}
+	}
+	shadow := cv.shadow
+	alreadyCreated := make(map[common.Hash]struct{})
+	for _, b := range tds.buffers {
+		for _, addrHash := range setKeys(b.created, true) {
+			if _, ok := alreadyCreated[addrHash]; ok {
+				continue
+			}
+			alreadyCreated[addrHash] = struct{}{}
+			shadow.DeleteSubtree(addrHash[:], tds.blockNr)
+		}
+		for _, addrHash := range b.accountKeys(true) {
+			if account := b.accountUpdates[addrHash]; account != nil {
+				// Storage root of the current layout does not apply, the storage sub-trie is kept or built below
+				acc := account.SelfCopy()
+				acc.Root = trie.EmptyRoot
+				shadow.UpdateAccount(addrHash[:], acc)
+			} else {
+				shadow.Delete(addrHash[:], tds.blockNr)
+			}
+		}
+		for _, addrHash := range b.storageKeys(true) {
+			m := b.storageUpdates[addrHash]
+			for _, keyHash := range b.storageItemKeys(addrHash, true) {
+				cKey := dbutils.GenerateCompositeTrieKey(addrHash, keyHash)
+				if v := m[keyHash]; len(v) > 0 {
+					shadow.Update(cKey, v, tds.blockNr)
+				} else {
+					shadow.Delete(cKey, tds.blockNr)
+				}
+			}
+		}
+		for _, addrHash := range setKeys(b.deleted, true) {
+			if _, ok := b.recreated[addrHash]; ok {
+				continue
+			}
+			shadow.DeleteSubtree(addrHash[:], tds.blockNr)
+		}
+	}
+
+	divergences := compareTries(t, shadow, tds.aggregateBuffer, tds.blockNr)
+	cv.divergences = divergences
+	for i, d := range divergences {
+		if i == maxLoggedDivergences {
+			break
+		}
+		tds.getLogger().Error("Trie layouts diverge", "block", d.BlockNr, "prefix", fmt.Sprintf("%x", d.Prefix),
+			"binary", t.IsBinary(), "primary", fmt.Sprintf("%x", d.Primary), "shadow", fmt.Sprintf("%x", d.Shadow))
+	}
+	if len(divergences) > maxLoggedDivergences {
+		tds.getLogger().Error("Trie layouts diverge in more items", "block", tds.blockNr, "divergences", len(divergences))
+	}
+	return nil
+}
+
+// compareTries compares the accounts and the storage items updated by the buffer in the tries of the two layouts.
+// The items not resolved in the primary trie are skipped
+func compareTries(primary, shadow *trie.Trie, b *Buffer, blockNr uint64) []TrieDivergence {
+	accountKeys := make(map[common.Hash]struct{})
+	for addrHash := range b.accountUpdates {
+		accountKeys[addrHash] = struct{}{}
+	}
+	for addrHash := range b.created {
+		accountKeys[addrHash] = struct{}{}
+	}
+	for addrHash := range b.deleted {
+		accountKeys[addrHash] = struct{}{}
+	}
+	var divergences []TrieDivergence
+	diverged := make(map[common.Hash]struct{})
+	for addrHash := range accountKeys {
+		primaryAcc, ok1 := primary.GetAccount(addrHash[:])
+		shadowAcc, ok2 := shadow.GetAccount(addrHash[:])
+		if !ok1 || !ok2 {
+			// Not resolved in the trie of the current layout
+			continue
+		}
+		primaryValue, shadowValue := encodeAccountWithoutRoot(primaryAcc), encodeAccountWithoutRoot(shadowAcc)
+		if !bytes.Equal(primaryValue, shadowValue) {
+			diverged[addrHash] = struct{}{}
+			divergences = append(divergences, TrieDivergence{BlockNr: blockNr, Prefix: common.CopyBytes(addrHash[:]), Primary: primaryValue, Shadow: shadowValue})
+		}
+	}
+	for addrHash, m := range b.storageUpdates {
+		if _, ok := diverged[addrHash]; ok {
+			continue
+		}
+		for keyHash := range m {
+			cKey := dbutils.GenerateCompositeTrieKey(addrHash, keyHash)
+			primaryValue, ok1 := primary.Get(cKey)
+			shadowValue, ok2 := shadow.Get(cKey)
+			if !ok1 || !ok2 {
+				continue
+			}
+			if !bytes.Equal(primaryValue, shadowValue) {
+				divergences = append(divergences, TrieDivergence{BlockNr: blockNr, Prefix: cKey, Primary: common.CopyBytes(primaryValue), Shadow: common.CopyBytes(shadowValue)})
+			}
+		}
+	}
+	sort.Slice(divergences, func(i, j int) bool { return bytes.Compare(divergences[i].Prefix, divergences[j].Prefix) < 0 })
+	return divergences
+}
+
+// encodeAccountWithoutRoot encodes the account for storage with the empty storage root, which depends on the layout,
+// nil for the absent account
+func encodeAccountWithoutRoot(acc *accounts.Account) []byte {
+	if acc == nil {
+		return nil
+	}
+	a := acc.SelfCopy()
+	a.Root = trie.EmptyRoot
+	enc := make([]byte, a.EncodingLengthForStorage())
+	a.EncodeForStorage(enc)
+	return enc
+}
@@ -0,0 +1,79 @@
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestCrossValidation(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetCrossValidation(true)
+	a, contract := common.HexToAddress("0xa"), common.HexToAddress("0xc")
+	commitTestBlock(t, tds, 1, func(ibs *IntraBlockState) {
+		ibs.AddBalance(a, big.NewInt(10))
+		ibs.CreateAccount(contract, true)
+		ibs.SetState(contract, common.Hash{1}, common.Hash{31: 1})
+		ibs.SetState(contract, common.Hash{2}, common.Hash{31: 2})
+	})
+	commitTestBlock(t, tds, 2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(a, big.NewInt(5))
+		ibs.SetState(contract, common.Hash{1}, common.Hash{})
+	})
+	if d := tds.LastTrieDivergences(); len(d) != 0 {
+		t.Fatalf("expected no divergences, got %v", d)
+	}
+	shadow := tds.crossValidation.shadow
+	if shadow == nil || !shadow.IsBinary() {
+		t.Fatalf("expected the binary trie alongside the hexary one")
+	}
+	if expected, _ := flatStateRoot(db, true); shadow.Hash() != expected {
+		t.Errorf("expected the binary root %x, got %x", expected, shadow.Hash())
+	}
+
+	commitTestBlock(t, tds, 3, func(ibs *IntraBlockState) {
+		ibs.Suicide(contract)
+		ibs.AddBalance(a, big.NewInt(1))
+	})
+	if d := tds.LastTrieDivergences(); len(d) != 0 {
+		t.Fatalf("expected no divergences, got %v", d)
+	}
+
+	// Divergences are reported for the items updated by the block
+	primary, err := tds.concreteTrie()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrHashA := crypto.Keccak256Hash(a[:])
+	b := &Buffer{}
+	b.initialise()
+	b.accountUpdates[addrHashA] = nil
+	keyHash := crypto.Keccak256Hash(common.Hash{5}.Bytes())
+	b.storageUpdates[addrHashA] = map[common.Hash][]byte{keyHash: nil}
+	if d := compareTries(primary, shadow, b, 3); len(d) != 0 {
+		t.Fatalf("expected no divergences, got %v", d)
+	}
+	shadow.Delete(addrHashA[:], 3)
+	d := compareTries(primary, shadow, b, 3)
+	if len(d) != 1 || !bytes.Equal(d[0].Prefix, addrHashA[:]) || d[0].Primary == nil || d[0].Shadow != nil {
+		t.Fatalf("expected the divergence of the account, got %v", d)
+	}
+	acc, _ := primary.GetAccount(addrHashA[:])
+	acc.Root = trie.EmptyRoot
+	shadow.UpdateAccount(addrHashA[:], acc)
+	shadow.Update(dbutils.GenerateCompositeTrieKey(addrHashA, keyHash), []byte{1}, 3)
+	d = compareTries(primary, shadow, b, 3)
+	if len(d) != 1 || !bytes.Equal(d[0].Prefix, dbutils.GenerateCompositeTrieKey(addrHashA, keyHash)) || d[0].Primary != nil {
+		t.Fatalf("expected the divergence of the storage item, got %v", d)
+	}
+}
@@ -0,0 +1,62 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+)
+
+// customWrites are the writes into the custom buckets made during the current block, see PutCustom
+type customWrites struct {
+	mu      sync.Mutex
+	changes []ReplicaChange
+}
+
+// PutCustom writes the entry of the custom bucket (see dbutils.RegisterBucket) as a part of the current block,
+// for example, from the state writer of the application indexing the state. The writes are kept until the block
+// is finished, and are then written by DbStateWriter into the same batch as the state changes of the block
+// (and streamed to the replicas with them), so that the custom buckets are committed atomically with the state.
+// The writes of the failed block are discarded with the TrieDbState. The custom buckets have no history, so
+// the application is responsible for reverting its entries when the blocks are unwound
+func (tds *TrieDbState) PutCustom(bucket, key, value []byte) error {
+	return tds.addCustomWrite(ReplicaChange{Bucket: bucket, Key: common.CopyBytes(key), Value: common.CopyBytes(value)})
+}
+
+// DeleteCustom deletes the entry of the custom bucket as a part of the current block, see PutCustom
+func (tds *TrieDbState) DeleteCustom(bucket, key []byte) error {
+	return tds.addCustomWrite(ReplicaChange{Bucket: bucket, Key: common.CopyBytes(key), Deleted: true})
+}
+
+func (tds *TrieDbState) addCustomWrite(c ReplicaChange) error {
+	if !dbutils.IsCustomBucket(c.Bucket) {
+		return fmt.Errorf("bucket %q is not registered as custom", c.Bucket)
+	}
+	cw := tds.customWrites
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.changes = append(cw.changes, c)
+	return nil
+}
+
+// writeCustom writes out the writes into the custom buckets made during the block, when the block is finished
+func (dsw *DbStateWriter) writeCustom() error {
+	cw := dsw.tds.customWrites
+	cw.mu.Lock()
+	changes := cw.changes
+	cw.changes = nil
+	cw.mu.Unlock()
+	for _, c := range changes {
+		var err error
+		if c.Deleted {
+			err = dsw.db.Delete(c.Bucket, c.Key)
+		} else {
+			err = dsw.db.Put(c.Bucket, c.Key, c.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestPutCustom(t *testing.T) {
+	bucket := []byte("test-state-index")
+	if !dbutils.IsCustomBucket(bucket) {
+		if err := dbutils.RegisterBucket(dbutils.CustomBucket{Name: bucket}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	db := ethdb.NewMemDatabase()
+	if err := db.Put(bucket, []byte("stale"), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	batch := db.NewBatch()
+	tds, err := NewTrieDbState(common.Hash{}, batch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tds.PutCustom([]byte("not-registered"), []byte("k"), []byte("v")); err == nil {
+		t.Errorf("expected the write into the bucket not registered to fail")
+	}
+
+	ibs := New(tds)
+	tds.StartNewBuffer()
+	ibs.AddBalance(common.HexToAddress("0xa"), big.NewInt(10))
+	if err = tds.PutCustom(bucket, []byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err = tds.DeleteCustom(bucket, []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = batch.Get(bucket, []byte("k")); err != ethdb.ErrKeyNotFound {
+		t.Errorf("expected the write to be kept until the block is finished, got error %v", err)
+	}
+	tds.SetBlockNr(1)
+	if err = tds.CommitBlock(ctx, ibs, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written into the batch of the block, not yet into the database
+	if v, err := batch.Get(bucket, []byte("k")); err != nil || string(v) != "v" {
+		t.Errorf("expected the write in the batch, got %q, error %v", v, err)
+	}
+	if _, err = db.Get(bucket, []byte("k")); err != ethdb.ErrKeyNotFound {
+		t.Errorf("expected the write not to be committed yet, got error %v", err)
+	}
+	if _, err = batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(bucket, []byte("k")); err != nil || string(v) != "v" {
+		t.Errorf("expected the write committed with the block, got %q, error %v", v, err)
+	}
+	if _, err = db.Get(bucket, []byte("stale")); err != ethdb.ErrKeyNotFound {
+		t.Errorf("expected the deletion committed with the block, got error %v", err)
+	}
+	addrHash := crypto.Keccak256Hash(common.HexToAddress("0xa").Bytes())
+	if _, err = db.Get(dbutils.AccountsBucket, addrHash[:]); err != nil {
+		t.Errorf("expected the account committed with the block, got error %v", err)
+	}
+}
@@ -19,14 +19,12 @@ package state
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"fmt"
 	"io"
-	"runtime"
+	"math/big"
 	"sort"
 	"sync"
 	"sync/atomic"
-	"unsafe"
 
 	"github.com/ledgerwatch/turbo-geth/common/debug"
 
@@ -37,15 +35,34 @@ import (
 	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/metrics"
 	"github.com/ledgerwatch/turbo-geth/trie"
 )
 
-// Trie cache generation limit after which to evict trie nodes from memory.
-var MaxTrieCacheGen = uint32(1024 * 1024)
+// Default trie cache generation limit after which to evict trie nodes from memory.
+// It is used to initialise new TrieDbState instances, which can then be tuned with SetCacheGenLimit
+const DefaultTrieCacheGen = uint32(1024 * 1024)
+
+// Default number of entries in the cache of address hashes (see SetAddrHashCacheSize)
+const defaultAddrHashCacheSize = 64 * 1024
+
+var (
+	addrHashHitCounter  = metrics.NewRegisteredCounter("state/addrhash/hit", nil)
+	addrHashMissCounter = metrics.NewRegisteredCounter("state/addrhash/miss", nil)
+
+	// Cost of resolving the state trie, reported once per block (see BlockResolverStats)
+	resolveAccountKeysMeter     = metrics.NewRegisteredMeter("state/resolve/account/keys", nil)
+	resolveStorageKeysMeter     = metrics.NewRegisteredMeter("state/resolve/storage/keys", nil)
+	resolveAccountBytesMeter    = metrics.NewRegisteredMeter("state/resolve/account/bytes", nil)
+	resolveStorageBytesMeter    = metrics.NewRegisteredMeter("state/resolve/storage/bytes", nil)
+	resolveAccountSubtriesMeter = metrics.NewRegisteredMeter("state/resolve/account/subtries", nil)
+	resolveStorageSubtriesMeter = metrics.NewRegisteredMeter("state/resolve/storage/subtries", nil)
+	resolveRequestTimer         = metrics.NewRegisteredTimer("state/resolve/request", nil)
+)
 
 const (
 	//FirstContractIncarnation - first incarnation for contract accounts. After 1 it increases by 1.
-	FirstContractIncarnation = 1
+	FirstContractIncarnation = accounts.FirstContractIncarnation
 	//NonContractIncarnation incarnation for non contracts
 	NonContractIncarnation = 0
 )
@@ -101,6 +118,11 @@ type Buffer struct {
 	accountReads   map[common.Hash]struct{}
 	deleted        map[common.Hash]struct{}
 	created        map[common.Hash]struct{}
+	recreated      map[common.Hash]struct{} // Subset of created, for the contracts self-destructed earlier in the same block
+	// Values observed by the reads (only populated when read values capture is enabled).
+	// For each key, only the first observed value is kept, nil means that the item was not found
+	storageReadValues map[common.Hash]map[common.Hash][]byte
+	accountReadValues map[common.Hash][]byte
 }
 
 // Prepares buffer for work or clears previous data
@@ -111,15 +133,37 @@ func (b *Buffer) initialise() {
 	b.accountReads = make(map[common.Hash]struct{})
 	b.deleted = make(map[common.Hash]struct{})
 	b.created = make(map[common.Hash]struct{})
+	b.recreated = make(map[common.Hash]struct{})
+	b.storageReadValues = make(map[common.Hash]map[common.Hash][]byte)
+	b.accountReadValues = make(map[common.Hash][]byte)
 }
 
-// Replaces account pointer with pointers to the copies
-func (b *Buffer) detachAccounts() {
-	for addrHash, account := range b.accountUpdates {
-		if account != nil {
-			b.accountUpdates[addrHash] = account.SelfCopy()
-		}
+// mergeAccount records the account update in this buffer, which owns its copies of the accounts, so that the
+// buffers merged in keep their values. If only the balance and the nonce have changed (as in the simple
+// transfers), the delta is applied to the copy held already, otherwise the whole account is copied
+func (b *Buffer) mergeAccount(addrHash common.Hash, account *accounts.Account) {
+	if account == nil {
+		b.accountUpdates[addrHash] = nil
+		return
 	}
+	prev := b.accountUpdates[addrHash]
+	if prev == nil {
+		prev = new(accounts.Account)
+		prev.Copy(account)
+		b.accountUpdates[addrHash] = prev
+		return
+	}
+	if prev == account {
+		return
+	}
+	if prev.Initialised == account.Initialised && prev.Root == account.Root && prev.CodeHash == account.CodeHash &&
+		prev.Incarnation == account.Incarnation && prev.HasStorageSize == account.HasStorageSize &&
+		prev.StorageSize == account.StorageSize && bytes.Equal(prev.Extra, account.Extra) {
+		prev.Nonce = account.Nonce
+		prev.Balance.Set(&account.Balance)
+		return
+	}
+	prev.Copy(account)
 }
 
 // Merges the content of another buffer into this one
@@ -145,7 +189,7 @@ func (b *Buffer) merge(other *Buffer) {
 		}
 	}
 	for addrHash, account := range other.accountUpdates {
-		b.accountUpdates[addrHash] = account
+		b.mergeAccount(addrHash, account)
 	}
 	for addrHash := range other.accountReads {
 		b.accountReads[addrHash] = struct{}{}
@@ -156,12 +200,104 @@ func (b *Buffer) merge(other *Buffer) {
 	for addrHash := range other.created {
 		b.created[addrHash] = struct{}{}
 	}
+	for addrHash := range other.recreated {
+		b.recreated[addrHash] = struct{}{}
+	}
+	// For the read values, the earliest observation wins
+	for addrHash, om := range other.storageReadValues {
+		m, ok := b.storageReadValues[addrHash]
+		if !ok {
+			m = make(map[common.Hash][]byte)
+			b.storageReadValues[addrHash] = m
+		}
+		for keyHash, v := range om {
+			if _, ok := m[keyHash]; !ok {
+				m[keyHash] = v
+			}
+		}
+	}
+	for addrHash, v := range other.accountReadValues {
+		if _, ok := b.accountReadValues[addrHash]; !ok {
+			b.accountReadValues[addrHash] = v
+		}
+	}
+}
+
+func sortHashes(hashes []common.Hash) {
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+}
+
+func setKeys(m map[common.Hash]struct{}, sorted bool) []common.Hash {
+	keys := make([]common.Hash, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	if sorted {
+		sortHashes(keys)
+	}
+	return keys
+}
+
+func (b *Buffer) accountKeys(sorted bool) []common.Hash {
+	keys := make([]common.Hash, 0, len(b.accountUpdates))
+	for addrHash := range b.accountUpdates {
+		keys = append(keys, addrHash)
+	}
+	if sorted {
+		sortHashes(keys)
+	}
+	return keys
+}
+
+func (b *Buffer) storageKeys(sorted bool) []common.Hash {
+	keys := make([]common.Hash, 0, len(b.storageUpdates))
+	for addrHash := range b.storageUpdates {
+		keys = append(keys, addrHash)
+	}
+	if sorted {
+		sortHashes(keys)
+	}
+	return keys
+}
+
+func (b *Buffer) storageItemKeys(addrHash common.Hash, sorted bool) []common.Hash {
+	m := b.storageUpdates[addrHash]
+	keys := make([]common.Hash, 0, len(m))
+	for keyHash := range m {
+		keys = append(keys, keyHash)
+	}
+	if sorted {
+		sortHashes(keys)
+	}
+	return keys
+}
+
+// SortedAccounts returns the hashes of the addresses with account updates or deletions, in ascending order
+func (b *Buffer) SortedAccounts() []common.Hash {
+	return b.accountKeys(true)
+}
+
+// SortedStorage returns the hashes of the addresses with storage updates in ascending order,
+// together with the sorted hashes of the updated storage keys for each of these addresses
+func (b *Buffer) SortedStorage() ([]common.Hash, [][]common.Hash) {
+	addrHashes := b.storageKeys(true)
+	keyHashes := make([][]common.Hash, len(addrHashes))
+	for i, addrHash := range addrHashes {
+		keyHashes[i] = b.storageItemKeys(addrHash, true)
+	}
+	return addrHashes, keyHashes
 }
 
 // TrieDbState implements StateReader by wrapping a trie and a database, where trie acts as a cache for the database
 type TrieDbState struct {
-	t                 *trie.Trie
-	tMu               *sync.Mutex
+	t                 TrieBackend
+	tMu               *sync.RWMutex // Write lock for the modifications of the trie, read lock for the lookups
+	hashMu            *sync.Mutex   // Hashing under the read lock of tMu, which caches the hashes in the nodes
+	touchMu           *sync.Mutex   // Touches of the nodes recorded in tp by the lookups under the read lock of tMu
+	touchOrigin       TouchOrigin   // Origin of the current touches, see SetTouchOrigin
+	touchStats        *TouchStats   // Touches of the current block, nil unless enabled by SetTouchStats
+	lastTouchStats    *TouchStats   // Touches of the last finished block
+	view              *readView     // Values read from the trie, served without tMu
 	db                ethdb.Database
 	blockNr           uint64
 	buffers           []*Buffer
@@ -169,58 +305,123 @@ type TrieDbState struct {
 	currentBuffer     *Buffer
 	codeCache         *lru.Cache
 	codeSizeCache     *lru.Cache
+	addrHashCache     *lru.Cache      // Address => address hash, nil if disabled
+	frequentActors    *frequentActors // Address hashes of the most frequently touched accounts, nil if disabled
+	rawKeys           bool            // Development mode, where the keys are not hashed (see SetRawKeys)
+	codePrefetch      bool
 	historical        bool
 	noHistory         bool
 	resolveReads      bool
+	captureReadValues bool
+	deterministic     bool // Buffers are applied to the trie in the sorted order of keys
 	savePreimages     bool
 	resolveSetBuilder *trie.ResolveSetBuilder
+	proofSession      *ProofSession // Session recording the touches instead of resolveSetBuilder, see BeginProofSession
 	tp                *trie.TriePruning
+	cacheGenLimit     uint32 // Accessed atomically, can be adjusted at runtime
+	forensicsDir      string // If not empty, diagnostic dumps of mismatched storage roots are written there
+	// Latest values of the storage items written by the finished buffers of the current block
+	blockStorageWrites map[common.Hash]map[common.Hash][]byte
+	savepoints         []bufferSavepoint
+	noAutoResolve      bool // If set, CalcTrieRoots returns NotResolvedError instead of resolving the missing parts of the trie
+	reuseResolution    bool // If set, CalcTrieRoots does not re-check the keys it has already checked within the current block
+	resolvedAccounts   map[common.Hash]struct{}
+	resolvedStorage    map[common.StorageKey]struct{}
+	background         sync.WaitGroup // Background tasks (like asynchronous pruning) that Close waits for
+	changeStreamer     *ChangeStreamer
+	pendingChanges     []*BlockChanges  // Changes of the blocks written by DbStateWriter, not yet sent to the followers
+	blockHash          common.Hash      // Hash of the current block, labelling its changes, see SetBlockHashes
+	parentHash         common.Hash      // Hash of the parent of the current block
+	customWrites       *customWrites    // Writes into the custom buckets made during the current block, see PutCustom
+	commitHooks        []CommitHook     // Invoked for every block finished by DbStateWriter, see OnCommit
+	committing         *commitWriter    // Writer finishing the block for the hooks made by WriterHook
+	stateExporter      ExportSink       // Receives the changes of the committed blocks, see SetStateExporter
+	pendingExports     [][]*StateChange // Changes to export by block, waiting for the commit of the blocks
+	binaryTrieBlock    *big.Int         // First block processed with the binary trie, nil if there is no such fork
+	resolverStatsMu    sync.Mutex
+	resolverStats      trie.ResolverStats // Cost of the resolutions of the current block
+	lastResolverStats  trie.ResolverStats // Cost of the resolutions of the last finished block
+	resolveBudget      trie.ResolveBudget // Limit of the work of one resolution, no limit by default
+	committer          func() error       // Commits the database on Close, see SetCommitter
+	closeMu            sync.Mutex
+	closed             bool // Set by Close, guarded by closeMu
+
+	// Prediction of the touches from the recent blocks, see SetTouchPrefetch
+	trieVersion         uint64              // Incremented (atomically) whenever the trie is brought to a different state
+	touchPrefetchBlocks uint64              // How many recent blocks the prediction is made from
+	predictedTouches    map[string]struct{} // Address hashes and storage keys prefetched for the current block
+	prefetchHits        uint64
+	prefetchMisses      uint64
+
+	logger              log.Logger // Default logger is used if nil, see SetLogger
+	memStatsLogInterval uint64
+	memStatsLogCalls    uint64
+
+	phaseStatsMu   sync.Mutex
+	phaseStats     PhaseStats // Time spent in the phases of the current block
+	lastPhaseStats PhaseStats // Time spent in the phases of the last finished block
+
+	snapshotInterval uint64 // Blocks between the trie snapshots, see SetTrieSnapshots
+	snapshotDepth    int
+	historyBatching  bool // History records are written when the block is finished, see SetHistoryBatching
+	stateChecksum    bool // Checksum of the flat state is maintained by the commits, see SetStateChecksum
+
+	txChanges *txChangeRecorder // Values written by the transactions of the current block, nil unless enabled by SetTxChanges
+
+	crossValidation *crossValidator // Trie of the other layout, updated alongside, nil unless enabled by SetCrossValidation
+
+	// Accounts touched (true) and deleted (false) by the blocks since the last WriteLastTouches,
+	// nil unless enabled by SetLastTouches
+	lastTouches map[common.Hash]bool
+
+	// Contracts whose code was read by the blocks since the last WriteCodeReads, nil unless enabled by SetCodeReads
+	codeReads map[common.Hash]struct{}
+}
+
+// NotResolvedError is returned by CalcTrieRoots when auto-resolution is disabled, and some parts of the trie
+// that are required for computing the root are not resolved
+type NotResolvedError struct {
+	Prefixes [][]byte // Paths (in HEX encoding) of the nodes that need resolution
+}
+
+func (e *NotResolvedError) Error() string {
+	return fmt.Sprintf("trie is not resolved for %d prefixes, first %x", len(e.Prefixes), e.Prefixes[0])
+}
+
+// bufferSavepoint marks the buffer started by PushBuffer
+type bufferSavepoint struct {
+	name  string
+	index int // Index of the buffer in tds.buffers
 }
 
-var (
-	trieObj   = make(map[uint64]uintptr)
-	trieObjMu sync.RWMutex
-)
-
-func getTrieDBState(db ethdb.Database) *TrieDbState {
-	if db == nil {
-		return nil
-	}
-	trieObjMu.RLock()
-	tr, ok := trieObj[db.ID()]
-	trieObjMu.RUnlock()
-
-	if !ok {
-		return nil
-	}
-
-	return (*TrieDbState)(unsafe.Pointer(tr))
+func NewTrieDbState(root common.Hash, db ethdb.Database, blockNr uint64) (*TrieDbState, error) {
+	return newTrieDbState(root, db, blockNr)
 }
 
-func setTrieDBState(tds *TrieDbState, id uint64) {
-	if tds == nil {
-		return
+// NewEncryptedTrieDbState creates TrieDbState on top of the database encrypting the values with the key
+// (see ethdb.NewEncryptedDatabase). A database that is already encrypting is used as it is
+func NewEncryptedTrieDbState(root common.Hash, db ethdb.Database, blockNr uint64, key []byte) (*TrieDbState, error) {
+	if !ethdb.IsEncrypted(db) {
+		encDb, err := ethdb.NewEncryptedDatabase(db, key)
+		if err != nil {
+			return nil, err
+		}
+		db = encDb
 	}
-
-	ptr := unsafe.Pointer(tds)
-
-	trieObjMu.Lock()
-	trieObj[id] = uintptr(ptr)
-	trieObjMu.Unlock()
+	return NewTrieDbState(root, db, blockNr)
 }
 
-func NewTrieDbState(root common.Hash, db ethdb.Database, blockNr uint64) (*TrieDbState, error) {
-	tds, err := newTrieDbState(root, db, blockNr)
-	if err != nil {
-		return nil, err
-	}
-
-	setTrieDBState(tds, db.ID())
-
-	return tds, nil
+// NewTrieDbStateWithBackend creates TrieDbState on top of the given trie implementation instead of
+// a fresh *trie.Trie
+func NewTrieDbStateWithBackend(t TrieBackend, db ethdb.Database, blockNr uint64) (*TrieDbState, error) {
+	return newTrieDbStateWithBackend(t, db, blockNr)
 }
 
 func newTrieDbState(root common.Hash, db ethdb.Database, blockNr uint64) (*TrieDbState, error) {
+	return newTrieDbStateWithBackend(trie.New(root), db, blockNr)
+}
+
+func newTrieDbStateWithBackend(t TrieBackend, db ethdb.Database, blockNr uint64) (*TrieDbState, error) {
 	csc, err := lru.New(100000)
 	if err != nil {
 		return nil, err
@@ -229,35 +430,47 @@ func newTrieDbState(root common.Hash, db ethdb.Database, blockNr uint64) (*TrieD
 	if err != nil {
 		return nil, err
 	}
-	t := trie.New(root)
+	ahc, err := lru.New(defaultAddrHashCacheSize)
+	if err != nil {
+		return nil, err
+	}
 	tp := trie.NewTriePruning(blockNr)
 
 	tds := &TrieDbState{
 		t:                 t,
-		tMu:               new(sync.Mutex),
+		tMu:               new(sync.RWMutex),
+		hashMu:            new(sync.Mutex),
+		touchMu:           new(sync.Mutex),
+		view:              newReadView(),
 		db:                db,
 		blockNr:           blockNr,
 		codeCache:         cc,
 		codeSizeCache:     csc,
+		addrHashCache:     ahc,
 		resolveSetBuilder: trie.NewResolveSetBuilder(),
 		tp:                tp,
 		savePreimages:     true,
+		cacheGenLimit:     DefaultTrieCacheGen,
+		customWrites:      &customWrites{},
 	}
-	t.SetTouchFunc(func(hex []byte, del bool) {
-		tp.Touch(hex, del)
-	})
+	t.SetTouchFunc(tds.touchFunc(tp))
+	t.SetGeneration(blockNr)
 
 	return tds, nil
 }
 
-func GetTrieDbState(root common.Hash, db ethdb.Database, blockNr uint64) (*TrieDbState, error) {
-	if tr := getTrieDBState(db); tr != nil {
-		if tr.getBlockNr() == blockNr && tr.LastRoot() == root {
-			return tr, nil
+// touchFunc returns the function recording the touches of the trie nodes in tp. Lookups touch the nodes
+// while only holding the read lock of tMu, so the touches are serialised by touchMu
+func (tds *TrieDbState) touchFunc(tp *trie.TriePruning) func(hex []byte, del bool) {
+	touchMu := tds.touchMu
+	return func(hex []byte, del bool) {
+		touchMu.Lock()
+		tp.Touch(hex, del)
+		if tds.touchStats != nil && !del {
+			tds.touchStats.add(hex, tds.touchOrigin)
 		}
+		touchMu.Unlock()
 	}
-
-	return newTrieDbState(root, db, blockNr)
 }
 
 func (tds *TrieDbState) EnablePreimages(ep bool) {
@@ -272,24 +485,51 @@ func (tds *TrieDbState) SetResolveReads(rr bool) {
 	tds.resolveReads = rr
 }
 
+// SetCaptureReadValues enables recording of the values observed by the reads, which
+// are then committed to by ReadSetDigest
+func (tds *TrieDbState) SetCaptureReadValues(c bool) {
+	tds.captureReadValues = c
+}
+
+// SetDeterministic makes updateTrieRoots process the accounts and storage items of each buffer
+// in the sorted order of their keys, rather than in the map iteration order, so that the processing
+// (and the logs it produces) is reproducible between runs
+func (tds *TrieDbState) SetDeterministic(d bool) {
+	tds.deterministic = d
+}
+
 func (tds *TrieDbState) SetNoHistory(nh bool) {
 	tds.noHistory = nh
 }
 
 func (tds *TrieDbState) Copy() *TrieDbState {
 	tds.tMu.Lock()
-	tcopy := *tds.t
+	var tcopy TrieBackend
+	if t, ok := tds.t.(*trie.Trie); ok {
+		c := *t
+		tcopy = &c
+	} else {
+		// Other backends are not copyable, so the copy shares it with the original
+		tcopy = tds.t
+	}
 	tds.tMu.Unlock()
 
 	n := tds.getBlockNr()
 	tp := trie.NewTriePruning(n)
 
 	cpy := TrieDbState{
-		t:       &tcopy,
-		tMu:     new(sync.Mutex),
-		db:      tds.db,
-		blockNr: n,
-		tp:      tp,
+		t:             tcopy,
+		tMu:           new(sync.RWMutex),
+		hashMu:        new(sync.Mutex),
+		touchMu:       new(sync.Mutex),
+		view:          newReadView(),
+		db:            tds.db,
+		blockNr:       n,
+		tp:            tp,
+		cacheGenLimit: tds.CacheGenLimit(),
+		rawKeys:       tds.rawKeys,
+		logger:        tds.logger,
+		customWrites:  &customWrites{},
 	}
 	return &cpy
 }
@@ -298,24 +538,108 @@ func (tds *TrieDbState) Database() ethdb.Database {
 	return tds.db
 }
 
+// Trie returns the underlying trie, or nil if TrieDbState was created with a backend other than *trie.Trie
 func (tds *TrieDbState) Trie() *trie.Trie {
-	return tds.t
+	t, _ := tds.t.(*trie.Trie)
+	return t
+}
+
+// concreteTrie returns the underlying *trie.Trie for the operations (pruning, witness extraction,
+// hashing with modifications) which are only available for the canonical trie implementation
+func (tds *TrieDbState) concreteTrie() (*trie.Trie, error) {
+	if t, ok := tds.t.(*trie.Trie); ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("operation is not supported by trie backend %T", tds.t)
 }
 
 func (tds *TrieDbState) StartNewBuffer() {
+	if tds.currentBuffer == nil && tds.txChanges != nil {
+		// New block, the changes of the block that was not committed are dropped
+		tds.txChanges.reset()
+	}
 	if tds.currentBuffer != nil {
 		if tds.aggregateBuffer == nil {
 			tds.aggregateBuffer = &Buffer{}
 			tds.aggregateBuffer.initialise()
 		}
+		tds.compactStorageUpdates(tds.currentBuffer)
 		tds.aggregateBuffer.merge(tds.currentBuffer)
-		tds.currentBuffer.detachAccounts()
 	}
 	tds.currentBuffer = &Buffer{}
 	tds.currentBuffer.initialise()
 	tds.buffers = append(tds.buffers, tds.currentBuffer)
 }
 
+// PushBuffer starts a new buffer (as StartNewBuffer does) and marks it with the named savepoint,
+// so that the change period starting with this buffer can later be discarded by PopBuffer
+func (tds *TrieDbState) PushBuffer(name string) {
+	tds.StartNewBuffer()
+	tds.savepoints = append(tds.savepoints, bufferSavepoint{name: name, index: len(tds.buffers) - 1})
+}
+
+// PopBuffer removes the latest savepoint and returns its name. If discard is true, all the buffers started
+// since the savepoint are thrown away, and the buffer preceding the savepoint becomes current again.
+// Otherwise, the buffers are kept as part of the block. Reverting the corresponding changes
+// in IntraBlockState (for example, via RevertToSnapshot) is the responsibility of the caller
+func (tds *TrieDbState) PopBuffer(discard bool) (string, error) {
+	if len(tds.savepoints) == 0 {
+		return "", fmt.Errorf("no buffer savepoints to pop")
+	}
+	sp := tds.savepoints[len(tds.savepoints)-1]
+	tds.savepoints = tds.savepoints[:len(tds.savepoints)-1]
+	if !discard {
+		return sp.name, nil
+	}
+	tds.buffers = tds.buffers[:sp.index]
+	tds.aggregateBuffer = nil
+	tds.blockStorageWrites = nil
+	if sp.index == 0 {
+		tds.currentBuffer = nil
+		return sp.name, nil
+	}
+	tds.currentBuffer = tds.buffers[sp.index-1]
+	// Aggregate buffer and the storage writes used for compaction only contain the finished buffers
+	tds.aggregateBuffer = &Buffer{}
+	tds.aggregateBuffer.initialise()
+	for _, b := range tds.buffers[:sp.index-1] {
+		tds.compactStorageUpdates(b)
+		tds.aggregateBuffer.merge(b)
+	}
+	return sp.name, nil
+}
+
+// compactStorageUpdates removes from the finished buffer the storage writes that do not change the values
+// written by the earlier buffers of the same block. IntraBlockState writes out all the dirty storage items at
+// the end of every transaction, so without compaction, the same values would be repeated in many buffers
+func (tds *TrieDbState) compactStorageUpdates(b *Buffer) {
+	if tds.blockStorageWrites == nil {
+		tds.blockStorageWrites = make(map[common.Hash]map[common.Hash][]byte)
+	}
+	// Storage of the deleted and re-created contracts starts afresh
+	for addrHash := range b.deleted {
+		delete(tds.blockStorageWrites, addrHash)
+	}
+	for addrHash := range b.created {
+		delete(tds.blockStorageWrites, addrHash)
+	}
+	for addrHash, m := range b.storageUpdates {
+		written, ok := tds.blockStorageWrites[addrHash]
+		if !ok {
+			written = make(map[common.Hash][]byte)
+			tds.blockStorageWrites[addrHash] = written
+		}
+		for keyHash, v := range m {
+			if w, ok := written[keyHash]; ok && bytes.Equal(w, v) {
+				delete(m, keyHash)
+				continue
+			}
+			written[keyHash] = v
+		}
+		// Empty map is kept on purpose, so that the storage root of the account still gets recomputed
+	}
+}
+
 func (tds *TrieDbState) WithNewBuffer() *TrieDbState {
 	aggregateBuffer := &Buffer{}
 	aggregateBuffer.initialise()
@@ -329,6 +653,9 @@ func (tds *TrieDbState) WithNewBuffer() *TrieDbState {
 	t := &TrieDbState{
 		t:                 tds.t,
 		tMu:               tds.tMu,
+		hashMu:            tds.hashMu,
+		touchMu:           tds.touchMu,
+		view:              tds.view,
 		db:                tds.db,
 		blockNr:           tds.getBlockNr(),
 		buffers:           buffers,
@@ -336,11 +663,24 @@ func (tds *TrieDbState) WithNewBuffer() *TrieDbState {
 		currentBuffer:     currentBuffer,
 		codeCache:         tds.codeCache,
 		codeSizeCache:     tds.codeSizeCache,
+		addrHashCache:     tds.addrHashCache,
+		frequentActors:    tds.frequentActors,
+		customWrites:      tds.customWrites,
+		commitHooks:       tds.commitHooks,
+		committing:        tds.committing,
+		stateExporter:     tds.stateExporter,
+		rawKeys:           tds.rawKeys,
 		historical:        tds.historical,
 		noHistory:         tds.noHistory,
 		resolveReads:      tds.resolveReads,
+		captureReadValues: tds.captureReadValues,
+		deterministic:     tds.deterministic,
 		resolveSetBuilder: tds.resolveSetBuilder,
+		proofSession:      tds.proofSession,
 		tp:                tds.tp,
+		forensicsDir:      tds.forensicsDir,
+		cacheGenLimit:     tds.CacheGenLimit(),
+		logger:            tds.logger,
 	}
 	tds.tMu.Unlock()
 
@@ -348,8 +688,15 @@ func (tds *TrieDbState) WithNewBuffer() *TrieDbState {
 }
 
 func (tds *TrieDbState) LastRoot() common.Hash {
-	tds.tMu.Lock()
-	defer tds.tMu.Unlock()
+	tds.tMu.RLock()
+	defer tds.tMu.RUnlock()
+	return tds.hashUnderReadLock()
+}
+
+// hashUnderReadLock returns the root hash of the trie, for the callers holding only the read lock of tMu
+func (tds *TrieDbState) hashUnderReadLock() common.Hash {
+	tds.hashMu.Lock()
+	defer tds.hashMu.Unlock()
 	return tds.t.Hash()
 }
 
@@ -368,27 +715,50 @@ func (tds *TrieDbState) UpdateStateTrie() ([]common.Hash, error) {
 	tds.tMu.Lock()
 	defer tds.tMu.Unlock()
 
-	roots, err := tds.updateTrieRoots(true)
+	var roots []common.Hash
+	err := tds.inPhase(context.Background(), PhaseUpdate, func(ctx context.Context) error {
+		var err error
+		roots, err = tds.updateTrieRoots(ctx, true)
+		return err
+	})
+	if err == nil {
+		err = tds.crossValidate()
+	}
+	tds.collectLastTouches()
 	tds.clearUpdates()
 	return roots, err
 }
 
 func (tds *TrieDbState) PrintTrie(w io.Writer) {
-	tds.tMu.Lock()
-	defer tds.tMu.Unlock()
+	tds.tMu.RLock()
+	defer tds.tMu.RUnlock()
 	tds.t.Print(w)
 	fmt.Fprintln(w, "") //nolint
 }
 
+// ExportTrie writes the structure of the cached state trie in DOT or JSON format,
+// optionally limited to the subtrie under the given prefix (in HEX encoding)
+func (tds *TrieDbState) ExportTrie(w io.Writer, format trie.ExportFormat, prefix []byte) error {
+	tds.tMu.RLock()
+	defer tds.tMu.RUnlock()
+	tds.hashMu.Lock()
+	defer tds.hashMu.Unlock()
+	t, err := tds.concreteTrie()
+	if err != nil {
+		return err
+	}
+	return t.ExportTrie(w, format, prefix)
+}
+
 // Builds a map where for each address (of a smart contract) there is
 // a sorted list of all key hashes that were touched within the
 // period for which we are aggregating updates
-func (tds *TrieDbState) buildStorageTouches(withReads bool, withValues bool) (common.StorageKeys, [][]byte) {
+func (tds *TrieDbState) buildStorageTouches(aggregate *Buffer, withReads bool, withValues bool) (common.StorageKeys, [][]byte) {
 	storageTouches := common.StorageKeys{}
 	var values [][]byte
-	for addrHash, m := range tds.aggregateBuffer.storageUpdates {
+	for addrHash, m := range aggregate.storageUpdates {
 		if withValues {
-			if _, ok := tds.aggregateBuffer.deleted[addrHash]; ok {
+			if _, ok := aggregate.deleted[addrHash]; ok {
 				continue
 			}
 		}
@@ -400,8 +770,8 @@ func (tds *TrieDbState) buildStorageTouches(withReads bool, withValues bool) (co
 		}
 	}
 	if withReads {
-		for addrHash, m := range tds.aggregateBuffer.storageReads {
-			mWrite := tds.aggregateBuffer.storageUpdates[addrHash]
+		for addrHash, m := range aggregate.storageReads {
+			mWrite := aggregate.storageUpdates[addrHash]
 			for keyHash := range m {
 				if mWrite != nil {
 					if _, ok := mWrite[keyHash]; ok {
@@ -424,7 +794,7 @@ func (tds *TrieDbState) buildStorageTouches(withReads bool, withValues bool) (co
 		for _, storageKey := range storageTouches {
 			copy(addrHash[:], storageKey[:])
 			copy(keyHash[:], storageKey[common.HashLength:])
-			values = append(values, tds.aggregateBuffer.storageUpdates[addrHash][keyHash])
+			values = append(values, aggregate.storageUpdates[addrHash][keyHash])
 		}
 	}
 	return storageTouches, values
@@ -433,43 +803,52 @@ func (tds *TrieDbState) buildStorageTouches(withReads bool, withValues bool) (co
 // Expands the storage tries (by loading data from the database) if it is required
 // for accessing storage slots containing in the storageTouches map
 func (tds *TrieDbState) resolveStorageTouches(storageTouches common.StorageKeys, resolveFunc func(*trie.Resolver) error) error {
+	return resolveFunc(tds.storageResolver(storageTouches))
+}
+
+// storageResolver creates the resolver of the storage items needing the resolution, nil if there are none
+func (tds *TrieDbState) storageResolver(storageTouches common.StorageKeys) *trie.Resolver {
 	var resolver *trie.Resolver
-	for _, storageKey := range storageTouches {
-		if need, req := tds.t.NeedResolution(storageKey[:common.HashLength], storageKey[:]); need {
-			if resolver == nil {
-				resolver = trie.NewResolver(0, false, tds.blockNr)
-				resolver.SetHistorical(tds.historical)
-			}
-			resolver.AddRequest(req)
+	keys := make([][]byte, len(storageTouches))
+	for i := range storageTouches {
+		keys[i] = storageTouches[i][:]
+	}
+	for _, req := range tds.t.NeedResolutionBatch(common.HashLength, keys) {
+		if resolver == nil {
+			resolver = trie.NewResolver(0, false, tds.blockNr)
+			resolver.SetHistorical(tds.historical)
 		}
+		resolver.AddRequest(req)
 	}
-	return resolveFunc(resolver)
+	return resolver
 }
 
 // Populate pending block proof so that it will be sufficient for accessing all storage slots in storageTouches
 func (tds *TrieDbState) populateStorageBlockProof(storageTouches common.StorageKeys) error { //nolint
-	for _, storageKey := range storageTouches {
-		tds.resolveSetBuilder.AddStorageTouch(storageKey[:])
-	}
+	tds.recordProof(func(b *trie.ResolveSetBuilder) {
+		for _, storageKey := range storageTouches {
+			b.AddStorageTouch(storageKey[:])
+		}
+	})
 	return nil
 }
 
 // Builds a sorted list of all address hashes that were touched within the
 // period for which we are aggregating updates
-func (tds *TrieDbState) buildAccountTouches(withReads bool, withValues bool) (common.Hashes, []*accounts.Account) {
+func (tds *TrieDbState) buildAccountTouches(aggregate *Buffer, withReads bool, withValues bool) (common.Hashes, []*accounts.Account) {
 	accountTouches := common.Hashes{}
 	var aValues []*accounts.Account
-	for addrHash, aValue := range tds.aggregateBuffer.accountUpdates {
+	for addrHash, aValue := range aggregate.accountUpdates {
 		if aValue != nil {
-			if _, ok := tds.aggregateBuffer.deleted[addrHash]; ok {
+			if _, ok := aggregate.deleted[addrHash]; ok {
 				accountTouches = append(accountTouches, addrHash)
 			}
 		}
 		accountTouches = append(accountTouches, addrHash)
 	}
 	if withReads {
-		for addrHash := range tds.aggregateBuffer.accountReads {
-			if _, ok := tds.aggregateBuffer.accountUpdates[addrHash]; !ok {
+		for addrHash := range aggregate.accountReads {
+			if _, ok := aggregate.accountUpdates[addrHash]; !ok {
 				accountTouches = append(accountTouches, addrHash)
 			}
 		}
@@ -482,9 +861,9 @@ func (tds *TrieDbState) buildAccountTouches(withReads bool, withValues bool) (co
 			if i < len(accountTouches)-1 && addrHash == accountTouches[i+1] {
 				aValues[i] = nil // Entry that would wipe out existing storage
 			} else {
-				a := tds.aggregateBuffer.accountUpdates[addrHash]
+				a := aggregate.accountUpdates[addrHash]
 				if a != nil {
-					if _, ok := tds.aggregateBuffer.storageUpdates[addrHash]; ok {
+					if _, ok := aggregate.storageUpdates[addrHash]; ok {
 						var ac accounts.Account
 						ac.Copy(a)
 						ac.Root = trie.EmptyRoot
@@ -501,33 +880,116 @@ func (tds *TrieDbState) buildAccountTouches(withReads bool, withValues bool) (co
 // Expands the accounts trie (by loading data from the database) if it is required
 // for accessing accounts whose addresses are contained in the accountTouches
 func (tds *TrieDbState) resolveAccountTouches(accountTouches common.Hashes, resolveFunc func(*trie.Resolver) error) error {
+	var codeHashes []common.Hash
+	if err := resolveFunc(tds.accountResolver(accountTouches, &codeHashes)); err != nil {
+		return err
+	}
+	tds.prefetchCodes(codeHashes)
+	return nil
+}
+
+// accountResolver creates the resolver of the accounts needing the resolution, nil if there are none.
+// If the code prefetch is enabled, the resolution collects the code hashes of the contracts into codeHashes
+func (tds *TrieDbState) accountResolver(accountTouches common.Hashes, codeHashes *[]common.Hash) *trie.Resolver {
 	var resolver *trie.Resolver
-	for _, addrHash := range accountTouches {
-		if need, req := tds.t.NeedResolution(nil, addrHash[:]); need {
-			if resolver == nil {
-				resolver = trie.NewResolver(0, true, tds.blockNr)
-				resolver.SetHistorical(tds.historical)
+	keys := make([][]byte, len(accountTouches))
+	for i := range accountTouches {
+		keys[i] = accountTouches[i][:]
+	}
+	for _, req := range tds.t.NeedResolutionBatch(0, keys) {
+		if resolver == nil {
+			resolver = trie.NewResolver(0, true, tds.blockNr)
+			resolver.SetHistorical(tds.historical)
+			if tds.codePrefetch {
+				touched := make(map[common.Hash]struct{}, len(accountTouches))
+				for _, addrHash := range accountTouches {
+					touched[addrHash] = struct{}{}
+				}
+				resolver.SetCodeHashHook(codePrefetchHook(touched, codeHashes))
 			}
-			resolver.AddRequest(req)
 		}
+		resolver.AddRequest(req)
 	}
-	return resolveFunc(resolver)
+	return resolver
 }
 
 func (tds *TrieDbState) populateAccountBlockProof(accountTouches common.Hashes) {
-	for _, addrHash := range accountTouches {
-		a := addrHash
-		tds.resolveSetBuilder.AddTouch(a[:])
-	}
+	tds.recordProof(func(b *trie.ResolveSetBuilder) {
+		for _, addrHash := range accountTouches {
+			a := addrHash
+			b.AddTouch(a[:])
+		}
+	})
 }
 
 // ExtractTouches returns two lists of keys - for accounts and storage items correspondingly
 // Each list is the collection of keys that have been "touched" (inserted, updated, or simply accessed)
 // since the last invocation of `ExtractTouches`.
 func (tds *TrieDbState) ExtractTouches() (accountTouches [][]byte, storageTouches [][]byte) {
+	if tds.proofSession != nil {
+		return tds.proofSession.ExtractTouches()
+	}
 	return tds.resolveSetBuilder.ExtractTouches()
 }
 
+// ExtractTypedTouches is the counterpart of ExtractTouches that returns the touches of accounts, storage items
+// and codes with the kinds of access and the indices of the buffers where they happened.
+// Touches are only recorded when resolveReads is set. The same item may be reported more than once
+func (tds *TrieDbState) ExtractTypedTouches() []trie.Touch {
+	if tds.proofSession != nil {
+		return tds.proofSession.ExtractTypedTouches()
+	}
+	return tds.resolveSetBuilder.ExtractTypedTouches()
+}
+
+// populateTypedTouches records the typed touches from all the buffers, in the order of buffers and keys
+func (tds *TrieDbState) populateTypedTouches() {
+	var touches []trie.Touch
+	for i, b := range tds.buffers {
+		for _, addrHash := range setKeys(b.created, true) {
+			touches = append(touches, trie.Touch{Key: addrHash[:], Kind: trie.TouchAccount, Access: trie.TouchCreate, BufferIndex: i})
+		}
+		for _, addrHash := range b.accountKeys(true) {
+			if _, ok := b.created[addrHash]; ok {
+				continue
+			}
+			access := trie.TouchWrite
+			if b.accountUpdates[addrHash] == nil {
+				access = trie.TouchDelete
+			}
+			touches = append(touches, trie.Touch{Key: addrHash[:], Kind: trie.TouchAccount, Access: access, BufferIndex: i})
+		}
+		for _, addrHash := range setKeys(b.accountReads, true) {
+			touches = append(touches, trie.Touch{Key: addrHash[:], Kind: trie.TouchAccount, Access: trie.TouchRead, BufferIndex: i})
+		}
+		for _, addrHash := range b.storageKeys(true) {
+			m := b.storageUpdates[addrHash]
+			for _, keyHash := range b.storageItemKeys(addrHash, true) {
+				access := trie.TouchWrite
+				if len(m[keyHash]) == 0 {
+					access = trie.TouchDelete
+				}
+				touches = append(touches, trie.Touch{Key: dbutils.GenerateCompositeTrieKey(addrHash, keyHash), Kind: trie.TouchStorage, Access: access, BufferIndex: i})
+			}
+		}
+		readAddrHashes := make([]common.Hash, 0, len(b.storageReads))
+		for addrHash := range b.storageReads {
+			readAddrHashes = append(readAddrHashes, addrHash)
+		}
+		sortHashes(readAddrHashes)
+		for _, addrHash := range readAddrHashes {
+			for _, keyHash := range setKeys(b.storageReads[addrHash], true) {
+				touches = append(touches, trie.Touch{Key: dbutils.GenerateCompositeTrieKey(addrHash, keyHash), Kind: trie.TouchStorage, Access: trie.TouchRead, BufferIndex: i})
+			}
+		}
+	}
+	tds.recordProof(func(b *trie.ResolveSetBuilder) {
+		for _, touch := range touches {
+			b.AddTypedTouch(touch)
+		}
+	})
+}
+
 func (tds *TrieDbState) resolveStateTrieWithFunc(resolveFunc func(*trie.Resolver) error) error {
 	// Aggregating the current buffer, if any
 	if tds.currentBuffer != nil {
@@ -545,10 +1007,11 @@ func (tds *TrieDbState) resolveStateTrieWithFunc(resolveFunc func(*trie.Resolver
 	defer tds.tMu.Unlock()
 
 	// Prepare (resolve) storage tries so that actual modifications can proceed without database access
-	storageTouches, _ := tds.buildStorageTouches(tds.resolveReads, false)
+	storageTouches, _ := tds.buildStorageTouches(tds.aggregateBuffer, tds.resolveReads, false)
 
 	// Prepare (resolve) accounts trie so that actual modifications can proceed without database access
-	accountTouches, _ := tds.buildAccountTouches(tds.resolveReads, false)
+	accountTouches, _ := tds.buildAccountTouches(tds.aggregateBuffer, tds.resolveReads, false)
+	tds.countPrefetchHits(accountTouches, storageTouches)
 	var err error
 
 	if err = tds.resolveAccountTouches(accountTouches, resolveFunc); err != nil {
@@ -557,6 +1020,7 @@ func (tds *TrieDbState) resolveStateTrieWithFunc(resolveFunc func(*trie.Resolver
 
 	if tds.resolveReads {
 		tds.populateAccountBlockProof(accountTouches)
+		tds.populateTypedTouches()
 	}
 
 	if err = tds.resolveStorageTouches(storageTouches, resolveFunc); err != nil {
@@ -571,17 +1035,44 @@ func (tds *TrieDbState) resolveStateTrieWithFunc(resolveFunc func(*trie.Resolver
 	return nil
 }
 
+// resolveSnapshot pins the current state for the resolutions of the accounts and of the storage, so that
+// both observe the same state even if a block is committed concurrently. It returns nil for the historical
+// state, and for the databases not supporting snapshots
+func (tds *TrieDbState) resolveSnapshot() (ethdb.Snapshot, error) {
+	if tds.historical {
+		return nil, nil
+	}
+	if s, ok := tds.db.(ethdb.Snapshotter); ok {
+		return s.NewSnapshot()
+	}
+	return nil, nil
+}
+
 // ResolveStateTrie resolves parts of the state trie that would be necessary for any updates
 // (and reads, if `resolveReads` is set).
 func (tds *TrieDbState) ResolveStateTrie(extractWitnesses bool) ([]*trie.Witness, error) {
 	var witnesses []*trie.Witness
+	var snapshot ethdb.Snapshot
+	var spent trie.ResolverStats
+	defer func() {
+		if snapshot != nil {
+			snapshot.Release()
+		}
+	}()
 
 	resolveFunc := func(resolver *trie.Resolver) error {
 		if resolver == nil {
 			return nil
 		}
+		if snapshot == nil {
+			var err error
+			if snapshot, err = tds.resolveSnapshot(); err != nil {
+				return err
+			}
+		}
+		resolver.SetSnapshot(snapshot)
 		resolver.CollectWitnesses(extractWitnesses)
-		if err := resolver.ResolveWithDb(tds.db, tds.blockNr); err != nil {
+		if err := tds.resolveWithDb(resolver, &spent); err != nil {
 			return err
 		}
 
@@ -602,13 +1093,88 @@ func (tds *TrieDbState) ResolveStateTrie(extractWitnesses bool) ([]*trie.Witness
 
 		return nil
 	}
-	if err := tds.resolveStateTrieWithFunc(resolveFunc); err != nil {
+	if err := tds.inPhase(context.Background(), PhaseResolve, func(context.Context) error {
+		return tds.resolveStateTrieWithFunc(resolveFunc)
+	}); err != nil {
 		return nil, err
 	}
 
 	return witnesses, nil
 }
 
+// SetResolveBudget limits the work of each resolution of the state trie (see trie.ResolveBudget). When the budget
+// is exhausted, the resolution fails with trie.ErrResolveBudgetExceeded, leaving the trie partially resolved.
+// The zero budget (the default) means no limit, which is required for the block processing
+func (tds *TrieDbState) SetResolveBudget(budget trie.ResolveBudget) {
+	tds.resolveBudget = budget
+}
+
+// resolveWithDb runs the resolver against the database, adding its cost to the statistics of the current block.
+// spent is the cost of the preceding resolvers of the same resolution, which is taken out of the budget
+func (tds *TrieDbState) resolveWithDb(resolver *trie.Resolver, spent *trie.ResolverStats) error {
+	return tds.runResolver(resolver, spent, func() error {
+		return resolver.ResolveWithDb(tds.db, tds.blockNr)
+	})
+}
+
+// resolveDetached is resolveWithDb for the block blockNr, without tMu held: the resolved subtries
+// are left to be hooked by trie.Resolver.HookResolved
+func (tds *TrieDbState) resolveDetached(resolver *trie.Resolver, blockNr uint64, spent *trie.ResolverStats) error {
+	return tds.runResolver(resolver, spent, func() error {
+		return resolver.ResolveDetached(tds.db, blockNr)
+	})
+}
+
+// runResolver runs the resolution within the resolution budget, and accounts for its cost
+func (tds *TrieDbState) runResolver(resolver *trie.Resolver, spent *trie.ResolverStats, resolve func() error) error {
+	if budget := tds.resolveBudget; budget != (trie.ResolveBudget{}) {
+		if budget.Time > 0 {
+			if budget.Time -= spent.AccountTime + spent.StorageTime; budget.Time <= 0 {
+				return trie.ErrResolveBudgetExceeded
+			}
+		}
+		if budget.Bytes > 0 {
+			if budget.Bytes -= spent.AccountBytes + spent.StorageBytes; budget.Bytes <= 0 {
+				return trie.ErrResolveBudgetExceeded
+			}
+		}
+		resolver.SetBudget(budget)
+	}
+	err := resolve()
+	stats := resolver.Stats()
+	spent.Add(stats)
+	tds.resolverStatsMu.Lock()
+	tds.resolverStats.Add(stats)
+	tds.resolverStatsMu.Unlock()
+	return err
+}
+
+// BlockResolverStats returns the cost of resolving the state trie for the last finished block,
+// that is the block passed to the last invocation of SetBlockNr
+func (tds *TrieDbState) BlockResolverStats() trie.ResolverStats {
+	tds.resolverStatsMu.Lock()
+	defer tds.resolverStatsMu.Unlock()
+	return tds.lastResolverStats
+}
+
+// finishResolverStats closes the statistics of the resolutions of the current block and reports them as metrics
+func (tds *TrieDbState) finishResolverStats() {
+	tds.resolverStatsMu.Lock()
+	defer tds.resolverStatsMu.Unlock()
+	s := tds.resolverStats
+	resolveAccountKeysMeter.Mark(int64(s.AccountKeys))
+	resolveStorageKeysMeter.Mark(int64(s.StorageKeys))
+	resolveAccountBytesMeter.Mark(int64(s.AccountBytes))
+	resolveStorageBytesMeter.Mark(int64(s.StorageBytes))
+	resolveAccountSubtriesMeter.Mark(int64(s.AccountSubtries))
+	resolveStorageSubtriesMeter.Mark(int64(s.StorageSubtries))
+	if s.Requests() > 0 {
+		resolveRequestTimer.Update(s.TimePerRequest())
+	}
+	tds.lastResolverStats = s
+	tds.resolverStats = trie.ResolverStats{}
+}
+
 // ResolveStateTrieStateless uses a witness DB to resolve subtries
 func (tds *TrieDbState) ResolveStateTrieStateless(database trie.WitnessStorage) error {
 	var startPos int64
@@ -617,7 +1183,7 @@ func (tds *TrieDbState) ResolveStateTrieStateless(database trie.WitnessStorage)
 			return nil
 		}
 
-		pos, err := resolver.ResolveStateless(database, tds.blockNr, MaxTrieCacheGen, startPos)
+		pos, err := resolver.ResolveStateless(database, tds.blockNr, tds.CacheGenLimit(), startPos)
 		if err != nil {
 			return err
 		}
@@ -629,27 +1195,164 @@ func (tds *TrieDbState) ResolveStateTrieStateless(database trie.WitnessStorage)
 	return tds.resolveStateTrieWithFunc(resolveFunc)
 }
 
+// SetAutoResolve controls whether CalcTrieRoots resolves (loads from the database) the parts of the trie
+// it needs, or returns NotResolvedError listing them. Auto-resolution is on by default
+func (tds *TrieDbState) SetAutoResolve(ar bool) {
+	tds.noAutoResolve = !ar
+}
+
+// SetReuseResolution makes repeated invocations of CalcTrieRoots within the same block (e.g. during
+// block building) skip the resolution checks for the keys that have already been checked
+func (tds *TrieDbState) SetReuseResolution(r bool) {
+	tds.reuseResolution = r
+	tds.resolvedAccounts = nil
+	tds.resolvedStorage = nil
+}
+
+// ensureResolved makes sure that the trie is resolved for all the given keys, either by resolving it,
+// or by returning NotResolvedError
+func (tds *TrieDbState) ensureResolved(accountKeys common.Hashes, storageKeys common.StorageKeys) error {
+	if tds.reuseResolution {
+		if tds.resolvedAccounts == nil {
+			tds.resolvedAccounts = make(map[common.Hash]struct{})
+			tds.resolvedStorage = make(map[common.StorageKey]struct{})
+		}
+		var aKeys common.Hashes
+		for _, addrHash := range accountKeys {
+			if _, ok := tds.resolvedAccounts[addrHash]; !ok {
+				aKeys = append(aKeys, addrHash)
+			}
+		}
+		var sKeys common.StorageKeys
+		for _, storageKey := range storageKeys {
+			if _, ok := tds.resolvedStorage[storageKey]; !ok {
+				sKeys = append(sKeys, storageKey)
+			}
+		}
+		accountKeys, storageKeys = aKeys, sKeys
+	}
+	if tds.noAutoResolve {
+		keys := make([][]byte, len(accountKeys))
+		for i := range accountKeys {
+			keys[i] = accountKeys[i][:]
+		}
+		requests := tds.t.NeedResolutionBatch(0, keys)
+		keys = make([][]byte, len(storageKeys))
+		for i := range storageKeys {
+			keys[i] = storageKeys[i][:]
+		}
+		requests = append(requests, tds.t.NeedResolutionBatch(common.HashLength, keys)...)
+		if len(requests) > 0 {
+			prefixes := make([][]byte, len(requests))
+			for i, req := range requests {
+				prefixes[i] = common.CopyBytes(req.Prefix())
+			}
+			return &NotResolvedError{Prefixes: prefixes}
+		}
+	} else {
+		var snapshot ethdb.Snapshot
+		var spent trie.ResolverStats
+		defer func() {
+			if snapshot != nil {
+				snapshot.Release()
+			}
+		}()
+		resolveFunc := func(resolver *trie.Resolver) error {
+			if resolver == nil {
+				return nil
+			}
+			if snapshot == nil {
+				var err error
+				if snapshot, err = tds.resolveSnapshot(); err != nil {
+					return err
+				}
+			}
+			resolver.SetSnapshot(snapshot)
+			return tds.resolveWithDb(resolver, &spent)
+		}
+		if err := tds.resolveAccountTouches(accountKeys, resolveFunc); err != nil {
+			return err
+		}
+		if err := tds.resolveStorageTouches(storageKeys, resolveFunc); err != nil {
+			return err
+		}
+	}
+	if tds.reuseResolution {
+		for _, addrHash := range accountKeys {
+			tds.resolvedAccounts[addrHash] = struct{}{}
+		}
+		for _, storageKey := range storageKeys {
+			tds.resolvedStorage[storageKey] = struct{}{}
+		}
+	}
+	return nil
+}
+
 // CalcTrieRoots calculates trie roots without modifying the state trie
 func (tds *TrieDbState) CalcTrieRoots(trace bool) (common.Hash, error) {
 	tds.tMu.Lock()
 	defer tds.tMu.Unlock()
 
+	if tds.aggregateBuffer == nil {
+		return tds.t.Hash(), nil
+	}
+
 	// Retrive the list of inserted/updated/deleted storage items (keys and values)
-	storageKeys, sValues := tds.buildStorageTouches(false, true)
+	storageKeys, sValues := tds.buildStorageTouches(tds.aggregateBuffer, false, true)
 	if trace {
-		fmt.Printf("len(storageKeys)=%d, len(sValues)=%d\n", len(storageKeys), len(sValues))
+		tds.getLogger().Info("Storage touches", "keys", len(storageKeys), "values", len(sValues))
 	}
 	// Retrive the list of inserted/updated/deleted accounts (keys and values)
-	accountKeys, aValues := tds.buildAccountTouches(false, true)
+	accountKeys, aValues := tds.buildAccountTouches(tds.aggregateBuffer, false, true)
 	if trace {
-		fmt.Printf("len(accountKeys)=%d, len(aValues)=%d\n", len(accountKeys), len(aValues))
+		tds.getLogger().Info("Account touches", "keys", len(accountKeys), "values", len(aValues))
+	}
+	if err := tds.ensureResolved(accountKeys, storageKeys); err != nil {
+		return common.Hash{}, err
 	}
-	return trie.HashWithModifications(tds.t, accountKeys, aValues, storageKeys, sValues, common.HashLength, trace)
+	t, err := tds.concreteTrie()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	var root common.Hash
+	err = tds.inPhase(context.Background(), PhaseHash, func(context.Context) error {
+		var err error
+		root, err = trie.HashWithModifications(t, accountKeys, aValues, storageKeys, sValues, common.HashLength, trace)
+		return err
+	})
+	return root, err
+}
+
+// RootAfterBuffer computes the state root as it would be after applying the buffers 0..i of the current block,
+// without modifying the trie. It can be used to produce intermediate roots (e.g. for pre-Byzantium receipts)
+// before UpdateStateTrie is called. As for CalcTrieRoots, the trie needs to be resolved (see ResolveStateTrie)
+func (tds *TrieDbState) RootAfterBuffer(i int) (common.Hash, error) {
+	if i < 0 || i >= len(tds.buffers) {
+		return common.Hash{}, fmt.Errorf("buffer index %d out of range [0, %d)", i, len(tds.buffers))
+	}
+	tds.tMu.Lock()
+	defer tds.tMu.Unlock()
+
+	var aggregate Buffer
+	aggregate.initialise()
+	for _, b := range tds.buffers[:i+1] {
+		aggregate.merge(b)
+	}
+	storageKeys, sValues := tds.buildStorageTouches(&aggregate, false, true)
+	accountKeys, aValues := tds.buildAccountTouches(&aggregate, false, true)
+	t, err := tds.concreteTrie()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return trie.HashWithModifications(t, accountKeys, aValues, storageKeys, sValues, common.HashLength, false)
 }
 
 // forward is `true` if the function is used to progress the state forward (by adding blocks)
 // forward is `false` if the function is used to rewind the state (for reorgs, for example)
-func (tds *TrieDbState) updateTrieRoots(forward bool) ([]common.Hash, error) {
+func (tds *TrieDbState) updateTrieRoots(ctx context.Context, forward bool) ([]common.Hash, error) {
+	atomic.AddUint64(&tds.trieVersion, 1)
+	// The updates are not attributed to the transaction executed last
+	tds.SetTouchOrigin(TouchOrigin{})
 	accountUpdates := tds.aggregateBuffer.accountUpdates
 	// Perform actual updates on the tries, and compute one trie root per buffer
 	// These roots can be used to populate receipt.PostState on pre-Byzantium
@@ -657,9 +1360,10 @@ func (tds *TrieDbState) updateTrieRoots(forward bool) ([]common.Hash, error) {
 	// The following map is to prevent repeated clearouts of the storage
 	alreadyCreated := make(map[common.Hash]struct{})
 	for i, b := range tds.buffers {
+		tds.view.invalidate(b)
 		// New contracts are being created at these addresses. Therefore, we need to clear the storage items
 		// that might be remaining in the trie and figure out the next incarnations
-		for addrHash := range b.created {
+		for _, addrHash := range setKeys(b.created, tds.deterministic) {
 			// Prevent repeated storage clearouts
 			if _, ok := alreadyCreated[addrHash]; ok {
 				continue
@@ -676,16 +1380,18 @@ func (tds *TrieDbState) updateTrieRoots(forward bool) ([]common.Hash, error) {
 			tds.t.DeleteSubtree(addrHash[:], tds.blockNr)
 		}
 
-		for addrHash, account := range b.accountUpdates {
-			if account != nil {
+		for _, addrHash := range b.accountKeys(tds.deterministic) {
+			if account := b.accountUpdates[addrHash]; account != nil {
 				//fmt.Println("b.accountUpdates",addrHash.String(), account.Incarnation)
 				tds.t.UpdateAccount(addrHash[:], account)
 			} else {
 				tds.t.Delete(addrHash[:], tds.blockNr)
 			}
 		}
-		for addrHash, m := range b.storageUpdates {
-			for keyHash, v := range m {
+		for _, addrHash := range b.storageKeys(tds.deterministic) {
+			m := b.storageUpdates[addrHash]
+			for _, keyHash := range b.storageItemKeys(addrHash, tds.deterministic) {
+				v := m[keyHash]
 				cKey := dbutils.GenerateCompositeTrieKey(addrHash, keyHash)
 				if len(v) > 0 {
 					//fmt.Printf("Update storage trie addrHash %x, keyHash %x: %x\n", addrHash, keyHash, v)
@@ -748,7 +1454,7 @@ func (tds *TrieDbState) updateTrieRoots(forward bool) ([]common.Hash, error) {
 					}
 
 					if account.Root != h {
-						return nil, fmt.Errorf("mismatched storage root for %x: expected %x, got %x", addrHash, account.Root, h)
+						return nil, tds.storageRootMismatch(addrHash, account, h, b)
 					}
 				}
 				if account, ok := accountUpdates[addrHash]; ok && account != nil {
@@ -758,15 +1464,15 @@ func (tds *TrieDbState) updateTrieRoots(forward bool) ([]common.Hash, error) {
 					}
 
 					if account.Root != h {
-						return nil, fmt.Errorf("mismatched storage root for %x: expected %x, got %x", addrHash, account.Root, h)
+						return nil, tds.storageRootMismatch(addrHash, account, h, b)
 					}
 				}
 			}
 		}
 
 		// For the contracts that got deleted
-		for addrHash := range b.deleted {
-			if _, ok := b.created[addrHash]; ok {
+		for _, addrHash := range setKeys(b.deleted, tds.deterministic) {
+			if _, ok := b.recreated[addrHash]; ok {
 				// In some rather artificial circumstances, an account can be recreated after having been self-destructed
 				// in the same block. It can only happen when contract is introduced in the genesis state with nonce 0
 				// rather than created by a transaction (in that case, its starting nonce is 1). The self-destructed
@@ -774,7 +1480,7 @@ func (tds *TrieDbState) updateTrieRoots(forward bool) ([]common.Hash, error) {
 				// it will prevent any re-creation within the same block. However, if the contract is introduced in
 				// the genesis state, its nonce is 0, and that means it can be self-destructed, and then re-created,
 				// all in the same block. In such cases, we must preserve storage modifications happening after the
-				// self-destruction
+				// self-destruction. Such re-creations are signalled explicitly by the EVM layer (see ContractRecreator)
 				continue
 			}
 			if account, ok := b.accountUpdates[addrHash]; ok && account != nil {
@@ -787,7 +1493,10 @@ func (tds *TrieDbState) updateTrieRoots(forward bool) ([]common.Hash, error) {
 			}
 			tds.t.DeleteSubtree(addrHash[:], tds.blockNr)
 		}
-		roots[i] = tds.t.Hash()
+		_ = tds.inPhase(ctx, PhaseHash, func(context.Context) error {
+			roots[i] = tds.t.Hash()
+			return nil
+		})
 	}
 	return roots, nil
 }
@@ -796,81 +1505,124 @@ func (tds *TrieDbState) clearUpdates() {
 	tds.buffers = nil
 	tds.currentBuffer = nil
 	tds.aggregateBuffer = nil
+	tds.blockStorageWrites = nil
+	tds.savepoints = nil
+	tds.resolvedAccounts = nil
+	tds.resolvedStorage = nil
 }
 
 func (tds *TrieDbState) Rebuild() error {
 	tds.tMu.Lock()
 	defer tds.tMu.Unlock()
+	if tds.binaryAt(tds.blockNr) {
+		return tds.rebuildBinary()
+	}
 	err := tds.t.Rebuild(tds.db, tds.blockNr)
 	if err != nil {
 		return err
 	}
-
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-	log.Info("Memory after rebuild", "nodes", tds.tp.NodeCount(), "alloc", int(m.Alloc/1024), "sys", int(m.Sys/1024), "numGC", int(m.NumGC))
+	tds.view.reset()
+	tds.logMemStats(false, "Memory after rebuild", "nodes", tds.tp.NodeCount())
 	return nil
 }
 
 func (tds *TrieDbState) SetBlockNr(blockNr uint64) {
+	tds.finishResolverStats()
+	tds.finishPhaseStats()
 	tds.setBlockNr(blockNr)
+	tds.touchMu.Lock()
+	tds.finishTouchStats()
 	tds.tp.SetBlockNr(blockNr)
+	tds.touchMu.Unlock()
+	tds.t.SetGeneration(blockNr)
 }
 
 func (tds *TrieDbState) GetBlockNr() uint64 {
 	return tds.getBlockNr()
 }
 
+// unwoundStorageItem is the storage item restored by UnwindTo
+type unwoundStorageItem struct {
+	addrHash    common.Hash
+	incarnation uint64
+	keyHash     common.Hash
+	value       []byte
+}
+
+// flatIncarnation returns the incarnation of the account in the current state, 0 if the account does not exist
+func (tds *TrieDbState) flatIncarnation(addrHash common.Hash) (uint64, error) {
+	enc, err := tds.db.Get(dbutils.AccountsBucket, addrHash[:])
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return 0, err
+	}
+	if len(enc) == 0 {
+		return 0, nil
+	}
+	var acc accounts.Account
+	if err = acc.DecodeForStorage(enc); err != nil {
+		return 0, err
+	}
+	return acc.Incarnation, nil
+}
+
 func (tds *TrieDbState) UnwindTo(blockNr uint64) error {
+	// Background prefetch must not resolve from the database being unwound
+	atomic.AddUint64(&tds.trieVersion, 1)
 	tds.StartNewBuffer()
 	b := tds.currentBuffer
+	// Writes of the unwind are streamed to the followers as the revert
+	db := tds.revertRecorder(blockNr)
 
+	// Incarnations of the accounts before the unwind, for the accounts being restored.
+	// Zero means that the account does not exist
+	prevIncarnations := make(map[common.Hash]uint64)
+	var storageItems []unwoundStorageItem
 	if err := tds.db.RewindData(tds.blockNr, blockNr, func(bucket, key, value []byte) error {
 		//fmt.Printf("bucket: %x, key: %x, value: %x\n", bucket, key, value)
-		if bytes.Equal(bucket, dbutils.AccountsHistoryBucket) {
-			var addrHash common.Hash
-			copy(addrHash[:], key)
-			if len(value) > 0 {
-				var acc accounts.Account
-				if err := acc.DecodeForStorage(value); err != nil {
-					return err
-				}
+		rec, err := DecodeHistoryRecord(bucket, key, value)
+		if err != nil {
+			return err
+		}
+		addrHash := rec.AddrHash
+		if rec.IsAccount() {
+			prevIncarnation, err := tds.flatIncarnation(addrHash)
+			if err != nil {
+				return err
+			}
+			prevIncarnations[addrHash] = prevIncarnation
+			if acc := rec.Account; acc != nil {
 				// Fetch the code hash
 				if acc.Incarnation > 0 && debug.IsThinHistory() && acc.IsEmptyCodeHash() {
 					if codeHash, err := tds.db.Get(dbutils.ContractCodeBucket, dbutils.GenerateStoragePrefix(addrHash, acc.Incarnation)); err == nil {
 						copy(acc.CodeHash[:], codeHash)
 					}
 				}
-				b.accountUpdates[addrHash] = &acc
-				value = make([]byte, acc.EncodingLengthForStorage())
-				acc.EncodeForStorage(value)
-				if err := tds.db.Put(dbutils.AccountsBucket, addrHash[:], value); err != nil {
+				b.accountUpdates[addrHash] = acc
+				if err := db.Put(dbutils.AccountsBucket, addrHash[:], rec.EncodeValue()); err != nil {
 					return err
 				}
 			} else {
 				b.accountUpdates[addrHash] = nil
-				if err := tds.db.Delete(dbutils.AccountsBucket, addrHash[:]); err != nil {
+				if err := db.Delete(dbutils.AccountsBucket, addrHash[:]); err != nil {
 					return err
 				}
 			}
-		} else if bytes.Equal(bucket, dbutils.StorageHistoryBucket) {
-			var addrHash common.Hash
-			copy(addrHash[:], key[:common.HashLength])
-			var keyHash common.Hash
-			copy(keyHash[:], key[common.HashLength+common.IncarnationLength:])
-			m, ok := b.storageUpdates[addrHash]
-			if !ok {
-				m = make(map[common.Hash][]byte)
-				b.storageUpdates[addrHash] = m
+		} else {
+			storageItems = append(storageItems, unwoundStorageItem{addrHash: addrHash, incarnation: rec.Incarnation, keyHash: rec.KeyHash, value: rec.Value})
+			compositeKey := rec.Key()
+			current, err := tds.db.Get(dbutils.StorageBucket, compositeKey)
+			if err != nil && err != ethdb.ErrKeyNotFound {
+				return err
+			}
+			if err := updateStorageSize(db, compositeKey, current, rec.Value); err != nil {
+				return err
 			}
-			if len(value) > 0 {
-				m[keyHash] = value
-				if err := tds.db.Put(dbutils.StorageBucket, key[:common.HashLength+common.IncarnationLength+common.HashLength], value); err != nil {
+			if len(rec.Value) > 0 {
+				if err := db.Put(dbutils.StorageBucket, compositeKey, rec.Value); err != nil {
 					return err
 				}
 			} else {
-				m[keyHash] = nil
-				if err := tds.db.Delete(dbutils.StorageBucket, key[:common.HashLength+common.IncarnationLength+common.HashLength]); err != nil {
+				if err := db.Delete(dbutils.StorageBucket, compositeKey); err != nil {
 					return err
 				}
 			}
@@ -879,28 +1631,101 @@ func (tds *TrieDbState) UnwindTo(blockNr uint64) error {
 	}); err != nil {
 		return err
 	}
+	// Accounts that are restored with a different incarnation (unwinding across a self-destruct or a re-creation)
+	// get their storage from the restored storage root, rather than from the items modified in the unwound blocks.
+	// The storage of the incarnation being restored is still in the database, because it is scoped by the incarnation
+	// Thin history does not keep the storage roots, so the storage has to be re-built from the modified items
+	recreated := make(map[common.Hash]struct{})
+	for addrHash, prevIncarnation := range prevIncarnations {
+		if debug.IsThinHistory() {
+			break
+		}
+		if acc := b.accountUpdates[addrHash]; acc != nil && acc.Incarnation != prevIncarnation {
+			recreated[addrHash] = struct{}{}
+		}
+	}
+	if len(recreated) > 0 {
+		tds.tMu.Lock()
+		tds.view.reset()
+		for addrHash := range recreated {
+			// Account node goes away together with the storage of the other incarnation, and updateTrieRoots
+			// puts it back with the storage sub-trie represented by the hash of the restored storage root
+			tds.t.Delete(addrHash[:], tds.blockNr)
+		}
+		tds.tMu.Unlock()
+	}
+	for _, item := range storageItems {
+		if _, ok := recreated[item.addrHash]; ok {
+			continue
+		}
+		if acc, ok := b.accountUpdates[item.addrHash]; ok && (acc == nil || acc.Incarnation != item.incarnation) {
+			// Storage of other incarnations does not belong to the restored account
+			continue
+		}
+		m, ok := b.storageUpdates[item.addrHash]
+		if !ok {
+			m = make(map[common.Hash][]byte)
+			b.storageUpdates[item.addrHash] = m
+		}
+		if len(item.value) > 0 {
+			m[item.keyHash] = item.value
+		} else {
+			m[item.keyHash] = nil
+		}
+	}
 	if _, err := tds.ResolveStateTrie(false); err != nil {
 		return err
 	}
 
 	tds.tMu.Lock()
 	defer tds.tMu.Unlock()
-	if _, err := tds.updateTrieRoots(false); err != nil {
+	if _, err := tds.updateTrieRoots(context.Background(), false); err != nil {
+		return err
+	}
+	// Unwinding is rare, the values are simply read again
+	tds.view.reset()
+	if err := ethdb.UnwindHistoryBitmaps(db, blockNr); err != nil {
 		return err
 	}
+	if err := invalidateStateChecksum(db); err != nil {
+		return err
+	}
+	tds.resetCrossValidation()
 	for i := tds.blockNr; i > blockNr; i-- {
-		if err := tds.db.DeleteTimestamp(i); err != nil {
+		if err := deleteBlockRecords(db, i); err != nil {
+			return err
+		}
+	}
+	if err := unwindUndoLog(db, blockNr); err != nil {
+		return err
+	}
+	if tds.lastTouches != nil {
+		tds.lastTouches = make(map[common.Hash]bool)
+		if err := unwindLastTouches(db, blockNr); err != nil {
 			return err
 		}
 	}
+	if tds.codeReads != nil {
+		tds.codeReads = make(map[common.Hash]struct{})
+	}
 
 	tds.clearUpdates()
+	unwoundFrom := tds.blockNr
 	tds.setBlockNr(blockNr)
+	if !tds.binaryAt(blockNr) {
+		if err := tds.restoreHexary(); err != nil {
+			return err
+		}
+	}
+	tds.exportRevert(blockNr+1, unwoundFrom)
 	return nil
 }
 
 func (tds *TrieDbState) readAccountDataByHash(addrHash common.Hash) (*accounts.Account, error) {
 	if acc, ok := tds.GetAccount(addrHash); ok {
+		if acc == nil {
+			return nil, ErrAccountNotFound
+		}
 		return acc, nil
 	}
 
@@ -909,17 +1734,14 @@ func (tds *TrieDbState) readAccountDataByHash(addrHash common.Hash) (*accounts.A
 	var enc []byte
 	if tds.historical {
 		enc, err = tds.db.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, addrHash[:], tds.blockNr+1)
-		if err != nil {
-			enc = nil
-		}
 	} else {
 		enc, err = tds.db.Get(dbutils.AccountsBucket, addrHash[:])
-		if err != nil {
-			enc = nil
-		}
+	}
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, err
 	}
 	if len(enc) == 0 {
-		return nil, nil
+		return nil, ErrAccountNotFound
 	}
 	var a accounts.Account
 	if err := a.DecodeForStorage(enc); err != nil {
@@ -931,31 +1753,48 @@ func (tds *TrieDbState) readAccountDataByHash(addrHash common.Hash) (*accounts.A
 		if err == nil {
 			a.CodeHash = common.BytesToHash(codeHash)
 		} else {
-			log.Error("Get code hash is incorrect", "err", err)
+			tds.getLogger().Error("Get code hash is incorrect", "err", err)
 		}
 	}
 	return &a, nil
 }
 
 func (tds *TrieDbState) GetAccount(addrHash common.Hash) (*accounts.Account, bool) {
-	tds.tMu.Lock()
-	defer tds.tMu.Unlock()
+	if acc, touches, ok := tds.view.account(addrHash); ok {
+		tds.touchView(touches)
+		return acc, true
+	}
+	tds.tMu.RLock()
+	defer tds.tMu.RUnlock()
 	acc, ok := tds.t.GetAccount(addrHash[:])
+	if ok {
+		tds.view.addAccount(addrHash, acc, tds.viewTouches(addrHash[:]))
+	}
 	return acc, ok
 }
 
 func (tds *TrieDbState) ReadAccountData(address common.Address) (*accounts.Account, error) {
-	addrHash, err := common.HashData(address[:])
+	addrHash, err := tds.hashAddress(address)
 	if err != nil {
 		return nil, err
 	}
-	if tds.resolveReads {
+	if tds.resolveReads || tds.lastTouches != nil {
 		if _, ok := tds.currentBuffer.accountUpdates[addrHash]; !ok {
 			tds.currentBuffer.accountReads[addrHash] = struct{}{}
 		}
 	}
 
-	return tds.readAccountDataByHash(addrHash)
+	acc, err := tds.readAccountDataByHash(addrHash)
+	if err == ErrAccountNotFound {
+		acc, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tds.captureReadValues {
+		tds.captureAccountRead(addrHash, acc)
+	}
+	return acc, nil
 }
 
 func (tds *TrieDbState) savePreimage(save bool, hash, preimage []byte) error {
@@ -971,14 +1810,60 @@ func (tds *TrieDbState) savePreimage(save bool, hash, preimage []byte) error {
 }
 
 func (tds *TrieDbState) HashAddress(address common.Address, save bool) (common.Hash, error) {
-	addrHash, err := common.HashData(address[:])
+	addrHash, err := tds.hashAddress(address)
 	if err != nil {
 		return common.Hash{}, err
 	}
+	if tds.rawKeys {
+		return addrHash, nil
+	}
 	return addrHash, tds.savePreimage(save, addrHash[:], address[:])
 }
 
+// SetAddrHashCacheSize sets the number of address hashes remembered to avoid hashing the same addresses
+// over and over again (by ReadAccountData and the state writers). Zero disables the cache
+func (tds *TrieDbState) SetAddrHashCacheSize(size int) error {
+	if size == 0 {
+		tds.addrHashCache = nil
+		return nil
+	}
+	c, err := lru.New(size)
+	if err != nil {
+		return err
+	}
+	tds.addrHashCache = c
+	return nil
+}
+
+func (tds *TrieDbState) hashAddress(address common.Address) (common.Hash, error) {
+	if tds.rawKeys {
+		return common.BytesToHash(address[:]), nil
+	}
+	if tds.frequentActors != nil {
+		if h, ok := tds.frequentActors.lookupHash(address); ok {
+			return h, nil
+		}
+	}
+	if tds.addrHashCache == nil {
+		return common.HashData(address[:])
+	}
+	if h, ok := tds.addrHashCache.Get(address); ok {
+		addrHashHitCounter.Inc(1)
+		return h.(common.Hash), nil
+	}
+	addrHashMissCounter.Inc(1)
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return common.Hash{}, err
+	}
+	tds.addrHashCache.Add(address, addrHash)
+	return addrHash, nil
+}
+
 func (tds *TrieDbState) HashKey(key *common.Hash, save bool) (common.Hash, error) {
+	if tds.rawKeys {
+		return *key, nil
+	}
 	keyHash, err := common.HashData(key[:])
 	if err != nil {
 		return common.Hash{}, err
@@ -987,6 +1872,11 @@ func (tds *TrieDbState) HashKey(key *common.Hash, save bool) (common.Hash, error
 }
 
 func (tds *TrieDbState) GetKey(shaKey []byte) []byte {
+	if tds.frequentActors != nil {
+		if address, ok := tds.frequentActors.lookupAddress(shaKey); ok {
+			return address
+		}
+	}
 	key, _ := tds.db.Get(dbutils.PreimagePrefix, shaKey)
 	return key
 }
@@ -1030,9 +1920,18 @@ func (tds *TrieDbState) ReadAccountStorage(address common.Address, incarnation u
 		}
 	}
 
-	tds.tMu.Lock()
-	enc, ok := tds.t.Get(dbutils.GenerateCompositeTrieKey(addrHash, seckey))
-	defer tds.tMu.Unlock()
+	enc, touches, ok := tds.view.storage(addrHash, incarnation, seckey)
+	if ok {
+		tds.touchView(touches)
+	} else {
+		tds.tMu.RLock()
+		trieKey := dbutils.GenerateCompositeTrieKey(addrHash, seckey)
+		enc, ok = tds.t.GetStorage(trieKey, incarnation)
+		if ok {
+			tds.view.addStorage(addrHash, incarnation, seckey, enc, tds.viewTouches(trieKey))
+		}
+		tds.tMu.RUnlock()
+	}
 	if !ok {
 		// Not present in the trie, try database
 		if tds.historical {
@@ -1047,10 +1946,25 @@ func (tds *TrieDbState) ReadAccountStorage(address common.Address, incarnation u
 			}
 		}
 	}
+	if tds.captureReadValues {
+		tds.captureStorageRead(addrHash, seckey, enc)
+	}
 	return enc, nil
 }
 
-func (tds *TrieDbState) ReadAccountCode(address common.Address, codeHash common.Hash) (code []byte, err error) {
+func (tds *TrieDbState) ReadAccountCode(address common.Address, codeHash common.Hash) ([]byte, error) {
+	code, err := tds.readAccountCode(address, codeHash)
+	if err == nil && len(code) > 0 {
+		if err := tds.recordCodeRead(address); err != nil {
+			return nil, err
+		}
+	}
+	return code, err
+}
+
+// readAccountCode reads the code without counting it as the read of the contract (see SetCodeReads),
+// which ReadAccountCodeSize is not
+func (tds *TrieDbState) readAccountCode(address common.Address, codeHash common.Hash) (code []byte, err error) {
 	if bytes.Equal(codeHash[:], emptyCodeHash) {
 		return nil, nil
 	}
@@ -1064,14 +1978,18 @@ func (tds *TrieDbState) ReadAccountCode(address common.Address, codeHash common.
 		}
 	}
 	if tds.resolveReads {
-		addrHash, err1 := common.HashData(address[:])
+		addrHash, err1 := tds.hashAddress(address)
 		if err1 != nil {
 			return nil, err
 		}
 		if _, ok := tds.currentBuffer.accountUpdates[addrHash]; !ok {
 			tds.currentBuffer.accountReads[addrHash] = struct{}{}
 		}
-		tds.resolveSetBuilder.ReadCode(codeHash, code)
+		bufferIndex := len(tds.buffers) - 1
+		tds.recordProof(func(b *trie.ResolveSetBuilder) {
+			b.ReadCode(codeHash, code)
+			b.AddTypedTouch(trie.Touch{Key: codeHash[:], Kind: trie.TouchCode, Access: trie.TouchRead, BufferIndex: bufferIndex})
+		})
 	}
 	return code, err
 }
@@ -1084,94 +2002,108 @@ func (tds *TrieDbState) ReadAccountCodeSize(address common.Address, codeHash com
 			if cachedCode, ok := tds.codeCache.Get(codeHash); ok {
 				code, err = cachedCode.([]byte), nil
 			} else {
-				code, err = tds.ReadAccountCode(address, codeHash)
+				code, err = tds.readAccountCode(address, codeHash)
 				if err != nil {
 					return 0, err
 				}
 			}
 		}
 	} else {
-		code, err = tds.ReadAccountCode(address, codeHash)
-		if err != nil {
-			return 0, err
+		var found bool
+		if !tds.resolveReads {
+			// The code itself is only needed when building the witness
+			if codeSize, found, err = readCodeSize(tds.db, codeHash); err != nil {
+				return 0, err
+			}
+			if found {
+				tds.codeSizeCache.Add(codeHash, codeSize)
+			}
+		}
+		if !found {
+			code, err = tds.readAccountCode(address, codeHash)
+			if err != nil {
+				return 0, err
+			}
+			codeSize = len(code)
 		}
-		codeSize = len(code)
 	}
 	if tds.resolveReads {
-		addrHash, err1 := common.HashData(address[:])
+		addrHash, err1 := tds.hashAddress(address)
 		if err1 != nil {
 			return 0, err
 		}
 		if _, ok := tds.currentBuffer.accountUpdates[addrHash]; !ok {
 			tds.currentBuffer.accountReads[addrHash] = struct{}{}
 		}
-		tds.resolveSetBuilder.ReadCode(codeHash, code)
+		bufferIndex := len(tds.buffers) - 1
+		tds.recordProof(func(b *trie.ResolveSetBuilder) {
+			b.ReadCode(codeHash, code)
+			b.AddTypedTouch(trie.Touch{Key: codeHash[:], Kind: trie.TouchCode, Access: trie.TouchRead, BufferIndex: bufferIndex})
+		})
 	}
 	return codeSize, nil
 }
 
 // nextIncarnation determines what should be the next incarnation of an account (i.e. how many time it has existed before at this address)
 func (tds *TrieDbState) nextIncarnation(addrHash common.Hash) (uint64, error) {
-	var found bool
-	var incarnationBytes [common.IncarnationLength]byte
 	if tds.historical {
-		// We reserve ethdb.MaxTimestampLength (8) at the end of the key to accomodate any possible timestamp
-		// (timestamp's encoding may have variable length)
-		startkey := make([]byte, common.HashLength+common.IncarnationLength+common.HashLength+ethdb.MaxTimestampLength)
-		var fixedbits uint = 8 * common.HashLength
-		copy(startkey, addrHash[:])
-		if err := tds.db.WalkAsOf(dbutils.StorageBucket, dbutils.StorageHistoryBucket, startkey, fixedbits, tds.blockNr, func(k, _ []byte) (bool, error) {
-			copy(incarnationBytes[:], k[common.HashLength:])
-			found = true
-			return false, nil
-		}); err != nil {
-			return 0, err
-		}
-	} else {
-		startkey := make([]byte, common.HashLength+common.IncarnationLength+common.HashLength)
-		var fixedbits uint = 8 * common.HashLength
-		copy(startkey, addrHash[:])
-		if err := tds.db.Walk(dbutils.StorageBucket, startkey, fixedbits, func(k, v []byte) (bool, error) {
-			copy(incarnationBytes[:], k[common.HashLength:])
-			found = true
-			return false, nil
-		}); err != nil {
-			return 0, err
-		}
+		return accounts.NextIncarnationAsOf(tds.db, addrHash, tds.blockNr)
 	}
-	if found {
-		return (^uint64(0) ^ binary.BigEndian.Uint64(incarnationBytes[:])) + 1, nil
-	}
-	return FirstContractIncarnation, nil
+	return accounts.NextIncarnation(tds.db, addrHash)
 }
 
-var prevMemStats runtime.MemStats
-
 type TrieStateWriter struct {
 	tds *TrieDbState
 }
 
+// SetCacheGenLimit changes the number of trie nodes kept in memory by PruneTries for this instance.
+// It is safe to call concurrently with the block processing
+func (tds *TrieDbState) SetCacheGenLimit(limit uint32) {
+	atomic.StoreUint32(&tds.cacheGenLimit, limit)
+}
+
+func (tds *TrieDbState) CacheGenLimit() uint32 {
+	return atomic.LoadUint32(&tds.cacheGenLimit)
+}
+
+// PruneTries unloads the least recently touched nodes of the trie, so that at most CacheGenLimit of them remain.
+// It does nothing for the binary trie (see ErrBinaryTrieNotPrunable)
 func (tds *TrieDbState) PruneTries(print bool) {
 	tds.tMu.Lock()
 	defer tds.tMu.Unlock()
 	if print {
 		prunableNodes := tds.t.CountPrunableNodes()
-		fmt.Printf("[Before] Actual prunable nodes: %d, accounted: %d\n", prunableNodes, tds.tp.NodeCount())
+		tds.getLogger().Info("Prunable nodes before pruning", "actual", prunableNodes, "accounted", tds.tp.NodeCount())
 	}
 
-	tds.tp.PruneTo(tds.t, int(MaxTrieCacheGen))
-
-	if print {
-		prunableNodes := tds.t.CountPrunableNodes()
-		fmt.Printf("[After] Actual prunable nodes: %d, accounted: %d\n", prunableNodes, tds.tp.NodeCount())
+	t, err := tds.concreteTrie()
+	if err != nil {
+		tds.getLogger().Warn("Skipping pruning", "err", err)
+		return
+	}
+	if t.IsBinary() {
+		if print {
+			tds.getLogger().Warn("Skipping pruning", "err", ErrBinaryTrieNotPrunable)
+		}
+		return
+	}
+	limit := tds.CacheGenLimit()
+	_ = tds.inPhase(context.Background(), PhasePrune, func(context.Context) error {
+		tds.tp.PruneTo(t, int(limit))
+		return nil
+	})
+	// Pruned nodes may need to be resolved again
+	tds.resolvedAccounts = nil
+	tds.resolvedStorage = nil
+	if tds.view.full() {
+		tds.view.reset()
 	}
 
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-	log.Info("Memory", "nodes", tds.tp.NodeCount(), "alloc", int(m.Alloc/1024), "sys", int(m.Sys/1024), "numGC", int(m.NumGC))
 	if print {
-		fmt.Printf("Pruning done. Nodes: %d, alloc: %d, sys: %d, numGC: %d\n", tds.tp.NodeCount(), int(m.Alloc/1024), int(m.Sys/1024), int(m.NumGC))
+		prunableNodes := tds.t.CountPrunableNodes()
+		tds.getLogger().Info("Prunable nodes after pruning", "actual", prunableNodes, "accounted", tds.tp.NodeCount())
 	}
+	tds.logMemStats(print, "Memory", "nodes", tds.tp.NodeCount(), "limit", limit)
 }
 
 func (tds *TrieDbState) TrieStateWriter() *TrieStateWriter {
@@ -1179,7 +2111,18 @@ func (tds *TrieDbState) TrieStateWriter() *TrieStateWriter {
 }
 
 func (tds *TrieDbState) DbStateWriter() *DbStateWriter {
-	return &DbStateWriter{tds: tds}
+	dsw := &DbStateWriter{tds: tds, db: tds.db}
+	if tds.changeStreamer != nil {
+		tds.blockChanges()
+		dsw.db = &changeRecorder{Database: tds.db, record: tds.recordChange}
+	}
+	if tds.historyBatching {
+		dsw.history = make(map[string][]ethdb.KV)
+	}
+	if tds.stateChecksum {
+		dsw.checksumDelta = new(common.Hash)
+	}
+	return dsw
 }
 
 func accountsEqual(a1, a2 *accounts.Account) bool {
@@ -1207,7 +2150,7 @@ func accountsEqual(a1, a2 *accounts.Account) bool {
 	} else if a1.CodeHash != a2.CodeHash {
 		return false
 	}
-	return true
+	return bytes.Equal(a1.Extra, a2.Extra)
 }
 
 func (tsw *TrieStateWriter) UpdateAccountData(_ context.Context, address common.Address, original, account *accounts.Account) error {
@@ -1216,7 +2159,13 @@ func (tsw *TrieStateWriter) UpdateAccountData(_ context.Context, address common.
 		return err
 	}
 
-	tsw.tds.currentBuffer.accountUpdates[addrHash] = account
+	// The account of the state object is copied, because the state objects are recycled (see IntraBlockState.Reset)
+	acc := new(accounts.Account)
+	acc.Copy(account)
+	tsw.tds.currentBuffer.accountUpdates[addrHash] = acc
+	if tsw.tds.txChanges != nil {
+		tsw.tds.recordTxChange(dbutils.AccountsHistoryBucket, addrHash[:], NewAccountHistoryRecord(addrHash, account).EncodeValue())
+	}
 	return nil
 }
 
@@ -1228,12 +2177,17 @@ func (tsw *TrieStateWriter) DeleteAccount(_ context.Context, address common.Addr
 	tsw.tds.currentBuffer.accountUpdates[addrHash] = nil
 	delete(tsw.tds.currentBuffer.storageUpdates, addrHash)
 	tsw.tds.currentBuffer.deleted[addrHash] = struct{}{}
+	tsw.tds.recordTxChange(dbutils.AccountsHistoryBucket, addrHash[:], []byte{})
 	return nil
 }
 
 func (tsw *TrieStateWriter) UpdateAccountCode(addrHash common.Hash, incarnation uint64, codeHash common.Hash, code []byte) error {
 	if tsw.tds.resolveReads {
-		tsw.tds.resolveSetBuilder.CreateCode(codeHash, code)
+		bufferIndex := len(tsw.tds.buffers) - 1
+		tsw.tds.recordProof(func(b *trie.ResolveSetBuilder) {
+			b.CreateCode(codeHash, code)
+			b.AddTypedTouch(trie.Touch{Key: codeHash[:], Kind: trie.TouchCode, Access: trie.TouchCreate, BufferIndex: bufferIndex})
+		})
 	}
 	return nil
 }
@@ -1259,27 +2213,59 @@ func (tsw *TrieStateWriter) WriteAccountStorage(_ context.Context, address commo
 	} else {
 		m[seckey] = nil
 	}
+	if tsw.tds.txChanges != nil {
+		tsw.tds.recordTxChange(dbutils.StorageHistoryBucket, dbutils.GenerateCompositeStorageKey(addrHash, incarnation, seckey), common.CopyBytes(v))
+	}
 	//fmt.Printf("WriteAccountStorage %x %x: %x, buffer %d\n", addrHash, seckey, value, len(tsw.tds.buffers))
 	return nil
 }
 
 // ExtractWitness produces block witness for the block just been processed, in a serialised form
 func (tds *TrieDbState) ExtractWitness(trace bool, isBinary bool) (*trie.Witness, error) {
+	if tds.proofSession != nil {
+		return tds.proofSession.ExtractWitness(trace, isBinary)
+	}
 	rs, codeMap := tds.resolveSetBuilder.Build(isBinary)
 
 	return tds.makeBlockWitness(trace, rs, codeMap, isBinary)
 }
 
+// ExtractTypedWitness is the counterpart of ExtractWitness that also returns the typed touches the witness
+// is produced for (see ExtractTypedTouches), which ExtractWitness discards
+func (tds *TrieDbState) ExtractTypedWitness(trace bool, isBinary bool) (*trie.Witness, []trie.Touch, error) {
+	if tds.proofSession != nil {
+		return tds.proofSession.ExtractTypedWitness(trace, isBinary)
+	}
+	rs, codeMap, touches := tds.resolveSetBuilder.BuildTyped(isBinary)
+	w, err := tds.makeBlockWitness(trace, rs, codeMap, isBinary)
+	if err != nil {
+		return nil, nil, err
+	}
+	return w, touches, nil
+}
+
 func (tds *TrieDbState) makeBlockWitness(trace bool, rs *trie.ResolveSet, codeMap map[common.Hash][]byte, isBinary bool) (*trie.Witness, error) {
-	tds.tMu.Lock()
-	defer tds.tMu.Unlock()
+	tds.tMu.RLock()
+	defer tds.tMu.RUnlock()
+	tds.hashMu.Lock()
+	defer tds.hashMu.Unlock()
 
-	t := tds.t
+	t, err := tds.concreteTrie()
+	if err != nil {
+		return nil, err
+	}
 	if isBinary {
-		t = trie.HexToBin(tds.t).Trie()
+		t = trie.HexToBin(t).Trie()
 	}
 
-	return t.ExtractWitness(tds.blockNr, trace, rs, codeMap)
+	w, err := t.ExtractWitness(tds.blockNr, trace, rs, codeMap)
+	if err != nil {
+		return nil, err
+	}
+	if isBinary {
+		w.Header.Capabilities |= trie.WitnessBinaryTrie
+	}
+	return w, nil
 }
 
 func (tsw *TrieStateWriter) CreateContract(address common.Address) error {
@@ -1298,6 +2284,20 @@ func (tsw *TrieStateWriter) CreateContract(address common.Address) error {
 	return nil
 }
 
+// RecreateContract is the same as CreateContract, but for the contract that self-destructed earlier in the same
+// block, so that the storage modifications made after the self-destruction are preserved (see ContractRecreator)
+func (tsw *TrieStateWriter) RecreateContract(address common.Address) error {
+	if err := tsw.CreateContract(address); err != nil {
+		return err
+	}
+	addrHash, err := tsw.tds.HashAddress(address, false /*save*/)
+	if err != nil {
+		return err
+	}
+	tsw.tds.currentBuffer.recreated[addrHash] = struct{}{}
+	return nil
+}
+
 func (tds *TrieDbState) TriePruningDebugDump() string {
 	return tds.tp.DebugDump()
 }
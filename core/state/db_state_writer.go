@@ -7,11 +7,18 @@ import (
 	"github.com/ledgerwatch/turbo-geth/common/dbutils"
 	"github.com/ledgerwatch/turbo-geth/common/debug"
 	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
 	"github.com/ledgerwatch/turbo-geth/trie"
 )
 
 type DbStateWriter struct {
-	tds *TrieDbState
+	tds            *TrieDbState
+	db             ethdb.Database // Database of the tds, or the changeRecorder when the changes are streamed
+	accountChanges uint32         // Number of historical records written for the accounts, for the root index
+	storageChanges uint32         // Number of historical records written for the storage items, for the root index
+
+	history       map[string][]ethdb.KV // History records of the block by the historical bucket, nil unless batched
+	checksumDelta *common.Hash          // Changes of the checksum of the flat state, nil unless enabled by SetStateChecksum
 }
 
 func (dsw *DbStateWriter) UpdateAccountData(ctx context.Context, address common.Address, original, account *accounts.Account) error {
@@ -23,33 +30,28 @@ func (dsw *DbStateWriter) UpdateAccountData(ctx context.Context, address common.
 	if err != nil {
 		return err
 	}
-	if err = dsw.tds.db.Put(dbutils.AccountsBucket, addrHash[:], data); err != nil {
+	if err = dsw.updateAccountChecksum(addrHash, data); err != nil {
+		return err
+	}
+	if err = dsw.db.Put(dbutils.AccountsBucket, addrHash[:], data); err != nil {
 		return err
 	}
 
-	noHistory := dsw.tds.noHistory
 	// Don't write historical record if the account did not change
 	if accountsEqual(original, account) {
 		return nil
 	}
-	var originalData []byte
-	if !original.Initialised {
-		originalData = []byte{}
-	} else {
+	rec := NewAccountHistoryRecord(addrHash, original)
+	if rec.Account != nil && debug.IsThinHistory() {
 		// we can reduce storage size for history there
 		// because we have accountHash+incarnation -> codehash of contract in separate bucket
 		// and we don't need root in history requests
-		testAcc := original.SelfCopy()
-		if debug.IsThinHistory() {
-			copy(testAcc.CodeHash[:], emptyCodeHash)
-			testAcc.Root = trie.EmptyRoot
-		}
-
-		originalDataLen := testAcc.EncodingLengthForStorage()
-		originalData = make([]byte, originalDataLen)
-		testAcc.EncodeForStorage(originalData)
+		rec.Account = original.SelfCopy()
+		copy(rec.Account.CodeHash[:], emptyCodeHash)
+		rec.Account.Root = trie.EmptyRoot
 	}
-	return dsw.tds.db.PutS(dbutils.AccountsHistoryBucket, addrHash[:], originalData, dsw.tds.blockNr, noHistory)
+	dsw.accountChanges++
+	return dsw.putHistory(rec.Bucket, rec.Key(), rec.EncodeValue())
 }
 
 func (dsw *DbStateWriter) DeleteAccount(ctx context.Context, address common.Address, original *accounts.Account) error {
@@ -57,33 +59,32 @@ func (dsw *DbStateWriter) DeleteAccount(ctx context.Context, address common.Addr
 	if err != nil {
 		return err
 	}
-	if err := dsw.tds.db.Delete(dbutils.AccountsBucket, addrHash[:]); err != nil {
+	if err = dsw.updateAccountChecksum(addrHash, nil); err != nil {
 		return err
 	}
-
-	var originalData []byte
-	if !original.Initialised {
-		// Account has been created and deleted in the same block
-		originalData = []byte{}
-	} else {
-		originalDataLen := original.EncodingLengthForStorage()
-		originalData = make([]byte, originalDataLen)
-		original.EncodeForStorage(originalData)
-		// We must keep root using thin history on deleting account as is
+	if err := dsw.db.Delete(dbutils.AccountsBucket, addrHash[:]); err != nil {
+		return err
 	}
 
-	noHistory := dsw.tds.noHistory
-	return dsw.tds.db.PutS(dbutils.AccountsHistoryBucket, addrHash[:], originalData, dsw.tds.blockNr, noHistory)
+	// Account created and deleted in the same block is recorded as not existing.
+	// We must keep root using thin history on deleting account as is
+	rec := NewAccountHistoryRecord(addrHash, original)
+
+	dsw.accountChanges++
+	return dsw.putHistory(rec.Bucket, rec.Key(), rec.EncodeValue())
 }
 
 func (dsw *DbStateWriter) UpdateAccountCode(addrHash common.Hash, incarnation uint64, codeHash common.Hash, code []byte) error {
 	//save contract code mapping
-	if err := dsw.tds.db.Put(dbutils.CodeBucket, codeHash[:], code); err != nil {
+	if err := dsw.db.Put(dbutils.CodeBucket, codeHash[:], code); err != nil {
+		return err
+	}
+	if err := writeCodeSize(dsw.db, codeHash, code); err != nil {
 		return err
 	}
 	if debug.IsThinHistory() {
 		//save contract to codeHash mapping
-		return dsw.tds.db.Put(dbutils.ContractCodeBucket, dbutils.GenerateStoragePrefix(addrHash, incarnation), codeHash.Bytes())
+		return dsw.db.Put(dbutils.ContractCodeBucket, dbutils.GenerateStoragePrefix(addrHash, incarnation), codeHash.Bytes())
 	}
 	return nil
 }
@@ -105,22 +106,24 @@ func (dsw *DbStateWriter) WriteAccountStorage(ctx context.Context, address commo
 		return err
 	}
 
-	compositeKey := dbutils.GenerateCompositeStorageKey(addrHash, incarnation, seckey)
+	rec := NewStorageHistoryRecord(addrHash, incarnation, seckey, original[:])
+	compositeKey := rec.Key()
 	if len(v) == 0 {
-		err = dsw.tds.db.Delete(dbutils.StorageBucket, compositeKey)
+		err = dsw.db.Delete(dbutils.StorageBucket, compositeKey)
 	} else {
-		err = dsw.tds.db.Put(dbutils.StorageBucket, compositeKey, vv)
+		err = dsw.db.Put(dbutils.StorageBucket, compositeKey, vv)
 	}
 	//fmt.Printf("WriteAccountStorage (db) %x %d %x: %x\n", address, incarnation, key, value)
 	if err != nil {
 		return err
 	}
 
-	noHistory := dsw.tds.noHistory
-	o := bytes.TrimLeft(original[:], "\x00")
-	originalValue := make([]byte, len(o))
-	copy(originalValue, o)
-	return dsw.tds.db.PutS(dbutils.StorageHistoryBucket, compositeKey, originalValue, dsw.tds.blockNr, noHistory)
+	if err = updateStorageSize(dsw.db, compositeKey, rec.Value, vv); err != nil {
+		return err
+	}
+	dsw.updateChecksum(dbutils.StorageBucket, compositeKey, rec.Value, vv)
+	dsw.storageChanges++
+	return dsw.putHistory(rec.Bucket, compositeKey, rec.EncodeValue())
 }
 
 func (dsw *DbStateWriter) CreateContract(address common.Address) error {
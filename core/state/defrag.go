@@ -0,0 +1,151 @@
+package state
+
+import (
+	"errors"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// DefragResult describes the work done by DefragmentContractStorage
+type DefragResult struct {
+	Rewritten          int      // Number of the storage items of the current incarnation written back
+	Purged             int      // Number of the storage items of the previous incarnations removed
+	PurgedIncarnations []uint64 // Previous incarnations whose storage has been removed
+	KeptIncarnations   []uint64 // Previous incarnations whose storage is kept, because their end is not in the history
+}
+
+var errDefragBatch = errors.New("storage defragmentation needs the database rather than a batch, as it merges the history into the past change sets")
+
+// DefragmentContractStorage rewrites the storage items of the current incarnation of the contract in the order
+// of their keys, in one transaction, so that they are laid out contiguously in the StorageBucket again,
+// which improves the locality of MultiWalk over the contract.
+// The storage items of the previous incarnations (left behind by self-destructs and re-creations) are removed
+// at the same time, if the block where the incarnation ended is found in the accounts history. For each of
+// them, the history record (and the change set entry) is added to that block first, so that the historical
+// reads and the unwinding past that block still find the values. The storage of the previous incarnations is
+// kept when the history is not available (e.g. in the thin history mode, or without history).
+// The job is meant for the maintenance of the idle database, as it is not coordinated with TrieDbState
+func DefragmentContractStorage(db ethdb.Database, addrHash common.Hash) (*DefragResult, error) {
+	if _, ok := db.(ethdb.DbWithPendingMutations); ok {
+		return nil, errDefragBatch
+	}
+	var current uint64
+	if enc, err := db.Get(dbutils.AccountsBucket, addrHash[:]); err == nil && len(enc) > 0 {
+		var acc accounts.Account
+		if err = acc.DecodeForStorage(enc); err != nil {
+			return nil, err
+		}
+		current = acc.Incarnation
+	} else if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+
+	var endBlocks map[uint64]uint64
+	if !debug.IsThinHistory() {
+		var err error
+		if endBlocks, err = incarnationEndBlocks(db, addrHash); err != nil {
+			return nil, err
+		}
+	}
+
+	type item struct {
+		k, v        []byte
+		incarnation uint64
+	}
+	var items []item
+	if err := db.Walk(dbutils.StorageBucket, addrHash[:], 8*common.HashLength, func(k, v []byte) (bool, error) {
+		if len(k) == common.HashLength+common.IncarnationLength+common.HashLength {
+			items = append(items, item{common.CopyBytes(k), common.CopyBytes(v), dbutils.DecodeIncarnation(k[common.HashLength:])})
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	res := &DefragResult{}
+	var storageTuples, sizeTuples [][]byte
+	lastIncarnation := current
+	for _, it := range items {
+		if it.incarnation == current {
+			storageTuples = append(storageTuples, dbutils.StorageBucket, it.k, it.v)
+			res.Rewritten++
+			continue
+		}
+		endBlock, ok := endBlocks[it.incarnation]
+		if it.incarnation != lastIncarnation {
+			lastIncarnation = it.incarnation
+			if ok {
+				res.PurgedIncarnations = append(res.PurgedIncarnations, it.incarnation)
+				sizeTuples = append(sizeTuples, dbutils.StateSizeBucket, it.k[:common.HashLength+common.IncarnationLength], nil)
+			} else {
+				res.KeptIncarnations = append(res.KeptIncarnations, it.incarnation)
+			}
+		}
+		if !ok {
+			continue
+		}
+		// A record at the end block already holds the value before the block, which is the one to keep,
+		// the value in the StorageBucket has been written in the same block, before the self-destruct
+		composite, _ := dbutils.CompositeKeySuffix(it.k, endBlock)
+		if _, err := db.Get(dbutils.StorageHistoryBucket, composite); err == ethdb.ErrKeyNotFound {
+			if err = db.PutS(dbutils.StorageHistoryBucket, it.k, it.v, endBlock, false); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		storageTuples = append(storageTuples, dbutils.StorageBucket, it.k, nil)
+		res.Purged++
+	}
+	if len(storageTuples) == 0 {
+		return res, nil
+	}
+	if _, err := db.MultiPut(append(storageTuples, sizeTuples...)...); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// incarnationEndBlocks returns the blocks where the incarnations of the account ended, according
+// to the accounts history. The history record of a block holds the account before the block, so the last
+// record of an incarnation is at the block where it has been replaced by another incarnation or deleted
+func incarnationEndBlocks(db ethdb.Getter, addrHash common.Hash) (map[uint64]uint64, error) {
+	endBlocks := make(map[uint64]uint64)
+	err := db.Walk(dbutils.AccountsHistoryBucket, addrHash[:], 8*common.HashLength, func(k, v []byte) (bool, error) {
+		if len(k) <= common.HashLength || len(v) == 0 {
+			return true, nil
+		}
+		rec, err := DecodeHistoryEntry(dbutils.AccountsHistoryBucket, k, v)
+		if err != nil {
+			return false, err
+		}
+		if incarnation := rec.Account.Incarnation; incarnation > 0 && rec.BlockNr > endBlocks[incarnation] {
+			endBlocks[incarnation] = rec.BlockNr
+		}
+		return true, nil
+	})
+	return endBlocks, err
+}
+
+// DefragmentLargestContracts runs DefragmentContractStorage for the n contracts with the largest storage
+// (see TopContractsBySize), which are the most likely to be fragmented and to be walked over
+func DefragmentLargestContracts(db ethdb.Database, n int, onContract func(ContractSize, *DefragResult)) error {
+	top, err := TopContractsBySize(db, n)
+	if err != nil {
+		return err
+	}
+	for _, cs := range top {
+		res, err := DefragmentContractStorage(db, cs.AddrHash)
+		if err != nil {
+			return err
+		}
+		if onContract != nil {
+			onContract(cs, res)
+		}
+	}
+	return nil
+}
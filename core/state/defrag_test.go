@@ -0,0 +1,104 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestDefragmentContractStorage(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := make(map[uint64]common.Hash)
+	block := func(blockNr uint64, change func(ibs *IntraBlockState)) {
+		roots[blockNr], _ = commitTestBlock(t, tds, blockNr, change)
+	}
+	contract := common.HexToAddress("0xc")
+	addrHash := crypto.Keccak256Hash(contract[:])
+	k1, k2 := common.Hash{1}, common.Hash{2}
+	block(1, func(ibs *IntraBlockState) {
+		ibs.CreateAccount(contract, true)
+		ibs.SetState(contract, k1, common.Hash{31: 1})
+		ibs.SetState(contract, k2, common.Hash{31: 2})
+	})
+	block(2, func(ibs *IntraBlockState) {
+		ibs.Suicide(contract)
+	})
+	block(3, func(ibs *IntraBlockState) {
+		ibs.CreateAccount(contract, true)
+		ibs.SetState(contract, k1, common.Hash{31: 5})
+	})
+	acc, err := tds.ReadAccountData(contract)
+	if err != nil || acc == nil || acc.Incarnation < 2 {
+		t.Fatalf("expected the contract to be re-created with a new incarnation, got %+v, %v", acc, err)
+	}
+	oldIncarnation := acc.Incarnation - 1
+
+	oldKeys := make([][]byte, 2)
+	for i, k := range []common.Hash{k1, k2} {
+		seckey := crypto.Keccak256Hash(k[:])
+		oldKeys[i] = dbutils.GenerateCompositeStorageKey(addrHash, oldIncarnation, seckey)
+	}
+	// The previous incarnation ended in block 2, the reads as of the later blocks do not find its storage any more
+	asOf := func(toBlock uint64) [][]byte {
+		var values [][]byte
+		for _, k := range oldKeys {
+			for ts := uint64(1); ts <= toBlock; ts++ {
+				v, _ := db.GetAsOf(dbutils.StorageBucket, dbutils.StorageHistoryBucket, k, ts)
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+	before := asOf(2)
+	if len(before[1]) == 0 || len(before[3]) == 0 {
+		t.Fatalf("expected the storage of the previous incarnation as of block 2, got %x", before)
+	}
+
+	if _, err = DefragmentContractStorage(db.NewBatch(), addrHash); err == nil {
+		t.Errorf("expected the batch to be rejected")
+	}
+	res, err := DefragmentContractStorage(db, addrHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rewritten != 1 || res.Purged != 2 || len(res.PurgedIncarnations) != 1 || res.PurgedIncarnations[0] != oldIncarnation {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	for _, k := range oldKeys {
+		if _, err = db.Get(dbutils.StorageBucket, k); err != ethdb.ErrKeyNotFound {
+			t.Errorf("expected the storage of the previous incarnation to be removed, got %v", err)
+		}
+	}
+	after := asOf(2)
+	for i := range before {
+		if string(before[i]) != string(after[i]) {
+			t.Errorf("historical read %d changed: %x before, %x after", i, before[i], after[i])
+		}
+	}
+	for _, k := range oldKeys {
+		if v, _ := db.GetAsOf(dbutils.StorageBucket, dbutils.StorageHistoryBucket, k, 3); len(v) != 0 {
+			t.Errorf("expected no value after the end of the incarnation, got %x", v)
+		}
+	}
+	if cs, err := ReadContractSize(db, addrHash); err != nil || cs.Slots != 1 {
+		t.Errorf("expected only the current incarnation to be accounted, got %+v, %v", cs, err)
+	}
+
+	// Unwinding past the end of the previous incarnation brings its storage back
+	if err = tds.UnwindTo(1); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(dbutils.StorageBucket, oldKeys[1]); err != nil || common.BytesToHash(v) != (common.Hash{31: 2}) {
+		t.Errorf("expected the storage of the previous incarnation to be restored, got %x, %v", v, err)
+	}
+	if root := tds.LastRoot(); root != roots[1] {
+		t.Errorf("expected root %x after the unwind, got %x", roots[1], root)
+	}
+}
@@ -93,10 +93,7 @@ func (tds *TrieDbState) dump(c collector, excludeCode, excludeStorage, excludeMi
 	emptyAddress := common.Address{}
 	missingPreimages := 0
 
-	tds.tMu.Lock()
-	h := tds.t.Hash()
-	tds.tMu.Unlock()
-	c.onRoot(h)
+	c.onRoot(tds.LastRoot())
 	var acc accounts.Account
 	var prefix [32]byte
 	err := tds.db.Walk(dbutils.AccountsBucket, prefix[:], 0, func(k, v []byte) (bool, error) {
@@ -0,0 +1,29 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// ErrAccountNotFound is returned by the lookups of accounts by their address hashes when the account does not
+// exist. StateReader methods do not return it, they return nil account instead
+var ErrAccountNotFound = errors.New("account not found")
+
+// ErrStaleRoot is returned when the state is rewound (see UnwindTo) and the storage root recorded in the history
+// of the account does not match the storage sub-trie. It means that the trie (or the history) does not correspond
+// to the block, and the caller may want to rebuild the trie or unwind further
+type ErrStaleRoot struct {
+	AddrHash common.Hash
+	Expected common.Hash // Storage root of the account
+	Got      common.Hash // Root of the storage sub-trie
+	Dump     string      // Path to the forensic dump, if it has been produced (see SetForensicsDir)
+}
+
+func (e *ErrStaleRoot) Error() string {
+	if e.Dump == "" {
+		return fmt.Sprintf("mismatched storage root for %x: expected %x, got %x", e.AddrHash, e.Expected, e.Got)
+	}
+	return fmt.Sprintf("mismatched storage root for %x: expected %x, got %x (forensic dump in %s)", e.AddrHash, e.Expected, e.Got, e.Dump)
+}
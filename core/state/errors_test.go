@@ -0,0 +1,43 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestAccountNotFound(t *testing.T) {
+	tds, err := NewTrieDbState(common.Hash{}, ethdb.NewMemDatabase(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := common.HexToAddress("0x1234")
+	addrHash, err := common.HashData(addr[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.readAccountDataByHash(addrHash); err != ErrAccountNotFound {
+		t.Fatalf("expected ErrAccountNotFound, got %v", err)
+	}
+	// StateReader reports missing accounts as nil
+	if acc, err := tds.ReadAccountData(addr); acc != nil || err != nil {
+		t.Fatalf("expected nil account and no error, got %v, %v", acc, err)
+	}
+
+	ctx := context.Background()
+	ibs := New(tds)
+	ibs.AddBalance(addr, big.NewInt(1))
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	if acc, err := tds.readAccountDataByHash(addrHash); err != nil || acc.Balance.Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("unexpected account %v, error %v", acc, err)
+	}
+}
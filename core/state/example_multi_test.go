@@ -0,0 +1,73 @@
+package state_test
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// commitGenesis writes the balances as the state of block 0 and returns its root
+func commitGenesis(tds *state.TrieDbState, balances map[common.Address]int64) (common.Hash, error) {
+	ctx := context.Background()
+	ibs := state.New(tds)
+	tds.StartNewBuffer()
+	for addr, balance := range balances {
+		ibs.AddBalance(addr, big.NewInt(balance))
+	}
+	if err := ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		return common.Hash{}, err
+	}
+	roots, err := tds.ComputeTrieRoots()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	tds.SetBlockNr(0)
+	if err := ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		return common.Hash{}, err
+	}
+	return roots[len(roots)-1], nil
+}
+
+// This example shows two chains with different genesis states and databases in one process.
+// Each TrieDbState is configured on its own, and the StateCache keeps them apart.
+func ExampleStateCache_multipleChains() {
+	alice, bob := common.HexToAddress("0xa"), common.HexToAddress("0xb")
+	geneses := []map[common.Address]int64{
+		{alice: 100},
+		{alice: 1, bob: 2},
+	}
+
+	cache := state.NewStateCache()
+	dbs := make([]ethdb.Database, len(geneses))
+	roots := make([]common.Hash, len(geneses))
+	for i, genesis := range geneses {
+		dbs[i] = ethdb.NewMemDatabase()
+		tds, err := cache.GetOrCreate(common.Hash{}, dbs[i], 0)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		tds.SetCacheGenLimit(uint32(1000 * (i + 1)))
+		if roots[i], err = commitGenesis(tds, genesis); err != nil {
+			fmt.Println(err)
+			return
+		}
+		cache.Put(tds)
+	}
+
+	for i, db := range dbs {
+		tds := cache.Get(db, roots[i], 0)
+		ibs := state.New(tds)
+		fmt.Printf("chain %d: alice %d, bob %d, cache generations %d\n", i, ibs.GetBalance(alice), ibs.GetBalance(bob), tds.CacheGenLimit())
+	}
+	fmt.Println("same root:", roots[0] == roots[1])
+
+	// Output:
+	// chain 0: alice 100, bob 0, cache generations 1000
+	// chain 1: alice 1, bob 2, cache generations 2000
+	// same root: false
+}
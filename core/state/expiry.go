@@ -0,0 +1,319 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+const expiredValueLen = 16
+
+// SetLastTouches enables the bookkeeping of the last block touching every account in the LastTouchBucket,
+// which is the basis of the state expiry experiments (see UntouchedAccounts and ExpireAccounts). An account is
+// touched when it is read, written, or its storage is written. The touches are written out by
+// DbStateWriter.WriteLastTouches
+func (tds *TrieDbState) SetLastTouches(enabled bool) {
+	if enabled {
+		if tds.lastTouches == nil {
+			tds.lastTouches = make(map[common.Hash]bool)
+		}
+	} else {
+		tds.lastTouches = nil
+	}
+}
+
+// collectLastTouches adds the accounts touched by the buffers of the current block to lastTouches
+func (tds *TrieDbState) collectLastTouches() {
+	if tds.lastTouches == nil || tds.aggregateBuffer == nil {
+		return
+	}
+	b := tds.aggregateBuffer
+	for addrHash := range b.accountReads {
+		tds.lastTouches[addrHash] = true
+	}
+	for addrHash := range b.storageUpdates {
+		tds.lastTouches[addrHash] = true
+	}
+	for addrHash, acc := range b.accountUpdates {
+		tds.lastTouches[addrHash] = acc != nil
+	}
+}
+
+// WriteLastTouches records the current block as the last touch of the accounts touched since the last
+// invocation (see SetLastTouches), and forgets the deleted accounts. It is meant to be called after CommitBlock
+func (dsw *DbStateWriter) WriteLastTouches() error {
+	touches := dsw.tds.lastTouches
+	if touches == nil {
+		return nil
+	}
+	dsw.tds.lastTouches = make(map[common.Hash]bool)
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, dsw.tds.blockNr)
+	for addrHash, exists := range touches {
+		var err error
+		if exists {
+			err = dsw.db.Put(dbutils.LastTouchBucket, common.CopyBytes(addrHash[:]), common.CopyBytes(v))
+		} else {
+			err = dsw.db.Delete(dbutils.LastTouchBucket, addrHash[:])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unwindLastTouches brings the last touches after the block back to the block. The touches made before the
+// unwound blocks are not known anymore, so the accounts are treated as touched by the block, which only
+// postpones their expiry
+func unwindLastTouches(db ethdb.Database, blockNr uint64) error {
+	var keys [][]byte
+	if err := db.Walk(dbutils.LastTouchBucket, nil, 0, func(k, v []byte) (bool, error) {
+		if len(v) == 8 && binary.BigEndian.Uint64(v) > blockNr {
+			keys = append(keys, common.CopyBytes(k))
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, blockNr)
+		if err := db.Put(dbutils.LastTouchBucket, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LastTouched returns the number of the last block touching the account, as recorded when the bookkeeping
+// is enabled by SetLastTouches. The second return value is false if the touch is not recorded
+func LastTouched(db ethdb.Getter, addrHash common.Hash) (uint64, bool, error) {
+	v, err := db.Get(dbutils.LastTouchBucket, addrHash[:])
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return 0, false, err
+	}
+	if len(v) == 0 {
+		return 0, false, nil
+	}
+	if len(v) != 8 {
+		return 0, false, fmt.Errorf("invalid last touch of %x: length %d", addrHash, len(v))
+	}
+	return binary.BigEndian.Uint64(v), true, nil
+}
+
+// UntouchedAccount is the account reported by UntouchedAccounts
+type UntouchedAccount struct {
+	AddrHash    common.Hash
+	LastTouched uint64
+}
+
+// UntouchedAccounts returns (at most limit, all if limit is zero) existing accounts that have not been touched
+// for at least n blocks before the block blockNr, in the ascending order of the address hashes.
+// The accounts without the recorded touches (the ones not touched since the bookkeeping has been enabled)
+// are not reported
+func UntouchedAccounts(db ethdb.Getter, blockNr, n uint64, limit int) ([]UntouchedAccount, error) {
+	if blockNr < n {
+		return nil, nil
+	}
+	var candidates []UntouchedAccount
+	if err := db.Walk(dbutils.LastTouchBucket, nil, 0, func(k, v []byte) (bool, error) {
+		if len(k) != common.HashLength || len(v) != 8 {
+			return false, fmt.Errorf("invalid last touch record %x: %x", k, v)
+		}
+		if lastTouched := binary.BigEndian.Uint64(v); lastTouched+n <= blockNr {
+			candidates = append(candidates, UntouchedAccount{AddrHash: common.BytesToHash(k), LastTouched: lastTouched})
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	var untouched []UntouchedAccount
+	for _, u := range candidates {
+		if limit > 0 && len(untouched) == limit {
+			break
+		}
+		enc, err := db.Get(dbutils.AccountsBucket, u.AddrHash[:])
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return nil, err
+		}
+		if len(enc) > 0 {
+			untouched = append(untouched, u)
+		}
+	}
+	return untouched, nil
+}
+
+// ExpiredAccount is the tombstone of the account removed from the state by ExpireAccounts
+type ExpiredAccount struct {
+	AddrHash    common.Hash
+	BlockNr     uint64 // Block after which the account expired
+	Incarnation uint64
+}
+
+// ReadExpiredAccount returns the tombstone of the account, or nil if the account is not expired
+func ReadExpiredAccount(db ethdb.Getter, addrHash common.Hash) (*ExpiredAccount, error) {
+	v, err := db.Get(dbutils.ExpiredAccountsBucket, addrHash[:])
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+	if len(v) == 0 {
+		return nil, nil
+	}
+	if len(v) != expiredValueLen {
+		return nil, fmt.Errorf("invalid tombstone of %x: length %d", addrHash, len(v))
+	}
+	return &ExpiredAccount{AddrHash: addrHash, BlockNr: binary.BigEndian.Uint64(v), Incarnation: binary.BigEndian.Uint64(v[8:])}, nil
+}
+
+// ExpireAccounts removes the accounts, together with the storage of their current incarnations, from the
+// state trie and from the flat state, leaving the tombstones in the ExpiredAccountsBucket. The accounts that
+// do not exist are skipped. It returns the tombstones written. The state root preceding the expiry is added
+// to the ExpiryRootBucket, so that the accounts can be brought back by ResurrectAccount.
+// The expiry changes the state root outside of the block processing, and is not recorded in the history,
+// so it is only meant for the state expiry experiments on the private chains. Like UnwindTo, it is to be
+// invoked between the blocks, after the last block is committed
+func (tds *TrieDbState) ExpireAccounts(addrHashes []common.Hash) ([]ExpiredAccount, error) {
+	sorted := make([]common.Hash, len(addrHashes))
+	copy(sorted, addrHashes)
+	sortHashes(sorted)
+
+	var expired []ExpiredAccount
+	for i, addrHash := range sorted {
+		if i > 0 && addrHash == sorted[i-1] {
+			continue
+		}
+		enc, err := tds.db.Get(dbutils.AccountsBucket, addrHash[:])
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return nil, err
+		}
+		if len(enc) == 0 {
+			continue
+		}
+		var acc accounts.Account
+		if err = acc.DecodeForStorage(enc); err != nil {
+			return nil, err
+		}
+		expired = append(expired, ExpiredAccount{AddrHash: addrHash, BlockNr: tds.blockNr, Incarnation: acc.Incarnation})
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	if err := appendExpiryRoot(tds.db, tds.blockNr, tds.LastRoot()); err != nil {
+		return nil, err
+	}
+	if err := invalidateStateChecksum(tds.db); err != nil {
+		return nil, err
+	}
+	tds.StartNewBuffer()
+	b := tds.currentBuffer
+	for _, e := range expired {
+		b.accountUpdates[e.AddrHash] = nil
+		b.deleted[e.AddrHash] = struct{}{}
+	}
+	if _, err := tds.ResolveStateTrie(false); err != nil {
+		return nil, err
+	}
+	tds.tMu.Lock()
+	_, err := tds.updateTrieRoots(context.Background(), true)
+	tds.view.reset()
+	tds.clearUpdates()
+	tds.resetCrossValidation()
+	tds.tMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range expired {
+		if err := expireFlatAccount(tds.db, e); err != nil {
+			return nil, err
+		}
+		if tds.lastTouches != nil {
+			delete(tds.lastTouches, e.AddrHash)
+		}
+	}
+	return expired, nil
+}
+
+// expireFlatAccount replaces the account and the storage of its incarnation in the flat state with the tombstone
+func expireFlatAccount(db ethdb.Database, e ExpiredAccount) error {
+	type item struct{ k, v []byte }
+	var items []item
+	if e.Incarnation > 0 {
+		prefix := dbutils.GenerateStoragePrefix(e.AddrHash, e.Incarnation)
+		if err := db.Walk(dbutils.StorageBucket, prefix, 8*uint(len(prefix)), func(k, v []byte) (bool, error) {
+			items = append(items, item{common.CopyBytes(k), common.CopyBytes(v)})
+			return true, nil
+		}); err != nil {
+			return err
+		}
+	}
+	for _, it := range items {
+		if err := updateStorageSize(db, it.k, it.v, nil); err != nil {
+			return err
+		}
+		if err := db.Delete(dbutils.StorageBucket, it.k); err != nil {
+			return err
+		}
+	}
+	if err := db.Delete(dbutils.AccountsBucket, e.AddrHash[:]); err != nil {
+		return err
+	}
+	if err := db.Delete(dbutils.LastTouchBucket, e.AddrHash[:]); err != nil {
+		return err
+	}
+	v := make([]byte, expiredValueLen)
+	binary.BigEndian.PutUint64(v, e.BlockNr)
+	binary.BigEndian.PutUint64(v[8:], e.Incarnation)
+	return db.Put(dbutils.ExpiredAccountsBucket, common.CopyBytes(e.AddrHash[:]), v)
+}
+
+// appendExpiryRoot adds the state root preceding an expiry after the block to the expiry root index
+func appendExpiryRoot(db ethdb.Database, blockNr uint64, root common.Hash) error {
+	roots, err := ReadExpiryRoots(db, blockNr)
+	if err != nil {
+		return err
+	}
+	v := make([]byte, 0, (len(roots)+1)*common.HashLength)
+	for _, r := range append(roots, root) {
+		v = append(v, r[:]...)
+	}
+	return db.Put(dbutils.ExpiryRootBucket, dbutils.EncodeTimestamp(blockNr), v)
+}
+
+// ReadExpiryRoots returns the state roots preceding the expiries of the accounts after the block, in the order
+// of the expiries
+func ReadExpiryRoots(db ethdb.Getter, blockNr uint64) ([]common.Hash, error) {
+	v, err := db.Get(dbutils.ExpiryRootBucket, dbutils.EncodeTimestamp(blockNr))
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+	if len(v)%common.HashLength != 0 {
+		return nil, fmt.Errorf("invalid expiry roots of block %d: length %d", blockNr, len(v))
+	}
+	roots := make([]common.Hash, len(v)/common.HashLength)
+	for i := range roots {
+		copy(roots[i][:], v[i*common.HashLength:])
+	}
+	return roots, nil
+}
+
+// ExpireUntouched is the expiry writer: it tombstones (see ExpireAccounts) the accounts that have not been
+// touched for at least n blocks before the current block, and returns their tombstones
+func (tds *TrieDbState) ExpireUntouched(n uint64) ([]ExpiredAccount, error) {
+	untouched, err := UntouchedAccounts(tds.db, tds.getBlockNr(), n, 0)
+	if err != nil {
+		return nil, err
+	}
+	addrHashes := make([]common.Hash, len(untouched))
+	for i, u := range untouched {
+		addrHashes[i] = u.AddrHash
+	}
+	return tds.ExpireAccounts(addrHashes)
+}
@@ -0,0 +1,84 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestExpireUntouched(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetLastTouches(true)
+	block := func(blockNr uint64, change func(ibs *IntraBlockState)) {
+		_, dsw := commitTestBlock(t, tds, blockNr, change)
+		if err := dsw.WriteLastTouches(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, contract := common.HexToAddress("0xa"), common.HexToAddress("0xc")
+	addrHashA, addrHashC := crypto.Keccak256Hash(a[:]), crypto.Keccak256Hash(contract[:])
+	block(1, func(ibs *IntraBlockState) {
+		ibs.AddBalance(a, big.NewInt(10))
+		ibs.CreateAccount(contract, true)
+		ibs.SetState(contract, common.Hash{1}, common.Hash{31: 1})
+	})
+	block(2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(a, big.NewInt(5))
+	})
+	block(3, func(ibs *IntraBlockState) {
+		// Reading is touching too
+		ibs.GetBalance(a)
+	})
+
+	if blockNr, ok, err := LastTouched(db, addrHashA); err != nil || !ok || blockNr != 3 {
+		t.Errorf("expected the account touched by block 3, got %d, %t, %v", blockNr, ok, err)
+	}
+	if blockNr, ok, err := LastTouched(db, addrHashC); err != nil || !ok || blockNr != 1 {
+		t.Errorf("expected the contract touched by block 1, got %d, %t, %v", blockNr, ok, err)
+	}
+	untouched, err := UntouchedAccounts(db, 3, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(untouched) != 1 || untouched[0].AddrHash != addrHashC || untouched[0].LastTouched != 1 {
+		t.Errorf("expected the contract untouched for 2 blocks, got %+v", untouched)
+	}
+	if untouched, _ = UntouchedAccounts(db, 3, 3, 0); len(untouched) != 0 {
+		t.Errorf("expected nothing untouched for 3 blocks, got %+v", untouched)
+	}
+
+	expired, err := tds.ExpireUntouched(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].AddrHash != addrHashC || expired[0].BlockNr != 3 || expired[0].Incarnation != FirstContractIncarnation {
+		t.Fatalf("unexpected tombstones %+v", expired)
+	}
+	if tombstone, err := ReadExpiredAccount(db, addrHashC); err != nil || tombstone == nil || *tombstone != expired[0] {
+		t.Errorf("expected the tombstone %+v, got %+v, %v", expired[0], tombstone, err)
+	}
+	if acc, err := tds.ReadAccountData(contract); err != nil || acc != nil {
+		t.Errorf("expected the contract to be removed, got %+v, %v", acc, err)
+	}
+	prefix := dbutils.GenerateStoragePrefix(addrHashC, FirstContractIncarnation)
+	if err = db.Walk(dbutils.StorageBucket, prefix, 8*uint(len(prefix)), func(k, _ []byte) (bool, error) {
+		t.Errorf("expected the storage to be removed, found %x", k)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, _ := flatStateRoot(db, false); tds.LastRoot() != expected {
+		t.Errorf("expected the root %x of the flat state, got %x", expected, tds.LastRoot())
+	}
+	if _, ok, _ := LastTouched(db, addrHashC); ok {
+		t.Errorf("expected the last touch of the expired contract to be removed")
+	}
+}
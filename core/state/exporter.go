@@ -0,0 +1,327 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// Kinds of the StateChange messages
+const (
+	ChangeAccount        = "account"
+	ChangeAccountDeleted = "account_deleted"
+	ChangeStorage        = "storage"
+	ChangeCode           = "code"
+	ChangeContract       = "contract_created"
+	ChangeRevert         = "revert" // Changes of the blocks from FromBlock to ToBlock are reverted, see SetStateExporter
+)
+
+// StateChange is the message published by the ExportWriter for every change of the state
+type StateChange struct {
+	Kind        string          `json:"kind"`
+	BlockNr     uint64          `json:"block"`
+	Address     *common.Address `json:"address,omitempty"`
+	AddrHash    *common.Hash    `json:"addrHash,omitempty"` // Only for the code, which is written by the address hash
+	Nonce       *uint64         `json:"nonce,omitempty"`
+	Balance     *hexutil.Big    `json:"balance,omitempty"`
+	Incarnation uint64          `json:"incarnation,omitempty"`
+	CodeHash    *common.Hash    `json:"codeHash,omitempty"`
+	Key         *common.Hash    `json:"key,omitempty"`
+	Original    *common.Hash    `json:"original,omitempty"`
+	Value       *common.Hash    `json:"value,omitempty"`
+	Code        hexutil.Bytes   `json:"code,omitempty"`
+	FromBlock   uint64          `json:"fromBlock,omitempty"` // Only for the revert, first unwound block
+	ToBlock     uint64          `json:"toBlock,omitempty"`   // Only for the revert, last unwound block
+}
+
+// ExportSink receives the messages of the ExportWriter. Implementations can forward them to
+// message queues (for example, Kafka) or other data pipelines
+type ExportSink interface {
+	Publish(change *StateChange) error
+}
+
+// BatchSink is the ExportSink receiving the changes of one block at once, for example in one request
+type BatchSink interface {
+	ExportSink
+	PublishBatch(changes []*StateChange) error
+}
+
+// publishBatch publishes the changes of one block, in one batch if the sink supports it
+func publishBatch(sink ExportSink, changes []*StateChange) error {
+	if b, ok := sink.(BatchSink); ok {
+		return b.PublishBatch(changes)
+	}
+	for _, change := range changes {
+		if err := sink.Publish(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetStateExporter sets the sink receiving the changes recorded by the writers of ExportWriter, and the ChangeRevert
+// message when the state is unwound (see UnwindTo). The changes are published by EmitChanges, once the blocks are
+// committed to the database, so the changes of the blocks rolled back are never published.
+// The ChangeRevert tells the subscribers to discard the previously delivered changes of the unwound blocks.
+// The message carries the block the state is unwound to as its BlockNr, and the range of the unwound blocks,
+// so that the changes of every block are applied downstream exactly once across the reorgs: the changes
+// of the new blocks with the same numbers follow the revert. nil disables it
+func (tds *TrieDbState) SetStateExporter(sink ExportSink) {
+	tds.stateExporter = sink
+}
+
+// exportRevert records the ChangeRevert message of the blocks from fromBlock to toBlock, which have been unwound,
+// to be published with the changes of the blocks following it once the unwind is committed
+func (tds *TrieDbState) exportRevert(fromBlock, toBlock uint64) {
+	if tds.stateExporter == nil || fromBlock > toBlock {
+		return
+	}
+	tds.pendingExports = append(tds.pendingExports, []*StateChange{{
+		Kind:      ChangeRevert,
+		BlockNr:   fromBlock - 1,
+		FromBlock: fromBlock,
+		ToBlock:   toBlock,
+	}})
+}
+
+// ExportWriter is the StateWriter publishing the changes of one block to the ExportSink.
+// It is meant to be combined with the DbStateWriter using the TeeWriter
+type ExportWriter struct {
+	publish func(change *StateChange) error
+	blockNr uint64
+}
+
+// NewExportWriter creates the writer publishing the changes to the sink as they are written. The blocks processed
+// with the TrieDbState are rather exported by the writer of ExportWriter, once they are committed
+func NewExportWriter(sink ExportSink, blockNr uint64) *ExportWriter {
+	return &ExportWriter{publish: sink.Publish, blockNr: blockNr}
+}
+
+// ExportWriter creates the writer recording the changes of the current block for the sink set by SetStateExporter,
+// to be published by EmitChanges once the block is committed to the database
+func (tds *TrieDbState) ExportWriter() *ExportWriter {
+	return &ExportWriter{publish: tds.bufferExport, blockNr: tds.getBlockNr()}
+}
+
+// bufferExport adds the change to the changes of its block waiting for the commit
+func (tds *TrieDbState) bufferExport(change *StateChange) error {
+	n := len(tds.pendingExports)
+	if n == 0 || tds.pendingExports[n-1][0].BlockNr != change.BlockNr || tds.pendingExports[n-1][0].Kind == ChangeRevert {
+		tds.pendingExports = append(tds.pendingExports, nil)
+		n++
+	}
+	tds.pendingExports[n-1] = append(tds.pendingExports[n-1], change)
+	return nil
+}
+
+// emitExports publishes the changes of the committed blocks, logging the failures of the sink rather than
+// returning them, so that the sink does not hold up the blocks
+func (tds *TrieDbState) emitExports() {
+	exports := tds.pendingExports
+	tds.pendingExports = nil
+	if tds.stateExporter == nil {
+		return
+	}
+	for _, changes := range exports {
+		if err := publishBatch(tds.stateExporter, changes); err != nil {
+			tds.getLogger().Warn("Could not export the changes of the state", "block", changes[0].BlockNr, "error", err)
+		}
+	}
+}
+
+func (ew *ExportWriter) UpdateAccountData(_ context.Context, address common.Address, original, account *accounts.Account) error {
+	if accountsEqual(original, account) {
+		return nil
+	}
+	nonce := account.Nonce
+	codeHash := account.CodeHash
+	return ew.publish(&StateChange{
+		Kind:        ChangeAccount,
+		BlockNr:     ew.blockNr,
+		Address:     &address,
+		Nonce:       &nonce,
+		Balance:     (*hexutil.Big)(new(big.Int).Set(&account.Balance)),
+		Incarnation: account.Incarnation,
+		CodeHash:    &codeHash,
+	})
+}
+
+func (ew *ExportWriter) UpdateAccountCode(addrHash common.Hash, incarnation uint64, codeHash common.Hash, code []byte) error {
+	return ew.publish(&StateChange{
+		Kind:        ChangeCode,
+		BlockNr:     ew.blockNr,
+		AddrHash:    &addrHash,
+		Incarnation: incarnation,
+		CodeHash:    &codeHash,
+		Code:        common.CopyBytes(code),
+	})
+}
+
+func (ew *ExportWriter) DeleteAccount(_ context.Context, address common.Address, original *accounts.Account) error {
+	return ew.publish(&StateChange{
+		Kind:        ChangeAccountDeleted,
+		BlockNr:     ew.blockNr,
+		Address:     &address,
+		Incarnation: original.Incarnation,
+	})
+}
+
+func (ew *ExportWriter) WriteAccountStorage(_ context.Context, address common.Address, incarnation uint64, key, original, value *common.Hash) error {
+	if *original == *value {
+		return nil
+	}
+	k, o, v := *key, *original, *value
+	return ew.publish(&StateChange{
+		Kind:        ChangeStorage,
+		BlockNr:     ew.blockNr,
+		Address:     &address,
+		Incarnation: incarnation,
+		Key:         &k,
+		Original:    &o,
+		Value:       &v,
+	})
+}
+
+func (ew *ExportWriter) CreateContract(address common.Address) error {
+	return ew.publish(&StateChange{
+		Kind:    ChangeContract,
+		BlockNr: ew.blockNr,
+		Address: &address,
+	})
+}
+
+// JSONSink writes the messages to the writer as JSON, one per line
+type JSONSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{enc: json.NewEncoder(w)}
+}
+
+func (s *JSONSink) Publish(change *StateChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(change)
+}
+
+// PublishBatch writes the changes of the block together, without interleaving them with other writers
+func (s *JSONSink) PublishBatch(changes []*StateChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, change := range changes {
+		if err := s.enc.Encode(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookSink posts the messages as JSON to the URL: one message per request given to Publish,
+// and the array of the changes of the block given to PublishBatch
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookSink(url string, timeout time.Duration) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *WebhookSink) Publish(change *StateChange) error {
+	return s.post(change)
+}
+
+func (s *WebhookSink) PublishBatch(changes []*StateChange) error {
+	return s.post(changes)
+}
+
+func (s *WebhookSink) post(message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// AsyncSink publishes the changes to the sink in the background, the changes of one block at a time, so that
+// the import of the blocks is not held up by the sink. The failures of the sink are logged, and the changes
+// of the blocks arriving when the queue is full are dropped (with the error), so an outage of the sink
+// costs the consumers the changes, but does not stop the import
+type AsyncSink struct {
+	sink   ExportSink
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []*StateChange
+	done   chan struct{}
+}
+
+// NewAsyncSink starts publishing to the sink, with the queue of at most queueLen blocks
+func NewAsyncSink(sink ExportSink, queueLen int) *AsyncSink {
+	s := &AsyncSink{sink: sink, queue: make(chan []*StateChange, queueLen), done: make(chan struct{})}
+	go s.run()
+	return s
+}
+
+func (s *AsyncSink) run() {
+	defer close(s.done)
+	for changes := range s.queue {
+		if err := publishBatch(s.sink, changes); err != nil {
+			log.Warn("Could not export the changes of the state", "block", changes[0].BlockNr, "changes", len(changes), "error", err)
+		}
+	}
+}
+
+func (s *AsyncSink) Publish(change *StateChange) error {
+	return s.PublishBatch([]*StateChange{change})
+}
+
+// PublishBatch queues the changes of one block for publishing
+func (s *AsyncSink) PublishBatch(changes []*StateChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errors.New("export sink is closed")
+	}
+	select {
+	case s.queue <- changes:
+		return nil
+	default:
+		return fmt.Errorf("export queue is full, %d changes of block %d dropped", len(changes), changes[0].BlockNr)
+	}
+}
+
+// Close publishes the changes already queued, and stops the publishing
+func (s *AsyncSink) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
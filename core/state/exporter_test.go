@@ -0,0 +1,199 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestExportWriter(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	addr := common.HexToAddress("0x1234")
+	ibs := New(tds)
+	ibs.AddBalance(addr, big.NewInt(100))
+	ibs.SetState(addr, common.Hash{1}, common.Hash{2})
+	ibs.SetCode(addr, []byte{0x60, 0x00})
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	var out bytes.Buffer
+	tds.SetStateExporter(NewJSONSink(&out))
+	if err = ibs.CommitBlock(ctx, NewTeeWriter(tds.DbStateWriter(), tds.ExportWriter())); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is published before the block is committed
+	if out.Len() != 0 {
+		t.Fatalf("expected no changes before the commit, got %s", out.String())
+	}
+	if err = tds.EmitChanges(); err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := make(map[string]int)
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var change StateChange
+		if err = dec.Decode(&change); err != nil {
+			t.Fatal(err)
+		}
+		if change.BlockNr != 1 {
+			t.Errorf("expected block 1, got %d", change.BlockNr)
+		}
+		switch change.Kind {
+		case ChangeAccount:
+			if *change.Address != addr || change.Balance.ToInt().Cmp(big.NewInt(100)) != 0 {
+				t.Errorf("unexpected account change %+v", change)
+			}
+		case ChangeStorage:
+			if *change.Key != (common.Hash{1}) || *change.Value != (common.Hash{2}) {
+				t.Errorf("unexpected storage change %+v", change)
+			}
+		case ChangeCode:
+			if !bytes.Equal(change.Code, []byte{0x60, 0x00}) {
+				t.Errorf("unexpected code change %+v", change)
+			}
+		}
+		kinds[change.Kind]++
+	}
+	for _, kind := range []string{ChangeAccount, ChangeStorage, ChangeCode} {
+		if kinds[kind] != 1 {
+			t.Errorf("expected one %s change, got %d", kind, kinds[kind])
+		}
+	}
+
+	// The changes also reached the database
+	if v, err := db.Get(dbutils.CodeBucket, crypto.Keccak256([]byte{0x60, 0x00})); err != nil || len(v) == 0 {
+		t.Errorf("code not written to the database: %v", err)
+	}
+}
+
+func TestExportRevert(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	ctx := context.Background()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	sink := NewJSONSink(&out)
+	tds.SetStateExporter(sink)
+	addr := common.HexToAddress("0x1234")
+	block := func(blockNr uint64, amount int64) {
+		ibs := New(tds)
+		tds.StartNewBuffer()
+		ibs.AddBalance(addr, big.NewInt(amount))
+		if err := ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tds.ComputeTrieRoots(); err != nil {
+			t.Fatal(err)
+		}
+		tds.SetBlockNr(blockNr)
+		if err := tds.CommitBlock(ctx, ibs, NewTeeWriter(tds.DbStateWriter(), tds.ExportWriter())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block(1, 10)
+	block(2, 20)
+	block(3, 30)
+	if err = tds.EmitChanges(); err != nil {
+		t.Fatal(err)
+	}
+	published := out.Len()
+	if err = tds.UnwindTo(1); err != nil {
+		t.Fatal(err)
+	}
+	// The revert waits for the commit of the unwind
+	if out.Len() != published {
+		t.Fatalf("expected the revert published after the commit")
+	}
+	block(2, 5)
+	if err = tds.EmitChanges(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Balances of the account seen downstream, by block, with the reverted blocks discarded
+	balances := make(map[uint64]int64)
+	var reverts int
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var change StateChange
+		if err = dec.Decode(&change); err != nil {
+			t.Fatal(err)
+		}
+		switch change.Kind {
+		case ChangeAccount:
+			balances[change.BlockNr] = change.Balance.ToInt().Int64()
+		case ChangeRevert:
+			reverts++
+			if change.BlockNr != 1 || change.FromBlock != 2 || change.ToBlock != 3 {
+				t.Errorf("unexpected revert %+v", change)
+			}
+			for blockNr := change.FromBlock; blockNr <= change.ToBlock; blockNr++ {
+				delete(balances, blockNr)
+			}
+		}
+	}
+	if reverts != 1 {
+		t.Errorf("expected one revert, got %d", reverts)
+	}
+	if len(balances) != 2 || balances[1] != 10 || balances[2] != 15 {
+		t.Errorf("unexpected balances downstream: %v", balances)
+	}
+}
+
+type failingSink struct {
+	mu      sync.Mutex
+	batches [][]*StateChange
+}
+
+func (s *failingSink) Publish(change *StateChange) error {
+	return s.PublishBatch([]*StateChange{change})
+}
+
+func (s *failingSink) PublishBatch(changes []*StateChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, changes)
+	if changes[0].BlockNr == 1 {
+		return errors.New("sink is down")
+	}
+	return nil
+}
+
+func TestAsyncSink(t *testing.T) {
+	sink := &failingSink{}
+	async := NewAsyncSink(sink, 2)
+	// The failure of the first block does not stop the publishing of the next one
+	for blockNr := uint64(1); blockNr <= 2; blockNr++ {
+		if err := async.PublishBatch([]*StateChange{{Kind: ChangeAccount, BlockNr: blockNr}, {Kind: ChangeStorage, BlockNr: blockNr}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	async.Close()
+	if len(sink.batches) != 2 || len(sink.batches[0]) != 2 || sink.batches[1][0].BlockNr != 2 {
+		t.Errorf("expected the changes of both blocks published in batches, got %v", sink.batches)
+	}
+	if err := async.Publish(&StateChange{Kind: ChangeAccount, BlockNr: 3}); err == nil {
+		t.Errorf("expected the closed sink to refuse the changes")
+	}
+}
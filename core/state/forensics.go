@@ -0,0 +1,106 @@
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// SetForensicsDir enables dumping of the diagnostic information into the given directory
+// when the storage root computed from the trie does not match the root of the account.
+// Empty dir disables the dumps.
+func (tds *TrieDbState) SetForensicsDir(dir string) {
+	tds.forensicsDir = dir
+}
+
+// storageRootMismatch produces the error for the mismatched storage root, and if enabled, dumps
+// the resolved storage sub-trie, the content of the buffer and the storage in the database
+// for the offending contract
+func (tds *TrieDbState) storageRootMismatch(addrHash common.Hash, account *accounts.Account, h common.Hash, b *Buffer) error {
+	e := &ErrStaleRoot{AddrHash: addrHash, Expected: account.Root, Got: h}
+	if tds.forensicsDir == "" {
+		return e
+	}
+	path, err := tds.dumpStorageMismatch(addrHash, account, h, b)
+	if err != nil {
+		tds.getLogger().Warn("Forensic dump failed", "account", addrHash, "err", err)
+		return e
+	}
+	e.Dump = path
+	return e
+}
+
+func (tds *TrieDbState) dumpStorageMismatch(addrHash common.Hash, account *accounts.Account, h common.Hash, b *Buffer) (path string, err error) {
+	path = filepath.Join(tds.forensicsDir, fmt.Sprintf("storage_mismatch_%d_%x.txt", tds.blockNr, addrHash))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		// The dump is incomplete if it is not closed cleanly
+		if cerr := f.Close(); err == nil && cerr != nil {
+			path, err = "", cerr
+		}
+	}()
+	w := bufio.NewWriter(f)
+
+	fmt.Fprintf(w, "block %d, account %x, incarnation %d\n", tds.blockNr, addrHash, account.Incarnation)
+	fmt.Fprintf(w, "expected storage root %x, computed %x\n", account.Root, h)
+
+	fmt.Fprintf(w, "\n=== Resolved sub-trie ===\n")
+	if t, err1 := tds.concreteTrie(); err1 == nil {
+		prefix := make([]byte, 2*common.HashLength)
+		for i, c := range addrHash {
+			prefix[2*i] = c / 16
+			prefix[2*i+1] = c % 16
+		}
+		if err = t.ExportTrie(w, trie.ExportJSON, prefix); err != nil {
+			return "", err
+		}
+	} else {
+		fmt.Fprintf(w, "%v\n", err1)
+	}
+
+	fmt.Fprintf(w, "\n=== Buffer ===\n")
+	for _, buffer := range []*Buffer{b, tds.aggregateBuffer} {
+		if buffer == nil {
+			continue
+		}
+		if acc, ok := buffer.accountUpdates[addrHash]; ok {
+			if acc == nil {
+				fmt.Fprintf(w, "account deleted\n")
+			} else {
+				fmt.Fprintf(w, "account update: nonce %d, balance %s, incarnation %d, root %x\n", acc.Nonce, acc.Balance.String(), acc.Incarnation, acc.Root)
+			}
+		}
+		if _, ok := buffer.created[addrHash]; ok {
+			fmt.Fprintf(w, "created\n")
+		}
+		if _, ok := buffer.deleted[addrHash]; ok {
+			fmt.Fprintf(w, "deleted\n")
+		}
+		for keyHash, v := range buffer.storageUpdates[addrHash] {
+			fmt.Fprintf(w, "storage update %x: %x\n", keyHash, v)
+		}
+		fmt.Fprintf(w, "---\n")
+	}
+
+	fmt.Fprintf(w, "\n=== Database storage ===\n")
+	prefix := dbutils.GenerateStoragePrefix(addrHash, account.Incarnation)
+	if err = tds.db.Walk(dbutils.StorageBucket, prefix, 8*uint(len(prefix)), func(k, v []byte) (bool, error) {
+		fmt.Fprintf(w, "%x: %x\n", k[len(prefix):], v)
+		return true, nil
+	}); err != nil {
+		return "", err
+	}
+	if err = w.Flush(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
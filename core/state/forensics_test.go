@@ -0,0 +1,73 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestStorageMismatchDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forensics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := common.HexToAddress("0xc0")
+	key, value := common.Hash{1}, common.Hash{31: 0x2a}
+	commitTestBlock(t, tds, 1, func(ibs *IntraBlockState) {
+		ibs.CreateAccount(contract, true)
+		ibs.SetState(contract, key, value)
+	})
+	addrHash := crypto.Keccak256Hash(contract[:])
+	acc, err := tds.readAccountDataByHash(addrHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Account update in the buffer that does not agree with the storage trie
+	var stale accounts.Account
+	stale.Copy(acc)
+	stale.Root = common.HexToHash("0xbad")
+	var b Buffer
+	b.initialise()
+	b.accountUpdates[addrHash] = &stale
+	b.storageUpdates[addrHash] = map[common.Hash][]byte{crypto.Keccak256Hash(key[:]): {0x2b}}
+
+	if err = tds.storageRootMismatch(addrHash, &stale, acc.Root, &b); err.(*ErrStaleRoot).Dump != "" {
+		t.Errorf("expected no dump without the forensics directory, got %v", err)
+	}
+	tds.SetForensicsDir(dir)
+	err = tds.storageRootMismatch(addrHash, &stale, acc.Root, &b)
+	e, ok := err.(*ErrStaleRoot)
+	if !ok || e.AddrHash != addrHash || e.Expected != stale.Root || e.Got != acc.Root || e.Dump == "" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	dump, err := ioutil.ReadFile(e.Dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		fmt.Sprintf("block 1, account %x, incarnation %d", addrHash, acc.Incarnation),
+		fmt.Sprintf("expected storage root %x, computed %x", stale.Root, acc.Root),
+		fmt.Sprintf("account update: nonce %d, balance 0, incarnation %d, root %x", acc.Nonce, acc.Incarnation, stale.Root),
+		fmt.Sprintf("storage update %x: 2b", crypto.Keccak256Hash(key[:])),
+		fmt.Sprintf("%x: 2a", crypto.Keccak256Hash(key[:])),
+	} {
+		if !strings.Contains(string(dump), line+"\n") {
+			t.Errorf("expected %q in the dump:\n%s", line, dump)
+		}
+	}
+}
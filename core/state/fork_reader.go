@@ -0,0 +1,264 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// Prefixes of the values in the ForkBucket
+const (
+	forkAbsent  byte = 0 // Absent in the forked chain, or deleted locally
+	forkPresent byte = 1 // Followed by the account encoded for storage, or by the storage value
+)
+
+// ForkReader implements StateReader of a local devnet forked from another chain (for example, the mainnet at block N).
+// The accounts and the storage items missing in the local state are faulted on demand from the remote reader,
+// which is either DbState over the remote database (see remote.NewRemoteBoltDatabase), or RPCStateReader,
+// and are cached in the ForkBucket, so that every item is fetched at most once. The codes are cached in the CodeBucket.
+// The storage items are faulted only for the incarnation of the faulted account, so that the contracts
+// re-created locally start with the empty storage. For the deletions of the faulted items not to be undone
+// by the faulting, the blocks of the devnet are to be committed via ForkWriter
+type ForkReader struct {
+	local  StateReader
+	db     ethdb.Database
+	remote StateReader
+}
+
+func NewForkReader(local StateReader, db ethdb.Database, remote StateReader) *ForkReader {
+	return &ForkReader{local: local, db: db, remote: remote}
+}
+
+func (r *ForkReader) ReadAccountData(address common.Address) (*accounts.Account, error) {
+	acc, err := r.local.ReadAccountData(address)
+	if err != nil || acc != nil {
+		return acc, err
+	}
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return nil, err
+	}
+	return r.forkAccount(address, addrHash)
+}
+
+// forkAccount returns the account of the forked chain, faulting it from the remote reader if it is not cached yet
+func (r *ForkReader) forkAccount(address common.Address, addrHash common.Hash) (*accounts.Account, error) {
+	v, err := r.db.Get(dbutils.ForkBucket, addrHash[:])
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+	if len(v) == 0 {
+		acc, err := r.remote.ReadAccountData(address)
+		if err != nil {
+			return nil, fmt.Errorf("faulting account %x: %w", address, err)
+		}
+		v = []byte{forkAbsent}
+		if acc != nil {
+			v = make([]byte, 1+acc.EncodingLengthForStorage())
+			v[0] = forkPresent
+			acc.EncodeForStorage(v[1:])
+		}
+		if err = r.db.Put(dbutils.ForkBucket, common.CopyBytes(addrHash[:]), v); err != nil {
+			return nil, err
+		}
+	}
+	if v[0] == forkAbsent {
+		return nil, nil
+	}
+	var acc accounts.Account
+	if err = acc.DecodeForStorage(v[1:]); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+func (r *ForkReader) ReadAccountStorage(address common.Address, incarnation uint64, key *common.Hash) ([]byte, error) {
+	value, err := r.local.ReadAccountStorage(address, incarnation, key)
+	if err != nil || len(value) > 0 {
+		return value, err
+	}
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return nil, err
+	}
+	keyHash, err := common.HashData(key[:])
+	if err != nil {
+		return nil, err
+	}
+	compositeKey := dbutils.GenerateCompositeStorageKey(addrHash, incarnation, keyHash)
+	v, err := r.db.Get(dbutils.ForkBucket, compositeKey)
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+	if len(v) == 0 {
+		acc, err := r.forkAccount(address, addrHash)
+		if err != nil {
+			return nil, err
+		}
+		if acc == nil || acc.Incarnation != incarnation {
+			// Storage of the contract created locally
+			return nil, nil
+		}
+		if value, err = r.remote.ReadAccountStorage(address, incarnation, key); err != nil {
+			return nil, fmt.Errorf("faulting storage %x of %x: %w", *key, address, err)
+		}
+		v = append([]byte{forkAbsent}, value...)
+		if len(value) > 0 {
+			v[0] = forkPresent
+		}
+		if err = r.db.Put(dbutils.ForkBucket, compositeKey, v); err != nil {
+			return nil, err
+		}
+	}
+	if v[0] == forkAbsent {
+		return nil, nil
+	}
+	return v[1:], nil
+}
+
+func (r *ForkReader) ReadAccountCode(address common.Address, codeHash common.Hash) ([]byte, error) {
+	if bytes.Equal(codeHash[:], emptyCodeHash) {
+		return nil, nil
+	}
+	code, err := r.local.ReadAccountCode(address, codeHash)
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+	if len(code) > 0 {
+		return code, nil
+	}
+	if code, err = r.remote.ReadAccountCode(address, codeHash); err != nil {
+		return nil, fmt.Errorf("faulting code %x of %x: %w", codeHash, address, err)
+	}
+	if h := crypto.Keccak256Hash(code); h != codeHash {
+		return nil, fmt.Errorf("faulted code of %x has hash %x, expected %x", address, h, codeHash)
+	}
+	if err = r.db.Put(dbutils.CodeBucket, common.CopyBytes(codeHash[:]), code); err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+func (r *ForkReader) ReadAccountCodeSize(address common.Address, codeHash common.Hash) (int, error) {
+	code, err := r.ReadAccountCode(address, codeHash)
+	return len(code), err
+}
+
+// ForkWriter passes the writes to the writer of the local state, and records the deletions of the accounts and
+// of the storage items in the ForkBucket, so that ForkReader does not fault them from the forked chain again
+type ForkWriter struct {
+	StateWriter
+	db ethdb.Database
+}
+
+func NewForkWriter(w StateWriter, db ethdb.Database) *ForkWriter {
+	return &ForkWriter{StateWriter: w, db: db}
+}
+
+func (fw *ForkWriter) DeleteAccount(ctx context.Context, address common.Address, original *accounts.Account) error {
+	if err := fw.StateWriter.DeleteAccount(ctx, address, original); err != nil {
+		return err
+	}
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return err
+	}
+	return fw.db.Put(dbutils.ForkBucket, addrHash[:], []byte{forkAbsent})
+}
+
+func (fw *ForkWriter) WriteAccountStorage(ctx context.Context, address common.Address, incarnation uint64, key, original, value *common.Hash) error {
+	if err := fw.StateWriter.WriteAccountStorage(ctx, address, incarnation, key, original, value); err != nil {
+		return err
+	}
+	if *value != (common.Hash{}) {
+		return nil
+	}
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return err
+	}
+	keyHash, err := common.HashData(key[:])
+	if err != nil {
+		return err
+	}
+	return fw.db.Put(dbutils.ForkBucket, dbutils.GenerateCompositeStorageKey(addrHash, incarnation, keyHash), []byte{forkAbsent})
+}
+
+// StateRPC is the part of the API of ethclient.Client used by RPCStateReader
+type StateRPC interface {
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error)
+	StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error)
+}
+
+// RPCStateReader reads the state at the given block from a remote node via JSON-RPC, for ForkReader.
+// The RPC does not expose the incarnations and the storage roots, so the contracts are read with
+// FirstContractIncarnation and the empty storage root
+type RPCStateReader struct {
+	ctx     context.Context
+	client  StateRPC
+	blockNr *big.Int
+}
+
+func NewRPCStateReader(ctx context.Context, client StateRPC, blockNr uint64) *RPCStateReader {
+	return &RPCStateReader{ctx: ctx, client: client, blockNr: new(big.Int).SetUint64(blockNr)}
+}
+
+func (r *RPCStateReader) ReadAccountData(address common.Address) (*accounts.Account, error) {
+	balance, err := r.client.BalanceAt(r.ctx, address, r.blockNr)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := r.client.NonceAt(r.ctx, address, r.blockNr)
+	if err != nil {
+		return nil, err
+	}
+	code, err := r.client.CodeAt(r.ctx, address, r.blockNr)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Sign() == 0 && nonce == 0 && len(code) == 0 {
+		return nil, nil
+	}
+	acc := accounts.NewAccount()
+	acc.Initialised = true
+	acc.Nonce = nonce
+	acc.Balance.Set(balance)
+	if len(code) > 0 {
+		acc.CodeHash = crypto.Keccak256Hash(code)
+		acc.Incarnation = FirstContractIncarnation
+	}
+	return &acc, nil
+}
+
+func (r *RPCStateReader) ReadAccountStorage(address common.Address, incarnation uint64, key *common.Hash) ([]byte, error) {
+	value, err := r.client.StorageAt(r.ctx, address, *key, r.blockNr)
+	if err != nil {
+		return nil, err
+	}
+	value = bytes.TrimLeft(value, "\x00")
+	if len(value) == 0 {
+		return nil, nil
+	}
+	return value, nil
+}
+
+func (r *RPCStateReader) ReadAccountCode(address common.Address, codeHash common.Hash) ([]byte, error) {
+	if bytes.Equal(codeHash[:], emptyCodeHash) {
+		return nil, nil
+	}
+	return r.client.CodeAt(r.ctx, address, r.blockNr)
+}
+
+func (r *RPCStateReader) ReadAccountCodeSize(address common.Address, codeHash common.Hash) (int, error) {
+	code, err := r.ReadAccountCode(address, codeHash)
+	return len(code), err
+}
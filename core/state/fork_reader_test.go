@@ -0,0 +1,124 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// forkTestRPC serves the state of the forked chain to RPCStateReader, and counts the calls
+type forkTestRPC struct {
+	balances map[common.Address]*big.Int
+	codes    map[common.Address][]byte
+	storage  map[common.Address]map[common.Hash]common.Hash
+	calls    int
+}
+
+func (f *forkTestRPC) BalanceAt(_ context.Context, account common.Address, _ *big.Int) (*big.Int, error) {
+	f.calls++
+	if b, ok := f.balances[account]; ok {
+		return new(big.Int).Set(b), nil
+	}
+	return new(big.Int), nil
+}
+
+func (f *forkTestRPC) NonceAt(_ context.Context, _ common.Address, _ *big.Int) (uint64, error) {
+	f.calls++
+	return 0, nil
+}
+
+func (f *forkTestRPC) CodeAt(_ context.Context, account common.Address, _ *big.Int) ([]byte, error) {
+	f.calls++
+	return f.codes[account], nil
+}
+
+func (f *forkTestRPC) StorageAt(_ context.Context, account common.Address, key common.Hash, _ *big.Int) ([]byte, error) {
+	f.calls++
+	v := f.storage[account][key]
+	return v[:], nil
+}
+
+func TestForkReader(t *testing.T) {
+	ctx := context.Background()
+	a, c, absent := common.HexToAddress("0xa"), common.HexToAddress("0xc"), common.HexToAddress("0xd")
+	code := []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+	k1, k2 := common.Hash{1}, common.Hash{2}
+	rpc := &forkTestRPC{
+		balances: map[common.Address]*big.Int{a: big.NewInt(10), c: big.NewInt(3)},
+		codes:    map[common.Address][]byte{c: code},
+		storage:  map[common.Address]map[common.Hash]common.Hash{c: {k1: {31: 1}}},
+	}
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewForkReader(tds, db, NewRPCStateReader(ctx, rpc, 100))
+
+	acc, err := r.ReadAccountData(a)
+	if err != nil || acc == nil || acc.Balance.Int64() != 10 {
+		t.Fatalf("unexpected faulted account %+v, %v", acc, err)
+	}
+	calls := rpc.calls
+	if acc, err = r.ReadAccountData(a); err != nil || acc == nil || acc.Balance.Int64() != 10 {
+		t.Fatalf("unexpected cached account %+v, %v", acc, err)
+	}
+	if acc, err = r.ReadAccountData(absent); err != nil || acc != nil {
+		t.Fatalf("expected the absent account, got %+v, %v", acc, err)
+	}
+	if _, err = r.ReadAccountData(absent); err != nil {
+		t.Fatal(err)
+	}
+	contract, err := r.ReadAccountData(c)
+	if err != nil || contract == nil || contract.Incarnation != FirstContractIncarnation || contract.CodeHash != crypto.Keccak256Hash(code) {
+		t.Fatalf("unexpected faulted contract %+v, %v", contract, err)
+	}
+	if got, err := r.ReadAccountCode(c, contract.CodeHash); err != nil || string(got) != string(code) {
+		t.Errorf("unexpected faulted code %x, %v", got, err)
+	}
+	if v, err := r.ReadAccountStorage(c, contract.Incarnation, &k1); err != nil || len(v) != 1 || v[0] != 1 {
+		t.Errorf("unexpected faulted storage item %x, %v", v, err)
+	}
+	if v, err := r.ReadAccountStorage(c, contract.Incarnation, &k2); err != nil || len(v) != 0 {
+		t.Errorf("expected the absent storage item, got %x, %v", v, err)
+	}
+	if v, err := r.ReadAccountStorage(c, contract.Incarnation+1, &k1); err != nil || len(v) != 0 {
+		t.Errorf("expected the empty storage of the other incarnation, got %x, %v", v, err)
+	}
+	calls = rpc.calls - calls
+	if _, err = r.ReadAccountStorage(c, contract.Incarnation, &k1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.ReadAccountData(absent); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3+3+1+1+1 {
+		t.Errorf("expected every item to be faulted once, got %d calls", calls)
+	}
+
+	// Local block clears the faulted storage item and spends the faulted balance
+	ibs := New(r)
+	tds.StartNewBuffer()
+	ibs.SetState(c, k1, common.Hash{})
+	ibs.SubBalance(a, big.NewInt(4))
+	if err = ibs.FinalizeTx(ctx, NewForkWriter(tds.TrieStateWriter(), db)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = tds.CommitBlock(ctx, ibs, NewForkWriter(tds.DbStateWriter(), db)); err != nil {
+		t.Fatal(err)
+	}
+	if acc, err = r.ReadAccountData(a); err != nil || acc == nil || acc.Balance.Int64() != 6 {
+		t.Errorf("unexpected local account %+v, %v", acc, err)
+	}
+	if v, err := r.ReadAccountStorage(c, contract.Incarnation, &k1); err != nil || len(v) != 0 {
+		t.Errorf("expected the storage item cleared locally not to be faulted again, got %x, %v", v, err)
+	}
+}
@@ -0,0 +1,230 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// Blocks between the refreshes of the table of the frequent actors, see DbStateWriter.WriteFrequentActors
+const frequentActorsRefreshInterval = 100
+
+// Candidates for the table of the frequent actors counted between the refreshes, per entry of the table.
+// The least recently missed ones are dropped beyond that
+const frequentActorsCandidates = 16
+
+// FrequentActorStats shows the hashing work saved by the table of the frequent actors, see SetFrequentActors
+type FrequentActorStats struct {
+	Entries        int    // Accounts in the table
+	HashesSaved    uint64 // Keccak computations of the addresses avoided by HashAddress
+	PreimagesSaved uint64 // Preimage lookups in the database avoided by GetKey
+	Misses         uint64 // Addresses not found in the table, which had to be hashed
+}
+
+// frequentActor is the entry of the table of the frequent actors
+type frequentActor struct {
+	score    uint64 // Incremented atomically by the lookups
+	addrHash common.Hash
+}
+
+// frequentActors is the table of the address hashes of the most frequently touched accounts
+type frequentActors struct {
+	hashesSaved    uint64 // Counters of FrequentActorStats, updated atomically
+	preimagesSaved uint64
+	misses         uint64
+
+	// HashAddress is invoked by the concurrent readers, which only take the read lock,
+	// the table is only modified by the refreshes
+	mu        sync.RWMutex
+	size      int
+	entries   int
+	byAddress map[common.Address]*frequentActor
+	byHash    map[common.Hash]common.Address
+	counts    *lru.Cache // Misses since the last refresh (*uint64), by address
+}
+
+func newFrequentActors(size int) (*frequentActors, error) {
+	counts, err := lru.New(size * frequentActorsCandidates)
+	if err != nil {
+		return nil, err
+	}
+	return &frequentActors{
+		size:      size,
+		byAddress: make(map[common.Address]*frequentActor),
+		byHash:    make(map[common.Hash]common.Address),
+		counts:    counts,
+	}, nil
+}
+
+// SetFrequentActors enables the table of the address hashes of (at most) size most frequently touched accounts
+// (like the validators and the popular contracts), which HashAddress and GetKey consult before hashing the address
+// or looking up the preimage. The table is kept in the FrequentActorsBucket, and loaded from there when enabled.
+// It is refreshed by DbStateWriter.WriteFrequentActors, the savings are shown by FrequentActorStats.
+// Zero disables the table
+func (tds *TrieDbState) SetFrequentActors(size int) error {
+	if size == 0 {
+		tds.frequentActors = nil
+		return nil
+	}
+	fa, err := newFrequentActors(size)
+	if err != nil {
+		return err
+	}
+	if err = tds.db.Walk(dbutils.FrequentActorsBucket, nil, 0, func(k, v []byte) (bool, error) {
+		if len(v) != common.AddressLength+8 {
+			return true, nil
+		}
+		address := common.BytesToAddress(v[:common.AddressLength])
+		fa.add(address, common.BytesToHash(k), binary.BigEndian.Uint64(v[common.AddressLength:]))
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	// The table may have been written with the larger size
+	if ranked := fa.ranked(); len(ranked) > size {
+		for _, address := range ranked[size:] {
+			fa.remove(address)
+		}
+	}
+	fa.entries = len(fa.byAddress)
+	tds.frequentActors = fa
+	return nil
+}
+
+// FrequentActorStats returns the savings of the table of the frequent actors since it was enabled
+func (tds *TrieDbState) FrequentActorStats() FrequentActorStats {
+	fa := tds.frequentActors
+	if fa == nil {
+		return FrequentActorStats{}
+	}
+	fa.mu.RLock()
+	defer fa.mu.RUnlock()
+	return FrequentActorStats{
+		Entries:        fa.entries,
+		HashesSaved:    atomic.LoadUint64(&fa.hashesSaved),
+		PreimagesSaved: atomic.LoadUint64(&fa.preimagesSaved),
+		Misses:         atomic.LoadUint64(&fa.misses),
+	}
+}
+
+// lookupHash returns the address hash from the table, and counts the miss otherwise. The counts of the misses
+// are approximate: the concurrent first misses of the same address may be counted once
+func (fa *frequentActors) lookupHash(address common.Address) (common.Hash, bool) {
+	fa.mu.RLock()
+	defer fa.mu.RUnlock()
+	if actor, ok := fa.byAddress[address]; ok {
+		atomic.AddUint64(&fa.hashesSaved, 1)
+		atomic.AddUint64(&actor.score, 1)
+		return actor.addrHash, true
+	}
+	atomic.AddUint64(&fa.misses, 1)
+	if count, ok := fa.counts.Get(address); ok {
+		atomic.AddUint64(count.(*uint64), 1)
+	} else {
+		n := uint64(1)
+		fa.counts.Add(address, &n)
+	}
+	return common.Hash{}, false
+}
+
+func (fa *frequentActors) lookupAddress(addrHash []byte) ([]byte, bool) {
+	if len(addrHash) != common.HashLength {
+		return nil, false
+	}
+	fa.mu.RLock()
+	defer fa.mu.RUnlock()
+	address, ok := fa.byHash[common.BytesToHash(addrHash)]
+	if !ok {
+		return nil, false
+	}
+	atomic.AddUint64(&fa.preimagesSaved, 1)
+	return common.CopyBytes(address[:]), true
+}
+
+// ranked returns the addresses of the table ordered by their scores, the highest first.
+// It is to be called with the write lock held (or before the table is shared)
+func (fa *frequentActors) ranked() []common.Address {
+	ranked := make([]common.Address, 0, len(fa.byAddress))
+	for address := range fa.byAddress {
+		ranked = append(ranked, address)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		si, sj := fa.byAddress[ranked[i]].score, fa.byAddress[ranked[j]].score
+		if si != sj {
+			return si > sj
+		}
+		return bytes.Compare(ranked[i][:], ranked[j][:]) < 0
+	})
+	return ranked
+}
+
+func (fa *frequentActors) add(address common.Address, addrHash common.Hash, score uint64) {
+	fa.byAddress[address] = &frequentActor{score: score, addrHash: addrHash}
+	fa.byHash[addrHash] = address
+}
+
+func (fa *frequentActors) remove(address common.Address) {
+	delete(fa.byHash, fa.byAddress[address].addrHash)
+	delete(fa.byAddress, address)
+}
+
+// WriteFrequentActors refreshes the table of the frequent actors (see SetFrequentActors) every 100 blocks:
+// the scores of the accounts in the table are halved, the accounts missed since the last refresh compete
+// with them by their numbers of misses (only the recently missed ones are counted, up to 16 per entry
+// of the table), and the ones with the highest scores are kept in the table.
+// It is meant to be called after CommitBlock
+func (dsw *DbStateWriter) WriteFrequentActors() error {
+	fa := dsw.tds.frequentActors
+	if fa == nil || dsw.tds.blockNr%frequentActorsRefreshInterval != 0 {
+		return nil
+	}
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	for _, actor := range fa.byAddress {
+		actor.score /= 2
+	}
+	for _, key := range fa.counts.Keys() {
+		address := key.(common.Address)
+		if _, ok := fa.byAddress[address]; ok {
+			continue
+		}
+		count, ok := fa.counts.Peek(address)
+		if !ok {
+			continue
+		}
+		addrHash, err := common.HashData(address[:])
+		if err != nil {
+			return err
+		}
+		fa.add(address, addrHash, *count.(*uint64))
+	}
+	fa.counts.Purge()
+	if ranked := fa.ranked(); len(ranked) > fa.size {
+		for _, address := range ranked[fa.size:] {
+			addrHash := fa.byAddress[address].addrHash
+			fa.remove(address)
+			if err := dsw.db.Delete(dbutils.FrequentActorsBucket, addrHash[:]); err != nil && err != ethdb.ErrKeyNotFound {
+				return err
+			}
+		}
+	}
+	for address, actor := range fa.byAddress {
+		v := make([]byte, common.AddressLength+8)
+		copy(v, address[:])
+		binary.BigEndian.PutUint64(v[common.AddressLength:], actor.score)
+		if err := dsw.db.Put(dbutils.FrequentActorsBucket, common.CopyBytes(actor.addrHash[:]), v); err != nil {
+			return err
+		}
+	}
+	fa.entries = len(fa.byAddress)
+	dsw.tds.getLogger().Debug("Refreshed frequent actors", "entries", fa.entries, "hashes saved", atomic.LoadUint64(&fa.hashesSaved),
+		"preimages saved", atomic.LoadUint64(&fa.preimagesSaved), "misses", atomic.LoadUint64(&fa.misses))
+	return nil
+}
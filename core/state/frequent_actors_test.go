@@ -0,0 +1,130 @@
+package state
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestFrequentActors(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tds.SetFrequentActors(2); err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := common.HexToAddress("0xa"), common.HexToAddress("0xb"), common.HexToAddress("0xc")
+	for _, address := range []common.Address{a, a, a, b, b, c} {
+		if _, err = tds.HashAddress(address, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := tds.FrequentActorStats(); stats.Misses != 6 || stats.HashesSaved != 0 || stats.Entries != 0 {
+		t.Errorf("unexpected stats before the refresh: %+v", stats)
+	}
+
+	// Not refreshed between the intervals
+	tds.SetBlockNr(frequentActorsRefreshInterval - 1)
+	if err = tds.DbStateWriter().WriteFrequentActors(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := tds.FrequentActorStats(); stats.Entries != 0 {
+		t.Errorf("expected no entries before the interval, got %d", stats.Entries)
+	}
+	tds.SetBlockNr(frequentActorsRefreshInterval)
+	if err = tds.DbStateWriter().WriteFrequentActors(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := tds.FrequentActorStats(); stats.Entries != 2 {
+		t.Errorf("expected 2 entries, got %d", stats.Entries)
+	}
+	hashC := crypto.Keccak256Hash(c[:])
+	if _, err = db.Get(dbutils.FrequentActorsBucket, hashC[:]); err != ethdb.ErrKeyNotFound {
+		t.Errorf("expected the least frequent actor not to be stored, got error %v", err)
+	}
+
+	addrHash, err := tds.HashAddress(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrHash != crypto.Keccak256Hash(a[:]) {
+		t.Errorf("wrong address hash from the table: %x", addrHash)
+	}
+	hashB := crypto.Keccak256Hash(b[:])
+	if key := tds.GetKey(hashB[:]); !bytes.Equal(key, b[:]) {
+		t.Errorf("wrong preimage from the table: %x", key)
+	}
+	if stats := tds.FrequentActorStats(); stats.HashesSaved != 1 || stats.PreimagesSaved != 1 || stats.Misses != 6 {
+		t.Errorf("unexpected stats after the refresh: %+v", stats)
+	}
+
+	// Smaller table loaded from the database keeps the most frequent actor
+	tds2, err := NewTrieDbState(common.Hash{}, db, frequentActorsRefreshInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tds2.SetFrequentActors(1); err != nil {
+		t.Fatal(err)
+	}
+	if stats := tds2.FrequentActorStats(); stats.Entries != 1 {
+		t.Errorf("expected 1 entry loaded, got %d", stats.Entries)
+	}
+	if _, err = tds2.HashAddress(a, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds2.HashAddress(b, false); err != nil {
+		t.Fatal(err)
+	}
+	if stats := tds2.FrequentActorStats(); stats.HashesSaved != 1 || stats.Misses != 1 {
+		t.Errorf("unexpected stats of the loaded table: %+v", stats)
+	}
+}
+
+func TestFrequentActorsConcurrent(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tds.SetFrequentActors(1); err != nil {
+		t.Fatal(err)
+	}
+	frequent := common.HexToAddress("0xf")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				// Many rare actors, and the frequent one
+				if _, err := tds.HashAddress(common.BytesToAddress([]byte{byte(i), byte(j)}), false); err != nil {
+					t.Error(err)
+				}
+				if _, err := tds.HashAddress(frequent, false); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := tds.frequentActors.counts.Len(); n > frequentActorsCandidates {
+		t.Errorf("expected at most %d candidates counted, got %d", frequentActorsCandidates, n)
+	}
+	tds.SetBlockNr(frequentActorsRefreshInterval)
+	if err = tds.DbStateWriter().WriteFrequentActors(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.HashAddress(frequent, false); err != nil {
+		t.Fatal(err)
+	}
+	if stats := tds.FrequentActorStats(); stats.Entries != 1 || stats.HashesSaved != 1 || stats.Misses != 800 {
+		t.Errorf("expected the frequent actor in the table, got %+v", stats)
+	}
+}
@@ -0,0 +1,211 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// AccessPricing is a hypothetical pricing of the state accesses, evaluated by SimulateAccessGas
+type AccessPricing interface {
+	// TouchGas returns the gas of the touch. warm tells whether the same item has already been touched
+	// by the same transaction
+	TouchGas(touch trie.Touch, warm bool) uint64
+	// WitnessGas returns the gas of the witness of the block, zero if the witness is not priced
+	WitnessGas(stats *trie.BlockWitnessStats) uint64
+}
+
+// FlatPricing charges the same for every touch of the same kind, like the pricing of Istanbul
+type FlatPricing struct {
+	AccountRead  uint64
+	StorageRead  uint64
+	CodeRead     uint64
+	AccountWrite uint64
+	StorageWrite uint64
+}
+
+// IstanbulPricing approximates the pricing of the state accesses in Istanbul. The writes of the storage
+// are charged as the modifications of the existing items, as the touches do not tell the original values
+var IstanbulPricing = FlatPricing{
+	AccountRead:  params.BalanceGasEIP1884,
+	StorageRead:  params.SloadGasEIP1884,
+	CodeRead:     params.ExtcodeHashGasEIP1884,
+	StorageWrite: params.SstoreCleanGasEIP2200,
+}
+
+func (p FlatPricing) TouchGas(touch trie.Touch, warm bool) uint64 {
+	switch touch.Kind {
+	case trie.TouchAccount:
+		if touch.Access == trie.TouchRead {
+			return p.AccountRead
+		}
+		return p.AccountWrite
+	case trie.TouchStorage:
+		if touch.Access == trie.TouchRead {
+			return p.StorageRead
+		}
+		return p.StorageWrite
+	case trie.TouchCode:
+		return p.CodeRead
+	}
+	return 0
+}
+
+func (p FlatPricing) WitnessGas(*trie.BlockWitnessStats) uint64 {
+	return 0
+}
+
+// ColdWarmPricing charges more for the first touch of an item by the transaction than for the subsequent ones,
+// as proposed by EIP-2929. The writes of the storage are charged on top of the access
+type ColdWarmPricing struct {
+	ColdAccount  uint64
+	ColdStorage  uint64
+	Warm         uint64
+	StorageWrite uint64
+}
+
+// EIP2929Pricing is the pricing proposed by EIP-2929
+var EIP2929Pricing = ColdWarmPricing{
+	ColdAccount:  2600,
+	ColdStorage:  2100,
+	Warm:         100,
+	StorageWrite: params.SstoreCleanGasEIP2200 - 2100,
+}
+
+func (p ColdWarmPricing) TouchGas(touch trie.Touch, warm bool) uint64 {
+	var gas uint64
+	switch {
+	case warm:
+		gas = p.Warm
+	case touch.Kind == trie.TouchStorage:
+		gas = p.ColdStorage
+	default:
+		gas = p.ColdAccount
+	}
+	if touch.Kind == trie.TouchStorage && touch.Access != trie.TouchRead {
+		gas += p.StorageWrite
+	}
+	return gas
+}
+
+func (p ColdWarmPricing) WitnessGas(*trie.BlockWitnessStats) uint64 {
+	return 0
+}
+
+// WitnessPricing charges for the size of the witness of the block instead of the touches
+type WitnessPricing struct {
+	TrieByte uint64 // Gas per byte of the witness, except the codes
+	CodeByte uint64 // Gas per byte of the codes in the witness
+}
+
+func (p WitnessPricing) TouchGas(trie.Touch, bool) uint64 {
+	return 0
+}
+
+func (p WitnessPricing) WitnessGas(stats *trie.BlockWitnessStats) uint64 {
+	codes := stats.CodesSize()
+	return p.TrieByte*(stats.BlockWitnessSize()-codes) + p.CodeByte*codes
+}
+
+// GasReport is the result of SimulateAccessGas
+type GasReport struct {
+	TxGas      []uint64 // Gas of the touches, by the index of the buffer (normally, transaction) where they happened
+	WitnessGas uint64   // Gas of the witness of the whole block
+}
+
+// Total is the gas of the whole block
+func (r *GasReport) Total() uint64 {
+	total := r.WitnessGas
+	for _, gas := range r.TxGas {
+		total += gas
+	}
+	return total
+}
+
+// SimulateAccessGas computes the gas that the touches of a block would cost under the pricing. The touches and
+// the witness are normally those of the block just processed, see TrieDbState.ExtractTypedWitness. The witness
+// can be nil for the pricings that do not depend on it
+func SimulateAccessGas(touches []trie.Touch, witness *trie.Witness, pricing AccessPricing) (*GasReport, error) {
+	report := &GasReport{}
+	if witness != nil {
+		stats, err := witness.WriteTo(ioutil.Discard)
+		if err != nil {
+			return nil, err
+		}
+		report.WitnessGas = pricing.WitnessGas(stats)
+	}
+	// Items touched by each transaction, by the kind and the key
+	warm := make(map[int]map[string]struct{})
+	for _, touch := range touches {
+		if touch.BufferIndex < 0 {
+			return nil, fmt.Errorf("negative buffer index %d", touch.BufferIndex)
+		}
+		for len(report.TxGas) <= touch.BufferIndex {
+			report.TxGas = append(report.TxGas, 0)
+		}
+		txWarm, ok := warm[touch.BufferIndex]
+		if !ok {
+			txWarm = make(map[string]struct{})
+			warm[touch.BufferIndex] = txWarm
+		}
+		item := string(append([]byte{byte(touch.Kind)}, touch.Key...))
+		_, isWarm := txWarm[item]
+		txWarm[item] = struct{}{}
+		report.TxGas[touch.BufferIndex] += pricing.TouchGas(touch, isWarm)
+	}
+	return report, nil
+}
+
+// BlockTouches are the touches of one block
+type BlockTouches struct {
+	BlockNr uint64
+	Touches []trie.Touch
+}
+
+// TouchesFromAccessTrace converts the access trace recorded by RecordingReader into the touches of the blocks,
+// so that it can be priced by SimulateAccessGas. The trace does not tell the boundaries of the transactions,
+// so all the touches of a block are attributed to the same buffer. The reads recorded before the first block
+// boundary are attributed to the block 0
+func TouchesFromAccessTrace(trace []Access) ([]BlockTouches, error) {
+	var blocks []BlockTouches
+	if len(trace) > 0 && trace[0].Kind != AccessBlock {
+		blocks = append(blocks, BlockTouches{})
+	}
+	for i := range trace {
+		a := &trace[i]
+		if a.Kind == AccessBlock {
+			blocks = append(blocks, BlockTouches{BlockNr: a.BlockNr})
+			continue
+		}
+		var touch trie.Touch
+		switch a.Kind {
+		case AccessAccount:
+			addrHash, err := common.HashData(a.Address[:])
+			if err != nil {
+				return nil, err
+			}
+			touch = trie.Touch{Key: addrHash[:], Kind: trie.TouchAccount}
+		case AccessStorage:
+			addrHash, err := common.HashData(a.Address[:])
+			if err != nil {
+				return nil, err
+			}
+			keyHash, err := common.HashData(a.Key[:])
+			if err != nil {
+				return nil, err
+			}
+			touch = trie.Touch{Key: dbutils.GenerateCompositeTrieKey(addrHash, keyHash), Kind: trie.TouchStorage}
+		case AccessCode, AccessCodeSize:
+			touch = trie.Touch{Key: common.CopyBytes(a.CodeHash[:]), Kind: trie.TouchCode}
+		default:
+			return nil, fmt.Errorf("access %d: unknown access kind %d", i, a.Kind)
+		}
+		block := &blocks[len(blocks)-1]
+		block.Touches = append(block.Touches, touch)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,121 @@
+package state
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestSimulateAccessGas(t *testing.T) {
+	k1, k2, a := []byte("k1"), []byte("k2"), []byte("a")
+	touches := []trie.Touch{
+		{Key: k1, Kind: trie.TouchStorage, Access: trie.TouchRead},
+		{Key: k1, Kind: trie.TouchStorage, Access: trie.TouchRead},
+		{Key: k2, Kind: trie.TouchStorage, Access: trie.TouchWrite},
+		{Key: k1, Kind: trie.TouchStorage, Access: trie.TouchRead, BufferIndex: 1},
+		{Key: a, Kind: trie.TouchAccount, Access: trie.TouchRead},
+	}
+	for _, tc := range []struct {
+		name     string
+		pricing  AccessPricing
+		expected []uint64
+	}{
+		{"istanbul", IstanbulPricing, []uint64{800 + 800 + 5000 + 700, 800}},
+		{"eip2929", EIP2929Pricing, []uint64{2100 + 100 + 5000 + 2600, 2100}},
+		{"witness", WitnessPricing{TrieByte: 1}, []uint64{0, 0}},
+	} {
+		report, err := SimulateAccessGas(touches, nil, tc.pricing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.TxGas) != len(tc.expected) || report.TxGas[0] != tc.expected[0] || report.TxGas[1] != tc.expected[1] {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, report.TxGas)
+		}
+		if report.Total() != tc.expected[0]+tc.expected[1] {
+			t.Errorf("%s: unexpected total %d", tc.name, report.Total())
+		}
+	}
+}
+
+func TestSimulateWitnessGas(t *testing.T) {
+	tds, err := NewTrieDbState(common.Hash{}, ethdb.NewMemDatabase(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tds.StartNewBuffer()
+	w := tds.TrieStateWriter()
+	for i := 0; i < 10; i++ {
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i + 1)
+		if err = w.UpdateAccountData(ctx, common.BytesToAddress([]byte{byte(i)}), &accounts.Account{}, &acc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetResolveReads(true)
+	tds.ExtractTouches()
+	tds.StartNewBuffer()
+	for i := 0; i < 3; i++ {
+		if _, err = tds.ReadAccountData(common.BytesToAddress([]byte{byte(i)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = tds.ResolveStateTrie(false); err != nil {
+		t.Fatal(err)
+	}
+	witness, touches, err := tds.ExtractTypedWitness(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(touches) != 3 {
+		t.Errorf("expected the touches of 3 accounts, got %d", len(touches))
+	}
+	stats, err := witness.WriteTo(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := SimulateAccessGas(touches, witness, WitnessPricing{TrieByte: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.WitnessGas == 0 || report.WitnessGas != 2*stats.BlockWitnessSize() {
+		t.Errorf("expected %d gas for the witness, got %d", 2*stats.BlockWitnessSize(), report.WitnessGas)
+	}
+}
+
+func TestTouchesFromAccessTrace(t *testing.T) {
+	addr := common.HexToAddress("0x1")
+	trace := []Access{
+		{Kind: AccessAccount, Address: addr},
+		{Kind: AccessBlock, BlockNr: 5},
+		{Kind: AccessStorage, Address: addr, Incarnation: 1, Key: common.Hash{1}},
+		{Kind: AccessCode, Address: addr, CodeHash: common.Hash{2}},
+		{Kind: AccessCodeSize, Address: addr, CodeHash: common.Hash{2}},
+	}
+	blocks, err := TouchesFromAccessTrace(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[0].BlockNr != 0 || blocks[1].BlockNr != 5 {
+		t.Fatalf("unexpected blocks %+v", blocks)
+	}
+	if len(blocks[0].Touches) != 1 || len(blocks[1].Touches) != 3 {
+		t.Fatalf("unexpected touches %+v", blocks)
+	}
+	report, err := SimulateAccessGas(blocks[1].Touches, nil, EIP2929Pricing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The code is warm when its size is read after the code itself
+	if expected := uint64(2100 + 2600 + 100); report.Total() != expected {
+		t.Errorf("expected %d, got %d", expected, report.Total())
+	}
+}
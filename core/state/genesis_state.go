@@ -0,0 +1,110 @@
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// GenesisAccount is the account of the genesis state, as in core.GenesisAccount
+type GenesisAccount struct {
+	Code    []byte
+	Storage map[common.Hash]common.Hash
+	Balance *big.Int
+	Nonce   uint64
+}
+
+type sortedItems struct {
+	keys, values [][]byte
+}
+
+func (s *sortedItems) Len() int           { return len(s.keys) }
+func (s *sortedItems) Less(i, j int) bool { return bytes.Compare(s.keys[i], s.keys[j]) < 0 }
+func (s *sortedItems) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+// WriteGenesisState writes the genesis state into the flat buckets, with the history records of block 0,
+// the same way as the DbStateWriter does, and returns the state root. The root is computed by streaming
+// the sorted keys into the hash builder (see trie.RootOfSorted), without constructing the trie, so the
+// binary trie root can be produced as well as the hexary one
+func WriteGenesisState(db ethdb.Database, alloc map[common.Address]GenesisAccount, binary bool) (common.Hash, error) {
+	var accountItems sortedItems
+	for address, ga := range alloc {
+		addrHash := crypto.Keccak256Hash(address[:])
+		acc := accounts.NewAccount()
+		acc.Initialised = true
+		acc.Nonce = ga.Nonce
+		if ga.Balance != nil {
+			acc.Balance.Set(ga.Balance)
+		}
+		if len(ga.Code) > 0 || len(ga.Storage) > 0 {
+			acc.Incarnation = 1
+		}
+
+		var storageItems sortedItems
+		for key, value := range ga.Storage {
+			v := bytes.TrimLeft(value[:], "\x00")
+			if len(v) == 0 {
+				continue
+			}
+			keyHash := crypto.Keccak256Hash(key[:])
+			storageItems.keys = append(storageItems.keys, keyHash[:])
+			storageItems.values = append(storageItems.values, common.CopyBytes(v))
+			compositeKey := dbutils.GenerateCompositeStorageKey(addrHash, acc.Incarnation, keyHash)
+			if err := db.Put(dbutils.StorageBucket, compositeKey, common.CopyBytes(v)); err != nil {
+				return common.Hash{}, err
+			}
+			if err := db.PutS(dbutils.StorageHistoryBucket, compositeKey, []byte{}, 0, false); err != nil {
+				return common.Hash{}, err
+			}
+		}
+		sort.Sort(&storageItems)
+		root, err := trie.RootOfSorted(storageItems.keys, storageItems.values, binary)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		acc.Root = root
+
+		if len(ga.Code) > 0 {
+			codeHash := crypto.Keccak256Hash(ga.Code)
+			acc.CodeHash = codeHash
+			if err := db.Put(dbutils.CodeBucket, codeHash[:], common.CopyBytes(ga.Code)); err != nil {
+				return common.Hash{}, err
+			}
+			if err := writeCodeSize(db, codeHash, ga.Code); err != nil {
+				return common.Hash{}, err
+			}
+			if debug.IsThinHistory() {
+				if err := db.Put(dbutils.ContractCodeBucket, dbutils.GenerateStoragePrefix(addrHash, acc.Incarnation), codeHash[:]); err != nil {
+					return common.Hash{}, err
+				}
+			}
+		}
+
+		data := make([]byte, acc.EncodingLengthForStorage())
+		acc.EncodeForStorage(data)
+		if err := db.Put(dbutils.AccountsBucket, addrHash[:], data); err != nil {
+			return common.Hash{}, err
+		}
+		if err := db.PutS(dbutils.AccountsHistoryBucket, addrHash[:], []byte{}, 0, false); err != nil {
+			return common.Hash{}, err
+		}
+
+		leaf := make([]byte, acc.EncodingLengthForHashing())
+		acc.EncodeForHashing(leaf)
+		accountItems.keys = append(accountItems.keys, addrHash[:])
+		accountItems.values = append(accountItems.values, leaf)
+	}
+	sort.Sort(&accountItems)
+	return trie.RootOfSortedEncoded(accountItems.keys, accountItems.values, binary)
+}
@@ -0,0 +1,109 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestWriteGenesisState(t *testing.T) {
+	alloc := map[common.Address]GenesisAccount{
+		common.HexToAddress("0x1"): {Balance: big.NewInt(1000)},
+		common.HexToAddress("0x2"): {Balance: big.NewInt(5), Nonce: 3},
+		common.HexToAddress("0x3"): {
+			Balance: big.NewInt(0),
+			Code:    []byte{0x60, 0x00},
+			Storage: map[common.Hash]common.Hash{{1}: {31: 1}, {2}: common.HexToHash("0xff00ff"), {3}: {}},
+		},
+	}
+
+	// Reference: the same state written through the IntraBlockState
+	refDb := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, refDb, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tds.StartNewBuffer()
+	ibs := New(tds)
+	for addr, ga := range alloc {
+		ibs.AddBalance(addr, ga.Balance)
+		ibs.SetCode(addr, ga.Code)
+		ibs.SetNonce(addr, ga.Nonce)
+		for key, value := range ga.Storage {
+			ibs.SetState(addr, key, value)
+		}
+		if len(ga.Code) > 0 || len(ga.Storage) > 0 {
+			ibs.SetIncarnation(addr, 1)
+		}
+	}
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	roots, err := tds.ComputeTrieRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+
+	db := ethdb.NewMemDatabase()
+	root, err := WriteGenesisState(db, alloc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := roots[len(roots)-1]; root != expected {
+		t.Errorf("expected root %x, got %x", expected, root)
+	}
+	for _, bucket := range [][]byte{dbutils.AccountsBucket, dbutils.StorageBucket, dbutils.CodeBucket} {
+		if err = refDb.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			got, err1 := db.Get(bucket, k)
+			if err1 != nil || string(got) != string(v) {
+				t.Errorf("bucket %s, key %x: expected %x, got %x (%v)", bucket, k, v, got, err1)
+			}
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Binary root matches the binary trie with the same content
+	binRoot, err := WriteGenesisState(ethdb.NewMemDatabase(), alloc, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := trie.NewBinary(common.Hash{})
+	if err = db.Walk(dbutils.AccountsBucket, nil, 0, func(k, v []byte) (bool, error) {
+		var acc accounts.Account
+		if err1 := acc.DecodeForStorage(v); err1 != nil {
+			return false, err1
+		}
+		// Storage is inserted below
+		acc.Root = trie.EmptyRoot
+		bt.UpdateAccount(common.CopyBytes(k), &acc)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Walk(dbutils.StorageBucket, nil, 0, func(k, v []byte) (bool, error) {
+		addrHash := common.BytesToHash(k[:common.HashLength])
+		keyHash := common.BytesToHash(k[common.HashLength+common.IncarnationLength:])
+		bt.Update(dbutils.GenerateCompositeTrieKey(addrHash, keyHash), common.CopyBytes(v), 0)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := bt.Hash(); binRoot != expected {
+		t.Errorf("expected binary root %x, got %x", expected, binRoot)
+	}
+	if binRoot == root {
+		t.Errorf("binary and hexary roots should differ")
+	}
+}
@@ -0,0 +1,191 @@
+package state
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// healLogEvery is the number of checked accounts between the progress reports
+const healLogEvery = 100000
+
+// StorageFetcher supplies the complete storage of a contract from an external source (for example, from the peers),
+// so that Heal can repair the storage that is missing or corrupted in the database.
+// Values are expected in the same form as in the StorageBucket (without leading zeros)
+type StorageFetcher interface {
+	FetchStorage(ctx context.Context, addrHash common.Hash, storageRoot common.Hash) (map[common.Hash][]byte, error)
+}
+
+// HealProgress is reported periodically while healing, and once more at the end
+type HealProgress struct {
+	Checked  uint64      // Number of accounts checked so far
+	Damaged  uint64      // Number of contracts whose storage does not match their storage root
+	Repaired uint64      // Number of damaged contracts that have been repaired
+	Last     common.Hash // Address hash of the last checked account
+}
+
+// HealReport lists the contracts found damaged by Heal
+type HealReport struct {
+	HealProgress
+	Unrepaired []common.Hash // Address hashes of the damaged contracts that could not be repaired
+}
+
+// Healer detects contracts whose storage root does not match the content of the StorageBucket
+// (for example, after an interrupted import), and repairs them using the StorageFetcher, if one is set
+type Healer struct {
+	db       ethdb.Database
+	fetcher  StorageFetcher
+	progress func(HealProgress)
+}
+
+func NewHealer(db ethdb.Database) *Healer {
+	return &Healer{db: db}
+}
+
+// SetFetcher sets the source of the storage for the repairs. Without it, damaged contracts are only reported
+func (h *Healer) SetFetcher(fetcher StorageFetcher) {
+	h.fetcher = fetcher
+}
+
+// SetProgressHook sets the function receiving the progress reports
+func (h *Healer) SetProgressHook(progress func(HealProgress)) {
+	h.progress = progress
+}
+
+// Heal checks the storage of every contract in the current state, using the default Healer
+func Heal(ctx context.Context, db ethdb.Database) (*HealReport, error) {
+	return NewHealer(db).Heal(ctx)
+}
+
+// Heal checks the storage of every contract in the current state. The contracts are checked first,
+// and the damaged ones are repaired afterwards, one at a time
+func (h *Healer) Heal(ctx context.Context) (*HealReport, error) {
+	report := &HealReport{}
+	var damaged []common.Hash
+	damagedAccounts := make(map[common.Hash]*accounts.Account)
+	if err := h.db.Walk(dbutils.AccountsBucket, nil, 0, func(k, v []byte) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		addrHash := common.BytesToHash(k)
+		var acc accounts.Account
+		if err := acc.DecodeForStorage(v); err != nil {
+			return false, fmt.Errorf("decoding account %x: %v", addrHash, err)
+		}
+		report.Checked++
+		report.Last = addrHash
+		if acc.Root == (common.Hash{}) {
+			acc.Root = trie.EmptyRoot
+		}
+		if acc.Incarnation > 0 || acc.Root != trie.EmptyRoot {
+			root, err := flatStorageRoot(h.db, addrHash, &acc)
+			if err != nil {
+				return false, err
+			}
+			if root != acc.Root {
+				log.Warn("Storage root mismatch", "account", addrHash, "incarnation", acc.Incarnation, "expected", acc.Root, "got", root)
+				report.Damaged++
+				damaged = append(damaged, addrHash)
+				damagedAccounts[addrHash] = &acc
+			}
+		}
+		if report.Checked%healLogEvery == 0 {
+			h.reportProgress(report)
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, addrHash := range damaged {
+		if h.fetcher == nil {
+			report.Unrepaired = append(report.Unrepaired, addrHash)
+			continue
+		}
+		if err := h.repair(ctx, addrHash, damagedAccounts[addrHash]); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Warn("Could not repair storage", "account", addrHash, "err", err)
+			report.Unrepaired = append(report.Unrepaired, addrHash)
+			continue
+		}
+		report.Repaired++
+		h.reportProgress(report)
+	}
+	h.reportProgress(report)
+	return report, nil
+}
+
+func (h *Healer) reportProgress(report *HealReport) {
+	log.Info("Healing state", "checked", report.Checked, "damaged", report.Damaged, "repaired", report.Repaired)
+	if h.progress != nil {
+		h.progress(report.HealProgress)
+	}
+}
+
+// repair replaces the storage of the current incarnation of the contract with the fetched one,
+// after checking that the fetched storage matches the storage root of the account
+func (h *Healer) repair(ctx context.Context, addrHash common.Hash, acc *accounts.Account) error {
+	storage, err := h.fetcher.FetchStorage(ctx, addrHash, acc.Root)
+	if err != nil {
+		return err
+	}
+	root, _ := storageRoot(addrHash, acc, func(t *trie.Trie) error {
+		for keyHash, v := range storage {
+			if len(v) > 0 {
+				t.Update(dbutils.GenerateCompositeTrieKey(addrHash, keyHash), v, 0)
+			}
+		}
+		return nil
+	})
+	if root != acc.Root {
+		return fmt.Errorf("fetched storage has root %x, expected %x", root, acc.Root)
+	}
+	batch := h.db.NewBatch()
+	if err := DeleteIncarnationStorage(batch, addrHash, acc.Incarnation); err != nil {
+		batch.Rollback()
+		return err
+	}
+	for keyHash, v := range storage {
+		if len(v) == 0 {
+			continue
+		}
+		if err := batch.Put(dbutils.StorageBucket, dbutils.GenerateCompositeStorageKey(addrHash, acc.Incarnation, keyHash), common.CopyBytes(v)); err != nil {
+			batch.Rollback()
+			return err
+		}
+	}
+	_, err = batch.Commit()
+	return err
+}
+
+// flatStorageRoot computes the storage root of the current incarnation of the contract from the StorageBucket
+func flatStorageRoot(db ethdb.Getter, addrHash common.Hash, acc *accounts.Account) (common.Hash, error) {
+	return storageRoot(addrHash, acc, func(t *trie.Trie) error {
+		return WalkIncarnationStorage(db, addrHash, acc.Incarnation, func(keyHash common.Hash, v []byte) (bool, error) {
+			t.Update(dbutils.GenerateCompositeTrieKey(addrHash, keyHash), common.CopyBytes(v), 0)
+			return true, nil
+		})
+	})
+}
+
+// storageRoot computes the storage root of the contract from scratch, from the storage items inserted by fill
+func storageRoot(addrHash common.Hash, acc *accounts.Account, fill func(t *trie.Trie) error) (common.Hash, error) {
+	a := new(accounts.Account)
+	a.Copy(acc)
+	a.Root = trie.EmptyRoot
+	t := trie.New(common.Hash{})
+	t.UpdateAccount(addrHash[:], a)
+	if err := fill(t); err != nil {
+		return common.Hash{}, err
+	}
+	_, root := t.DeepHash(addrHash[:])
+	return root, nil
+}
@@ -0,0 +1,97 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+type mapStorageFetcher map[common.Hash]map[common.Hash][]byte
+
+func (f mapStorageFetcher) FetchStorage(_ context.Context, addrHash common.Hash, _ common.Hash) (map[common.Hash][]byte, error) {
+	return f[addrHash], nil
+}
+
+func TestHeal(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	addr := common.HexToAddress("0x1234")
+	ibs := New(tds)
+	ibs.CreateAccount(addr, true)
+	ibs.SetCode(addr, []byte{0x60, 0x00})
+	for i := byte(1); i <= 3; i++ {
+		ibs.SetState(addr, common.Hash{i}, common.Hash{i})
+	}
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Heal(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Damaged != 0 {
+		t.Fatalf("expected no damaged contracts, got %d", report.Damaged)
+	}
+
+	addrHash := crypto.Keccak256Hash(addr[:])
+	acc, err := tds.ReadAccountData(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := make(map[common.Hash][]byte)
+	if err = WalkIncarnationStorage(db, addrHash, acc.Incarnation, func(keyHash common.Hash, v []byte) (bool, error) {
+		storage[keyHash] = common.CopyBytes(v)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an interrupted import by losing one of the storage items
+	for keyHash := range storage {
+		if err = db.Delete(dbutils.StorageBucket, dbutils.GenerateCompositeStorageKey(addrHash, acc.Incarnation, keyHash)); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	report, err = Heal(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Damaged != 1 || len(report.Unrepaired) != 1 || report.Unrepaired[0] != addrHash {
+		t.Fatalf("expected the contract to be reported damaged, got %+v", report)
+	}
+
+	healer := NewHealer(db)
+	healer.SetFetcher(mapStorageFetcher{addrHash: storage})
+	var progress []HealProgress
+	healer.SetProgressHook(func(p HealProgress) { progress = append(progress, p) })
+	if report, err = healer.Heal(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired != 1 || len(report.Unrepaired) != 0 {
+		t.Fatalf("expected the contract to be repaired, got %+v", report)
+	}
+	if len(progress) == 0 || progress[len(progress)-1].Repaired != 1 {
+		t.Errorf("expected the progress to be reported, got %+v", progress)
+	}
+	if report, err = Heal(ctx, db); err != nil || report.Damaged != 0 {
+		t.Errorf("expected no damaged contracts after the repair, got %+v, error %v", report, err)
+	}
+}
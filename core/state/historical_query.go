@@ -0,0 +1,63 @@
+package state
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// QueryHistorical runs f against the state as of each of the given blocks, concurrently. Every block gets
+// its own historical reader (see DbState), and at most `readers` of them are active at the same time
+// (runtime.NumCPU() if readers is not positive). The first error returned by f stops the remaining queries
+// and is returned, as is the error of the context if it is cancelled before all blocks are processed
+func QueryHistorical(ctx context.Context, db ethdb.Getter, blockNrs []uint64, readers int, f func(blockNr uint64, reader StateReader) error) error {
+	if readers <= 0 {
+		readers = runtime.NumCPU()
+	}
+	if readers > len(blockNrs) {
+		readers = len(blockNrs)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan uint64)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blockNr := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := f(blockNr, NewDbState(db, blockNr)); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+feed:
+	for _, blockNr := range blockNrs {
+		select {
+		case jobs <- blockNr:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestQueryHistorical(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := common.HexToAddress("0xa")
+	blockNrs := []uint64{1, 2, 3, 4, 5, 6}
+	for _, blockNr := range blockNrs {
+		commitTestBlock(t, tds, blockNr, func(ibs *IntraBlockState) {
+			ibs.AddBalance(addr, big.NewInt(10))
+		})
+	}
+
+	var active, maxActive int32
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	if err = QueryHistorical(context.Background(), db, blockNrs, 2, func(blockNr uint64, reader StateReader) error {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		acc, err := reader.ReadAccountData(addr)
+		if err != nil {
+			return err
+		}
+		if acc == nil || acc.Balance.Uint64() != 10*blockNr {
+			t.Errorf("block %d: unexpected account %+v", blockNr, acc)
+		}
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		seen[blockNr] = true
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(blockNrs) {
+		t.Errorf("expected all blocks queried, got %v", seen)
+	}
+	if maxActive > 2 {
+		t.Errorf("expected at most 2 concurrent readers, got %d", maxActive)
+	}
+}
+
+func TestQueryHistoricalError(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	errFirst := errors.New("first")
+	var queried []uint64
+	// With the single reader, the blocks are queried in order
+	err := QueryHistorical(context.Background(), db, []uint64{1, 2, 3, 4, 5}, 1, func(blockNr uint64, _ StateReader) error {
+		queried = append(queried, blockNr)
+		switch blockNr {
+		case 3:
+			return errFirst
+		case 4, 5:
+			return errors.New("later")
+		}
+		return nil
+	})
+	if err != errFirst {
+		t.Errorf("expected the first error, got %v", err)
+	}
+	if len(queried) != 3 {
+		t.Errorf("expected the queries stopped after the error, got %v", queried)
+	}
+}
+
+func TestQueryHistoricalCancel(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	ctx, cancel := context.WithCancel(context.Background())
+	var queried []uint64
+	err := QueryHistorical(ctx, db, []uint64{1, 2, 3, 4, 5}, 1, func(blockNr uint64, _ StateReader) error {
+		queried = append(queried, blockNr)
+		if blockNr == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("expected the error of the context, got %v", err)
+	}
+	if len(queried) != 2 {
+		t.Errorf("expected the queries stopped by the cancellation, got %v", queried)
+	}
+
+	// Cancelled before the start
+	queried = nil
+	if err = QueryHistorical(ctx, db, []uint64{1, 2}, 2, func(blockNr uint64, _ StateReader) error {
+		queried = append(queried, blockNr)
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("expected the error of the context, got %v", err)
+	}
+	if len(queried) != 0 {
+		t.Errorf("expected no queries, got %v", queried)
+	}
+}
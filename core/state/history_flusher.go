@@ -0,0 +1,50 @@
+package state
+
+import (
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// BlockFinisher is implemented by the state writers that defer some of the writes until the end of the block.
+// IntraBlockState.CommitBlock calls FinishBlock after writing out the changes of the block
+type BlockFinisher interface {
+	FinishBlock() error
+}
+
+// SetHistoryBatching makes DbStateWriter collect the history records of the block and write them out when
+// the block is finished (see BlockFinisher), sorted and in one pass per historical bucket (see ethdb.PutSBatch),
+// instead of writing them one by one
+func (tds *TrieDbState) SetHistoryBatching(enabled bool) {
+	tds.historyBatching = enabled
+}
+
+// putHistory writes the history record, or adds it to the records of the block if the history is batched
+func (dsw *DbStateWriter) putHistory(hBucket, key, value []byte) error {
+	if dsw.history == nil {
+		return dsw.db.PutS(hBucket, key, value, dsw.tds.blockNr, dsw.tds.noHistory)
+	}
+	dsw.history[string(hBucket)] = append(dsw.history[string(hBucket)], ethdb.KV{K: key, V: value})
+	return nil
+}
+
+// FinishBlock writes out the history records of the block collected when the history is batched,
+// and the writes into the custom buckets made during the block (see TrieDbState.PutCustom),
+// and then invokes the commit hooks (see TrieDbState.OnCommit)
+func (dsw *DbStateWriter) FinishBlock() error {
+	if err := dsw.writeCustom(); err != nil {
+		return err
+	}
+	hBuckets := make([]string, 0, len(dsw.history))
+	for hBucket := range dsw.history {
+		hBuckets = append(hBuckets, hBucket)
+	}
+	sort.Strings(hBuckets)
+	for _, hBucket := range hBuckets {
+		if err := ethdb.PutSBatch(dsw.db, []byte(hBucket), dsw.history[hBucket], dsw.tds.blockNr, dsw.tds.noHistory); err != nil {
+			return err
+		}
+		delete(dsw.history, hBucket)
+	}
+	return dsw.runCommitHooks()
+}
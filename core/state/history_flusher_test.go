@@ -0,0 +1,75 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestHistoryBatching(t *testing.T) {
+	ctx := context.Background()
+	run := func(batching bool) ethdb.Database {
+		db := ethdb.NewMemDatabase()
+		tds, err := NewTrieDbState(common.Hash{}, db, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tds.SetHistoryBatching(batching)
+		for blockNr := uint64(1); blockNr <= 2; blockNr++ {
+			ibs := New(tds)
+			tds.StartNewBuffer()
+			for i := byte(1); i <= 3; i++ {
+				addr := common.Address{i}
+				if blockNr == 1 {
+					ibs.CreateAccount(addr, true)
+				}
+				ibs.AddBalance(addr, big.NewInt(int64(blockNr)))
+				ibs.SetState(addr, common.Hash{i}, common.Hash{31: byte(blockNr)})
+			}
+			if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = tds.ComputeTrieRoots(); err != nil {
+				t.Fatal(err)
+			}
+			tds.SetBlockNr(blockNr)
+			if err = tds.CommitBlock(ctx, ibs, NewTeeWriter(tds.DbStateWriter())); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db
+	}
+	dump := func(db ethdb.Database, bucket []byte) map[string]string {
+		m := make(map[string]string)
+		if err := db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			if bytes.Equal(bucket, dbutils.ChangeSetBucket) {
+				return true, dbutils.Walk(v, func(ck, cv []byte) error {
+					m[string(k)+string(ck)] = string(cv)
+					return nil
+				})
+			}
+			m[string(k)] = string(v)
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	single, batched := run(false), run(true)
+	for _, bucket := range [][]byte{dbutils.AccountsHistoryBucket, dbutils.StorageHistoryBucket, dbutils.ChangeSetBucket} {
+		expected, got := dump(single, bucket), dump(batched, bucket)
+		if len(expected) == 0 || len(got) != len(expected) {
+			t.Errorf("%s: expected %d entries, got %d", bucket, len(expected), len(got))
+		}
+		for k, v := range expected {
+			if got[k] != v {
+				t.Errorf("%s: expected %x for %x, got %x", bucket, v, k, got[k])
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+// HistoryRecord is the typed form of the records of the history buckets and of the change sets.
+//
+// The key of the record is the address hash for the accounts (AccountsHistoryBucket), and the address hash +
+// inverted incarnation + storage key hash for the storage items (StorageHistoryBucket). In the history buckets,
+// the key is followed by the encoded timestamp (block number, see dbutils.EncodeTimestamp), while the change
+// sets (and RewindData) give the key without it.
+//
+// The value is the state of the item before the block: the account in the storage encoding, or the storage
+// value without the leading zeros. Empty value means that the item did not exist
+type HistoryRecord struct {
+	Bucket      []byte // AccountsHistoryBucket or StorageHistoryBucket
+	AddrHash    common.Hash
+	Incarnation uint64      // Storage items only
+	KeyHash     common.Hash // Storage items only
+	BlockNr     uint64      // Only known for the records of the history buckets, see DecodeHistoryEntry
+	// Account before the block, nil if it did not exist (accounts only)
+	Account *accounts.Account
+	// Storage value before the block, empty if the item did not exist (storage items only)
+	Value []byte
+}
+
+// NewAccountHistoryRecord makes the record of the account before the change, original being nil or not initialised
+// if the account did not exist
+func NewAccountHistoryRecord(addrHash common.Hash, original *accounts.Account) *HistoryRecord {
+	rec := &HistoryRecord{Bucket: dbutils.AccountsHistoryBucket, AddrHash: addrHash}
+	if original != nil && original.Initialised {
+		rec.Account = original
+	}
+	return rec
+}
+
+// NewStorageHistoryRecord makes the record of the storage item before the change
+func NewStorageHistoryRecord(addrHash common.Hash, incarnation uint64, keyHash common.Hash, original []byte) *HistoryRecord {
+	return &HistoryRecord{
+		Bucket:      dbutils.StorageHistoryBucket,
+		AddrHash:    addrHash,
+		Incarnation: incarnation,
+		KeyHash:     keyHash,
+		Value:       bytes.TrimLeft(original, "\x00"),
+	}
+}
+
+// IsAccount tells whether the record is of an account rather than of a storage item
+func (r *HistoryRecord) IsAccount() bool {
+	return bytes.Equal(r.Bucket, dbutils.AccountsHistoryBucket)
+}
+
+// Key returns the key of the record without the timestamp, as it is passed to PutS and written to the change sets
+func (r *HistoryRecord) Key() []byte {
+	if r.IsAccount() {
+		return common.CopyBytes(r.AddrHash[:])
+	}
+	return dbutils.GenerateCompositeStorageKey(r.AddrHash, r.Incarnation, r.KeyHash)
+}
+
+// EncodeValue returns the value of the record, never nil
+func (r *HistoryRecord) EncodeValue() []byte {
+	if r.IsAccount() {
+		if r.Account == nil {
+			return []byte{}
+		}
+		v := make([]byte, r.Account.EncodingLengthForStorage())
+		r.Account.EncodeForStorage(v)
+		return v
+	}
+	v := make([]byte, len(r.Value))
+	copy(v, r.Value)
+	return v
+}
+
+// DecodeHistoryRecord decodes the record given by the key without the timestamp, as in the change sets
+// and in the callbacks of RewindData
+func DecodeHistoryRecord(hBucket, key, value []byte) (*HistoryRecord, error) {
+	rec := &HistoryRecord{Bucket: hBucket}
+	switch {
+	case bytes.Equal(hBucket, dbutils.AccountsHistoryBucket):
+		if len(key) != common.HashLength {
+			return nil, fmt.Errorf("account history key of %d bytes", len(key))
+		}
+		copy(rec.AddrHash[:], key)
+		if len(value) > 0 {
+			var acc accounts.Account
+			if err := acc.DecodeForStorage(value); err != nil {
+				return nil, err
+			}
+			rec.Account = &acc
+		}
+	case bytes.Equal(hBucket, dbutils.StorageHistoryBucket):
+		if len(key) != common.HashLength+common.IncarnationLength+common.HashLength {
+			return nil, fmt.Errorf("storage history key of %d bytes", len(key))
+		}
+		copy(rec.AddrHash[:], key[:common.HashLength])
+		rec.Incarnation = dbutils.DecodeIncarnation(key[common.HashLength:])
+		copy(rec.KeyHash[:], key[common.HashLength+common.IncarnationLength:])
+		rec.Value = common.CopyBytes(value)
+	default:
+		return nil, fmt.Errorf("unknown history bucket %q", hBucket)
+	}
+	return rec, nil
+}
+
+// DecodeHistoryEntry decodes the entry of the history bucket, whose key is followed by the encoded timestamp
+func DecodeHistoryEntry(hBucket, k, v []byte) (*HistoryRecord, error) {
+	keyLen := common.HashLength
+	if bytes.Equal(hBucket, dbutils.StorageHistoryBucket) {
+		keyLen += common.IncarnationLength + common.HashLength
+	}
+	if len(k) <= keyLen {
+		return nil, fmt.Errorf("history key of %d bytes has no timestamp", len(k))
+	}
+	blockNr, err := decodeTimestampSuffix(k[keyLen:])
+	if err != nil {
+		return nil, err
+	}
+	rec, err := DecodeHistoryRecord(hBucket, k[:keyLen], v)
+	if err != nil {
+		return nil, err
+	}
+	rec.BlockNr = blockNr
+	return rec, nil
+}
+
+// DecodeChangeSetKey decodes the key of the ChangeSetBucket into the block number and the history bucket
+func DecodeChangeSetKey(k []byte) (uint64, []byte, error) {
+	if len(k) == 0 || len(k) < int(k[0]>>5) {
+		return 0, nil, fmt.Errorf("invalid change set key %x", k)
+	}
+	blockNr, hBucket := dbutils.DecodeTimestamp(k)
+	return blockNr, hBucket, nil
+}
+
+// decodeTimestampSuffix decodes the timestamp that makes up the whole suffix
+func decodeTimestampSuffix(suffix []byte) (uint64, error) {
+	if len(suffix) == 0 || len(suffix) != int(suffix[0]>>5) {
+		return 0, fmt.Errorf("invalid timestamp %x", suffix)
+	}
+	blockNr, _ := dbutils.DecodeTimestamp(suffix)
+	return blockNr, nil
+}
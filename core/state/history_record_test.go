@@ -0,0 +1,91 @@
+package state
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+func TestAccountHistoryRecord(t *testing.T) {
+	addrHash := common.Hash{0xaa}
+	acc := accounts.NewAccount()
+	acc.Initialised = true
+	acc.Nonce = 3
+	acc.Balance.SetInt64(100)
+	acc.Incarnation = 2
+
+	rec := NewAccountHistoryRecord(addrHash, &acc)
+	if !bytes.Equal(rec.Key(), addrHash[:]) {
+		t.Errorf("unexpected key %x", rec.Key())
+	}
+	decoded, err := DecodeHistoryRecord(rec.Bucket, rec.Key(), rec.EncodeValue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.AddrHash != addrHash || decoded.Account == nil || decoded.Account.Nonce != 3 || decoded.Account.Incarnation != 2 {
+		t.Errorf("unexpected record %+v", decoded)
+	}
+
+	// The account that did not exist is recorded with the empty value
+	rec = NewAccountHistoryRecord(addrHash, &accounts.Account{})
+	if v := rec.EncodeValue(); v == nil || len(v) != 0 {
+		t.Errorf("expected empty value, got %x", v)
+	}
+	if decoded, err = DecodeHistoryRecord(rec.Bucket, rec.Key(), rec.EncodeValue()); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Account != nil {
+		t.Errorf("expected no account, got %+v", decoded.Account)
+	}
+}
+
+func TestStorageHistoryRecord(t *testing.T) {
+	addrHash, keyHash := common.Hash{0xaa}, common.Hash{0xbb}
+	original := common.Hash{}
+	original[31] = 0x05
+
+	rec := NewStorageHistoryRecord(addrHash, 7, keyHash, original[:])
+	if !bytes.Equal(rec.EncodeValue(), []byte{0x05}) {
+		t.Errorf("expected the leading zeros to be trimmed, got %x", rec.EncodeValue())
+	}
+	if !bytes.Equal(rec.Key(), dbutils.GenerateCompositeStorageKey(addrHash, 7, keyHash)) {
+		t.Errorf("unexpected key %x", rec.Key())
+	}
+
+	// Entry of the history bucket carries the block number in the suffix
+	k, _ := dbutils.CompositeKeySuffix(rec.Key(), 12345)
+	decoded, err := DecodeHistoryEntry(dbutils.StorageHistoryBucket, k, rec.EncodeValue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.AddrHash != addrHash || decoded.Incarnation != 7 || decoded.KeyHash != keyHash || decoded.BlockNr != 12345 || !bytes.Equal(decoded.Value, []byte{0x05}) {
+		t.Errorf("unexpected record %+v", decoded)
+	}
+
+	if _, err = DecodeHistoryRecord(dbutils.StorageHistoryBucket, k, nil); err == nil {
+		t.Errorf("expected the key with the timestamp to be rejected")
+	}
+	if _, err = DecodeHistoryEntry(dbutils.StorageHistoryBucket, rec.Key(), nil); err == nil {
+		t.Errorf("expected the key without the timestamp to be rejected")
+	}
+	if _, err = DecodeHistoryRecord([]byte("unknown"), rec.Key(), nil); err == nil {
+		t.Errorf("expected the unknown bucket to be rejected")
+	}
+}
+
+func TestDecodeChangeSetKey(t *testing.T) {
+	k := append(dbutils.EncodeTimestamp(42), dbutils.AccountsHistoryBucket...)
+	blockNr, hBucket, err := DecodeChangeSetKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockNr != 42 || !bytes.Equal(hBucket, dbutils.AccountsHistoryBucket) {
+		t.Errorf("unexpected block %d and bucket %q", blockNr, hBucket)
+	}
+	if _, _, err = DecodeChangeSetKey(nil); err == nil {
+		t.Errorf("expected the empty key to be rejected")
+	}
+}
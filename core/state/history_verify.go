@@ -0,0 +1,128 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// HistoryMismatch describes a history entry that does not agree with the change sets
+// and the flat state
+type HistoryMismatch struct {
+	BlockNr  uint64
+	Bucket   []byte // AccountsHistoryBucket or StorageHistoryBucket
+	Key      []byte
+	Expected []byte // Value reconstructed by rewinding the flat state with the change sets
+	Got      []byte // Value returned by the history bucket
+}
+
+func (m HistoryMismatch) String() string {
+	return fmt.Sprintf("block %d, bucket %s, key %x: expected %x, got %x", m.BlockNr, m.Bucket, m.Key, m.Expected, m.Got)
+}
+
+// VerifyHistory checks the history of the blocks fromBlock+1 to toBlock. It rewinds the flat state
+// block by block, by applying the inverse of the change sets, and checks that the history buckets
+// reproduce the same state before and after each of the blocks. The database is not modified
+func VerifyHistory(db ethdb.Getter, fromBlock, toBlock uint64) ([]HistoryMismatch, error) {
+	if fromBlock >= toBlock {
+		return nil, fmt.Errorf("empty block range %d-%d", fromBlock, toBlock)
+	}
+	// State as of toBlock, for the keys modified after it. Other keys come from the flat buckets
+	overlay := make(map[string][]byte)
+	if err := ethdb.RewindData(db, math.MaxUint64, toBlock, func(hBucket, key, value []byte) error {
+		overlay[string(hBucket)+string(key)] = value
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	type change struct {
+		hBucket, key, value []byte
+	}
+	changes := make(map[uint64][]change)
+	if err := db.Walk(dbutils.ChangeSetBucket, dbutils.EncodeTimestamp(fromBlock+1), 0, func(k, v []byte) (bool, error) {
+		blockNr, hBucket, err := DecodeChangeSetKey(k)
+		if err != nil {
+			return false, err
+		}
+		if blockNr > toBlock {
+			return false, nil
+		}
+		hBucket = common.CopyBytes(hBucket)
+		return true, dbutils.Walk(v, func(key, value []byte) error {
+			changes[blockNr] = append(changes[blockNr], change{hBucket, common.CopyBytes(key), common.CopyBytes(value)})
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	var mismatches []HistoryMismatch
+	check := func(blockNr, timestamp uint64, c change, expected []byte) error {
+		got, err := db.GetAsOf(flatBucket(c.hBucket), c.hBucket, c.key, timestamp)
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return err
+		}
+		if !historyValuesEqual(c.hBucket, expected, got) {
+			mismatches = append(mismatches, HistoryMismatch{BlockNr: blockNr, Bucket: c.hBucket, Key: c.key, Expected: expected, Got: got})
+		}
+		return nil
+	}
+	for blockNr := toBlock; blockNr > fromBlock; blockNr-- {
+		for _, c := range changes[blockNr] {
+			overlayKey := string(c.hBucket) + string(c.key)
+			after, ok := overlay[overlayKey]
+			if !ok {
+				var err error
+				if after, err = db.Get(flatBucket(c.hBucket), c.key); err != nil && err != ethdb.ErrKeyNotFound {
+					return nil, err
+				}
+			}
+			// State after the block
+			if err := check(blockNr, blockNr+1, c, after); err != nil {
+				return nil, err
+			}
+			// State before the block
+			if err := check(blockNr, blockNr, c, c.value); err != nil {
+				return nil, err
+			}
+			overlay[overlayKey] = c.value
+		}
+	}
+	return mismatches, nil
+}
+
+// flatBucket returns the bucket of the current state for the given history bucket
+func flatBucket(hBucket []byte) []byte {
+	if bytes.Equal(hBucket, dbutils.AccountsHistoryBucket) {
+		return dbutils.AccountsBucket
+	}
+	return dbutils.StorageBucket
+}
+
+// historyValuesEqual compares the values of the history entries. With the thin history, the accounts
+// are recorded without the storage root and the code hash, so these fields are not compared
+func historyValuesEqual(hBucket, v1, v2 []byte) bool {
+	if !debug.IsThinHistory() || !bytes.Equal(hBucket, dbutils.AccountsHistoryBucket) || len(v1) == 0 || len(v2) == 0 {
+		return bytes.Equal(v1, v2)
+	}
+	var a1, a2 accounts.Account
+	if err := a1.DecodeForStorage(v1); err != nil {
+		return false
+	}
+	if err := a2.DecodeForStorage(v2); err != nil {
+		return false
+	}
+	for _, a := range []*accounts.Account{&a1, &a2} {
+		copy(a.CodeHash[:], emptyCodeHash)
+		a.Root = trie.EmptyRoot
+	}
+	return accountsEqual(&a1, &a2)
+}
@@ -0,0 +1,58 @@
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestVerifyHistory(t *testing.T) {
+	if debug.IsThinHistory() {
+		t.Skip("corrupts the history entries in the full history layout")
+	}
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := common.HexToAddress("0x1234")
+	for blockNr := uint64(1); blockNr <= 3; blockNr++ {
+		value := common.BigToHash(new(big.Int).SetUint64(blockNr))
+		commitTestBlock(t, tds, blockNr, func(ibs *IntraBlockState) {
+			ibs.AddBalance(addr, big.NewInt(100))
+			ibs.SetState(addr, common.Hash{1}, value)
+		})
+	}
+
+	mismatches, err := VerifyHistory(db, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("expected consistent history, got %v", mismatches)
+	}
+
+	// Corrupt the record of the account before block 2
+	addrHash := crypto.Keccak256Hash(addr[:])
+	composite, _ := dbutils.CompositeKeySuffix(addrHash[:], 2)
+	if err = db.Put(dbutils.AccountsHistoryBucket, composite, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if mismatches, err = VerifyHistory(db, 0, 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) == 0 {
+		t.Fatalf("expected the corrupted entry to be reported")
+	}
+	for _, m := range mismatches {
+		if (m.BlockNr != 1 && m.BlockNr != 2) || !bytes.Equal(m.Key, addrHash[:]) {
+			t.Errorf("unexpected mismatch %v", m)
+		}
+	}
+}
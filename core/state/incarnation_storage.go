@@ -0,0 +1,37 @@
+package state
+
+import (
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// WalkIncarnationStorage walks over the storage items of one incarnation of the contract in the current state.
+// Storage of the previous incarnations stays in the database after self-destruction (so that it can be restored
+// by UnwindTo), interleaved with the storage of the other incarnations under the same address hash prefix
+func WalkIncarnationStorage(db ethdb.Getter, addrHash common.Hash, incarnation uint64, walker func(keyHash common.Hash, value []byte) (bool, error)) error {
+	prefix := dbutils.GenerateStoragePrefix(addrHash, incarnation)
+	startkey := make([]byte, common.HashLength+common.IncarnationLength+common.HashLength)
+	copy(startkey, prefix)
+	return db.Walk(dbutils.StorageBucket, startkey, 8*uint(len(prefix)), func(k, v []byte) (bool, error) {
+		return walker(common.BytesToHash(k[len(prefix):]), v)
+	})
+}
+
+// DeleteIncarnationStorage removes the storage items of one incarnation of the contract from the current state,
+// leaving the other incarnations intact. It does not record any history
+func DeleteIncarnationStorage(db ethdb.Database, addrHash common.Hash, incarnation uint64) error {
+	var keys [][]byte
+	if err := WalkIncarnationStorage(db, addrHash, incarnation, func(keyHash common.Hash, _ []byte) (bool, error) {
+		keys = append(keys, dbutils.GenerateCompositeStorageKey(addrHash, incarnation, keyHash))
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := db.Delete(dbutils.StorageBucket, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
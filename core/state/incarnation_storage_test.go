@@ -0,0 +1,56 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestIncarnationStorage(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	addrHash := common.HexToHash("0x1234")
+	other := common.HexToHash("0x1235")
+	put := func(addrHash common.Hash, incarnation uint64, n int) {
+		for i := 0; i < n; i++ {
+			k := dbutils.GenerateCompositeStorageKey(addrHash, incarnation, common.BigToHash(big.NewInt(int64(i+1))))
+			if err := db.Put(dbutils.StorageBucket, k, []byte{byte(i + 1)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(addrHash, 1, 3)
+	put(addrHash, 2, 2)
+	put(other, 1, 4)
+
+	count := func(addrHash common.Hash, incarnation uint64) int {
+		var n int
+		if err := WalkIncarnationStorage(db, addrHash, incarnation, func(_ common.Hash, _ []byte) (bool, error) {
+			n++
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(addrHash, 1); n != 3 {
+		t.Errorf("expected 3 items in incarnation 1, got %d", n)
+	}
+	if n := count(addrHash, 2); n != 2 {
+		t.Errorf("expected 2 items in incarnation 2, got %d", n)
+	}
+	if err := DeleteIncarnationStorage(db, addrHash, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(addrHash, 2); n != 0 {
+		t.Errorf("expected no items in incarnation 2 after deletion, got %d", n)
+	}
+	if n := count(addrHash, 1); n != 3 {
+		t.Errorf("expected incarnation 1 to be intact, got %d items", n)
+	}
+	if n := count(other, 1); n != 4 {
+		t.Errorf("expected other contract to be intact, got %d items", n)
+	}
+}
@@ -141,12 +141,13 @@ func (sdb *IntraBlockState) Error() error {
 
 // Reset clears out all ephemeral state objects from the state db, but keeps
 // the underlying state trie to avoid reloading data for the next operations.
+// State objects are recycled, so the state writers must not keep the accounts
+// passed to them (TrieStateWriter copies them).
 func (sdb *IntraBlockState) Reset() error {
 	sdb.Lock()
 	defer sdb.Unlock()
 
-	sdb.stateObjects = make(map[common.Address]*stateObject)
-	sdb.stateObjectsDirty = make(map[common.Address]struct{})
+	sdb.releaseStateObjects()
 	sdb.thash = common.Hash{}
 	sdb.bhash = common.Hash{}
 	sdb.txIndex = 0
@@ -416,6 +417,19 @@ func (sdb *IntraBlockState) GetCommittedState(addr common.Address, hash common.H
 	return common.Hash{}
 }
 
+// GetOriginalState retrieves a value from the given account's storage as it was at the beginning of the block.
+// Since the original values are never modified within the block, reverts do not affect the result.
+func (sdb *IntraBlockState) GetOriginalState(addr common.Address, hash common.Hash) common.Hash {
+	sdb.Lock()
+	defer sdb.Unlock()
+
+	stateObject := sdb.getStateObject(addr)
+	if stateObject != nil {
+		return stateObject.GetOriginalState(hash)
+	}
+	return common.Hash{}
+}
+
 func (sdb *IntraBlockState) HasSuicided(addr common.Address) bool {
 	sdb.Lock()
 	defer sdb.Unlock()
@@ -770,8 +784,13 @@ func (sdb *IntraBlockState) CreateAccount(addr common.Address, contractCreation
 	}
 
 	var previous *stateObject
+	var recreated bool
 	if contractCreation {
 		previous = sdb.getStateObject(addr)
+		// Self-destructed objects stay in stateObjects (marked as deleted) until the end of the block
+		if obj := sdb.stateObjects[addr]; obj != nil && obj.deleted {
+			recreated = true
+		}
 	}
 
 	newObj, prev := sdb.createObject(addr, previous)
@@ -781,6 +800,7 @@ func (sdb *IntraBlockState) CreateAccount(addr common.Address, contractCreation
 
 	if contractCreation {
 		newObj.created = true
+		newObj.recreated = recreated
 	}
 }
 
@@ -872,18 +892,78 @@ func (sdb *IntraBlockState) FinalizeTx(ctx context.Context, stateWriter StateWri
 				return err
 			}
 			if stateObject.created {
-				if err := stateWriter.CreateContract(addr); err != nil {
+				if err := createContract(stateWriter, addr, stateObject.recreated); err != nil {
 					return err
 				}
 			}
 		}
 		sdb.stateObjectsDirty[addr] = struct{}{}
 	}
+	if f, ok := stateWriter.(TxFinisher); ok {
+		f.FinishTx()
+	}
 	// Invalidate journal because reverting across transactions is not allowed.
 	sdb.clearJournalAndRefund()
 	return nil
 }
 
+// FinalizeIncremental writes the modified storage items of the dirty state objects out to the stateWriter
+// in the middle of a transaction, so that the dirty storage does not keep growing in very large blocks.
+// The journal stays valid: reverting a flushed change puts the previous value back into the dirty storage,
+// and the flushed objects are kept dirty until the end of the transaction, so that FinalizeTx writes them again.
+// Contracts created within the block and self-destructed ones are skipped, because a revert may remove them entirely.
+func (sdb *IntraBlockState) FinalizeIncremental(ctx context.Context, stateWriter StateWriter) error {
+	sdb.Lock()
+	defer sdb.Unlock()
+
+	for addr := range sdb.journal.dirties {
+		stateObject, exist := sdb.stateObjects[addr]
+		if !exist || stateObject.created || stateObject.suicided {
+			continue
+		}
+		if len(stateObject.dirtyStorage) == 0 {
+			continue
+		}
+		if err := stateObject.flushStorage(ctx, stateWriter); err != nil {
+			return err
+		}
+		// Extra dirty mark which is not undone by the reverts
+		sdb.journal.dirty(addr)
+	}
+	return nil
+}
+
+// DirtyStorageCount returns the number of storage items that are modified, but not yet written out,
+// which can be used to decide when to call FinalizeIncremental
+func (sdb *IntraBlockState) DirtyStorageCount() int {
+	sdb.Lock()
+	defer sdb.Unlock()
+
+	var count int
+	for addr := range sdb.journal.dirties {
+		if stateObject, exist := sdb.stateObjects[addr]; exist {
+			count += len(stateObject.dirtyStorage)
+		}
+	}
+	return count
+}
+
+// ContractRecreator is implemented by the state writers that need to distinguish the contracts created at
+// the addresses where other contracts self-destructed earlier in the same block. This can only happen to the
+// contracts introduced in the genesis state with nonce 0 (see TrieDbState.updateTrieRoots)
+type ContractRecreator interface {
+	RecreateContract(address common.Address) error
+}
+
+func createContract(stateWriter StateWriter, addr common.Address, recreated bool) error {
+	if recreated {
+		if cr, ok := stateWriter.(ContractRecreator); ok {
+			return cr.RecreateContract(addr)
+		}
+	}
+	return stateWriter.CreateContract(addr)
+}
+
 // CommitBlock finalizes the state by removing the self destructed objects
 // and clears the journal as well as the refunds.
 func (sdb *IntraBlockState) CommitBlock(ctx context.Context, stateWriter StateWriter) error {
@@ -924,17 +1004,33 @@ func (sdb *IntraBlockState) CommitBlock(ctx context.Context, stateWriter StateWr
 			}
 
 			if stateObject.created {
-				if err := stateWriter.CreateContract(addr); err != nil {
+				if err := createContract(stateWriter, addr, stateObject.recreated); err != nil {
 					return err
 				}
 			}
 		}
 	}
+	if f, ok := stateWriter.(BlockFinisher); ok {
+		if err := f.FinishBlock(); err != nil {
+			return err
+		}
+	}
+	// The state of the block is written, the objects are read again from the state reader if needed
+	sdb.releaseStateObjects()
 	// Invalidate journal because reverting across transactions is not allowed.
 	sdb.clearJournalAndRefund()
 	return nil
 }
 
+// releaseStateObjects returns the state objects to the pool and forgets them
+func (sdb *IntraBlockState) releaseStateObjects() {
+	for _, stateObject := range sdb.stateObjects {
+		stateObject.release()
+	}
+	sdb.stateObjects = make(map[common.Address]*stateObject)
+	sdb.stateObjectsDirty = make(map[common.Address]struct{})
+}
+
 // Prepare sets the current transaction hash and index and block hash which is
 // used when the EVM emits new state logs.
 func (sdb *IntraBlockState) Prepare(thash, bhash common.Hash, ti int) {
@@ -944,6 +1040,22 @@ func (sdb *IntraBlockState) Prepare(thash, bhash common.Hash, ti int) {
 	sdb.thash = thash
 	sdb.bhash = bhash
 	sdb.txIndex = ti
+	if s, ok := sdb.stateReader.(TouchOriginSetter); ok {
+		s.SetTouchOrigin(TouchOrigin{TxHash: thash})
+	}
+}
+
+// SetTouchDepth informs the state reader (if it implements TouchOriginSetter) about the call depth of the EVM,
+// so that the touches of the trie nodes are attributed to the current transaction and the depth
+func (sdb *IntraBlockState) SetTouchDepth(depth int) {
+	s, ok := sdb.stateReader.(TouchOriginSetter)
+	if !ok {
+		return
+	}
+	sdb.RLock()
+	thash := sdb.thash
+	sdb.RUnlock()
+	s.SetTouchOrigin(TouchOrigin{TxHash: thash, Depth: depth})
 }
 
 // no not lock
@@ -36,6 +36,7 @@ import (
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/crypto"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
 )
 
@@ -517,3 +518,171 @@ func TestIntraBlockStateNewContractAccount(t *testing.T) {
 	}
 
 }
+
+// storageRecorder is a StateWriter that remembers the last written value of each storage item
+type storageRecorder struct {
+	NoopWriter
+	storage map[common.Hash]common.Hash
+}
+
+func (sr *storageRecorder) WriteAccountStorage(_ context.Context, address common.Address, incarnation uint64, key, original, value *common.Hash) error {
+	sr.storage[*key] = *value
+	return nil
+}
+
+func TestFinalizeIncremental(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	state := New(tds)
+	w := &storageRecorder{storage: make(map[common.Hash]common.Hash)}
+	ctx := context.Background()
+
+	addr := common.BytesToAddress([]byte{1})
+	key1 := common.BytesToHash([]byte{1})
+	key2 := common.BytesToHash([]byte{2})
+	state.AddBalance(addr, big.NewInt(1))
+	state.SetState(addr, key1, common.BytesToHash([]byte{1}))
+	if err := state.FinalizeTx(ctx, w); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := state.Snapshot()
+	state.SetState(addr, key1, common.BytesToHash([]byte{2}))
+	state.SetState(addr, key2, common.BytesToHash([]byte{3}))
+	if n := state.DirtyStorageCount(); n != 2 {
+		t.Errorf("expected 2 dirty storage items, got %d", n)
+	}
+	if err := state.FinalizeIncremental(ctx, w); err != nil {
+		t.Fatal(err)
+	}
+	if n := state.DirtyStorageCount(); n != 0 {
+		t.Errorf("expected no dirty storage items after flushing, got %d", n)
+	}
+	if v := state.GetState(addr, key1); v != common.BytesToHash([]byte{2}) {
+		t.Errorf("unexpected value after flushing: %x", v)
+	}
+	if v := state.GetCommittedState(addr, key1); v != common.BytesToHash([]byte{1}) {
+		t.Errorf("committed value must not change until the end of the transaction, got %x", v)
+	}
+	if w.storage[key2] != common.BytesToHash([]byte{3}) {
+		t.Errorf("expected flushed value to be written out, got %x", w.storage[key2])
+	}
+
+	state.RevertToSnapshot(snapshot)
+	if v := state.GetState(addr, key1); v != common.BytesToHash([]byte{1}) {
+		t.Errorf("unexpected value after revert: %x", v)
+	}
+	if err := state.FinalizeTx(ctx, w); err != nil {
+		t.Fatal(err)
+	}
+	if w.storage[key1] != common.BytesToHash([]byte{1}) || w.storage[key2] != (common.Hash{}) {
+		t.Errorf("reverted values must be written out again, got %x and %x", w.storage[key1], w.storage[key2])
+	}
+}
+
+func TestGetOriginalState(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	state := New(tds)
+	ctx := context.Background()
+
+	addr := common.BytesToAddress([]byte{1})
+	key := common.BytesToHash([]byte{1})
+	state.AddBalance(addr, big.NewInt(1))
+	state.SetState(addr, key, common.BytesToHash([]byte{1}))
+	if err := state.FinalizeTx(ctx, NewNoopWriter()); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := state.Snapshot()
+	state.SetState(addr, key, common.BytesToHash([]byte{2}))
+	if v := state.GetOriginalState(addr, key); v != (common.Hash{}) {
+		t.Errorf("expected empty original value, got %x", v)
+	}
+	if v := state.GetCommittedState(addr, key); v != common.BytesToHash([]byte{1}) {
+		t.Errorf("expected committed value 1, got %x", v)
+	}
+	state.RevertToSnapshot(snapshot)
+	if v := state.GetOriginalState(addr, key); v != (common.Hash{}) {
+		t.Errorf("expected empty original value after revert, got %x", v)
+	}
+}
+
+func TestBalanceDeltaRevert(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	state := New(tds)
+
+	addr := common.BytesToAddress([]byte{1})
+	state.AddBalance(addr, big.NewInt(100))
+	snapshot := state.Snapshot()
+	state.AddBalance(addr, big.NewInt(42))
+	state.SubBalance(addr, big.NewInt(7))
+	if b := state.GetBalance(addr); b.Cmp(big.NewInt(135)) != 0 {
+		t.Errorf("expected balance 135, got %s", b)
+	}
+	state.RevertToSnapshot(snapshot)
+	if b := state.GetBalance(addr); b.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("expected balance 100 after revert, got %s", b)
+	}
+}
+
+func TestRecycledStateObjects(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	addr, other := common.HexToAddress("0x1"), common.HexToAddress("0x2")
+	addrHash := crypto.Keccak256Hash(addr[:])
+	state := New(tds)
+	tds.StartNewBuffer()
+	state.AddBalance(addr, big.NewInt(100))
+	if err = state.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	// The objects released by Reset are reused, the buffer of the TrieDbState must not see it
+	if err = state.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	state.AddBalance(other, big.NewInt(5))
+	if a := tds.currentBuffer.accountUpdates[addrHash]; a == nil || a.Balance.Cmp(big.NewInt(100)) != 0 || !a.Initialised {
+		t.Fatalf("expected the buffered account unchanged by the recycling, got %+v", a)
+	}
+	if err = state.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = state.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	// The objects are recycled by CommitBlock, and read again afterwards
+	if len(state.stateObjects) != 0 {
+		t.Errorf("expected the state objects released by CommitBlock, got %d", len(state.stateObjects))
+	}
+	if b := state.GetBalance(other); b.Cmp(big.NewInt(5)) != 0 {
+		t.Errorf("expected balance 5 after the commit, got %d", b)
+	}
+}
+
+func BenchmarkIntraBlockStateReset(b *testing.B) {
+	db := ethdb.NewMemDatabase()
+	tds, _ := NewTrieDbState(common.Hash{}, db, 0)
+	state := New(tds)
+	addrs := make([]common.Address, 1000)
+	for i := range addrs {
+		addrs[i] = common.BytesToAddress([]byte{byte(i >> 8), byte(i)})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, addr := range addrs {
+			state.AddBalance(addr, big.NewInt(1))
+		}
+		_ = state.Reset()
+	}
+}
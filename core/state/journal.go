@@ -114,6 +114,12 @@ type (
 		account *common.Address
 		prev    *big.Int
 	}
+	// balanceDeltaChange is journalled by AddBalance and SubBalance instead of balanceChange,
+	// so that the balance can be modified in place, without copying the previous value
+	balanceDeltaChange struct {
+		account *common.Address
+		delta   *big.Int
+	}
 	nonceChange struct {
 		account *common.Address
 		prev    uint64
@@ -194,6 +200,15 @@ func (ch balanceChange) dirtied() *common.Address {
 	return ch.account
 }
 
+func (ch balanceDeltaChange) revert(s *IntraBlockState) {
+	so := s.getStateObject(*ch.account)
+	so.data.Balance.Sub(&so.data.Balance, ch.delta)
+}
+
+func (ch balanceDeltaChange) dirtied() *common.Address {
+	return ch.account
+}
+
 func (ch nonceChange) revert(s *IntraBlockState) {
 	s.getStateObject(*ch.account).setNonce(ch.prev)
 }
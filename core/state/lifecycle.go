@@ -0,0 +1,102 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// PruneTriesAsync runs PruneTries in the background. Close waits for it to finish
+func (tds *TrieDbState) PruneTriesAsync(print bool) {
+	tds.background.Add(1)
+	go func() {
+		defer tds.background.Done()
+		tds.PruneTries(print)
+	}()
+}
+
+// ErrUnfinishedBlock is returned by Close when there are the changes in the buffers that have not been committed
+// with a block, so the trie does not match the persisted state
+var ErrUnfinishedBlock = errors.New("closing the state with the changes of an unfinished block")
+
+// SetCommitter sets the function committing the database of TrieDbState on Close, for the owners of the database
+// doing more on its commits (like BlockChain, streaming the changes to the replicas). By default, Close commits
+// the database itself if it has pending mutations
+func (tds *TrieDbState) SetCommitter(commit func() error) {
+	tds.committer = commit
+}
+
+// Close finishes the work of TrieDbState: it waits for the background pruning, persists the keys of the code caches
+// (see PersistCodeCacheKeys) and the snapshot of the trie (if enabled by SetTrieSnapshots), records the block number
+// and the state root as cleanly closed (see ReadCleanShutdown), and commits the database (which includes
+// the preimages), see SetCommitter. The trie itself, including its intermediate hashes, is not persisted.
+// The state has to be the one of the last committed block: if there are the changes in the buffers not committed
+// with a block, ErrUnfinishedBlock is returned. If the context is done before the background tasks finish,
+// its error is returned. In both cases nothing is written.
+// Closing already closed TrieDbState does nothing, the concurrent invocations wait for each other
+func (tds *TrieDbState) Close(ctx context.Context) error {
+	tds.closeMu.Lock()
+	defer tds.closeMu.Unlock()
+	if tds.closed {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		tds.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if tds.currentBuffer != nil || tds.aggregateBuffer != nil {
+		return ErrUnfinishedBlock
+	}
+	if err := tds.PersistCodeCacheKeys(); err != nil {
+		return err
+	}
+	if err := tds.snapshotTrieOnClose(); err != nil {
+		return err
+	}
+	var enc [8 + common.HashLength]byte
+	binary.BigEndian.PutUint64(enc[:], tds.getBlockNr())
+	root := tds.LastRoot()
+	copy(enc[8:], root[:])
+	if err := tds.db.Put(dbutils.StateCleanShutdownKey, dbutils.StateCleanShutdownKey, enc[:]); err != nil {
+		return err
+	}
+	if tds.committer != nil {
+		if err := tds.committer(); err != nil {
+			return err
+		}
+	} else if batch, ok := tds.db.(ethdb.DbWithPendingMutations); ok {
+		if _, err := batch.Commit(); err != nil {
+			return err
+		}
+	}
+	tds.closed = true
+	return nil
+}
+
+// ReadCleanShutdown returns the block number and the state root recorded by TrieDbState.Close.
+// ok is false if there is no record, which means that the last run did not finish cleanly
+// (or that the database has never been closed with Close)
+func ReadCleanShutdown(db ethdb.Getter) (blockNr uint64, root common.Hash, ok bool) {
+	enc, err := db.Get(dbutils.StateCleanShutdownKey, dbutils.StateCleanShutdownKey)
+	if err != nil || len(enc) != 8+common.HashLength {
+		return 0, common.Hash{}, false
+	}
+	return binary.BigEndian.Uint64(enc), common.BytesToHash(enc[8:]), true
+}
+
+// ClearCleanShutdown removes the record written by Close. It is meant to be called when the database
+// is opened, so that an abrupt termination can be detected on the next start
+func ClearCleanShutdown(db ethdb.Deleter) error {
+	return db.Delete(dbutils.StateCleanShutdownKey, dbutils.StateCleanShutdownKey)
+}
@@ -0,0 +1,145 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestCloseRecordsCleanShutdown(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := ReadCleanShutdown(db); ok {
+		t.Fatalf("did not expect clean shutdown record before Close")
+	}
+	ctx := context.Background()
+	ibs := New(tds)
+	ibs.AddBalance(common.HexToAddress("0x1234"), big.NewInt(100))
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	tds.PruneTriesAsync(false)
+	if err = tds.Close(ctx); err != ErrUnfinishedBlock {
+		t.Fatalf("expected ErrUnfinishedBlock, got %v", err)
+	}
+	if _, _, ok := ReadCleanShutdown(db); ok {
+		t.Fatalf("did not expect clean shutdown record with the unfinished block")
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if err = tds.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	blockNr, root, ok := ReadCleanShutdown(db)
+	if !ok {
+		t.Fatalf("expected clean shutdown record after Close")
+	}
+	if blockNr != 1 || root != tds.LastRoot() {
+		t.Errorf("unexpected clean shutdown record: block %d, root %x (expected root %x)", blockNr, root, tds.LastRoot())
+	}
+	if err = ClearCleanShutdown(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok = ReadCleanShutdown(db); ok {
+		t.Errorf("did not expect clean shutdown record after clearing it")
+	}
+	// Closed already, so the concurrent invocations do nothing
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tds.Close(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, _, ok = ReadCleanShutdown(db); ok {
+		t.Errorf("did not expect clean shutdown record written by the repeated Close")
+	}
+}
+
+func TestCloseCommitter(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	batch := db.NewBatch()
+	tds, err := NewTrieDbState(common.Hash{}, batch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commits int
+	tds.SetCommitter(func() error {
+		commits++
+		_, err := batch.Commit()
+		return err
+	})
+	if err = tds.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if commits != 1 {
+		t.Errorf("expected the database committed by the committer once, got %d", commits)
+	}
+	if _, _, ok := ReadCleanShutdown(db); !ok {
+		t.Errorf("expected clean shutdown record committed")
+	}
+}
+
+func TestWarmCodeCaches(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []common.Hash
+	for i := 0; i < 3; i++ {
+		code := []byte{0x60, byte(i)}
+		codeHash := crypto.Keccak256Hash(code)
+		if err = db.Put(dbutils.CodeBucket, codeHash[:], code); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, codeHash)
+	}
+	// Accessed in reverse order, so that hashes[0] is the most recently used
+	for i := len(hashes) - 1; i >= 0; i-- {
+		if _, err = tds.ReadAccountCode(common.Address{}, hashes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tds.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewTrieDbState(tds.LastRoot(), db, tds.GetBlockNr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.WarmCodeCaches()
+	restarted.background.Wait()
+	keys := restarted.codeCache.Keys()
+	if len(keys) != len(hashes) {
+		t.Fatalf("expected %d codes in the cache, got %d", len(hashes), len(keys))
+	}
+	for i, k := range keys {
+		if k.(common.Hash) != hashes[len(hashes)-1-i] {
+			t.Errorf("unexpected order of the code cache: %x", keys)
+		}
+	}
+	if size, ok := restarted.codeSizeCache.Get(hashes[1]); !ok || size.(int) != 2 {
+		t.Errorf("expected the code size to be cached, got %v", size)
+	}
+}
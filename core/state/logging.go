@@ -0,0 +1,72 @@
+package state
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// loggerHolder wraps the logger, because atomic.Value cannot hold interface values of different types
+type loggerHolder struct {
+	logger log.Logger
+}
+
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(loggerHolder{log.Root()})
+}
+
+// SetDefaultLogger replaces the logger of the TrieDbState instances which have not been given their own
+// logger with SetLogger. By default, the root logger is used
+func SetDefaultLogger(logger log.Logger) {
+	if logger == nil {
+		logger = log.Root()
+	}
+	defaultLogger.Store(loggerHolder{logger})
+}
+
+// SetLogger makes this TrieDbState write to the logger, discarding the records above the level (e.g. with
+// log.LvlWarn, the memory statistics and the progress messages are not written). Records that pass the level are
+// handled by the current handler of the logger, even if it is replaced later. With nil logger, the default one
+// is used again (see SetDefaultLogger)
+func (tds *TrieDbState) SetLogger(logger log.Logger, lvl log.Lvl) {
+	if logger == nil {
+		tds.logger = nil
+		return
+	}
+	filtered := logger.New()
+	filtered.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Lvl > lvl {
+			return nil
+		}
+		return logger.GetHandler().Log(r)
+	}))
+	tds.logger = filtered
+}
+
+// SetMemStatsLogInterval makes PruneTries and Rebuild report the memory statistics only every n-th time
+// they are called, because reading the statistics stops the world. Zero and one report every time
+func (tds *TrieDbState) SetMemStatsLogInterval(n uint64) {
+	atomic.StoreUint64(&tds.memStatsLogInterval, n)
+}
+
+func (tds *TrieDbState) getLogger() log.Logger {
+	if tds.logger != nil {
+		return tds.logger
+	}
+	return defaultLogger.Load().(loggerHolder).logger
+}
+
+// logMemStats writes the memory statistics if the call is sampled (see SetMemStatsLogInterval) or forced
+func (tds *TrieDbState) logMemStats(force bool, msg string, ctx ...interface{}) {
+	calls := atomic.AddUint64(&tds.memStatsLogCalls, 1)
+	if n := atomic.LoadUint64(&tds.memStatsLogInterval); !force && n > 1 && calls%n != 1 {
+		return
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	ctx = append(ctx, "alloc", int(m.Alloc/1024), "sys", int(m.Sys/1024), "numGC", int(m.NumGC))
+	tds.getLogger().Info(msg, ctx...)
+}
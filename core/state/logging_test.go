@@ -0,0 +1,58 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+func TestTrieDbStateLogger(t *testing.T) {
+	tds, err := NewTrieDbState(common.Hash{}, ethdb.NewMemDatabase(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*log.Record
+	logger := log.New()
+	logger.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+
+	tds.SetLogger(logger, log.LvlWarn)
+	tds.PruneTries(false)
+	if len(records) != 0 {
+		t.Errorf("expected the memory statistics to be filtered out, got %q", records[0].Msg)
+	}
+
+	tds.SetLogger(logger, log.LvlInfo)
+	tds.SetMemStatsLogInterval(3)
+	for i := 0; i < 4; i++ {
+		tds.PruneTries(false)
+	}
+	// Every third call is sampled, starting from the first one
+	if len(records) != 1 {
+		t.Fatalf("expected 1 sampled record, got %d", len(records))
+	}
+	tds.PruneTries(false)
+	tds.PruneTries(false)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 sampled records, got %d", len(records))
+	}
+	if records[1].Msg != "Memory" {
+		t.Errorf("unexpected message %q", records[1].Msg)
+	}
+	// Explicitly requested output is not sampled
+	tds.PruneTries(true)
+	if len(records) != 5 {
+		t.Errorf("expected 5 records, got %d", len(records))
+	}
+
+	// Copies share the logger
+	cpy := tds.WithNewBuffer()
+	cpy.getLogger().Warn("copy")
+	if len(records) != 6 {
+		t.Errorf("expected the copy to write to the same logger")
+	}
+}
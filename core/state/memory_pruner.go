@@ -0,0 +1,106 @@
+package state
+
+import (
+	"context"
+	"runtime"
+	"time"
+)
+
+// MemoryPruner triggers pruning of the trie cache in response to the memory pressure, rather than
+// relying only on the generation limit. When the heap exceeds the soft threshold, the trie is pruned to
+// a fraction of its current size, and every subsequent check that still finds the heap above the threshold
+// halves the target again. Once the pressure is gone, the target grows back towards the configured
+// cache generation limit. The binary trie cannot be pruned (see ErrBinaryTrieNotPrunable), so the
+// controller refuses to act on it.
+type MemoryPruner struct {
+	tds       *TrieDbState
+	limit     uint64  // Memory limit in bytes
+	soft      float64 // Fraction of the limit above which the pruning starts
+	baseLimit uint32  // Cache generation limit of tds before the controller started to lower it
+	target    uint32  // Current node count target, 0 if the controller is not active
+	heapAlloc func() uint64
+}
+
+// NewMemoryPruner creates the controller for the given TrieDbState. If limit is 0, it is taken from the
+// memory obtained from the OS by the time the controller is created, which suits processes that run close
+// to their steady state.
+func NewMemoryPruner(tds *TrieDbState, limit uint64) *MemoryPruner {
+	if limit == 0 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		limit = m.Sys
+	}
+	return &MemoryPruner{
+		tds:       tds,
+		limit:     limit,
+		soft:      0.8,
+		baseLimit: tds.CacheGenLimit(),
+		heapAlloc: func() uint64 {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			return m.HeapAlloc
+		},
+	}
+}
+
+// Check compares the heap size with the thresholds and prunes the trie if required.
+// It returns true if the pruning has been performed
+func (mp *MemoryPruner) Check() bool {
+	heap := mp.heapAlloc()
+	if err := mp.tds.prunable(); err != nil {
+		if float64(heap) >= mp.soft*float64(mp.limit) {
+			mp.tds.getLogger().Error("Memory pressure cannot be relieved", "heap", heap, "limit", mp.limit, "err", err)
+		}
+		return false
+	}
+	if float64(heap) < mp.soft*float64(mp.limit) {
+		if mp.target != 0 {
+			// Pressure is gone, let the cache grow back gradually
+			if mp.target >= mp.baseLimit/2 {
+				mp.target = 0
+				mp.tds.SetCacheGenLimit(mp.baseLimit)
+			} else {
+				mp.target *= 2
+				mp.tds.SetCacheGenLimit(mp.target)
+			}
+		}
+		return false
+	}
+	if mp.target == 0 {
+		mp.tds.tMu.Lock()
+		nodes := uint32(mp.tds.tp.NodeCount())
+		mp.tds.tMu.Unlock()
+		mp.target = nodes - nodes/4
+		if heap >= mp.limit {
+			// Hard threshold is exceeded straight away
+			mp.target = nodes / 2
+		}
+		if mp.target > mp.baseLimit {
+			mp.target = mp.baseLimit
+		}
+	} else if mp.target > 1 {
+		mp.target /= 2
+	}
+	if mp.target == 0 {
+		mp.target = 1
+	}
+	mp.tds.getLogger().Info("Memory pressure, pruning the trie", "heap", heap, "limit", mp.limit, "target", mp.target)
+	mp.tds.SetCacheGenLimit(mp.target)
+	mp.tds.PruneTries(false)
+	return true
+}
+
+// Run performs the checks at the given interval, until the context is cancelled.
+// Check must not be called directly while Run is active
+func (mp *MemoryPruner) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mp.Check()
+		}
+	}
+}
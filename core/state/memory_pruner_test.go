@@ -0,0 +1,65 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestMemoryPrunerTargets(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetCacheGenLimit(1000)
+	mp := NewMemoryPruner(tds, 100)
+	var heap uint64
+	mp.heapAlloc = func() uint64 { return heap }
+
+	heap = 50
+	if mp.Check() {
+		t.Errorf("did not expect pruning below the soft threshold")
+	}
+	heap = 90
+	if !mp.Check() {
+		t.Errorf("expected pruning above the soft threshold")
+	}
+	first := tds.CacheGenLimit()
+	if first >= 1000 {
+		t.Errorf("expected lowered limit, got %d", first)
+	}
+	if !mp.Check() {
+		t.Errorf("expected pruning above the soft threshold")
+	}
+	if second := tds.CacheGenLimit(); second >= first && first > 1 {
+		t.Errorf("expected progressively lower limit, got %d after %d", second, first)
+	}
+	heap = 10
+	for i := 0; i < 64 && tds.CacheGenLimit() != 1000; i++ {
+		mp.Check()
+	}
+	if l := tds.CacheGenLimit(); l != 1000 {
+		t.Errorf("expected the limit to be restored to 1000, got %d", l)
+	}
+}
+
+func TestMemoryPrunerBinaryTrie(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.setTrie(trie.NewBinary(common.Hash{}))
+	tds.SetCacheGenLimit(1000)
+	mp := NewMemoryPruner(tds, 100)
+	mp.heapAlloc = func() uint64 { return 200 }
+	if mp.Check() {
+		t.Errorf("did not expect pruning of the binary trie")
+	}
+	if l := tds.CacheGenLimit(); l != 1000 {
+		t.Errorf("expected the limit to stay 1000, got %d", l)
+	}
+}
@@ -0,0 +1,126 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// maxNonceBalanceEntries limits the size of the cache of NonceBalanceReader, it is cleared when full
+const maxNonceBalanceEntries = 64 * 1024
+
+type nonceBalance struct {
+	nonce   uint64
+	balance big.Int
+}
+
+// NonceBalanceReader serves nonces and balances of the accounts directly from the AccountsBucket, without
+// the trie and the code caches. It is meant for high-QPS validations in the transaction pool.
+// Read values are cached until the next block is committed (see Watch and Invalidate)
+type NonceBalanceReader struct {
+	db         ethdb.Getter
+	mu         sync.RWMutex
+	cache      map[common.Address]*nonceBalance
+	blockNr    uint64
+	generation uint64 // Incremented by Invalidate, so that the values read before it are not cached after it
+}
+
+func NewNonceBalanceReader(db ethdb.Getter) *NonceBalanceReader {
+	return &NonceBalanceReader{
+		db:    db,
+		cache: make(map[common.Address]*nonceBalance),
+	}
+}
+
+func (r *NonceBalanceReader) read(address common.Address) (*nonceBalance, error) {
+	r.mu.RLock()
+	nb, ok := r.cache[address]
+	generation := r.generation
+	r.mu.RUnlock()
+	if ok {
+		return nb, nil
+	}
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return nil, err
+	}
+	nb = &nonceBalance{}
+	enc, err := r.db.Get(dbutils.AccountsBucket, addrHash[:])
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+	if err == nil && len(enc) > 0 {
+		var a accounts.Account
+		if err = a.DecodeForStorage(enc); err != nil {
+			return nil, err
+		}
+		nb.nonce = a.Nonce
+		nb.balance.Set(&a.Balance)
+	}
+	r.mu.Lock()
+	// The value may have been read before the block invalidating it was committed
+	if r.generation == generation {
+		if len(r.cache) >= maxNonceBalanceEntries {
+			r.cache = make(map[common.Address]*nonceBalance)
+		}
+		r.cache[address] = nb
+	}
+	r.mu.Unlock()
+	return nb, nil
+}
+
+// GetNonce returns the nonce of the account, 0 if the account does not exist
+func (r *NonceBalanceReader) GetNonce(address common.Address) (uint64, error) {
+	nb, err := r.read(address)
+	if err != nil {
+		return 0, err
+	}
+	return nb.nonce, nil
+}
+
+// GetBalance returns the balance of the account, 0 if the account does not exist
+func (r *NonceBalanceReader) GetBalance(address common.Address) (*big.Int, error) {
+	nb, err := r.read(address)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).Set(&nb.balance), nil
+}
+
+// Invalidate drops the cached values after the block with the given number has been committed
+func (r *NonceBalanceReader) Invalidate(blockNr uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = make(map[common.Address]*nonceBalance)
+	r.blockNr = blockNr
+	r.generation++
+}
+
+// BlockNr returns the number of the block of the last invalidation
+func (r *NonceBalanceReader) BlockNr() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.blockNr
+}
+
+// Watch invalidates the cache on every header received from the channel (normally, fed from the
+// chain head events), until the context is cancelled or the channel is closed
+func (r *NonceBalanceReader) Watch(ctx context.Context, heads <-chan *types.Header) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case header, ok := <-heads:
+			if !ok {
+				return
+			}
+			r.Invalidate(header.Number.Uint64())
+		}
+	}
+}
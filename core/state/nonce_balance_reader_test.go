@@ -0,0 +1,95 @@
+package state
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestNonceBalanceReader(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := common.HexToAddress("0x1234")
+	commit := func(blockNr uint64, nonce uint64, balance int64) {
+		commitTestBlock(t, tds, blockNr, func(ibs *IntraBlockState) {
+			ibs.SetNonce(addr, nonce)
+			ibs.SetBalance(addr, big.NewInt(balance))
+		})
+	}
+
+	r := NewNonceBalanceReader(db)
+	if nonce, err := r.GetNonce(addr); err != nil || nonce != 0 {
+		t.Fatalf("expected nonce 0 for missing account, got %d (%v)", nonce, err)
+	}
+	commit(1, 5, 100)
+	// Cached value is served until invalidation
+	if nonce, _ := r.GetNonce(addr); nonce != 0 {
+		t.Errorf("expected cached nonce 0, got %d", nonce)
+	}
+	r.Invalidate(1)
+	if nonce, _ := r.GetNonce(addr); nonce != 5 {
+		t.Errorf("expected nonce 5, got %d", nonce)
+	}
+	if balance, _ := r.GetBalance(addr); balance.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("expected balance 100, got %s", balance)
+	}
+	if r.BlockNr() != 1 {
+		t.Errorf("expected block number 1, got %d", r.BlockNr())
+	}
+}
+
+// hookedGetter runs the hook after every Get, or fails the Get with err if set
+type hookedGetter struct {
+	ethdb.Getter
+	hook func()
+	err  error
+}
+
+func (g *hookedGetter) Get(bucket, key []byte) ([]byte, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	v, err := g.Getter.Get(bucket, key)
+	if g.hook != nil {
+		g.hook()
+	}
+	return v, err
+}
+
+func TestNonceBalanceReaderInvalidatedRead(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := common.HexToAddress("0x1234")
+	getter := &hookedGetter{Getter: db}
+	r := NewNonceBalanceReader(getter)
+
+	// The block is committed right after the old value is read
+	getter.hook = func() {
+		getter.hook = nil
+		commitTestBlock(t, tds, 1, func(ibs *IntraBlockState) {
+			ibs.SetNonce(addr, 5)
+		})
+		r.Invalidate(1)
+	}
+	if nonce, err := r.GetNonce(addr); err != nil || nonce != 0 {
+		t.Fatalf("expected the old nonce 0, got %d (%v)", nonce, err)
+	}
+	if nonce, _ := r.GetNonce(addr); nonce != 5 {
+		t.Errorf("expected the value read before the invalidation not to be cached, got nonce %d", nonce)
+	}
+
+	getter.err = errors.New("disk failure")
+	r.Invalidate(2)
+	if _, err = r.GetBalance(addr); err != getter.err {
+		t.Errorf("expected the failure of the database to be returned, got %v", err)
+	}
+}
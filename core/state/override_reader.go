@@ -0,0 +1,113 @@
+package state
+
+import (
+	"bytes"
+	"math/big"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+// AccountOverride replaces parts of an account for the simulated executions, see OverrideReader.
+// The fields left nil keep the values read from the underlying reader
+type AccountOverride struct {
+	Nonce   *uint64
+	Balance *big.Int
+	Code    []byte                      // Empty (but not nil) code turns the contract into a non-contract account
+	State   map[common.Hash]common.Hash // Replaces the whole storage, StateDiff is ignored if set
+	// Replaces the given storage items, the other items are read from the underlying reader
+	StateDiff map[common.Hash]common.Hash
+}
+
+// OverrideReader implements StateReader on top of another reader (for example, DbState at a historical block),
+// with some accounts replaced, for eth_call-style simulations. The accounts that do not exist in the underlying
+// reader are created by their overrides
+type OverrideReader struct {
+	inner     StateReader
+	overrides map[common.Address]AccountOverride
+	codes     map[common.Address]common.Hash // Hashes of the overridden codes
+}
+
+func NewOverrideReader(inner StateReader, overrides map[common.Address]AccountOverride) *OverrideReader {
+	r := &OverrideReader{
+		inner:     inner,
+		overrides: overrides,
+		codes:     make(map[common.Address]common.Hash),
+	}
+	for address, o := range overrides {
+		if o.Code != nil {
+			r.codes[address] = crypto.Keccak256Hash(o.Code)
+		}
+	}
+	return r
+}
+
+func (r *OverrideReader) ReadAccountData(address common.Address) (*accounts.Account, error) {
+	acc, err := r.inner.ReadAccountData(address)
+	if err != nil {
+		return nil, err
+	}
+	o, ok := r.overrides[address]
+	if !ok {
+		return acc, nil
+	}
+	if acc == nil {
+		a := accounts.NewAccount()
+		a.Initialised = true
+		acc = &a
+	} else {
+		// The account returned by the underlying reader may be shared
+		acc = acc.SelfCopy()
+	}
+	if o.Nonce != nil {
+		acc.Nonce = *o.Nonce
+	}
+	if o.Balance != nil {
+		acc.Balance.Set(o.Balance)
+	}
+	if codeHash, ok := r.codes[address]; ok {
+		acc.CodeHash = codeHash
+		if len(o.Code) > 0 && acc.Incarnation == 0 {
+			acc.Incarnation = FirstContractIncarnation
+		}
+	}
+	return acc, nil
+}
+
+func (r *OverrideReader) ReadAccountStorage(address common.Address, incarnation uint64, key *common.Hash) ([]byte, error) {
+	o, ok := r.overrides[address]
+	if !ok {
+		return r.inner.ReadAccountStorage(address, incarnation, key)
+	}
+	if o.State != nil {
+		return overriddenValue(o.State[*key]), nil
+	}
+	if v, ok := o.StateDiff[*key]; ok {
+		return overriddenValue(v), nil
+	}
+	return r.inner.ReadAccountStorage(address, incarnation, key)
+}
+
+// overriddenValue returns the storage value in the form returned by the readers, without the leading zeros
+func overriddenValue(v common.Hash) []byte {
+	enc := bytes.TrimLeft(v[:], "\x00")
+	if len(enc) == 0 {
+		return nil
+	}
+	return common.CopyBytes(enc)
+}
+
+func (r *OverrideReader) ReadAccountCode(address common.Address, codeHash common.Hash) ([]byte, error) {
+	if h, ok := r.codes[address]; ok && h == codeHash {
+		return r.overrides[address].Code, nil
+	}
+	return r.inner.ReadAccountCode(address, codeHash)
+}
+
+func (r *OverrideReader) ReadAccountCodeSize(address common.Address, codeHash common.Hash) (int, error) {
+	if h, ok := r.codes[address]; ok && h == codeHash {
+		return len(r.overrides[address].Code), nil
+	}
+	return r.inner.ReadAccountCodeSize(address, codeHash)
+}
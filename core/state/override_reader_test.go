@@ -0,0 +1,62 @@
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestOverrideReader(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	existing, created := common.HexToAddress("0x1"), common.HexToAddress("0x2")
+	slot1, slot2 := common.HexToHash("0x01"), common.HexToHash("0x02")
+
+	acc := accounts.NewAccount()
+	acc.Initialised = true
+	acc.Nonce = 5
+	acc.Balance.SetInt64(100)
+	acc.Incarnation = FirstContractIncarnation
+	enc := make([]byte, acc.EncodingLengthForStorage())
+	acc.EncodeForStorage(enc)
+	addrHash, _ := common.HashData(existing[:])
+	if err := db.Put(dbutils.AccountsBucket, addrHash[:], enc); err != nil {
+		t.Fatal(err)
+	}
+	for _, slot := range []common.Hash{slot1, slot2} {
+		keyHash, _ := common.HashData(slot[:])
+		if err := db.Put(dbutils.StorageBucket, dbutils.GenerateCompositeStorageKey(addrHash, FirstContractIncarnation, keyHash), []byte{0x0a}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code := []byte{0x60, 0x00}
+	ibs := New(NewOverrideReader(NewDbState(db, 0), map[common.Address]AccountOverride{
+		existing: {Balance: big.NewInt(7), StateDiff: map[common.Hash]common.Hash{slot1: common.HexToHash("0x0b")}},
+		created:  {Code: code, State: map[common.Hash]common.Hash{slot2: common.HexToHash("0x0c")}},
+	}))
+
+	if ibs.GetNonce(existing) != 5 || ibs.GetBalance(existing).Int64() != 7 {
+		t.Errorf("unexpected nonce %d and balance %d", ibs.GetNonce(existing), ibs.GetBalance(existing))
+	}
+	if v := ibs.GetState(existing, slot1); v != common.HexToHash("0x0b") {
+		t.Errorf("expected the overridden slot, got %x", v)
+	}
+	if v := ibs.GetState(existing, slot2); v != common.HexToHash("0x0a") {
+		t.Errorf("expected the slot from the database, got %x", v)
+	}
+
+	if !ibs.Exist(created) || !bytes.Equal(ibs.GetCode(created), code) || ibs.GetCodeSize(created) != len(code) {
+		t.Errorf("expected the created account with the code")
+	}
+	if v := ibs.GetState(created, slot2); v != common.HexToHash("0x0c") {
+		t.Errorf("expected the overridden slot, got %x", v)
+	}
+	if v := ibs.GetState(created, slot1); v != (common.Hash{}) {
+		t.Errorf("expected the storage to be replaced, got %x", v)
+	}
+}
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+// PendingChanges is a snapshot of the modifications that have been written to TrieDbState (via TrieStateWriter)
+// but not yet applied to the trie (see UpdateStateTrie). Everything is keyed by the hashes of the addresses and
+// of the storage keys, the way it is kept in the buffers. The snapshot does not share any data with TrieDbState
+type PendingChanges struct {
+	Accounts  map[common.Hash]*accounts.Account      // Updated accounts, nil for the deleted ones
+	Deleted   []common.Hash                          // Self-destructed accounts
+	Created   []common.Hash                          // Accounts where contracts have been created
+	Storage   map[common.Hash]map[common.Hash][]byte // Storage writes, nil value for the deleted items
+	Preimages map[common.Hash]common.Address         // Addresses of the accounts above, where the preimages are known
+}
+
+// PendingChanges returns the modifications pending in the buffers of the current block, including the current
+// buffer. Addresses are filled in from the preimages stored in the database (see EnablePreimages)
+func (tds *TrieDbState) PendingChanges() *PendingChanges {
+	var aggregate Buffer
+	aggregate.initialise()
+	for _, b := range tds.buffers {
+		aggregate.merge(b)
+	}
+	pc := &PendingChanges{
+		Accounts:  make(map[common.Hash]*accounts.Account, len(aggregate.accountUpdates)),
+		Deleted:   setKeys(aggregate.deleted, true),
+		Created:   setKeys(aggregate.created, true),
+		Storage:   make(map[common.Hash]map[common.Hash][]byte, len(aggregate.storageUpdates)),
+		Preimages: make(map[common.Hash]common.Address),
+	}
+	// The aggregate holds its own copies of the accounts
+	for addrHash, account := range aggregate.accountUpdates {
+		pc.Accounts[addrHash] = account
+	}
+	for addrHash, m := range aggregate.storageUpdates {
+		sm := make(map[common.Hash][]byte, len(m))
+		for keyHash, v := range m {
+			sm[keyHash] = common.CopyBytes(v)
+		}
+		pc.Storage[addrHash] = sm
+	}
+	lookup := func(addrHash common.Hash) {
+		if _, ok := pc.Preimages[addrHash]; ok {
+			return
+		}
+		if p, _ := tds.db.Get(dbutils.PreimagePrefix, addrHash[:]); len(p) == common.AddressLength {
+			pc.Preimages[addrHash] = common.BytesToAddress(p)
+		}
+	}
+	for addrHash := range pc.Accounts {
+		lookup(addrHash)
+	}
+	for addrHash := range pc.Storage {
+		lookup(addrHash)
+	}
+	return pc
+}
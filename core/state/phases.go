@@ -0,0 +1,123 @@
+package state
+
+import (
+	"context"
+	"runtime/pprof"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/metrics"
+)
+
+// Phase is a part of the work of TrieDbState on a block. The goroutines are labelled with the phase
+// (label "state") while they are in it, so that the CPU profiles attribute the time to the phases
+type Phase int
+
+const (
+	PhaseResolve Phase = iota // Loading the parts of the trie touched by the block from the database
+	PhaseUpdate               // Applying the changes of the block to the trie
+	PhaseHash                 // Computing the state roots
+	PhasePrune                // Evicting the old parts of the trie from memory
+	PhaseCommit               // Writing the changes of the block to the database
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"resolve", "update", "hash", "prune", "commit"}
+
+var phaseTimers = [numPhases]metrics.Timer{
+	metrics.NewRegisteredTimer("state/phase/resolve", nil),
+	metrics.NewRegisteredTimer("state/phase/update", nil),
+	metrics.NewRegisteredTimer("state/phase/hash", nil),
+	metrics.NewRegisteredTimer("state/phase/prune", nil),
+	metrics.NewRegisteredTimer("state/phase/commit", nil),
+}
+
+func (p Phase) String() string {
+	if p < 0 || p >= numPhases {
+		return "unknown"
+	}
+	return phaseNames[p]
+}
+
+// PhaseStats is the time spent by TrieDbState in each phase of a block. The time of a phase
+// does not include the phases nested in it (e.g. hashing the trie while updating it)
+type PhaseStats struct {
+	Resolve time.Duration
+	Update  time.Duration
+	Hash    time.Duration
+	Prune   time.Duration
+	Commit  time.Duration
+}
+
+func (s *PhaseStats) add(p Phase, d time.Duration) {
+	switch p {
+	case PhaseResolve:
+		s.Resolve += d
+	case PhaseUpdate:
+		s.Update += d
+	case PhaseHash:
+		s.Hash += d
+	case PhasePrune:
+		s.Prune += d
+	case PhaseCommit:
+		s.Commit += d
+	}
+}
+
+// Total is the time spent in all the phases
+func (s *PhaseStats) Total() time.Duration {
+	return s.Resolve + s.Update + s.Hash + s.Prune + s.Commit
+}
+
+// phaseNestingKey is the context key of the time spent in the phases nested in the current one
+type phaseNestingKey struct{}
+
+// inPhase runs f labelled with the phase, and accounts its time (minus the time of the nested phases)
+// to the current block. The context passed to f has to be used for the nested phases
+func (tds *TrieDbState) inPhase(ctx context.Context, p Phase, f func(ctx context.Context) error) error {
+	start := time.Now()
+	var nested time.Duration
+	parent, _ := ctx.Value(phaseNestingKey{}).(*time.Duration)
+	var err error
+	pprof.Do(context.WithValue(ctx, phaseNestingKey{}, &nested), pprof.Labels("state", p.String()), func(ctx context.Context) {
+		err = f(ctx)
+	})
+	elapsed := time.Since(start)
+	if parent != nil {
+		*parent += elapsed
+	}
+	d := elapsed - nested
+	phaseTimers[p].Update(d)
+	tds.phaseStatsMu.Lock()
+	if p == PhaseCommit {
+		// Blocks are committed after SetBlockNr, so the commit belongs to the block which has just been finished
+		tds.lastPhaseStats.add(p, d)
+	} else {
+		tds.phaseStats.add(p, d)
+	}
+	tds.phaseStatsMu.Unlock()
+	return err
+}
+
+// CommitBlock writes the changes of the block made in the IntraBlockState to the state writer (normally the one
+// returned by DbStateWriter), in the commit phase. It is to be called after SetBlockNr for the block
+func (tds *TrieDbState) CommitBlock(ctx context.Context, ibs *IntraBlockState, stateWriter StateWriter) error {
+	return tds.inPhase(ctx, PhaseCommit, func(ctx context.Context) error {
+		return ibs.CommitBlock(ctx, stateWriter)
+	})
+}
+
+// BlockPhaseStats returns the time spent in the phases of the last finished block, that is the block passed to
+// the last invocation of SetBlockNr. Its commit phase is included once CommitBlock returns
+func (tds *TrieDbState) BlockPhaseStats() PhaseStats {
+	tds.phaseStatsMu.Lock()
+	defer tds.phaseStatsMu.Unlock()
+	return tds.lastPhaseStats
+}
+
+// finishPhaseStats closes the phase statistics of the current block
+func (tds *TrieDbState) finishPhaseStats() {
+	tds.phaseStatsMu.Lock()
+	defer tds.phaseStatsMu.Unlock()
+	tds.lastPhaseStats = tds.phaseStats
+	tds.phaseStats = PhaseStats{}
+}
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestBlockPhaseStats(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ibs := New(tds)
+	for i := 0; i < 100; i++ {
+		ibs.AddBalance(common.BytesToAddress([]byte{byte(i)}), big.NewInt(int64(i+1)))
+	}
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	stats := tds.BlockPhaseStats()
+	if stats.Update == 0 || stats.Hash == 0 {
+		t.Errorf("expected the update and the hash phases to be measured, got %+v", stats)
+	}
+	if stats.Commit != 0 {
+		t.Errorf("did not expect the commit phase before the commit, got %+v", stats)
+	}
+	if err = tds.CommitBlock(ctx, ibs, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if stats = tds.BlockPhaseStats(); stats.Commit == 0 {
+		t.Errorf("expected the commit phase to be accounted to the finished block, got %+v", stats)
+	}
+	tds.PruneTries(false)
+
+	tds.SetBlockNr(2)
+	stats = tds.BlockPhaseStats()
+	if stats.Prune == 0 {
+		t.Errorf("expected the prune phase to be measured, got %+v", stats)
+	}
+	if stats.Update != 0 || stats.Hash != 0 || stats.Commit != 0 {
+		t.Errorf("expected the statistics to be reset for the next block, got %+v", stats)
+	}
+}
+
+func TestPhaseLabels(t *testing.T) {
+	tds, err := NewTrieDbState(common.Hash{}, ethdb.NewMemDatabase(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outer, inner, restored string
+	if err = tds.inPhase(context.Background(), PhaseUpdate, func(ctx context.Context) error {
+		outer, _ = pprof.Label(ctx, "state")
+		_ = tds.inPhase(ctx, PhaseHash, func(ctx context.Context) error {
+			inner, _ = pprof.Label(ctx, "state")
+			return nil
+		})
+		restored, _ = pprof.Label(ctx, "state")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if outer != "update" || inner != "hash" || restored != "update" {
+		t.Errorf("unexpected labels: outer %q, inner %q, restored %q", outer, inner, restored)
+	}
+	tds.SetBlockNr(1)
+	if stats := tds.BlockPhaseStats(); stats.Total() != stats.Update+stats.Hash {
+		t.Errorf("expected only the update and hash phases, got %+v", stats)
+	}
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// ProofSession accumulates the touches (and the accessed codes) of the reads and the writes performed through
+// its own TrieDbState (see State), independently of the block processing and of the other sessions, so that
+// the witnesses and the proofs can be extracted from the same trie concurrently, for example while mining
+// and serving eth_getProof. Sessions can be nested: the touches recorded by a session started from the
+// State of another session are also recorded by the enclosing session, until it ends
+type ProofSession struct {
+	parent  *ProofSession
+	state   *TrieDbState
+	mu      sync.Mutex // Protects builder and ended, as the nested sessions record from their own goroutines
+	builder *trie.ResolveSetBuilder
+	ended   bool
+}
+
+// BeginProofSession starts the proof session on top of the current trie. The touches made through tds itself
+// are not recorded by the session, unless tds is the State of another session, which becomes the parent
+func (tds *TrieDbState) BeginProofSession() *ProofSession {
+	ps := &ProofSession{
+		parent:  tds.proofSession,
+		builder: trie.NewResolveSetBuilder(),
+	}
+	ps.state = tds.WithNewBuffer()
+	ps.state.resolveReads = true
+	ps.state.resolveSetBuilder = ps.builder
+	ps.state.proofSession = ps
+	return ps
+}
+
+// State returns the TrieDbState whose reads, writes and resolutions are recorded by the session
+func (ps *ProofSession) State() *TrieDbState {
+	return ps.state
+}
+
+// record applies f to the builder of the session, unless the session has ended
+func (ps *ProofSession) record(f func(*trie.ResolveSetBuilder)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if !ps.ended {
+		f(ps.builder)
+	}
+}
+
+// ExtractTouches is the counterpart of TrieDbState.ExtractTouches for the touches recorded by the session
+func (ps *ProofSession) ExtractTouches() (accountTouches [][]byte, storageTouches [][]byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.builder.ExtractTouches()
+}
+
+// ExtractTypedTouches is the counterpart of TrieDbState.ExtractTypedTouches for the touches recorded by the session
+func (ps *ProofSession) ExtractTypedTouches() []trie.Touch {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.builder.ExtractTypedTouches()
+}
+
+// ExtractWitness produces the witness for the touches recorded by the session since the previous extraction,
+// and clears them. The touches of the block processing and of the other sessions are not affected
+func (ps *ProofSession) ExtractWitness(trace bool, isBinary bool) (*trie.Witness, error) {
+	ps.mu.Lock()
+	rs, codeMap := ps.builder.Build(isBinary)
+	ps.mu.Unlock()
+	return ps.state.makeBlockWitness(trace, rs, codeMap, isBinary)
+}
+
+// ExtractTypedWitness is the counterpart of TrieDbState.ExtractTypedWitness for the touches recorded by the session
+func (ps *ProofSession) ExtractTypedWitness(trace bool, isBinary bool) (*trie.Witness, []trie.Touch, error) {
+	ps.mu.Lock()
+	rs, codeMap, touches := ps.builder.BuildTyped(isBinary)
+	ps.mu.Unlock()
+	w, err := ps.state.makeBlockWitness(trace, rs, codeMap, isBinary)
+	if err != nil {
+		return nil, nil, err
+	}
+	return w, touches, nil
+}
+
+// End stops the recording. The touches that have not been extracted yet are discarded
+func (ps *ProofSession) End() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.ended = true
+	ps.builder = trie.NewResolveSetBuilder()
+}
+
+// recordProof applies f to the builder of tds, and to the builders of the enclosing proof sessions, if any
+func (tds *TrieDbState) recordProof(f func(*trie.ResolveSetBuilder)) {
+	if tds.proofSession == nil {
+		f(tds.resolveSetBuilder)
+		return
+	}
+	for ps := tds.proofSession; ps != nil; ps = ps.parent {
+		ps.record(f)
+	}
+}
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestProofSessions(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	addrs := []common.Address{common.HexToAddress("0x1"), common.HexToAddress("0x2"), common.HexToAddress("0x3")}
+	tds.StartNewBuffer()
+	w := tds.TrieStateWriter()
+	for i, addr := range addrs {
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i + 1)
+		if err = w.UpdateAccountData(ctx, addr, &accounts.Account{}, &acc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetResolveReads(true)
+	tds.ExtractTouches()
+
+	read := func(s *TrieDbState, addr common.Address) {
+		s.StartNewBuffer()
+		if _, err := s.ReadAccountData(addr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ResolveStateTrie(false); err != nil {
+			t.Fatal(err)
+		}
+		s.clearUpdates()
+	}
+	check := func(name string, touches [][]byte, expected ...common.Address) {
+		t.Helper()
+		if len(touches) != len(expected) {
+			t.Fatalf("%s: expected %d touches, got %d", name, len(expected), len(touches))
+		}
+		for i, addr := range expected {
+			addrHash, _ := common.HashData(addr[:])
+			if !bytes.Equal(touches[i], addrHash[:]) {
+				t.Errorf("%s: unexpected touch %d: %x, expected %x", name, i, touches[i], addrHash)
+			}
+		}
+	}
+
+	outer := tds.BeginProofSession()
+	inner := outer.State().BeginProofSession()
+	read(tds, addrs[0])
+	read(outer.State(), addrs[1])
+	read(inner.State(), addrs[2])
+
+	touches, _ := tds.ExtractTouches()
+	check("block", touches, addrs[0])
+	touches, _ = inner.ExtractTouches()
+	check("inner", touches, addrs[2])
+
+	// The witness of the outer session covers its own touches and the ones of the inner session
+	w1, err := outer.ExtractWitness(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w1 == nil || len(w1.Operators) == 0 {
+		t.Errorf("expected non-empty witness")
+	}
+	touches, _ = outer.ExtractTouches()
+	check("outer after extraction", touches)
+
+	inner.End()
+	read(inner.State(), addrs[0])
+	touches, _ = inner.ExtractTouches()
+	check("ended inner", touches)
+	touches, _ = outer.ExtractTouches()
+	check("outer", touches, addrs[0])
+	touches, _ = tds.ExtractTouches()
+	check("block after the sessions", touches)
+}
@@ -0,0 +1,135 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// Query selects the accounts of the current state. All the conditions that are set must hold.
+// The query is executed as a single scan over the AccountsBucket, with the point lookups
+// into the StorageBucket for the storage conditions
+type Query struct {
+	BalanceGT         *big.Int
+	BalanceLT         *big.Int
+	NonceGT           *uint64
+	CodeHashIn        []common.Hash
+	HasCode           *bool
+	StorageSlotEquals map[common.Hash]common.Hash // Storage slot (not hashed) => value
+	Limit             int                         // Maximum number of results, 0 means no limit
+}
+
+// QueryResult is the account matching the Query. Address is nil if its preimage is not known
+type QueryResult struct {
+	Address  *common.Address
+	AddrHash common.Hash
+	Account  *accounts.Account
+}
+
+// slotCondition is the storage condition with the slot hashed, as it is in the StorageBucket
+type slotCondition struct {
+	keyHash common.Hash
+	value   []byte // Without leading zeros, like in the StorageBucket
+}
+
+func (q *Query) slotConditions() ([]slotCondition, error) {
+	conditions := make([]slotCondition, 0, len(q.StorageSlotEquals))
+	for slot, value := range q.StorageSlotEquals {
+		keyHash, err := common.HashData(slot[:])
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, slotCondition{keyHash: keyHash, value: bytes.TrimLeft(value[:], "\x00")})
+	}
+	return conditions, nil
+}
+
+// matchAccount checks the conditions on the account itself
+func (q *Query) matchAccount(acc *accounts.Account) bool {
+	if q.BalanceGT != nil && acc.Balance.Cmp(q.BalanceGT) <= 0 {
+		return false
+	}
+	if q.BalanceLT != nil && acc.Balance.Cmp(q.BalanceLT) >= 0 {
+		return false
+	}
+	if q.NonceGT != nil && acc.Nonce <= *q.NonceGT {
+		return false
+	}
+	if q.HasCode != nil && *q.HasCode == acc.IsEmptyCodeHash() {
+		return false
+	}
+	if len(q.CodeHashIn) > 0 {
+		found := false
+		for _, codeHash := range q.CodeHashIn {
+			if acc.CodeHash == codeHash {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// RunQuery streams the accounts matching the query to the walker, in the order of their address hashes.
+// If walker returns false, the scan stops
+func RunQuery(ctx context.Context, db ethdb.Getter, q *Query, walker func(*QueryResult) (bool, error)) error {
+	conditions, err := q.slotConditions()
+	if err != nil {
+		return err
+	}
+	var found int
+	return db.Walk(dbutils.AccountsBucket, nil, 0, func(k, v []byte) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		acc := new(accounts.Account)
+		if err := acc.DecodeForStorage(v); err != nil {
+			return false, fmt.Errorf("decoding account %x: %v", k, err)
+		}
+		if !q.matchAccount(acc) {
+			return true, nil
+		}
+		addrHash := common.BytesToHash(k)
+		for _, c := range conditions {
+			value, err := db.Get(dbutils.StorageBucket, dbutils.GenerateCompositeStorageKey(addrHash, acc.Incarnation, c.keyHash))
+			if err != nil && err != ethdb.ErrKeyNotFound {
+				return false, err
+			}
+			if !bytes.Equal(value, c.value) {
+				return true, nil
+			}
+		}
+		result := &QueryResult{AddrHash: addrHash, Account: acc}
+		if preimage, err := db.Get(dbutils.PreimagePrefix, addrHash[:]); err == nil && len(preimage) == common.AddressLength {
+			address := common.BytesToAddress(preimage)
+			result.Address = &address
+		}
+		found++
+		more, err := walker(result)
+		if err != nil {
+			return false, err
+		}
+		return more && (q.Limit == 0 || found < q.Limit), nil
+	})
+}
+
+// Execute runs the query and collects the matching accounts
+func (q *Query) Execute(ctx context.Context, db ethdb.Getter) ([]*QueryResult, error) {
+	var results []*QueryResult
+	if err := RunQuery(ctx, db, q, func(r *QueryResult) (bool, error) {
+		results = append(results, r)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
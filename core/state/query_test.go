@@ -0,0 +1,81 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestQuery(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.EnablePreimages(true)
+	ctx := context.Background()
+	poor := common.HexToAddress("0x1")
+	rich := common.HexToAddress("0x2")
+	contract := common.HexToAddress("0x3")
+	code := []byte{0x60, 0x00}
+	ibs := New(tds)
+	ibs.AddBalance(poor, big.NewInt(10))
+	ibs.AddBalance(rich, big.NewInt(1000))
+	ibs.AddBalance(contract, big.NewInt(500))
+	ibs.SetCode(contract, code)
+	ibs.SetState(contract, common.Hash{1}, common.Hash{31: 7})
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, q *Query, expected ...common.Address) {
+		results, err := q.Execute(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[common.Address]struct{})
+		for _, r := range results {
+			if r.Address == nil {
+				t.Errorf("%s: missing preimage of %x", name, r.AddrHash)
+				continue
+			}
+			got[*r.Address] = struct{}{}
+		}
+		if len(got) != len(expected) {
+			t.Errorf("%s: expected %d results, got %d", name, len(expected), len(got))
+		}
+		for _, addr := range expected {
+			if _, ok := got[addr]; !ok {
+				t.Errorf("%s: %x not found", name, addr)
+			}
+		}
+	}
+	hasCode := true
+	check("balance", &Query{BalanceGT: big.NewInt(100)}, rich, contract)
+	check("balance range", &Query{BalanceGT: big.NewInt(100), BalanceLT: big.NewInt(1000)}, contract)
+	check("code hash", &Query{CodeHashIn: []common.Hash{crypto.Keccak256Hash(code)}}, contract)
+	check("has code", &Query{HasCode: &hasCode}, contract)
+	check("storage", &Query{StorageSlotEquals: map[common.Hash]common.Hash{{1}: {31: 7}}}, contract)
+	check("storage mismatch", &Query{StorageSlotEquals: map[common.Hash]common.Hash{{1}: {31: 8}}})
+	check("all", &Query{}, poor, rich, contract)
+
+	results, err := (&Query{Limit: 2}).Execute(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected 2 results with the limit, got %d", len(results))
+	}
+}
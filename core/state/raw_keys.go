@@ -0,0 +1,35 @@
+package state
+
+import (
+	"errors"
+
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+// ErrRawKeysOnMainnet is returned by SetRawKeys for the main network
+var ErrRawKeysOnMainnet = errors.New("raw-keyed state cannot be used with the mainnet chain ID")
+
+// SetRawKeys switches TrieDbState into the development mode, where the trie and the state buckets are keyed by
+// the addresses (left-padded to 32 bytes) and the storage keys themselves, rather than by their Keccak hashes.
+// It makes the databases human-inspectable and saves the hashing in the tests, but the state roots are
+// not the consensus ones, so it is refused for the chain config with the mainnet chain ID. The config is
+// checked rather than the genesis in the database, because the mode must be chosen before anything is written,
+// and kept for the lifetime of the database.
+// Code mapping of the thin history (ContractCodeBucket) is still keyed by the hashes
+func (tds *TrieDbState) SetRawKeys(raw bool, config *params.ChainConfig) error {
+	if raw {
+		if config == nil || config.ChainID == nil {
+			return errors.New("raw-keyed state requires the chain config with the chain ID")
+		}
+		if config.ChainID.Cmp(params.MainnetChainConfig.ChainID) == 0 {
+			return ErrRawKeysOnMainnet
+		}
+	}
+	tds.rawKeys = raw
+	return nil
+}
+
+// RawKeys returns true if the state is keyed by the raw addresses and storage keys (see SetRawKeys)
+func (tds *TrieDbState) RawKeys() bool {
+	return tds.rawKeys
+}
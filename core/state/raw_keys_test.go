@@ -0,0 +1,57 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+func TestRawKeys(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tds.SetRawKeys(true, params.AllEthashProtocolChanges); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	addr := common.HexToAddress("0x1234")
+	ibs := New(tds)
+	ibs.AddBalance(addr, big.NewInt(100))
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	rawKey := common.BytesToHash(addr[:])
+	if enc, _ := db.Get(dbutils.AccountsBucket, rawKey[:]); len(enc) == 0 {
+		t.Errorf("expected the account to be keyed by the raw address")
+	}
+	if acc, err := tds.ReadAccountData(addr); err != nil || acc == nil || acc.Balance.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("unexpected account %+v, error %v", acc, err)
+	}
+
+	// Nothing is written yet for the mainnet, the chain config tells it
+	tds, err = NewTrieDbState(common.Hash{}, ethdb.NewMemDatabase(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tds.SetRawKeys(true, params.MainnetChainConfig); err != ErrRawKeysOnMainnet {
+		t.Errorf("expected ErrRawKeysOnMainnet, got %v", err)
+	}
+	if err = tds.SetRawKeys(true, nil); err == nil || tds.RawKeys() {
+		t.Errorf("expected the raw keys refused without the chain config")
+	}
+}
@@ -0,0 +1,96 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"golang.org/x/crypto/sha3"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+func (tds *TrieDbState) captureAccountRead(addrHash common.Hash, acc *accounts.Account) {
+	if tds.currentBuffer == nil {
+		return
+	}
+	if _, ok := tds.currentBuffer.accountReadValues[addrHash]; ok {
+		return
+	}
+	var enc []byte
+	if acc != nil {
+		enc = make([]byte, acc.EncodingLengthForStorage())
+		acc.EncodeForStorage(enc)
+	}
+	tds.currentBuffer.accountReadValues[addrHash] = enc
+}
+
+func (tds *TrieDbState) captureStorageRead(addrHash common.Hash, keyHash common.Hash, enc []byte) {
+	if tds.currentBuffer == nil {
+		return
+	}
+	m, ok := tds.currentBuffer.storageReadValues[addrHash]
+	if !ok {
+		m = make(map[common.Hash][]byte)
+		tds.currentBuffer.storageReadValues[addrHash] = m
+	}
+	if _, ok := m[keyHash]; !ok {
+		m[keyHash] = common.CopyBytes(enc)
+	}
+}
+
+// ReadSetDigest returns a commitment to the values observed by the reads in all the current buffers
+// (i.e. since the last UpdateStateTrie or UnwindTo). Only the first observation of each key is committed to.
+// Values are only captured when enabled via SetCaptureReadValues.
+// The digest is the keccak256 of the sorted sequence of accounts records (addrHash, value), followed
+// by the sorted sequence of storage records (addrHash, keyHash, value), where each value is prefixed
+// by its length, and absent items are encoded as empty values.
+func (tds *TrieDbState) ReadSetDigest() common.Hash {
+	var b Buffer
+	b.initialise()
+	for _, buffer := range tds.buffers {
+		b.merge(buffer)
+	}
+
+	sha := sha3.NewLegacyKeccak256()
+	var lenBytes [4]byte
+	writeValue := func(v []byte) {
+		binary.BigEndian.PutUint32(lenBytes[:], uint32(len(v)))
+		sha.Write(lenBytes[:])
+		sha.Write(v)
+	}
+
+	addrHashes := make([]common.Hash, 0, len(b.accountReadValues))
+	for addrHash := range b.accountReadValues {
+		addrHashes = append(addrHashes, addrHash)
+	}
+	sort.Slice(addrHashes, func(i, j int) bool { return bytes.Compare(addrHashes[i][:], addrHashes[j][:]) < 0 })
+	for _, addrHash := range addrHashes {
+		sha.Write(addrHash[:])
+		writeValue(b.accountReadValues[addrHash])
+	}
+
+	addrHashes = addrHashes[:0]
+	for addrHash := range b.storageReadValues {
+		addrHashes = append(addrHashes, addrHash)
+	}
+	sort.Slice(addrHashes, func(i, j int) bool { return bytes.Compare(addrHashes[i][:], addrHashes[j][:]) < 0 })
+	for _, addrHash := range addrHashes {
+		m := b.storageReadValues[addrHash]
+		keyHashes := make([]common.Hash, 0, len(m))
+		for keyHash := range m {
+			keyHashes = append(keyHashes, keyHash)
+		}
+		sort.Slice(keyHashes, func(i, j int) bool { return bytes.Compare(keyHashes[i][:], keyHashes[j][:]) < 0 })
+		for _, keyHash := range keyHashes {
+			sha.Write(addrHash[:])
+			sha.Write(keyHash[:])
+			writeValue(m[keyHash])
+		}
+	}
+
+	var h common.Hash
+	sha.Sum(h[:0])
+	return h
+}
@@ -0,0 +1,59 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func readSetDigestForBalance(t *testing.T, balance int64) common.Hash {
+	db := ethdb.NewMemDatabase()
+	addr := common.HexToAddress("0x1234")
+	addrHash, err := common.HashData(addr[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc := accounts.NewAccount()
+	acc.Balance.SetInt64(balance)
+	enc := make([]byte, acc.EncodingLengthForStorage())
+	acc.EncodeForStorage(enc)
+	if err = db.Put(dbutils.AccountsBucket, addrHash[:], enc); err != nil {
+		t.Fatal(err)
+	}
+
+	// State root has to match the flat state, otherwise the empty trie tells that the account does not exist
+	tr := trie.New(common.Hash{})
+	tr.UpdateAccount(addrHash[:], &acc)
+	tds, err := NewTrieDbState(tr.Hash(), db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetCaptureReadValues(true)
+	tds.StartNewBuffer()
+	if _, err = tds.ReadAccountData(addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ReadAccountData(common.HexToAddress("0x5678")); err != nil {
+		t.Fatal(err)
+	}
+	return tds.ReadSetDigest()
+}
+
+func TestReadSetDigest(t *testing.T) {
+	d1 := readSetDigestForBalance(t, 100)
+	d2 := readSetDigestForBalance(t, 100)
+	d3 := readSetDigestForBalance(t, 101)
+	if d1 != d2 {
+		t.Errorf("digest is not deterministic: %x != %x", d1, d2)
+	}
+	if d1 == d3 {
+		t.Errorf("digest does not depend on the observed values")
+	}
+	if d1 == (&TrieDbState{}).ReadSetDigest() {
+		t.Errorf("digest of a non-empty read-set must differ from the empty one")
+	}
+}
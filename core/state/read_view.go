@@ -0,0 +1,181 @@
+package state
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/metrics"
+)
+
+// maxReadViewEntries limits the number of the values in the read view. When it is exceeded,
+// the view is replaced by an empty one at the next pruning of the trie
+const maxReadViewEntries = 1024 * 1024
+
+var (
+	readViewHitMeter  = metrics.NewRegisteredMeter("state/view/hit", nil)
+	readViewMissMeter = metrics.NewRegisteredMeter("state/view/miss", nil)
+)
+
+// readView serves the accounts and the storage items that have been read from the trie, and have not been
+// modified since, without taking tMu. The values stay in the view when the nodes they were read from
+// are collapsed into hash nodes by the pruning, so the reads of the unchanged data do not wait for
+// the block processing even then. The values are immutable: the entries are only added under the read
+// lock of tMu (so that they correspond to the trie), and removed under the write lock of tMu, by
+// invalidate, before the trie is modified. The maps are swapped atomically by reset.
+// Each value carries the prefixes of the trie nodes that its lookup touched, and the reads served
+// from the view touch them again, so that the pruning does not evict the paths of the most read values
+type readView struct {
+	v atomic.Value // *readViewMaps
+}
+
+type readViewMaps struct {
+	accounts sync.Map // common.Hash => *accountViewEntry
+	storage  sync.Map // common.Hash => *sync.Map of storageViewKey => *storageViewEntry
+	size     int64
+}
+
+type accountViewEntry struct {
+	acc     *accounts.Account // nil for non-existent accounts
+	touches [][]byte
+}
+
+type storageViewEntry struct {
+	value   []byte
+	touches [][]byte
+}
+
+type storageViewKey struct {
+	incarnation uint64
+	keyHash     common.Hash
+}
+
+func newReadView() *readView {
+	rv := &readView{}
+	rv.reset()
+	return rv
+}
+
+// reset replaces all the values with the empty view. It has to be called with the write lock of tMu
+func (rv *readView) reset() {
+	rv.v.Store(&readViewMaps{})
+}
+
+func (rv *readView) maps() *readViewMaps {
+	return rv.v.Load().(*readViewMaps)
+}
+
+func (rv *readView) full() bool {
+	return atomic.LoadInt64(&rv.maps().size) >= maxReadViewEntries
+}
+
+// account returns the account together with the prefixes of the trie nodes touched by its lookup
+func (rv *readView) account(addrHash common.Hash) (*accounts.Account, [][]byte, bool) {
+	v, ok := rv.maps().accounts.Load(addrHash)
+	if !ok {
+		readViewMissMeter.Mark(1)
+		return nil, nil, false
+	}
+	readViewHitMeter.Mark(1)
+	e := v.(*accountViewEntry)
+	if e.acc == nil {
+		return nil, e.touches, true
+	}
+	var cpy accounts.Account
+	cpy.Copy(e.acc)
+	return &cpy, e.touches, true
+}
+
+// addAccount has to be called with the read lock of tMu, with the account found in the trie
+func (rv *readView) addAccount(addrHash common.Hash, acc *accounts.Account, touches [][]byte) {
+	m := rv.maps()
+	if atomic.LoadInt64(&m.size) >= maxReadViewEntries {
+		return
+	}
+	e := &accountViewEntry{touches: touches}
+	if acc != nil {
+		e.acc = new(accounts.Account)
+		e.acc.Copy(acc)
+	}
+	if _, loaded := m.accounts.LoadOrStore(addrHash, e); !loaded {
+		atomic.AddInt64(&m.size, 1)
+	}
+}
+
+// storage returns the storage item together with the prefixes of the trie nodes touched by its lookup
+func (rv *readView) storage(addrHash common.Hash, incarnation uint64, keyHash common.Hash) ([]byte, [][]byte, bool) {
+	s, ok := rv.maps().storage.Load(addrHash)
+	if !ok {
+		readViewMissMeter.Mark(1)
+		return nil, nil, false
+	}
+	v, ok := s.(*sync.Map).Load(storageViewKey{incarnation, keyHash})
+	if !ok {
+		readViewMissMeter.Mark(1)
+		return nil, nil, false
+	}
+	readViewHitMeter.Mark(1)
+	e := v.(*storageViewEntry)
+	return e.value, e.touches, true
+}
+
+// addStorage has to be called with the read lock of tMu, with the storage item found in the trie
+func (rv *readView) addStorage(addrHash common.Hash, incarnation uint64, keyHash common.Hash, value []byte, touches [][]byte) {
+	m := rv.maps()
+	if atomic.LoadInt64(&m.size) >= maxReadViewEntries {
+		return
+	}
+	s, _ := m.storage.LoadOrStore(addrHash, &sync.Map{})
+	if _, loaded := s.(*sync.Map).LoadOrStore(storageViewKey{incarnation, keyHash}, &storageViewEntry{common.CopyBytes(value), touches}); !loaded {
+		atomic.AddInt64(&m.size, 1)
+	}
+}
+
+// invalidate removes the values of the accounts and the storage items modified by the buffer.
+// It has to be called with the write lock of tMu, before the modifications are applied to the trie
+func (rv *readView) invalidate(b *Buffer) {
+	m := rv.maps()
+	remove := func(addrHash common.Hash) {
+		m.accounts.Delete(addrHash)
+		// The storage root of the account changes together with its storage items
+		m.storage.Delete(addrHash)
+	}
+	for addrHash := range b.accountUpdates {
+		remove(addrHash)
+	}
+	for addrHash := range b.storageUpdates {
+		remove(addrHash)
+	}
+	for addrHash := range b.created {
+		remove(addrHash)
+	}
+	for addrHash := range b.deleted {
+		remove(addrHash)
+	}
+}
+
+// viewTouches returns the prefixes of the trie nodes touched by the lookup of the key, to be stored in the view
+// with the value. It has to be called with the read lock of tMu. The binary trie is not tracked for pruning
+func (tds *TrieDbState) viewTouches(key []byte) [][]byte {
+	t, err := tds.concreteTrie()
+	if err != nil || t.IsBinary() {
+		return nil
+	}
+	return t.TouchedPrefixes(key)
+}
+
+// touchView records the touches of a value served from the view, in the same way as the lookups in the trie do
+func (tds *TrieDbState) touchView(touches [][]byte) {
+	if len(touches) == 0 {
+		return
+	}
+	tds.touchMu.Lock()
+	defer tds.touchMu.Unlock()
+	for _, hex := range touches {
+		tds.tp.Touch(hex, false)
+		if tds.touchStats != nil {
+			tds.touchStats.add(hex, tds.touchOrigin)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestReadViewWithoutLock(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := common.HexToAddress("0xc")
+	commitTestBlock(t, tds, 1, func(ibs *IntraBlockState) {
+		for i := 0; i < 50; i++ {
+			ibs.AddBalance(common.BytesToAddress([]byte{byte(i + 1)}), big.NewInt(1))
+		}
+		ibs.CreateAccount(contract, true)
+		ibs.SetState(contract, common.Hash{1}, common.Hash{31: 1})
+	})
+	addr := common.BytesToAddress([]byte{1})
+	key := common.Hash{1}
+	read := func() (*big.Int, []byte) {
+		acc, err := tds.ReadAccountData(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := tds.ReadAccountStorage(contract, 1, &key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &acc.Balance, v
+	}
+	read()
+
+	// The unchanged values are served while the trie is being modified, also after they are pruned from the trie
+	tds.SetCacheGenLimit(0)
+	tds.PruneTries(false)
+	tds.tMu.Lock()
+	done := make(chan struct{})
+	var balance *big.Int
+	var value []byte
+	go func() {
+		balance, value = read()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("read of the unchanged values waits for tMu")
+	}
+	tds.tMu.Unlock()
+	if balance.Uint64() != 1 || common.BytesToHash(value) != (common.Hash{31: 1}) {
+		t.Errorf("unexpected values: balance %d, storage %x", balance, value)
+	}
+
+	// Modified values are not served from the view
+	tds.SetCacheGenLimit(DefaultTrieCacheGen)
+	commitTestBlock(t, tds, 2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(addr, big.NewInt(2))
+		ibs.SetState(contract, key, common.Hash{31: 2})
+	})
+	if balance, value = read(); balance.Uint64() != 3 || common.BytesToHash(value) != (common.Hash{31: 2}) {
+		t.Errorf("expected the modified values, got balance %d, storage %x", balance, value)
+	}
+}
+
+func TestReadViewTouches(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitTestBlock(t, tds, 1, func(ibs *IntraBlockState) {
+		for i := 0; i < 50; i++ {
+			ibs.AddBalance(common.BytesToAddress([]byte{byte(i + 1)}), big.NewInt(1))
+		}
+	})
+	addr := common.BytesToAddress([]byte{1})
+	addrHash, err := tds.hashAddress(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first read is served from the trie, the following ones from the view
+	for blockNr := uint64(1); blockNr <= 4; blockNr++ {
+		tds.SetBlockNr(blockNr)
+		if _, err = tds.ReadAccountData(addr); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, ok := tds.view.account(addrHash); !ok {
+			t.Fatalf("account is not in the view after the read at block %d", blockNr)
+		}
+	}
+
+	tds.SetCacheGenLimit(0)
+	tds.PruneTries(false)
+	if acc, ok := tds.t.GetAccount(addrHash[:]); !ok || acc == nil {
+		t.Errorf("account served from the view has been pruned from the trie")
+	}
+	var pruned bool
+	for i := 1; i < 50; i++ {
+		h, err := tds.hashAddress(common.BytesToAddress([]byte{byte(i + 1)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := tds.t.GetAccount(h[:]); !ok {
+			pruned = true
+		}
+	}
+	if !pruned {
+		t.Errorf("expected the accounts that were not read to be pruned")
+	}
+}
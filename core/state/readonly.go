@@ -70,7 +70,7 @@ func (dbs *DbState) ForEachStorage(addr common.Address, start []byte, cb func(ke
 	var s [common.HashLength + common.IncarnationLength + common.HashLength]byte
 	copy(s[:], addrHash[:])
 	// TODO: [Issue 99] support incarnations
-	binary.BigEndian.PutUint64(s[common.HashLength:], ^uint64(FirstContractIncarnation))
+	dbutils.EncodeIncarnation(s[common.HashLength:], FirstContractIncarnation)
 	copy(s[common.HashLength+common.IncarnationLength:], start)
 	var lastSecKey common.Hash
 	overrideCounter := 0
@@ -202,6 +202,12 @@ func (dbs *DbState) ReadAccountCode(address common.Address, codeHash common.Hash
 }
 
 func (dbs *DbState) ReadAccountCodeSize(address common.Address, codeHash common.Hash) (int, error) {
+	if bytes.Equal(codeHash[:], emptyCodeHash) {
+		return 0, nil
+	}
+	if codeSize, found, err := readCodeSize(dbs.db, codeHash); err != nil || found {
+		return codeSize, err
+	}
 	code, err := dbs.ReadAccountCode(address, codeHash)
 	if err != nil {
 		return 0, err
@@ -344,7 +350,7 @@ func (dbs *DbState) WalkStorageRange(addrHash common.Hash, prefix trie.Keybytes,
 	startkey := make([]byte, common.HashLength+common.IncarnationLength+common.HashLength)
 	copy(startkey, addrHash[:])
 	// TODO: [Issue 99] Support incarnations
-	binary.BigEndian.PutUint64(startkey[common.HashLength:], ^uint64(1))
+	dbutils.EncodeIncarnation(startkey[common.HashLength:], FirstContractIncarnation)
 	copy(startkey[common.HashLength+common.IncarnationLength:], prefix.Data)
 
 	fixedbits := (common.HashLength + common.IncarnationLength + uint(len(prefix.Data))) * 8
@@ -0,0 +1,115 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// Contract introduced in the genesis state with nonce 0 can be self-destructed and re-created in the same block
+// (see TrieDbState.updateTrieRoots). Each case describes the transactions of such block, and the expected state
+// is constructed from scratch
+type recreationTx func(ibs *IntraBlockState)
+
+type recreationCase struct {
+	name        string
+	txs         []recreationTx
+	sameBuffer  bool // All transactions write into one buffer
+	expected    map[common.Hash]common.Hash
+	expectAlive bool
+}
+
+var (
+	recreationAddr = common.HexToAddress("0x1234")
+	recreationCode = []byte{0x60, 0x00, 0xff}
+)
+
+func recreationSuicide(ibs *IntraBlockState) {
+	ibs.Suicide(recreationAddr)
+}
+
+func recreationCreate(storage map[common.Hash]common.Hash) recreationTx {
+	return func(ibs *IntraBlockState) {
+		ibs.CreateAccount(recreationAddr, true)
+		ibs.SetCode(recreationAddr, recreationCode)
+		for k, v := range storage {
+			ibs.SetState(recreationAddr, k, v)
+		}
+	}
+}
+
+// recreationState creates the contract with the given storage in block 1, and returns the state after it
+func recreationState(t *testing.T, storage map[common.Hash]common.Hash) *TrieDbState {
+	tds, err := NewTrieDbState(common.Hash{}, ethdb.NewMemDatabase(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ibs := New(tds)
+	if storage != nil {
+		recreationCreate(storage)(ibs)
+	}
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	return tds
+}
+
+func TestContractRecreation(t *testing.T) {
+	genesis := map[common.Hash]common.Hash{
+		common.HexToHash("01"): common.HexToHash("01"),
+		common.HexToHash("02"): common.HexToHash("02"),
+	}
+	after := map[common.Hash]common.Hash{
+		common.HexToHash("02"): common.HexToHash("22"),
+		common.HexToHash("03"): common.HexToHash("03"),
+	}
+	cases := []recreationCase{
+		{name: "destruct", txs: []recreationTx{recreationSuicide}},
+		{name: "recreate", txs: []recreationTx{recreationSuicide, recreationCreate(after)}, expected: after, expectAlive: true},
+		{name: "recreate in one buffer", txs: []recreationTx{recreationSuicide, recreationCreate(after)}, sameBuffer: true, expected: after, expectAlive: true},
+		{name: "recreate empty", txs: []recreationTx{recreationSuicide, recreationCreate(nil)}, expected: map[common.Hash]common.Hash{}, expectAlive: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			tds := recreationState(t, genesis)
+			ctx := context.Background()
+			ibs := New(tds)
+			if c.sameBuffer {
+				tds.StartNewBuffer()
+			}
+			for _, tx := range c.txs {
+				if !c.sameBuffer {
+					tds.StartNewBuffer()
+				}
+				tx(ibs)
+				if err := ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := tds.ComputeTrieRoots(); err != nil {
+				t.Fatal(err)
+			}
+			var expected *TrieDbState
+			if c.expectAlive {
+				expected = recreationState(t, c.expected)
+			} else {
+				expected = recreationState(t, nil)
+			}
+			if tds.LastRoot() != expected.LastRoot() {
+				t.Errorf("state root %x, expected %x", tds.LastRoot(), expected.LastRoot())
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+)
+
+// ReplicaChange is one write of the DbStateWriter, as it is replayed by the replicas.
+// Writes into the history buckets (PutS) carry the history bucket and the original value
+type ReplicaChange struct {
+	Bucket    []byte
+	Key       []byte
+	Value     []byte
+	Deleted   bool
+	NoHistory bool // Only for the history writes: only the change set is written
+	// Deletion of the history and the change sets of the block encoded in the key, see ethdb.Database.DeleteTimestamp
+	DeletedBlock bool
+}
+
+// BlockChanges are the changes of the flat buckets made by one block, in the order of writing, or the changes
+// undoing the blocks after BlockNr (Revert, see TrieDbState.UnwindTo). The replicas are brought from the block
+// ParentHash to the block BlockHash by the changes
+type BlockChanges struct {
+	BlockNr    uint64
+	BlockHash  common.Hash
+	ParentHash common.Hash // Parent of the block, or the head being reverted
+	Revert     bool
+	FromBlock  uint64 // Only for the reverts: number of the head being reverted
+	Changes    []ReplicaChange
+}
+
+// ChangeStreamer ships the changes of the committed blocks to the followers, as the stream of RLP-encoded
+// BlockChanges. The writer may be a network connection or a file used as a queue
+type ChangeStreamer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewChangeStreamer(w io.Writer) *ChangeStreamer {
+	return &ChangeStreamer{w: w}
+}
+
+// Send writes the changes of one block to the stream
+func (s *ChangeStreamer) Send(changes *BlockChanges) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return rlp.Encode(s.w, changes)
+}
+
+// SetChangeStreamer makes the DbStateWriter record the changes of the blocks, to be sent by EmitChanges
+// once they are committed to the database. nil disables the recording
+func (tds *TrieDbState) SetChangeStreamer(s *ChangeStreamer) {
+	tds.changeStreamer = s
+	tds.pendingChanges = nil
+}
+
+// SetBlockHashes labels the changes of the block being committed with the hashes of the block and of its parent,
+// by which the replicas follow the chain across the reorgs (see ReplicaApplier.Apply)
+func (tds *TrieDbState) SetBlockHashes(hash, parentHash common.Hash) {
+	tds.blockHash = hash
+	tds.parentHash = parentHash
+}
+
+// EmitChanges sends the changes of the blocks written since the previous call to the followers, and publishes
+// them to the state exporter (see SetStateExporter). It is meant to be called after the batch holding these blocks
+// has been committed. Only the failures of the streaming are returned, the ones of the exporter are logged
+func (tds *TrieDbState) EmitChanges() error {
+	tds.emitExports()
+	if tds.changeStreamer == nil {
+		return nil
+	}
+	pending := tds.pendingChanges
+	tds.pendingChanges = nil
+	for _, changes := range pending {
+		if err := tds.changeStreamer.Send(changes); err != nil {
+			return fmt.Errorf("streaming changes of block %d: %v", changes.BlockNr, err)
+		}
+	}
+	return nil
+}
+
+// blockChanges returns the changes of the current block, which are sent even if the block changes nothing,
+// so that the replicas see every block of the chain
+func (tds *TrieDbState) blockChanges() *BlockChanges {
+	blockNr := tds.getBlockNr()
+	n := len(tds.pendingChanges)
+	if n == 0 || tds.pendingChanges[n-1].BlockNr != blockNr || tds.pendingChanges[n-1].Revert {
+		tds.pendingChanges = append(tds.pendingChanges, &BlockChanges{BlockNr: blockNr, BlockHash: tds.blockHash, ParentHash: tds.parentHash})
+		n++
+	}
+	return tds.pendingChanges[n-1]
+}
+
+func (tds *TrieDbState) recordChange(c ReplicaChange) {
+	changes := tds.blockChanges()
+	changes.Changes = append(changes.Changes, c)
+}
+
+// revertRecorder returns the database recording the writes of the unwind from the head to the block blockNr
+// into the revert sent to the followers, or the database itself if the changes are not streamed.
+// The hashes of the blocks are taken from the canonical chain, which is not yet modified by the unwind
+func (tds *TrieDbState) revertRecorder(blockNr uint64) ethdb.Database {
+	if tds.changeStreamer == nil {
+		return tds.db
+	}
+	revert := &BlockChanges{
+		BlockNr:    blockNr,
+		BlockHash:  rawdb.ReadCanonicalHash(tds.db, blockNr),
+		ParentHash: rawdb.ReadCanonicalHash(tds.db, tds.blockNr),
+		Revert:     true,
+		FromBlock:  tds.blockNr,
+	}
+	tds.pendingChanges = append(tds.pendingChanges, revert)
+	return &changeRecorder{Database: tds.db, record: func(c ReplicaChange) {
+		revert.Changes = append(revert.Changes, c)
+	}}
+}
+
+// changeRecorder passes the writes of the DbStateWriter (or of the unwind) to the database,
+// and records them for the followers
+type changeRecorder struct {
+	ethdb.Database
+	record func(c ReplicaChange)
+}
+
+func (r *changeRecorder) Put(bucket, key, value []byte) error {
+	if err := r.Database.Put(bucket, key, value); err != nil {
+		return err
+	}
+	r.record(ReplicaChange{Bucket: bucket, Key: common.CopyBytes(key), Value: common.CopyBytes(value)})
+	return nil
+}
+
+func (r *changeRecorder) Delete(bucket, key []byte) error {
+	if err := r.Database.Delete(bucket, key); err != nil {
+		return err
+	}
+	r.record(ReplicaChange{Bucket: bucket, Key: common.CopyBytes(key), Deleted: true})
+	return nil
+}
+
+func (r *changeRecorder) PutS(hBucket, key, value []byte, timestamp uint64, noHistory bool) error {
+	if err := r.Database.PutS(hBucket, key, value, timestamp, noHistory); err != nil {
+		return err
+	}
+	r.record(ReplicaChange{Bucket: hBucket, Key: common.CopyBytes(key), Value: common.CopyBytes(value), NoHistory: noHistory})
+	return nil
+}
+
+// PutSBatch writes the history records of the block in one pass if the database supports it (see ethdb.PutSBatch),
+// and records each of them
+func (r *changeRecorder) PutSBatch(hBucket []byte, kvs []ethdb.KV, timestamp uint64, noHistory bool) error {
+	if err := ethdb.PutSBatch(r.Database, hBucket, kvs, timestamp, noHistory); err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		r.record(ReplicaChange{Bucket: hBucket, Key: common.CopyBytes(kv.K), Value: common.CopyBytes(kv.V), NoHistory: noHistory})
+	}
+	return nil
+}
+
+func (r *changeRecorder) DeleteTimestamp(timestamp uint64) error {
+	if err := r.Database.DeleteTimestamp(timestamp); err != nil {
+		return err
+	}
+	r.record(ReplicaChange{Key: dbutils.EncodeTimestamp(timestamp), DeletedBlock: true})
+	return nil
+}
+
+func isHistoryBucket(bucket []byte) bool {
+	return bytes.Equal(bucket, dbutils.AccountsHistoryBucket) || bytes.Equal(bucket, dbutils.StorageHistoryBucket)
+}
+
+// ReplicaApplier replays the changes streamed by the ChangeStreamer into the replica database,
+// without re-executing the blocks
+type ReplicaApplier struct {
+	db ethdb.Database
+}
+
+func NewReplicaApplier(db ethdb.Database) *ReplicaApplier {
+	return &ReplicaApplier{db: db}
+}
+
+// LastBlock returns the number of the last block applied to the replica, and false if there is none
+func (a *ReplicaApplier) LastBlock() (uint64, bool) {
+	blockNr, _, ok := a.Head()
+	return blockNr, ok
+}
+
+// Head returns the number and the hash of the last block applied to the replica, and false if there is none
+func (a *ReplicaApplier) Head() (uint64, common.Hash, bool) {
+	v, err := a.db.Get(dbutils.ReplicaProgressKey, dbutils.ReplicaProgressKey)
+	if err != nil || (len(v) != 8 && len(v) != 8+common.HashLength) {
+		return 0, common.Hash{}, false
+	}
+	return binary.BigEndian.Uint64(v), common.BytesToHash(v[8:]), true
+}
+
+// Apply writes the changes of one block (or the revert of the blocks) into the replica, atomically.
+// The changes are applied only on top of the block they were made on: the blocks at or below the head of
+// the replica, and the reverts of other heads, are skipped, so that the follower can be restarted from
+// an earlier point of the stream. Changes that do not follow the head of the replica are an error
+func (a *ReplicaApplier) Apply(changes *BlockChanges) error {
+	head, hash, ok := a.Head()
+	if changes.Revert {
+		if !ok || head > changes.FromBlock || (head == changes.FromBlock && hash != changes.ParentHash) {
+			return nil
+		}
+		if head < changes.FromBlock {
+			return fmt.Errorf("revert of block %d, replica is at block %d", changes.FromBlock, head)
+		}
+	} else if ok {
+		if changes.BlockNr <= head {
+			return nil
+		}
+		if changes.BlockNr != head+1 || changes.ParentHash != hash {
+			return fmt.Errorf("block %d with parent %x does not follow the head %d %x of the replica", changes.BlockNr, changes.ParentHash, head, hash)
+		}
+	}
+	batch := a.db.NewBatch()
+	for _, c := range changes.Changes {
+		var err error
+		switch {
+		case c.DeletedBlock:
+			timestamp, _ := dbutils.DecodeTimestamp(c.Key)
+			err = batch.DeleteTimestamp(timestamp)
+		case c.Deleted:
+			err = batch.Delete(c.Bucket, c.Key)
+		case isHistoryBucket(c.Bucket):
+			value := c.Value
+			if value == nil {
+				value = []byte{}
+			}
+			err = batch.PutS(c.Bucket, c.Key, value, changes.BlockNr, c.NoHistory)
+		default:
+			err = batch.Put(c.Bucket, c.Key, c.Value)
+		}
+		if err != nil {
+			batch.Rollback()
+			return err
+		}
+	}
+	var progress [8 + common.HashLength]byte
+	binary.BigEndian.PutUint64(progress[:], changes.BlockNr)
+	copy(progress[8:], changes.BlockHash[:])
+	if err := batch.Put(dbutils.ReplicaProgressKey, dbutils.ReplicaProgressKey, progress[:]); err != nil {
+		batch.Rollback()
+		return err
+	}
+	_, err := batch.Commit()
+	return err
+}
+
+// Run applies the changes read from the stream until it ends or the context is cancelled
+func (a *ReplicaApplier) Run(ctx context.Context, r io.Reader) error {
+	stream := rlp.NewStream(r, 0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var changes BlockChanges
+		if err := stream.Decode(&changes); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := a.Apply(&changes); err != nil {
+			return fmt.Errorf("applying changes of block %d: %v", changes.BlockNr, err)
+		}
+		log.Debug("Replica updated", "block", changes.BlockNr, "revert", changes.Revert, "changes", len(changes.Changes))
+	}
+}
@@ -0,0 +1,176 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestReplicaStreaming(t *testing.T) {
+	for _, batching := range []bool{false, true} {
+		testReplicaStreaming(t, batching)
+	}
+}
+
+func testReplicaStreaming(t *testing.T, historyBatching bool) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	tds.SetChangeStreamer(NewChangeStreamer(&stream))
+	tds.SetHistoryBatching(historyBatching)
+
+	ctx := context.Background()
+	addr := common.HexToAddress("0x1234")
+	ibs := New(tds)
+	for blockNr := uint64(1); blockNr <= 3; blockNr++ {
+		ibs.AddBalance(addr, big.NewInt(100))
+		ibs.SetState(addr, common.Hash{1}, common.BigToHash(new(big.Int).SetUint64(blockNr)))
+		if blockNr == 2 {
+			ibs.SetCode(addr, []byte{0x60, 0x00})
+		}
+		tds.StartNewBuffer()
+		if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tds.ComputeTrieRoots(); err != nil {
+			t.Fatal(err)
+		}
+		tds.SetBlockNr(blockNr)
+		if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tds.EmitChanges(); err != nil {
+		t.Fatal(err)
+	}
+
+	replica := ethdb.NewMemDatabase()
+	applier := NewReplicaApplier(replica)
+	// The stream is replayed twice, the second time is a no-op
+	data := stream.Bytes()
+	for i := 0; i < 2; i++ {
+		if err = applier.Run(ctx, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last, ok := applier.LastBlock(); !ok || last != 3 {
+		t.Fatalf("expected the replica at block 3, got %d %t", last, ok)
+	}
+
+	for _, bucket := range [][]byte{dbutils.AccountsBucket, dbutils.StorageBucket, dbutils.CodeBucket} {
+		expected := make(map[string]string)
+		if err = db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			expected[string(k)] = string(v)
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(expected) == 0 {
+			t.Fatalf("bucket %s is empty", bucket)
+		}
+		if err = replica.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			if expected[string(k)] != string(v) {
+				t.Errorf("bucket %s, key %x: expected %x, got %x", bucket, k, expected[string(k)], v)
+			}
+			delete(expected, string(k))
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(expected) != 0 {
+			t.Errorf("bucket %s: %d keys missing in the replica", bucket, len(expected))
+		}
+	}
+
+	// The history is replicated as well
+	addrHash, err := tds.HashAddress(addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for blockNr := uint64(1); blockNr <= 3; blockNr++ {
+		expected, err1 := db.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, addrHash[:], blockNr)
+		got, err2 := replica.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, addrHash[:], blockNr)
+		if err1 != err2 || !bytes.Equal(expected, got) {
+			t.Errorf("history batching %t, as of block %d: expected %x (%v), got %x (%v)", historyBatching, blockNr, expected, err1, got, err2)
+		}
+	}
+}
+
+func TestReplicaReorg(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	tds.SetChangeStreamer(NewChangeStreamer(&stream))
+	addr := common.HexToAddress("0x1234")
+	// Blocks of the first branch are labelled 1, 2, 3, and the ones of the second branch 0x12, 0x13
+	block := func(blockNr uint64, hash, parentHash byte, value int64) {
+		tds.SetBlockHashes(common.Hash{hash}, common.Hash{parentHash})
+		commitTestBlock(t, tds, blockNr, func(ibs *IntraBlockState) {
+			ibs.AddBalance(addr, big.NewInt(value))
+			ibs.SetState(addr, common.Hash{byte(blockNr)}, common.Hash{31: byte(value)})
+		})
+		rawdb.WriteCanonicalHash(db, common.Hash{hash}, blockNr)
+	}
+	block(1, 1, 0, 1)
+	block(2, 2, 1, 2)
+	block(3, 3, 2, 3)
+	if err = tds.UnwindTo(1); err != nil {
+		t.Fatal(err)
+	}
+	block(2, 0x12, 1, 5)
+	block(3, 0x13, 0x12, 7)
+	if err = tds.EmitChanges(); err != nil {
+		t.Fatal(err)
+	}
+
+	replica := ethdb.NewMemDatabase()
+	applier := NewReplicaApplier(replica)
+	// The stream is replayed twice, the second time the reverted blocks and the revert itself are skipped
+	data := stream.Bytes()
+	for i := 0; i < 2; i++ {
+		if err = applier.Run(context.Background(), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if blockNr, hash, ok := applier.Head(); !ok || blockNr != 3 || hash != (common.Hash{0x13}) {
+		t.Fatalf("expected the replica at block 3 of the second branch, got %d %x %t", blockNr, hash, ok)
+	}
+	for _, bucket := range [][]byte{dbutils.AccountsBucket, dbutils.StorageBucket, dbutils.ChangeSetBucket} {
+		expected := make(map[string]string)
+		if err = db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			expected[string(k)] = string(v)
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err = replica.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			if e, ok := expected[string(k)]; !ok || e != string(v) {
+				t.Errorf("bucket %s, key %x: expected %x (%t), got %x", bucket, k, e, ok, v)
+			}
+			delete(expected, string(k))
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(expected) != 0 {
+			t.Errorf("bucket %s: %d keys missing in the replica", bucket, len(expected))
+		}
+	}
+
+	// Block that does not follow the head of the replica
+	if err = applier.Apply(&BlockChanges{BlockNr: 4, ParentHash: common.Hash{3}}); err == nil {
+		t.Errorf("expected the block on top of the reverted branch to fail")
+	}
+}
@@ -0,0 +1,118 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// ResurrectAccount brings back the account removed by ExpireAccounts, given the proof (in the format of
+// trie.MultiProof) of the account and of its storage items against one of the state roots preceding the
+// expiry (see ReadExpiryRoots). keyHashes are the hashes of the keys of the storage items covered by the proof.
+// The storage items have to be complete, as they are checked against the storage root of the account.
+// The account is put back into the state trie and into the flat state with the incarnation it had when it
+// expired, and the resurrection counts as its touch. It fails if the account is not expired, or exists again.
+// Like the expiry, the resurrection is not recorded in the history, and is to be invoked between the blocks
+func (tds *TrieDbState) ResurrectAccount(addrHash common.Hash, keyHashes []common.Hash, proof [][]byte) error {
+	tombstone, err := ReadExpiredAccount(tds.db, addrHash)
+	if err != nil {
+		return err
+	}
+	if tombstone == nil {
+		return fmt.Errorf("account %x is not expired", addrHash)
+	}
+	enc, err := tds.db.Get(dbutils.AccountsBucket, addrHash[:])
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return err
+	}
+	if len(enc) > 0 {
+		return fmt.Errorf("expired account %x exists again", addrHash)
+	}
+	roots, err := ReadExpiryRoots(tds.db, tombstone.BlockNr)
+	if err != nil {
+		return err
+	}
+
+	storageKeys := make([][]byte, len(keyHashes))
+	for i, keyHash := range keyHashes {
+		storageKeys[i] = dbutils.GenerateCompositeTrieKey(addrHash, keyHash)
+	}
+	var acc *accounts.Account
+	var values [][]byte
+	for _, root := range roots {
+		accs, vals, err := trie.VerifyMultiProof(root, [][]byte{addrHash[:]}, storageKeys, proof)
+		if err == nil && accs[0] != nil {
+			acc, values = accs[0], vals
+			break
+		}
+	}
+	if acc == nil {
+		return fmt.Errorf("proof of %x does not match the expiry roots of block %d", addrHash, tombstone.BlockNr)
+	}
+	storage := trie.New(common.Hash{})
+	for i, keyHash := range keyHashes {
+		if len(values[i]) > 0 {
+			storage.Update(keyHash[:], values[i], 0)
+		}
+	}
+	if storageRoot := storage.Hash(); storageRoot != acc.Root {
+		return fmt.Errorf("storage items of %x are incomplete: storage root %x, expected %x", addrHash, storageRoot, acc.Root)
+	}
+	acc.Initialised = true
+	acc.Incarnation = tombstone.Incarnation
+
+	tds.StartNewBuffer()
+	b := tds.currentBuffer
+	b.accountUpdates[addrHash] = acc.SelfCopy()
+	m := make(map[common.Hash][]byte)
+	for i, keyHash := range keyHashes {
+		if len(values[i]) > 0 {
+			m[keyHash] = values[i]
+		}
+	}
+	if len(m) > 0 {
+		b.storageUpdates[addrHash] = m
+	}
+	if _, err = tds.ResolveStateTrie(false); err != nil {
+		return err
+	}
+	tds.tMu.Lock()
+	_, err = tds.updateTrieRoots(context.Background(), true)
+	tds.view.reset()
+	tds.clearUpdates()
+	tds.resetCrossValidation()
+	tds.tMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for keyHash, v := range m {
+		compositeKey := dbutils.GenerateCompositeStorageKey(addrHash, acc.Incarnation, keyHash)
+		if err = updateStorageSize(tds.db, compositeKey, nil, v); err != nil {
+			return err
+		}
+		if err = tds.db.Put(dbutils.StorageBucket, compositeKey, common.CopyBytes(v)); err != nil {
+			return err
+		}
+	}
+	enc = make([]byte, acc.EncodingLengthForStorage())
+	acc.EncodeForStorage(enc)
+	if err = tds.db.Put(dbutils.AccountsBucket, common.CopyBytes(addrHash[:]), enc); err != nil {
+		return err
+	}
+	if err = tds.db.Delete(dbutils.ExpiredAccountsBucket, addrHash[:]); err != nil {
+		return err
+	}
+	if err = invalidateStateChecksum(tds.db); err != nil {
+		return err
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, tds.blockNr)
+	return tds.db.Put(dbutils.LastTouchBucket, common.CopyBytes(addrHash[:]), v)
+}
@@ -0,0 +1,92 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestResurrectAccount(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	ctx := context.Background()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, contract := common.HexToAddress("0xa"), common.HexToAddress("0xc")
+	addrHashC := crypto.Keccak256Hash(contract[:])
+	k1, k2 := common.Hash{1}, common.Hash{2}
+	keyHashes := []common.Hash{crypto.Keccak256Hash(k1[:]), crypto.Keccak256Hash(k2[:])}
+
+	ibs := New(tds)
+	tds.StartNewBuffer()
+	ibs.AddBalance(a, big.NewInt(10))
+	ibs.CreateAccount(contract, true)
+	ibs.AddBalance(contract, big.NewInt(7))
+	ibs.SetState(contract, k1, common.Hash{31: 1})
+	ibs.SetState(contract, k2, common.Hash{31: 2})
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = tds.CommitBlock(ctx, ibs, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	rootBefore := tds.LastRoot()
+
+	storageKeys := [][]byte{
+		dbutils.GenerateCompositeTrieKey(addrHashC, keyHashes[0]),
+		dbutils.GenerateCompositeTrieKey(addrHashC, keyHashes[1]),
+	}
+	proof, err := trie.MultiProof(tds.Trie(), [][]byte{addrHashC[:]}, storageKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tds.ResurrectAccount(addrHashC, keyHashes, proof); err == nil {
+		t.Errorf("expected error for the account that is not expired")
+	}
+	if _, err = tds.ExpireAccounts([]common.Hash{addrHashC}); err != nil {
+		t.Fatal(err)
+	}
+	if roots, err := ReadExpiryRoots(db, 1); err != nil || len(roots) != 1 || roots[0] != rootBefore {
+		t.Fatalf("expected the expiry root %x, got %x, %v", rootBefore, roots, err)
+	}
+
+	if err = tds.ResurrectAccount(addrHashC, keyHashes[:1], proof); err == nil {
+		t.Errorf("expected error for the incomplete storage")
+	}
+	if err = tds.ResurrectAccount(addrHashC, keyHashes, proof[1:]); err == nil {
+		t.Errorf("expected error for the proof not matching the expiry roots")
+	}
+	if err = tds.ResurrectAccount(addrHashC, keyHashes, proof); err != nil {
+		t.Fatal(err)
+	}
+	if root := tds.LastRoot(); root != rootBefore {
+		t.Errorf("expected the root %x before the expiry, got %x", rootBefore, root)
+	}
+	if expected, _ := flatStateRoot(db, false); expected != rootBefore {
+		t.Errorf("expected the root %x of the flat state, got %x", rootBefore, expected)
+	}
+	acc, err := tds.ReadAccountData(contract)
+	if err != nil || acc == nil || acc.Incarnation != FirstContractIncarnation || acc.Balance.Int64() != 7 {
+		t.Fatalf("unexpected resurrected account %+v, %v", acc, err)
+	}
+	if v, err := tds.ReadAccountStorage(contract, acc.Incarnation, &k2); err != nil || len(v) != 1 || v[0] != 2 {
+		t.Errorf("unexpected resurrected storage item %x, %v", v, err)
+	}
+	if tombstone, _ := ReadExpiredAccount(db, addrHashC); tombstone != nil {
+		t.Errorf("expected the tombstone to be removed, got %+v", tombstone)
+	}
+	if err = tds.ResurrectAccount(addrHashC, keyHashes, proof); err == nil {
+		t.Errorf("expected error for the resurrected account")
+	}
+}
@@ -0,0 +1,72 @@
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// RootIndexEntry is the record of the state root index, maintained by DbStateWriter.WriteRootIndex at every
+// commit. It allows serving historical proofs and building canonical hash tries without header lookups
+type RootIndexEntry struct {
+	BlockNr        uint64
+	Root           common.Hash
+	AccountChanges uint32 // Number of records in the accounts history for this block
+	StorageChanges uint32 // Number of records in the storage history for this block
+}
+
+const rootIndexValueLen = common.HashLength + 4 + 4
+
+func decodeRootIndexEntry(blockNr uint64, v []byte) (*RootIndexEntry, error) {
+	if len(v) != rootIndexValueLen {
+		return nil, fmt.Errorf("invalid root index record for block %d: length %d", blockNr, len(v))
+	}
+	return &RootIndexEntry{
+		BlockNr:        blockNr,
+		Root:           common.BytesToHash(v[:common.HashLength]),
+		AccountChanges: binary.BigEndian.Uint32(v[common.HashLength:]),
+		StorageChanges: binary.BigEndian.Uint32(v[common.HashLength+4:]),
+	}, nil
+}
+
+// WriteRootIndex records the current state root and the numbers of historical records written by this writer
+// in the state root index, under the current block number. It is meant to be called after CommitBlock
+func (dsw *DbStateWriter) WriteRootIndex() error {
+	root := dsw.tds.LastRoot()
+	v := make([]byte, rootIndexValueLen)
+	copy(v, root[:])
+	binary.BigEndian.PutUint32(v[common.HashLength:], dsw.accountChanges)
+	binary.BigEndian.PutUint32(v[common.HashLength+4:], dsw.storageChanges)
+	return dsw.db.Put(dbutils.StateRootIndexBucket, dbutils.EncodeTimestamp(dsw.tds.blockNr), v)
+}
+
+// ReadRootIndex returns the state root index record for the given block, or nil if there is none
+func ReadRootIndex(db ethdb.Getter, blockNr uint64) (*RootIndexEntry, error) {
+	v, err := db.Get(dbutils.StateRootIndexBucket, dbutils.EncodeTimestamp(blockNr))
+	if err == ethdb.ErrKeyNotFound || (err == nil && len(v) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeRootIndexEntry(blockNr, v)
+}
+
+// WalkRootIndex calls walker for the records of the state root index for blocks from..to (inclusive), in the
+// ascending order of block numbers. Blocks without records are skipped. If walker returns false, the walk stops
+func WalkRootIndex(db ethdb.Getter, from, to uint64, walker func(*RootIndexEntry) (bool, error)) error {
+	return db.Walk(dbutils.StateRootIndexBucket, dbutils.EncodeTimestamp(from), 0, func(k, v []byte) (bool, error) {
+		blockNr, _ := dbutils.DecodeTimestamp(k)
+		if blockNr > to {
+			return false, nil
+		}
+		entry, err := decodeRootIndexEntry(blockNr, v)
+		if err != nil {
+			return false, err
+		}
+		return walker(entry)
+	})
+}
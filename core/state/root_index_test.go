@@ -0,0 +1,51 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestRootIndex(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := make(map[uint64]common.Hash)
+	for blockNr := uint64(1); blockNr <= 3; blockNr++ {
+		addr := common.BigToAddress(new(big.Int).SetUint64(blockNr))
+		_, dbw := commitTestBlock(t, tds, blockNr, func(ibs *IntraBlockState) {
+			ibs.AddBalance(addr, big.NewInt(100))
+		})
+		if err = dbw.WriteRootIndex(); err != nil {
+			t.Fatal(err)
+		}
+		roots[blockNr] = tds.LastRoot()
+	}
+	entry, err := ReadRootIndex(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Root != roots[2] || entry.AccountChanges != 1 || entry.StorageChanges != 0 {
+		t.Errorf("unexpected root index entry for block 2: %+v", entry)
+	}
+	if entry, _ = ReadRootIndex(db, 4); entry != nil {
+		t.Errorf("did not expect root index entry for block 4: %+v", entry)
+	}
+	var walked []uint64
+	if err = WalkRootIndex(db, 2, 3, func(e *RootIndexEntry) (bool, error) {
+		if e.Root != roots[e.BlockNr] {
+			t.Errorf("unexpected root for block %d: %x", e.BlockNr, e.Root)
+		}
+		walked = append(walked, e.BlockNr)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 2 || walked[0] != 2 || walked[1] != 3 {
+		t.Errorf("unexpected blocks walked: %v", walked)
+	}
+}
@@ -0,0 +1,151 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// GetAccountAt returns the account as of the given block, or nil if it does not exist at that block.
+// The current state is read directly from the flat buckets, and the older states from the history.
+// If withProof is set, the account is read from the state trie instead, and the Merkle proof against the
+// state root of the block is returned alongside (in the format of trie.MultiProof)
+func GetAccountAt(db ethdb.Database, address common.Address, blockNr uint64, withProof bool) (*accounts.Account, [][]byte, error) {
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if withProof {
+		r, t, err := resolvingReaderAt(db, blockNr)
+		if err != nil {
+			return nil, nil, err
+		}
+		acc, err := r.GetAccount(addrHash[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		proof, err := trie.MultiProof(t, [][]byte{addrHash[:]}, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return acc, proof, nil
+	}
+	acc, err := readAccountAt(db, addrHash, blockNr)
+	return acc, nil, err
+}
+
+// GetStorageAt returns the value of the storage item as of the given block, nil if the item (or the account)
+// does not exist at that block. With withProof, the proof covers both the account and the storage item
+func GetStorageAt(db ethdb.Database, address common.Address, slot common.Hash, blockNr uint64, withProof bool) ([]byte, [][]byte, error) {
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	seckey, err := common.HashData(slot[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if withProof {
+		r, t, err := resolvingReaderAt(db, blockNr)
+		if err != nil {
+			return nil, nil, err
+		}
+		acc, err := r.GetAccount(addrHash[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		var value []byte
+		cKey := dbutils.GenerateCompositeTrieKey(addrHash, seckey)
+		if acc != nil {
+			if value, err = r.Get(cKey); err != nil {
+				return nil, nil, err
+			}
+		}
+		proof, err := trie.MultiProof(t, [][]byte{addrHash[:]}, [][]byte{cKey})
+		if err != nil {
+			return nil, nil, err
+		}
+		return value, proof, nil
+	}
+	acc, err := readAccountAt(db, addrHash, blockNr)
+	if err != nil || acc == nil {
+		return nil, nil, err
+	}
+	storageKey := dbutils.GenerateCompositeStorageKey(addrHash, acc.Incarnation, seckey)
+	var value []byte
+	if isCurrentBlock(db, blockNr) {
+		value, err = db.Get(dbutils.StorageBucket, storageKey)
+	} else {
+		value, err = db.GetAsOf(dbutils.StorageBucket, dbutils.StorageHistoryBucket, storageKey, blockNr+1)
+	}
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, nil, err
+	}
+	return value, nil, nil
+}
+
+// isCurrentBlock returns true if the flat buckets hold the state as of the given block, which is the case
+// for the head block and beyond, and also when the head is unknown
+func isCurrentBlock(db ethdb.Database, blockNr uint64) bool {
+	headHash := rawdb.ReadHeadBlockHash(db)
+	if headHash == (common.Hash{}) {
+		return true
+	}
+	head := rawdb.ReadHeaderNumber(db, headHash)
+	return head == nil || blockNr >= *head
+}
+
+func readAccountAt(db ethdb.Database, addrHash common.Hash, blockNr uint64) (*accounts.Account, error) {
+	var enc []byte
+	var err error
+	if isCurrentBlock(db, blockNr) {
+		enc, err = db.Get(dbutils.AccountsBucket, addrHash[:])
+	} else {
+		enc, err = db.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, addrHash[:], blockNr+1)
+	}
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+	if len(enc) == 0 {
+		return nil, nil
+	}
+	var acc accounts.Account
+	if err = acc.DecodeForStorage(enc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+// stateRootAt returns the state root of the given block, from the state root index (see WriteRootIndex),
+// or from the canonical header
+func stateRootAt(db ethdb.Database, blockNr uint64) (common.Hash, error) {
+	entry, err := ReadRootIndex(db, blockNr)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if entry != nil {
+		return entry.Root, nil
+	}
+	header := rawdb.ReadHeader(db, rawdb.ReadCanonicalHash(db, blockNr), blockNr)
+	if header == nil {
+		return common.Hash{}, fmt.Errorf("state root of block %d is not known", blockNr)
+	}
+	return header.Root, nil
+}
+
+// resolvingReaderAt creates the empty trie for the state as of the given block, and the reader that resolves it on demand
+func resolvingReaderAt(db ethdb.Database, blockNr uint64) (*trie.ResolvingReader, *trie.Trie, error) {
+	root, err := stateRootAt(db, blockNr)
+	if err != nil {
+		return nil, nil, err
+	}
+	t := trie.New(root)
+	r := trie.NewResolvingReader(t, db, blockNr)
+	r.SetHistorical(!isCurrentBlock(db, blockNr))
+	return r, t, nil
+}
@@ -0,0 +1,76 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/rawdb"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestGetAccountAndStorageAt(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := common.HexToAddress("0x1234")
+	slot := common.HexToHash("01")
+	for blockNr := uint64(1); blockNr <= 2; blockNr++ {
+		value := common.BigToHash(new(big.Int).SetUint64(blockNr))
+		_, dbw := commitTestBlock(t, tds, blockNr, func(ibs *IntraBlockState) {
+			ibs.AddBalance(addr, big.NewInt(100))
+			ibs.SetState(addr, slot, value)
+		})
+		if err = dbw.WriteRootIndex(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head := &types.Header{Number: big.NewInt(2)}
+	rawdb.WriteHeader(db, head)
+	rawdb.WriteHeadBlockHash(db, head.Hash())
+
+	for blockNr := uint64(1); blockNr <= 2; blockNr++ {
+		expectedBalance := big.NewInt(100 * int64(blockNr))
+		acc, _, err := GetAccountAt(db, addr, blockNr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acc == nil || acc.Balance.Cmp(expectedBalance) != 0 {
+			t.Errorf("block %d: unexpected account %+v", blockNr, acc)
+		}
+		value, _, err := GetStorageAt(db, addr, slot, blockNr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if common.BytesToHash(value) != common.BigToHash(new(big.Int).SetUint64(blockNr)) {
+			t.Errorf("block %d: unexpected storage value %x", blockNr, value)
+		}
+	}
+
+	// Proof for the current state
+	value, proof, err := GetStorageAt(db, addr, slot, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := ReadRootIndex(db, 2)
+	if err != nil || entry == nil {
+		t.Fatalf("missing root index entry: %v", err)
+	}
+	addrHash, _ := common.HashData(addr[:])
+	seckey, _ := common.HashData(slot[:])
+	accs, values, err := trie.VerifyMultiProof(entry.Root, [][]byte{addrHash[:]}, [][]byte{dbutils.GenerateCompositeTrieKey(addrHash, seckey)}, proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accs[0] == nil || accs[0].Balance.Cmp(big.NewInt(200)) != 0 {
+		t.Errorf("unexpected account in the proof: %+v", accs[0])
+	}
+	if string(values[0]) != string(value) {
+		t.Errorf("value in the proof %x does not match returned value %x", values[0], value)
+	}
+}
@@ -0,0 +1,83 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func newStateCacheKey(db ethdb.Database, root common.Hash, blockNr uint64) stateCacheKey {
+	// Empty trie can be created with the zero root, but its LastRoot is the empty root
+	if root == (common.Hash{}) {
+		root = trie.EmptyRoot
+	}
+	return stateCacheKey{db: db, root: root, blockNr: blockNr}
+}
+
+type stateCacheKey struct {
+	db      ethdb.Database
+	root    common.Hash
+	blockNr uint64
+}
+
+// StateCache keeps TrieDbState instances for reuse, keyed by the database, the state root and the block number.
+// It is owned by the caller, so that several chains (or reopened databases) in one process do not interfere
+type StateCache struct {
+	mu      sync.Mutex
+	entries map[stateCacheKey]*TrieDbState
+}
+
+func NewStateCache() *StateCache {
+	return &StateCache{entries: make(map[stateCacheKey]*TrieDbState)}
+}
+
+// Get returns the cached TrieDbState for the given database, root and block number, or nil.
+// Instances that have moved on to another root or block since they were put are dropped
+func (sc *StateCache) Get(db ethdb.Database, root common.Hash, blockNr uint64) *TrieDbState {
+	key := newStateCacheKey(db, root, blockNr)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	tds, ok := sc.entries[key]
+	if !ok {
+		return nil
+	}
+	if tds.getBlockNr() != key.blockNr || tds.LastRoot() != key.root {
+		delete(sc.entries, key)
+		return nil
+	}
+	return tds
+}
+
+// Put adds the TrieDbState to the cache, under its current root and block number
+func (sc *StateCache) Put(tds *TrieDbState) {
+	key := newStateCacheKey(tds.db, tds.LastRoot(), tds.getBlockNr())
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.entries[key] = tds
+}
+
+// GetOrCreate returns the cached TrieDbState, or creates and caches a new one
+func (sc *StateCache) GetOrCreate(root common.Hash, db ethdb.Database, blockNr uint64) (*TrieDbState, error) {
+	if tds := sc.Get(db, root, blockNr); tds != nil {
+		return tds, nil
+	}
+	tds, err := newTrieDbState(root, db, blockNr)
+	if err != nil {
+		return nil, err
+	}
+	sc.Put(tds)
+	return tds, nil
+}
+
+// Remove drops all the instances for the given database, for example, when it is closed
+func (sc *StateCache) Remove(db ethdb.Database) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for key := range sc.entries {
+		if key.db == db {
+			delete(sc.entries, key)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestStateCache(t *testing.T) {
+	db1 := ethdb.NewMemDatabase()
+	db2 := ethdb.NewMemDatabase()
+	sc := NewStateCache()
+
+	tds1, err := sc.GetOrCreate(common.Hash{}, db1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds2, err := sc.GetOrCreate(common.Hash{}, db2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tds1 == tds2 {
+		t.Errorf("expected different instances for different databases")
+	}
+	if tds := sc.Get(db1, common.Hash{}, 0); tds != tds1 {
+		t.Errorf("expected cached instance for the first database")
+	}
+	if tds := sc.Get(db1, common.Hash{}, 1); tds != nil {
+		t.Errorf("did not expect instance for another block")
+	}
+
+	// Instance that moved on to another block is not returned
+	tds1.SetBlockNr(1)
+	if tds := sc.Get(db1, common.Hash{}, 0); tds != nil {
+		t.Errorf("did not expect instance that moved to another block")
+	}
+	sc.Put(tds1)
+	if tds := sc.Get(db1, common.Hash{}, 1); tds != tds1 {
+		t.Errorf("expected instance put under the new block")
+	}
+
+	sc.Remove(db2)
+	if tds := sc.Get(db2, common.Hash{}, 0); tds != nil {
+		t.Errorf("did not expect instance for removed database")
+	}
+}
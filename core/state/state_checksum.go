@@ -0,0 +1,119 @@
+package state
+
+import (
+	"encoding/binary"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// SetStateChecksum enables maintaining the checksum of the flat state (see ReadStateChecksum) by
+// DbStateWriter.WriteStateChecksum at every commit, from the changes of the block
+func (tds *TrieDbState) SetStateChecksum(enabled bool) {
+	tds.stateChecksum = enabled
+}
+
+// xorEntry adds (or removes, which is the same) the entry of the flat state to the checksum
+func xorEntry(checksum *common.Hash, bucket, key, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	h := crypto.Keccak256Hash(bucket, key, value)
+	for i := range checksum {
+		checksum[i] ^= h[i]
+	}
+}
+
+// updateChecksum records the change of the flat entry from original to value (empty if the entry does not exist)
+func (dsw *DbStateWriter) updateChecksum(bucket, key, original, value []byte) {
+	if dsw.checksumDelta == nil {
+		return
+	}
+	xorEntry(dsw.checksumDelta, bucket, key, original)
+	xorEntry(dsw.checksumDelta, bucket, key, value)
+}
+
+// updateAccountChecksum records the change of the flat entry of the account, reading its current value
+func (dsw *DbStateWriter) updateAccountChecksum(addrHash common.Hash, value []byte) error {
+	if dsw.checksumDelta == nil {
+		return nil
+	}
+	original, err := dsw.db.Get(dbutils.AccountsBucket, addrHash[:])
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return err
+	}
+	dsw.updateChecksum(dbutils.AccountsBucket, addrHash[:], original, value)
+	return nil
+}
+
+// ComputeStateChecksum returns the checksum of the flat state: XOR of the Keccak hashes of the bucket, the key
+// and the value of every entry of the accounts bucket and of the storage bucket. It does not depend on the order
+// of the entries, and so it can be maintained from the changes (see SetStateChecksum). Two nodes with the same
+// flat state have the same checksum, which is much cheaper to compare than to compute the state roots.
+// It walks the whole state, so the database must not have pending mutations
+func ComputeStateChecksum(db ethdb.Getter) (common.Hash, error) {
+	var checksum common.Hash
+	for _, bucket := range [][]byte{dbutils.AccountsBucket, dbutils.StorageBucket} {
+		if err := db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			xorEntry(&checksum, bucket, k, v)
+			return true, nil
+		}); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	return checksum, nil
+}
+
+// ReadStateChecksum returns the checksum of the flat state (see ComputeStateChecksum) after the given block,
+// as maintained by the commits. ok is false if there is no valid checksum, which happens when it is not enabled,
+// or after the flat state is modified outside of the blocks (unwinding, truncation, expiry)
+func ReadStateChecksum(db ethdb.Getter) (blockNr uint64, checksum common.Hash, ok bool) {
+	enc, err := db.Get(dbutils.StateChecksumKey, dbutils.StateChecksumKey)
+	if err != nil || len(enc) != 8+common.HashLength {
+		return 0, common.Hash{}, false
+	}
+	return binary.BigEndian.Uint64(enc), common.BytesToHash(enc[8:]), true
+}
+
+func writeStateChecksum(db ethdb.Putter, blockNr uint64, checksum common.Hash) error {
+	var enc [8 + common.HashLength]byte
+	binary.BigEndian.PutUint64(enc[:], blockNr)
+	copy(enc[8:], checksum[:])
+	return db.Put(dbutils.StateChecksumKey, dbutils.StateChecksumKey, enc[:])
+}
+
+// InitStateChecksum computes the checksum of the flat state, which is the state after the given block, and records
+// it to be maintained from there by the commits (see SetStateChecksum)
+func InitStateChecksum(db ethdb.Database, blockNr uint64) (common.Hash, error) {
+	checksum, err := ComputeStateChecksum(db)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return checksum, writeStateChecksum(db, blockNr, checksum)
+}
+
+// invalidateStateChecksum removes the checksum of the flat state, when the flat state is modified outside of the blocks
+func invalidateStateChecksum(db ethdb.Deleter) error {
+	return db.Delete(dbutils.StateChecksumKey, dbutils.StateChecksumKey)
+}
+
+// WriteStateChecksum applies the changes of the flat state made by this writer to the checksum recorded after
+// the previous block, and records it under the current block (see SetStateChecksum). Without the checksum of
+// the previous block, nothing is recorded, and the checksum has to be initialised by InitStateChecksum.
+// It is meant to be called after CommitBlock
+func (dsw *DbStateWriter) WriteStateChecksum() error {
+	if dsw.checksumDelta == nil {
+		return nil
+	}
+	blockNr, checksum, ok := ReadStateChecksum(dsw.db)
+	if !ok || blockNr+1 != dsw.tds.blockNr {
+		return invalidateStateChecksum(dsw.db)
+	}
+	for i := range checksum {
+		checksum[i] ^= dsw.checksumDelta[i]
+	}
+	dsw.checksumDelta = new(common.Hash)
+	return writeStateChecksum(dsw.db, dsw.tds.blockNr, checksum)
+}
@@ -0,0 +1,63 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestStateChecksum(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetStateChecksum(true)
+	if _, err = InitStateChecksum(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	block := func(blockNr uint64, change func(ibs *IntraBlockState)) {
+		_, dsw := commitTestBlock(t, tds, blockNr, change)
+		if err := dsw.WriteStateChecksum(); err != nil {
+			t.Fatal(err)
+		}
+		checksumBlockNr, checksum, ok := ReadStateChecksum(db)
+		if !ok || checksumBlockNr != blockNr {
+			t.Fatalf("expected the checksum of block %d, got %d %t", blockNr, checksumBlockNr, ok)
+		}
+		if expected, _ := ComputeStateChecksum(db); checksum != expected {
+			t.Errorf("block %d: expected the checksum %x, got %x", blockNr, expected, checksum)
+		}
+	}
+	a, contract := common.HexToAddress("0xa"), common.HexToAddress("0xc")
+	block(1, func(ibs *IntraBlockState) {
+		ibs.AddBalance(a, big.NewInt(10))
+		ibs.CreateAccount(contract, true)
+		ibs.SetState(contract, common.Hash{1}, common.Hash{31: 1})
+		ibs.SetState(contract, common.Hash{2}, common.Hash{31: 2})
+	})
+	_, checksum1, _ := ReadStateChecksum(db)
+	block(2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(a, big.NewInt(5))
+		ibs.SetState(contract, common.Hash{1}, common.Hash{})
+		ibs.SetState(contract, common.Hash{2}, common.Hash{31: 3})
+	})
+	block(3, func(ibs *IntraBlockState) {
+		ibs.Suicide(contract)
+	})
+
+	if err = tds.UnwindTo(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := ReadStateChecksum(db); ok {
+		t.Errorf("expected the checksum to be invalidated by the unwind")
+	}
+	if checksum, err := InitStateChecksum(db, 1); err != nil || checksum != checksum1 {
+		t.Errorf("expected the checksum %x of block 1 after the unwind, got %x, %v", checksum1, checksum, err)
+	}
+	block(2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(a, big.NewInt(1))
+	})
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"sync"
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
@@ -49,6 +50,29 @@ func (s Storage) String() (str string) {
 	return
 }
 
+// Pools of state objects and storage maps, recycled when IntraBlockState is reset
+var (
+	stateObjectPool = sync.Pool{New: func() interface{} { return new(stateObject) }}
+	storagePool     = sync.Pool{New: func() interface{} { return make(Storage) }}
+)
+
+// maxPooledStorage limits the size of the maps returned to the pool, because maps never shrink
+const maxPooledStorage = 1024
+
+func newStorage() Storage {
+	return storagePool.Get().(Storage)
+}
+
+func releaseStorage(s Storage) {
+	if s == nil || len(s) > maxPooledStorage {
+		return
+	}
+	for key := range s {
+		delete(s, key)
+	}
+	storagePool.Put(s)
+}
+
 func (s Storage) Copy() Storage {
 	cpy := make(Storage)
 	for key, value := range s {
@@ -83,6 +107,7 @@ type stateObject struct {
 	originStorage      Storage // Storage cache of original entries to dedup rewrites
 	blockOriginStorage Storage
 	dirtyStorage       Storage // Storage entries that need to be flushed to disk
+	flushedStorage     Storage // Storage entries written out by FinalizeIncremental during the current transaction
 	fakeStorage        Storage // Fake storage which constructed by caller for debugging purpose.
 
 	// Cache flags.
@@ -92,6 +117,7 @@ type stateObject struct {
 	suicided  bool
 	deleted   bool // true if account was deleted during the lifetime of this object
 	created   bool // true if this object represents a newly created contract
+	recreated bool // true if the contract is created at the address self-destructed earlier in the same block
 }
 
 // empty returns whether the account is considered empty.
@@ -104,13 +130,12 @@ const HugeNumber = uint64(1 << 63)
 
 // newObject creates a state object.
 func newObject(db *IntraBlockState, address common.Address, data, original *accounts.Account) *stateObject {
-	var so = stateObject{
-		db:                 db,
-		address:            address,
-		originStorage:      make(Storage),
-		blockOriginStorage: make(Storage),
-		dirtyStorage:       make(Storage),
-	}
+	so := stateObjectPool.Get().(*stateObject)
+	so.db = db
+	so.address = address
+	so.originStorage = newStorage()
+	so.blockOriginStorage = newStorage()
+	so.dirtyStorage = newStorage()
 	so.data.Copy(data)
 	if !so.data.Initialised {
 		so.data.Balance.SetUint64(0)
@@ -124,7 +149,18 @@ func newObject(db *IntraBlockState, address common.Address, data, original *acco
 	}
 	so.original.Copy(original)
 
-	return &so
+	return so
+}
+
+// release returns the object and its storage maps to the pools.
+// The object must not be used afterwards
+func (so *stateObject) release() {
+	releaseStorage(so.originStorage)
+	releaseStorage(so.blockOriginStorage)
+	releaseStorage(so.dirtyStorage)
+	releaseStorage(so.flushedStorage)
+	*so = stateObject{}
+	stateObjectPool.Put(so)
 }
 
 // EncodeRLP implements rlp.Encoder.
@@ -160,6 +196,9 @@ func (so *stateObject) GetState(key common.Hash) common.Hash {
 	if dirty {
 		return value
 	}
+	if value, flushed := so.flushedStorage[key]; flushed {
+		return value
+	}
 	// Otherwise return the entry's original value
 	return so.GetCommittedState(key)
 }
@@ -191,6 +230,31 @@ func (so *stateObject) GetCommittedState(key common.Hash) common.Hash {
 	return value
 }
 
+// GetOriginalState retrieves a value of the storage item as it was at the beginning of the block.
+// For contracts created within the block, the original storage is empty.
+func (so *stateObject) GetOriginalState(key common.Hash) common.Hash {
+	if value, cached := so.blockOriginStorage[key]; cached {
+		return value
+	}
+	if so.created {
+		return common.Hash{}
+	}
+	enc, err := so.db.stateReader.ReadAccountStorage(so.address, so.data.GetIncarnation(), &key)
+	if err != nil {
+		so.setError(err)
+		return common.Hash{}
+	}
+	var value common.Hash
+	if enc != nil {
+		value.SetBytes(enc)
+	}
+	so.blockOriginStorage[key] = value
+	if _, cached := so.originStorage[key]; !cached {
+		so.originStorage[key] = value
+	}
+	return value
+}
+
 // SetState updates a value in account storage.
 func (so *stateObject) SetState(key, value common.Hash) {
 	// If the new value is the same as old, don't set
@@ -242,6 +306,37 @@ func (so *stateObject) updateTrie(ctx context.Context, stateWriter StateWriter)
 			return err
 		}
 	}
+	// Items written out earlier in this transaction are now committed too
+	for key, value := range so.flushedStorage {
+		if _, ok := so.dirtyStorage[key]; !ok {
+			so.originStorage[key] = value
+		}
+	}
+	so.flushedStorage = nil
+	return nil
+}
+
+// flushStorage writes out the dirty storage items in the middle of a transaction.
+// Unlike updateTrie, it does not change the committed values (originStorage), because
+// they are still needed for gas metering until the end of the transaction
+func (so *stateObject) flushStorage(ctx context.Context, stateWriter StateWriter) error {
+	if len(so.dirtyStorage) == 0 {
+		return nil
+	}
+	if so.flushedStorage == nil {
+		so.flushedStorage = make(Storage)
+	}
+	for key, value := range so.dirtyStorage {
+		key := key
+		value := value
+
+		original := so.blockOriginStorage[key]
+		if err := stateWriter.WriteAccountStorage(ctx, so.address, so.data.GetIncarnation(), &key, &original, &value); err != nil {
+			return err
+		}
+		so.flushedStorage[key] = value
+	}
+	so.dirtyStorage = make(Storage)
 	return nil
 }
 
@@ -257,7 +352,12 @@ func (so *stateObject) AddBalance(amount *big.Int) {
 
 		return
 	}
-	so.SetBalance(new(big.Int).Add(so.Balance(), amount))
+	so.db.journal.append(balanceDeltaChange{
+		account: &so.address,
+		delta:   new(big.Int).Set(amount),
+	})
+	so.data.Balance.Add(&so.data.Balance, amount)
+	so.data.Initialised = true
 }
 
 // SubBalance removes amount from so's balance.
@@ -266,7 +366,12 @@ func (so *stateObject) SubBalance(amount *big.Int) {
 	if amount.Sign() == 0 {
 		return
 	}
-	so.SetBalance(new(big.Int).Sub(so.Balance(), amount))
+	so.db.journal.append(balanceDeltaChange{
+		account: &so.address,
+		delta:   new(big.Int).Neg(amount),
+	})
+	so.data.Balance.Sub(&so.data.Balance, amount)
+	so.data.Initialised = true
 }
 
 func (so *stateObject) SetBalance(amount *big.Int) {
@@ -293,6 +398,9 @@ func (so *stateObject) deepCopy(db *IntraBlockState) *stateObject {
 	stateObject := newObject(db, so.address, &so.data, &so.original)
 	stateObject.code = so.code
 	stateObject.dirtyStorage = so.dirtyStorage.Copy()
+	if so.flushedStorage != nil {
+		stateObject.flushedStorage = so.flushedStorage.Copy()
+	}
 	stateObject.originStorage = so.originStorage.Copy()
 	stateObject.blockOriginStorage = so.blockOriginStorage.Copy()
 	stateObject.suicided = so.suicided
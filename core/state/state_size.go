@@ -0,0 +1,132 @@
+package state
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+const stateSizeValueLen = 16
+
+// ContractSize is the size of the storage of a contract in the StorageBucket
+type ContractSize struct {
+	AddrHash common.Hash
+	Slots    uint64 // Number of the storage items
+	Bytes    uint64 // Total size of the keys and the values of the storage items
+}
+
+// updateStateSize adds the differences to the counters of the storage with the given prefix (addrHash+incarnation)
+func updateStateSize(db ethdb.Database, prefix []byte, slots, bytes int64) error {
+	if slots == 0 && bytes == 0 {
+		return nil
+	}
+	var v [stateSizeValueLen]byte
+	enc, err := db.Get(dbutils.StateSizeBucket, prefix)
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return err
+	}
+	if len(enc) == stateSizeValueLen {
+		copy(v[:], enc)
+	}
+	s := int64(binary.BigEndian.Uint64(v[:])) + slots
+	b := int64(binary.BigEndian.Uint64(v[8:])) + bytes
+	if s <= 0 {
+		return db.Delete(dbutils.StateSizeBucket, prefix)
+	}
+	if b < 0 {
+		b = 0
+	}
+	binary.BigEndian.PutUint64(v[:], uint64(s))
+	binary.BigEndian.PutUint64(v[8:], uint64(b))
+	return db.Put(dbutils.StateSizeBucket, common.CopyBytes(prefix), v[:])
+}
+
+// updateStorageSize accounts for the storage item under compositeKey changing from the original to the new value
+// (empty for the missing item)
+func updateStorageSize(db ethdb.Database, compositeKey []byte, original, value []byte) error {
+	var slots, bytes int64
+	switch {
+	case len(original) == 0 && len(value) > 0:
+		slots, bytes = 1, int64(len(compositeKey)+len(value))
+	case len(original) > 0 && len(value) == 0:
+		slots, bytes = -1, -int64(len(compositeKey)+len(original))
+	default:
+		bytes = int64(len(value) - len(original))
+	}
+	return updateStateSize(db, compositeKey[:common.HashLength+common.IncarnationLength], slots, bytes)
+}
+
+// ReadContractSize returns the size of the storage of the contract, including the storage of its previous
+// incarnations, which remains in the database
+func ReadContractSize(db ethdb.Getter, addrHash common.Hash) (ContractSize, error) {
+	cs := ContractSize{AddrHash: addrHash}
+	err := db.Walk(dbutils.StateSizeBucket, addrHash[:], 8*common.HashLength, func(k, v []byte) (bool, error) {
+		if len(v) != stateSizeValueLen {
+			return false, fmt.Errorf("invalid state size record for %x: length %d", k, len(v))
+		}
+		cs.Slots += binary.BigEndian.Uint64(v)
+		cs.Bytes += binary.BigEndian.Uint64(v[8:])
+		return true, nil
+	})
+	return cs, err
+}
+
+// TopContractsBySize returns up to n contracts with the largest storage (in bytes, as counted by ReadContractSize),
+// in the descending order of sizes
+func TopContractsBySize(db ethdb.Getter, n int) ([]ContractSize, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	h := &contractSizeHeap{}
+	var current ContractSize
+	flush := func() {
+		if current.Slots == 0 {
+			return
+		}
+		if h.Len() < n {
+			heap.Push(h, current)
+		} else if (*h)[0].Bytes < current.Bytes {
+			(*h)[0] = current
+			heap.Fix(h, 0)
+		}
+	}
+	if err := db.Walk(dbutils.StateSizeBucket, nil, 0, func(k, v []byte) (bool, error) {
+		if len(k) < common.HashLength || len(v) != stateSizeValueLen {
+			return false, fmt.Errorf("invalid state size record for %x: length %d", k, len(v))
+		}
+		// Records of all the incarnations of a contract are adjacent
+		if addrHash := common.BytesToHash(k[:common.HashLength]); addrHash != current.AddrHash {
+			flush()
+			current = ContractSize{AddrHash: addrHash}
+		}
+		current.Slots += binary.BigEndian.Uint64(v)
+		current.Bytes += binary.BigEndian.Uint64(v[8:])
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	flush()
+	top := make([]ContractSize, h.Len())
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(h).(ContractSize)
+	}
+	return top, nil
+}
+
+// contractSizeHeap is the min-heap of contract sizes by bytes
+type contractSizeHeap []ContractSize
+
+func (h contractSizeHeap) Len() int            { return len(h) }
+func (h contractSizeHeap) Less(i, j int) bool  { return h[i].Bytes < h[j].Bytes }
+func (h contractSizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *contractSizeHeap) Push(x interface{}) { *h = append(*h, x.(ContractSize)) }
+func (h *contractSizeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
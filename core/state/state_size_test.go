@@ -0,0 +1,57 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestTopContractsBySize(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, small := common.HexToAddress("0xb"), common.HexToAddress("0x5")
+	largeHash, smallHash := crypto.Keccak256Hash(large[:]), crypto.Keccak256Hash(small[:])
+	commitTestBlock(t, tds, 1, func(ibs *IntraBlockState) {
+		ibs.CreateAccount(large, true)
+		for i := 1; i <= 3; i++ {
+			ibs.SetState(large, common.Hash{byte(i)}, common.Hash{30: 1, 31: byte(i)})
+		}
+		ibs.CreateAccount(small, true)
+		ibs.SetState(small, common.Hash{1}, common.Hash{31: 1})
+	})
+	// Composite key (32+8+32 bytes) and the value without leading zeros
+	top, err := TopContractsBySize(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 1 || top[0] != (ContractSize{AddrHash: largeHash, Slots: 3, Bytes: 3 * (72 + 2)}) {
+		t.Fatalf("unexpected top contracts: %+v", top)
+	}
+	top, err = TopContractsBySize(db, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].AddrHash != largeHash || top[1] != (ContractSize{AddrHash: smallHash, Slots: 1, Bytes: 72 + 1}) {
+		t.Fatalf("unexpected top contracts: %+v", top)
+	}
+
+	commitTestBlock(t, tds, 2, func(ibs *IntraBlockState) {
+		ibs.SetState(large, common.Hash{1}, common.Hash{})
+		ibs.SetState(large, common.Hash{2}, common.Hash{31: 2})
+	})
+	if cs, err := ReadContractSize(db, largeHash); err != nil || cs.Slots != 2 || cs.Bytes != 72+2+72+1 {
+		t.Errorf("unexpected size after the update: %+v, %v", cs, err)
+	}
+
+	if err = tds.UnwindTo(1); err != nil {
+		t.Fatal(err)
+	}
+	if cs, err := ReadContractSize(db, largeHash); err != nil || cs.Slots != 3 || cs.Bytes != 3*(72+2) {
+		t.Errorf("unexpected size after the unwind: %+v, %v", cs, err)
+	}
+}
@@ -0,0 +1,167 @@
+// Package statebench generates synthetic state with the distributions resembling the mainnet
+// (share of contracts, skew of the storage sizes, sizes of the contract codes), and applies
+// synthetic blocks to it. It is used by the benchmarks of the resolution, update, pruning and
+// witness paths of TrieDbState, so that performance changes can be evaluated reproducibly.
+package statebench
+
+import (
+	"context"
+	"math/big"
+	"math/rand"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// Shape describes the distributions of the generated state
+type Shape struct {
+	Accounts      int     // Total number of accounts, including contracts
+	ContractShare float64 // Fraction of the accounts that are contracts
+	StorageSkew   float64 // Parameter s (> 1) of the Zipf distribution of the number of storage items per contract
+	MaxStorage    uint64  // Maximum number of storage items of one contract
+	AvgCodeSize   int     // Mean of the (exponential) distribution of the code sizes
+	MaxCodeSize   int     // Maximum code size
+	CodeReuse     float64 // Fraction of the contracts that reuse the code of another contract
+	Seed          int64
+}
+
+// MainnetShape returns the shape with the proportions observed on the mainnet, scaled down to the given number of accounts
+func MainnetShape(accounts int) Shape {
+	return Shape{
+		Accounts:      accounts,
+		ContractShare: 0.12,
+		StorageSkew:   1.3,
+		MaxStorage:    uint64(accounts) / 4,
+		AvgCodeSize:   4 * 1024,
+		MaxCodeSize:   24 * 1024,
+		CodeReuse:     0.6,
+		Seed:          1,
+	}
+}
+
+// State is the generated state, persisted in the database at block 1
+type State struct {
+	DB          ethdb.Database
+	Root        common.Hash
+	BlockNr     uint64
+	Accounts    []common.Address // Externally owned accounts
+	Contracts   []common.Address
+	StorageKeys map[common.Address][]common.Hash
+}
+
+// Generate creates the state of the given shape in a new in-memory database
+func Generate(shape Shape) (*State, error) {
+	rng := rand.New(rand.NewSource(shape.Seed))
+	db := ethdb.NewMemDatabase()
+	tds, err := state.NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		return nil, err
+	}
+	tds.SetNoHistory(true)
+	ibs := state.New(tds)
+	s := &State{DB: db, StorageKeys: make(map[common.Address][]common.Hash)}
+
+	var zipf *rand.Zipf
+	if shape.MaxStorage > 0 {
+		zipf = rand.NewZipf(rng, shape.StorageSkew, 1, shape.MaxStorage)
+	}
+	var codes [][]byte
+	for i := 0; i < shape.Accounts; i++ {
+		var addr common.Address
+		rng.Read(addr[:])
+		if rng.Float64() >= shape.ContractShare {
+			ibs.AddBalance(addr, new(big.Int).SetUint64(rng.Uint64()))
+			s.Accounts = append(s.Accounts, addr)
+			continue
+		}
+		ibs.CreateAccount(addr, true)
+		ibs.SetNonce(addr, 1)
+		var code []byte
+		if len(codes) > 0 && rng.Float64() < shape.CodeReuse {
+			code = codes[rng.Intn(len(codes))]
+		} else {
+			size := int(rng.ExpFloat64()*float64(shape.AvgCodeSize)) + 1
+			if size > shape.MaxCodeSize {
+				size = shape.MaxCodeSize
+			}
+			code = make([]byte, size)
+			rng.Read(code)
+			codes = append(codes, code)
+		}
+		ibs.SetCode(addr, code)
+		if zipf != nil {
+			n := zipf.Uint64()
+			keys := make([]common.Hash, n)
+			for j := range keys {
+				rng.Read(keys[j][:])
+				var value common.Hash
+				rng.Read(value[:])
+				ibs.SetState(addr, keys[j], value)
+			}
+			s.StorageKeys[addr] = keys
+		}
+		s.Contracts = append(s.Contracts, addr)
+	}
+
+	ctx := context.Background()
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		return nil, err
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		return nil, err
+	}
+	tds.SetBlockNr(1)
+	if err = ibs.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		return nil, err
+	}
+	s.Root = tds.LastRoot()
+	s.BlockNr = 1
+	return s, nil
+}
+
+// NewTrieDbState opens the generated state with the empty trie cache, so that everything needs to be resolved from the database
+func (s *State) NewTrieDbState() (*state.TrieDbState, error) {
+	tds, err := state.NewTrieDbState(s.Root, s.DB, s.BlockNr)
+	if err != nil {
+		return nil, err
+	}
+	tds.SetNoHistory(true)
+	return tds, nil
+}
+
+// ApplyBlock applies the synthetic block to the IntraBlockState: transfers between randomly chosen
+// accounts, and writes to the storage items of randomly chosen contracts (both existing and new items)
+func (s *State) ApplyBlock(ctx context.Context, ibs *state.IntraBlockState, tds *state.TrieDbState, rng *rand.Rand, transfers, storageWrites int) error {
+	for i := 0; i < transfers; i++ {
+		tds.StartNewBuffer()
+		from := s.Accounts[rng.Intn(len(s.Accounts))]
+		to := s.Accounts[rng.Intn(len(s.Accounts))]
+		amount := big.NewInt(rng.Int63n(1000) + 1)
+		if ibs.GetBalance(from).Cmp(amount) >= 0 {
+			ibs.SubBalance(from, amount)
+			ibs.AddBalance(to, amount)
+		}
+		ibs.SetNonce(from, ibs.GetNonce(from)+1)
+		if err := ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < storageWrites && len(s.Contracts) > 0; i++ {
+		tds.StartNewBuffer()
+		addr := s.Contracts[rng.Intn(len(s.Contracts))]
+		var key, value common.Hash
+		if keys := s.StorageKeys[addr]; len(keys) > 0 && rng.Intn(2) == 0 {
+			key = keys[rng.Intn(len(keys))]
+		} else {
+			rng.Read(key[:])
+		}
+		rng.Read(value[:])
+		ibs.SetState(addr, key, value)
+		if err := ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
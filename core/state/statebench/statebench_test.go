@@ -0,0 +1,110 @@
+package statebench
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/core/state"
+)
+
+const (
+	benchAccounts      = 20000
+	benchTransfers     = 200
+	benchStorageWrites = 400
+)
+
+var (
+	benchState     *State
+	benchStateErr  error
+	benchStateOnce sync.Once
+)
+
+func generated(b *testing.B) *State {
+	benchStateOnce.Do(func() {
+		benchState, benchStateErr = Generate(MainnetShape(benchAccounts))
+	})
+	if benchStateErr != nil {
+		b.Fatal(benchStateErr)
+	}
+	return benchState
+}
+
+// prepareBlock opens the generated state with the cold trie cache and applies a synthetic block to it
+func prepareBlock(b *testing.B, s *State, rng *rand.Rand, resolveReads bool) *state.TrieDbState {
+	tds, err := s.NewTrieDbState()
+	if err != nil {
+		b.Fatal(err)
+	}
+	tds.SetResolveReads(resolveReads)
+	ibs := state.New(tds)
+	if err = s.ApplyBlock(context.Background(), ibs, tds, rng, benchTransfers, benchStorageWrites); err != nil {
+		b.Fatal(err)
+	}
+	return tds
+}
+
+func BenchmarkResolve(b *testing.B) {
+	s := generated(b)
+	rng := rand.New(rand.NewSource(2))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tds := prepareBlock(b, s, rng, false)
+		b.StartTimer()
+		if _, err := tds.ResolveStateTrie(false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUpdate(b *testing.B) {
+	s := generated(b)
+	rng := rand.New(rand.NewSource(3))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tds := prepareBlock(b, s, rng, false)
+		if _, err := tds.ResolveStateTrie(false); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if _, err := tds.UpdateStateTrie(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPrune(b *testing.B) {
+	s := generated(b)
+	rng := rand.New(rand.NewSource(4))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tds := prepareBlock(b, s, rng, false)
+		if _, err := tds.ComputeTrieRoots(); err != nil {
+			b.Fatal(err)
+		}
+		tds.SetCacheGenLimit(1000)
+		b.StartTimer()
+		tds.PruneTries(false)
+	}
+}
+
+func BenchmarkWitness(b *testing.B) {
+	s := generated(b)
+	rng := rand.New(rand.NewSource(5))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tds := prepareBlock(b, s, rng, true)
+		if _, err := tds.ResolveStateTrie(true); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if _, err := tds.ExtractWitness(false, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -150,7 +150,10 @@ func (s *Stateless) UpdateAccountData(_ context.Context, address common.Address,
 	if s.trace {
 		fmt.Printf("UpdateAccountData for address %x, addrHash %x\n", address, addrHash)
 	}
-	s.accountUpdates[addrHash] = account
+	// The account of the state object is copied, because the state objects are recycled (see IntraBlockState.Reset)
+	acc := new(accounts.Account)
+	acc.Copy(account)
+	s.accountUpdates[addrHash] = acc
 	return nil
 }
 
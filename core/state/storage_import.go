@@ -0,0 +1,124 @@
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// ImportContractStorage seeds the storage of the contract at the given address with the storage exported
+// by trie.ExportSubtree (for example, of the same contract on the mainnet, to fork it on a devnet).
+// The storage items are checked against the expected storage root, and the storage root against the proof
+// of the export, before anything is written. The existing account keeps its balance, nonce and code, but gets
+// the next incarnation, so that its previous storage is discarded, and the account that does not exist is created.
+// Like the resurrection, the import is not recorded in the history, and is to be invoked between the blocks
+func (tds *TrieDbState) ImportContractStorage(address common.Address, r io.Reader, expectedRoot common.Hash) error {
+	er, err := trie.NewSubtreeExportReader(r)
+	if err != nil {
+		return err
+	}
+	if er.StorageRoot != expectedRoot {
+		return fmt.Errorf("export has storage root %x, expected %x", er.StorageRoot, expectedRoot)
+	}
+	if _, err = er.VerifyProof(); err != nil {
+		return err
+	}
+	var keyHashes, values [][]byte
+	for {
+		keyHash, value, err := er.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		keyHashes = append(keyHashes, common.CopyBytes(keyHash[:]))
+		values = append(values, value)
+	}
+	storageRoot, err := trie.RootOfSorted(keyHashes, values, false)
+	if err != nil {
+		return err
+	}
+	if storageRoot != expectedRoot {
+		return fmt.Errorf("imported storage has root %x, expected %x", storageRoot, expectedRoot)
+	}
+
+	addrHash, err := tds.HashAddress(address, true /*save*/)
+	if err != nil {
+		return err
+	}
+	acc := accounts.NewAccount()
+	enc, err := tds.db.Get(dbutils.AccountsBucket, addrHash[:])
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return err
+	}
+	if len(enc) > 0 {
+		if err = acc.DecodeForStorage(enc); err != nil {
+			return err
+		}
+	}
+	if acc.Incarnation >= FirstContractIncarnation {
+		acc.Incarnation++
+	} else {
+		acc.Incarnation = FirstContractIncarnation
+	}
+	acc.Initialised = true
+
+	tds.StartNewBuffer()
+	b := tds.currentBuffer
+	b.created[addrHash] = struct{}{}
+	b.accountUpdates[addrHash] = &acc
+	m := make(map[common.Hash][]byte, len(keyHashes))
+	for i, keyHash := range keyHashes {
+		m[common.BytesToHash(keyHash)] = values[i]
+	}
+	if len(m) > 0 {
+		b.storageUpdates[addrHash] = m
+	}
+	if _, err = tds.ResolveStateTrie(false); err != nil {
+		return err
+	}
+	tds.tMu.Lock()
+	_, err = tds.updateTrieRoots(context.Background(), true)
+	tds.view.reset()
+	tds.clearUpdates()
+	tds.resetCrossValidation()
+	tds.tMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for i, keyHash := range keyHashes {
+		compositeKey := dbutils.GenerateCompositeStorageKey(addrHash, acc.Incarnation, common.BytesToHash(keyHash))
+		if err = updateStorageSize(tds.db, compositeKey, nil, values[i]); err != nil {
+			return err
+		}
+		if err = tds.db.Put(dbutils.StorageBucket, compositeKey, values[i]); err != nil {
+			return err
+		}
+	}
+	if debug.IsThinHistory() && !acc.IsEmptyCodeHash() {
+		if err = tds.db.Put(dbutils.ContractCodeBucket, dbutils.GenerateStoragePrefix(addrHash, acc.Incarnation), acc.CodeHash.Bytes()); err != nil {
+			return err
+		}
+	}
+	enc = make([]byte, acc.EncodingLengthForStorage())
+	acc.EncodeForStorage(enc)
+	if err = tds.db.Put(dbutils.AccountsBucket, common.CopyBytes(addrHash[:]), enc); err != nil {
+		return err
+	}
+	if err = invalidateStateChecksum(tds.db); err != nil {
+		return err
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, tds.blockNr)
+	return tds.db.Put(dbutils.LastTouchBucket, common.CopyBytes(addrHash[:]), v)
+}
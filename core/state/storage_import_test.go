@@ -0,0 +1,102 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestImportContractStorage(t *testing.T) {
+	ctx := context.Background()
+	contract := common.HexToAddress("0xc")
+	addrHash := crypto.Keccak256Hash(contract[:])
+	k1, k2, k3 := common.Hash{1}, common.Hash{2}, common.Hash{3}
+
+	// Contract on the source chain
+	srcDb := ethdb.NewMemDatabase()
+	src, err := NewTrieDbState(common.Hash{}, srcDb, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ibs := New(src)
+	src.StartNewBuffer()
+	ibs.AddBalance(common.HexToAddress("0xa"), big.NewInt(10))
+	ibs.CreateAccount(contract, true)
+	ibs.SetState(contract, k1, common.Hash{31: 1})
+	ibs.SetState(contract, k2, common.Hash{31: 2})
+	if err = ibs.FinalizeTx(ctx, src.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = src.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	src.SetBlockNr(1)
+	if err = src.CommitBlock(ctx, ibs, src.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	acc, err := src.ReadAccountData(contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageRoot := acc.Root
+	var export bytes.Buffer
+	if err = trie.ExportSubtree(srcDb, addrHash, acc.Incarnation, &export); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same address on the devnet, with its own balance and storage
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ibs = New(tds)
+	tds.StartNewBuffer()
+	ibs.CreateAccount(contract, true)
+	ibs.AddBalance(contract, big.NewInt(5))
+	ibs.SetState(contract, k3, common.Hash{31: 3})
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err = tds.CommitBlock(ctx, ibs, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	rootBefore := tds.LastRoot()
+
+	if err = tds.ImportContractStorage(contract, bytes.NewReader(export.Bytes()), common.Hash{1}); err == nil {
+		t.Errorf("expected error for the unexpected storage root")
+	}
+	if root := tds.LastRoot(); root != rootBefore {
+		t.Errorf("expected the root %x to be unchanged by the failed import, got %x", rootBefore, root)
+	}
+	if err = tds.ImportContractStorage(contract, bytes.NewReader(export.Bytes()), storageRoot); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := tds.ReadAccountData(contract)
+	if err != nil || imported == nil {
+		t.Fatalf("unexpected imported account %+v, %v", imported, err)
+	}
+	if imported.Balance.Int64() != 5 || imported.Incarnation != FirstContractIncarnation+1 || imported.Root != storageRoot {
+		t.Errorf("unexpected imported account: balance %d, incarnation %d, root %x", imported.Balance.Int64(), imported.Incarnation, imported.Root)
+	}
+	if v, err := tds.ReadAccountStorage(contract, imported.Incarnation, &k2); err != nil || len(v) != 1 || v[0] != 2 {
+		t.Errorf("unexpected imported storage item %x, %v", v, err)
+	}
+	if v, err := tds.ReadAccountStorage(contract, imported.Incarnation, &k3); err != nil || len(v) != 0 {
+		t.Errorf("expected the storage of the previous incarnation to be discarded, got %x, %v", v, err)
+	}
+	if expected, _ := flatStateRoot(db, false); expected != tds.LastRoot() {
+		t.Errorf("expected the root %x of the flat state, got %x", expected, tds.LastRoot())
+	}
+}
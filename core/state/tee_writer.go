@@ -0,0 +1,74 @@
+package state
+
+import (
+	"context"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+// TeeWriter passes every write to all of its writers, in order. The first error stops the write
+type TeeWriter struct {
+	writers []StateWriter
+}
+
+func NewTeeWriter(writers ...StateWriter) *TeeWriter {
+	return &TeeWriter{writers: writers}
+}
+
+func (tw *TeeWriter) UpdateAccountData(ctx context.Context, address common.Address, original, account *accounts.Account) error {
+	for _, w := range tw.writers {
+		if err := w.UpdateAccountData(ctx, address, original, account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tw *TeeWriter) UpdateAccountCode(addrHash common.Hash, incarnation uint64, codeHash common.Hash, code []byte) error {
+	for _, w := range tw.writers {
+		if err := w.UpdateAccountCode(addrHash, incarnation, codeHash, code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tw *TeeWriter) DeleteAccount(ctx context.Context, address common.Address, original *accounts.Account) error {
+	for _, w := range tw.writers {
+		if err := w.DeleteAccount(ctx, address, original); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tw *TeeWriter) WriteAccountStorage(ctx context.Context, address common.Address, incarnation uint64, key, original, value *common.Hash) error {
+	for _, w := range tw.writers {
+		if err := w.WriteAccountStorage(ctx, address, incarnation, key, original, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tw *TeeWriter) CreateContract(address common.Address) error {
+	for _, w := range tw.writers {
+		if err := w.CreateContract(address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FinishBlock finishes the block for the writers implementing BlockFinisher
+func (tw *TeeWriter) FinishBlock() error {
+	for _, w := range tw.writers {
+		if f, ok := w.(BlockFinisher); ok {
+			if err := f.FinishBlock(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// MappingLayout tells how the compiler places the items of a mapping in the storage
+type MappingLayout int
+
+const (
+	// SolidityMapping places the value for the key at keccak256(key . slot)
+	SolidityMapping MappingLayout = iota
+	// VyperMapping places the value for the key at keccak256(slot . key)
+	VyperMapping
+)
+
+// TokenLayout describes where a token contract keeps the balances of the holders
+type TokenLayout struct {
+	Token       common.Address
+	BalanceSlot common.Hash // Storage slot of the balances mapping
+	Mapping     MappingLayout
+}
+
+// holder extracts the holder from the preimage of the storage key, if the key belongs to the balances mapping
+func (l *TokenLayout) holder(preimage []byte) (common.Address, bool) {
+	if len(preimage) != 2*common.HashLength {
+		return common.Address{}, false
+	}
+	key, slot := preimage[:common.HashLength], preimage[common.HashLength:]
+	if l.Mapping == VyperMapping {
+		key, slot = slot, key
+	}
+	if !bytes.Equal(slot, l.BalanceSlot[:]) {
+		return common.Address{}, false
+	}
+	// Addresses are left-padded with zeros to 32 bytes
+	for _, b := range key[:common.HashLength-common.AddressLength] {
+		if b != 0 {
+			return common.Address{}, false
+		}
+	}
+	return common.BytesToAddress(key), true
+}
+
+// PreimageSource returns the preimage of the hash, or nil if it is not known
+type PreimageSource func(hash common.Hash) []byte
+
+// TokenIndexer is the StateWriter maintaining the index of the token balances by holder, from the writes
+// into the balance mappings of the configured tokens. The holders are recovered from the preimages of
+// the storage keys, so the SHA3 preimage recording must be enabled in the VM. It is meant to be combined
+// with the DbStateWriter using the TeeWriter. The previous balances are kept for the block blockNr,
+// so that the index is unwound together with the state (see TrieDbState.UnwindTo and TruncateAbove)
+type TokenIndexer struct {
+	db        ethdb.Database
+	layouts   map[common.Address][]TokenLayout
+	preimages PreimageSource
+	blockNr   uint64
+}
+
+func NewTokenIndexer(db ethdb.Database, layouts []TokenLayout, preimages PreimageSource, blockNr uint64) *TokenIndexer {
+	byToken := make(map[common.Address][]TokenLayout)
+	for _, l := range layouts {
+		byToken[l.Token] = append(byToken[l.Token], l)
+	}
+	return &TokenIndexer{db: db, layouts: byToken, preimages: preimages, blockNr: blockNr}
+}
+
+func (ti *TokenIndexer) UpdateAccountData(_ context.Context, address common.Address, original, account *accounts.Account) error {
+	return nil
+}
+
+func (ti *TokenIndexer) UpdateAccountCode(addrHash common.Hash, incarnation uint64, codeHash common.Hash, code []byte) error {
+	return nil
+}
+
+// DeleteAccount removes the balances of the self-destructed token
+func (ti *TokenIndexer) DeleteAccount(_ context.Context, address common.Address, original *accounts.Account) error {
+	if _, ok := ti.layouts[address]; !ok {
+		return nil
+	}
+	var keys [][]byte
+	if err := ti.db.Walk(dbutils.TokenBalanceBucket, address[:], 8*common.AddressLength, func(k, _ []byte) (bool, error) {
+		keys = append(keys, common.CopyBytes(k))
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := recordUndo(ti.db, ti.blockNr, dbutils.TokenBalanceBucket, k); err != nil {
+			return err
+		}
+		if err := ti.db.Delete(dbutils.TokenBalanceBucket, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ti *TokenIndexer) WriteAccountStorage(_ context.Context, address common.Address, incarnation uint64, key, original, value *common.Hash) error {
+	layouts, ok := ti.layouts[address]
+	if !ok || *original == *value {
+		return nil
+	}
+	preimage := ti.preimages(*key)
+	for i := range layouts {
+		holder, ok := layouts[i].holder(preimage)
+		if !ok {
+			continue
+		}
+		indexKey := tokenBalanceKey(address, holder)
+		if err := recordUndo(ti.db, ti.blockNr, dbutils.TokenBalanceBucket, indexKey); err != nil {
+			return err
+		}
+		balance := bytes.TrimLeft(value[:], "\x00")
+		if len(balance) == 0 {
+			return ti.db.Delete(dbutils.TokenBalanceBucket, indexKey)
+		}
+		return ti.db.Put(dbutils.TokenBalanceBucket, indexKey, common.CopyBytes(balance))
+	}
+	return nil
+}
+
+func (ti *TokenIndexer) CreateContract(address common.Address) error {
+	return nil
+}
+
+func tokenBalanceKey(token, holder common.Address) []byte {
+	k := make([]byte, 2*common.AddressLength)
+	copy(k, token[:])
+	copy(k[common.AddressLength:], holder[:])
+	return k
+}
+
+// TokenBalance returns the indexed balance of the holder of the token, zero if there is none
+func TokenBalance(db ethdb.Getter, token, holder common.Address) (*big.Int, error) {
+	v, err := db.Get(dbutils.TokenBalanceBucket, tokenBalanceKey(token, holder))
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(v), nil
+}
+
+// WalkTokenHolders calls walker for the holders of the token with non-zero balances, in the order of addresses.
+// If walker returns false, the walk stops
+func WalkTokenHolders(db ethdb.Getter, token common.Address, walker func(holder common.Address, balance *big.Int) (bool, error)) error {
+	return db.Walk(dbutils.TokenBalanceBucket, token[:], 8*common.AddressLength, func(k, v []byte) (bool, error) {
+		return walker(common.BytesToAddress(k[common.AddressLength:]), new(big.Int).SetBytes(v))
+	})
+}
@@ -0,0 +1,101 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestTokenIndexer(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	token := common.HexToAddress("0x70c3")
+	vyperToken := common.HexToAddress("0x7")
+	holder1 := common.HexToAddress("0x1")
+	holder2 := common.HexToAddress("0x2")
+	slot := common.BigToHash(big.NewInt(3))
+
+	preimages := make(map[common.Hash][]byte)
+	balanceKey := func(holder common.Address, vyper bool) *common.Hash {
+		var preimage []byte
+		if vyper {
+			preimage = append(append(preimage, slot[:]...), holder.Hash().Bytes()...)
+		} else {
+			preimage = append(append(preimage, holder.Hash().Bytes()...), slot[:]...)
+		}
+		k := crypto.Keccak256Hash(preimage)
+		preimages[k] = preimage
+		return &k
+	}
+	layouts := []TokenLayout{
+		{Token: token, BalanceSlot: slot},
+		{Token: vyperToken, BalanceSlot: slot, Mapping: VyperMapping},
+	}
+	indexer := NewTokenIndexer(db, layouts, func(hash common.Hash) []byte { return preimages[hash] }, 1)
+
+	ctx := context.Background()
+	write := func(addr common.Address, key *common.Hash, original, value int64) {
+		o, v := common.BigToHash(big.NewInt(original)), common.BigToHash(big.NewInt(value))
+		if err := indexer.WriteAccountStorage(ctx, addr, 1, key, &o, &v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(token, balanceKey(holder1, false), 0, 100)
+	write(token, balanceKey(holder2, false), 0, 50)
+	write(vyperToken, balanceKey(holder1, true), 0, 7)
+	// Other slots and other contracts are not indexed
+	otherSlot := common.Hash{5}
+	write(token, &otherSlot, 0, 1)
+	write(common.HexToAddress("0x9"), balanceKey(holder1, false), 0, 1)
+
+	expect := func(tok, holder common.Address, expected int64) {
+		balance, err := TokenBalance(db, tok, holder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Cmp(big.NewInt(expected)) != 0 {
+			t.Errorf("balance of %x in %x: expected %d, got %d", holder, tok, expected, balance)
+		}
+	}
+	expect(token, holder1, 100)
+	expect(token, holder2, 50)
+	expect(vyperToken, holder1, 7)
+	expect(common.HexToAddress("0x9"), holder1, 0)
+
+	// Balance dropping to zero removes the holder
+	indexer = NewTokenIndexer(db, layouts, func(hash common.Hash) []byte { return preimages[hash] }, 2)
+	write(token, balanceKey(holder1, false), 100, 120)
+	write(token, balanceKey(holder2, false), 50, 0)
+	var holders []common.Address
+	if err := WalkTokenHolders(db, token, func(holder common.Address, balance *big.Int) (bool, error) {
+		holders = append(holders, holder)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(holders) != 1 || holders[0] != holder1 {
+		t.Errorf("expected only %x as the holder, got %x", holder1, holders)
+	}
+
+	if err := indexer.DeleteAccount(ctx, token, nil); err != nil {
+		t.Fatal(err)
+	}
+	expect(token, holder1, 0)
+	expect(vyperToken, holder1, 7)
+
+	// The balances are restored by the truncation of the block
+	if err := TruncateAbove(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	expect(token, holder1, 100)
+	expect(token, holder2, 50)
+	expect(vyperToken, holder1, 7)
+	if err := TruncateAbove(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	expect(token, holder1, 0)
+	expect(vyperToken, holder1, 0)
+}
@@ -0,0 +1,198 @@
+package state
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/metrics"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+var (
+	prefetchHitCounter  = metrics.NewRegisteredCounter("state/prefetch/hit", nil)
+	prefetchMissCounter = metrics.NewRegisteredCounter("state/prefetch/miss", nil)
+)
+
+// SetTouchPrefetch enables the prediction of the accounts and the storage items touched by the next block:
+// those changed by the last `blocks` blocks (according to the change sets) are resolved in the background by
+// PrefetchRecentTouches. Zero disables the prediction
+func (tds *TrieDbState) SetTouchPrefetch(blocks uint64) {
+	tds.touchPrefetchBlocks = blocks
+}
+
+// PrefetchRecentTouches starts resolving the parts of the trie touched by the recent blocks in the background,
+// so that the recurring actors are already in memory when the next block touches them. It is meant to be
+// invoked before the block is executed. The prefetch is abandoned if the trie is modified before its results are hooked in.
+// Close waits for it to finish
+func (tds *TrieDbState) PrefetchRecentTouches() error {
+	if tds.touchPrefetchBlocks == 0 {
+		return nil
+	}
+	blockNr := tds.getBlockNr()
+	var from uint64
+	if blockNr >= tds.touchPrefetchBlocks {
+		from = blockNr - tds.touchPrefetchBlocks + 1
+	}
+	accountTouches, storageTouches, err := tds.recentTouches(from, blockNr)
+	if err != nil {
+		return err
+	}
+	predicted := make(map[string]struct{}, len(accountTouches)+len(storageTouches))
+	for _, addrHash := range accountTouches {
+		predicted[string(addrHash[:])] = struct{}{}
+	}
+	for _, storageKey := range storageTouches {
+		predicted[string(storageKey[:])] = struct{}{}
+	}
+	version := atomic.LoadUint64(&tds.trieVersion)
+	tds.tMu.Lock()
+	tds.predictedTouches = predicted
+	tds.tMu.Unlock()
+	if len(predicted) == 0 {
+		return nil
+	}
+
+	tds.background.Add(1)
+	go func() {
+		defer tds.background.Done()
+		// The trie is locked only to create the requests and to hook the results in, the database is read
+		// without the lock, so that the execution of the block is not held up by the prefetch
+		tds.tMu.Lock()
+		if atomic.LoadUint64(&tds.trieVersion) != version {
+			// The trie does not correspond to the state in the database anymore
+			tds.tMu.Unlock()
+			return
+		}
+		var codeHashes []common.Hash
+		var resolvers []*trie.Resolver
+		if resolver := tds.accountResolver(accountTouches, &codeHashes); resolver != nil {
+			resolvers = append(resolvers, resolver)
+		}
+		if resolver := tds.storageResolver(storageTouches); resolver != nil {
+			resolvers = append(resolvers, resolver)
+		}
+		tds.tMu.Unlock()
+		if len(resolvers) == 0 {
+			return
+		}
+
+		snapshot, err := tds.resolveSnapshot()
+		if err != nil {
+			tds.getLogger().Warn("Touch prefetch failed", "block", blockNr, "err", err)
+			return
+		}
+		if snapshot != nil {
+			defer snapshot.Release()
+		}
+		var spent trie.ResolverStats
+		for _, resolver := range resolvers {
+			resolver.SetSnapshot(snapshot)
+			if err = tds.resolveDetached(resolver, blockNr, &spent); err != nil {
+				tds.getLogger().Warn("Touch prefetch failed", "block", blockNr, "err", err)
+				return
+			}
+		}
+
+		tds.tMu.Lock()
+		if atomic.LoadUint64(&tds.trieVersion) != version {
+			// The trie has been updated meanwhile, so the resolved parts may be outdated
+			tds.tMu.Unlock()
+			return
+		}
+		for _, resolver := range resolvers {
+			resolver.HookResolved()
+		}
+		tds.tMu.Unlock()
+		tds.prefetchCodes(codeHashes)
+	}()
+	return nil
+}
+
+// recentTouches reads the keys of the accounts and of the storage items changed by the blocks from..to
+// from the change sets, sorted and without duplicates
+func (tds *TrieDbState) recentTouches(from, to uint64) (common.Hashes, common.StorageKeys, error) {
+	accounts := make(map[common.Hash]struct{})
+	storage := make(map[common.StorageKey]struct{})
+	if err := tds.db.Walk(dbutils.ChangeSetBucket, dbutils.EncodeTimestamp(from), 0, func(k, v []byte) (bool, error) {
+		timestamp, bucket, err := DecodeChangeSetKey(k)
+		if err != nil {
+			return false, err
+		}
+		if timestamp > to {
+			return false, nil
+		}
+		if !bytes.Equal(bucket, dbutils.AccountsHistoryBucket) && !bytes.Equal(bucket, dbutils.StorageHistoryBucket) {
+			return true, nil
+		}
+		return true, dbutils.Walk(v, func(key, _ []byte) error {
+			rec, err := DecodeHistoryRecord(bucket, key, nil)
+			if err != nil {
+				// Malformed keys are not worth prefetching
+				return nil
+			}
+			if rec.IsAccount() {
+				accounts[rec.AddrHash] = struct{}{}
+				return nil
+			}
+			var storageKey common.StorageKey
+			copy(storageKey[:], rec.AddrHash[:])
+			copy(storageKey[common.HashLength:], rec.KeyHash[:])
+			storage[storageKey] = struct{}{}
+			return nil
+		})
+	}); err != nil {
+		return nil, nil, err
+	}
+	accountTouches := make(common.Hashes, 0, len(accounts))
+	for addrHash := range accounts {
+		accountTouches = append(accountTouches, addrHash)
+	}
+	sort.Sort(accountTouches)
+	storageTouches := make(common.StorageKeys, 0, len(storage))
+	for storageKey := range storage {
+		storageTouches = append(storageTouches, storageKey)
+	}
+	sort.Sort(storageTouches)
+	return accountTouches, storageTouches, nil
+}
+
+// countPrefetchHits compares the touches of the block with the prediction made by PrefetchRecentTouches,
+// and clears the prediction. It has to be called with tMu held
+func (tds *TrieDbState) countPrefetchHits(accountTouches common.Hashes, storageTouches common.StorageKeys) {
+	if tds.predictedTouches == nil {
+		return
+	}
+	var hits, misses uint64
+	for _, addrHash := range accountTouches {
+		if _, ok := tds.predictedTouches[string(addrHash[:])]; ok {
+			hits++
+		} else {
+			misses++
+		}
+	}
+	for _, storageKey := range storageTouches {
+		if _, ok := tds.predictedTouches[string(storageKey[:])]; ok {
+			hits++
+		} else {
+			misses++
+		}
+	}
+	tds.predictedTouches = nil
+	prefetchHitCounter.Inc(int64(hits))
+	prefetchMissCounter.Inc(int64(misses))
+	atomic.AddUint64(&tds.prefetchHits, hits)
+	atomic.AddUint64(&tds.prefetchMisses, misses)
+}
+
+// TouchPrefetchHitRate returns the share of the touches of the blocks which have been predicted by
+// PrefetchRecentTouches, or zero if nothing has been measured yet
+func (tds *TrieDbState) TouchPrefetchHitRate() float64 {
+	hits, misses := atomic.LoadUint64(&tds.prefetchHits), atomic.LoadUint64(&tds.prefetchMisses)
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
@@ -0,0 +1,65 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestPrefetchRecentTouches(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	contract := common.HexToAddress("0xc")
+
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitTestBlock(t, tds, 1, func(ibs *IntraBlockState) {
+		for i := byte(1); i <= 20; i++ {
+			ibs.AddBalance(common.Address{i}, big.NewInt(int64(i)))
+		}
+		ibs.CreateAccount(contract, true)
+		ibs.SetState(contract, common.Hash{1}, common.Hash{31: 1})
+		ibs.SetState(contract, common.Hash{2}, common.Hash{31: 2})
+	})
+	root2, _ := commitTestBlock(t, tds, 2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(common.Address{1}, big.NewInt(100))
+		ibs.SetState(contract, common.Hash{2}, common.Hash{31: 3})
+	})
+
+	// Restart with nothing resolved, predicting the touches from the last block only
+	tds, err = NewTrieDbState(root2, db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetTouchPrefetch(1)
+	if err = tds.PrefetchRecentTouches(); err != nil {
+		t.Fatal(err)
+	}
+	tds.background.Wait()
+
+	account1 := crypto.Keccak256(common.Address{1}.Bytes())
+	account2 := crypto.Keccak256(common.Address{2}.Bytes())
+	contractHash := crypto.Keccak256(contract.Bytes())
+	slot2 := append(common.CopyBytes(contractHash), crypto.Keccak256(common.Hash{2}.Bytes())...)
+	if need, _ := tds.t.NeedResolution(nil, account1); need {
+		t.Errorf("account changed by the last block has not been prefetched")
+	}
+	if need, _ := tds.t.NeedResolution(contractHash, slot2); need {
+		t.Errorf("storage item changed by the last block has not been prefetched")
+	}
+	if need, _ := tds.t.NeedResolution(nil, account2); !need {
+		t.Errorf("account changed only by the earlier block is not expected to be prefetched")
+	}
+
+	commitTestBlock(t, tds, 3, func(ibs *IntraBlockState) {
+		ibs.AddBalance(common.Address{1}, big.NewInt(1))
+		ibs.AddBalance(common.Address{2}, big.NewInt(1))
+	})
+	if rate := tds.TouchPrefetchHitRate(); rate != 0.5 {
+		t.Errorf("expected hit rate 0.5, got %f", rate)
+	}
+}
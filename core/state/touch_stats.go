@@ -0,0 +1,115 @@
+package state
+
+import (
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// TouchOrigin tags the touches of the trie nodes with what caused them
+type TouchOrigin struct {
+	TxHash common.Hash // Zero for the touches outside of the transactions (e.g. computing the state root)
+	Depth  int         // Call depth of the EVM, zero outside of the calls
+}
+
+// TouchOriginSetter is implemented by the state readers that attribute the touches to their origins.
+// IntraBlockState keeps it informed about the current transaction and the call depth
+type TouchOriginSetter interface {
+	SetTouchOrigin(origin TouchOrigin)
+}
+
+// ContractTouchStats counts the touches of the nodes of the storage trie of one contract
+type ContractTouchStats struct {
+	Touches  int
+	ByOrigin map[TouchOrigin]int
+}
+
+// TouchStats counts the touches of the trie nodes made by one block, see TrieDbState.SetTouchStats
+type TouchStats struct {
+	AccountTouches int                                 // Touches of the nodes of the account trie
+	Contracts      map[common.Hash]*ContractTouchStats // Touches of the storage tries, by address hash
+}
+
+func newTouchStats() *TouchStats {
+	return &TouchStats{Contracts: make(map[common.Hash]*ContractTouchStats)}
+}
+
+// add counts the touch of the node at the path hex. The paths of the nodes of the storage tries
+// start with the address hash of the contract
+func (s *TouchStats) add(hex []byte, origin TouchOrigin) {
+	if len(hex) < 2*common.HashLength {
+		s.AccountTouches++
+		return
+	}
+	var addrHash common.Hash
+	for i := range addrHash {
+		addrHash[i] = hex[2*i]<<4 | hex[2*i+1]
+	}
+	cs, ok := s.Contracts[addrHash]
+	if !ok {
+		cs = &ContractTouchStats{ByOrigin: make(map[TouchOrigin]int)}
+		s.Contracts[addrHash] = cs
+	}
+	cs.Touches++
+	cs.ByOrigin[origin]++
+}
+
+// TopContracts returns the address hashes of (at most) n contracts with the most touches, in the descending order
+func (s *TouchStats) TopContracts(n int) []common.Hash {
+	top := make([]common.Hash, 0, len(s.Contracts))
+	for addrHash := range s.Contracts {
+		top = append(top, addrHash)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		ti, tj := s.Contracts[top[i]].Touches, s.Contracts[top[j]].Touches
+		if ti != tj {
+			return ti > tj
+		}
+		return top[i].Hex() < top[j].Hex()
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// SetTouchStats enables counting the touches of the trie nodes per contract and per origin (see SetTouchOrigin).
+// The counts of the last finished block are returned by BlockTouchStats
+func (tds *TrieDbState) SetTouchStats(enabled bool) {
+	tds.touchMu.Lock()
+	defer tds.touchMu.Unlock()
+	if enabled {
+		if tds.touchStats == nil {
+			tds.touchStats = newTouchStats()
+		}
+	} else {
+		tds.touchStats = nil
+		tds.lastTouchStats = nil
+	}
+}
+
+// SetTouchOrigin sets the origin of the subsequent touches. It is invoked by IntraBlockState when
+// a transaction is started and when the EVM enters or leaves a call
+func (tds *TrieDbState) SetTouchOrigin(origin TouchOrigin) {
+	tds.touchMu.Lock()
+	tds.touchOrigin = origin
+	tds.touchMu.Unlock()
+}
+
+// BlockTouchStats returns the touches of the last finished block, that is the block passed to the last
+// invocation of SetBlockNr. It returns nil if the statistics are not enabled, or no block is finished yet
+func (tds *TrieDbState) BlockTouchStats() *TouchStats {
+	tds.touchMu.Lock()
+	defer tds.touchMu.Unlock()
+	return tds.lastTouchStats
+}
+
+// finishTouchStats closes the touch statistics of the current block. To be invoked under touchMu
+func (tds *TrieDbState) finishTouchStats() {
+	if tds.touchStats == nil {
+		return
+	}
+	tds.lastTouchStats = tds.touchStats
+	tds.touchStats = newTouchStats()
+	tds.touchOrigin = TouchOrigin{}
+}
@@ -0,0 +1,75 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestBlockTouchStats(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetTouchStats(true)
+	ctx := context.Background()
+	contracts := []common.Address{common.HexToAddress("0xc1"), common.HexToAddress("0xc2")}
+	ibs := New(tds)
+	for i := 0; i < 10; i++ {
+		ibs.AddBalance(common.BytesToAddress([]byte{byte(i)}), big.NewInt(int64(i+1)))
+	}
+	for _, contract := range contracts {
+		ibs.CreateAccount(contract, true)
+		for i := 0; i < 10; i++ {
+			ibs.SetState(contract, common.Hash{byte(i)}, common.Hash{31: 1})
+		}
+	}
+	tds.StartNewBuffer()
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	stats := tds.BlockTouchStats()
+	if stats == nil || stats.AccountTouches == 0 || len(stats.Contracts) != 2 {
+		t.Fatalf("expected the touches of the accounts and of both contracts, got %+v", stats)
+	}
+	for addrHash, cs := range stats.Contracts {
+		if cs.ByOrigin[TouchOrigin{}] != cs.Touches {
+			t.Errorf("expected the updates of %x to have no origin, got %+v", addrHash, cs.ByOrigin)
+		}
+	}
+
+	// Reads are attributed to the transaction and the call depth
+	txHash := common.HexToHash("0x1234")
+	ibs = New(tds)
+	ibs.Prepare(txHash, common.Hash{}, 0)
+	ibs.SetTouchDepth(2)
+	ibs.GetState(contracts[0], common.Hash{3})
+	tds.SetBlockNr(2)
+	stats = tds.BlockTouchStats()
+	addrHash, err := common.HashData(contracts[0][:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Contracts) != 1 || stats.Contracts[addrHash] == nil {
+		t.Fatalf("expected the touches of the first contract only, got %+v", stats.Contracts)
+	}
+	if cs := stats.Contracts[addrHash]; cs.ByOrigin[TouchOrigin{TxHash: txHash, Depth: 2}] != cs.Touches || cs.Touches == 0 {
+		t.Errorf("expected the touches to be attributed to the transaction, got %+v", cs.ByOrigin)
+	}
+	if top := stats.TopContracts(5); len(top) != 1 || top[0] != addrHash {
+		t.Errorf("unexpected top contracts %x", top)
+	}
+
+	tds.SetTouchStats(false)
+	if stats = tds.BlockTouchStats(); stats != nil {
+		t.Errorf("expected no statistics once disabled, got %+v", stats)
+	}
+}
@@ -0,0 +1,50 @@
+package state
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// TxResult is the outcome of the execution of a transaction
+type TxResult struct {
+	ReturnData []byte
+	UsedGas    uint64
+	Failed     bool // Execution reverted or ran out of gas, the transaction is still valid
+}
+
+// TxExecutor executes the transactions of one block on top of a state. It is implemented by
+// core.BlockTxExecutor, as this package cannot depend on the state transition
+type TxExecutor interface {
+	// TxCount returns the number of transactions in the block
+	TxCount() int
+	// Context returns the context with the flags of the forks active in the block, see IntraBlockState.FinalizeTx
+	Context() context.Context
+	// ExecuteTx applies the transaction txIdx of the block to the state, with the given configuration of the EVM
+	ExecuteTx(ibs *IntraBlockState, txIdx int, cfg vm.Config) (*TxResult, error)
+}
+
+// TraceTx re-executes the transaction txIdx of the block blockNr with the tracer attached. The state is read
+// as of the end of the previous block, and the earlier transactions of the block are replayed first, with their
+// changes kept in memory only. This is the plumbing behind debug_traceTransaction
+func TraceTx(db ethdb.Getter, blockNr uint64, txIdx int, tracer vm.Tracer, exec TxExecutor) (*TxResult, error) {
+	if blockNr == 0 {
+		return nil, fmt.Errorf("genesis block has no transactions")
+	}
+	if txIdx < 0 || txIdx >= exec.TxCount() {
+		return nil, fmt.Errorf("transaction index %d out of range [0, %d)", txIdx, exec.TxCount())
+	}
+	ibs := New(NewDbState(db, blockNr-1))
+	ctx := exec.Context()
+	for i := 0; i < txIdx; i++ {
+		if _, err := exec.ExecuteTx(ibs, i, vm.Config{}); err != nil {
+			return nil, fmt.Errorf("replaying transaction %d: %v", i, err)
+		}
+		if err := ibs.FinalizeTx(ctx, NewNoopWriter()); err != nil {
+			return nil, err
+		}
+	}
+	return exec.ExecuteTx(ibs, txIdx, vm.Config{Debug: true, Tracer: tracer})
+}
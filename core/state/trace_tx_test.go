@@ -0,0 +1,91 @@
+package state_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/consensus/ethash"
+	"github.com/ledgerwatch/turbo-geth/core"
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/params"
+)
+
+func TestTraceTx(t *testing.T) {
+	var (
+		db      = ethdb.NewMemDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		counter = common.HexToAddress("0xc0")
+		gspec   = &core.Genesis{
+			Config: &params.ChainConfig{
+				ChainID:        big.NewInt(1),
+				HomesteadBlock: new(big.Int),
+				EIP150Block:    new(big.Int),
+				EIP155Block:    new(big.Int),
+				EIP158Block:    new(big.Int),
+				ByzantiumBlock: new(big.Int),
+			},
+			Alloc: core.GenesisAlloc{
+				address: {Balance: big.NewInt(1000000000)},
+				// PUSH1 0 SLOAD PUSH1 1 ADD PUSH1 0 SSTORE STOP
+				counter: {Balance: new(big.Int), Code: common.FromHex("0x60005460010160005500")},
+			},
+		}
+		genesis   = gspec.MustCommit(db)
+		genesisDb = db.MemCopy()
+		signer    = types.HomesteadSigner{}
+	)
+
+	engine := ethash.NewFaker()
+	blockchain, err := core.NewBlockChain(db, nil, gspec.Config, engine, vm.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	ctx := blockchain.WithContext(context.Background(), big.NewInt(genesis.Number().Int64()+1))
+	blocks, _ := core.GenerateChain(ctx, gspec.Config, genesis, engine, genesisDb, 1, func(i int, block *core.BlockGen) {
+		for j := 0; j < 3; j++ {
+			tx, err1 := types.SignTx(types.NewTransaction(block.TxNonce(address), counter, new(big.Int), 100000, new(big.Int), nil), signer, key)
+			if err1 != nil {
+				t.Fatal(err1)
+			}
+			block.AddTx(tx)
+		}
+	})
+	if _, err = blockchain.InsertChain(types.Blocks{blocks[0]}); err != nil {
+		t.Fatal(err)
+	}
+
+	exec := core.NewBlockTxExecutor(gspec.Config, blockchain, blocks[0])
+	for txIdx := 0; txIdx < 3; txIdx++ {
+		tracer := vm.NewStructLogger(nil)
+		res, err := state.TraceTx(db, 1, txIdx, tracer, exec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Failed || res.UsedGas == 0 {
+			t.Errorf("tx %d: unexpected result %+v", txIdx, res)
+		}
+		// The counter loaded by the transaction reflects the replayed earlier transactions
+		var loaded *big.Int
+		for _, l := range tracer.StructLogs() {
+			if l.Op == vm.ADD {
+				loaded = l.Stack[0]
+			}
+		}
+		if loaded == nil || loaded.Int64() != int64(txIdx) {
+			t.Errorf("tx %d: expected the counter %d, got %v", txIdx, txIdx, loaded)
+		}
+	}
+
+	if _, err = state.TraceTx(db, 1, 3, vm.NewStructLogger(nil), exec); err == nil {
+		t.Errorf("expected error for the transaction out of range")
+	}
+}
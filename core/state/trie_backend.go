@@ -0,0 +1,35 @@
+package state
+
+import (
+	"io"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// TrieBackend is the set of trie operations that TrieDbState relies upon to keep its in-memory
+// cache of the state trie. *trie.Trie is the canonical implementation; other implementations
+// (for example, mocks in the tests of resolution and unwinding logic) can be plugged in
+// via NewTrieDbStateWithBackend
+type TrieBackend interface {
+	Get(key []byte) (value []byte, gotValue bool)
+	GetStorage(key []byte, incarnation uint64) (value []byte, gotValue bool)
+	GetAccount(key []byte) (value *accounts.Account, gotValue bool)
+	Update(key, value []byte, blockNr uint64)
+	UpdateAccount(key []byte, acc *accounts.Account)
+	Delete(key []byte, blockNr uint64)
+	DeleteSubtree(keyPrefix []byte, blockNr uint64)
+	DeepHash(keyPrefix []byte) (bool, common.Hash)
+	Hash() common.Hash
+	NeedResolution(contract []byte, storageKey []byte) (bool, *trie.ResolveRequest)
+	NeedResolutionBatch(contractLen int, keys [][]byte) []*trie.ResolveRequest
+	Rebuild(db ethdb.Database, blockNr uint64) error
+	CountPrunableNodes() int
+	SetTouchFunc(touchFunc func(hex []byte, del bool))
+	SetGeneration(gen uint64)
+	Print(w io.Writer)
+}
+
+var _ TrieBackend = (*trie.Trie)(nil)
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// recordingTrie is a TrieBackend that delegates to the real trie, but remembers which accounts were updated
+type recordingTrie struct {
+	*trie.Trie
+	updatedAccounts map[common.Hash]struct{}
+}
+
+func (rt *recordingTrie) UpdateAccount(key []byte, acc *accounts.Account) {
+	rt.updatedAccounts[common.BytesToHash(key)] = struct{}{}
+	rt.Trie.UpdateAccount(key, acc)
+}
+
+func TestTrieBackend(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	rt := &recordingTrie{Trie: trie.New(common.Hash{}), updatedAccounts: make(map[common.Hash]struct{})}
+	tds, err := NewTrieDbStateWithBackend(rt, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tds.Trie() != nil {
+		t.Errorf("expected Trie() to be nil for non-canonical backend")
+	}
+	addr := common.HexToAddress("0x1234")
+	acc := accounts.NewAccount()
+	acc.Balance.Set(big.NewInt(100))
+
+	tds.StartNewBuffer()
+	if err = tds.TrieStateWriter().UpdateAccountData(context.Background(), addr, &accounts.Account{}, &acc); err != nil {
+		t.Fatal(err)
+	}
+	root, err := tds.ComputeTrieRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrHash, err := common.HashData(addr[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rt.updatedAccounts[addrHash]; !ok {
+		t.Errorf("expected account %x to be updated via the backend", addrHash)
+	}
+
+	expected := trie.New(common.Hash{})
+	expected.UpdateAccount(addrHash[:], &acc)
+	if root[0] != expected.Hash() {
+		t.Errorf("unexpected root: %x, expected %x", root[0], expected.Hash())
+	}
+}
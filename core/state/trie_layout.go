@@ -0,0 +1,222 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// ErrBinaryTrieNotPrunable is reported when the pruning is requested for the binary trie. The parts of it that
+// are pruned could not be resolved back, so it is held in memory fully, and its size is not limited
+var ErrBinaryTrieNotPrunable = errors.New("binary trie cannot be pruned")
+
+// SetBinaryTrieBlock sets the first block processed with the binary trie (see params.ChainConfig.BinaryTrieBlock).
+// The states produced by the blocks before it have the hexary roots. With nil, the hexary trie is used for all blocks.
+// It needs to be set before Rebuild, so that the state after the fork is rebuilt in the binary layout.
+// From the fork block on, the whole state trie is held in memory (see ErrBinaryTrieNotPrunable)
+func (tds *TrieDbState) SetBinaryTrieBlock(blockNr *big.Int) {
+	tds.tMu.Lock()
+	defer tds.tMu.Unlock()
+	tds.binaryTrieBlock = blockNr
+}
+
+// prunable returns ErrBinaryTrieNotPrunable if the trie is in the binary layout
+func (tds *TrieDbState) prunable() error {
+	tds.tMu.RLock()
+	defer tds.tMu.RUnlock()
+	if t, ok := tds.t.(*trie.Trie); ok && t.IsBinary() {
+		return ErrBinaryTrieNotPrunable
+	}
+	return nil
+}
+
+// binaryAt tells whether the state produced by the block is in the binary layout
+func (tds *TrieDbState) binaryAt(blockNr uint64) bool {
+	return tds.binaryTrieBlock != nil && tds.binaryTrieBlock.Cmp(new(big.Int).SetUint64(blockNr)) <= 0
+}
+
+// ApplyTrieLayout switches the trie to the layout of the block about to be processed. It does nothing except
+// at the fork block, where the hexary trie is replaced by the binary trie built from the flat state.
+// Before the switch, the parent state is verified: the hexary root streamed from the flat state has to be
+// the root of the trie, and the binary root streamed from the flat state has to be the root of the binary
+// trie. Both roots are recorded in the TrieLayoutBucket under the fork block.
+// The binary trie is held in memory fully and is not pruned (see PruneTries)
+func (tds *TrieDbState) ApplyTrieLayout(blockNr uint64) error {
+	tds.tMu.Lock()
+	defer tds.tMu.Unlock()
+	return tds.applyTrieLayout(blockNr)
+}
+
+func (tds *TrieDbState) applyTrieLayout(blockNr uint64) error {
+	binary := tds.binaryAt(blockNr)
+	t, err := tds.concreteTrie()
+	if err != nil {
+		if binary {
+			return err
+		}
+		return nil
+	}
+	if t.IsBinary() == binary {
+		return nil
+	}
+	if !binary {
+		return tds.restoreHexary()
+	}
+	if tds.binaryAt(tds.blockNr) {
+		// Parent state is already in the binary layout, the trie has not been rebuilt
+		return tds.rebuildBinary()
+	}
+
+	hexRoot := t.Hash()
+	flatHexRoot, err := flatStateRoot(tds.db, false)
+	if err != nil {
+		return err
+	}
+	if flatHexRoot != hexRoot {
+		return fmt.Errorf("trie layout switch at block %d: flat state has hexary root %x, expected %x", blockNr, flatHexRoot, hexRoot)
+	}
+	bt, err := trieFromFlat(tds.db, true)
+	if err != nil {
+		return err
+	}
+	binRoot, err := flatStateRoot(tds.db, true)
+	if err != nil {
+		return err
+	}
+	if h := bt.Hash(); h != binRoot {
+		return fmt.Errorf("trie layout switch at block %d: binary trie has root %x, streamed root is %x", blockNr, h, binRoot)
+	}
+	v := make([]byte, 2*common.HashLength)
+	copy(v, hexRoot[:])
+	copy(v[common.HashLength:], binRoot[:])
+	if err := tds.db.Put(dbutils.TrieLayoutBucket, dbutils.EncodeTimestamp(blockNr), v); err != nil {
+		return err
+	}
+	tds.setTrie(bt)
+	tds.getLogger().Info("Switched to the binary trie", "block", blockNr, "hexary root", hexRoot, "binary root", binRoot)
+	return nil
+}
+
+// rebuildBinary replaces the trie with the binary trie built from the flat state, which has to have the root
+// of the current trie. Binary trie cannot be resolved from the database piece by piece, so it is built fully
+func (tds *TrieDbState) rebuildBinary() error {
+	expected := tds.t.Hash()
+	bt, err := trieFromFlat(tds.db, true)
+	if err != nil {
+		return err
+	}
+	if h := bt.Hash(); h != expected {
+		return fmt.Errorf("rebuilding binary trie at block %d: got root %x, expected %x", tds.blockNr, h, expected)
+	}
+	tds.setTrie(bt)
+	tds.getLogger().Info("Rebuilt binary trie", "block", tds.blockNr, "root", expected)
+	return nil
+}
+
+// restoreHexary replaces the binary trie by the hexary one, after the state has been unwound below the fork.
+// The hexary trie gets resolved from the database on demand again
+func (tds *TrieDbState) restoreHexary() error {
+	if t, ok := tds.t.(*trie.Trie); !ok || !t.IsBinary() {
+		return nil
+	}
+	hexRoot, err := flatStateRoot(tds.db, false)
+	if err != nil {
+		return err
+	}
+	tds.setTrie(trie.New(hexRoot))
+	tds.getLogger().Info("Switched back to the hexary trie", "block", tds.blockNr, "root", hexRoot)
+	return nil
+}
+
+// setTrie replaces the trie, starting the pruning afresh. The binary trie is not tracked for pruning,
+// because the parts of it that are pruned cannot be resolved back (see ErrBinaryTrieNotPrunable)
+func (tds *TrieDbState) setTrie(t *trie.Trie) {
+	tds.setTrieWithPruning(t, trie.NewTriePruning(tds.blockNr))
+}
+
+// setTrieWithPruning replaces the trie and the state of its pruning
+func (tds *TrieDbState) setTrieWithPruning(t *trie.Trie, tp *trie.TriePruning) {
+	tds.t = t
+	tds.touchMu.Lock() // Read by touchView without tMu
+	tds.tp = tp
+	tds.touchMu.Unlock()
+	tds.view.reset()
+	if !t.IsBinary() {
+		t.SetTouchFunc(tds.touchFunc(tds.tp))
+	}
+	t.SetGeneration(tds.blockNr)
+	tds.resolvedAccounts = nil
+	tds.resolvedStorage = nil
+	tds.resetCrossValidation()
+}
+
+// trieFromFlat builds the full trie of the current state in the given layout from the flat buckets
+func trieFromFlat(db ethdb.Getter, binary bool) (*trie.Trie, error) {
+	bt := trie.New(common.Hash{})
+	if binary {
+		bt = trie.NewBinary(common.Hash{})
+	}
+	err := db.Walk(dbutils.AccountsBucket, nil, 0, func(k, v []byte) (bool, error) {
+		var acc accounts.Account
+		if err := acc.DecodeForStorage(v); err != nil {
+			return false, err
+		}
+		addrHash := common.BytesToHash(k)
+		// Storage root comes from the storage items inserted below
+		acc.Root = trie.EmptyRoot
+		bt.UpdateAccount(addrHash[:], &acc)
+		if acc.Incarnation == 0 {
+			return true, nil
+		}
+		if err := WalkIncarnationStorage(db, addrHash, acc.Incarnation, func(keyHash common.Hash, value []byte) (bool, error) {
+			bt.Update(dbutils.GenerateCompositeTrieKey(addrHash, keyHash), common.CopyBytes(value), 0)
+			return true, nil
+		}); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bt, nil
+}
+
+// flatStateRoot computes the root of the current state in the given layout from the flat buckets. The accounts
+// and the storage items are streamed into the hash builder (see trie.SortedRoot), without constructing the trie
+func flatStateRoot(db ethdb.Getter, binary bool) (common.Hash, error) {
+	accountsRoot := trie.NewSortedRootEncoded(binary)
+	err := db.Walk(dbutils.AccountsBucket, nil, 0, func(k, v []byte) (bool, error) {
+		var acc accounts.Account
+		if err := acc.DecodeForStorage(v); err != nil {
+			return false, err
+		}
+		acc.Root = trie.EmptyRoot
+		if acc.Incarnation > 0 {
+			storageRoot := trie.NewSortedRoot(binary)
+			if err := WalkIncarnationStorage(db, common.BytesToHash(k), acc.Incarnation, func(keyHash common.Hash, value []byte) (bool, error) {
+				return true, storageRoot.Add(keyHash[:], value)
+			}); err != nil {
+				return false, err
+			}
+			root, err := storageRoot.Root()
+			if err != nil {
+				return false, err
+			}
+			acc.Root = root
+		}
+		leaf := make([]byte, acc.EncodingLengthForHashing())
+		acc.EncodeForHashing(leaf)
+		return true, accountsRoot.Add(k, leaf)
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return accountsRoot.Root()
+}
@@ -0,0 +1,97 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestTrieLayoutSwitch(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBinaryTrieBlock(big.NewInt(2))
+	contract := common.HexToAddress("0xc")
+	block := func(blockNr uint64, change func(ibs *IntraBlockState)) common.Hash {
+		if err := tds.ApplyTrieLayout(blockNr); err != nil {
+			t.Fatal(err)
+		}
+		root, _ := commitTestBlock(t, tds, blockNr, change)
+		return root
+	}
+
+	root1 := block(1, func(ibs *IntraBlockState) {
+		for i := byte(1); i <= 10; i++ {
+			ibs.AddBalance(common.Address{i}, big.NewInt(int64(i)))
+		}
+		ibs.CreateAccount(contract, true)
+		ibs.SetCode(contract, []byte{0x60, 0x00})
+		ibs.SetState(contract, common.Hash{1}, common.Hash{31: 1})
+		ibs.SetState(contract, common.Hash{2}, common.Hash{31: 2})
+	})
+	if expected, _ := flatStateRoot(db, false); root1 != expected {
+		t.Fatalf("block 1: expected hexary root %x, got %x", expected, root1)
+	}
+	binRoot1, err := flatStateRoot(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root2 := block(2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(common.Address{1}, big.NewInt(100))
+		ibs.SetState(contract, common.Hash{2}, common.Hash{})
+		ibs.SetState(contract, common.Hash{3}, common.Hash{31: 3})
+	})
+	if expected, _ := flatStateRoot(db, true); root2 != expected {
+		t.Fatalf("block 2: expected binary root %x, got %x", expected, root2)
+	}
+	marker, err := db.Get(dbutils.TrieLayoutBucket, dbutils.EncodeTimestamp(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if common.BytesToHash(marker[:common.HashLength]) != root1 || common.BytesToHash(marker[common.HashLength:]) != binRoot1 {
+		t.Errorf("unexpected transition record %x", marker)
+	}
+	root3 := block(3, func(ibs *IntraBlockState) {
+		ibs.AddBalance(common.Address{2}, big.NewInt(100))
+	})
+	if expected, _ := flatStateRoot(db, true); root3 != expected {
+		t.Fatalf("block 3: expected binary root %x, got %x", expected, root3)
+	}
+
+	// Restart after the fork
+	tds2, err := NewTrieDbState(root3, db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds2.SetBinaryTrieBlock(big.NewInt(2))
+	if err = tds2.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	if root := tds2.LastRoot(); root != root3 {
+		t.Errorf("after rebuild: expected root %x, got %x", root3, root)
+	}
+
+	// Unwinding below the fork brings the hexary trie back
+	if err = tds.UnwindTo(1); err != nil {
+		t.Fatal(err)
+	}
+	if root := tds.LastRoot(); root != root1 {
+		t.Errorf("after unwind: expected root %x, got %x", root1, root)
+	}
+	if _, err = db.Get(dbutils.TrieLayoutBucket, dbutils.EncodeTimestamp(2)); err != ethdb.ErrKeyNotFound {
+		t.Errorf("expected the transition record to be removed, got %v", err)
+	}
+	// and the fork block switches to the binary trie again
+	if err = tds.ApplyTrieLayout(2); err != nil {
+		t.Fatal(err)
+	}
+	if root := tds.LastRoot(); root != binRoot1 {
+		t.Errorf("after the switch: expected root %x, got %x", binRoot1, root)
+	}
+}
@@ -0,0 +1,179 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// Version of the encoding of the trie snapshots. The snapshots of other versions are discarded
+const trieSnapshotVersion byte = 1
+
+// Default depth (in nibbles) of the trie snapshots, see SetTrieSnapshots
+const DefaultTrieSnapshotDepth = 5
+
+// SetTrieSnapshots makes SnapshotTrie persist the upper levels of the trie, down to depth (in nibbles,
+// DefaultTrieSnapshotDepth if zero), every `interval` blocks. Zero interval disables the snapshots
+func (tds *TrieDbState) SetTrieSnapshots(interval uint64, depth int) {
+	if depth == 0 {
+		depth = DefaultTrieSnapshotDepth
+	}
+	tds.snapshotInterval = interval
+	tds.snapshotDepth = depth
+}
+
+// SnapshotTrie writes the snapshot of the trie and of its pruning state to the TrieSnapshotBucket, if the
+// current block is a multiple of the snapshot interval, replacing the previous snapshot. It is meant to be
+// called after the block is committed, with the same database (batch), so that the snapshot is
+// only persisted together with the state it describes. Close also writes the snapshot, whatever the block,
+// so that the restart after the clean shutdown finds the snapshot of the head block
+func (tds *TrieDbState) SnapshotTrie() error {
+	tds.tMu.Lock()
+	defer tds.tMu.Unlock()
+	if tds.snapshotInterval == 0 || tds.blockNr%tds.snapshotInterval != 0 {
+		return nil
+	}
+	return tds.writeTrieSnapshot()
+}
+
+// WriteTrieSnapshot is SnapshotTrie for the state of the writer, to be registered as a commit hook (see WriterHook)
+func (dsw *DbStateWriter) WriteTrieSnapshot() error {
+	return dsw.tds.SnapshotTrie()
+}
+
+// snapshotTrieOnClose writes the snapshot of the trie of the current block, if the snapshots are enabled
+func (tds *TrieDbState) snapshotTrieOnClose() error {
+	tds.tMu.Lock()
+	defer tds.tMu.Unlock()
+	if tds.snapshotInterval == 0 {
+		return nil
+	}
+	return tds.writeTrieSnapshot()
+}
+
+// writeTrieSnapshot needs tMu to be held
+func (tds *TrieDbState) writeTrieSnapshot() error {
+	t, err := tds.concreteTrie()
+	if err != nil || t.IsBinary() {
+		// Binary trie is rebuilt from the flat state anyway
+		return nil
+	}
+	var buf bytes.Buffer
+	root := t.Hash()
+	buf.WriteByte(trieSnapshotVersion)
+	buf.Write(root[:])
+	var num [binary.MaxVarintLen64]byte
+	writeUvarint := func(x uint64) {
+		buf.Write(num[:binary.PutUvarint(num[:], x)])
+	}
+	writeUvarint(tds.tp.OldestGeneration())
+	timestamps := tds.tp.Timestamps(tds.snapshotDepth)
+	writeUvarint(uint64(len(timestamps)))
+	for hexS, ts := range timestamps {
+		writeUvarint(uint64(len(hexS)))
+		buf.WriteString(hexS)
+		writeUvarint(ts)
+	}
+	if err = t.WriteSnapshot(&buf, tds.snapshotDepth); err != nil {
+		return err
+	}
+
+	// Only the latest snapshot is kept
+	key := dbutils.EncodeTimestamp(tds.blockNr)
+	var stale [][]byte
+	if err = tds.db.Walk(dbutils.TrieSnapshotBucket, nil, 0, func(k, _ []byte) (bool, error) {
+		if !bytes.Equal(k, key) {
+			stale = append(stale, common.CopyBytes(k))
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range stale {
+		if err = tds.db.Delete(dbutils.TrieSnapshotBucket, k); err != nil {
+			return err
+		}
+	}
+	return tds.db.Put(dbutils.TrieSnapshotBucket, key, buf.Bytes())
+}
+
+// LoadTrieSnapshot replaces the trie with the one from the snapshot of the current block, if there is one,
+// which is much faster than Rebuild. There is one if the block was the last one before the clean shutdown
+// (see Close), or a multiple of the snapshot interval. Snapshots of another version or for another root are discarded.
+// It returns false if there was no usable snapshot, in which case the trie needs to be rebuilt
+func (tds *TrieDbState) LoadTrieSnapshot() (bool, error) {
+	tds.tMu.Lock()
+	defer tds.tMu.Unlock()
+	if tds.binaryAt(tds.blockNr) {
+		return false, nil
+	}
+	key := dbutils.EncodeTimestamp(tds.blockNr)
+	v, err := tds.db.Get(dbutils.TrieSnapshotBucket, key)
+	if err == ethdb.ErrKeyNotFound || len(v) == 0 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	t, tp, err := decodeTrieSnapshot(v, tds.t.Hash(), tds.blockNr)
+	if err != nil {
+		tds.getLogger().Warn("Discarding trie snapshot", "block", tds.blockNr, "err", err)
+		return false, tds.db.Delete(dbutils.TrieSnapshotBucket, key)
+	}
+	tds.setTrieWithPruning(t, tp)
+	tds.getLogger().Info("Loaded trie snapshot", "block", tds.blockNr, "nodes", tp.NodeCount())
+	return true, nil
+}
+
+func decodeTrieSnapshot(v []byte, root common.Hash, blockNr uint64) (*trie.Trie, *trie.TriePruning, error) {
+	if v[0] != trieSnapshotVersion {
+		return nil, nil, fmt.Errorf("unsupported version %d", v[0])
+	}
+	r := bytes.NewReader(v[1:])
+	var snapshotRoot common.Hash
+	if _, err := io.ReadFull(r, snapshotRoot[:]); err != nil {
+		return nil, nil, err
+	}
+	if snapshotRoot != root {
+		return nil, nil, fmt.Errorf("snapshot of root %x, expected %x", snapshotRoot, root)
+	}
+	oldest, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	tp := trie.NewTriePruning(oldest)
+	tp.SetBlockNr(blockNr)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := uint64(0); i < count; i++ {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if l > uint64(r.Len()) {
+			return nil, nil, fmt.Errorf("prefix of %d nibbles is longer than the rest of the snapshot", l)
+		}
+		hex := make([]byte, l)
+		if _, err = io.ReadFull(r, hex); err != nil {
+			return nil, nil, err
+		}
+		ts, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		tp.SetTimestamp(hex, ts)
+	}
+	t, err := trie.ReadSnapshot(r, root, blockNr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, tp, nil
+}
@@ -0,0 +1,120 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestTrieSnapshotRestart(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	contract := common.HexToAddress("0xc")
+	block := func(tds *TrieDbState, blockNr uint64, change func(ibs *IntraBlockState)) common.Hash {
+		root, _ := commitTestBlock(t, tds, blockNr, change)
+		if err := tds.SnapshotTrie(); err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetTrieSnapshots(2, 2)
+	block(tds, 1, func(ibs *IntraBlockState) {
+		for i := 0; i < 100; i++ {
+			ibs.AddBalance(common.BytesToAddress([]byte{byte(i)}), big.NewInt(int64(i+1)))
+		}
+		ibs.CreateAccount(contract, true)
+		ibs.SetState(contract, common.Hash{1}, common.Hash{31: 1})
+	})
+	if _, err = db.Get(dbutils.TrieSnapshotBucket, dbutils.EncodeTimestamp(1)); err != ethdb.ErrKeyNotFound {
+		t.Errorf("did not expect a snapshot outside of the interval, got %v", err)
+	}
+	root2 := block(tds, 2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(common.BytesToAddress([]byte{1}), big.NewInt(100))
+	})
+
+	// Restart from the snapshot
+	restarted, err := NewTrieDbState(root2, db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := restarted.LoadTrieSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded {
+		t.Fatal("expected the snapshot to be loaded")
+	}
+	if restarted.tp.NodeCount() == 0 {
+		t.Errorf("expected the pruning state to be restored")
+	}
+	change := func(ibs *IntraBlockState) {
+		ibs.AddBalance(common.BytesToAddress([]byte{2}), big.NewInt(100))
+		ibs.SetState(contract, common.Hash{2}, common.Hash{31: 2})
+	}
+	// Same block on a copy of the database processed with the original trie
+	reference, err := NewTrieDbState(root2, db.MemCopy(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := block(reference, 3, change)
+	if root := block(restarted, 3, change); root != expected {
+		t.Errorf("after restart from the snapshot: expected root %x, got %x", expected, root)
+	}
+	if _, err = db.Get(dbutils.TrieSnapshotBucket, dbutils.EncodeTimestamp(2)); err != nil {
+		t.Errorf("expected the snapshot to be kept, got %v", err)
+	}
+
+	// Snapshot which does not match the root is discarded
+	mismatched, err := NewTrieDbState(common.Hash{1}, db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err = mismatched.LoadTrieSnapshot(); err != nil || loaded {
+		t.Errorf("expected the snapshot for another root not to be loaded, got %t, %v", loaded, err)
+	}
+	if _, err = db.Get(dbutils.TrieSnapshotBucket, dbutils.EncodeTimestamp(2)); err != ethdb.ErrKeyNotFound {
+		t.Errorf("expected the invalid snapshot to be removed, got %v", err)
+	}
+}
+
+func TestTrieSnapshotOnClose(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetTrieSnapshots(100, 2)
+	var root common.Hash
+	for blockNr := uint64(1); blockNr <= 3; blockNr++ {
+		root, _ = commitTestBlock(t, tds, blockNr, func(ibs *IntraBlockState) {
+			ibs.AddBalance(common.BytesToAddress([]byte{byte(blockNr)}), big.NewInt(int64(blockNr)))
+		})
+		if err = tds.SnapshotTrie(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tds.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The head block is not a multiple of the interval, but the snapshot of the clean shutdown is there
+	restarted, err := NewTrieDbState(root, db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := restarted.LoadTrieSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded {
+		t.Errorf("expected the snapshot written by Close to be loaded")
+	}
+}
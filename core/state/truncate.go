@@ -0,0 +1,112 @@
+package state
+
+import (
+	"math"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// deleteBlockRecords removes the history of the block (incl. ChangeSet) and the records kept per block
+func deleteBlockRecords(db ethdb.Database, blockNr uint64) error {
+	if err := db.DeleteTimestamp(blockNr); err != nil {
+		return err
+	}
+	if err := db.Delete(dbutils.StateRootIndexBucket, dbutils.EncodeTimestamp(blockNr)); err != nil {
+		return err
+	}
+	if err := db.Delete(dbutils.TrieLayoutBucket, dbutils.EncodeTimestamp(blockNr)); err != nil {
+		return err
+	}
+	if err := db.Delete(dbutils.TrieSnapshotBucket, dbutils.EncodeTimestamp(blockNr)); err != nil {
+		return err
+	}
+	return deleteTxChanges(db, blockNr)
+}
+
+// lastHistoryBlock returns the highest block with the ChangeSet or with the state root recorded
+func lastHistoryBlock(db ethdb.Getter, blockNr uint64) (uint64, error) {
+	last := blockNr
+	for _, bucket := range [][]byte{dbutils.ChangeSetBucket, dbutils.StateRootIndexBucket} {
+		if err := db.Walk(bucket, dbutils.EncodeTimestamp(blockNr+1), 0, func(k, _ []byte) (bool, error) {
+			if timestamp, _ := dbutils.DecodeTimestamp(k); timestamp > last {
+				last = timestamp
+			}
+			return true, nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return last, nil
+}
+
+// TruncateAbove permanently removes the effects of the blocks after blockNr from the database: the flat state
+// is brought back to the state after the block from the ChangeSets, and the history, the ChangeSets and
+// the records kept per block (state roots, trie layouts and snapshots, transaction changes) of the later blocks
+// are deleted, as well as their traces in the history bitmaps and in the last touches (the checksum of the flat state
+// is removed, see InitStateChecksum). The indices kept next to the state (token balances, last code reads) are restored.
+// Unlike TrieDbState.UnwindTo, it does not need the state trie of the head, so it can rescue a database
+// whose head is corrupted. The chain itself (headers, bodies, head markers) is to be rolled back separately,
+// and TrieDbState is to be re-created after the truncation
+func TruncateAbove(db ethdb.Database, blockNr uint64) error {
+	last, err := lastHistoryBlock(db, blockNr)
+	if err != nil {
+		return err
+	}
+	if err = ethdb.RewindData(db, math.MaxUint64, blockNr, func(bucket, key, value []byte) error {
+		rec, err := DecodeHistoryRecord(bucket, key, value)
+		if err != nil {
+			return err
+		}
+		if rec.IsAccount() {
+			acc := rec.Account
+			if acc == nil {
+				return db.Delete(dbutils.AccountsBucket, rec.AddrHash[:])
+			}
+			if acc.Incarnation > 0 && debug.IsThinHistory() && acc.IsEmptyCodeHash() {
+				// Thin history does not keep the code hashes of the contracts
+				if codeHash, err := db.Get(dbutils.ContractCodeBucket, dbutils.GenerateStoragePrefix(rec.AddrHash, acc.Incarnation)); err == nil {
+					copy(acc.CodeHash[:], codeHash)
+				}
+			}
+			return db.Put(dbutils.AccountsBucket, rec.AddrHash[:], rec.EncodeValue())
+		}
+		compositeKey := rec.Key()
+		current, err := db.Get(dbutils.StorageBucket, compositeKey)
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return err
+		}
+		if err = updateStorageSize(db, compositeKey, current, rec.Value); err != nil {
+			return err
+		}
+		if len(rec.Value) > 0 {
+			return db.Put(dbutils.StorageBucket, compositeKey, rec.Value)
+		}
+		return db.Delete(dbutils.StorageBucket, compositeKey)
+	}); err != nil {
+		return err
+	}
+
+	if err = ethdb.UnwindHistoryBitmaps(db, blockNr); err != nil {
+		return err
+	}
+	for i := last; i > blockNr; i-- {
+		if err = deleteBlockRecords(db, i); err != nil {
+			return err
+		}
+	}
+	if err = unwindLastTouches(db, blockNr); err != nil {
+		return err
+	}
+	if err = unwindUndoLog(db, blockNr); err != nil {
+		return err
+	}
+	if err = invalidateStateChecksum(db); err != nil {
+		return err
+	}
+	if shutdownBlockNr, _, ok := ReadCleanShutdown(db); ok && shutdownBlockNr > blockNr {
+		return ClearCleanShutdown(db)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestTruncateAbove(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := make(map[uint64]common.Hash)
+	block := func(blockNr uint64, change func(ibs *IntraBlockState)) {
+		roots[blockNr], _ = commitTestBlock(t, tds, blockNr, change)
+	}
+	a, contract := common.HexToAddress("0xa"), common.HexToAddress("0xc")
+	addrHashA := crypto.Keccak256Hash(a[:])
+	block(1, func(ibs *IntraBlockState) {
+		ibs.AddBalance(a, big.NewInt(10))
+		ibs.CreateAccount(contract, true)
+		ibs.SetState(contract, common.Hash{1}, common.Hash{31: 1})
+	})
+	block(2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(a, big.NewInt(5))
+		ibs.SetState(contract, common.Hash{1}, common.Hash{31: 2})
+		ibs.SetState(contract, common.Hash{2}, common.Hash{31: 3})
+	})
+	block(3, func(ibs *IntraBlockState) {
+		ibs.Suicide(contract)
+		ibs.AddBalance(common.HexToAddress("0xb"), big.NewInt(1))
+	})
+
+	if err = TruncateAbove(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	if root, err := flatStateRoot(db, false); err != nil || root != roots[1] {
+		t.Errorf("expected the root %x of block 1, got %x, %v", roots[1], root, err)
+	}
+	for blockNr := uint64(2); blockNr <= 3; blockNr++ {
+		for _, hBucket := range [][]byte{dbutils.AccountsHistoryBucket, dbutils.StorageHistoryBucket} {
+			if cs, _ := db.Get(dbutils.ChangeSetBucket, dbutils.CompositeChangeSetKey(dbutils.EncodeTimestamp(blockNr), hBucket)); cs != nil {
+				t.Errorf("expected the ChangeSet of block %d to be removed", blockNr)
+			}
+		}
+	}
+	if cs, _ := db.Get(dbutils.ChangeSetBucket, dbutils.CompositeChangeSetKey(dbutils.EncodeTimestamp(1), dbutils.AccountsHistoryBucket)); cs == nil {
+		t.Errorf("expected the ChangeSet of block 1 to be kept")
+	}
+
+	// The state continues from block 1
+	tds, err = NewTrieDbState(roots[1], db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block(2, func(ibs *IntraBlockState) {
+		ibs.AddBalance(a, big.NewInt(1))
+	})
+	if root, _ := flatStateRoot(db, false); root != roots[2] {
+		t.Errorf("expected the root %x of the new block 2, got %x", roots[2], root)
+	}
+	if v, err := db.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, addrHashA[:], 2); err != nil || len(v) == 0 {
+		t.Errorf("expected the history of the new block 2, got %x, %v", v, err)
+	}
+}
@@ -0,0 +1,235 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// TxFinisher is implemented by the state writers that need to know the boundaries of the transactions.
+// IntraBlockState.FinalizeTx calls FinishTx after writing out the changes of the transaction
+type TxFinisher interface {
+	FinishTx()
+}
+
+// txChanges are the values written by one transaction, by the history bucket and the key of the history record
+type txChanges map[string]map[string][]byte
+
+func (c txChanges) set(hBucket, key, value []byte) {
+	m, ok := c[string(hBucket)]
+	if !ok {
+		m = make(map[string][]byte)
+		c[string(hBucket)] = m
+	}
+	m[string(key)] = value
+}
+
+// txChangeRecorder collects the values written by the transactions of the block being processed,
+// to be written out by DbStateWriter.WriteTxChanges
+type txChangeRecorder struct {
+	current txChanges
+	txs     []txChanges
+}
+
+func (r *txChangeRecorder) reset() {
+	r.current = make(txChanges)
+	r.txs = nil
+}
+
+// SetTxChanges enables recording the changes made by every transaction in the TxChangeSetBucket, so that
+// they can be queried by TxDiff without re-execution
+func (tds *TrieDbState) SetTxChanges(enabled bool) {
+	if enabled {
+		if tds.txChanges == nil {
+			tds.txChanges = &txChangeRecorder{}
+			tds.txChanges.reset()
+		}
+	} else {
+		tds.txChanges = nil
+	}
+}
+
+func (tds *TrieDbState) recordTxChange(hBucket, key, value []byte) {
+	if tds.txChanges != nil {
+		tds.txChanges.current.set(hBucket, key, value)
+	}
+}
+
+// FinishTx closes the changes of the current transaction, the changes written afterwards belong to the next one
+func (tsw *TrieStateWriter) FinishTx() {
+	if r := tsw.tds.txChanges; r != nil {
+		r.txs = append(r.txs, r.current)
+		r.current = make(txChanges)
+	}
+}
+
+// txChangeSetKey makes the key of the TxChangeSetBucket
+func txChangeSetKey(blockNr uint64, txIdx int, hBucket []byte) []byte {
+	ts := dbutils.EncodeTimestamp(blockNr)
+	k := make([]byte, len(ts)+4+len(hBucket))
+	copy(k, ts)
+	binary.BigEndian.PutUint32(k[len(ts):], uint32(txIdx))
+	copy(k[len(ts)+4:], hBucket)
+	return k
+}
+
+// WriteTxChanges writes out the changes recorded for the transactions of the current block (see SetTxChanges)
+// under the current block number. It is meant to be called after CommitBlock
+func (dsw *DbStateWriter) WriteTxChanges() error {
+	r := dsw.tds.txChanges
+	if r == nil {
+		return nil
+	}
+	txs := r.txs
+	r.reset()
+	for txIdx, changes := range txs {
+		for hBucket, m := range changes {
+			cs := dbutils.NewChangeSet()
+			for key, value := range m {
+				if err := cs.Add([]byte(key), value); err != nil {
+					return err
+				}
+			}
+			v, err := cs.Encode()
+			if err != nil {
+				return err
+			}
+			if err := dsw.db.Put(dbutils.TxChangeSetBucket, txChangeSetKey(dsw.tds.blockNr, txIdx, []byte(hBucket)), v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteTxChanges removes the changes recorded for the transactions of the block
+func deleteTxChanges(db ethdb.Database, blockNr uint64) error {
+	prefix := dbutils.EncodeTimestamp(blockNr)
+	var keys [][]byte
+	if err := db.Walk(dbutils.TxChangeSetBucket, prefix, 8*uint(len(prefix)), func(k, _ []byte) (bool, error) {
+		keys = append(keys, common.CopyBytes(k))
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := db.Delete(dbutils.TxChangeSetBucket, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TxChange is the change of an account or of a storage item made by a transaction
+type TxChange struct {
+	Before *HistoryRecord
+	After  *HistoryRecord
+}
+
+// TxDiff returns the changes made by the transaction txIdx of the block, as recorded when the recording is
+// enabled by SetTxChanges. The index equal to the number of transactions gives the changes made when the block
+// is finalised (block and uncle rewards). The accounts are ordered before the storage items, each by the key.
+// The values before the first change in the block come from the change set of the block, which does not keep
+// the code hashes and the storage roots of the accounts in the thin history mode.
+// The self-destruct of a contract is reported as the deletion of the account, without its storage items
+func TxDiff(db ethdb.Getter, blockNr uint64, txIdx int) ([]TxChange, error) {
+	// Values written by the transactions of the block, by the history bucket and the key
+	var txs []txChanges
+	prefix := dbutils.EncodeTimestamp(blockNr)
+	if err := db.Walk(dbutils.TxChangeSetBucket, prefix, 8*uint(len(prefix)), func(k, v []byte) (bool, error) {
+		if len(k) < len(prefix)+4 {
+			return false, fmt.Errorf("invalid transaction change set key %x", k)
+		}
+		idx := int(binary.BigEndian.Uint32(k[len(prefix):]))
+		for len(txs) <= idx {
+			txs = append(txs, make(txChanges))
+		}
+		hBucket := k[len(prefix)+4:]
+		return true, dbutils.Walk(v, func(key, value []byte) error {
+			txs[idx].set(hBucket, key, common.CopyBytes(value))
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	if len(txs) == 0 {
+		return nil, fmt.Errorf("no transaction changes recorded for block %d", blockNr)
+	}
+	if txIdx < 0 || txIdx >= len(txs) {
+		return nil, fmt.Errorf("transaction index %d out of range [0, %d)", txIdx, len(txs))
+	}
+
+	var changes []TxChange
+	for _, hBucket := range [][]byte{dbutils.AccountsHistoryBucket, dbutils.StorageHistoryBucket} {
+		written := txs[txIdx][string(hBucket)]
+		if len(written) == 0 {
+			continue
+		}
+		blockChanges, err := db.Get(dbutils.ChangeSetBucket, dbutils.CompositeChangeSetKey(prefix, hBucket))
+		if err != nil && err != ethdb.ErrKeyNotFound {
+			return nil, err
+		}
+		keys := make([]string, 0, len(written))
+		for key := range written {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			before, err := valueBeforeTx(txs, txIdx, hBucket, []byte(key), blockChanges)
+			if err != nil {
+				return nil, err
+			}
+			after := written[key]
+			if bytes.Equal(before, after) {
+				continue
+			}
+			var change TxChange
+			if change.Before, err = DecodeHistoryRecord(hBucket, []byte(key), before); err != nil {
+				return nil, err
+			}
+			if change.After, err = DecodeHistoryRecord(hBucket, []byte(key), after); err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// valueBeforeTx finds the value of the item before the transaction txIdx: the value written by the latest earlier
+// transaction, otherwise the value before the block
+func valueBeforeTx(txs []txChanges, txIdx int, hBucket, key []byte, blockChanges []byte) ([]byte, error) {
+	for i := txIdx - 1; i >= 0; i-- {
+		if v, ok := txs[i][string(hBucket)][string(key)]; ok {
+			return v, nil
+		}
+	}
+	var before []byte
+	found := false
+	if len(blockChanges) > 0 {
+		if err := dbutils.Walk(blockChanges, func(k, v []byte) error {
+			if !found && bytes.Equal(k, key) {
+				before = common.CopyBytes(v)
+				found = true
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if found {
+		return before, nil
+	}
+	// Not in the change set of the block means that the value after the block is the same as before it
+	for i := len(txs) - 1; i >= txIdx; i-- {
+		if v, ok := txs[i][string(hBucket)][string(key)]; ok {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
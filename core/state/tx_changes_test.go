@@ -0,0 +1,92 @@
+package state
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestTxDiff(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds, err := NewTrieDbState(common.Hash{}, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tds.SetTxChanges(true)
+	ctx := context.Background()
+	a, b, c := common.HexToAddress("0xa"), common.HexToAddress("0xb"), common.HexToAddress("0xc")
+	key := common.HexToHash("0x01")
+
+	ibs := New(tds)
+	tds.StartNewBuffer()
+	ibs.AddBalance(a, big.NewInt(10))
+	ibs.SetState(b, key, common.HexToHash("0x01"))
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	ibs.AddBalance(a, big.NewInt(5))
+	ibs.SetState(b, key, common.HexToHash("0x02"))
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	// Rewards
+	ibs.AddBalance(c, big.NewInt(2))
+	if err = ibs.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	dsw := tds.DbStateWriter()
+	if err = ibs.CommitBlock(ctx, dsw); err != nil {
+		t.Fatal(err)
+	}
+	if err = dsw.WriteTxChanges(); err != nil {
+		t.Fatal(err)
+	}
+
+	addrHashA, _ := common.HashData(a[:])
+	changes, err := TxDiff(db, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Accounts a and b, storage item of b
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes of the first transaction, got %d", len(changes))
+	}
+
+	changes, err = TxDiff(db, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Account b is written again, but not changed
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes of the second transaction, got %d", len(changes))
+	}
+	if ch := changes[0]; !ch.After.IsAccount() || ch.After.AddrHash != addrHashA ||
+		ch.Before.Account.Balance.Int64() != 10 || ch.After.Account.Balance.Int64() != 15 {
+		t.Errorf("unexpected change of the account %+v", ch)
+	}
+	if ch := changes[1]; ch.After.IsAccount() || string(ch.Before.Value) != "\x01" || string(ch.After.Value) != "\x02" {
+		t.Errorf("unexpected change of the storage %+v", ch)
+	}
+
+	changes, err = TxDiff(db, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Before.Account != nil || changes[0].After.Account.Balance.Int64() != 2 {
+		t.Errorf("unexpected changes of the rewards %+v", changes)
+	}
+
+	if _, err = TxDiff(db, 1, 3); err == nil {
+		t.Errorf("expected error for the transaction out of range")
+	}
+	if _, err = TxDiff(db, 2, 0); err == nil {
+		t.Errorf("expected error for the block without the recorded changes")
+	}
+}
@@ -0,0 +1,80 @@
+package state
+
+import (
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// The indices maintained next to the state (token balances, code reads) are not covered by the history
+// of the state, so the values they overwrite are kept in the IndexUndoBucket, by block, for the unwinds
+
+func undoKey(blockNr uint64, bucket, key []byte) []byte {
+	ts := dbutils.EncodeTimestamp(blockNr)
+	k := make([]byte, 0, len(ts)+1+len(bucket)+len(key))
+	k = append(k, ts...)
+	k = append(k, byte(len(bucket)))
+	k = append(k, bucket...)
+	return append(k, key...)
+}
+
+// recordUndo saves the value of the key in the bucket before its first change in the block, so that
+// unwindUndoLog can restore it. It is to be called before every write to the key
+func recordUndo(db ethdb.Database, blockNr uint64, bucket, key []byte) error {
+	k := undoKey(blockNr, bucket, key)
+	if _, err := db.Get(dbutils.IndexUndoBucket, k); err == nil {
+		return nil
+	} else if err != ethdb.ErrKeyNotFound {
+		return err
+	}
+	prev, err := db.Get(bucket, key)
+	if err != nil && err != ethdb.ErrKeyNotFound {
+		return err
+	}
+	v := []byte{0}
+	if err == nil {
+		v = append([]byte{1}, prev...)
+	}
+	return db.Put(dbutils.IndexUndoBucket, k, v)
+}
+
+type undoRecord struct {
+	k, bucket, key, value []byte
+}
+
+// unwindUndoLog restores the values saved by recordUndo for the blocks after blockNr, and removes the records
+func unwindUndoLog(db ethdb.Database, blockNr uint64) error {
+	var records []undoRecord
+	if err := db.Walk(dbutils.IndexUndoBucket, dbutils.EncodeTimestamp(blockNr+1), 0, func(k, v []byte) (bool, error) {
+		_, rest := dbutils.DecodeTimestamp(k)
+		if len(rest) == 0 || len(rest) < 1+int(rest[0]) || len(v) == 0 {
+			return true, nil
+		}
+		records = append(records, undoRecord{
+			k:      common.CopyBytes(k),
+			bucket: common.CopyBytes(rest[1 : 1+rest[0]]),
+			key:    common.CopyBytes(rest[1+rest[0]:]),
+			value:  common.CopyBytes(v),
+		})
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	// From the last block back, so that the value before the first unwound block is the one left
+	for i := len(records) - 1; i >= 0; i-- {
+		r := records[i]
+		var err error
+		if r.value[0] == 1 {
+			err = db.Put(r.bucket, r.key, r.value[1:])
+		} else {
+			err = db.Delete(r.bucket, r.key)
+		}
+		if err != nil {
+			return err
+		}
+		if err = db.Delete(dbutils.IndexUndoBucket, r.k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
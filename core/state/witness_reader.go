@@ -0,0 +1,115 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// MissingKeys are the parts of the state that are touched, but not present in the witness
+type MissingKeys struct {
+	Accounts []common.Hash // Address hashes
+	Storage  [][]byte      // Address hash + storage key hash
+	Codes    []common.Hash
+}
+
+// Empty tells whether nothing is missing
+func (m *MissingKeys) Empty() bool {
+	return len(m.Accounts) == 0 && len(m.Storage) == 0 && len(m.Codes) == 0
+}
+
+// WitnessStateReader implements StateReader over the state trie built from a witness, for the stateless
+// execution of the calls. Unlike Stateless, it does not fail on the parts of the state that are not in
+// the witness: they are read as empty and recorded (see Missing), so that the caller can tell that
+// the result is not reliable, and what the witness has to be extended with
+type WitnessStateReader struct {
+	t       *trie.Trie
+	codeMap trie.CodeMap
+	missing MissingKeys
+	seen    map[string]struct{} // Missing keys already recorded
+}
+
+// NewWitnessStateReader builds the state trie from the witness, checking that its root matches stateRoot
+func NewWitnessStateReader(stateRoot common.Hash, witness *trie.Witness, isBinary bool) (*WitnessStateReader, error) {
+	t, codeMap, err := trie.BuildTrieFromWitness(witness, isBinary, false)
+	if err != nil {
+		return nil, err
+	}
+	if !isBinary && t.Hash() != stateRoot {
+		return nil, fmt.Errorf("state root mismatch: witness gives %x, expected %x", t.Hash(), stateRoot)
+	}
+	return &WitnessStateReader{t: t, codeMap: codeMap, seen: make(map[string]struct{})}, nil
+}
+
+// Missing returns the keys touched so far that are not in the witness
+func (r *WitnessStateReader) Missing() *MissingKeys {
+	return &r.missing
+}
+
+// markMissing records the key once, returning true if it was not recorded before
+func (r *WitnessStateReader) markMissing(kind byte, key []byte) bool {
+	k := string(append([]byte{kind}, key...))
+	if _, ok := r.seen[k]; ok {
+		return false
+	}
+	r.seen[k] = struct{}{}
+	return true
+}
+
+func (r *WitnessStateReader) ReadAccountData(address common.Address) (*accounts.Account, error) {
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return nil, err
+	}
+	acc, ok := r.t.GetAccount(addrHash[:])
+	if !ok {
+		if r.markMissing('a', addrHash[:]) {
+			r.missing.Accounts = append(r.missing.Accounts, addrHash)
+		}
+		return nil, nil
+	}
+	return acc, nil
+}
+
+func (r *WitnessStateReader) ReadAccountStorage(address common.Address, incarnation uint64, key *common.Hash) ([]byte, error) {
+	addrHash, err := common.HashData(address[:])
+	if err != nil {
+		return nil, err
+	}
+	seckey, err := common.HashData(key[:])
+	if err != nil {
+		return nil, err
+	}
+	storageKey := dbutils.GenerateCompositeTrieKey(addrHash, seckey)
+	enc, ok := r.t.Get(storageKey)
+	if !ok {
+		if r.markMissing('s', storageKey) {
+			r.missing.Storage = append(r.missing.Storage, storageKey)
+		}
+		return nil, nil
+	}
+	return enc, nil
+}
+
+func (r *WitnessStateReader) ReadAccountCode(address common.Address, codeHash common.Hash) ([]byte, error) {
+	if bytes.Equal(codeHash[:], emptyCodeHash) {
+		return nil, nil
+	}
+	code, ok := r.codeMap[codeHash]
+	if !ok {
+		if r.markMissing('c', codeHash[:]) {
+			r.missing.Codes = append(r.missing.Codes, codeHash)
+		}
+		return nil, nil
+	}
+	return code, nil
+}
+
+func (r *WitnessStateReader) ReadAccountCodeSize(address common.Address, codeHash common.Hash) (int, error) {
+	code, err := r.ReadAccountCode(address, codeHash)
+	return len(code), err
+}
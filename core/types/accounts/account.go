@@ -1,6 +1,7 @@
 package accounts
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"math/big"
@@ -24,6 +25,7 @@ type Account struct {
 	Incarnation    uint64
 	HasStorageSize bool
 	StorageSize    uint64
+	Extra          []byte // Fields of the non-Ethereum account models, only encoded by their codecs (see SetCodec)
 }
 
 var emptyCodeHash = crypto.Keccak256Hash(nil)
@@ -49,7 +51,7 @@ func bytesToUint64(buf []byte) (x uint64) {
 	return
 }
 
-func (a *Account) EncodingLengthForStorage() uint {
+func (a *Account) encodingLengthForStorage() uint {
 	var structLength uint = 1 // 1 byte for fieldset
 
 	if b0.Cmp(&a.Balance) == -1 {
@@ -79,7 +81,7 @@ func (a *Account) EncodingLengthForStorage() uint {
 	return structLength
 }
 
-func (a *Account) EncodingLengthForHashing() uint {
+func (a *Account) encodingLengthForHashing() uint {
 	var structLength uint
 
 	var balanceBytes int
@@ -119,7 +121,7 @@ func (a *Account) EncodingLengthForHashing() uint {
 	return uint(1+lengthBytes) + structLength
 }
 
-func (a *Account) EncodeForStorage(buffer []byte) {
+func (a *Account) encodeForStorage(buffer []byte) {
 	var fieldSet = 0 // start with first bit set to 0
 	var pos = 1
 	if a.Nonce > 0 {
@@ -236,7 +238,7 @@ func (a *Account) EncodeRLP(w io.Writer) error {
 	return err
 }
 
-func (a *Account) EncodeForHashing(buffer []byte) {
+func (a *Account) encodeForHashing(buffer []byte) {
 
 	var balanceBytes int
 	if b128.Cmp(&a.Balance) == 1 && a.Balance.Sign() == 1 {
@@ -354,9 +356,10 @@ func (a *Account) Copy(image *Account) {
 	a.HasStorageSize = image.HasStorageSize
 	a.StorageSize = image.StorageSize
 	a.Incarnation = image.Incarnation
+	a.Extra = common.CopyBytes(image.Extra)
 }
 
-func (a *Account) DecodeForHashing(enc []byte) error {
+func (a *Account) decodeForHashing(enc []byte) error {
 	length, structure, pos := decodeLengthForHashing(enc, 0)
 	if pos+length != len(enc) {
 		return fmt.Errorf(
@@ -531,7 +534,7 @@ func (a *Account) DecodeForHashing(enc []byte) error {
 	return nil
 }
 
-func (a *Account) DecodeForStorage(enc []byte) error {
+func (a *Account) decodeForStorage(enc []byte) error {
 	a.Initialised = true
 	a.Nonce = 0
 	a.Incarnation = 0
@@ -540,12 +543,13 @@ func (a *Account) DecodeForStorage(enc []byte) error {
 	a.CodeHash = emptyCodeHash
 	a.StorageSize = 0
 	a.HasStorageSize = false
+	a.Extra = nil
 
-	var fieldSet = enc[0]
-	var pos = 1
 	if len(enc) == 0 {
 		return nil
 	}
+	var fieldSet = enc[0]
+	var pos = 1
 
 	if fieldSet&1 > 0 {
 		decodeLength := int(enc[pos])
@@ -678,5 +682,6 @@ func (a *Account) Equals(acc *Account) bool {
 		a.Balance.Cmp(&acc.Balance) == 0 &&
 		a.Incarnation == acc.Incarnation &&
 		a.HasStorageSize == acc.HasStorageSize &&
-		a.StorageSize == acc.StorageSize
+		a.StorageSize == acc.StorageSize &&
+		bytes.Equal(a.Extra, acc.Extra)
 }
@@ -0,0 +1,80 @@
+package accounts
+
+import "sync/atomic"
+
+// Codec is the encoding of the accounts in the database (storage encoding) and in the leaves of the state trie
+// (hashing encoding). The chains whose account models extend the Ethereum one (for example, with the staking
+// information, or with the storage rent paid so far) keep the extra fields in Account.Extra and plug their
+// encoding in with SetCodec, reusing the rest of the state machinery (TrieDbState, DbStateWriter, history)
+type Codec interface {
+	EncodingLengthForStorage(a *Account) uint
+	EncodeForStorage(buffer []byte, a *Account)
+	// DecodeForStorage decodes the account from its storage encoding, an empty encoding gives an empty account
+	DecodeForStorage(a *Account, enc []byte) error
+	EncodingLengthForHashing(a *Account) uint
+	EncodeForHashing(buffer []byte, a *Account)
+	// DecodeForHashing decodes the account from the leaf of the state trie, for example of a proof,
+	// and from the RLP streams (see Account.DecodeRLP)
+	DecodeForHashing(a *Account, enc []byte) error
+}
+
+// EthereumCodec is the encoding of the Ethereum accounts, used unless replaced by SetCodec.
+// It ignores Account.Extra
+type EthereumCodec struct{}
+
+func (EthereumCodec) EncodingLengthForStorage(a *Account) uint      { return a.encodingLengthForStorage() }
+func (EthereumCodec) EncodeForStorage(buffer []byte, a *Account)    { a.encodeForStorage(buffer) }
+func (EthereumCodec) DecodeForStorage(a *Account, enc []byte) error { return a.decodeForStorage(enc) }
+func (EthereumCodec) EncodingLengthForHashing(a *Account) uint      { return a.encodingLengthForHashing() }
+func (EthereumCodec) EncodeForHashing(buffer []byte, a *Account)    { a.encodeForHashing(buffer) }
+func (EthereumCodec) DecodeForHashing(a *Account, enc []byte) error { return a.decodeForHashing(enc) }
+
+// codecHolder wraps the codecs stored in the atomic.Value, which requires the same concrete type for all of them
+type codecHolder struct {
+	Codec
+}
+
+var codec atomic.Value
+
+func init() {
+	codec.Store(codecHolder{EthereumCodec{}})
+}
+
+// SetCodec replaces the encoding of the accounts, nil restores EthereumCodec. It is safe for concurrent use,
+// but the accounts encoded with one codec cannot be decoded with another one, so it is meant to be invoked
+// at the start, before any state is opened
+func SetCodec(c Codec) {
+	if c == nil {
+		c = EthereumCodec{}
+	}
+	codec.Store(codecHolder{c})
+}
+
+// CurrentCodec returns the encoding of the accounts in use
+func CurrentCodec() Codec {
+	return codec.Load().(codecHolder).Codec
+}
+
+func (a *Account) EncodingLengthForStorage() uint {
+	return CurrentCodec().EncodingLengthForStorage(a)
+}
+
+func (a *Account) EncodeForStorage(buffer []byte) {
+	CurrentCodec().EncodeForStorage(buffer, a)
+}
+
+func (a *Account) DecodeForStorage(enc []byte) error {
+	return CurrentCodec().DecodeForStorage(a, enc)
+}
+
+func (a *Account) EncodingLengthForHashing() uint {
+	return CurrentCodec().EncodingLengthForHashing(a)
+}
+
+func (a *Account) EncodeForHashing(buffer []byte) {
+	CurrentCodec().EncodeForHashing(buffer, a)
+}
+
+func (a *Account) DecodeForHashing(enc []byte) error {
+	return CurrentCodec().DecodeForHashing(a, enc)
+}
@@ -0,0 +1,168 @@
+package accounts
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+)
+
+// extraCodec prefixes the Ethereum storage encoding with the length of Account.Extra and Account.Extra itself
+type extraCodec struct {
+	EthereumCodec
+}
+
+func (c extraCodec) EncodingLengthForStorage(a *Account) uint {
+	return 1 + uint(len(a.Extra)) + c.EthereumCodec.EncodingLengthForStorage(a)
+}
+
+func (c extraCodec) EncodeForStorage(buffer []byte, a *Account) {
+	buffer[0] = byte(len(a.Extra))
+	copy(buffer[1:], a.Extra)
+	c.EthereumCodec.EncodeForStorage(buffer[1+len(a.Extra):], a)
+}
+
+func (c extraCodec) DecodeForStorage(a *Account, enc []byte) error {
+	if len(enc) == 0 {
+		return c.EthereumCodec.DecodeForStorage(a, enc)
+	}
+	n := int(enc[0])
+	if len(enc) < 1+n {
+		return fmt.Errorf("extra of %d bytes does not fit", n)
+	}
+	if err := c.EthereumCodec.DecodeForStorage(a, enc[1+n:]); err != nil {
+		return err
+	}
+	a.Extra = append([]byte{}, enc[1:1+n]...)
+	return nil
+}
+
+// extraHashing is the leaf of the state trie of extraCodec: the Ethereum fields followed by Account.Extra
+type extraHashing struct {
+	Nonce    uint64
+	Balance  *big.Int
+	Root     common.Hash
+	CodeHash common.Hash
+	Extra    []byte
+}
+
+func (extraCodec) hashing(a *Account) []byte {
+	enc, err := rlp.EncodeToBytes(&extraHashing{Nonce: a.Nonce, Balance: &a.Balance, Root: a.Root, CodeHash: a.CodeHash, Extra: a.Extra})
+	if err != nil {
+		panic(err)
+	}
+	return enc
+}
+
+func (c extraCodec) EncodingLengthForHashing(a *Account) uint {
+	return uint(len(c.hashing(a)))
+}
+
+func (c extraCodec) EncodeForHashing(buffer []byte, a *Account) {
+	copy(buffer, c.hashing(a))
+}
+
+func (extraCodec) DecodeForHashing(a *Account, enc []byte) error {
+	var h extraHashing
+	if err := rlp.DecodeBytes(enc, &h); err != nil {
+		return err
+	}
+	a.Initialised = true
+	a.Nonce = h.Nonce
+	a.Balance.Set(h.Balance)
+	a.Root = h.Root
+	a.CodeHash = h.CodeHash
+	a.Extra = h.Extra
+	return nil
+}
+
+func TestSetCodec(t *testing.T) {
+	SetCodec(extraCodec{})
+	defer SetCodec(nil)
+
+	a := NewAccount()
+	a.Initialised = true
+	a.Nonce = 3
+	a.Balance.SetInt64(1000)
+	a.Extra = []byte("paid-until:100")
+	enc := make([]byte, a.EncodingLengthForStorage())
+	a.EncodeForStorage(enc)
+
+	var decoded Account
+	if err := decoded.DecodeForStorage(enc); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equals(&a) {
+		t.Errorf("expected %+v, got %+v", a, decoded)
+	}
+	if copied := decoded.SelfCopy(); !bytes.Equal(copied.Extra, a.Extra) {
+		t.Errorf("expected the extra fields to be copied, got %x", copied.Extra)
+	}
+
+	SetCodec(nil)
+	if _, ok := CurrentCodec().(EthereumCodec); !ok {
+		t.Errorf("expected the default codec to be restored, got %T", CurrentCodec())
+	}
+	ethEnc := make([]byte, a.EncodingLengthForStorage())
+	a.EncodeForStorage(ethEnc)
+	if !bytes.Equal(ethEnc, enc[1+len(a.Extra):]) {
+		t.Errorf("expected the Ethereum encoding %x, got %x", enc[1+len(a.Extra):], ethEnc)
+	}
+}
+
+func TestCodecHashing(t *testing.T) {
+	SetCodec(extraCodec{})
+	defer SetCodec(nil)
+
+	a := NewAccount()
+	a.Initialised = true
+	a.Nonce = 3
+	a.Balance.SetInt64(1000)
+	a.Extra = []byte("stake:5")
+	// The RLP encoding is the one of the leaves of the state trie
+	enc, err := rlp.EncodeToBytes(&a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Account
+	if err = rlp.DecodeBytes(enc, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equals(&a) {
+		t.Errorf("expected %+v from the RLP stream, got %+v", a, decoded)
+	}
+	// The leaves of the proofs are decoded with DecodeForHashing
+	var leaf Account
+	if err = leaf.DecodeForHashing(enc); err != nil {
+		t.Fatal(err)
+	}
+	if !leaf.Equals(&a) {
+		t.Errorf("expected %+v from the leaf, got %+v", a, leaf)
+	}
+}
+
+func TestSetCodecConcurrently(t *testing.T) {
+	defer SetCodec(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetCodec(extraCodec{})
+		}()
+		go func() {
+			defer wg.Done()
+			a := NewAccount()
+			a.Nonce = 1
+			// The codec is read once per call, so the length matches the encoding
+			c := CurrentCodec()
+			enc := make([]byte, c.EncodingLengthForStorage(&a))
+			c.EncodeForStorage(enc, &a)
+		}()
+	}
+	wg.Wait()
+}
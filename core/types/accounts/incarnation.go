@@ -0,0 +1,60 @@
+package accounts
+
+import (
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+)
+
+// FirstContractIncarnation is the incarnation of a contract created at an address that never had storage before
+const FirstContractIncarnation = 1
+
+// StorageWalker is the part of ethdb.Getter used by NextIncarnation (ethdb cannot be imported here)
+type StorageWalker interface {
+	Walk(bucket, startkey []byte, fixedbits uint, walker func([]byte, []byte) (bool, error)) error
+}
+
+// HistoricalStorageWalker is the part of ethdb.Getter used by NextIncarnationAsOf
+type HistoricalStorageWalker interface {
+	WalkAsOf(bucket, hBucket, startkey []byte, fixedbits uint, timestamp uint64, walker func([]byte, []byte) (bool, error)) error
+}
+
+// maxTimestampLength is the space reserved at the end of the start key of WalkAsOf for the encoded timestamp
+// (same as ethdb.MaxTimestampLength)
+const maxTimestampLength = 8
+
+// NextIncarnation determines what should be the incarnation of a contract created at the given address
+// (i.e. how many times a contract has existed at this address before, plus one), from the current state.
+// Storage keys carry the inverted incarnation (see dbutils.EncodeIncarnation), so the first storage
+// item of the account belongs to its latest incarnation
+func NextIncarnation(db StorageWalker, addrHash common.Hash) (uint64, error) {
+	startkey := make([]byte, common.HashLength+common.IncarnationLength+common.HashLength)
+	copy(startkey, addrHash[:])
+	return nextIncarnation(func(walker func([]byte, []byte) (bool, error)) error {
+		return db.Walk(dbutils.StorageBucket, startkey, 8*common.HashLength, walker)
+	})
+}
+
+// NextIncarnationAsOf is the same as NextIncarnation, but for the state as of the given block
+func NextIncarnationAsOf(db HistoricalStorageWalker, addrHash common.Hash, blockNr uint64) (uint64, error) {
+	startkey := make([]byte, common.HashLength+common.IncarnationLength+common.HashLength+maxTimestampLength)
+	copy(startkey, addrHash[:])
+	return nextIncarnation(func(walker func([]byte, []byte) (bool, error)) error {
+		return db.WalkAsOf(dbutils.StorageBucket, dbutils.StorageHistoryBucket, startkey, 8*common.HashLength, blockNr, walker)
+	})
+}
+
+func nextIncarnation(walk func(walker func([]byte, []byte) (bool, error)) error) (uint64, error) {
+	var found bool
+	var incarnation uint64
+	if err := walk(func(k, _ []byte) (bool, error) {
+		incarnation = dbutils.DecodeIncarnation(k[common.HashLength:])
+		found = true
+		return false, nil
+	}); err != nil {
+		return 0, err
+	}
+	if found {
+		return incarnation + 1, nil
+	}
+	return FirstContractIncarnation, nil
+}
@@ -0,0 +1,94 @@
+package accounts
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/hexutil"
+)
+
+// AccountJSON is the JSON form of the account, for the external tools working with the storage encoding
+// of the accounts (see DecodeForStorageString and EncodeFromJSON)
+type AccountJSON struct {
+	Nonce       hexutil.Uint64  `json:"nonce"`
+	Balance     *hexutil.Big    `json:"balance"`
+	Root        common.Hash     `json:"root"`
+	CodeHash    common.Hash     `json:"codeHash"`
+	Incarnation hexutil.Uint64  `json:"incarnation"`
+	StorageSize *hexutil.Uint64 `json:"storageSize,omitempty"`
+	Extra       hexutil.Bytes   `json:"extra,omitempty"` // See Codec
+}
+
+// NewAccountJSON converts the account into its JSON form
+func NewAccountJSON(a *Account) *AccountJSON {
+	j := &AccountJSON{
+		Nonce:       hexutil.Uint64(a.Nonce),
+		Balance:     (*hexutil.Big)(new(big.Int).Set(&a.Balance)),
+		Root:        a.Root,
+		CodeHash:    a.CodeHash,
+		Incarnation: hexutil.Uint64(a.Incarnation),
+		Extra:       common.CopyBytes(a.Extra),
+	}
+	if a.HasStorageSize {
+		storageSize := hexutil.Uint64(a.StorageSize)
+		j.StorageSize = &storageSize
+	}
+	return j
+}
+
+// Account converts the JSON form back into the account. The missing root and code hash are those of the
+// account without storage and code
+func (j *AccountJSON) Account() *Account {
+	a := NewAccount()
+	a.Initialised = true
+	a.Nonce = uint64(j.Nonce)
+	if j.Balance != nil {
+		a.Balance.Set(j.Balance.ToInt())
+	}
+	if j.Root != (common.Hash{}) {
+		a.Root = j.Root
+	}
+	if j.CodeHash != (common.Hash{}) {
+		a.CodeHash = j.CodeHash
+	}
+	a.Incarnation = uint64(j.Incarnation)
+	if j.StorageSize != nil {
+		a.HasStorageSize = true
+		a.StorageSize = uint64(*j.StorageSize)
+	}
+	a.Extra = common.CopyBytes(j.Extra)
+	return &a
+}
+
+// DecodeForStorageString decodes the account from the hex string (with or without 0x prefix) of its storage
+// encoding, as found in the AccountsBucket and in the account history
+func DecodeForStorageString(enc string) (*Account, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(enc, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty account encoding")
+	}
+	var a Account
+	if err = a.DecodeForStorage(b); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// EncodeFromJSON produces the storage encoding of the account given in its JSON form (see AccountJSON)
+func EncodeFromJSON(data []byte) ([]byte, error) {
+	var j AccountJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+	a := j.Account()
+	enc := make([]byte, a.EncodingLengthForStorage())
+	a.EncodeForStorage(enc)
+	return enc, nil
+}
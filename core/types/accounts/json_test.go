@@ -0,0 +1,59 @@
+package accounts
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+func TestAccountJSONRoundTrip(t *testing.T) {
+	a := NewAccount()
+	a.Initialised = true
+	a.Nonce = 42
+	a.Balance.SetUint64(1000000)
+	a.Incarnation = 3
+	a.Root = common.HexToHash("0x1234")
+	a.HasStorageSize = true
+	a.StorageSize = 17
+	enc := make([]byte, a.EncodingLengthForStorage())
+	a.EncodeForStorage(enc)
+
+	decoded, err := DecodeForStorageString("0x" + hex.EncodeToString(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equals(&a) {
+		t.Errorf("expected %+v, got %+v", a, decoded)
+	}
+
+	data, err := json.Marshal(NewAccountJSON(decoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reencoded, err := EncodeFromJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(reencoded) != hex.EncodeToString(enc) {
+		t.Errorf("expected %x, got %x (from %s)", enc, reencoded, data)
+	}
+
+	// Missing hashes are those of the account without storage and code
+	if enc, err = EncodeFromJSON([]byte(`{"nonce":"0x1","balance":"0x10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err = DecodeForStorageString(hex.EncodeToString(enc)); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Nonce != 1 || decoded.Balance.Uint64() != 16 || !decoded.IsEmptyRoot() || !decoded.IsEmptyCodeHash() {
+		t.Errorf("unexpected account %+v", decoded)
+	}
+
+	for _, s := range []string{"", "0x", "zz"} {
+		if _, err = DecodeForStorageString(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
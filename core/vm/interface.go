@@ -44,6 +44,7 @@ type IntraBlockState interface {
 	GetRefund() uint64
 
 	GetCommittedState(common.Address, common.Hash) common.Hash
+	GetOriginalState(common.Address, common.Hash) common.Hash
 	GetState(common.Address, common.Hash) common.Hash
 	SetState(common.Address, common.Hash, common.Hash)
 
@@ -66,6 +67,12 @@ type IntraBlockState interface {
 	AddPreimage(common.Hash, []byte)
 }
 
+// touchDepthSetter is optionally implemented by IntraBlockState to attribute the touches
+// of the state trie to the call depth, see state.TouchOrigin
+type touchDepthSetter interface {
+	SetTouchDepth(depth int)
+}
+
 // CallContext provides a basic interface for the EVM calling conventions. The EVM
 // depends on this context being implemented for doing subcalls and initialising new EVM contracts.
 type CallContext interface {
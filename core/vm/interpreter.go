@@ -142,6 +142,10 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 	// Increment the call depth which is restricted to 1024
 	in.evm.depth++
 	defer func() { in.evm.depth-- }()
+	if s, ok := in.evm.IntraBlockState.(touchDepthSetter); ok {
+		s.SetTouchDepth(in.evm.depth)
+		defer s.SetTouchDepth(in.evm.depth - 1)
+	}
 
 	// Make sure the readOnly is only set if we aren't in readOnly yet.
 	// This makes also sure that the readOnly flag isn't removed for child calls.
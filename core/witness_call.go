@@ -0,0 +1,36 @@
+package core
+
+import (
+	"github.com/ledgerwatch/turbo-geth/core/state"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/vm"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+// WitnessCallResult is the result of ApplyMessageOnWitness
+type WitnessCallResult struct {
+	ReturnData []byte
+	UsedGas    uint64
+	Failed     bool
+	// Parts of the state touched by the call, but not present in the witness. If not empty, the witness
+	// is insufficient, and the other fields are not reliable, as the missing parts are read as empty
+	Missing *state.MissingKeys
+}
+
+// ApplyMessageOnWitness executes the call (as eth_call does) against the state given only by the witness,
+// which has to match the state root of the header. It lets the stateless RPC gateways serve the calls.
+// The chain is only consulted for the hashes of the previous blocks (BLOCKHASH opcode)
+func ApplyMessageOnWitness(config *params.ChainConfig, chain ChainContext, header *types.Header, witness *trie.Witness, msg Message) (*WitnessCallResult, error) {
+	reader, err := state.NewWitnessStateReader(header.Root, witness, config.IsBinaryTrie(header.Number))
+	if err != nil {
+		return nil, err
+	}
+	ibs := state.New(reader)
+	vmenv := vm.NewEVM(NewEVMContext(msg, header, chain, &header.Coinbase), ibs, config, vm.Config{})
+	ret, gas, failed, err := ApplyMessage(vmenv, msg, new(GasPool).AddGas(msg.Gas()))
+	if err != nil {
+		return nil, err
+	}
+	return &WitnessCallResult{ReturnData: ret, UsedGas: gas, Failed: failed, Missing: reader.Missing()}, nil
+}
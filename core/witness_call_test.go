@@ -0,0 +1,70 @@
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/params"
+	"github.com/ledgerwatch/turbo-geth/trie"
+)
+
+func TestApplyMessageOnWitness(t *testing.T) {
+	caller, contract := common.HexToAddress("0x1"), common.HexToAddress("0x2")
+	callerHash, contractHash := crypto.Keccak256(caller[:]), crypto.Keccak256(contract[:])
+	// PUSH1 0 SLOAD PUSH1 0 MSTORE PUSH1 32 PUSH1 0 RETURN
+	code := common.FromHex("0x60005460005260206000f3")
+	slotHash := crypto.Keccak256(common.Hash{}.Bytes())
+
+	tr := trie.New(common.Hash{})
+	callerAcc := accounts.NewAccount()
+	callerAcc.Balance.SetInt64(1000)
+	tr.UpdateAccount(callerHash, &callerAcc)
+	contractAcc := accounts.NewAccount()
+	contractAcc.CodeHash = crypto.Keccak256Hash(code)
+	tr.UpdateAccount(contractHash, &contractAcc)
+	storageKey := dbutils.GenerateCompositeTrieKey(common.BytesToHash(contractHash), common.BytesToHash(slotHash))
+	tr.Update(storageKey, []byte{0x2a}, 0)
+	header := &types.Header{Number: big.NewInt(1), Root: tr.Hash(), GasLimit: 1000000, Difficulty: new(big.Int)}
+
+	witness := func(keys ...[]byte) *trie.Witness {
+		rs := trie.NewResolveSet(0)
+		for _, key := range keys {
+			rs.AddKey(key)
+		}
+		w, err := tr.ExtractWitness(1, false, rs, trie.CodeMap{contractAcc.CodeHash: code})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	msg := types.NewMessage(caller, &contract, 0, new(big.Int), 100000, new(big.Int), nil, false)
+
+	res, err := ApplyMessageOnWitness(params.TestChainConfig, nil, header, witness(callerHash, contractHash, storageKey), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Missing.Empty() {
+		t.Errorf("expected nothing missing, got %+v", res.Missing)
+	}
+	if res.Failed || res.UsedGas == 0 || new(big.Int).SetBytes(res.ReturnData).Int64() != 0x2a {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	res, err = ApplyMessageOnWitness(params.TestChainConfig, nil, header, witness(callerHash), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Missing.Accounts) != 1 || res.Missing.Accounts[0] != common.BytesToHash(contractHash) {
+		t.Errorf("expected the contract account to be missing, got %+v", res.Missing)
+	}
+
+	header.Root = common.Hash{1}
+	if _, err = ApplyMessageOnWitness(params.TestChainConfig, nil, header, witness(callerHash), msg); err == nil {
+		t.Errorf("expected error for the witness not matching the state root")
+	}
+}
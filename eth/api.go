@@ -25,6 +25,7 @@ import (
 	"math/big"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
@@ -312,6 +313,105 @@ func (api *PrivateDebugAPI) Preimage(ctx context.Context, hash common.Hash) (hex
 	return nil, errors.New("unknown preimage")
 }
 
+// ContractSizeResult is the entry of the list returned by debug_topContractsBySize
+type ContractSizeResult struct {
+	AddrHash common.Hash     `json:"addrHash"`
+	Address  *common.Address `json:"address"` // nil if the preimage of the address hash is unknown
+	Slots    uint64          `json:"slots"`
+	Bytes    uint64          `json:"bytes"`
+}
+
+// TopContractsBySizeMaxResults is the maximum number of results to be returned by debug_topContractsBySize
+const TopContractsBySizeMaxResults = 1024
+
+// TopContractsBySize returns the contracts with the largest storage in the database, in the descending order of size
+func (api *PrivateDebugAPI) TopContractsBySize(ctx context.Context, n int) ([]ContractSizeResult, error) {
+	if n > TopContractsBySizeMaxResults {
+		n = TopContractsBySizeMaxResults
+	}
+	top, err := state.TopContractsBySize(api.eth.ChainDb(), n)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]ContractSizeResult, len(top))
+	for i, cs := range top {
+		results[i] = ContractSizeResult{AddrHash: cs.AddrHash, Slots: cs.Slots, Bytes: cs.Bytes}
+		if preimage := rawdb.ReadPreimage(api.eth.ChainDb(), cs.AddrHash); len(preimage) == common.AddressLength {
+			address := common.BytesToAddress(preimage)
+			results[i].Address = &address
+		}
+	}
+	return results, nil
+}
+
+// TouchOriginResult is the number of touches of the storage trie of a contract with the same origin
+type TouchOriginResult struct {
+	TxHash  common.Hash `json:"txHash"`
+	Depth   int         `json:"depth"`
+	Touches int         `json:"touches"`
+}
+
+// ContractTouchResult is the entry of the list returned by debug_blockTouchStats
+type ContractTouchResult struct {
+	AddrHash common.Hash         `json:"addrHash"`
+	Address  *common.Address     `json:"address"` // nil if the preimage of the address hash is unknown
+	Touches  int                 `json:"touches"`
+	Origins  []TouchOriginResult `json:"origins"`
+}
+
+// BlockTouchStatsResult is the result of debug_blockTouchStats
+type BlockTouchStatsResult struct {
+	AccountTouches int                   `json:"accountTouches"`
+	Contracts      []ContractTouchResult `json:"contracts"`
+}
+
+// BlockTouchStats returns the touches of the state trie made by the last processed block, for (at most) n contracts
+// with the most touches. The counting has to be enabled with BlockChain.SetTouchStats
+func (api *PrivateDebugAPI) BlockTouchStats(ctx context.Context, n int) (*BlockTouchStatsResult, error) {
+	if n > TopContractsBySizeMaxResults {
+		n = TopContractsBySizeMaxResults
+	}
+	tds, err := api.eth.BlockChain().GetTrieDbState()
+	if err != nil {
+		return nil, err
+	}
+	stats := tds.BlockTouchStats()
+	if stats == nil {
+		return nil, errors.New("touch statistics are not enabled")
+	}
+	result := &BlockTouchStatsResult{AccountTouches: stats.AccountTouches}
+	for _, addrHash := range stats.TopContracts(n) {
+		cs := stats.Contracts[addrHash]
+		r := ContractTouchResult{AddrHash: addrHash, Touches: cs.Touches}
+		if preimage := rawdb.ReadPreimage(api.eth.ChainDb(), addrHash); len(preimage) == common.AddressLength {
+			address := common.BytesToAddress(preimage)
+			r.Address = &address
+		}
+		for origin, touches := range cs.ByOrigin {
+			r.Origins = append(r.Origins, TouchOriginResult{TxHash: origin.TxHash, Depth: origin.Depth, Touches: touches})
+		}
+		sort.Slice(r.Origins, func(i, j int) bool { return r.Origins[i].Touches > r.Origins[j].Touches })
+		result.Contracts = append(result.Contracts, r)
+	}
+	return result, nil
+}
+
+// StateChecksumResult is the result of debug_stateChecksum
+type StateChecksumResult struct {
+	BlockNumber hexutil.Uint64 `json:"blockNumber"`
+	Checksum    common.Hash    `json:"checksum"`
+}
+
+// StateChecksum returns the checksum of the flat state (see state.ComputeStateChecksum) after the last committed block,
+// for comparing the full states of two nodes at the same block. It has to be enabled with BlockChain.SetStateChecksum
+func (api *PrivateDebugAPI) StateChecksum(ctx context.Context) (*StateChecksumResult, error) {
+	blockNr, checksum, ok := state.ReadStateChecksum(api.eth.ChainDb())
+	if !ok {
+		return nil, errors.New("state checksum is not available")
+	}
+	return &StateChecksumResult{BlockNumber: hexutil.Uint64(blockNr), Checksum: checksum}, nil
+}
+
 // BadBlockArgs represents the entries in the list returned when bad blocks are queried.
 type BadBlockArgs struct {
 	Hash  common.Hash            `json:"hash"`
@@ -186,6 +186,9 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 			TrieDirtyLimit:      config.TrieDirtyCache,
 			TrieCleanNoPrefetch: config.NoPrefetch,
 			TrieTimeLimit:       config.TrieTimeout,
+			TrieCacheGens:       config.TrieCacheGens,
+			TrieSnapshotBlocks:  config.TrieSnapshotBlocks,
+			HistoryBatching:     config.HistoryBatching,
 			DownloadOnly:        config.DownloadOnly,
 			NoHistory:           !config.StorageMode.History,
 			ArchiveSyncInterval: uint64(config.ArchiveSyncInterval),
@@ -179,6 +179,10 @@ type Config struct {
 	TrieCleanCache int
 	TrieDirtyCache int
 	TrieTimeout    time.Duration
+	TrieCacheGens  uint32 // Number of trie node generations to keep in memory, default if zero
+
+	TrieSnapshotBlocks uint64 // Blocks between the snapshots of the trie for fast restart, disabled if zero
+	HistoryBatching    bool   // Write the history records of a block in one pass when the block is committed
 
 	// Mining options
 	Miner miner.Config
@@ -38,6 +38,9 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		TrieCleanCache          int
 		TrieDirtyCache          int
 		TrieTimeout             time.Duration
+		TrieCacheGens           uint32
+		TrieSnapshotBlocks      uint64
+		HistoryBatching         bool
 		Miner                   miner.Config
 		Ethash                  ethash.Config
 		TxPool                  core.TxPoolConfig
@@ -70,6 +73,9 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.TrieCleanCache = c.TrieCleanCache
 	enc.TrieDirtyCache = c.TrieDirtyCache
 	enc.TrieTimeout = c.TrieTimeout
+	enc.TrieCacheGens = c.TrieCacheGens
+	enc.TrieSnapshotBlocks = c.TrieSnapshotBlocks
+	enc.HistoryBatching = c.HistoryBatching
 	enc.Miner = c.Miner
 	enc.Ethash = c.Ethash
 	enc.TxPool = c.TxPool
@@ -107,6 +113,9 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		TrieCleanCache          *int
 		TrieDirtyCache          *int
 		TrieTimeout             *time.Duration
+		TrieCacheGens           *uint32
+		TrieSnapshotBlocks      *uint64
+		HistoryBatching         *bool
 		Miner                   *miner.Config
 		Ethash                  *ethash.Config
 		TxPool                  *core.TxPoolConfig
@@ -184,6 +193,15 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.TrieTimeout != nil {
 		c.TrieTimeout = *dec.TrieTimeout
 	}
+	if dec.TrieCacheGens != nil {
+		c.TrieCacheGens = *dec.TrieCacheGens
+	}
+	if dec.TrieSnapshotBlocks != nil {
+		c.TrieSnapshotBlocks = *dec.TrieSnapshotBlocks
+	}
+	if dec.HistoryBatching != nil {
+		c.HistoryBatching = *dec.HistoryBatching
+	}
 	if dec.Miner != nil {
 		c.Miner = *dec.Miner
 	}
@@ -325,70 +325,71 @@ func (db *BadgerDatabase) MultiWalk(bucket []byte, startkeys [][]byte, fixedbits
 	if len(startkeys) == 0 {
 		return nil
 	}
+	return db.db.View(func(tx *badger.Txn) error {
+		return badgerMultiWalk(tx, bucket, startkeys, fixedbits, walker)
+	})
+}
 
+func badgerMultiWalk(tx *badger.Txn, bucket []byte, startkeys [][]byte, fixedbits []uint, walker func(int, []byte, []byte) error) error {
 	rangeIdx := 0 // What is the current range we are extracting
 	fixedbytes, mask := Bytesmask(fixedbits[rangeIdx])
 	startkey := startkeys[rangeIdx]
 
-	err := db.db.View(func(tx *badger.Txn) error {
-		it := tx.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		for it.Seek(bucketKey(bucket, startkey)); it.Valid(); it.Next() {
-			item := it.Item()
-			k := keyWithoutBucket(item.Key(), bucket)
-			if k == nil {
-				return nil
-			}
+	it := tx.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(bucketKey(bucket, startkey)); it.Valid(); it.Next() {
+		item := it.Item()
+		k := keyWithoutBucket(item.Key(), bucket)
+		if k == nil {
+			return nil
+		}
 
-			// Adjust rangeIdx if needed
-			if fixedbytes > 0 {
-				cmp := int(-1)
-				for cmp != 0 {
-					cmp = bytes.Compare(k[:fixedbytes-1], startkey[:fixedbytes-1])
-					if cmp == 0 {
-						k1 := k[fixedbytes-1] & mask
-						k2 := startkey[fixedbytes-1] & mask
-						if k1 < k2 {
-							cmp = -1
-						} else if k1 > k2 {
-							cmp = 1
-						}
+		// Adjust rangeIdx if needed
+		if fixedbytes > 0 {
+			cmp := int(-1)
+			for cmp != 0 {
+				cmp = bytes.Compare(k[:fixedbytes-1], startkey[:fixedbytes-1])
+				if cmp == 0 {
+					k1 := k[fixedbytes-1] & mask
+					k2 := startkey[fixedbytes-1] & mask
+					if k1 < k2 {
+						cmp = -1
+					} else if k1 > k2 {
+						cmp = 1
+					}
+				}
+				if cmp < 0 {
+					it.Seek(bucketKey(bucket, startkey))
+					if !it.Valid() {
+						return nil
+					}
+					item = it.Item()
+					k = keyWithoutBucket(item.Key(), bucket)
+					if k == nil {
+						return nil
 					}
-					if cmp < 0 {
-						it.Seek(bucketKey(bucket, startkey))
-						if !it.Valid() {
-							return nil
-						}
-						item = it.Item()
-						k = keyWithoutBucket(item.Key(), bucket)
-						if k == nil {
-							return nil
-						}
-					} else if cmp > 0 {
-						rangeIdx++
-						if rangeIdx == len(startkeys) {
-							return nil
-						}
-						fixedbytes, mask = Bytesmask(fixedbits[rangeIdx])
-						startkey = startkeys[rangeIdx]
+				} else if cmp > 0 {
+					rangeIdx++
+					if rangeIdx == len(startkeys) {
+						return nil
 					}
+					fixedbytes, mask = Bytesmask(fixedbits[rangeIdx])
+					startkey = startkeys[rangeIdx]
 				}
 			}
+		}
 
-			err := item.Value(func(v []byte) error {
-				if len(v) == 0 {
-					return nil
-				}
-				return walker(rangeIdx, k, v)
-			})
-			if err != nil {
-				return err
+		err := item.Value(func(v []byte) error {
+			if len(v) == 0 {
+				return nil
 			}
+			return walker(rangeIdx, k, v)
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
-
-	return err
+	}
+	return nil
 }
 
 // MultiPut inserts or updates multiple entries.
@@ -496,3 +497,87 @@ func (db *BadgerDatabase) TruncateAncients(items uint64) error {
 func (db *BadgerDatabase) ID() uint64 {
 	return db.id
 }
+
+// NewSnapshot pins a read transaction
+func (db *BadgerDatabase) NewSnapshot() (Snapshot, error) {
+	return &badgerSnapshot{txn: db.db.NewTransaction(false)}, nil
+}
+
+type badgerSnapshot struct {
+	txn *badger.Txn
+}
+
+func (s *badgerSnapshot) Get(bucket, key []byte) ([]byte, error) {
+	item, err := s.txn.Get(bucketKey(bucket, key))
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (s *badgerSnapshot) NewIterator(bucket, start []byte) Iterator {
+	return &badgerIterator{it: s.txn.NewIterator(badger.DefaultIteratorOptions), bucket: bucket, start: start}
+}
+
+func (s *badgerSnapshot) MultiWalk(bucket []byte, startkeys [][]byte, fixedbits []uint, walker func(int, []byte, []byte) error) error {
+	if len(startkeys) == 0 {
+		return nil
+	}
+	return badgerMultiWalk(s.txn, bucket, startkeys, fixedbits, walker)
+}
+
+func (s *badgerSnapshot) Release() {
+	if s.txn != nil {
+		s.txn.Discard()
+		s.txn = nil
+	}
+}
+
+type badgerIterator struct {
+	it      *badger.Iterator
+	bucket  []byte
+	start   []byte
+	started bool
+	k, v    []byte
+	err     error
+}
+
+func (it *badgerIterator) Next() bool {
+	if it.it == nil || it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		it.it.Seek(bucketKey(it.bucket, it.start))
+	} else {
+		it.it.Next()
+	}
+	it.k, it.v = nil, nil
+	if !it.it.Valid() {
+		return false
+	}
+	item := it.it.Item()
+	if it.k = keyWithoutBucket(item.Key(), it.bucket); it.k == nil {
+		return false
+	}
+	if it.v, it.err = item.ValueCopy(nil); it.err != nil {
+		it.k = nil
+		return false
+	}
+	return true
+}
+
+func (it *badgerIterator) Error() error  { return it.err }
+func (it *badgerIterator) Key() []byte   { return it.k }
+func (it *badgerIterator) Value() []byte { return it.v }
+
+func (it *badgerIterator) Release() {
+	if it.it != nil {
+		it.it.Close()
+		it.it = nil
+	}
+	it.k, it.v = nil, nil
+}
@@ -0,0 +1,216 @@
+package ethdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+// historyBitmapBucket returns the bucket of the bitmaps indexing the historical bucket, or nil if it is not indexed
+func historyBitmapBucket(hBucket []byte) []byte {
+	switch {
+	case bytes.Equal(hBucket, dbutils.AccountsHistoryBucket):
+		return dbutils.AccountsHistoryBitmapBucket
+	case bytes.Equal(hBucket, dbutils.StorageHistoryBucket):
+		return dbutils.StorageHistoryBitmapBucket
+	default:
+		return nil
+	}
+}
+
+// HistoryBitmapProgress returns the number of the last block merged into the history bitmaps
+func HistoryBitmapProgress(db Getter) (uint64, error) {
+	v, err := db.Get(dbutils.HistoryBitmapProgressKey, dbutils.HistoryBitmapProgressKey)
+	if err != nil && err != ErrKeyNotFound {
+		return 0, err
+	}
+	if len(v) < 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+func putHistoryBitmapProgress(db Putter, blockNr uint64) error {
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], blockNr)
+	return db.Put(dbutils.HistoryBitmapProgressKey, dbutils.HistoryBitmapProgressKey, v[:])
+}
+
+// ReadHistoryBitmap returns the bitmap of the blocks (merged so far) changing the key of the historical bucket
+func ReadHistoryBitmap(db Getter, hBucket, key []byte) (*RoaringBitmap, error) {
+	v, err := db.Get(historyBitmapBucket(hBucket), key)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+	return DecodeRoaringBitmap(v)
+}
+
+// MergeHistoryBitmaps adds the blocks after the last merged one, up to toBlock, to the roaring bitmaps of the blocks
+// changing every account and every storage item, built from the ChangeSets. The bitmaps compact the lists of
+// the change blocks of the history index, and are looked up by GetAsOfIndexed.
+// It is to be invoked periodically with the blocks whose ChangeSets are already in the database
+func MergeHistoryBitmaps(db Database, toBlock uint64) error {
+	progress, err := HistoryBitmapProgress(db)
+	if err != nil {
+		return err
+	}
+	if toBlock <= progress {
+		return nil
+	}
+	// bitmap bucket => key => blocks since the last merge
+	changes := make(map[string]map[string]*RoaringBitmap)
+	var walkErr error
+	if err = db.Walk(dbutils.ChangeSetBucket, dbutils.EncodeTimestamp(progress+1), 0, func(k, v []byte) (bool, error) {
+		timestamp, hBucket := dbutils.DecodeTimestamp(k)
+		if timestamp > toBlock {
+			return false, nil
+		}
+		bitmapBucket := historyBitmapBucket(hBucket)
+		if bitmapBucket == nil {
+			return true, nil
+		}
+		m, ok := changes[string(bitmapBucket)]
+		if !ok {
+			m = make(map[string]*RoaringBitmap)
+			changes[string(bitmapBucket)] = m
+		}
+		walkErr = dbutils.Walk(v, func(key, _ []byte) error {
+			rb, ok := m[string(key)]
+			if !ok {
+				rb = NewRoaringBitmap()
+				m[string(key)] = rb
+			}
+			return rb.Add(timestamp)
+		})
+		return walkErr == nil, walkErr
+	}); err != nil {
+		return err
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+
+	for bucket, m := range changes {
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			v, err := db.Get([]byte(bucket), []byte(key))
+			if err != nil && err != ErrKeyNotFound {
+				return err
+			}
+			rb, err := DecodeRoaringBitmap(v)
+			if err != nil {
+				return err
+			}
+			rb.Or(m[key])
+			if err = db.Put([]byte(bucket), []byte(key), rb.Encode()); err != nil {
+				return err
+			}
+		}
+	}
+	return putHistoryBitmapProgress(db, toBlock)
+}
+
+// UnwindHistoryBitmaps removes the blocks after blockNr from the history bitmaps. The ChangeSets of the removed
+// blocks are still to be in the database
+func UnwindHistoryBitmaps(db Database, blockNr uint64) error {
+	progress, err := HistoryBitmapProgress(db)
+	if err != nil {
+		return err
+	}
+	if progress <= blockNr {
+		return nil
+	}
+	for _, hBucket := range [][]byte{dbutils.AccountsHistoryBucket, dbutils.StorageHistoryBucket} {
+		bitmapBucket := historyBitmapBucket(hBucket)
+		removed := make(map[string][]uint64)
+		for timestamp := progress; timestamp > blockNr; timestamp-- {
+			cs, err := db.Get(dbutils.ChangeSetBucket, dbutils.CompositeChangeSetKey(dbutils.EncodeTimestamp(timestamp), hBucket))
+			if err != nil && err != ErrKeyNotFound {
+				return err
+			}
+			if err = dbutils.Walk(cs, func(key, _ []byte) error {
+				removed[string(key)] = append(removed[string(key)], timestamp)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		for key, timestamps := range removed {
+			rb, err := ReadHistoryBitmap(db, hBucket, []byte(key))
+			if err != nil {
+				return err
+			}
+			for _, timestamp := range timestamps {
+				rb.Remove(timestamp)
+			}
+			if rb.Cardinality() == 0 {
+				err = db.Delete(bitmapBucket, []byte(key))
+			} else {
+				err = db.Put(bitmapBucket, []byte(key), rb.Encode())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return putHistoryBitmapProgress(db, blockNr)
+}
+
+// GetAsOfIndexed returns the same value as GetAsOf, finding the first block changing the key since the timestamp
+// by the rank and the select of its history bitmap, and taking the value from the ChangeSet of that block.
+// The blocks after the last merged one (see MergeHistoryBitmaps) are looked up by GetAsOf
+func GetAsOfIndexed(db Getter, bucket, hBucket, key []byte, timestamp uint64) ([]byte, error) {
+	progress, err := HistoryBitmapProgress(db)
+	if err != nil {
+		return nil, err
+	}
+	if timestamp > progress || historyBitmapBucket(hBucket) == nil {
+		return db.GetAsOf(bucket, hBucket, key, timestamp)
+	}
+	rb, err := ReadHistoryBitmap(db, hBucket, key)
+	if err != nil {
+		return nil, err
+	}
+	changeBlock, ok := rb.Seek(timestamp)
+	if !ok {
+		// Not changed since the timestamp up to the last merged block
+		return db.GetAsOf(bucket, hBucket, key, progress+1)
+	}
+	cs, err := db.Get(dbutils.ChangeSetBucket, dbutils.CompositeChangeSetKey(dbutils.EncodeTimestamp(changeBlock), hBucket))
+	if err != nil {
+		return nil, err
+	}
+	data, err := dbutils.FindLast(cs, key)
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+	data = common.CopyBytes(data)
+	if len(data) == 0 || !bytes.Equal(hBucket, dbutils.AccountsHistoryBucket) {
+		return data, nil
+	}
+	// Thin history does not keep the code hashes of the contracts
+	var acc accounts.Account
+	if err = acc.DecodeForStorage(data); err != nil {
+		return nil, err
+	}
+	if acc.Incarnation > 0 && acc.IsEmptyCodeHash() {
+		codeHash, err := db.Get(dbutils.ContractCodeBucket, dbutils.GenerateStoragePrefix(common.BytesToHash(key), acc.Incarnation))
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		if len(codeHash) > 0 {
+			acc.CodeHash = common.BytesToHash(codeHash)
+			data = make([]byte, acc.EncodingLengthForStorage())
+			acc.EncodeForStorage(data)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,78 @@
+package ethdb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+)
+
+func TestGetAsOfIndexed(t *testing.T) {
+	if debug.IsThinHistory() {
+		t.Skip()
+	}
+	db := NewMemDatabase()
+	key := func(i byte) []byte {
+		return dbutils.GenerateCompositeStorageKey(common.Hash{i}, 1, common.Hash{i})
+	}
+	// key 1 changes in every odd block, key 2 in every fifth block, key 3 only in block 10
+	for blockNr := uint64(1); blockNr <= 20; blockNr++ {
+		for i, changed := range []bool{blockNr%2 == 1, blockNr%5 == 0, blockNr == 10} {
+			if !changed {
+				continue
+			}
+			k := key(byte(i + 1))
+			if err := db.PutS(dbutils.StorageHistoryBucket, k, []byte{byte(i + 1), byte(blockNr)}, blockNr, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put(dbutils.StorageBucket, k, []byte{byte(i + 1), byte(blockNr + 1)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := MergeHistoryBitmaps(db, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := MergeHistoryBitmaps(db, 15); err != nil {
+		t.Fatal(err)
+	}
+	if progress, err := HistoryBitmapProgress(db); err != nil || progress != 15 {
+		t.Fatalf("expected the progress 15, got %d, %v", progress, err)
+	}
+	rb, err := ReadHistoryBitmap(db, dbutils.StorageHistoryBucket, key(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb.Cardinality() != 3 || !rb.Contains(5) || !rb.Contains(10) || !rb.Contains(15) {
+		t.Errorf("unexpected bitmap of key 2, cardinality %d", rb.Cardinality())
+	}
+
+	compare := func() {
+		for i := byte(1); i <= 3; i++ {
+			for timestamp := uint64(1); timestamp <= 22; timestamp++ {
+				expected, err1 := db.GetAsOf(dbutils.StorageBucket, dbutils.StorageHistoryBucket, key(i), timestamp)
+				v, err2 := GetAsOfIndexed(db, dbutils.StorageBucket, dbutils.StorageHistoryBucket, key(i), timestamp)
+				if err1 != err2 || !bytes.Equal(v, expected) {
+					t.Errorf("key %d as of %d: expected %x %v, got %x %v", i, timestamp, expected, err1, v, err2)
+				}
+			}
+		}
+	}
+	compare()
+
+	if err = UnwindHistoryBitmaps(db, 9); err != nil {
+		t.Fatal(err)
+	}
+	if progress, _ := HistoryBitmapProgress(db); progress != 9 {
+		t.Errorf("expected the progress 9 after the unwind, got %d", progress)
+	}
+	if rb, _ = ReadHistoryBitmap(db, dbutils.StorageHistoryBucket, key(2)); rb.Cardinality() != 1 || !rb.Contains(5) {
+		t.Errorf("unexpected bitmap of key 2 after the unwind, cardinality %d", rb.Cardinality())
+	}
+	if v, _ := db.Get(dbutils.StorageHistoryBitmapBucket, key(3)); v != nil {
+		t.Errorf("expected the bitmap of key 3 to be removed, got %x", v)
+	}
+	compare()
+}
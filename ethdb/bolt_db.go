@@ -22,6 +22,7 @@ import (
 	"github.com/ledgerwatch/turbo-geth/common"
 	"os"
 	"path"
+	"sort"
 
 	"github.com/ledgerwatch/turbo-geth/common/debug"
 
@@ -41,16 +42,23 @@ type BoltDatabase struct {
 	db  *bolt.DB   // BoltDB instance
 	log log.Logger // Contextual logger tracking the database path
 	id  uint64
+
+	compressed  map[string]*prefixCompression // Buckets with the prefix-compressed keys, by name
+	valueCodecs map[string]*valueCompression  // Buckets with the compressed values, by name
 }
 
 // NewBoltDatabase returns a BoltDB wrapper.
 func NewWrapperBoltDatabase(db *bolt.DB) *BoltDatabase {
 	logger := log.New()
-	return &BoltDatabase{
+	boltDb := &BoltDatabase{
 		db:  db,
 		log: logger,
 		id:  id(),
 	}
+	if err := boltDb.loadLayout(); err != nil {
+		logger.Error("Could not load the layout of the buckets", "err", err)
+	}
+	return boltDb
 }
 
 // NewBoltDatabase returns a BoltDB wrapper.
@@ -67,21 +75,22 @@ func NewBoltDatabase(file string) (*BoltDatabase, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &BoltDatabase{
+	boltDb := &BoltDatabase{
 		db:  db,
 		log: logger,
 		id:  id(),
-	}, nil
+	}
+	if err := boltDb.loadLayout(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return boltDb, nil
 }
 
 // Put inserts or updates a single entry.
 func (db *BoltDatabase) Put(bucket, key []byte, value []byte) error {
 	err := db.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(bucket, true)
-		if err != nil {
-			return err
-		}
-		return b.Put(key, value)
+		return db.put(tx, bucket, key, value)
 	})
 	return err
 }
@@ -89,7 +98,7 @@ func (db *BoltDatabase) Put(bucket, key []byte, value []byte) error {
 // PutS adds a new entry to the historical buckets:
 // hBucket (unless changeSetBucketOnly) and ChangeSet.
 func (db *BoltDatabase) PutS(hBucket, key, value []byte, timestamp uint64, changeSetBucketOnly bool) error {
-	composite, encodedTS := dbutils.CompositeKeySuffix(key, timestamp)
+	_, encodedTS := dbutils.CompositeKeySuffix(key, timestamp)
 	changeSetKey := dbutils.CompositeChangeSetKey(encodedTS, hBucket)
 	err := db.db.Update(func(tx *bolt.Tx) error {
 		if !changeSetBucketOnly {
@@ -97,31 +106,8 @@ func (db *BoltDatabase) PutS(hBucket, key, value []byte, timestamp uint64, chang
 			if err != nil {
 				return err
 			}
-			switch {
-			case debug.IsThinHistory() && bytes.Equal(hBucket, dbutils.AccountsHistoryBucket):
-				b, _ := hb.Get(key)
-				b, err = AppendToIndex(b, timestamp)
-				if err != nil {
-					log.Error("PutS AppendChangedOnIndex err", "err", err)
-					return err
-				}
-				if err = hb.Put(key, b); err != nil {
-					return err
-				}
-			case debug.IsThinHistory() && bytes.Equal(hBucket, dbutils.StorageHistoryBucket):
-				b, _ := hb.Get(key[:common.HashLength+common.IncarnationLength])
-				b, err = AppendToStorageIndex(b, key[common.HashLength+common.IncarnationLength:common.HashLength+common.IncarnationLength+common.HashLength], timestamp)
-				if err != nil {
-					log.Error("PutS AppendChangedOnIndex err", "err", err)
-					return err
-				}
-				if err = hb.Put(key, b); err != nil {
-					return err
-				}
-			default:
-				if err = hb.Put(composite, value); err != nil {
-					return err
-				}
+			if err = db.putHistory(hb, hBucket, key, value, timestamp); err != nil {
+				return err
 			}
 		}
 
@@ -142,6 +128,77 @@ func (db *BoltDatabase) PutS(hBucket, key, value []byte, timestamp uint64, chang
 	return err
 }
 
+// PutSBatch adds the entries of one block to the historical buckets in one transaction, see HistoryBatchPutter
+func (db *BoltDatabase) PutSBatch(hBucket []byte, kvs []KV, timestamp uint64, changeSetBucketOnly bool) error {
+	if len(kvs) == 0 {
+		return nil
+	}
+	changeSetKey := dbutils.CompositeChangeSetKey(dbutils.EncodeTimestamp(timestamp), hBucket)
+	return db.db.Update(func(tx *bolt.Tx) error {
+		if !changeSetBucketOnly {
+			hb, err := tx.CreateBucketIfNotExists(hBucket, true)
+			if err != nil {
+				return err
+			}
+			for _, kv := range kvs {
+				if err = db.putHistory(hb, hBucket, kv.K, kv.V, timestamp); err != nil {
+					return err
+				}
+			}
+		}
+
+		sb, err := tx.CreateBucketIfNotExists(dbutils.ChangeSetBucket, true)
+		if err != nil {
+			return err
+		}
+		changes := dbutils.NewChangeSet()
+		if dat, _ := sb.Get(changeSetKey); len(dat) > 0 {
+			if err = dbutils.Walk(dat, func(k, v []byte) error {
+				return changes.Add(common.CopyBytes(k), common.CopyBytes(v))
+			}); err != nil {
+				return err
+			}
+		}
+		for _, kv := range kvs {
+			if err = changes.Add(kv.K, kv.V); err != nil {
+				return err
+			}
+		}
+		sort.Sort(changes)
+		dat, err := changes.Encode()
+		if err != nil {
+			return err
+		}
+		return sb.Put(changeSetKey, dat)
+	})
+}
+
+// putHistory writes the entry of the historical bucket: the value with the timestamp suffix added to the key,
+// or the index of the changes in the thin history mode
+func (db *BoltDatabase) putHistory(hb *bolt.Bucket, hBucket, key, value []byte, timestamp uint64) error {
+	switch {
+	case debug.IsThinHistory() && bytes.Equal(hBucket, dbutils.AccountsHistoryBucket):
+		b, _ := hb.Get(key)
+		b, err := AppendToIndex(b, timestamp)
+		if err != nil {
+			log.Error("PutS AppendChangedOnIndex err", "err", err)
+			return err
+		}
+		return hb.Put(key, b)
+	case debug.IsThinHistory() && bytes.Equal(hBucket, dbutils.StorageHistoryBucket):
+		b, _ := hb.Get(key[:common.HashLength+common.IncarnationLength])
+		b, err := AppendToStorageIndex(b, key[common.HashLength+common.IncarnationLength:common.HashLength+common.IncarnationLength+common.HashLength], timestamp)
+		if err != nil {
+			log.Error("PutS AppendChangedOnIndex err", "err", err)
+			return err
+		}
+		return hb.Put(key, b)
+	default:
+		composite, _ := dbutils.CompositeKeySuffix(key, timestamp)
+		return hb.Put(composite, db.encodeValue(hBucket, composite, value))
+	}
+}
+
 func (db *BoltDatabase) MultiPut(tuples ...[]byte) (uint64, error) {
 	var savedTx *bolt.Tx
 	err := db.db.Update(func(tx *bolt.Tx) error {
@@ -149,6 +206,21 @@ func (db *BoltDatabase) MultiPut(tuples ...[]byte) (uint64, error) {
 			bucketEnd := bucketStart
 			for ; bucketEnd < len(tuples) && bytes.Equal(tuples[bucketEnd], tuples[bucketStart]); bucketEnd += 3 {
 			}
+			if db.hasLayout(tuples[bucketStart]) {
+				for i := bucketStart; i < bucketEnd; i += 3 {
+					var err error
+					if tuples[i+2] == nil {
+						err = db.delete(tx, tuples[i], tuples[i+1])
+					} else {
+						err = db.put(tx, tuples[i], tuples[i+1], tuples[i+2])
+					}
+					if err != nil {
+						return err
+					}
+				}
+				bucketStart = bucketEnd
+				continue
+			}
 			b, err := tx.CreateBucketIfNotExists(tuples[bucketStart], false)
 			if err != nil {
 				return err
@@ -176,14 +248,9 @@ func (db *BoltDatabase) MultiPut(tuples ...[]byte) (uint64, error) {
 func (db *BoltDatabase) Has(bucket, key []byte) (bool, error) {
 	var has bool
 	err := db.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		if b == nil {
-			has = false
-		} else {
-			v, _ := b.Get(key)
-			has = v != nil
-		}
-		return nil
+		v, err := db.get(tx, bucket, key)
+		has = v != nil
+		return err
 	})
 	return has, err
 }
@@ -197,15 +264,12 @@ func (db *BoltDatabase) Get(bucket, key []byte) ([]byte, error) {
 	// Retrieve the key and increment the miss counter if not found
 	var dat []byte
 	err := db.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		if b != nil {
-			v, _ := b.Get(key)
-			if v != nil {
-				dat = make([]byte, len(v))
-				copy(dat, v)
-			}
+		v, err := db.get(tx, bucket, key)
+		if v != nil {
+			dat = make([]byte, len(v))
+			copy(dat, v)
 		}
-		return nil
+		return err
 	})
 	if dat == nil {
 		return nil, ErrKeyNotFound
@@ -261,31 +325,28 @@ func (db *BoltDatabase) GetAsOf(bucket, hBucket, key []byte, timestamp uint64) (
 			}
 		default:
 			composite, _ := dbutils.CompositeKeySuffix(key, timestamp)
-			hB := tx.Bucket(hBucket)
-			if hB == nil {
+			hC := db.cursor(tx, hBucket)
+			if hC == nil {
 				return ErrKeyNotFound
 			}
-			hC := hB.Cursor()
 			hK, hV := hC.Seek(composite)
+			if err := cursorErr(hC); err != nil {
+				return err
+			}
 			if hK != nil && bytes.HasPrefix(hK, key) {
 				dat = make([]byte, len(hV))
 				copy(dat, hV)
 				return nil
 			}
 		}
-		{
-			b := tx.Bucket(bucket)
-			if b == nil {
-				return ErrKeyNotFound
-			}
-			c := b.Cursor()
-
-			k, v := c.Seek(key)
-			if k != nil && bytes.Equal(k, key) {
-				dat = make([]byte, len(v))
-				copy(dat, v)
-				return nil
-			}
+		v, err := db.get(tx, bucket, key)
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			dat = make([]byte, len(v))
+			copy(dat, v)
+			return nil
 		}
 
 		return ErrKeyNotFound
@@ -306,11 +367,10 @@ func Bytesmask(fixedbits uint) (fixedbytes int, mask byte) {
 func (db *BoltDatabase) Walk(bucket, startkey []byte, fixedbits uint, walker func(k, v []byte) (bool, error)) error {
 	fixedbytes, mask := Bytesmask(fixedbits)
 	err := db.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		if b == nil {
+		c := db.cursor(tx, bucket)
+		if c == nil {
 			return nil
 		}
-		c := b.Cursor()
 		k, v := c.Seek(startkey)
 		for k != nil && (fixedbits == 0 || bytes.Equal(k[:fixedbytes-1], startkey[:fixedbytes-1]) && (k[fixedbytes-1]&mask) == (startkey[fixedbytes-1]&mask)) {
 			goOn, err := walker(k, v)
@@ -322,7 +382,7 @@ func (db *BoltDatabase) Walk(bucket, startkey []byte, fixedbits uint, walker fun
 			}
 			k, v = c.Next()
 		}
-		return nil
+		return cursorErr(c)
 	})
 	return err
 }
@@ -331,56 +391,58 @@ func (db *BoltDatabase) MultiWalk(bucket []byte, startkeys [][]byte, fixedbits [
 	if len(startkeys) == 0 {
 		return nil
 	}
+	return db.db.View(func(tx *bolt.Tx) error {
+		return db.multiWalk(tx, bucket, startkeys, fixedbits, walker)
+	})
+}
+
+func (db *BoltDatabase) multiWalk(tx *bolt.Tx, bucket []byte, startkeys [][]byte, fixedbits []uint, walker func(int, []byte, []byte) error) error {
 	rangeIdx := 0 // What is the current range we are extracting
 	fixedbytes, mask := Bytesmask(fixedbits[rangeIdx])
 	startkey := startkeys[rangeIdx]
-	err := db.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		if b == nil {
-			return nil
-		}
-		c := b.Cursor()
-		k, v := c.Seek(startkey)
-		for k != nil {
-			// Adjust rangeIdx if needed
-			if fixedbytes > 0 {
-				cmp := int(-1)
-				for cmp != 0 {
-					cmp = bytes.Compare(k[:fixedbytes-1], startkey[:fixedbytes-1])
-					if cmp == 0 {
-						k1 := k[fixedbytes-1] & mask
-						k2 := startkey[fixedbytes-1] & mask
-						if k1 < k2 {
-							cmp = -1
-						} else if k1 > k2 {
-							cmp = 1
-						}
+	c := db.cursor(tx, bucket)
+	if c == nil {
+		return nil
+	}
+	k, v := c.Seek(startkey)
+	for k != nil {
+		// Adjust rangeIdx if needed
+		if fixedbytes > 0 {
+			cmp := int(-1)
+			for cmp != 0 {
+				cmp = bytes.Compare(k[:fixedbytes-1], startkey[:fixedbytes-1])
+				if cmp == 0 {
+					k1 := k[fixedbytes-1] & mask
+					k2 := startkey[fixedbytes-1] & mask
+					if k1 < k2 {
+						cmp = -1
+					} else if k1 > k2 {
+						cmp = 1
 					}
-					if cmp < 0 {
-						k, v = c.SeekTo(startkey)
-						if k == nil {
-							return nil
-						}
-					} else if cmp > 0 {
-						rangeIdx++
-						if rangeIdx == len(startkeys) {
-							return nil
-						}
-						fixedbytes, mask = Bytesmask(fixedbits[rangeIdx])
-						startkey = startkeys[rangeIdx]
+				}
+				if cmp < 0 {
+					k, v = c.SeekTo(startkey)
+					if k == nil {
+						return cursorErr(c)
+					}
+				} else if cmp > 0 {
+					rangeIdx++
+					if rangeIdx == len(startkeys) {
+						return nil
 					}
+					fixedbytes, mask = Bytesmask(fixedbits[rangeIdx])
+					startkey = startkeys[rangeIdx]
 				}
 			}
-			if len(v) > 0 {
-				if err := walker(rangeIdx, k, v); err != nil {
-					return err
-				}
+		}
+		if len(v) > 0 {
+			if err := walker(rangeIdx, k, v); err != nil {
+				return err
 			}
-			k, v = c.Next()
 		}
-		return nil
-	})
-	return err
+		k, v = c.Next()
+	}
+	return cursorErr(c)
 }
 
 func (db *BoltDatabase) WalkAsOf(bucket, hBucket, startkey []byte, fixedbits uint, timestamp uint64, walker func(k []byte, v []byte) (bool, error)) error {
@@ -394,18 +456,16 @@ func (db *BoltDatabase) WalkAsOf(bucket, hBucket, startkey []byte, fixedbits uin
 	sl := l + len(encodedTS)
 	keyBuffer := make([]byte, l+len(EndSuffix))
 	err := db.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		if b == nil {
+		mainCursor := db.cursor(tx, bucket)
+		if mainCursor == nil {
 			return nil
 		}
-		hB := tx.Bucket(hBucket)
-		if hB == nil {
+		historyCursor := db.cursor(tx, hBucket)
+		if historyCursor == nil {
 			return nil
 		}
 		//for state
-		mainCursor := b.Cursor()
 		//for historic data
-		historyCursor := hB.Cursor()
 		k, v := mainCursor.Seek(startkey)
 		hK, hV := historyCursor.Seek(startkey)
 		goOn := true
@@ -462,7 +522,10 @@ func (db *BoltDatabase) WalkAsOf(bucket, hBucket, startkey []byte, fixedbits uin
 				}
 			}
 		}
-		return err
+		if err != nil {
+			return err
+		}
+		return cursorErr(mainCursor, historyCursor)
 	})
 	return err
 }
@@ -483,17 +546,15 @@ func (db *BoltDatabase) MultiWalkAsOf(bucket, hBucket []byte, startkeys [][]byte
 	sl := l + len(encodedTS)
 	keyBuffer := make([]byte, l+len(EndSuffix))
 	if err := db.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		if b == nil {
+		mainCursor := db.cursor(tx, bucket)
+		if mainCursor == nil {
 			return nil
 		}
-		hB := tx.Bucket(hBucket)
-		if hB == nil {
+		historyCursor := db.cursor(tx, hBucket)
+		if historyCursor == nil {
 			return nil
 		}
-		mainCursor := b.Cursor()
-		historyCursor := hB.Cursor()
-		additionalHistoryCursor := hB.Cursor()
+		additionalHistoryCursor := tx.Bucket(hBucket).Cursor()
 		k, v := mainCursor.Seek(startkey)
 		hK, hV := historyCursor.Seek(startkey)
 		goOn := true
@@ -544,7 +605,7 @@ func (db *BoltDatabase) MultiWalkAsOf(bucket, hBucket []byte, startkeys [][]byte
 					if cmp > 0 && hCmp > 0 {
 						keyIdx++
 						if keyIdx == len(startkeys) {
-							return nil
+							return cursorErr(mainCursor, historyCursor)
 						}
 						fixedbytes, mask = Bytesmask(fixedbits[keyIdx])
 						startkey = startkeys[keyIdx]
@@ -593,7 +654,10 @@ func (db *BoltDatabase) MultiWalkAsOf(bucket, hBucket []byte, startkeys [][]byte
 				}
 			}
 		}
-		return err
+		if err != nil {
+			return err
+		}
+		return cursorErr(mainCursor, historyCursor)
 	}); err != nil {
 		return err
 	}
@@ -608,12 +672,7 @@ func (db *BoltDatabase) RewindData(timestampSrc, timestampDst uint64, df func(hB
 func (db *BoltDatabase) Delete(bucket, key []byte) error {
 	// Execute the actual operation
 	err := db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		if b != nil {
-			return b.Delete(key)
-		} else {
-			return nil
-		}
+		return db.delete(tx, bucket, key)
 	})
 	return err
 }
@@ -735,3 +794,72 @@ func NewDatabaseWithFreezer(db Database, dir, suffix string) (Database, error) {
 	// FIXME: implement freezer in Turbo-Geth
 	return db, nil
 }
+
+// NewSnapshot pins a read transaction. Note that while it is open, the database file cannot be remapped,
+// so a write transaction needing to grow the database waits until the snapshot is released
+func (db *BoltDatabase) NewSnapshot() (Snapshot, error) {
+	tx, err := db.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &boltSnapshot{db: db, tx: tx}, nil
+}
+
+type boltSnapshot struct {
+	db *BoltDatabase
+	tx *bolt.Tx
+}
+
+func (s *boltSnapshot) Get(bucket, key []byte) ([]byte, error) {
+	v, err := s.db.get(s.tx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		return common.CopyBytes(v), nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (s *boltSnapshot) NewIterator(bucket, start []byte) Iterator {
+	return &boltIterator{c: s.db.cursor(s.tx, bucket), start: start}
+}
+
+func (s *boltSnapshot) MultiWalk(bucket []byte, startkeys [][]byte, fixedbits []uint, walker func(int, []byte, []byte) error) error {
+	if len(startkeys) == 0 {
+		return nil
+	}
+	return s.db.multiWalk(s.tx, bucket, startkeys, fixedbits, walker)
+}
+
+func (s *boltSnapshot) Release() {
+	if s.tx != nil {
+		_ = s.tx.Rollback()
+		s.tx = nil
+	}
+}
+
+type boltIterator struct {
+	c       boltCursor
+	start   []byte
+	started bool
+	k, v    []byte
+}
+
+func (it *boltIterator) Next() bool {
+	if it.c == nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		it.k, it.v = it.c.Seek(it.start)
+	} else {
+		it.k, it.v = it.c.Next()
+	}
+	return it.k != nil
+}
+
+func (it *boltIterator) Error() error  { return cursorErr(it.c) }
+func (it *boltIterator) Key() []byte   { return it.k }
+func (it *boltIterator) Value() []byte { return it.v }
+func (it *boltIterator) Release()      { it.c, it.k, it.v = nil, nil, nil }
@@ -0,0 +1,101 @@
+package ethdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/log"
+)
+
+// MigrateCustomBuckets applies the migrations of the custom buckets (see dbutils.RegisterBucket) which are not yet
+// applied to the database. Every migration is applied in its own batch, together with the new version of the bucket,
+// so that the interrupted migrations are resumed from the first one not committed. It is meant to be called
+// after the database is opened, and before the blocks are processed
+func MigrateCustomBuckets(db Database) error {
+	for _, b := range dbutils.CustomBuckets() {
+		var version uint64
+		v, err := db.Get(dbutils.CustomBucketVersionBucket, b.Name)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		if len(v) == 8 {
+			version = binary.BigEndian.Uint64(v)
+		}
+		if version > uint64(len(b.Migrations)) {
+			return fmt.Errorf("custom bucket %q has version %d, the application knows %d", b.Name, version, len(b.Migrations))
+		}
+		for ; version < uint64(len(b.Migrations)); version++ {
+			batch := db.NewBatch()
+			if err := b.Migrations[version](batch); err != nil {
+				batch.Rollback()
+				return fmt.Errorf("migration %d of custom bucket %q: %w", version+1, b.Name, err)
+			}
+			var newVersion [8]byte
+			binary.BigEndian.PutUint64(newVersion[:], version+1)
+			if err := batch.Put(dbutils.CustomBucketVersionBucket, b.Name, newVersion[:]); err != nil {
+				batch.Rollback()
+				return err
+			}
+			if _, err := batch.Commit(); err != nil {
+				return err
+			}
+			log.Info("Migrated custom bucket", "bucket", string(b.Name), "version", version+1)
+		}
+	}
+	return nil
+}
+
+// walkMerged walks the bucket of the underlying database together with the pending writes of the mutation,
+// which take precedence. It is used for the custom buckets, whose writers read their own writes
+// within the same batch, unlike the state buckets
+func (m *mutation) walkMerged(bucket, startkey []byte, fixedbits uint, walker func([]byte, []byte) (bool, error)) error {
+	fixedbytes, mask := Bytesmask(fixedbits)
+	matches := func(k []byte) bool {
+		return fixedbits == 0 || bytes.Equal(k[:fixedbytes-1], startkey[:fixedbytes-1]) && (k[fixedbytes-1]&mask) == (startkey[fixedbytes-1]&mask)
+	}
+	var pending []KV
+	m.mu.RLock()
+	for k, v := range m.puts[string(bucket)] {
+		key := []byte(k)
+		if bytes.Compare(key, startkey) >= 0 && len(key) >= fixedbytes && matches(key) {
+			pending = append(pending, KV{K: key, V: v})
+		}
+	}
+	m.mu.RUnlock()
+	sort.Slice(pending, func(i, j int) bool { return bytes.Compare(pending[i].K, pending[j].K) < 0 })
+
+	// emit skips the deleted entries, stopped is set when the walker stops
+	var stopped bool
+	emit := func(k, v []byte) (bool, error) {
+		if v == nil {
+			return true, nil
+		}
+		goOn, err := walker(k, v)
+		stopped = err != nil || !goOn
+		return goOn, err
+	}
+	if err := m.db.Walk(bucket, startkey, fixedbits, func(k, v []byte) (bool, error) {
+		for len(pending) > 0 && bytes.Compare(pending[0].K, k) < 0 {
+			if goOn, err := emit(pending[0].K, pending[0].V); err != nil || !goOn {
+				return goOn, err
+			}
+			pending = pending[1:]
+		}
+		if len(pending) > 0 && bytes.Equal(pending[0].K, k) {
+			v = pending[0].V
+			pending = pending[1:]
+		}
+		return emit(k, v)
+	}); err != nil || stopped {
+		return err
+	}
+	for _, kv := range pending {
+		if goOn, err := emit(kv.K, kv.V); err != nil || !goOn {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package ethdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func registerTestBucket(t *testing.T, b dbutils.CustomBucket) {
+	if dbutils.IsCustomBucket(b.Name) {
+		return
+	}
+	assert.NoError(t, dbutils.RegisterBucket(b))
+}
+
+func TestRegisterBucket(t *testing.T) {
+	assert.Error(t, dbutils.RegisterBucket(dbutils.CustomBucket{Name: dbutils.AccountsBucket}))
+	assert.Error(t, dbutils.RegisterBucket(dbutils.CustomBucket{}))
+	registerTestBucket(t, dbutils.CustomBucket{Name: []byte("test-registered")})
+	assert.Error(t, dbutils.RegisterBucket(dbutils.CustomBucket{Name: []byte("test-registered")}))
+	assert.True(t, dbutils.IsCustomBucket([]byte("test-registered")))
+	assert.False(t, dbutils.IsCustomBucket([]byte("test-unregistered")))
+}
+
+func TestCustomBucketWalkMerged(t *testing.T) {
+	bucket := []byte("test-walk")
+	registerTestBucket(t, dbutils.CustomBucket{Name: bucket})
+	db := NewMemDatabase()
+	defer db.Close()
+	for _, k := range []string{"a1", "a3", "a5", "b1"} {
+		assert.NoError(t, db.Put(bucket, []byte(k), []byte("db-"+k)))
+	}
+
+	batch := db.NewBatch()
+	assert.NoError(t, batch.Put(bucket, []byte("a2"), []byte("batch-a2")))
+	assert.NoError(t, batch.Put(bucket, []byte("a3"), []byte("batch-a3")))
+	assert.NoError(t, batch.Delete(bucket, []byte("a5")))
+	assert.NoError(t, batch.Put(bucket, []byte("a6"), []byte("batch-a6")))
+	assert.NoError(t, batch.Put(bucket, []byte("b0"), []byte("batch-b0")))
+
+	var walked []string
+	assert.NoError(t, batch.Walk(bucket, []byte("a"), 8, func(k, v []byte) (bool, error) {
+		walked = append(walked, fmt.Sprintf("%s=%s", k, v))
+		return true, nil
+	}))
+	assert.Equal(t, []string{"a1=db-a1", "a2=batch-a2", "a3=batch-a3", "a6=batch-a6"}, walked)
+
+	// Stopped by the walker
+	walked = nil
+	assert.NoError(t, batch.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+		walked = append(walked, string(k))
+		return len(walked) < 3, nil
+	}))
+	assert.Equal(t, []string{"a1", "a2", "a3"}, walked)
+
+	walked = nil
+	assert.NoError(t, batch.Walk(bucket, []byte("a4"), 0, func(k, v []byte) (bool, error) {
+		walked = append(walked, string(k))
+		return true, nil
+	}))
+	assert.Equal(t, []string{"a6", "b0", "b1"}, walked)
+}
+
+func TestMigrateCustomBuckets(t *testing.T) {
+	bucket := []byte("test-migrate")
+	var applied int
+	registerTestBucket(t, dbutils.CustomBucket{
+		Name: bucket,
+		Migrations: []dbutils.BucketMigration{
+			func(db dbutils.BucketStore) error {
+				applied++
+				return db.Put(bucket, []byte("k"), []byte("v1"))
+			},
+			func(db dbutils.BucketStore) error {
+				applied++
+				// Reads the write of the migration within the same batch
+				v, err := db.Get(bucket, []byte("k"))
+				if err != nil {
+					return err
+				}
+				return db.Put(bucket, []byte("k"), append(v, "+v2"...))
+			},
+		},
+		Decode: func(k, v []byte) (string, error) {
+			return fmt.Sprintf("%s -> %s", k, v), nil
+		},
+	})
+	db := NewMemDatabase()
+	defer db.Close()
+
+	assert.NoError(t, MigrateCustomBuckets(db))
+	assert.Equal(t, 2, applied)
+	v, err := db.Get(bucket, []byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v1+v2", string(v))
+
+	// Applied migrations are not repeated
+	assert.NoError(t, MigrateCustomBuckets(db))
+	assert.Equal(t, 2, applied)
+
+	decoded, err := DecodeEntry(bucket, []byte("k"), v)
+	assert.NoError(t, err)
+	assert.Equal(t, "k -> v1+v2", decoded)
+}
+
+func TestMigrateCustomBucketsFailure(t *testing.T) {
+	bucket := []byte("test-migrate-failure")
+	fail := true
+	registerTestBucket(t, dbutils.CustomBucket{
+		Name: bucket,
+		Migrations: []dbutils.BucketMigration{
+			func(db dbutils.BucketStore) error {
+				return db.Put(bucket, []byte("k1"), []byte("v1"))
+			},
+			func(db dbutils.BucketStore) error {
+				if err := db.Put(bucket, []byte("k2"), []byte("v2")); err != nil {
+					return err
+				}
+				if fail {
+					return errors.New("interrupted")
+				}
+				return nil
+			},
+		},
+	})
+	db := NewMemDatabase()
+	defer db.Close()
+
+	assert.Error(t, MigrateCustomBuckets(db))
+	_, err := db.Get(bucket, []byte("k1"))
+	assert.NoError(t, err)
+	_, err = db.Get(bucket, []byte("k2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// Resumed from the failed migration
+	fail = false
+	assert.NoError(t, MigrateCustomBuckets(db))
+	_, err = db.Get(bucket, []byte("k2"))
+	assert.NoError(t, err)
+}
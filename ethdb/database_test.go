@@ -286,3 +286,55 @@ func testWalk(db Database, t *testing.T) {
 
 	assert.Equal(t, keysInRange, gotKeys)
 }
+
+func TestMemoryDB_Snapshot(t *testing.T) {
+	testSnapshot(NewMemDatabase(), t)
+}
+
+func TestBadgerDB_Snapshot(t *testing.T) {
+	db, remove := newTestBadgerDB()
+	defer remove()
+	testSnapshot(db, t)
+}
+
+func testSnapshot(db Database, t *testing.T) {
+	for k, v := range hexEntries {
+		err := db.Put(bucket, common.FromHex(k), common.FromHex(v))
+		if err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	snapshot, err := db.(Snapshotter).NewSnapshot()
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	defer snapshot.Release()
+
+	// Changes made after the snapshot must not be observed
+	assert.NoError(t, db.Put(bucket, common.FromHex("b0"), common.FromHex("01")))
+	assert.NoError(t, db.Delete(bucket, common.FromHex("bb")))
+
+	v, err := snapshot.Get(bucket, common.FromHex("bb"))
+	assert.NoError(t, err)
+	assert.Equal(t, common.FromHex("7a"), v)
+	_, err = snapshot.Get(bucket, common.FromHex("b0"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	var gotKeys [][]byte
+	it := snapshot.NewIterator(bucket, startKey)
+	for it.Next() {
+		gotKeys = append(gotKeys, common.CopyBytes(it.Key()))
+	}
+	assert.NoError(t, it.Error())
+	it.Release()
+	assert.Equal(t, [][]byte{common.FromHex("a8"), common.FromHex("bb"), common.FromHex("bd"), common.FromHex("c0")}, gotKeys)
+
+	gotKeys = nil
+	err = snapshot.MultiWalk(bucket, [][]byte{startKey}, []uint{fixedBits}, func(_ int, key, _ []byte) error {
+		gotKeys = append(gotKeys, common.CopyBytes(key))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, keysInRange, gotKeys)
+}
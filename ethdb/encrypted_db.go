@@ -0,0 +1,311 @@
+package ethdb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+)
+
+// EncryptionKeyLength is the length of the key of the EncryptedDatabase (AES-256)
+const EncryptionKeyLength = 32
+
+// ErrDecryption is returned when a value cannot be decrypted, because of the wrong key or corrupted data
+var ErrDecryption = errors.New("db: value could not be decrypted")
+
+// EncryptedDatabase encrypts the values stored in the underlying database with AES-GCM, with a random nonce
+// per value. Keys are stored as they are, so that the iteration order is preserved. The change sets stay readable
+// as containers, with only the values inside them encrypted. The history index of the thin history is not encrypted
+type EncryptedDatabase struct {
+	db   Database
+	aead cipher.AEAD
+}
+
+func NewEncryptedDatabase(db Database, key []byte) (*EncryptedDatabase, error) {
+	if len(key) != EncryptionKeyLength {
+		return nil, fmt.Errorf("encryption key must be %d bytes long, got %d", EncryptionKeyLength, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedDatabase{db: db, aead: aead}, nil
+}
+
+// EncryptionKeyFromEnv reads the hex-encoded encryption key from the environment variable
+func EncryptionKeyFromEnv(name string) ([]byte, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(v), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("environment variable %s: %v", name, err)
+	}
+	if len(key) != EncryptionKeyLength {
+		return nil, fmt.Errorf("environment variable %s: encryption key must be %d bytes long, got %d", name, EncryptionKeyLength, len(key))
+	}
+	return key, nil
+}
+
+// IsEncrypted tells whether the database encrypts the values
+func IsEncrypted(db Database) bool {
+	switch db.(type) {
+	case *EncryptedDatabase, *encryptedBatch:
+		return true
+	}
+	return false
+}
+
+func (db *EncryptedDatabase) encrypt(value []byte) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	nonceSize := db.aead.NonceSize()
+	enc := make([]byte, nonceSize, nonceSize+len(value)+db.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, enc); err != nil {
+		return nil, err
+	}
+	return db.aead.Seal(enc, enc, value, nil), nil
+}
+
+func (db *EncryptedDatabase) decrypt(enc []byte) ([]byte, error) {
+	if enc == nil {
+		return nil, nil
+	}
+	nonceSize := db.aead.NonceSize()
+	if len(enc) < nonceSize+db.aead.Overhead() {
+		return nil, ErrDecryption
+	}
+	value, err := db.aead.Open(nil, enc[:nonceSize], enc[nonceSize:], nil)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	if value == nil {
+		// Empty values mark the absence in the history
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// decryptBucketValue restores the value read from the bucket as it was put
+func (db *EncryptedDatabase) decryptBucketValue(bucket, enc []byte) ([]byte, error) {
+	switch {
+	case bytes.Equal(bucket, dbutils.ChangeSetBucket):
+		return db.decryptChangeSet(enc)
+	case isHistoryIndex(bucket):
+		return enc, nil
+	default:
+		return db.decrypt(enc)
+	}
+}
+
+func (db *EncryptedDatabase) decryptChangeSet(enc []byte) ([]byte, error) {
+	cs := dbutils.NewChangeSet()
+	if err := dbutils.Walk(enc, func(k, v []byte) error {
+		value, err := db.decrypt(v)
+		if err != nil {
+			return err
+		}
+		return cs.Add(k, value)
+	}); err != nil {
+		return nil, err
+	}
+	return cs.Encode()
+}
+
+// isHistoryIndex tells whether the values of the bucket are the history index (not encrypted) rather than the data
+func isHistoryIndex(bucket []byte) bool {
+	return debug.IsThinHistory() && (bytes.Equal(bucket, dbutils.AccountsHistoryBucket) || bytes.Equal(bucket, dbutils.StorageHistoryBucket))
+}
+
+func (db *EncryptedDatabase) Put(bucket, key, value []byte) error {
+	enc, err := db.encrypt(value)
+	if err != nil {
+		return err
+	}
+	return db.db.Put(bucket, key, enc)
+}
+
+func (db *EncryptedDatabase) PutS(hBucket, key, value []byte, timestamp uint64, changeSetBucketOnly bool) error {
+	enc, err := db.encrypt(value)
+	if err != nil {
+		return err
+	}
+	return db.db.PutS(hBucket, key, enc, timestamp, changeSetBucketOnly)
+}
+
+func (db *EncryptedDatabase) PutSBatch(hBucket []byte, kvs []KV, timestamp uint64, changeSetBucketOnly bool) error {
+	encKvs := make([]KV, len(kvs))
+	for i, kv := range kvs {
+		enc, err := db.encrypt(kv.V)
+		if err != nil {
+			return err
+		}
+		encKvs[i] = KV{K: kv.K, V: enc}
+	}
+	return PutSBatch(db.db, hBucket, encKvs, timestamp, changeSetBucketOnly)
+}
+
+func (db *EncryptedDatabase) MultiPut(tuples ...[]byte) (uint64, error) {
+	encTuples := make([][]byte, len(tuples))
+	for i := 0; i < len(tuples); i += 3 {
+		encTuples[i], encTuples[i+1] = tuples[i], tuples[i+1]
+		enc, err := db.encrypt(tuples[i+2])
+		if err != nil {
+			return 0, err
+		}
+		encTuples[i+2] = enc
+	}
+	return db.db.MultiPut(encTuples...)
+}
+
+func (db *EncryptedDatabase) Get(bucket, key []byte) ([]byte, error) {
+	enc, err := db.db.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptBucketValue(bucket, enc)
+}
+
+func (db *EncryptedDatabase) GetAsOf(bucket, hBucket, key []byte, timestamp uint64) ([]byte, error) {
+	enc, err := db.db.GetAsOf(bucket, hBucket, key, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return db.decrypt(enc)
+}
+
+func (db *EncryptedDatabase) Has(bucket, key []byte) (bool, error) {
+	return db.db.Has(bucket, key)
+}
+
+func (db *EncryptedDatabase) Walk(bucket, startkey []byte, fixedbits uint, walker func([]byte, []byte) (bool, error)) error {
+	return db.db.Walk(bucket, startkey, fixedbits, func(k, enc []byte) (bool, error) {
+		v, err := db.decryptBucketValue(bucket, enc)
+		if err != nil {
+			return false, err
+		}
+		return walker(k, v)
+	})
+}
+
+func (db *EncryptedDatabase) MultiWalk(bucket []byte, startkeys [][]byte, fixedbits []uint, walker func(int, []byte, []byte) error) error {
+	return db.db.MultiWalk(bucket, startkeys, fixedbits, func(i int, k, enc []byte) error {
+		v, err := db.decryptBucketValue(bucket, enc)
+		if err != nil {
+			return err
+		}
+		// Empty values are skipped by MultiWalk, but they are not empty once encrypted
+		if len(v) == 0 {
+			return nil
+		}
+		return walker(i, k, v)
+	})
+}
+
+func (db *EncryptedDatabase) WalkAsOf(bucket, hBucket, startkey []byte, fixedbits uint, timestamp uint64, walker func([]byte, []byte) (bool, error)) error {
+	return db.db.WalkAsOf(bucket, hBucket, startkey, fixedbits, timestamp, func(k, enc []byte) (bool, error) {
+		v, err := db.decrypt(enc)
+		if err != nil {
+			return false, err
+		}
+		return walker(k, v)
+	})
+}
+
+func (db *EncryptedDatabase) MultiWalkAsOf(bucket, hBucket []byte, startkeys [][]byte, fixedbits []uint, timestamp uint64, walker func(int, []byte, []byte) error) error {
+	return db.db.MultiWalkAsOf(bucket, hBucket, startkeys, fixedbits, timestamp, func(i int, k, enc []byte) error {
+		v, err := db.decrypt(enc)
+		if err != nil {
+			return err
+		}
+		return walker(i, k, v)
+	})
+}
+
+func (db *EncryptedDatabase) RewindData(timestampSrc, timestampDst uint64, df func(bucket, key, value []byte) error) error {
+	return db.db.RewindData(timestampSrc, timestampDst, func(bucket, key, enc []byte) error {
+		v, err := db.decrypt(enc)
+		if err != nil {
+			return err
+		}
+		return df(bucket, key, v)
+	})
+}
+
+func (db *EncryptedDatabase) Delete(bucket, key []byte) error {
+	return db.db.Delete(bucket, key)
+}
+
+func (db *EncryptedDatabase) DeleteTimestamp(timestamp uint64) error {
+	return db.db.DeleteTimestamp(timestamp)
+}
+
+func (db *EncryptedDatabase) Close() {
+	db.db.Close()
+}
+
+func (db *EncryptedDatabase) NewBatch() DbWithPendingMutations {
+	batch := db.db.NewBatch()
+	return &encryptedBatch{EncryptedDatabase: &EncryptedDatabase{db: batch, aead: db.aead}, batch: batch}
+}
+
+func (db *EncryptedDatabase) IdealBatchSize() int {
+	return db.db.IdealBatchSize()
+}
+
+func (db *EncryptedDatabase) DiskSize() int64 {
+	return db.db.DiskSize()
+}
+
+func (db *EncryptedDatabase) Keys() ([][]byte, error) {
+	return db.db.Keys()
+}
+
+func (db *EncryptedDatabase) MemCopy() Database {
+	return &EncryptedDatabase{db: db.db.MemCopy(), aead: db.aead}
+}
+
+func (db *EncryptedDatabase) Ancients() (uint64, error) {
+	return db.db.Ancients()
+}
+
+func (db *EncryptedDatabase) TruncateAncients(items uint64) error {
+	return db.db.TruncateAncients(items)
+}
+
+func (db *EncryptedDatabase) ID() uint64 {
+	return db.db.ID()
+}
+
+// encryptedBatch encrypts the values put into the batch of the underlying database
+type encryptedBatch struct {
+	*EncryptedDatabase
+	batch DbWithPendingMutations
+}
+
+func (b *encryptedBatch) Commit() (uint64, error) {
+	return b.batch.Commit()
+}
+
+func (b *encryptedBatch) Rollback() {
+	b.batch.Rollback()
+}
+
+func (b *encryptedBatch) BatchSize() int {
+	return b.batch.BatchSize()
+}
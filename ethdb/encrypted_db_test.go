@@ -0,0 +1,78 @@
+package ethdb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptedDatabase(t *testing.T) {
+	raw := NewMemDatabase()
+	defer raw.Close()
+	key := bytes.Repeat([]byte{0x42}, EncryptionKeyLength)
+	db, err := NewEncryptedDatabase(raw, key)
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(db))
+	assert.False(t, IsEncrypted(raw))
+
+	assert.NoError(t, db.Put(dbutils.AccountsBucket, []byte("k1"), []byte("value1")))
+	assert.NoError(t, db.Put(dbutils.AccountsBucket, []byte("k2"), []byte("value2")))
+	v, err := db.Get(dbutils.AccountsBucket, []byte("k1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value1"), v)
+	stored, err := raw.Get(dbutils.AccountsBucket, []byte("k1"))
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(stored, []byte("value1")))
+
+	var walked []string
+	assert.NoError(t, db.Walk(dbutils.AccountsBucket, nil, 0, func(k, v []byte) (bool, error) {
+		walked = append(walked, string(k)+"="+string(v))
+		return true, nil
+	}))
+	assert.Equal(t, []string{"k1=value1", "k2=value2"}, walked)
+
+	walked = nil
+	assert.NoError(t, db.MultiWalk(dbutils.AccountsBucket, [][]byte{[]byte("k2")}, []uint{16}, func(_ int, k, v []byte) error {
+		walked = append(walked, string(k)+"="+string(v))
+		return nil
+	}))
+	assert.Equal(t, []string{"k2=value2"}, walked)
+
+	// History
+	assert.NoError(t, db.PutS(dbutils.AccountsHistoryBucket, []byte("k1"), []byte("old1"), 2, false))
+	assert.NoError(t, db.Put(dbutils.AccountsBucket, []byte("k1"), []byte("new1")))
+	v, err = db.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, []byte("k1"), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old1"), v)
+	v, err = db.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, []byte("k1"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new1"), v)
+
+	rewound := make(map[string]string)
+	assert.NoError(t, db.RewindData(2, 1, func(_, k, v []byte) error {
+		rewound[string(k)] = string(v)
+		return nil
+	}))
+	assert.Equal(t, map[string]string{"k1": "old1"}, rewound)
+
+	// Batch
+	batch := db.NewBatch()
+	assert.True(t, IsEncrypted(batch))
+	assert.NoError(t, batch.Put(dbutils.StorageBucket, []byte("s1"), []byte("storage1")))
+	_, err = batch.Commit()
+	assert.NoError(t, err)
+	v, err = db.Get(dbutils.StorageBucket, []byte("s1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("storage1"), v)
+
+	// Wrong key
+	wrong, err := NewEncryptedDatabase(raw, bytes.Repeat([]byte{0x43}, EncryptionKeyLength))
+	assert.NoError(t, err)
+	_, err = wrong.Get(dbutils.AccountsBucket, []byte("k2"))
+	assert.Equal(t, ErrDecryption, err)
+
+	_, err = NewEncryptedDatabase(raw, key[:16])
+	assert.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package ethdb
+
+import (
+	"bytes"
+	"sort"
+)
+
+// KV is the key and the value of an entry written in bulk
+type KV struct {
+	K []byte
+	V []byte
+}
+
+// HistoryBatchPutter is implemented by the databases that add all the entries of the historical bucket
+// made by one block in one pass, rather than encoding the timestamp and updating the ChangeSet for every entry
+type HistoryBatchPutter interface {
+	// PutSBatch is the bulk equivalent of PutS, the entries are sorted by key and have distinct keys
+	PutSBatch(hBucket []byte, kvs []KV, timestamp uint64, changeSetBucketOnly bool) error
+}
+
+// PutSBatch sorts the entries by key and adds them to the historical buckets (see Putter.PutS), in one pass
+// if the database implements HistoryBatchPutter, or one by one otherwise. The slice of the caller is not modified.
+// Of the entries with the same key, only the first one is added, because it holds the value before the block
+func PutSBatch(db Putter, hBucket []byte, kvs []KV, timestamp uint64, changeSetBucketOnly bool) error {
+	sorted := make([]KV, len(kvs))
+	copy(sorted, kvs)
+	sort.SliceStable(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].K, sorted[j].K) < 0 })
+	kvs = sorted[:0]
+	for i, kv := range sorted {
+		if i == 0 || !bytes.Equal(kv.K, sorted[i-1].K) {
+			kvs = append(kvs, kv)
+		}
+	}
+	if bp, ok := db.(HistoryBatchPutter); ok {
+		return bp.PutSBatch(hBucket, kvs, timestamp, changeSetBucketOnly)
+	}
+	for _, kv := range kvs {
+		if err := db.PutS(hBucket, kv.K, kv.V, timestamp, changeSetBucketOnly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package ethdb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+)
+
+func TestPutSBatch(t *testing.T) {
+	if debug.IsThinHistory() {
+		t.Skip()
+	}
+	kvs := func() []KV {
+		return []KV{
+			{K: common.Hash{3}.Bytes(), V: []byte("three")},
+			{K: common.Hash{1}.Bytes(), V: []byte("one")},
+			{K: common.Hash{2}.Bytes(), V: []byte{}},
+		}
+	}
+	earlier := KV{K: common.Hash{4}.Bytes(), V: []byte("four")}
+
+	single := NewMemDatabase()
+	if err := single.PutS(dbutils.AccountsHistoryBucket, earlier.K, earlier.V, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range kvs() {
+		if err := single.PutS(dbutils.AccountsHistoryBucket, kv.K, kv.V, 5, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batched := NewMemDatabase()
+	if err := batched.PutS(dbutils.AccountsHistoryBucket, earlier.K, earlier.V, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutSBatch(batched, dbutils.AccountsHistoryBucket, kvs(), 5, false); err != nil {
+		t.Fatal(err)
+	}
+
+	mutation := NewMemDatabase()
+	batch := mutation.NewBatch()
+	// The later entry of the same key is dropped, and the slice is left as it is
+	later := KV{K: earlier.K, V: []byte("later")}
+	input := append(kvs(), earlier, later)
+	if err := PutSBatch(batch, dbutils.AccountsHistoryBucket, input, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(input[0].K, common.Hash{3}.Bytes()) || !bytes.Equal(input[4].V, later.V) {
+		t.Errorf("input entries have been reordered")
+	}
+	if _, err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := func(db Database) map[string]string {
+		m := make(map[string]string)
+		cs, err := db.Get(dbutils.ChangeSetBucket, dbutils.CompositeChangeSetKey(dbutils.EncodeTimestamp(5), dbutils.AccountsHistoryBucket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = dbutils.Walk(cs, func(k, v []byte) error {
+			m[string(k)] = string(v)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	expected := changes(single)
+	if len(expected) != 4 {
+		t.Fatalf("expected 4 changes, got %d", len(expected))
+	}
+	for name, db := range map[string]Database{"batched": batched, "mutation": mutation} {
+		got := changes(db)
+		if len(got) != len(expected) {
+			t.Errorf("%s: expected %d changes, got %d", name, len(expected), len(got))
+		}
+		for k, v := range expected {
+			if got[k] != v {
+				t.Errorf("%s: expected change %x: %x, got %x", name, k, v, got[k])
+			}
+		}
+		for _, kv := range append(kvs(), earlier) {
+			v, err := db.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, kv.K, 5)
+			if err != nil && err != ErrKeyNotFound {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(v, kv.V) {
+				t.Errorf("%s: expected %x as of block 5 for %x, got %x", name, kv.V, kv.K, v)
+			}
+		}
+	}
+}
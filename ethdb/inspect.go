@@ -0,0 +1,179 @@
+package ethdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+// InspectedEntry is the entry of the bucket returned by Inspect
+type InspectedEntry struct {
+	Key     []byte
+	Value   []byte
+	Decoded string // Human readable form of the key and the value, empty if the format of the bucket is not known
+}
+
+// entryDecoder produces the human readable form of the key and the value of the entry of a bucket
+type entryDecoder func(k, v []byte) (string, error)
+
+// Decoders of the buckets with the known formats. The history buckets are decoded in the default layout,
+// not in the layout of the thin history
+var entryDecoders = map[string]entryDecoder{
+	string(dbutils.AccountsBucket):        decodeAccountEntry,
+	string(dbutils.StorageBucket):         decodeStorageEntry,
+	string(dbutils.AccountsHistoryBucket): decodeAccountHistoryEntry,
+	string(dbutils.StorageHistoryBucket):  decodeStorageHistoryEntry,
+	string(dbutils.CodeBucket):            decodeCodeEntry,
+	string(dbutils.CodeSizeBucket):        decodeCodeSizeEntry,
+	string(dbutils.ContractCodeBucket):    decodeContractCodeEntry,
+	string(dbutils.ChangeSetBucket):       decodeChangeSetEntry,
+}
+
+// Inspect returns (at most) limit entries of the bucket whose keys start with the prefix, with their keys and values
+// decoded if the format of the bucket is known (see DecodeEntry). Zero limit means no limit
+func Inspect(db Getter, bucket, prefix []byte, limit int) ([]InspectedEntry, error) {
+	var entries []InspectedEntry
+	err := db.Walk(bucket, prefix, uint(8*len(prefix)), func(k, v []byte) (bool, error) {
+		entry := InspectedEntry{Key: common.CopyBytes(k), Value: common.CopyBytes(v)}
+		decoded, err := DecodeEntry(bucket, k, v)
+		if err != nil {
+			decoded = fmt.Sprintf("undecodable: %v", err)
+		}
+		entry.Decoded = decoded
+		entries = append(entries, entry)
+		return limit == 0 || len(entries) < limit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// DecodeEntry produces the human readable form of the key and the value of the entry of the bucket.
+// It returns an empty string if the format of the bucket is not known (see dbutils.CustomBucket for the custom buckets)
+func DecodeEntry(bucket, k, v []byte) (string, error) {
+	decoder, ok := entryDecoders[string(bucket)]
+	if !ok {
+		if b, ok := dbutils.GetCustomBucket(bucket); ok && b.Decode != nil {
+			return b.Decode(k, v)
+		}
+		return "", nil
+	}
+	return decoder(k, v)
+}
+
+func decodeAccount(v []byte) (string, error) {
+	if len(v) == 0 {
+		return "deleted", nil
+	}
+	var acc accounts.Account
+	if err := acc.DecodeForStorage(v); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("nonce=%d balance=%s incarnation=%d root=%x codeHash=%x", acc.Nonce, acc.Balance.String(), acc.Incarnation, acc.Root, acc.CodeHash), nil
+}
+
+// decodeStorageKey decodes the address hash + incarnation + storage key hash, returning the rest of the key
+func decodeStorageKey(k []byte) (string, []byte, error) {
+	if len(k) < common.HashLength+common.IncarnationLength+common.HashLength {
+		return "", nil, fmt.Errorf("storage key too short: %d bytes", len(k))
+	}
+	addrHash := k[:common.HashLength]
+	incarnation := dbutils.DecodeIncarnation(k[common.HashLength:])
+	keyHash := k[common.HashLength+common.IncarnationLength : common.HashLength+common.IncarnationLength+common.HashLength]
+	return fmt.Sprintf("addrHash=%x incarnation=%d keyHash=%x", addrHash, incarnation, keyHash), k[common.HashLength+common.IncarnationLength+common.HashLength:], nil
+}
+
+func decodeTimestamp(suffix []byte) (uint64, error) {
+	if len(suffix) == 0 || len(suffix) != int(suffix[0]>>5) {
+		return 0, fmt.Errorf("invalid timestamp %x", suffix)
+	}
+	timestamp, _ := dbutils.DecodeTimestamp(suffix)
+	return timestamp, nil
+}
+
+func decodeAccountEntry(k, v []byte) (string, error) {
+	acc, err := decodeAccount(v)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("addrHash=%x %s", k, acc), nil
+}
+
+func decodeStorageEntry(k, v []byte) (string, error) {
+	key, _, err := decodeStorageKey(k)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s value=%x", key, v), nil
+}
+
+func decodeAccountHistoryEntry(k, v []byte) (string, error) {
+	if len(k) < common.HashLength {
+		return "", fmt.Errorf("account history key too short: %d bytes", len(k))
+	}
+	timestamp, err := decodeTimestamp(k[common.HashLength:])
+	if err != nil {
+		return "", err
+	}
+	acc, err := decodeAccount(v)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("addrHash=%x block=%d %s", k[:common.HashLength], timestamp, acc), nil
+}
+
+func decodeStorageHistoryEntry(k, v []byte) (string, error) {
+	key, suffix, err := decodeStorageKey(k)
+	if err != nil {
+		return "", err
+	}
+	timestamp, err := decodeTimestamp(suffix)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s block=%d value=%x", key, timestamp, v), nil
+}
+
+func decodeCodeEntry(k, v []byte) (string, error) {
+	return fmt.Sprintf("codeHash=%x size=%d", k, len(v)), nil
+}
+
+func decodeCodeSizeEntry(k, v []byte) (string, error) {
+	if len(v) != 4 {
+		return "", fmt.Errorf("code size of %d bytes", len(v))
+	}
+	return fmt.Sprintf("codeHash=%x size=%d", k, binary.BigEndian.Uint32(v)), nil
+}
+
+func decodeContractCodeEntry(k, v []byte) (string, error) {
+	if len(k) != common.HashLength+common.IncarnationLength {
+		return "", fmt.Errorf("contract code key of %d bytes", len(k))
+	}
+	return fmt.Sprintf("addrHash=%x incarnation=%d codeHash=%x", k[:common.HashLength], dbutils.DecodeIncarnation(k[common.HashLength:]), v), nil
+}
+
+func decodeChangeSetEntry(k, v []byte) (string, error) {
+	if len(k) == 0 || len(k) < int(k[0]>>5) {
+		return "", fmt.Errorf("invalid change set key %x", k)
+	}
+	timestamp, bucket := dbutils.DecodeTimestamp(k)
+	kind := "unknown"
+	switch {
+	case bytes.Equal(bucket, dbutils.AccountsHistoryBucket):
+		kind = "accounts"
+	case bytes.Equal(bucket, dbutils.StorageHistoryBucket):
+		kind = "storage"
+	}
+	if len(v) == 0 {
+		return fmt.Sprintf("block=%d bucket=%s (%s) changes=0", timestamp, bucket, kind), nil
+	}
+	if len(v) < 4 {
+		return "", fmt.Errorf("change set of %d bytes", len(v))
+	}
+	return fmt.Sprintf("block=%d bucket=%s (%s) changes=%d", timestamp, bucket, kind, dbutils.Len(v)), nil
+}
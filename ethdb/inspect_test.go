@@ -0,0 +1,62 @@
+package ethdb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspect(t *testing.T) {
+	db := NewMemDatabase()
+	defer db.Close()
+
+	acc := accounts.NewAccount()
+	acc.Nonce = 7
+	acc.Balance.SetInt64(1000)
+	enc := make([]byte, acc.EncodingLengthForStorage())
+	acc.EncodeForStorage(enc)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, db.Put(dbutils.AccountsBucket, common.Hash{0xaa, byte(i)}.Bytes(), enc))
+	}
+	assert.NoError(t, db.Put(dbutils.AccountsBucket, common.Hash{0xbb}.Bytes(), enc))
+	storageKey := dbutils.GenerateCompositeStorageKey(common.Hash{0xaa}, 2, common.Hash{0xcc})
+	assert.NoError(t, db.Put(dbutils.StorageBucket, storageKey, []byte{0x01}))
+	historyKey, _ := dbutils.CompositeKeySuffix(storageKey, 12345)
+	assert.NoError(t, db.Put(dbutils.StorageHistoryBucket, historyKey, []byte{0x02}))
+	assert.NoError(t, db.Put([]byte("unknown"), []byte{1}, []byte{2}))
+
+	entries, err := Inspect(db, dbutils.AccountsBucket, []byte{0xaa}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.True(t, strings.Contains(entries[0].Decoded, "nonce=7 balance=1000"), entries[0].Decoded)
+
+	entries, err = Inspect(db, dbutils.AccountsBucket, nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(entries))
+
+	entries, err = Inspect(db, dbutils.StorageBucket, nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.True(t, strings.Contains(entries[0].Decoded, "incarnation=2"), entries[0].Decoded)
+
+	entries, err = Inspect(db, dbutils.StorageHistoryBucket, nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.True(t, strings.Contains(entries[0].Decoded, "block=12345 value=02"), entries[0].Decoded)
+
+	entries, err = Inspect(db, []byte("unknown"), nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "", entries[0].Decoded)
+
+	// Malformed entries are reported, not failing the inspection
+	assert.NoError(t, db.Put(dbutils.AccountsBucket, common.Hash{0xcc}.Bytes(), []byte{0x01, 0x05}))
+	entries, err = Inspect(db, dbutils.AccountsBucket, []byte{0xcc}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.True(t, strings.HasPrefix(entries[0].Decoded, "undecodable"), entries[0].Decoded)
+}
@@ -112,6 +112,14 @@ type MinDatabase interface {
 	Delete(bucket, key []byte) error
 }
 
+// Batch is the part of the database given to the writers that add their writes to the batch of the block,
+// so that they are committed or rolled back together with the state changes of the block
+type Batch interface {
+	Getter
+	Putter
+	Deleter
+}
+
 // DbWithPendingMutations is an extended version of the Database,
 // where all changes are first made in memory.
 // Later they can either be committed to the database or rolled back.
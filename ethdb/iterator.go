@@ -64,3 +64,25 @@ type Iteratee interface {
 	// of database content with a particular key prefix.
 	NewIteratorWithPrefix(prefix []byte) Iterator
 }
+
+// Snapshot is a read-only view of the database, pinned at the moment of its creation: writes
+// committed afterwards are not observed through it. It holds a read transaction open, so it
+// should be released as soon as possible. A snapshot is not safe for concurrent use.
+type Snapshot interface {
+	// Get returns the value for a given key if it's present.
+	Get(bucket, key []byte) ([]byte, error)
+
+	// NewIterator creates an iterator over the bucket, starting at the given key (or after, if it does not exist).
+	NewIterator(bucket, start []byte) Iterator
+
+	// MultiWalk is the same as Getter.MultiWalk, but observes the snapshot.
+	MultiWalk(bucket []byte, startkeys [][]byte, fixedbits []uint, walker func(int, []byte, []byte) error) error
+
+	// Release closes the read transaction. It can be called multiple times.
+	Release()
+}
+
+// Snapshotter is implemented by the databases supporting snapshot isolation.
+type Snapshotter interface {
+	NewSnapshot() (Snapshot, error)
+}
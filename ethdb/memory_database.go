@@ -82,8 +82,10 @@ func (db *BoltDatabase) MemCopy() Database {
 		panic(err)
 	}
 	return &BoltDatabase{
-		db:  mem,
-		log: logger,
-		id:  id(),
+		db:          mem,
+		log:         logger,
+		id:          id(),
+		compressed:  db.compressed,
+		valueCodecs: db.valueCodecs,
 	}
 }
@@ -195,7 +195,22 @@ func (m *mutation) PutS(hBucket, key, value []byte, timestamp uint64, noHistory
 	//fmt.Printf("PutS bucket %x key %x value %x timestamp %d\n", bucket, key, value, timestamp)
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return m.putSNoLock(hBucket, key, value, timestamp, noHistory)
+}
 
+// PutSBatch adds the entries of one block to the historical buckets under one lock, see HistoryBatchPutter
+func (m *mutation) PutSBatch(hBucket []byte, kvs []KV, timestamp uint64, noHistory bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, kv := range kvs {
+		if err := m.putSNoLock(hBucket, kv.K, kv.V, timestamp, noHistory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mutation) putSNoLock(hBucket, key, value []byte, timestamp uint64, noHistory bool) error {
 	hBucketStr := string(hBucket)
 	changesByBucket, ok := m.changeSetByBlock[timestamp]
 	if !ok {
@@ -252,6 +267,9 @@ func (m *mutation) GetAsOf(bucket, hBucket, key []byte, timestamp uint64) ([]byt
 // WARNING: Merged mem/DB walk is not implemented
 func (m *mutation) Walk(bucket, startkey []byte, fixedbits uint, walker func([]byte, []byte) (bool, error)) error {
 	m.panicOnEmptyDB()
+	if dbutils.IsCustomBucket(bucket) {
+		return m.walkMerged(bucket, startkey, fixedbits, walker)
+	}
 	return m.db.Walk(bucket, startkey, fixedbits, walker)
 }
 
@@ -0,0 +1,306 @@
+package ethdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/bolt"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+)
+
+// With the prefix compression, the keys of a bucket are split into the fixed-length prefix and the remainder
+// (for the StorageBucket, the address hash + incarnation, and the storage key hash). Each distinct prefix is stored
+// once in the dictionary bucket, mapped to a short sequential id, and the bucket itself is keyed by id + remainder.
+// Since the ids do not preserve the order of the prefixes, the iteration goes over the dictionary first, and then
+// over the range of each id, so that Walk and MultiWalk observe the same keys, in the same order, as without it.
+
+const prefixIDLength = 8
+
+// prefixCounterKey holds the last allocated id in the dictionary bucket. It is shorter than any prefix,
+// so it is skipped by the iteration
+var prefixCounterKey = []byte{0}
+
+type prefixCompression struct {
+	bucket    []byte
+	dict      []byte
+	prefixLen int
+}
+
+func prefixDictBucket(bucket []byte) []byte {
+	return append([]byte("prefixes-"), bucket...)
+}
+
+// EnableKeyPrefixCompression switches the bucket to the prefix-compressed layout, which is recorded in the
+// database. It is only possible while the bucket is empty, and must be done before the database is used concurrently
+func (db *BoltDatabase) EnableKeyPrefixCompression(bucket []byte, prefixLen int) error {
+	if prefixLen <= len(prefixCounterKey) {
+		return fmt.Errorf("prefix length %d is too short", prefixLen)
+	}
+	if pc, ok := db.compressed[string(bucket)]; ok {
+		if pc.prefixLen != prefixLen {
+			return fmt.Errorf("bucket %s is already compressed with prefix length %d", bucket, pc.prefixLen)
+		}
+		return nil
+	}
+	if err := db.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucket); b != nil {
+			if k, _ := b.Cursor().First(); k != nil {
+				return fmt.Errorf("bucket %s is not empty", bucket)
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists(dbutils.PrefixCompressionBucket, false)
+		if err != nil {
+			return err
+		}
+		var v [4]byte
+		binary.BigEndian.PutUint32(v[:], uint32(prefixLen))
+		return meta.Put(bucket, v[:])
+	}); err != nil {
+		return err
+	}
+	db.setPrefixCompression(bucket, prefixLen)
+	return nil
+}
+
+func (db *BoltDatabase) setPrefixCompression(bucket []byte, prefixLen int) {
+	if db.compressed == nil {
+		db.compressed = make(map[string]*prefixCompression)
+	}
+	db.compressed[string(bucket)] = &prefixCompression{bucket: bucket, dict: prefixDictBucket(bucket), prefixLen: prefixLen}
+}
+
+// loadPrefixCompression reads the layouts of the buckets recorded by EnableKeyPrefixCompression
+func (db *BoltDatabase) loadPrefixCompression() error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(dbutils.PrefixCompressionBucket)
+		if meta == nil {
+			return nil
+		}
+		c := meta.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) != 4 {
+				return fmt.Errorf("invalid prefix compression record for bucket %s", k)
+			}
+			db.setPrefixCompression(common.CopyBytes(k), int(binary.BigEndian.Uint32(v)))
+		}
+		return nil
+	})
+}
+
+func (pc *prefixCompression) split(key []byte) (prefix, suffix []byte, err error) {
+	if len(key) < pc.prefixLen {
+		return nil, nil, fmt.Errorf("key %x is too short for the bucket %s", key, pc.bucket)
+	}
+	return key[:pc.prefixLen], key[pc.prefixLen:], nil
+}
+
+func (pc *prefixCompression) get(tx *bolt.Tx, key []byte) []byte {
+	prefix, suffix, err := pc.split(key)
+	if err != nil {
+		return nil
+	}
+	dict, b := tx.Bucket(pc.dict), tx.Bucket(pc.bucket)
+	if dict == nil || b == nil {
+		return nil
+	}
+	id, _ := dict.Get(prefix)
+	if id == nil {
+		return nil
+	}
+	v, _ := b.Get(append(id[:prefixIDLength:prefixIDLength], suffix...))
+	return v
+}
+
+func (pc *prefixCompression) put(tx *bolt.Tx, key, value []byte) error {
+	prefix, suffix, err := pc.split(key)
+	if err != nil {
+		return err
+	}
+	dict, err := tx.CreateBucketIfNotExists(pc.dict, false)
+	if err != nil {
+		return err
+	}
+	b, err := tx.CreateBucketIfNotExists(pc.bucket, true)
+	if err != nil {
+		return err
+	}
+	id, _ := dict.Get(prefix)
+	if id == nil {
+		var counter uint64
+		if v, _ := dict.Get(prefixCounterKey); v != nil {
+			counter = binary.BigEndian.Uint64(v)
+		}
+		counter++
+		id = make([]byte, prefixIDLength)
+		binary.BigEndian.PutUint64(id, counter)
+		if err = dict.Put(prefixCounterKey, id); err != nil {
+			return err
+		}
+		if err = dict.Put(prefix, id); err != nil {
+			return err
+		}
+	}
+	return b.Put(append(id[:prefixIDLength:prefixIDLength], suffix...), value)
+}
+
+// delete removes the key. The prefix stays in the dictionary, an empty range is skipped by the iteration
+func (pc *prefixCompression) delete(tx *bolt.Tx, key []byte) error {
+	prefix, suffix, err := pc.split(key)
+	if err != nil {
+		return nil
+	}
+	dict, b := tx.Bucket(pc.dict), tx.Bucket(pc.bucket)
+	if dict == nil || b == nil {
+		return nil
+	}
+	id, _ := dict.Get(prefix)
+	if id == nil {
+		return nil
+	}
+	return b.Delete(append(id[:prefixIDLength:prefixIDLength], suffix...))
+}
+
+// loadLayout reads the layouts of the buckets recorded in the database
+func (db *BoltDatabase) loadLayout() error {
+	if err := db.loadPrefixCompression(); err != nil {
+		return err
+	}
+	return db.loadValueCompression()
+}
+
+// hasLayout tells whether the keys or the values of the bucket are not stored as they are
+func (db *BoltDatabase) hasLayout(bucket []byte) bool {
+	_, compressedKeys := db.compressed[string(bucket)]
+	_, compressedValues := db.valueCodecs[string(bucket)]
+	return compressedKeys || compressedValues
+}
+
+// boltCursor is the part of the bolt.Cursor used for the iteration over the buckets
+type boltCursor interface {
+	Seek(seek []byte) (key []byte, value []byte)
+	SeekTo(seek []byte) (key []byte, value []byte)
+	Next() (key []byte, value []byte)
+}
+
+// cursor returns the cursor iterating over the keys and values of the bucket as they were put,
+// or nil if the bucket does not exist
+func (db *BoltDatabase) cursor(tx *bolt.Tx, bucket []byte) boltCursor {
+	if _, ok := db.valueCodecs[string(bucket)]; ok {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		return &decodingCursor{boltCursor: b.Cursor(), db: db, bucket: bucket}
+	}
+	if pc, ok := db.compressed[string(bucket)]; ok {
+		dict, b := tx.Bucket(pc.dict), tx.Bucket(pc.bucket)
+		if dict == nil || b == nil {
+			return nil
+		}
+		return &prefixCursor{dict: dict.Cursor(), data: b.Cursor(), prefixLen: pc.prefixLen}
+	}
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil
+	}
+	return b.Cursor()
+}
+
+// get returns the value of the key in the bucket, or nil if it does not exist
+func (db *BoltDatabase) get(tx *bolt.Tx, bucket, key []byte) ([]byte, error) {
+	if pc, ok := db.compressed[string(bucket)]; ok {
+		return pc.get(tx, key), nil
+	}
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil, nil
+	}
+	v, _ := b.Get(key)
+	return db.decodeValue(bucket, key, v)
+}
+
+func (db *BoltDatabase) put(tx *bolt.Tx, bucket, key, value []byte) error {
+	if pc, ok := db.compressed[string(bucket)]; ok {
+		return pc.put(tx, key, value)
+	}
+	b, err := tx.CreateBucketIfNotExists(bucket, true)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, db.encodeValue(bucket, key, value))
+}
+
+func (db *BoltDatabase) delete(tx *bolt.Tx, bucket, key []byte) error {
+	if pc, ok := db.compressed[string(bucket)]; ok {
+		return pc.delete(tx, key)
+	}
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+// prefixCursor iterates over the prefix-compressed bucket, returning the keys with the prefixes restored
+type prefixCursor struct {
+	dict, data *bolt.Cursor
+	prefixLen  int
+	prefix     []byte // Current prefix, nil when the iteration is over
+	id         []byte // Id of the current prefix
+}
+
+func (c *prefixCursor) Seek(seek []byte) ([]byte, []byte) {
+	p := seek
+	if len(p) > c.prefixLen {
+		p = p[:c.prefixLen]
+	}
+	prefix, id := c.dict.Seek(p)
+	var suffix []byte
+	if len(seek) >= c.prefixLen && bytes.Equal(prefix, p) {
+		suffix = seek[c.prefixLen:]
+	}
+	return c.enter(prefix, id, suffix)
+}
+
+func (c *prefixCursor) SeekTo(seek []byte) ([]byte, []byte) {
+	return c.Seek(seek)
+}
+
+func (c *prefixCursor) Next() ([]byte, []byte) {
+	if c.prefix == nil {
+		return nil, nil
+	}
+	if k, v := c.data.Next(); k != nil && bytes.HasPrefix(k, c.id) {
+		return c.compose(k), v
+	}
+	prefix, id := c.dict.Next()
+	return c.enter(prefix, id, nil)
+}
+
+// enter positions the data cursor at the suffix within the range of the prefix, moving on to the next prefixes
+// while the ranges are exhausted
+func (c *prefixCursor) enter(prefix, id, suffix []byte) ([]byte, []byte) {
+	for ; prefix != nil; prefix, id = c.dict.Next() {
+		if len(prefix) != c.prefixLen {
+			suffix = nil
+			continue
+		}
+		k, v := c.data.Seek(append(id[:prefixIDLength:prefixIDLength], suffix...))
+		if k != nil && bytes.HasPrefix(k, id) {
+			c.prefix, c.id = prefix, id
+			return c.compose(k), v
+		}
+		suffix = nil
+	}
+	c.prefix, c.id = nil, nil
+	return nil, nil
+}
+
+func (c *prefixCursor) compose(k []byte) []byte {
+	key := make([]byte, c.prefixLen+len(k)-prefixIDLength)
+	copy(key, c.prefix)
+	copy(key[c.prefixLen:], k[prefixIDLength:])
+	return key
+}
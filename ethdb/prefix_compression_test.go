@@ -0,0 +1,64 @@
+package ethdb
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixCompression(t *testing.T) {
+	plain := NewMemDatabase()
+	defer plain.Close()
+	compressed := NewMemDatabase()
+	defer compressed.Close()
+	assert.NoError(t, compressed.EnableKeyPrefixCompression(bucket, 2))
+
+	// Prefixes are inserted out of order, so that their ids do not follow the order of the keys
+	entries := []string{"bb01", "aa02", "bb00", "aa01", "cc05", "aaff", "00aa"}
+	for _, db := range []*BoltDatabase{plain, compressed} {
+		for i, k := range entries {
+			assert.NoError(t, db.Put(bucket, common.FromHex(k), []byte{byte(i + 1)}))
+		}
+		assert.NoError(t, db.Delete(bucket, common.FromHex("cc05")))
+		_, err := db.MultiPut(bucket, common.FromHex("bb02"), []byte{0x10}, bucket, common.FromHex("bb00"), nil)
+		assert.NoError(t, err)
+	}
+
+	walk := func(db *BoltDatabase, startkey []byte, fixedbits uint) [][]byte {
+		var keys [][]byte
+		assert.NoError(t, db.Walk(bucket, startkey, fixedbits, func(k, v []byte) (bool, error) {
+			keys = append(keys, common.CopyBytes(k))
+			return true, nil
+		}))
+		return keys
+	}
+	for _, q := range []struct {
+		startkey  string
+		fixedbits uint
+	}{{"", 0}, {"aa", 8}, {"aa02", 8}, {"ab", 0}, {"bb", 16}, {"cc", 8}} {
+		assert.Equal(t, walk(plain, common.FromHex(q.startkey), q.fixedbits), walk(compressed, common.FromHex(q.startkey), q.fixedbits), "walk from %s", q.startkey)
+	}
+
+	multiWalk := func(db *BoltDatabase) [][]byte {
+		var keys [][]byte
+		assert.NoError(t, db.MultiWalk(bucket, [][]byte{common.FromHex("aa"), common.FromHex("bb01")}, []uint{8, 8}, func(i int, k, v []byte) error {
+			keys = append(keys, common.CopyBytes(k))
+			return nil
+		}))
+		return keys
+	}
+	assert.Equal(t, multiWalk(plain), multiWalk(compressed))
+
+	v, err := compressed.Get(bucket, common.FromHex("bb02"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x10}, v)
+	_, err = compressed.Get(bucket, common.FromHex("bb00"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// The layout is recorded in the database
+	reopened := NewWrapperBoltDatabase(compressed.DB())
+	assert.Equal(t, walk(plain, nil, 0), walk(reopened, nil, 0))
+
+	assert.Error(t, plain.EnableKeyPrefixCompression(bucket, 2))
+}
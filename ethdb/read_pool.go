@@ -0,0 +1,122 @@
+package ethdb
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ReadStats are the statistics of the read transactions of one consumer of the ReadPool
+type ReadStats struct {
+	Acquired uint64        // Number of read transactions opened
+	Canceled uint64        // Number of acquisitions abandoned because the context was done
+	Active   int           // Number of read transactions currently open
+	WaitTime time.Duration // Total time spent waiting for a read transaction
+	HoldTime time.Duration // Total time the read transactions were held open
+}
+
+// ReadPool bounds the number of the read transactions (snapshots) open concurrently by the readers
+// like RPC handlers, so that heavy read traffic cannot starve the block import on the shared database.
+// While a writer is waiting in Write, no new read transactions are opened; the ones already open
+// are allowed to finish
+type ReadPool struct {
+	db    Snapshotter
+	slots chan struct{}
+	gate  sync.RWMutex // Held for writing by the writers, and for reading by the readers waiting for a slot
+
+	statsLock sync.Mutex
+	stats     map[string]*ReadStats
+}
+
+func NewReadPool(db Snapshotter, size int) *ReadPool {
+	if size < 1 {
+		size = 1
+	}
+	return &ReadPool{
+		db:    db,
+		slots: make(chan struct{}, size),
+		stats: make(map[string]*ReadStats),
+	}
+}
+
+// Acquire opens a read transaction on behalf of the consumer, waiting for a free slot if the pool is exhausted,
+// or for the writer to finish. The returned snapshot must be released to free the slot
+func (p *ReadPool) Acquire(ctx context.Context, consumer string) (Snapshot, error) {
+	start := time.Now()
+	p.gate.RLock()
+	select {
+	case p.slots <- struct{}{}:
+		p.gate.RUnlock()
+	case <-ctx.Done():
+		p.gate.RUnlock()
+		p.record(consumer, func(s *ReadStats) {
+			s.Canceled++
+			s.WaitTime += time.Since(start)
+		})
+		return nil, ctx.Err()
+	}
+	snapshot, err := p.db.NewSnapshot()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	acquired := time.Now()
+	p.record(consumer, func(s *ReadStats) {
+		s.Acquired++
+		s.Active++
+		s.WaitTime += acquired.Sub(start)
+	})
+	return &pooledSnapshot{Snapshot: snapshot, pool: p, consumer: consumer, acquired: acquired}, nil
+}
+
+// Write runs f with the priority over the readers: the read transactions requested after the call
+// are opened only once f returns
+func (p *ReadPool) Write(f func() error) error {
+	p.gate.Lock()
+	defer p.gate.Unlock()
+	return f()
+}
+
+// Stats returns the copy of the statistics, by consumer
+func (p *ReadPool) Stats() map[string]ReadStats {
+	p.statsLock.Lock()
+	defer p.statsLock.Unlock()
+	stats := make(map[string]ReadStats, len(p.stats))
+	for consumer, s := range p.stats {
+		stats[consumer] = *s
+	}
+	return stats
+}
+
+func (p *ReadPool) record(consumer string, f func(s *ReadStats)) {
+	p.statsLock.Lock()
+	defer p.statsLock.Unlock()
+	s, ok := p.stats[consumer]
+	if !ok {
+		s = &ReadStats{}
+		p.stats[consumer] = s
+	}
+	f(s)
+}
+
+type pooledSnapshot struct {
+	Snapshot
+	pool     *ReadPool
+	consumer string
+	acquired time.Time
+	released bool
+}
+
+func (s *pooledSnapshot) Release() {
+	if s.released {
+		return
+	}
+	s.released = true
+	s.Snapshot.Release()
+	<-s.pool.slots
+	held := time.Since(s.acquired)
+	s.pool.record(s.consumer, func(stats *ReadStats) {
+		stats.Active--
+		stats.HoldTime += held
+	})
+}
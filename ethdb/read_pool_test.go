@@ -0,0 +1,65 @@
+package ethdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPool(t *testing.T) {
+	db := NewMemDatabase()
+	defer db.Close()
+	pool := NewReadPool(db, 1)
+
+	snapshot, err := pool.Acquire(context.Background(), "rpc")
+	assert.NoError(t, err)
+
+	// The pool is exhausted
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = pool.Acquire(ctx, "rpc")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	snapshot.Release()
+	snapshot.Release()
+	snapshot, err = pool.Acquire(context.Background(), "rpc")
+	assert.NoError(t, err)
+	snapshot.Release()
+
+	// New readers wait for the writer
+	writing := make(chan struct{})
+	finish := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- pool.Write(func() error {
+			close(writing)
+			<-finish
+			return nil
+		})
+	}()
+	<-writing
+	acquired := make(chan struct{})
+	go func() {
+		s, err1 := pool.Acquire(context.Background(), "graphql")
+		if err1 == nil {
+			s.Release()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("read transaction opened while the writer is active")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(finish)
+	assert.NoError(t, <-done)
+	<-acquired
+
+	stats := pool.Stats()
+	assert.Equal(t, uint64(2), stats["rpc"].Acquired)
+	assert.Equal(t, uint64(1), stats["rpc"].Canceled)
+	assert.Equal(t, 0, stats["rpc"].Active)
+	assert.Equal(t, uint64(1), stats["graphql"].Acquired)
+}
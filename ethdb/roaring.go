@@ -0,0 +1,338 @@
+package ethdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Containers with more values than that are kept as bitmaps rather than as sorted arrays
+const roaringArrayMaxSize = 4096
+
+const roaringBitmapWords = 1 << 16 / 64
+
+var errRoaringValueTooLarge = errors.New("roaring bitmap: value does not fit in 32 bits")
+
+// roaringContainer holds the lower 16 bits of the values sharing the upper 16 bits (key)
+type roaringContainer struct {
+	key   uint16
+	n     int      // cardinality
+	array []uint16 // sorted values, when n <= roaringArrayMaxSize
+	bits  []uint64 // bitmap of the values, when n > roaringArrayMaxSize
+}
+
+func (c *roaringContainer) contains(lo uint16) bool {
+	if c.bits != nil {
+		return c.bits[lo>>6]&(1<<(lo&63)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= lo })
+	return i < len(c.array) && c.array[i] == lo
+}
+
+func (c *roaringContainer) add(lo uint16) {
+	if c.bits != nil {
+		if c.bits[lo>>6]&(1<<(lo&63)) == 0 {
+			c.bits[lo>>6] |= 1 << (lo & 63)
+			c.n++
+		}
+		return
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= lo })
+	if i < len(c.array) && c.array[i] == lo {
+		return
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = lo
+	c.n++
+	if c.n > roaringArrayMaxSize {
+		c.bits = make([]uint64, roaringBitmapWords)
+		for _, v := range c.array {
+			c.bits[v>>6] |= 1 << (v & 63)
+		}
+		c.array = nil
+	}
+}
+
+func (c *roaringContainer) remove(lo uint16) {
+	if c.bits != nil {
+		if c.bits[lo>>6]&(1<<(lo&63)) != 0 {
+			c.bits[lo>>6] &^= 1 << (lo & 63)
+			c.n--
+		}
+		if c.n <= roaringArrayMaxSize {
+			array := make([]uint16, 0, c.n)
+			c.forEach(func(lo uint16) { array = append(array, lo) })
+			c.array, c.bits = array, nil
+		}
+		return
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= lo })
+	if i < len(c.array) && c.array[i] == lo {
+		c.array = append(c.array[:i], c.array[i+1:]...)
+		c.n--
+	}
+}
+
+// rank returns the number of the values not greater than lo
+func (c *roaringContainer) rank(lo uint16) int {
+	if c.bits != nil {
+		r := 0
+		for _, word := range c.bits[:lo>>6] {
+			r += bits.OnesCount64(word)
+		}
+		return r + bits.OnesCount64(c.bits[lo>>6]&(uint64(2)<<(lo&63)-1))
+	}
+	return sort.Search(len(c.array), func(i int) bool { return c.array[i] > lo })
+}
+
+// selectAt returns the i-th smallest value, i < n
+func (c *roaringContainer) selectAt(i int) uint16 {
+	if c.bits == nil {
+		return c.array[i]
+	}
+	for w, word := range c.bits {
+		count := bits.OnesCount64(word)
+		if i >= count {
+			i -= count
+			continue
+		}
+		for ; i > 0; i-- {
+			word &= word - 1
+		}
+		return uint16(w<<6 + bits.TrailingZeros64(word))
+	}
+	panic("roaring bitmap: select out of range")
+}
+
+func (c *roaringContainer) forEach(f func(lo uint16)) {
+	if c.bits == nil {
+		for _, lo := range c.array {
+			f(lo)
+		}
+		return
+	}
+	for w, word := range c.bits {
+		for ; word != 0; word &= word - 1 {
+			f(uint16(w<<6 + bits.TrailingZeros64(word)))
+		}
+	}
+}
+
+func (c *roaringContainer) copy() *roaringContainer {
+	cp := &roaringContainer{key: c.key, n: c.n}
+	if c.bits != nil {
+		cp.bits = append([]uint64(nil), c.bits...)
+	} else {
+		cp.array = append([]uint16(nil), c.array...)
+	}
+	return cp
+}
+
+// RoaringBitmap is a compressed set of 32-bit values (block numbers of the history index, see MergeHistoryBitmaps).
+// The values are split by their upper 16 bits into containers, which keep the lower 16 bits either
+// as sorted arrays or, when they hold more than 4096 values, as bitmaps
+type RoaringBitmap struct {
+	containers []*roaringContainer // sorted by key
+}
+
+func NewRoaringBitmap() *RoaringBitmap {
+	return &RoaringBitmap{}
+}
+
+func (rb *RoaringBitmap) find(key uint16) (int, bool) {
+	i := sort.Search(len(rb.containers), func(i int) bool { return rb.containers[i].key >= key })
+	return i, i < len(rb.containers) && rb.containers[i].key == key
+}
+
+// Add inserts the value into the bitmap, the values do not exceed math.MaxUint32
+func (rb *RoaringBitmap) Add(v uint64) error {
+	if v > math.MaxUint32 {
+		return errRoaringValueTooLarge
+	}
+	key := uint16(v >> 16)
+	i, ok := rb.find(key)
+	if !ok {
+		rb.containers = append(rb.containers, nil)
+		copy(rb.containers[i+1:], rb.containers[i:])
+		rb.containers[i] = &roaringContainer{key: key}
+	}
+	rb.containers[i].add(uint16(v))
+	return nil
+}
+
+// Remove deletes the value from the bitmap, if it is present
+func (rb *RoaringBitmap) Remove(v uint64) {
+	if v > math.MaxUint32 {
+		return
+	}
+	i, ok := rb.find(uint16(v >> 16))
+	if !ok {
+		return
+	}
+	c := rb.containers[i]
+	c.remove(uint16(v))
+	if c.n == 0 {
+		rb.containers = append(rb.containers[:i], rb.containers[i+1:]...)
+	}
+}
+
+func (rb *RoaringBitmap) Contains(v uint64) bool {
+	if v > math.MaxUint32 {
+		return false
+	}
+	i, ok := rb.find(uint16(v >> 16))
+	return ok && rb.containers[i].contains(uint16(v))
+}
+
+// Cardinality returns the number of the values in the bitmap
+func (rb *RoaringBitmap) Cardinality() uint64 {
+	var n uint64
+	for _, c := range rb.containers {
+		n += uint64(c.n)
+	}
+	return n
+}
+
+// Rank returns the number of the values not greater than v
+func (rb *RoaringBitmap) Rank(v uint64) uint64 {
+	if v > math.MaxUint32 {
+		return rb.Cardinality()
+	}
+	key := uint16(v >> 16)
+	var r uint64
+	for _, c := range rb.containers {
+		if c.key > key {
+			break
+		}
+		if c.key < key {
+			r += uint64(c.n)
+		} else {
+			r += uint64(c.rank(uint16(v)))
+		}
+	}
+	return r
+}
+
+// Select returns the i-th smallest value (counting from 0), and false if the bitmap has i values or less
+func (rb *RoaringBitmap) Select(i uint64) (uint64, bool) {
+	for _, c := range rb.containers {
+		if i < uint64(c.n) {
+			return uint64(c.key)<<16 | uint64(c.selectAt(int(i))), true
+		}
+		i -= uint64(c.n)
+	}
+	return 0, false
+}
+
+// Seek returns the smallest value not less than v, and false if there is no such value
+func (rb *RoaringBitmap) Seek(v uint64) (uint64, bool) {
+	if v == 0 {
+		return rb.Select(0)
+	}
+	return rb.Select(rb.Rank(v - 1))
+}
+
+// Or adds all the values of the other bitmap into this one
+func (rb *RoaringBitmap) Or(other *RoaringBitmap) {
+	for _, oc := range other.containers {
+		i, ok := rb.find(oc.key)
+		if !ok {
+			rb.containers = append(rb.containers, nil)
+			copy(rb.containers[i+1:], rb.containers[i:])
+			rb.containers[i] = oc.copy()
+			continue
+		}
+		c := rb.containers[i]
+		oc.forEach(c.add)
+	}
+}
+
+// Encode serialises the bitmap as the number of the containers (uint32 big endian), followed by the containers,
+// each being its key (uint16 big endian), its cardinality minus one (uint16 big endian), and either its sorted values
+// (uint16 big endian each), or its bitmap (1024 uint64 big endian) when the cardinality is above 4096
+func (rb *RoaringBitmap) Encode() []byte {
+	size := 4
+	for _, c := range rb.containers {
+		if c.bits != nil {
+			size += 4 + 8*roaringBitmapWords
+		} else {
+			size += 4 + 2*c.n
+		}
+	}
+	b := make([]byte, size)
+	binary.BigEndian.PutUint32(b, uint32(len(rb.containers)))
+	pos := 4
+	for _, c := range rb.containers {
+		binary.BigEndian.PutUint16(b[pos:], c.key)
+		binary.BigEndian.PutUint16(b[pos+2:], uint16(c.n-1))
+		pos += 4
+		if c.bits != nil {
+			for _, word := range c.bits {
+				binary.BigEndian.PutUint64(b[pos:], word)
+				pos += 8
+			}
+		} else {
+			for _, v := range c.array {
+				binary.BigEndian.PutUint16(b[pos:], v)
+				pos += 2
+			}
+		}
+	}
+	return b
+}
+
+// DecodeRoaringBitmap is the inverse of RoaringBitmap.Encode, empty input decodes into the empty bitmap
+func DecodeRoaringBitmap(b []byte) (*RoaringBitmap, error) {
+	rb := NewRoaringBitmap()
+	if len(b) == 0 {
+		return rb, nil
+	}
+	if len(b) < 4 {
+		return nil, fmt.Errorf("roaring bitmap: encoding too short: %d", len(b))
+	}
+	count := int(binary.BigEndian.Uint32(b))
+	pos := 4
+	for i := 0; i < count; i++ {
+		if len(b) < pos+4 {
+			return nil, fmt.Errorf("roaring bitmap: container %d truncated", i)
+		}
+		c := &roaringContainer{key: binary.BigEndian.Uint16(b[pos:]), n: int(binary.BigEndian.Uint16(b[pos+2:])) + 1}
+		pos += 4
+		if i > 0 && c.key <= rb.containers[i-1].key {
+			return nil, fmt.Errorf("roaring bitmap: container keys not sorted: %d after %d", c.key, rb.containers[i-1].key)
+		}
+		if c.n > roaringArrayMaxSize {
+			if len(b) < pos+8*roaringBitmapWords {
+				return nil, fmt.Errorf("roaring bitmap: container %d truncated", i)
+			}
+			c.bits = make([]uint64, roaringBitmapWords)
+			n := 0
+			for w := range c.bits {
+				c.bits[w] = binary.BigEndian.Uint64(b[pos:])
+				n += bits.OnesCount64(c.bits[w])
+				pos += 8
+			}
+			if n != c.n {
+				return nil, fmt.Errorf("roaring bitmap: container %d has %d values, expected %d", i, n, c.n)
+			}
+		} else {
+			if len(b) < pos+2*c.n {
+				return nil, fmt.Errorf("roaring bitmap: container %d truncated", i)
+			}
+			c.array = make([]uint16, c.n)
+			for j := range c.array {
+				c.array[j] = binary.BigEndian.Uint16(b[pos:])
+				pos += 2
+			}
+		}
+		rb.containers = append(rb.containers, c)
+	}
+	if pos != len(b) {
+		return nil, fmt.Errorf("roaring bitmap: %d trailing bytes", len(b)-pos)
+	}
+	return rb, nil
+}
@@ -0,0 +1,94 @@
+package ethdb
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestRoaringBitmap(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	rb := NewRoaringBitmap()
+	set := make(map[uint64]struct{})
+	// Dense values in the first container turn it into a bitmap, sparse ones are kept in the arrays
+	for i := 0; i < 6000; i++ {
+		set[uint64(rnd.Intn(1<<16))] = struct{}{}
+	}
+	for i := 0; i < 300; i++ {
+		set[uint64(rnd.Int63n(1<<32))] = struct{}{}
+	}
+	for v := range set {
+		if err := rb.Add(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rb.Add(1 << 32); err == nil {
+		t.Errorf("expected error for the value above 32 bits")
+	}
+
+	check := func(rb *RoaringBitmap) {
+		values := make([]uint64, 0, len(set))
+		for v := range set {
+			values = append(values, v)
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		if n := rb.Cardinality(); n != uint64(len(values)) {
+			t.Fatalf("expected cardinality %d, got %d", len(values), n)
+		}
+		for i, v := range values {
+			if !rb.Contains(v) {
+				t.Errorf("expected %d in the bitmap", v)
+			}
+			if r := rb.Rank(v); r != uint64(i+1) {
+				t.Errorf("expected rank %d of %d, got %d", i+1, v, r)
+			}
+			if s, ok := rb.Select(uint64(i)); !ok || s != v {
+				t.Errorf("expected %d selected at %d, got %d %t", v, i, s, ok)
+			}
+		}
+		if _, ok := rb.Select(uint64(len(values))); ok {
+			t.Errorf("expected nothing selected past the cardinality")
+		}
+		for i := 0; i < 1000; i++ {
+			v := uint64(rnd.Int63n(1 << 32))
+			j := sort.Search(len(values), func(j int) bool { return values[j] >= v })
+			s, ok := rb.Seek(v)
+			if j == len(values) {
+				if ok {
+					t.Errorf("expected nothing after %d, got %d", v, s)
+				}
+			} else if !ok || s != values[j] {
+				t.Errorf("expected %d after %d, got %d %t", values[j], v, s, ok)
+			}
+		}
+	}
+	check(rb)
+
+	decoded, err := DecodeRoaringBitmap(rb.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(decoded)
+
+	// Removal turns the bitmap container back into the array
+	for v := range set {
+		if v < 3000 {
+			rb.Remove(v)
+			delete(set, v)
+		}
+	}
+	check(rb)
+
+	other := NewRoaringBitmap()
+	for _, v := range []uint64{1, 2, 1 << 20, 1<<31 + 5} {
+		if err := other.Add(v); err != nil {
+			t.Fatal(err)
+		}
+		set[v] = struct{}{}
+	}
+	rb.Or(other)
+	check(rb)
+	if _, err = DecodeRoaringBitmap(rb.Encode()[:10]); err == nil {
+		t.Errorf("expected error for the truncated encoding")
+	}
+}
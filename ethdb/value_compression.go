@@ -0,0 +1,286 @@
+package ethdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/ledgerwatch/bolt"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+	"github.com/ledgerwatch/turbo-geth/log"
+	"github.com/ledgerwatch/turbo-geth/metrics"
+)
+
+// ValueCodec identifies the compression of the values of a bucket. Each stored value is prefixed with
+// the codec it was written with, so that the values not worth compressing are stored as they are.
+// zstd is not supported: it is not among the dependencies of the module, so snappy, which already is,
+// is used instead. Adding zstd is a new codec and does not change the format of the stored values
+type ValueCodec byte
+
+const (
+	CodecNone ValueCodec = iota
+	CodecSnappy
+)
+
+func (c ValueCodec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecSnappy:
+		return "snappy"
+	default:
+		return fmt.Sprintf("codec %d", byte(c))
+	}
+}
+
+// ParseValueCodec returns the codec by its name
+func ParseValueCodec(name string) (ValueCodec, error) {
+	switch name {
+	case "none":
+		return CodecNone, nil
+	case "snappy":
+		return CodecSnappy, nil
+	case "zstd":
+		return 0, fmt.Errorf("codec zstd is not supported, use snappy")
+	default:
+		return 0, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+// minCompressedValue is the size of the smallest value worth compressing
+const minCompressedValue = 64
+
+// valueMigrationBatch is the number of values re-encoded in one transaction by EnableValueCompression
+const valueMigrationBatch = 10000
+
+type valueCompression struct {
+	codec    ValueCodec
+	migrated bool
+	progress []byte // Last key re-encoded by the migration. Values of the keys after it are stored as they are
+
+	rawBytes    metrics.Counter // Size of the values before compression
+	storedBytes metrics.Counter // Size of the values as stored
+}
+
+func newValueCompression(bucket []byte, codec ValueCodec, migrated bool, progress []byte) *valueCompression {
+	return &valueCompression{
+		codec:       codec,
+		migrated:    migrated,
+		progress:    progress,
+		rawBytes:    metrics.GetOrRegisterCounter("db/compression/"+string(bucket)+"/raw", nil),
+		storedBytes: metrics.GetOrRegisterCounter("db/compression/"+string(bucket)+"/stored", nil),
+	}
+}
+
+// encoded tells whether the value of the key is stored with the codec prefix
+func (vc *valueCompression) encoded(key []byte) bool {
+	return vc.migrated || (vc.progress != nil && bytes.Compare(key, vc.progress) <= 0)
+}
+
+func (vc *valueCompression) encode(value []byte) []byte {
+	vc.rawBytes.Inc(int64(len(value)))
+	if vc.codec == CodecSnappy && len(value) >= minCompressedValue {
+		compressed := snappy.Encode(nil, value)
+		if len(compressed) < len(value) {
+			enc := make([]byte, 1+len(compressed))
+			enc[0] = byte(CodecSnappy)
+			copy(enc[1:], compressed)
+			vc.storedBytes.Inc(int64(len(enc)))
+			return enc
+		}
+	}
+	enc := make([]byte, 1+len(value))
+	enc[0] = byte(CodecNone)
+	copy(enc[1:], value)
+	vc.storedBytes.Inc(int64(len(enc)))
+	return enc
+}
+
+func decodeValue(enc []byte) ([]byte, error) {
+	if len(enc) == 0 {
+		return nil, fmt.Errorf("missing codec of the value")
+	}
+	switch ValueCodec(enc[0]) {
+	case CodecNone:
+		return enc[1:], nil
+	case CodecSnappy:
+		return snappy.Decode(nil, enc[1:])
+	default:
+		return nil, fmt.Errorf("unknown codec %d of the value", enc[0])
+	}
+}
+
+// EnableValueCompression switches the bucket to storing the values compressed with the codec, and re-encodes
+// the existing values. The progress is recorded in the database, so an interrupted migration is resumed by calling
+// it again. It must not run concurrently with the other users of the database
+func (db *BoltDatabase) EnableValueCompression(ctx context.Context, bucket []byte, codec ValueCodec) error {
+	if _, ok := db.compressed[string(bucket)]; ok {
+		return fmt.Errorf("bucket %s uses the prefix-compressed keys", bucket)
+	}
+	if debug.IsThinHistory() && (bytes.Equal(bucket, dbutils.AccountsHistoryBucket) || bytes.Equal(bucket, dbutils.StorageHistoryBucket)) {
+		return fmt.Errorf("bucket %s holds the history index with the thin history", bucket)
+	}
+	vc, ok := db.valueCodecs[string(bucket)]
+	if ok && vc.codec != codec {
+		return fmt.Errorf("bucket %s is already compressed with %s", bucket, vc.codec)
+	}
+	if !ok {
+		vc = newValueCompression(bucket, codec, false, nil)
+		if err := db.db.Update(func(tx *bolt.Tx) error {
+			return putValueCompression(tx, bucket, vc)
+		}); err != nil {
+			return err
+		}
+		db.setValueCompression(bucket, vc)
+	}
+	var total, before, after int
+	for !vc.migrated {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// The progress in memory is only advanced when the batch is committed
+		next := *vc
+		if err := db.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(bucket)
+			var keys, values [][]byte
+			if b != nil {
+				c := b.Cursor()
+				var k, v []byte
+				if vc.progress == nil {
+					k, v = c.First()
+				} else if k, v = c.Seek(vc.progress); k != nil && bytes.Equal(k, vc.progress) {
+					k, v = c.Next()
+				}
+				for ; k != nil && len(keys) < valueMigrationBatch; k, v = c.Next() {
+					keys = append(keys, common.CopyBytes(k))
+					values = append(values, vc.encode(v))
+					before += len(v)
+					after += len(values[len(values)-1])
+				}
+			}
+			for i, k := range keys {
+				if err := b.Put(k, values[i]); err != nil {
+					return err
+				}
+			}
+			total += len(keys)
+			if len(keys) < valueMigrationBatch {
+				next.migrated = true
+			} else {
+				next.progress = keys[len(keys)-1]
+			}
+			return putValueCompression(tx, bucket, &next)
+		}); err != nil {
+			return err
+		}
+		vc.migrated, vc.progress = next.migrated, next.progress
+		log.Info("Compressing values", "bucket", string(bucket), "values", total, "before", common.StorageSize(before), "after", common.StorageSize(after))
+	}
+	return nil
+}
+
+func putValueCompression(tx *bolt.Tx, bucket []byte, vc *valueCompression) error {
+	meta, err := tx.CreateBucketIfNotExists(dbutils.ValueCompressionBucket, false)
+	if err != nil {
+		return err
+	}
+	v := make([]byte, 2+len(vc.progress))
+	v[0] = byte(vc.codec)
+	if vc.migrated {
+		v[1] = 1
+	}
+	copy(v[2:], vc.progress)
+	return meta.Put(bucket, v)
+}
+
+func (db *BoltDatabase) setValueCompression(bucket []byte, vc *valueCompression) {
+	if db.valueCodecs == nil {
+		db.valueCodecs = make(map[string]*valueCompression)
+	}
+	db.valueCodecs[string(bucket)] = vc
+}
+
+// loadValueCompression reads the policies of the buckets recorded by EnableValueCompression
+func (db *BoltDatabase) loadValueCompression() error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(dbutils.ValueCompressionBucket)
+		if meta == nil {
+			return nil
+		}
+		c := meta.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) < 2 {
+				return fmt.Errorf("invalid value compression record for bucket %s", k)
+			}
+			var progress []byte
+			if len(v) > 2 {
+				progress = common.CopyBytes(v[2:])
+			}
+			bucket := common.CopyBytes(k)
+			db.setValueCompression(bucket, newValueCompression(bucket, ValueCodec(v[0]), v[1] == 1, progress))
+		}
+		return nil
+	})
+}
+
+// encodeValue prepares the value for storing in the bucket
+func (db *BoltDatabase) encodeValue(bucket, key, value []byte) []byte {
+	if vc, ok := db.valueCodecs[string(bucket)]; ok && vc.encoded(key) {
+		return vc.encode(value)
+	}
+	return value
+}
+
+// decodeValue restores the value read from the bucket
+func (db *BoltDatabase) decodeValue(bucket, key, value []byte) ([]byte, error) {
+	if vc, ok := db.valueCodecs[string(bucket)]; ok && value != nil && vc.encoded(key) {
+		return decodeValue(value)
+	}
+	return value, nil
+}
+
+// decodingCursor returns the values of the compressed bucket decoded. A value that cannot be decoded ends
+// the iteration, and the error is returned by cursorErr
+type decodingCursor struct {
+	boltCursor
+	db     *BoltDatabase
+	bucket []byte
+	err    error
+}
+
+func (c *decodingCursor) decode(k, v []byte) ([]byte, []byte) {
+	if k == nil || c.err != nil {
+		return nil, nil
+	}
+	dec, err := c.db.decodeValue(c.bucket, k, v)
+	if err != nil {
+		c.err = fmt.Errorf("decoding the value of %x in bucket %s: %w", k, c.bucket, err)
+		return nil, nil
+	}
+	return k, dec
+}
+
+// cursorErr returns the first error that ended the iteration of the cursors early
+func cursorErr(cursors ...boltCursor) error {
+	for _, c := range cursors {
+		if dc, ok := c.(*decodingCursor); ok && dc.err != nil {
+			return dc.err
+		}
+	}
+	return nil
+}
+
+func (c *decodingCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.decode(c.boltCursor.Seek(seek))
+}
+
+func (c *decodingCursor) SeekTo(seek []byte) ([]byte, []byte) {
+	return c.decode(c.boltCursor.SeekTo(seek))
+}
+
+func (c *decodingCursor) Next() ([]byte, []byte) {
+	return c.decode(c.boltCursor.Next())
+}
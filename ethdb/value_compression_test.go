@@ -0,0 +1,92 @@
+package ethdb
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ledgerwatch/bolt"
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/common/debug"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueCompression(t *testing.T) {
+	db := NewMemDatabase()
+	defer db.Close()
+
+	values := map[string][]byte{
+		"01": bytes.Repeat([]byte{0x60}, 1000),
+		"02": {0x01, 0x02},
+		"03": bytes.Repeat([]byte{0x01, 0x02, 0x03}, 100),
+	}
+	for k, v := range values {
+		assert.NoError(t, db.Put(bucket, common.FromHex(k), v))
+	}
+	assert.NoError(t, db.EnableValueCompression(context.Background(), bucket, CodecSnappy))
+	assert.NoError(t, db.Put(bucket, common.FromHex("04"), bytes.Repeat([]byte{0x04}, 500)))
+	values["04"] = bytes.Repeat([]byte{0x04}, 500)
+
+	check := func(db *BoltDatabase) {
+		for k, v := range values {
+			got, err := db.Get(bucket, common.FromHex(k))
+			assert.NoError(t, err)
+			assert.Equal(t, v, got, "key %s", k)
+		}
+		var walked int
+		assert.NoError(t, db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+			assert.Equal(t, values[common.Bytes2Hex(k)], v)
+			walked++
+			return true, nil
+		}))
+		assert.Equal(t, len(values), walked)
+	}
+	check(db)
+
+	// Values are stored compressed
+	var stored int
+	assert.NoError(t, db.db.View(func(tx *bolt.Tx) error {
+		v, _ := tx.Bucket(bucket).Get(common.FromHex("01"))
+		stored = len(v)
+		return nil
+	}))
+	assert.True(t, stored < len(values["01"]))
+
+	// The policy is recorded in the database
+	check(NewWrapperBoltDatabase(db.DB()))
+
+	assert.Error(t, db.EnableValueCompression(context.Background(), bucket, CodecNone))
+
+	// A value that cannot be decoded fails the walk instead of being returned empty
+	assert.NoError(t, db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put(common.FromHex("02"), []byte{byte(CodecSnappy), 0xff})
+	}))
+	var walked int
+	assert.Error(t, db.Walk(bucket, nil, 0, func(k, v []byte) (bool, error) {
+		walked++
+		return true, nil
+	}))
+	assert.Equal(t, 1, walked)
+}
+
+func TestValueCompressionHistory(t *testing.T) {
+	if debug.IsThinHistory() {
+		t.Skip("history buckets hold the index with the thin history")
+	}
+	db := NewMemDatabase()
+	defer db.Close()
+	assert.NoError(t, db.EnableValueCompression(context.Background(), dbutils.AccountsHistoryBucket, CodecSnappy))
+
+	key := common.FromHex("aa")
+	original := bytes.Repeat([]byte{0x11}, 200)
+	assert.NoError(t, db.PutS(dbutils.AccountsHistoryBucket, key, original, 5, false))
+	assert.NoError(t, db.Put(dbutils.AccountsBucket, key, []byte{0x22}))
+
+	v, err := db.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, key, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, original, v)
+	v, err = db.GetAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, key, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x22}, v)
+}
@@ -443,6 +443,21 @@ web3._extend({
 			call: 'debug_storageRangeAt',
 			params: 5,
 		}),
+		new web3._extend.Method({
+			name: 'topContractsBySize',
+			call: 'debug_topContractsBySize',
+			params: 1,
+		}),
+		new web3._extend.Method({
+			name: 'blockTouchStats',
+			call: 'debug_blockTouchStats',
+			params: 1,
+		}),
+		new web3._extend.Method({
+			name: 'stateChecksum',
+			call: 'debug_stateChecksum',
+			params: 0,
+		}),
 		new web3._extend.Method({
 			name: 'getModifiedAccountsByNumber',
 			call: 'debug_getModifiedAccountsByNumber',
@@ -1052,10 +1052,16 @@ func GetState(blockchain *core.BlockChain, parent *types.Block) (*state.IntraBlo
 		return nil, nil, err
 	}
 
-	tds, err := state.GetTrieDbState(parent.Root(), blockchain.ChainDb(), parent.NumberU64())
+	tds, err := blockchain.GetTrieDbState()
 	if err != nil {
 		return nil, nil, err
 	}
+	if tds.LastRoot() != parent.Root() || tds.GetBlockNr() != parent.NumberU64() {
+		// The chain has moved on from the parent, its state is resolved from the database on demand
+		if tds, err = state.NewTrieDbState(parent.Root(), blockchain.ChainDb(), parent.NumberU64()); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	tds = tds.WithNewBuffer()
 	tds.SetResolveReads(false)
@@ -0,0 +1,56 @@
+package trie
+
+import "github.com/ledgerwatch/turbo-geth/common"
+
+// CodeWindow keeps the contract codes included into (embedded or referenced by) the last K witnesses.
+// It is maintained in the same way by the producer and the consumer of the witnesses, so that the codes
+// present in the window can be referenced by hash rather than embedded
+type CodeWindow struct {
+	size   int
+	blocks []CodeMap           // Codes of the last witnesses, oldest first
+	counts map[common.Hash]int // Number of witnesses in the window including each code
+	codes  map[common.Hash][]byte
+}
+
+// NewCodeWindow creates the window over the given number of the witnesses
+func NewCodeWindow(size int) *CodeWindow {
+	if size < 1 {
+		size = 1
+	}
+	return &CodeWindow{
+		size:   size,
+		counts: make(map[common.Hash]int),
+		codes:  make(map[common.Hash][]byte),
+	}
+}
+
+func (w *CodeWindow) Has(codeHash common.Hash) bool {
+	_, ok := w.codes[codeHash]
+	return ok
+}
+
+func (w *CodeWindow) Get(codeHash common.Hash) ([]byte, bool) {
+	code, ok := w.codes[codeHash]
+	return code, ok
+}
+
+// Add moves the window forward by one witness, with the given codes
+func (w *CodeWindow) Add(codes CodeMap) {
+	if len(w.blocks) == w.size {
+		for codeHash := range w.blocks[0] {
+			w.counts[codeHash]--
+			if w.counts[codeHash] == 0 {
+				delete(w.counts, codeHash)
+				delete(w.codes, codeHash)
+			}
+		}
+		w.blocks = w.blocks[1:]
+	}
+	block := make(CodeMap, len(codes))
+	for codeHash, code := range codes {
+		block[codeHash] = code
+		w.counts[codeHash]++
+		w.codes[codeHash] = code
+	}
+	w.blocks = append(w.blocks, block)
+}
@@ -33,3 +33,16 @@ type MissingNodeError struct {
 func (err *MissingNodeError) Error() string {
 	return fmt.Sprintf("missing trie node %x (path %x)", err.NodeHash, err.Path)
 }
+
+// ErrHashMismatch is returned when the hash of the sub-trie loaded from the database (see ResolveWithDb)
+// does not match the hash node it is supposed to replace. It normally means that the database
+// does not correspond to the trie, and the caller may want to rebuild the trie or unwind
+type ErrHashMismatch struct {
+	Expected common.Hash
+	Got      common.Hash
+	Prefix   []byte // Hex-encoded path to the sub-trie, including the contract prefix for the storage tries
+}
+
+func (err *ErrHashMismatch) Error() string {
+	return fmt.Sprintf("mismatching hash for prefix %x: expected %x, got %x", err.Prefix, err.Expected, err.Got)
+}
@@ -0,0 +1,196 @@
+package trie
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ExportFormat specifies the output format of ExportTrie
+type ExportFormat int
+
+const (
+	ExportDOT  ExportFormat = iota // graphviz DOT
+	ExportJSON                     // structured JSON
+)
+
+// ExportedNode is the description of a cached trie node, as produced by ExportTrie
+type ExportedNode struct {
+	Type     string          `json:"type"`
+	Prefix   string          `json:"prefix"`          // Path from the root to the node, in HEX encoding
+	Key      string          `json:"key,omitempty"`   // Key of the short node, in HEX encoding
+	Hash     string          `json:"hash,omitempty"`  // Cached hash (for branch nodes, only if it is up to date), storage root for accounts
+	Gen      uint64          `json:"gen,omitempty"`   // Generation of the leaf (see GetWithGen)
+	Value    string          `json:"value,omitempty"` // Value of the leaf, or the summary of the account
+	Children []*ExportedNode `json:"children,omitempty"`
+}
+
+const hexNibbles = "0123456789abcdef"
+
+// nibblesToString renders HEX encoding as a string, with the terminator shown as "T"
+func nibblesToString(hex []byte) string {
+	var sb strings.Builder
+	for _, nibble := range hex {
+		if nibble < 16 {
+			sb.WriteByte(hexNibbles[nibble])
+		} else {
+			sb.WriteByte('T')
+		}
+	}
+	return sb.String()
+}
+
+// ExportTrie writes the structure of the cached part of the trie (node types, hashes, key prefixes
+// and generations) in the DOT or JSON format. If prefix (in HEX encoding) is not empty, only the subtrie
+// containing the keys with this prefix is exported.
+func (t *Trie) ExportTrie(w io.Writer, format ExportFormat, prefix []byte) error {
+	nd, hex := t.findSubtrie(prefix)
+	exported := exportNode(nd, hex)
+	switch format {
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(exported)
+	case ExportDOT:
+		var buf bytes.Buffer
+		buf.WriteString("digraph trie {\n\tnode [shape=box];\n")
+		if exported != nil {
+			id := 0
+			exportDOT(&buf, exported, &id)
+		}
+		buf.WriteString("}\n")
+		_, err := w.Write(buf.Bytes())
+		return err
+	default:
+		return fmt.Errorf("unknown export format: %d", format)
+	}
+}
+
+// findSubtrie returns the topmost node containing all the keys with the given prefix, and the path to it
+func (t *Trie) findSubtrie(prefix []byte) (node, []byte) {
+	nd := t.root
+	pos := 0
+	for pos < len(prefix) {
+		switch n := nd.(type) {
+		case *shortNode:
+			matchlen := prefixLen(prefix[pos:], n.Key)
+			if pos+matchlen == len(prefix) {
+				return n, prefix[:pos]
+			}
+			if matchlen < len(n.Key) && n.Key[matchlen] != 16 {
+				return nil, prefix
+			}
+			nd = n.Val
+			pos += matchlen
+		case *duoNode:
+			i1, i2 := n.childrenIdx()
+			switch prefix[pos] {
+			case i1:
+				nd = n.child1
+			case i2:
+				nd = n.child2
+			default:
+				return nil, prefix
+			}
+			pos++
+		case *fullNode:
+			nd = n.Children[prefix[pos]]
+			pos++
+		case *accountNode:
+			nd = n.storage
+		default:
+			// Value nodes, hash nodes and nil do not have children
+			return nil, prefix
+		}
+	}
+	return nd, prefix[:pos]
+}
+
+func exportNode(nd node, hex []byte) *ExportedNode {
+	switch n := nd.(type) {
+	case nil:
+		return nil
+	case *shortNode:
+		e := &ExportedNode{Type: "short", Prefix: nibblesToString(hex), Key: nibblesToString(n.Key), Gen: n.gen}
+		if child := exportNode(n.Val, concat(hex, n.Key...)); child != nil {
+			e.Children = append(e.Children, child)
+		}
+		return e
+	case *duoNode:
+		e := &ExportedNode{Type: "duo", Prefix: nibblesToString(hex)}
+		if !n.flags.dirty {
+			e.Hash = fmt.Sprintf("%x", n.flags.hash[:])
+		}
+		i1, i2 := n.childrenIdx()
+		e.Children = append(e.Children, exportNode(n.child1, concat(hex, i1)), exportNode(n.child2, concat(hex, i2)))
+		return e
+	case *fullNode:
+		e := &ExportedNode{Type: "full", Prefix: nibblesToString(hex)}
+		if !n.flags.dirty {
+			e.Hash = fmt.Sprintf("%x", n.flags.hash[:])
+		}
+		for i, child := range n.Children {
+			if child != nil {
+				e.Children = append(e.Children, exportNode(child, concat(hex, byte(i))))
+			}
+		}
+		return e
+	case *accountNode:
+		e := &ExportedNode{
+			Type:   "account",
+			Prefix: nibblesToString(hex),
+			Value:  fmt.Sprintf("nonce=%d balance=%s incarnation=%d", n.Nonce, n.Balance.String(), n.Incarnation),
+		}
+		if n.hashCorrect {
+			e.Hash = fmt.Sprintf("%x", n.Root[:])
+		}
+		// Storage keys continue after the terminator of the account key
+		storageHex := hex
+		if len(storageHex) > 0 && storageHex[len(storageHex)-1] == 16 {
+			storageHex = storageHex[:len(storageHex)-1]
+		}
+		if child := exportNode(n.storage, storageHex); child != nil {
+			e.Children = append(e.Children, child)
+		}
+		return e
+	case valueNode:
+		return &ExportedNode{Type: "value", Prefix: nibblesToString(hex), Value: fmt.Sprintf("%x", []byte(n))}
+	case hashNode:
+		return &ExportedNode{Type: "hash", Prefix: nibblesToString(hex), Hash: fmt.Sprintf("%x", []byte(n))}
+	default:
+		panic(fmt.Sprintf("%T: invalid node: %v", nd, nd))
+	}
+}
+
+func exportDOT(buf *bytes.Buffer, e *ExportedNode, id *int) int {
+	myID := *id
+	*id++
+	label := e.Type
+	if e.Prefix != "" {
+		label += "\\nprefix " + e.Prefix
+	}
+	if e.Key != "" {
+		label += "\\nkey " + e.Key
+	}
+	if e.Gen != 0 {
+		label += fmt.Sprintf("\\ngen %d", e.Gen)
+	}
+	if e.Hash != "" {
+		label += "\\nhash " + e.Hash[:8] + ".."
+	}
+	if e.Value != "" {
+		value := e.Value
+		if len(value) > 32 {
+			value = value[:32] + ".."
+		}
+		label += "\\n" + value
+	}
+	fmt.Fprintf(buf, "\tn%d [label=\"%s\"];\n", myID, label)
+	for _, child := range e.Children {
+		childID := exportDOT(buf, child, id)
+		fmt.Fprintf(buf, "\tn%d -> n%d;\n", myID, childID)
+	}
+	return myID
+}
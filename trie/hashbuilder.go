@@ -70,7 +70,7 @@ func (hb *HashBuilder) leaf(length int, keyHex []byte, val rlphacks.RlpSerializa
 func (hb *HashBuilder) leafHashWithKeyVal(key []byte, val rlphacks.RlpSerializable) error {
 	var hash [hashStackStride]byte // RLP representation of hash (or of un-hashed value if short)
 	// Compute the total length of binary representation
-	var keyPrefix [1]byte
+	var keyPrefix [3]byte
 	var lenPrefix [4]byte
 	var kp, kl int
 	// Write key
@@ -93,8 +93,7 @@ func (hb *HashBuilder) leafHashWithKeyVal(key []byte, val rlphacks.RlpSerializab
 		}
 	}
 	if compactLen > 1 {
-		keyPrefix[0] = 0x80 + byte(compactLen)
-		kp = 1
+		kp = generateKeyPrefix(keyPrefix[:], compactLen)
 		kl = compactLen
 	} else {
 		kl = 1
@@ -112,7 +111,26 @@ func (hb *HashBuilder) leafHashWithKeyVal(key []byte, val rlphacks.RlpSerializab
 	return nil
 }
 
-func (hb *HashBuilder) completeLeafHash(kp, kl, compactLen int, key []byte, keyPrefix [1]byte, compact0 byte, ni int, lenPrefix [4]byte, hash []byte, val rlphacks.RlpSerializable) error {
+// generateKeyPrefix writes the RLP prefix of the compact-encoded key of length compactLen, and returns the length
+// of the prefix. Keys of the binary tries can be longer than 55 bytes, so that they need the long string prefix
+func generateKeyPrefix(keyPrefix []byte, compactLen int) int {
+	switch {
+	case compactLen < 56:
+		keyPrefix[0] = 0x80 + byte(compactLen)
+		return 1
+	case compactLen < 256:
+		keyPrefix[0] = 0xb8
+		keyPrefix[1] = byte(compactLen)
+		return 2
+	default:
+		keyPrefix[0] = 0xb9
+		keyPrefix[1] = byte(compactLen >> 8)
+		keyPrefix[2] = byte(compactLen)
+		return 3
+	}
+}
+
+func (hb *HashBuilder) completeLeafHash(kp, kl, compactLen int, key []byte, keyPrefix [3]byte, compact0 byte, ni int, lenPrefix [4]byte, hash []byte, val rlphacks.RlpSerializable) error {
 	totalLen := kp + kl + val.DoubleRLPLen()
 	pt := rlphacks.GenerateStructLen(lenPrefix[:], totalLen)
 
@@ -251,7 +269,7 @@ func (hb *HashBuilder) accountLeafHash(length int, keyHex []byte, storageSize ui
 func (hb *HashBuilder) accountLeafHashWithKey(key []byte, popped int) error {
 	var hash [hashStackStride]byte // RLP representation of hash (or un-hashes value)
 	// Compute the total length of binary representation
-	var keyPrefix [1]byte
+	var keyPrefix [3]byte
 	var lenPrefix [4]byte
 	var kp, kl int
 	// Write key
@@ -274,8 +292,7 @@ func (hb *HashBuilder) accountLeafHashWithKey(key []byte, popped int) error {
 		}
 	}
 	if compactLen > 1 {
-		keyPrefix[0] = byte(128 + compactLen)
-		kp = 1
+		kp = generateKeyPrefix(keyPrefix[:], compactLen)
 		kl = compactLen
 	} else {
 		kl = 1
@@ -330,7 +347,7 @@ func (hb *HashBuilder) extensionHash(key []byte) error {
 	}
 	branchHash := hb.hashStack[len(hb.hashStack)-hashStackStride:]
 	// Compute the total length of binary representation
-	var keyPrefix [1]byte
+	var keyPrefix [3]byte
 	var lenPrefix [4]byte
 	var kp, kl int
 	// Write key
@@ -354,8 +371,7 @@ func (hb *HashBuilder) extensionHash(key []byte) error {
 		}
 	}
 	if compactLen > 1 {
-		keyPrefix[0] = 0x80 + byte(compactLen)
-		kp = 1
+		kp = generateKeyPrefix(keyPrefix[:], compactLen)
 		kl = compactLen
 	} else {
 		kl = 1
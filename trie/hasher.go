@@ -168,11 +168,12 @@ func (h *hasher) hashChildren(original node, bufOffset int) ([]byte, error) {
 			// Hashing the storage trie if necessary
 			if ac.storage == nil {
 				ac.Root = EmptyRoot
-			} else {
+			} else if !ac.hashCorrect {
 				_, err := h.hashInternal(ac.storage, true, ac.Root[:], bufOffset+pos)
 				if err != nil {
 					return nil, err
 				}
+				ac.hashCorrect = true
 			}
 
 			written, err := h.accountNodeToBuffer(ac, buffer, pos)
@@ -0,0 +1,268 @@
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+)
+
+// MultiProof produces a Merkle multiproof for the given accounts and storage items.
+// accountKeys are hashes of the addresses (32 bytes), storageKeys are composite keys
+// made of the address hash and the hash of the storage key (64 bytes), as produced by dbutils.GenerateCompositeTrieKey.
+// The multiproof is the list of RLP encodings of all trie nodes that are referenced by hash and lie on the
+// paths to the given keys (including the roots of storage tries). Nodes shared by several paths are
+// emitted only once. The paths need to be fully resolved, otherwise MissingNodeError is returned.
+// It is an alternative to the block witness for the consumers that only need to check few keys against the state root.
+func MultiProof(t *Trie, accountKeys [][]byte, storageKeys [][]byte) ([][]byte, error) {
+	if t.binary {
+		return nil, errors.New("multiproofs are not supported for binary tries")
+	}
+	var proof [][]byte
+	if t.root == nil {
+		return proof, nil
+	}
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+	seen := make(map[common.Hash]struct{})
+	for _, key := range accountKeys {
+		if err := t.collectProofNodes(h, keybytesToHex(key), seen, &proof); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range storageKeys {
+		if err := t.collectProofNodes(h, keybytesToHex(key), seen, &proof); err != nil {
+			return nil, err
+		}
+	}
+	return proof, nil
+}
+
+// collectProofNodes appends to the proof encodings of the hash-referenced nodes on the path to the given key
+func (t *Trie) collectProofNodes(h *hasher, hex []byte, seen map[common.Hash]struct{}, proof *[][]byte) error {
+	nd := t.root
+	pos := 0
+	isRoot := true
+	for {
+		switch n := nd.(type) {
+		case *shortNode, *duoNode, *fullNode:
+			enc, err := h.hashChildren(n, 0)
+			if err != nil {
+				return err
+			}
+			if len(enc) >= common.HashLength || isRoot {
+				hash := common.BytesToHash(h.makeHashNode(enc))
+				if _, ok := seen[hash]; !ok {
+					seen[hash] = struct{}{}
+					*proof = append(*proof, common.CopyBytes(enc))
+				}
+			}
+		}
+		isRoot = false
+		switch n := nd.(type) {
+		case nil, valueNode:
+			return nil
+		case *shortNode:
+			matchlen := prefixLen(hex[pos:], n.Key)
+			if ac, ok := n.Val.(*accountNode); ok && matchlen == len(n.Key)-1 && n.Key[matchlen] == 16 && pos+matchlen < len(hex)-1 {
+				// Key continues past the account, so it is a storage item
+				if ac.storage == nil {
+					return nil
+				}
+				nd = ac.storage
+				pos += matchlen
+				isRoot = true
+			} else if matchlen == len(n.Key) {
+				nd = n.Val
+				pos += matchlen
+			} else {
+				return nil
+			}
+		case *duoNode:
+			i1, i2 := n.childrenIdx()
+			switch hex[pos] {
+			case i1:
+				nd = n.child1
+			case i2:
+				nd = n.child2
+			default:
+				return nil
+			}
+			pos++
+		case *fullNode:
+			nd = n.Children[hex[pos]]
+			pos++
+		case *accountNode:
+			if pos >= len(hex)-1 || n.storage == nil {
+				return nil
+			}
+			nd = n.storage
+			isRoot = true
+		case hashNode:
+			return &MissingNodeError{NodeHash: common.BytesToHash(n), Path: common.CopyBytes(hex[:pos])}
+		default:
+			panic(fmt.Sprintf("%T: invalid node: %v", nd, nd))
+		}
+	}
+}
+
+// VerifyMultiProof checks the multiproof produced by MultiProof against the state root, and returns
+// the accounts and the storage values (in the same order as the keys). Absent items are returned as nil.
+// MissingNodeError is returned if the proof does not contain all the nodes required to reach the keys.
+func VerifyMultiProof(root common.Hash, accountKeys [][]byte, storageKeys [][]byte, proof [][]byte) ([]*accounts.Account, [][]byte, error) {
+	h := newHasher(false)
+	nodes := make(map[common.Hash][]byte, len(proof))
+	for _, enc := range proof {
+		nodes[common.BytesToHash(h.makeHashNode(enc))] = enc
+	}
+	returnHasherToPool(h)
+
+	accs := make([]*accounts.Account, len(accountKeys))
+	for i, key := range accountKeys {
+		acc, err := verifyProofAccount(nodes, root, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		accs[i] = acc
+	}
+	values := make([][]byte, len(storageKeys))
+	for i, key := range storageKeys {
+		if len(key) != 2*common.HashLength {
+			return nil, nil, fmt.Errorf("storage key must be %d bytes long, got %d", 2*common.HashLength, len(key))
+		}
+		acc, err := verifyProofAccount(nodes, root, key[:common.HashLength])
+		if err != nil {
+			return nil, nil, err
+		}
+		if acc == nil || acc.Root == EmptyRoot {
+			continue
+		}
+		leaf, err := lookupProofLeaf(nodes, acc.Root, keybytesToHex(key[common.HashLength:]))
+		if err != nil {
+			return nil, nil, err
+		}
+		if leaf == nil {
+			continue
+		}
+		enc, _, err := rlp.SplitString(leaf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if values[i], _, err = rlp.SplitString(enc); err != nil {
+			return nil, nil, err
+		}
+	}
+	return accs, values, nil
+}
+
+func verifyProofAccount(nodes map[common.Hash][]byte, root common.Hash, key []byte) (*accounts.Account, error) {
+	if root == EmptyRoot || root == (common.Hash{}) {
+		return nil, nil
+	}
+	leaf, err := lookupProofLeaf(nodes, root, keybytesToHex(key))
+	if err != nil || leaf == nil {
+		return nil, err
+	}
+	enc, _, err := rlp.SplitString(leaf)
+	if err != nil {
+		return nil, err
+	}
+	var acc accounts.Account
+	if err := acc.DecodeForHashing(enc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+// lookupProofLeaf walks the nodes of the proof from the root towards the key (hex encoded with terminator),
+// and returns the RLP encoding of the leaf's value, or nil if the key is not present in the trie
+func lookupProofLeaf(nodes map[common.Hash][]byte, root common.Hash, hex []byte) ([]byte, error) {
+	enc, ok := nodes[root]
+	if !ok {
+		return nil, &MissingNodeError{NodeHash: root}
+	}
+	pos := 0
+	for {
+		elems, _, err := rlp.SplitList(enc)
+		if err != nil {
+			return nil, err
+		}
+		count, err := rlp.CountValues(elems)
+		if err != nil {
+			return nil, err
+		}
+		var child []byte
+		switch count {
+		case 2:
+			compactKey, rest, err := rlp.SplitString(elems)
+			if err != nil {
+				return nil, err
+			}
+			key := compactToHex(compactKey)
+			if hasTerm(key) {
+				if !bytes.Equal(hex[pos:], key) {
+					return nil, nil
+				}
+				return splitRaw(rest)
+			}
+			if !bytes.HasPrefix(hex[pos:], key) {
+				return nil, nil
+			}
+			pos += len(key)
+			if child, err = nthRaw(rest, 0); err != nil {
+				return nil, err
+			}
+		case 17:
+			if child, err = nthRaw(elems, int(hex[pos])); err != nil {
+				return nil, err
+			}
+			pos++
+		default:
+			return nil, fmt.Errorf("invalid number of list elements in a trie node: %d", count)
+		}
+		kind, content, _, err := rlp.Split(child)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case kind == rlp.List:
+			// Node is embedded into its parent
+			enc = child
+		case len(content) == 0:
+			return nil, nil
+		case len(content) == common.HashLength:
+			hash := common.BytesToHash(content)
+			if enc, ok = nodes[hash]; !ok {
+				return nil, &MissingNodeError{NodeHash: hash, Path: common.CopyBytes(hex[:pos])}
+			}
+		default:
+			return nil, fmt.Errorf("invalid reference to a trie node: %x", child)
+		}
+	}
+}
+
+// nthRaw returns the raw encoding (including the RLP prefix) of the n-th item in the list content
+func nthRaw(elems []byte, n int) ([]byte, error) {
+	for i := 0; ; i++ {
+		raw, err := splitRaw(elems)
+		if err != nil {
+			return nil, err
+		}
+		if i == n {
+			return raw, nil
+		}
+		elems = elems[len(raw):]
+	}
+}
+
+// splitRaw returns the raw encoding (including the RLP prefix) of the first item in b
+func splitRaw(b []byte) ([]byte, error) {
+	_, _, rest, err := rlp.Split(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:len(b)-len(rest)], nil
+}
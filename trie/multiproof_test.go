@@ -0,0 +1,74 @@
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+func TestMultiProof(t *testing.T) {
+	trie := newEmpty()
+	var accountKeys [][]byte
+	for i := 0; i < 100; i++ {
+		key := crypto.Keccak256([]byte{byte(i)})
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i)
+		trie.UpdateAccount(key, &acc)
+		accountKeys = append(accountKeys, key)
+	}
+	var storageKeys [][]byte
+	for i := 0; i < 20; i++ {
+		key := append(common.CopyBytes(accountKeys[7]), crypto.Keccak256([]byte{byte(i), 1})...)
+		trie.Update(key, []byte{byte(i + 1), 0xff}, 0)
+		storageKeys = append(storageKeys, key)
+	}
+	root := trie.Hash()
+
+	absentAccount := crypto.Keccak256([]byte("absent"))
+	absentStorage := append(common.CopyBytes(accountKeys[7]), crypto.Keccak256([]byte("absent"))...)
+	proveAccounts := [][]byte{accountKeys[3], accountKeys[7], accountKeys[50], absentAccount}
+	proveStorage := [][]byte{storageKeys[0], storageKeys[11], absentStorage}
+	proof, err := MultiProof(trie, proveAccounts, proveStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var separate int
+	for _, key := range append(proveAccounts, proveStorage...) {
+		p, err := MultiProof(trie, [][]byte{key}, nil)
+		if len(key) > common.HashLength {
+			p, err = MultiProof(trie, nil, [][]byte{key})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		separate += len(p)
+	}
+	if len(proof) >= separate {
+		t.Errorf("multiproof is not compact: %d nodes, %d in separate proofs", len(proof), separate)
+	}
+
+	accs, values, err := VerifyMultiProof(root, proveAccounts, proveStorage, proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, nonce := range []uint64{3, 7, 50} {
+		if accs[i] == nil || accs[i].Nonce != nonce {
+			t.Errorf("unexpected account %d: %+v", i, accs[i])
+		}
+	}
+	if accs[3] != nil {
+		t.Errorf("expected absent account, got %+v", accs[3])
+	}
+	if !bytes.Equal(values[0], []byte{1, 0xff}) || !bytes.Equal(values[1], []byte{12, 0xff}) || values[2] != nil {
+		t.Errorf("unexpected storage values: %x", values)
+	}
+
+	// Removing any node from the proof must make the verification fail
+	if _, _, err = VerifyMultiProof(root, proveAccounts, proveStorage, proof[1:]); err == nil {
+		t.Errorf("expected verification of the incomplete proof to fail")
+	}
+}
@@ -51,6 +51,7 @@ type (
 	shortNode struct {
 		Key []byte // HEX encoding
 		Val node
+		gen uint64 // Block number at which the value of the leaf was last materialized (inserted, updated or resolved)
 	}
 	hashNode  []byte
 	valueNode []byte
@@ -0,0 +1,76 @@
+package trie
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrResolveBudgetExceeded is returned by ResolveWithDb when the resolution is stopped because the budget
+// set by SetBudget is exhausted. The subtries resolved before that remain hooked into the trie
+var ErrResolveBudgetExceeded = errors.New("resolution budget exceeded")
+
+// ResolveBudget limits the work of one invocation of ResolveWithDb. Zero values mean no limit,
+// which is what the block processing uses. Interactive callers (like RPC) can set the limits to get
+// a partial, but quick resolution of the requests with the highest priority
+type ResolveBudget struct {
+	Time  time.Duration // Time spent resolving
+	Bytes int           // Bytes of the keys and values read from the database
+}
+
+func (b ResolveBudget) unlimited() bool {
+	return b.Time <= 0 && b.Bytes <= 0
+}
+
+// SetBudget limits the work of ResolveWithDb. The requests are resolved in the order of decreasing priority
+// (see ResolveRequest.Priority), so that the requests with the lower priority are the ones left unresolved
+func (tr *Resolver) SetBudget(budget ResolveBudget) {
+	tr.budget = budget
+}
+
+// budgetLimits tracks the consumption of the budget across the batches of requests
+type budgetLimits struct {
+	budget    ResolveBudget
+	start     time.Time
+	bytesRead int // Bytes read by the batches already finished
+}
+
+// exceeded is checked for every key read by the current batch, the clock is only looked at every 64 keys
+func (l *budgetLimits) exceeded(keys int, bytesRead int) bool {
+	if l.budget.Bytes > 0 && l.bytesRead+bytesRead > l.budget.Bytes {
+		return true
+	}
+	return l.budget.Time > 0 && keys%64 == 0 && time.Since(l.start) > l.budget.Time
+}
+
+// priorityBatches splits the requests, already sorted by key, into the batches of the same priority,
+// starting from the highest priority. The order of the keys is kept within each batch
+func (tr *Resolver) priorityBatches() [][]*ResolveRequest {
+	requests := make([]*ResolveRequest, len(tr.requests))
+	copy(requests, tr.requests)
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].Priority > requests[j].Priority })
+	var batches [][]*ResolveRequest
+	start := 0
+	for i := 1; i <= len(requests); i++ {
+		if i == len(requests) || requests[i].Priority != requests[start].Priority {
+			batches = append(batches, requests[start:i])
+			start = i
+		}
+	}
+	return batches
+}
+
+// skipResolved removes the requests falling into the subtries that have already been resolved
+func skipResolved(requests []*ResolveRequest, resolved map[string]struct{}) []*ResolveRequest {
+	var remaining []*ResolveRequest
+	for _, req := range requests {
+		covered := false
+		for pos := 0; pos <= req.resolvePos && !covered; pos++ {
+			_, covered = resolved[string(req.contract)+string(req.resolveHex[:pos])]
+		}
+		if !covered {
+			remaining = append(remaining, req)
+		}
+	}
+	return remaining
+}
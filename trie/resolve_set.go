@@ -19,6 +19,8 @@ package trie
 import (
 	"bytes"
 	"sort"
+
+	"github.com/ledgerwatch/turbo-geth/common"
 )
 
 // ResolveSet encapsulates the set of keys that are required to be fully available, or resolved
@@ -28,9 +30,10 @@ import (
 type ResolveSet struct {
 	minLength int // Mininum length of prefixes for which `HashOnly` function can return `true`
 	hexes     sortable
-	inited    bool // Whether keys are sorted and "LTE" and "GT" indices set
-	lteIndex  int  // Index of the "LTE" key in the keys slice. Next one is "GT"
-	binary    bool // if true, use binary encoding instead of Hex
+	wildcards sortable // Prefixes of the subtrees to be resolved entirely, sorted and not covering one another once inited
+	inited    bool     // Whether keys are sorted and "LTE" and "GT" indices set
+	lteIndex  int      // Index of the "LTE" key in the keys slice. Next one is "GT"
+	binary    bool     // if true, use binary encoding instead of Hex
 }
 
 // NewResolveSet creates new ResolveSet
@@ -57,6 +60,29 @@ func (rs *ResolveSet) AddHex(hex []byte) {
 	}
 }
 
+// AddSubtree marks everything under the prefix (in KEY encoding) as required to be resolved,
+// instead of adding every key of the subtree to the set
+func (rs *ResolveSet) AddSubtree(keyPrefix []byte) {
+	hex := keybytesToHex(keyPrefix)
+	rs.AddSubtreeHex(hex[:len(hex)-1])
+}
+
+// AddSubtreeHex marks everything under the prefix (in HEX encoding, without the terminator) as required to be resolved.
+// The empty prefix marks the whole trie
+func (rs *ResolveSet) AddSubtreeHex(hexPrefix []byte) {
+	if rs.binary && len(hexPrefix) > 0 {
+		hexPrefix = keyHexToBin(hexPrefix)
+	}
+	prefix := common.CopyBytes(hexPrefix)
+	if prefix == nil {
+		prefix = []byte{}
+	}
+	rs.wildcards = append(rs.wildcards, prefix)
+	// The nodes on the path to the subtree need to be resolved as well
+	rs.hexes = append(rs.hexes, prefix)
+	rs.inited = false
+}
+
 func (rs *ResolveSet) ensureInited() {
 	if rs.inited {
 		return
@@ -64,6 +90,18 @@ func (rs *ResolveSet) ensureInited() {
 	if !sort.IsSorted(rs.hexes) {
 		sort.Sort(rs.hexes)
 	}
+	if !sort.IsSorted(rs.wildcards) {
+		sort.Sort(rs.wildcards)
+	}
+	// Drop the subtrees contained in the preceding ones
+	var wildcards sortable
+	for _, w := range rs.wildcards {
+		if len(wildcards) > 0 && bytes.HasPrefix(w, wildcards[len(wildcards)-1]) {
+			continue
+		}
+		wildcards = append(wildcards, w)
+	}
+	rs.wildcards = wildcards
 	rs.lteIndex = 0
 	rs.inited = true
 }
@@ -78,6 +116,9 @@ func (rs *ResolveSet) HashOnly(prefix []byte) bool {
 	if len(prefix) < rs.minLength {
 		return false
 	}
+	if rs.inSubtree(prefix) {
+		return false
+	}
 	// Adjust "GT" if necessary
 	var gtAdjusted bool
 	for rs.lteIndex < len(rs.hexes)-1 && bytes.Compare(rs.hexes[rs.lteIndex+1], prefix) <= 0 {
@@ -111,6 +152,16 @@ func (rs *ResolveSet) HashOnly(prefix []byte) bool {
 	return true
 }
 
+// inSubtree checks whether the prefix is inside of any of the subtrees added by AddSubtree or AddSubtreeHex
+func (rs *ResolveSet) inSubtree(prefix []byte) bool {
+	if len(rs.wildcards) == 0 {
+		return false
+	}
+	// The subtrees do not cover one another, so only the last one not greater than the prefix can contain it
+	i := sort.Search(len(rs.wildcards), func(i int) bool { return bytes.Compare(rs.wildcards[i], prefix) > 0 })
+	return i > 0 && bytes.HasPrefix(prefix, rs.wildcards[i-1])
+}
+
 // Current returns the hex value that has been used for the latest comparison in `HashOnly` function
 // It is only used in one edge case at the moment - to distinguish between the accounts' key
 // and the storage keys of the same account
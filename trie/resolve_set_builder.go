@@ -2,6 +2,35 @@ package trie
 
 import "github.com/ledgerwatch/turbo-geth/common"
 
+// TouchKind is the kind of the item touched during the execution of a block
+type TouchKind byte
+
+const (
+	TouchAccount TouchKind = iota
+	TouchStorage
+	TouchCode
+)
+
+// TouchAccess describes how the item was accessed
+type TouchAccess byte
+
+const (
+	TouchRead TouchAccess = iota
+	TouchWrite
+	TouchCreate
+	TouchDelete
+)
+
+// Touch is the typed record of the touched item. Key is the address hash for accounts, address hash
+// concatenated with the storage key hash for storage items, and the code hash for codes.
+// BufferIndex is the index of the buffer (normally, transaction within the block) where the access happened
+type Touch struct {
+	Key         []byte
+	Kind        TouchKind
+	Access      TouchAccess
+	BufferIndex int
+}
+
 // ResolveSetBuilder is the structure that accumulates the set of keys that were read or changes (touched) during
 // the execution of a block. It also tracks the contract codes that were created and used during the execution
 // of a block
@@ -10,6 +39,7 @@ type ResolveSetBuilder struct {
 	storageTouches [][]byte               // Read/change set of storage keys (account hashes concatenated with storage key hashes)
 	proofCodes     map[common.Hash][]byte // Contract codes that have been accessed
 	createdCodes   map[common.Hash][]byte // Contract codes that were created (deployed)
+	typedTouches   []Touch                // Touches with the kinds of access and buffer indices
 }
 
 // NewResolveSetBuilder creates new ProofGenerator and initialised its maps
@@ -30,15 +60,32 @@ func (pg *ResolveSetBuilder) AddStorageTouch(touch []byte) {
 	pg.storageTouches = append(pg.storageTouches, common.CopyBytes(touch))
 }
 
-// ExtractTouches returns accumulated read/change sets and clears them for the next block's execution
+// AddTypedTouch adds a record into the typed read/change set
+func (pg *ResolveSetBuilder) AddTypedTouch(touch Touch) {
+	touch.Key = common.CopyBytes(touch.Key)
+	pg.typedTouches = append(pg.typedTouches, touch)
+}
+
+// ExtractTouches returns accumulated read/change sets and clears them (and the typed touches) for the next block's execution
 func (pg *ResolveSetBuilder) ExtractTouches() ([][]byte, [][]byte) {
 	touches := pg.touches
 	storageTouches := pg.storageTouches
 	pg.touches = nil
 	pg.storageTouches = nil
+	pg.typedTouches = nil
 	return touches, storageTouches
 }
 
+// ExtractTypedTouches returns accumulated typed touches and clears them (and the flat read/change sets) for
+// the next block's execution
+func (pg *ResolveSetBuilder) ExtractTypedTouches() []Touch {
+	typedTouches := pg.typedTouches
+	pg.touches = nil
+	pg.storageTouches = nil
+	pg.typedTouches = nil
+	return typedTouches
+}
+
 // extractCodeMap returns the map of all contract codes that were required during the block's execution
 // but were not created during that same block. It also clears the maps for the next block's execution
 func (pg *ResolveSetBuilder) extractCodeMap() map[common.Hash][]byte {
@@ -81,3 +128,10 @@ func (pg *ResolveSetBuilder) Build(isBinary bool) (*ResolveSet, CodeMap) {
 	codeMap := pg.extractCodeMap()
 	return rs, codeMap
 }
+
+// BuildTyped is the counterpart of Build that also returns the typed touches, which Build discards
+func (pg *ResolveSetBuilder) BuildTyped(isBinary bool) (*ResolveSet, CodeMap, []Touch) {
+	typedTouches := pg.typedTouches
+	rs, codeMap := pg.Build(isBinary)
+	return rs, codeMap, typedTouches
+}
@@ -0,0 +1,43 @@
+package trie
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSetSubtree(t *testing.T) {
+	rs := NewResolveSet(0)
+	rs.AddHex([]byte{0x3, 0x4, 0x5, 16})
+	rs.AddSubtreeHex([]byte{0x1, 0x2, 0x3})
+	rs.AddSubtreeHex([]byte{0x1, 0x2})
+	rs.AddSubtree([]byte{0xa7})
+
+	// Path to the subtree
+	assert.False(t, rs.HashOnly([]byte{}))
+	assert.False(t, rs.HashOnly([]byte{0x1}))
+	// Subtree itself and everything under it
+	assert.False(t, rs.HashOnly([]byte{0x1, 0x2}))
+	assert.False(t, rs.HashOnly([]byte{0x1, 0x2, 0x0}))
+	assert.False(t, rs.HashOnly([]byte{0x1, 0x2, 0xf, 0xf, 0x0}))
+	// Siblings of the subtree
+	assert.True(t, rs.HashOnly([]byte{0x1, 0x3}))
+	assert.True(t, rs.HashOnly([]byte{0x1, 0x1, 0x2}))
+	// Single key still works
+	assert.False(t, rs.HashOnly([]byte{0x3, 0x4}))
+	assert.True(t, rs.HashOnly([]byte{0x3, 0x4, 0x6}))
+	// Subtree added in KEY encoding
+	assert.False(t, rs.HashOnly([]byte{0xa, 0x7, 0x0}))
+	assert.True(t, rs.HashOnly([]byte{0xa, 0x8}))
+	assert.Equal(t, 2, len(rs.wildcards), "covered subtree is expected to be dropped")
+
+	everything := NewResolveSet(0)
+	everything.AddSubtreeHex(nil)
+	assert.False(t, everything.HashOnly([]byte{0xf, 0xf, 0xf}))
+
+	binary := NewBinaryResolveSet(0)
+	binary.AddSubtreeHex([]byte{0x1})
+	assert.False(t, binary.HashOnly([]byte{0, 0, 0}))
+	assert.False(t, binary.HashOnly([]byte{0, 0, 0, 1, 1}))
+	assert.True(t, binary.HashOnly([]byte{0, 0, 1}))
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/ethdb"
@@ -38,6 +39,19 @@ type Resolver struct {
 	collectWitnesses bool       // if true, stores witnesses for all the subtries that are being resolved
 	witnesses        []*Witness // list of witnesses for resolved subtries, nil if `collectWitnesses` is false
 	topLevels        int        // How many top levels of the trie to keep (not roll into hashes)
+	codeHashHook     func(addrHash []byte, codeHash common.Hash)
+	snapshot         ethdb.Snapshot
+	stats            ResolverStats // Cost of the invocations of ResolveWithDb
+	budget           ResolveBudget
+	prioritised      bool               // Set if any of the requests has non-zero priority
+	detached         bool               // Set by ResolveDetached, the subtries are kept in `resolved` instead of hooked
+	resolved         []*resolvedSubtrie // Subtries resolved by ResolveDetached, waiting for HookResolved
+}
+
+type resolvedSubtrie struct {
+	t       *Trie
+	hookKey []byte
+	root    node
 }
 
 func NewResolver(topLevels int, forAccounts bool, blockNr uint64) *Resolver {
@@ -65,6 +79,24 @@ func (tr *Resolver) SetHistorical(h bool) {
 	tr.historical = h
 }
 
+// SetCodeHashHook sets the function invoked by ResolveWithDb for every account with code loaded from the database,
+// for example, to prefetch the code. addrHash must not be retained by the hook
+func (tr *Resolver) SetCodeHashHook(hook func(addrHash []byte, codeHash common.Hash)) {
+	tr.codeHashHook = hook
+}
+
+// SetSnapshot makes ResolveWithDb read the current state from the snapshot instead of the database, so that
+// several resolutions observe the same state while blocks are committed concurrently. Historical resolutions
+// still read from the database. The snapshot is not released by the resolver
+func (tr *Resolver) SetSnapshot(snapshot ethdb.Snapshot) {
+	tr.snapshot = snapshot
+}
+
+// Stats returns the cost of the resolutions done by ResolveWithDb so far
+func (tr *Resolver) Stats() ResolverStats {
+	return tr.stats
+}
+
 // Resolver implements sort.Interface
 // and sorts by resolve requests
 // (more general requests come first)
@@ -100,6 +132,9 @@ func (tr *Resolver) Swap(i, j int) {
 
 func (tr *Resolver) AddRequest(req *ResolveRequest) {
 	tr.requests = append(tr.requests, req)
+	if req.Priority != 0 {
+		tr.prioritised = true
+	}
 }
 
 func (tr *Resolver) Print() {
@@ -124,15 +159,70 @@ const (
 // ResolveWithDb resolves and hooks subtries using a state database.
 func (tr *Resolver) ResolveWithDb(db ethdb.Database, blockNr uint64) error {
 	var hf hookFunction
-	if tr.collectWitnesses {
+	if tr.detached {
+		hf = tr.detachSubtrie
+	} else if tr.collectWitnesses {
 		hf = tr.extractWitnessAndHookSubtrie
 	} else {
 		hf = hookSubtrie
 	}
 
 	sort.Stable(tr)
-	resolver := NewResolverStateful(tr.topLevels, tr.requests, hf)
-	return resolver.RebuildTrie(db, blockNr, tr.accounts, tr.historical)
+	batches := [][]*ResolveRequest{tr.requests}
+	if tr.prioritised {
+		batches = tr.priorityBatches()
+	}
+	var limits *budgetLimits
+	if !tr.budget.unlimited() {
+		limits = &budgetLimits{budget: tr.budget, start: time.Now()}
+	}
+	// Prefixes of the subtries already resolved by the preceding batches
+	resolved := make(map[string]struct{})
+	var err error
+	for i, batch := range batches {
+		if i > 0 {
+			batch = skipResolved(batch, resolved)
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if err = tr.resolveBatch(db, blockNr, batch, hf, limits); err != nil {
+			break
+		}
+		if i < len(batches)-1 {
+			for _, req := range batch {
+				resolved[string(req.contract)+string(req.resolveHex[:req.resolvePos])] = struct{}{}
+			}
+		}
+	}
+	return err
+}
+
+func (tr *Resolver) resolveBatch(db ethdb.Database, blockNr uint64, requests []*ResolveRequest, hf hookFunction, limits *budgetLimits) error {
+	resolver := NewResolverStateful(tr.topLevels, requests, hf)
+	resolver.codeHashHook = tr.codeHashHook
+	resolver.snapshot = tr.snapshot
+	resolver.limits = limits
+	start := time.Now()
+	err := resolver.RebuildTrie(db, blockNr, tr.accounts, tr.historical)
+	elapsed := time.Since(start)
+	if limits != nil {
+		limits.bytesRead += resolver.bytesRead
+	}
+	if tr.accounts {
+		tr.stats.AccountRequests += len(requests)
+		tr.stats.AccountSubtries += len(resolver.reqIndices)
+		tr.stats.AccountKeys += resolver.keysVisited
+		tr.stats.AccountBytes += resolver.bytesRead
+		tr.stats.AccountTime += elapsed
+	} else {
+		tr.stats.StorageRequests += len(requests)
+		tr.stats.StorageSubtries += len(resolver.reqIndices)
+		tr.stats.StorageKeys += resolver.keysVisited
+		tr.stats.StorageBytes += resolver.bytesRead
+		tr.stats.StorageTime += elapsed
+	}
+	return err
 }
 
 // ResolveStateless resolves and hooks subtries using a witnesses database instead of
@@ -143,31 +233,67 @@ func (tr *Resolver) ResolveStateless(db WitnessStorage, blockNr uint64, trieLimi
 	return resolver.RebuildTrie(db, blockNr, trieLimit, startPos)
 }
 
-func hookSubtrie(currentReq *ResolveRequest, hbRoot node, hbHash common.Hash) error {
+// ResolveDetached resolves the subtries like ResolveWithDb, but does not hook them into the tries of the requests,
+// so that the tries can be used while the database is read (the requests are to be created beforehand).
+// The resolved subtries are hooked by HookResolved
+func (tr *Resolver) ResolveDetached(db ethdb.Database, blockNr uint64) error {
+	tr.detached = true
+	defer func() { tr.detached = false }()
+	return tr.ResolveWithDb(db, blockNr)
+}
+
+// HookResolved hooks the subtries resolved by ResolveDetached into the tries. The tries must describe the same
+// state as when the requests were created, only the nodes still unresolved (hash nodes) are replaced
+func (tr *Resolver) HookResolved() {
+	for _, r := range tr.resolved {
+		r.t.hook(r.hookKey, r.root)
+	}
+	tr.resolved = nil
+}
+
+func (tr *Resolver) detachSubtrie(currentReq *ResolveRequest, hbRoot node, hbHash common.Hash) error {
+	hookKey, err := prepareHook(currentReq, hbRoot)
+	if err != nil {
+		return err
+	}
+	if len(currentReq.resolveHash) > 0 && !bytes.Equal(currentReq.resolveHash, hbHash[:]) {
+		return &ErrHashMismatch{Expected: common.BytesToHash(currentReq.resolveHash), Got: hbHash, Prefix: hookKey}
+	}
+	tr.resolved = append(tr.resolved, &resolvedSubtrie{t: currentReq.t, hookKey: hookKey, root: hbRoot})
+	return nil
+}
+
+// prepareHook computes the RLP of the resolved subtrie if the request requires it, and returns the key
+// of the node of the trie to be replaced by the subtrie
+func prepareHook(currentReq *ResolveRequest, hbRoot node) ([]byte, error) {
 	if currentReq.RequiresRLP {
 		hasher := newHasher(false)
 		defer returnHasherToPool(hasher)
 		h, err := hasher.hashChildren(hbRoot, 0)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		currentReq.NodeRLP = h
 	}
 
-	var hookKey []byte
 	if currentReq.contract == nil {
-		hookKey = currentReq.resolveHex[:currentReq.resolvePos]
-	} else {
-		contractHex := keybytesToHex(currentReq.contract)
-		contractHex = contractHex[:len(contractHex)-1-16] // Remove terminal nibble and incarnation bytes
-		hookKey = append(contractHex, currentReq.resolveHex[:currentReq.resolvePos]...)
+		return currentReq.resolveHex[:currentReq.resolvePos], nil
+	}
+	contractHex := keybytesToHex(currentReq.contract)
+	contractHex = contractHex[:len(contractHex)-1-16] // Remove terminal nibble and incarnation bytes
+	return append(contractHex, currentReq.resolveHex[:currentReq.resolvePos]...), nil
+}
+
+func hookSubtrie(currentReq *ResolveRequest, hbRoot node, hbHash common.Hash) error {
+	hookKey, err := prepareHook(currentReq, hbRoot)
+	if err != nil {
+		return err
 	}
 
 	//fmt.Printf("hookKey: %x, %s\n", hookKey, hbRoot.fstring(""))
 	currentReq.t.hook(hookKey, hbRoot)
 	if len(currentReq.resolveHash) > 0 && !bytes.Equal(currentReq.resolveHash, hbHash[:]) {
-		return fmt.Errorf("mismatching hash: %s %x for prefix %x, resolveHex %x, resolvePos %d",
-			currentReq.resolveHash, hbHash, currentReq.contract, currentReq.resolveHex, currentReq.resolvePos)
+		return &ErrHashMismatch{Expected: common.BytesToHash(currentReq.resolveHash), Got: hbHash, Prefix: hookKey}
 	}
 
 	return nil
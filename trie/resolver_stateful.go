@@ -34,6 +34,11 @@ type ResolverStateful struct {
 
 	roots        []node // roots of the tries that are being built
 	hookFunction hookFunction
+	codeHashHook func(addrHash []byte, codeHash common.Hash)
+	snapshot     ethdb.Snapshot
+	keysVisited  int // Keys passed to the Walker
+	bytesRead    int // Bytes of the keys and values passed to the Walker
+	limits       *budgetLimits
 }
 
 func NewResolverStateful(topLevels int, requests []*ResolveRequest, hookFunction hookFunction) *ResolverStateful {
@@ -84,10 +89,9 @@ func (tr *ResolverStateful) PrepareResolveParams() ([][]byte, []uint) {
 			}
 			rs := NewResolveSet(minLength)
 			tr.rss = append(tr.rss, rs)
-			rs.AddHex(req.resolveHex[req.resolvePos:])
+			addToResolveSet(rs, req)
 		} else {
-			rs := tr.rss[len(tr.rss)-1]
-			rs.AddHex(req.resolveHex[req.resolvePos:])
+			addToResolveSet(tr.rss[len(tr.rss)-1], req)
 		}
 	}
 	tr.currentReq = tr.requests[tr.reqIndices[0]]
@@ -95,6 +99,14 @@ func (tr *ResolverStateful) PrepareResolveParams() ([][]byte, []uint) {
 	return startkeys, fixedbits
 }
 
+func addToResolveSet(rs *ResolveSet, req *ResolveRequest) {
+	if req.Subtree {
+		rs.AddSubtreeHex(req.resolveHex[req.resolvePos:])
+	} else {
+		rs.AddHex(req.resolveHex[req.resolvePos:])
+	}
+}
+
 func (tr *ResolverStateful) finaliseRoot() error {
 	tr.curr.Reset()
 	tr.curr.Write(tr.succ.Bytes())
@@ -146,13 +158,13 @@ func (tr *ResolverStateful) RebuildTrie(
 		if historical {
 			err = db.MultiWalkAsOf(dbutils.AccountsBucket, dbutils.AccountsHistoryBucket, startkeys, fixedbits, blockNr+1, tr.WalkerAccounts)
 		} else {
-			err = db.MultiWalk(dbutils.AccountsBucket, startkeys, fixedbits, tr.WalkerAccounts)
+			err = tr.multiWalk(db, dbutils.AccountsBucket, startkeys, fixedbits, tr.WalkerAccounts)
 		}
 	} else {
 		if historical {
 			err = db.MultiWalkAsOf(dbutils.StorageBucket, dbutils.StorageHistoryBucket, startkeys, fixedbits, blockNr+1, tr.WalkerStorage)
 		} else {
-			err = db.MultiWalk(dbutils.StorageBucket, startkeys, fixedbits, tr.WalkerStorage)
+			err = tr.multiWalk(db, dbutils.StorageBucket, startkeys, fixedbits, tr.WalkerStorage)
 		}
 	}
 	if err != nil {
@@ -161,6 +173,14 @@ func (tr *ResolverStateful) RebuildTrie(
 	return tr.finaliseRoot()
 }
 
+// multiWalk reads the current state from the snapshot, if one is set
+func (tr *ResolverStateful) multiWalk(db ethdb.Database, bucket []byte, startkeys [][]byte, fixedbits []uint, walker func(int, []byte, []byte) error) error {
+	if tr.snapshot != nil {
+		return tr.snapshot.MultiWalk(bucket, startkeys, fixedbits, walker)
+	}
+	return db.MultiWalk(bucket, startkeys, fixedbits, walker)
+}
+
 func (tr *ResolverStateful) WalkerAccounts(keyIdx int, k []byte, v []byte) error {
 	return tr.Walker(true, keyIdx, k, v)
 }
@@ -172,6 +192,12 @@ func (tr *ResolverStateful) WalkerStorage(keyIdx int, k []byte, v []byte) error
 // Walker - k, v - shouldn't be reused in the caller's code
 func (tr *ResolverStateful) Walker(isAccount bool, keyIdx int, k []byte, v []byte) error {
 	//fmt.Printf("keyIdx: %d key:%x  value:%x, accounts: %t\n", keyIdx, k, v, tr.accounts)
+	tr.keysVisited++
+	tr.bytesRead += len(k) + len(v)
+	if tr.limits != nil && tr.limits.exceeded(tr.keysVisited, tr.bytesRead) {
+		// The subtrie being built is dropped, the ones already hooked stay
+		return ErrResolveBudgetExceeded
+	}
 	if keyIdx != tr.keyIdx {
 		if err := tr.finaliseRoot(); err != nil {
 			return err
@@ -224,6 +250,9 @@ func (tr *ResolverStateful) Walker(isAccount bool, keyIdx int, k []byte, v []byt
 			if err := tr.a.DecodeForStorage(v); err != nil {
 				return err
 			}
+			if tr.codeHashHook != nil && !tr.a.IsEmptyCodeHash() {
+				tr.codeHashHook(k, tr.a.CodeHash)
+			}
 			if tr.a.IsEmptyCodeHash() && tr.a.IsEmptyRoot() {
 				tr.fieldSet = AccountFieldSetNotContract
 			} else {
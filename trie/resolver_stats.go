@@ -0,0 +1,48 @@
+package trie
+
+import (
+	"time"
+)
+
+// ResolverStats is the cost of the resolutions from the state database, split between the account trie
+// and the storage tries. It is filled in by ResolveWithDb, and can be aggregated (e.g. per block) with Add
+type ResolverStats struct {
+	AccountRequests int           // Resolve requests for the account trie
+	StorageRequests int           // Resolve requests for the storage tries
+	AccountSubtries int           // Subtries of the account trie walked over (requests contained in others are not counted)
+	StorageSubtries int           // Subtries of the storage tries walked over
+	AccountKeys     int           // Accounts visited in the database
+	StorageKeys     int           // Storage items visited in the database
+	AccountBytes    int           // Bytes of keys and values of the accounts read from the database
+	StorageBytes    int           // Bytes of keys and values of the storage items read from the database
+	AccountTime     time.Duration // Time spent resolving the account trie
+	StorageTime     time.Duration // Time spent resolving the storage tries
+}
+
+// Add adds the counters of other to s
+func (s *ResolverStats) Add(other ResolverStats) {
+	s.AccountRequests += other.AccountRequests
+	s.StorageRequests += other.StorageRequests
+	s.AccountSubtries += other.AccountSubtries
+	s.StorageSubtries += other.StorageSubtries
+	s.AccountKeys += other.AccountKeys
+	s.StorageKeys += other.StorageKeys
+	s.AccountBytes += other.AccountBytes
+	s.StorageBytes += other.StorageBytes
+	s.AccountTime += other.AccountTime
+	s.StorageTime += other.StorageTime
+}
+
+// Requests is the total number of resolve requests
+func (s *ResolverStats) Requests() int {
+	return s.AccountRequests + s.StorageRequests
+}
+
+// TimePerRequest is the average time of resolving one request, zero if there were no requests
+func (s *ResolverStats) TimePerRequest() time.Duration {
+	n := s.Requests()
+	if n == 0 {
+		return 0
+	}
+	return (s.AccountTime + s.StorageTime) / time.Duration(n)
+}
@@ -294,3 +294,148 @@ func TestTwoAccounts(t *testing.T) {
 		t.Errorf("Resolve error: %v", err)
 	}
 }
+
+func TestResolveDetached(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	if err := db.Put(dbutils.AccountsBucket, common.Hex2Bytes("03601462093b5945d1676df093446790fd31b20e7b12a2e8e5e09d068109616b"), common.Hex2Bytes("020502540be400")); err != nil {
+		t.Error(err)
+	}
+	if err := db.Put(dbutils.AccountsBucket, common.Hex2Bytes("0fbc62ba90dec43ec1d6016f9dd39dc324e967f2a3459a78281d1f4b2ba962a6"), common.Hex2Bytes("120164204f1593970e8f030c0a2c39758181a447774eae7c65653c4e6440e8c18dad69bc")); err != nil {
+		t.Error(err)
+	}
+	root := common.HexToHash("925002c3260b44e44c3edebad1cc442142b03020209df1ab8bb86752edbd2cd7")
+	tr := New(root)
+	resolver := NewResolver(0, true, 0)
+	resolver.AddRequest(&ResolveRequest{t: tr, resolveHex: []byte{}, resolvePos: 0, resolveHash: hashNode(root[:])})
+	if err := resolver.ResolveDetached(db, 0); err != nil {
+		t.Fatalf("Resolve error: %v", err)
+	}
+	if _, ok := tr.root.(hashNode); !ok {
+		t.Fatalf("expected the trie untouched by the detached resolution, got %T", tr.root)
+	}
+	resolver.HookResolved()
+	if _, ok := tr.root.(hashNode); ok {
+		t.Fatalf("expected the resolved subtrie to be hooked in")
+	}
+	if h := tr.Hash(); h != root {
+		t.Errorf("expected root %x, got %x", root, h)
+	}
+}
+
+func TestResolveBudget(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	var keysA, keysB [][]byte
+	for i := 0; i < 20; i++ {
+		keyA := crypto.Keccak256([]byte{byte(i)})
+		keyA[0] &= 0x0f
+		keyB := crypto.Keccak256([]byte{byte(i), 1})
+		keyB[0] |= 0xf0
+		keysA = append(keysA, keyA)
+		keysB = append(keysB, keyB)
+	}
+	build := func() (*Trie, common.Hash) {
+		tr := New(common.Hash{})
+		for _, k := range append(append([][]byte{}, keysA...), keysB...) {
+			tr.Update(k, []byte("value"), 0)
+			if err := db.Put(dbutils.StorageBucket, k, []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root := tr.Hash()
+		// Only the root node stays resolved
+		h := newHasher(false)
+		defer returnHasherToPool(h)
+		tr.unload([]byte{0x0}, h)
+		tr.unload([]byte{0xf}, h)
+		return tr, root
+	}
+	requests := func(tr *Trie) (*ResolveRequest, *ResolveRequest) {
+		needA, reqA := tr.NeedResolution(nil, keysA[0])
+		needB, reqB := tr.NeedResolution(nil, keysB[0])
+		assert.True(t, needA && needB, "expected both subtries to need resolution")
+		return reqA, reqB
+	}
+
+	tr, root := build()
+	reqA, reqB := requests(tr)
+	reqB.Priority = 1
+	r := NewResolver(0, false, 0)
+	r.AddRequest(reqA)
+	r.AddRequest(reqB)
+	// Enough for one subtrie, but not for both
+	r.SetBudget(ResolveBudget{Bytes: 25 * (32 + 5)})
+	assert.Equal(t, ErrResolveBudgetExceeded, r.ResolveWithDb(db, 0))
+	need, _ := tr.NeedResolution(nil, keysA[0])
+	assert.True(t, need, "subtrie with the lower priority should not be resolved")
+	need, _ = tr.NeedResolution(nil, keysB[0])
+	assert.False(t, need, "subtrie with the higher priority should be resolved")
+	assert.Equal(t, root, tr.Hash())
+
+	// Without the budget, all requests are resolved regardless of the priority
+	tr, root = build()
+	reqA, reqB = requests(tr)
+	reqA.Priority = 1
+	r = NewResolver(0, false, 0)
+	r.AddRequest(reqA)
+	r.AddRequest(reqB)
+	assert.NoError(t, r.ResolveWithDb(db, 0))
+	for _, k := range [][]byte{keysA[0], keysB[0]} {
+		need, _ = tr.NeedResolution(nil, k)
+		assert.False(t, need)
+	}
+	assert.Equal(t, root, tr.Hash())
+	stats := r.Stats()
+	assert.Equal(t, 2, stats.StorageRequests)
+	assert.Equal(t, 40, stats.StorageKeys)
+}
+
+func TestResolveSubtree(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	var keys [][]byte
+	for i := 0; i < 20; i++ {
+		key := crypto.Keccak256([]byte{byte(i)})
+		key[0] &= 0x0f
+		keys = append(keys, key)
+	}
+	build := func() (*Trie, common.Hash) {
+		tr := New(common.Hash{})
+		for _, k := range keys {
+			tr.Update(k, []byte("value"), 0)
+			if err := db.Put(dbutils.StorageBucket, k, []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root := tr.Hash()
+		h := newHasher(false)
+		defer returnHasherToPool(h)
+		tr.unload([]byte{0x0}, h)
+		return tr, root
+	}
+	resolved := func(tr *Trie) int {
+		n := 0
+		for _, k := range keys {
+			if need, _ := tr.NeedResolution(nil, k); !need {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Request for a single key leaves its siblings unresolved
+	tr, root := build()
+	_, req := tr.NeedResolution(nil, keys[0])
+	r := NewResolver(0, false, 0)
+	r.AddRequest(req)
+	assert.NoError(t, r.ResolveWithDb(db, 0))
+	assert.True(t, resolved(tr) < len(keys))
+	assert.Equal(t, root, tr.Hash())
+
+	// Request for the subtree resolves all of its keys
+	tr, root = build()
+	_, req = tr.NeedResolution(nil, keys[0])
+	r = NewResolver(0, false, 0)
+	r.AddRequest(tr.NewSubtreeResolveRequest(nil, req.resolveHex[:req.resolvePos], req.resolvePos, req.resolveHash))
+	assert.NoError(t, r.ResolveWithDb(db, 0))
+	assert.Equal(t, len(keys), resolved(tr))
+	assert.Equal(t, root, tr.Hash())
+}
@@ -0,0 +1,76 @@
+package trie
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// maxResolveAttempts limits the number of resolutions performed by ResolvingReader for one read. Normally, one
+// resolution is enough, because the resolver loads the entire sub-trie under the missing node
+const maxResolveAttempts = 3
+
+// ResolvingReader reads the values and the accounts from a partially pruned (or not yet resolved) trie.
+// When the read encounters a hash node, the corresponding part of the trie is resolved from the database,
+// and the read is retried. The trie is modified by the resolution, so the caller must make sure that
+// nothing else accesses it at the same time
+type ResolvingReader struct {
+	t          *Trie
+	db         ethdb.Database
+	blockNr    uint64
+	historical bool
+}
+
+func NewResolvingReader(t *Trie, db ethdb.Database, blockNr uint64) *ResolvingReader {
+	return &ResolvingReader{t: t, db: db, blockNr: blockNr}
+}
+
+// SetHistorical makes the resolutions read the state as of the block of the reader (see Resolver.SetHistorical)
+func (r *ResolvingReader) SetHistorical(h bool) {
+	r.historical = h
+}
+
+// Get returns the value for the key, which is either the address hash, or the address hash followed by the hash
+// of the storage key (see dbutils.GenerateCompositeTrieKey). Nil is returned if the value does not exist
+func (r *ResolvingReader) Get(key []byte) ([]byte, error) {
+	for i := 0; i < maxResolveAttempts; i++ {
+		if value, ok := r.t.Get(key); ok {
+			return value, nil
+		}
+		if err := r.resolve(key); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("could not resolve key %x after %d attempts", key, maxResolveAttempts)
+}
+
+// GetAccount returns the account for the address hash, or nil if the account does not exist
+func (r *ResolvingReader) GetAccount(key []byte) (*accounts.Account, error) {
+	for i := 0; i < maxResolveAttempts; i++ {
+		if acc, ok := r.t.GetAccount(key); ok {
+			return acc, nil
+		}
+		if err := r.resolve(key); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("could not resolve account %x after %d attempts", key, maxResolveAttempts)
+}
+
+func (r *ResolvingReader) resolve(key []byte) error {
+	var contract []byte
+	forAccounts := len(key) <= common.HashLength
+	if !forAccounts {
+		contract = key[:common.HashLength]
+	}
+	need, req := r.t.NeedResolution(contract, key)
+	if !need {
+		return fmt.Errorf("read of key %x is incomplete, but no resolution is required", key)
+	}
+	resolver := NewResolver(0, forAccounts, r.blockNr)
+	resolver.SetHistorical(r.historical)
+	resolver.AddRequest(req)
+	return resolver.ResolveWithDb(r.db, r.blockNr)
+}
@@ -0,0 +1,55 @@
+package trie
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+func TestResolvingReaderGetAccount(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	full := New(common.Hash{})
+	var keys [][]byte
+	for i := 0; i < 100; i++ {
+		key := crypto.Keccak256([]byte{byte(i)})
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i)
+		enc := make([]byte, acc.EncodingLengthForStorage())
+		acc.EncodeForStorage(enc)
+		if err := db.Put(dbutils.AccountsBucket, key, enc); err != nil {
+			t.Fatal(err)
+		}
+		full.UpdateAccount(key, &acc)
+		keys = append(keys, key)
+	}
+
+	// Nothing is resolved in the new trie, only the root hash is known
+	tr := New(full.Hash())
+	if _, ok := tr.GetAccount(keys[0]); ok {
+		t.Fatalf("did not expect unresolved trie to return the account")
+	}
+	r := NewResolvingReader(tr, db, 0)
+	for i, key := range keys {
+		acc, err := r.GetAccount(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acc == nil || acc.Nonce != uint64(i) {
+			t.Fatalf("unexpected account %d: %+v", i, acc)
+		}
+	}
+	acc, err := r.GetAccount(crypto.Keccak256([]byte("missing")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc != nil {
+		t.Errorf("expected nil for the missing account, got %+v", acc)
+	}
+	if tr.Hash() != full.Hash() {
+		t.Errorf("resolution changed the root: %x, expected %x", tr.Hash(), full.Hash())
+	}
+}
@@ -0,0 +1,249 @@
+package trie
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// Tags of the nodes in the snapshot encoding
+const (
+	snapshotNil byte = iota
+	snapshotHash
+	snapshotShort
+	snapshotFull
+	snapshotDuo
+	snapshotValue
+	snapshotAccount
+)
+
+var errSnapshotBinary = errors.New("snapshots of the binary trie are not supported")
+
+// WriteSnapshot writes the cached part of the trie down to maxDepth (in nibbles, counted from the root
+// of the state trie, so that the storage tries start at depth 64, as for WitnessBuilder.SetMaxDepth) to w.
+// Branch nodes at maxDepth or deeper are written as their hashes. 0 means no cut-off.
+// Unlike the witness, the snapshot keeps all the fields of the accounts (e.g. incarnations),
+// so that the trie read back by ReadSnapshot can be used in place of the one resolved from the database
+func (t *Trie) WriteSnapshot(w io.Writer, maxDepth int) error {
+	if t.binary {
+		return errSnapshotBinary
+	}
+	bw := bufio.NewWriter(w)
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+	sw := &snapshotWriter{w: bw, h: h, maxDepth: maxDepth}
+	if err := sw.node(t.root, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadSnapshot reads the trie written by WriteSnapshot, and checks that its root is as expected.
+// The generations of the nodes are set to blockNr
+func ReadSnapshot(r io.Reader, root common.Hash, blockNr uint64) (*Trie, error) {
+	sr := &snapshotReader{r: bufio.NewReader(r), blockNr: blockNr}
+	nd, err := sr.node()
+	if err != nil {
+		return nil, err
+	}
+	t := New(common.Hash{})
+	t.root = nd
+	t.SetGeneration(blockNr)
+	if h := t.Hash(); h != root {
+		return nil, fmt.Errorf("snapshot has root %x, expected %x", h, root)
+	}
+	return t, nil
+}
+
+type snapshotWriter struct {
+	w        *bufio.Writer
+	h        *hasher
+	maxDepth int
+	buf      [binary.MaxVarintLen64]byte
+}
+
+func (sw *snapshotWriter) bytes(b []byte) error {
+	n := binary.PutUvarint(sw.buf[:], uint64(len(b)))
+	if _, err := sw.w.Write(sw.buf[:n]); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(b)
+	return err
+}
+
+func (sw *snapshotWriter) hash(nd node, hex []byte) error {
+	var hn common.Hash
+	if _, err := sw.h.hash(nd, len(hex) == 0, hn[:]); err != nil {
+		return err
+	}
+	if err := sw.w.WriteByte(snapshotHash); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(hn[:])
+	return err
+}
+
+func (sw *snapshotWriter) node(nd node, hex []byte) error {
+	cutOff := sw.maxDepth > 0 && len(hex) >= sw.maxDepth
+	switch n := nd.(type) {
+	case nil:
+		return sw.w.WriteByte(snapshotNil)
+	case hashNode:
+		if err := sw.w.WriteByte(snapshotHash); err != nil {
+			return err
+		}
+		_, err := sw.w.Write(n)
+		return err
+	case valueNode:
+		if err := sw.w.WriteByte(snapshotValue); err != nil {
+			return err
+		}
+		return sw.bytes(n)
+	case *shortNode:
+		if err := sw.w.WriteByte(snapshotShort); err != nil {
+			return err
+		}
+		if err := sw.bytes(n.Key); err != nil {
+			return err
+		}
+		key := n.Key
+		if key[len(key)-1] == 16 {
+			key = key[:len(key)-1]
+		}
+		return sw.node(n.Val, concat(hex, key...))
+	case *accountNode:
+		if err := sw.w.WriteByte(snapshotAccount); err != nil {
+			return err
+		}
+		enc := make([]byte, n.EncodingLengthForStorage())
+		n.EncodeForStorage(enc)
+		if err := sw.bytes(enc); err != nil {
+			return err
+		}
+		return sw.node(n.storage, hex)
+	case *duoNode:
+		if cutOff {
+			return sw.hash(n, hex)
+		}
+		if err := sw.w.WriteByte(snapshotDuo); err != nil {
+			return err
+		}
+		if err := binary.Write(sw.w, binary.BigEndian, n.mask); err != nil {
+			return err
+		}
+		i1, i2 := n.childrenIdx()
+		if err := sw.node(n.child1, expandKeyHex(hex, i1)); err != nil {
+			return err
+		}
+		return sw.node(n.child2, expandKeyHex(hex, i2))
+	case *fullNode:
+		if cutOff {
+			return sw.hash(n, hex)
+		}
+		if err := sw.w.WriteByte(snapshotFull); err != nil {
+			return err
+		}
+		for i, child := range n.Children {
+			if err := sw.node(child, expandKeyHex(hex, byte(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected node type: %T", nd)
+	}
+}
+
+type snapshotReader struct {
+	r       *bufio.Reader
+	blockNr uint64
+}
+
+func (sr *snapshotReader) bytes() ([]byte, error) {
+	l, err := binary.ReadUvarint(sr.r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, l)
+	if _, err = io.ReadFull(sr.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (sr *snapshotReader) node() (node, error) {
+	tag, err := sr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case snapshotNil:
+		return nil, nil
+	case snapshotHash:
+		hn := make(hashNode, common.HashLength)
+		if _, err = io.ReadFull(sr.r, hn); err != nil {
+			return nil, err
+		}
+		return hn, nil
+	case snapshotValue:
+		v, err := sr.bytes()
+		if err != nil {
+			return nil, err
+		}
+		return valueNode(v), nil
+	case snapshotShort:
+		key, err := sr.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) == 0 {
+			return nil, errors.New("snapshot: short node with empty key")
+		}
+		val, err := sr.node()
+		if err != nil {
+			return nil, err
+		}
+		return &shortNode{Key: key, Val: val, gen: sr.blockNr}, nil
+	case snapshotAccount:
+		enc, err := sr.bytes()
+		if err != nil {
+			return nil, err
+		}
+		n := &accountNode{}
+		if err = n.DecodeForStorage(enc); err != nil {
+			return nil, err
+		}
+		if n.storage, err = sr.node(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case snapshotDuo:
+		n := &duoNode{}
+		if err = binary.Read(sr.r, binary.BigEndian, &n.mask); err != nil {
+			return nil, err
+		}
+		if n.child1, err = sr.node(); err != nil {
+			return nil, err
+		}
+		if n.child2, err = sr.node(); err != nil {
+			return nil, err
+		}
+		n.flags.dirty = true
+		return n, nil
+	case snapshotFull:
+		n := &fullNode{}
+		for i := range n.Children {
+			if n.Children[i], err = sr.node(); err != nil {
+				return nil, err
+			}
+		}
+		n.flags.dirty = true
+		return n, nil
+	default:
+		return nil, fmt.Errorf("snapshot: unknown node tag %d", tag)
+	}
+}
@@ -0,0 +1,94 @@
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+func TestTrieSnapshot(t *testing.T) {
+	tr := New(common.Hash{})
+	for i := 0; i < 200; i++ {
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i)
+		tr.UpdateAccount(crypto.Keccak256([]byte{byte(i)}), &acc)
+	}
+	contract := crypto.Keccak256([]byte("contract"))
+	acc := accounts.NewAccount()
+	acc.Incarnation = 3
+	acc.CodeHash = common.BytesToHash(crypto.Keccak256([]byte("code")))
+	tr.UpdateAccount(contract, &acc)
+	storageKey := GenerateCompositeTrieKey(common.BytesToHash(contract), common.BytesToHash(crypto.Keccak256([]byte("key"))))
+	tr.Update(storageKey, []byte("value"), 0)
+	root := tr.Hash()
+
+	var full bytes.Buffer
+	if err := tr.WriteSnapshot(&full, 0); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ReadSnapshot(bytes.NewReader(full.Bytes()), root, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := restored.GetAccount(contract); !ok || a == nil || a.Incarnation != 3 || a.CodeHash != acc.CodeHash {
+		t.Errorf("expected the contract account to be restored with its incarnation, got %+v", a)
+	}
+	if v, ok := restored.Get(storageKey); !ok || string(v) != "value" {
+		t.Errorf("expected the storage item to be restored, got %q", v)
+	}
+
+	// Upper levels only
+	var top bytes.Buffer
+	if err = tr.WriteSnapshot(&top, 2); err != nil {
+		t.Fatal(err)
+	}
+	if top.Len() >= full.Len() {
+		t.Errorf("expected the snapshot of the upper levels (%d bytes) to be smaller than the full one (%d bytes)", top.Len(), full.Len())
+	}
+	restored, err = ReadSnapshot(bytes.NewReader(top.Bytes()), root, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unresolved int
+	for i := 0; i < 200; i++ {
+		if need, _ := restored.NeedResolution(nil, crypto.Keccak256([]byte{byte(i)})); need {
+			unresolved++
+		}
+	}
+	if unresolved == 0 {
+		t.Errorf("expected the accounts below the cut-off to need resolution")
+	}
+
+	if _, err = ReadSnapshot(bytes.NewReader(top.Bytes()), common.Hash{1}, 5); err == nil {
+		t.Errorf("expected the snapshot with another root to be rejected")
+	}
+	if _, err = ReadSnapshot(bytes.NewReader(top.Bytes()[:top.Len()/2]), root, 5); err == nil {
+		t.Errorf("expected the truncated snapshot to be rejected")
+	}
+}
+
+func TestTriePruningTimestamps(t *testing.T) {
+	tp := NewTriePruning(1)
+	tp.SetBlockNr(1)
+	tp.Touch([]byte{1}, false)
+	tp.SetBlockNr(2)
+	tp.Touch([]byte{1, 2}, false)
+	tp.Touch([]byte{1, 2, 3}, false)
+
+	timestamps := tp.Timestamps(3)
+	if len(timestamps) != 2 || timestamps[string([]byte{1})] != 1 || timestamps[string([]byte{1, 2})] != 2 {
+		t.Fatalf("unexpected timestamps %v", timestamps)
+	}
+
+	restored := NewTriePruning(tp.OldestGeneration())
+	restored.SetBlockNr(2)
+	for hexS, ts := range timestamps {
+		restored.SetTimestamp([]byte(hexS), ts)
+	}
+	if restored.NodeCount() != 2 || restored.GenCounts()[1] != 1 || restored.GenCounts()[2] != 1 {
+		t.Errorf("unexpected restored pruning state: %d nodes, generations %v", restored.NodeCount(), restored.GenCounts())
+	}
+}
@@ -0,0 +1,104 @@
+package trie
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/rlp"
+	"github.com/ledgerwatch/turbo-geth/trie/rlphacks"
+)
+
+// RootOfSorted computes the root hash of the trie holding the given keys and values, without constructing
+// the trie: the keys are streamed through GenStructStep into the HashBuilder. The keys must be sorted and
+// unique, and none of them can be a prefix of another. If bin is set, the root is the one of the binary trie
+// (see NewBinary), otherwise of the hexary one
+func RootOfSorted(keys [][]byte, values [][]byte, bin bool) (common.Hash, error) {
+	return rootOfSorted(keys, values, NewSortedRoot(bin))
+}
+
+// RootOfSortedEncoded is RootOfSorted for the values that are RLP-encoded already, like the accounts
+// (see accounts.Account.EncodeForHashing), which are placed into the leaves as they are
+func RootOfSortedEncoded(keys [][]byte, values [][]byte, bin bool) (common.Hash, error) {
+	return rootOfSorted(keys, values, NewSortedRootEncoded(bin))
+}
+
+func rootOfSorted(keys [][]byte, values [][]byte, sr *SortedRoot) (common.Hash, error) {
+	if len(keys) != len(values) {
+		return common.Hash{}, fmt.Errorf("got %d keys and %d values", len(keys), len(values))
+	}
+	for i, key := range keys {
+		if err := sr.Add(key, values[i]); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	return sr.Root()
+}
+
+// SortedRoot computes the same root as RootOfSorted, with the keys and the values added one by one,
+// so that the dataset does not need to be held in memory. Only the last added key and value are kept
+type SortedRoot struct {
+	bin        bool
+	leaf       func([]byte) rlphacks.RlpSerializable
+	hb         *HashBuilder
+	groups     []uint16
+	key, value []byte // Last added key and value, they are put into the trie when the next key is known
+	succ       []byte // Nibbles (or bits) of the last added key
+}
+
+// NewSortedRoot creates the builder of the root of the trie with the given values in the leaves
+func NewSortedRoot(bin bool) *SortedRoot {
+	return &SortedRoot{bin: bin, hb: NewHashBuilder(false), leaf: func(value []byte) rlphacks.RlpSerializable {
+		return rlphacks.RlpSerializableBytes(value)
+	}}
+}
+
+// NewSortedRootEncoded creates the builder of the root for the values that are RLP-encoded already
+func NewSortedRootEncoded(bin bool) *SortedRoot {
+	return &SortedRoot{bin: bin, hb: NewHashBuilder(false), leaf: func(value []byte) rlphacks.RlpSerializable {
+		return rlphacks.RlpEncodedBytes(value)
+	}}
+}
+
+// hashAllNodes makes GenStructStep only compute the hashes, without constructing the nodes
+func hashAllNodes(_ []byte) bool { return true }
+
+// Add adds the key and the value to the trie. The key has to be greater than all the keys added before
+func (sr *SortedRoot) Add(key, value []byte) error {
+	if sr.key != nil && bytes.Compare(sr.key, key) >= 0 {
+		return fmt.Errorf("keys are not sorted or not unique: %x after %x", key, sr.key)
+	}
+	curr := sr.succ
+	sr.succ = keybytesToHex(key)
+	if sr.bin {
+		sr.succ = keyHexToBin(sr.succ)
+	}
+	if sr.key != nil {
+		var err error
+		if sr.groups, err = GenStructStep(hashAllNodes, curr, sr.succ, sr.hb, GenStructStepLeafData{sr.leaf(sr.value)}, sr.groups); err != nil {
+			return err
+		}
+	}
+	sr.key, sr.value = common.CopyBytes(key), common.CopyBytes(value)
+	return nil
+}
+
+// Root returns the root hash of the trie with all the added keys
+func (sr *SortedRoot) Root() (common.Hash, error) {
+	if sr.key == nil {
+		return EmptyRoot, nil
+	}
+	if _, err := GenStructStep(hashAllNodes, sr.succ, nil, sr.hb, GenStructStepLeafData{sr.leaf(sr.value)}, sr.groups); err != nil {
+		return common.Hash{}, err
+	}
+	hb := sr.hb
+	if !hb.hasRoot() {
+		return common.Hash{}, fmt.Errorf("no root in the tree")
+	}
+	// The root shorter than 32 bytes is kept on the stack as is (as if it was embedded into its parent)
+	if hb.hashStack[0] != 0x80+common.HashLength {
+		return crypto.Keccak256Hash(hb.hashStack[:1+int(hb.hashStack[0]-rlp.EmptyListCode)]), nil
+	}
+	return hb.rootHash(), nil
+}
@@ -0,0 +1,54 @@
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+func TestRootOfSorted(t *testing.T) {
+	for _, n := range []int{1, 2, 17, 300, -2, -300} {
+		var keys, values [][]byte
+		if n > 0 {
+			for i := 0; i < n; i++ {
+				keys = append(keys, []byte(fmt.Sprintf("key%08d", i*7919%100003)))
+			}
+		} else {
+			// Long keys, which do not fit the short RLP prefixes in the binary trie
+			n = -n
+			for i := 0; i < n; i++ {
+				keys = append(keys, crypto.Keccak256([]byte(fmt.Sprintf("key%d", i))))
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+		for i := range keys {
+			values = append(values, bytes.Repeat([]byte{byte(i)}, 1+i%40))
+		}
+		for _, bin := range []bool{false, true} {
+			tr := New(EmptyRoot)
+			if bin {
+				tr = NewBinary(EmptyRoot)
+			}
+			for i, key := range keys {
+				tr.Update(key, values[i], 0)
+			}
+			root, err := RootOfSorted(keys, values, bin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := tr.Hash(); root != expected {
+				t.Errorf("%d keys, binary %t: expected root %x, got %x", n, bin, expected, root)
+			}
+		}
+	}
+
+	if root, err := RootOfSorted(nil, nil, false); err != nil || root != EmptyRoot {
+		t.Errorf("expected the empty root, got %x, %v", root, err)
+	}
+	if _, err := RootOfSorted([][]byte{{2}, {1}}, [][]byte{{1}, {1}}, false); err == nil {
+		t.Errorf("expected an error for the unsorted keys")
+	}
+}
@@ -251,6 +251,7 @@ func StreamHash(s *Stream, storagePrefixLen int, trace bool) (common.Hash, error
 				}
 				a.Copy(s.aValues[ai])
 				ai++
+				hashRef = nil
 				fieldSet = AccountFieldSetNotContract // base level - nonce and balance
 				if a.HasStorageSize {
 					fieldSet += AccountFieldSSizeOnly
@@ -285,6 +286,7 @@ func StreamHash(s *Stream, storagePrefixLen int, trace bool) (common.Hash, error
 				si++
 				value.Reset()
 				value.Write(v)
+				hashRef = nil
 			case SHashStreamItem:
 				h := s.hashes[hi]
 				hi++
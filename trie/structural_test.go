@@ -298,3 +298,24 @@ func TestToStream(t *testing.T) {
 		}
 	}
 }
+
+func TestHashWithModifications(t *testing.T) {
+	// Account leaves following the hashes of the untouched sub-tries in the stream
+	for _, n := range []int{1, 8, 17, 100} {
+		tr := New(common.Hash{})
+		keys := make(common.Hashes, n)
+		for i := range keys {
+			keys[i] = crypto.Keccak256Hash([]byte{byte(i)})
+			tr.UpdateAccount(keys[i][:], &accounts.Account{Initialised: true, Balance: *big.NewInt(int64(i + 1)), CodeHash: emptyState})
+		}
+		account := &accounts.Account{Initialised: true, Balance: *big.NewInt(1000), CodeHash: emptyState}
+		hash, err := HashWithModifications(tr, common.Hashes{keys[0]}, []*accounts.Account{account}, nil, nil, common.HashLength, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.UpdateAccount(keys[0][:], account)
+		if expected := tr.Hash(); hash != expected {
+			t.Errorf("%d accounts: expected %x, got %x", n, expected, hash)
+		}
+	}
+}
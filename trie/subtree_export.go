@@ -0,0 +1,210 @@
+package trie
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// Tags preceding the storage items in the subtree export, and marking its end
+const (
+	subtreeExportEnd byte = iota
+	subtreeExportItem
+)
+
+// Proof nodes and storage values are much shorter than that
+const maxSubtreeExportItem = 1 << 16
+
+// ExportSubtree writes the full storage of the contract (the account with the given address hash and incarnation)
+// from the flat state to w, together with the Merkle proof of the account, which carries the storage root,
+// against the state root. The storage items are streamed in the order of their key hashes, and are not checked
+// against the storage root, which is the job of the importer (see SubtreeExportReader).
+// The state root is computed by resolving the path to the account, which reads all the accounts
+func ExportSubtree(db ethdb.Database, addrHash common.Hash, incarnation uint64, w io.Writer) error {
+	enc, err := db.Get(dbutils.AccountsBucket, addrHash[:])
+	if err != nil {
+		if err == ethdb.ErrKeyNotFound {
+			return fmt.Errorf("account %x not found", addrHash)
+		}
+		return err
+	}
+	var acc accounts.Account
+	if err = acc.DecodeForStorage(enc); err != nil {
+		return err
+	}
+	if acc.Incarnation != incarnation {
+		return fmt.Errorf("account %x has incarnation %d, expected %d", addrHash, acc.Incarnation, incarnation)
+	}
+
+	t := New(common.Hash{})
+	resolver := NewResolver(0, true, 0)
+	resolver.AddRequest(t.NewResolveRequest(nil, keybytesToHex(addrHash[:]), 0, nil))
+	if err = resolver.ResolveWithDb(db, 0); err != nil {
+		return err
+	}
+	proof, err := MultiProof(t, [][]byte{addrHash[:]}, nil)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	ew := &exportWriter{w: bw}
+	stateRoot := t.Hash()
+	ew.write(addrHash[:])
+	var incBytes [8]byte
+	binary.BigEndian.PutUint64(incBytes[:], incarnation)
+	ew.write(incBytes[:])
+	ew.write(acc.Root[:])
+	ew.write(stateRoot[:])
+	ew.uvarint(uint64(len(proof)))
+	for _, p := range proof {
+		ew.bytes(p)
+	}
+	if ew.err != nil {
+		return ew.err
+	}
+
+	prefix := dbutils.GenerateStoragePrefix(addrHash, incarnation)
+	if err = db.Walk(dbutils.StorageBucket, prefix, 8*len(prefix), func(k, v []byte) (bool, error) {
+		ew.write([]byte{subtreeExportItem})
+		ew.write(k[len(prefix):])
+		ew.bytes(v)
+		return ew.err == nil, ew.err
+	}); err != nil {
+		return err
+	}
+	ew.write([]byte{subtreeExportEnd})
+	if ew.err != nil {
+		return ew.err
+	}
+	return bw.Flush()
+}
+
+// exportWriter remembers the first error of the writes, so that they can be checked once
+type exportWriter struct {
+	w   *bufio.Writer
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (ew *exportWriter) write(b []byte) {
+	if ew.err == nil {
+		_, ew.err = ew.w.Write(b)
+	}
+}
+
+func (ew *exportWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(ew.buf[:], v)
+	ew.write(ew.buf[:n])
+}
+
+func (ew *exportWriter) bytes(b []byte) {
+	ew.uvarint(uint64(len(b)))
+	ew.write(b)
+}
+
+// SubtreeExportReader reads the storage of the contract written by ExportSubtree
+type SubtreeExportReader struct {
+	AddrHash    common.Hash
+	Incarnation uint64
+	StorageRoot common.Hash
+	StateRoot   common.Hash
+	Proof       [][]byte // Merkle proof of the account against the state root, see MultiProof
+
+	r    *bufio.Reader
+	done bool
+}
+
+// NewSubtreeExportReader reads the header and the proof of the export, the storage items are then read with Next
+func NewSubtreeExportReader(r io.Reader) (*SubtreeExportReader, error) {
+	er := &SubtreeExportReader{r: bufio.NewReader(r)}
+	var incBytes [8]byte
+	for _, b := range [][]byte{er.AddrHash[:], incBytes[:], er.StorageRoot[:], er.StateRoot[:]} {
+		if _, err := io.ReadFull(er.r, b); err != nil {
+			return nil, err
+		}
+	}
+	er.Incarnation = binary.BigEndian.Uint64(incBytes[:])
+	count, err := binary.ReadUvarint(er.r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < count; i++ {
+		p, err := er.bytes()
+		if err != nil {
+			return nil, err
+		}
+		er.Proof = append(er.Proof, p)
+	}
+	return er, nil
+}
+
+func (er *SubtreeExportReader) bytes() ([]byte, error) {
+	l, err := binary.ReadUvarint(er.r)
+	if err != nil {
+		return nil, err
+	}
+	if l > maxSubtreeExportItem {
+		return nil, fmt.Errorf("subtree export: item of %d bytes is too large", l)
+	}
+	b := make([]byte, l)
+	if _, err = io.ReadFull(er.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// VerifyProof checks the proof of the account against the state root of the export, and returns the account,
+// which has to carry the storage root of the export. The incarnation is not part of the proof
+func (er *SubtreeExportReader) VerifyProof() (*accounts.Account, error) {
+	accs, _, err := VerifyMultiProof(er.StateRoot, [][]byte{er.AddrHash[:]}, nil, er.Proof)
+	if err != nil {
+		return nil, err
+	}
+	acc := accs[0]
+	if acc == nil {
+		return nil, fmt.Errorf("account %x is absent in the proof", er.AddrHash)
+	}
+	if acc.Root != er.StorageRoot {
+		return nil, fmt.Errorf("account %x in the proof has storage root %x, expected %x", er.AddrHash, acc.Root, er.StorageRoot)
+	}
+	return acc, nil
+}
+
+// Next returns the next storage item (the hash of its key and its value), and io.EOF after the last one
+func (er *SubtreeExportReader) Next() (common.Hash, []byte, error) {
+	var keyHash common.Hash
+	if er.done {
+		return keyHash, nil, io.EOF
+	}
+	tag, err := er.r.ReadByte()
+	if err != nil {
+		return keyHash, nil, err
+	}
+	switch tag {
+	case subtreeExportEnd:
+		er.done = true
+		return keyHash, nil, io.EOF
+	case subtreeExportItem:
+	default:
+		return keyHash, nil, fmt.Errorf("subtree export: unexpected tag %d", tag)
+	}
+	if _, err = io.ReadFull(er.r, keyHash[:]); err != nil {
+		return keyHash, nil, err
+	}
+	value, err := er.bytes()
+	if err != nil {
+		return keyHash, nil, err
+	}
+	if len(value) == 0 {
+		return keyHash, nil, errors.New("subtree export: empty storage value")
+	}
+	return keyHash, value, nil
+}
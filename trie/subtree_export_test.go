@@ -0,0 +1,98 @@
+package trie
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/common/dbutils"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportSubtree(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	contract := common.BytesToHash(crypto.Keccak256([]byte{7}))
+	var keyHashes [][]byte
+	var values [][]byte
+	for i := 0; i < 30; i++ {
+		keyHashes = append(keyHashes, crypto.Keccak256([]byte{byte(i), 1}))
+	}
+	sort.Slice(keyHashes, func(i, j int) bool { return bytes.Compare(keyHashes[i], keyHashes[j]) < 0 })
+	for i, keyHash := range keyHashes {
+		values = append(values, []byte{byte(i + 1), 0xff})
+		if err := db.Put(dbutils.StorageBucket, dbutils.GenerateCompositeStorageKey(contract, 1, common.BytesToHash(keyHash)), values[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Storage of the previous incarnation is not exported
+	if err := db.Put(dbutils.StorageBucket, dbutils.GenerateCompositeStorageKey(contract, 0, common.Hash{1}), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	storageRoot, err := RootOfSorted(keyHashes, values, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := New(common.Hash{})
+	for i := 0; i < 20; i++ {
+		addrHash := common.BytesToHash(crypto.Keccak256([]byte{byte(i)}))
+		acc := accounts.NewAccount()
+		acc.Nonce = uint64(i)
+		if addrHash == contract {
+			acc.Incarnation = 1
+			acc.Root = storageRoot
+		}
+		tr.UpdateAccount(addrHash[:], &acc)
+		enc := make([]byte, acc.EncodingLengthForStorage())
+		acc.EncodeForStorage(enc)
+		if err = db.Put(dbutils.AccountsBucket, addrHash[:], enc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	assert.Error(t, ExportSubtree(db, contract, 2, &buf), "incarnation does not match")
+	buf.Reset()
+	if err = ExportSubtree(db, contract, 1, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	er, err := NewSubtreeExportReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, contract, er.AddrHash)
+	assert.Equal(t, uint64(1), er.Incarnation)
+	assert.Equal(t, storageRoot, er.StorageRoot)
+	assert.Equal(t, tr.Hash(), er.StateRoot)
+	acc, err := er.VerifyProof()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(7), acc.Nonce)
+
+	var gotKeys, gotValues [][]byte
+	for {
+		keyHash, value, err := er.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotKeys = append(gotKeys, common.CopyBytes(keyHash[:]))
+		gotValues = append(gotValues, value)
+	}
+	assert.Equal(t, keyHashes, gotKeys)
+	assert.Equal(t, values, gotValues)
+
+	// Tampered proof is rejected
+	er.StateRoot = common.Hash{1}
+	_, err = er.VerifyProof()
+	assert.Error(t, err)
+}
@@ -50,6 +50,8 @@ type Trie struct {
 	Version uint8
 
 	binary bool
+
+	gen uint64 // Current generation (block number), used to stamp the leaves being materialized
 }
 
 // New creates a trie with an existing root node from db.
@@ -75,6 +77,11 @@ func NewBinary(root common.Hash) *Trie {
 	return trie
 }
 
+// IsBinary tells whether the keys of the trie are split into bits rather than nibbles (see NewBinary)
+func (t *Trie) IsBinary() bool {
+	return t.binary
+}
+
 // NewTestRLPTrie treats all the data provided to `Update` function as rlp-encoded.
 // it is usually used for testing purposes.
 func NewTestRLPTrie(root common.Hash) *Trie {
@@ -92,6 +99,11 @@ func (t *Trie) SetTouchFunc(touchFunc func(hex []byte, del bool)) {
 	t.touchFunc = touchFunc
 }
 
+// SetGeneration sets the block number that leaves inserted, updated or resolved from now on are stamped with
+func (t *Trie) SetGeneration(gen uint64) {
+	t.gen = gen
+}
+
 // Get returns the value for key stored in the trie.
 func (t *Trie) Get(key []byte) (value []byte, gotValue bool) {
 	if t.root == nil {
@@ -102,7 +114,73 @@ func (t *Trie) Get(key []byte) (value []byte, gotValue bool) {
 	if t.binary {
 		hex = keyHexToBin(hex)
 	}
-	return t.get(t.root, hex, 0)
+	return t.get(t.root, hex, 0, anyIncarnation)
+}
+
+// anyIncarnation disables the check of the incarnation in Trie.get
+const anyIncarnation = ^uint64(0)
+
+// TouchedPrefixes returns the prefixes of the branch nodes that a lookup of the key touches (see SetTouchFunc),
+// in the order of the lookup. The key is either an address hash, or an address hash followed by the hash of
+// a storage key. Replaying these touches keeps the path from being pruned when the value is served
+// from outside of the trie
+func (t *Trie) TouchedPrefixes(key []byte) [][]byte {
+	hex := keybytesToHex(key)
+	if t.binary {
+		hex = keyHexToBin(hex)
+	}
+	var prefixes [][]byte
+	nd, pos := t.root, 0
+	for pos < len(hex) {
+		switch n := nd.(type) {
+		case *shortNode:
+			matchlen := prefixLen(hex[pos:], n.Key)
+			if matchlen != len(n.Key) && n.Key[matchlen] != 16 {
+				return prefixes
+			}
+			nd = n.Val
+			pos += matchlen
+		case *duoNode:
+			prefixes = append(prefixes, common.CopyBytes(hex[:pos]))
+			i1, i2 := n.childrenIdx()
+			switch hex[pos] {
+			case i1:
+				nd = n.child1
+			case i2:
+				nd = n.child2
+			default:
+				return prefixes
+			}
+			pos++
+		case *fullNode:
+			prefixes = append(prefixes, common.CopyBytes(hex[:pos]))
+			nd = n.Children[hex[pos]]
+			pos++
+		case *accountNode:
+			nd = n.storage
+		default:
+			return prefixes
+		}
+	}
+	return prefixes
+}
+
+// GetStorage is the same as Get for the storage items (key is the address hash followed by the hash of the
+// storage key), but the value is only returned if the account on the path has the given incarnation.
+// Otherwise the storage in the trie belongs to a different incarnation of the contract (for example, the
+// contract has been re-created, and the trie has not been updated yet), and gotValue is false, so that
+// the value is read from the database. Accounts with incarnation 0 (for example, constructed from
+// the witnesses, which do not carry incarnations) are not checked
+func (t *Trie) GetStorage(key []byte, incarnation uint64) (value []byte, gotValue bool) {
+	if t.root == nil {
+		return nil, true
+	}
+
+	hex := keybytesToHex(key)
+	if t.binary {
+		hex = keyHexToBin(hex)
+	}
+	return t.get(t.root, hex, 0, incarnation)
 }
 
 func (t *Trie) GetAccount(key []byte) (value *accounts.Account, gotValue bool) {
@@ -164,18 +242,21 @@ func (t *Trie) getAccount(origNode node, key []byte, pos int) (value *accountNod
 	}
 }
 
-func (t *Trie) get(origNode node, key []byte, pos int) (value []byte, gotValue bool) {
+func (t *Trie) get(origNode node, key []byte, pos int, incarnation uint64) (value []byte, gotValue bool) {
 	switch n := (origNode).(type) {
 	case nil:
 		return nil, true
 	case valueNode:
 		return n, true
 	case *accountNode:
-		return t.get(n.storage, key, pos)
+		if incarnation != anyIncarnation && n.Incarnation != 0 && n.Incarnation != incarnation {
+			return nil, false
+		}
+		return t.get(n.storage, key, pos, incarnation)
 	case *shortNode:
 		matchlen := prefixLen(key[pos:], n.Key)
 		if matchlen == len(n.Key) || n.Key[matchlen] == 16 {
-			value, gotValue = t.get(n.Val, key, pos+matchlen)
+			value, gotValue = t.get(n.Val, key, pos+matchlen, incarnation)
 		} else {
 			value, gotValue = nil, true
 		}
@@ -185,9 +266,9 @@ func (t *Trie) get(origNode node, key []byte, pos int) (value []byte, gotValue b
 		i1, i2 := n.childrenIdx()
 		switch key[pos] {
 		case i1:
-			value, gotValue = t.get(n.child1, key, pos+1)
+			value, gotValue = t.get(n.child1, key, pos+1, incarnation)
 		case i2:
-			value, gotValue = t.get(n.child2, key, pos+1)
+			value, gotValue = t.get(n.child2, key, pos+1, incarnation)
 		default:
 			value, gotValue = nil, true
 		}
@@ -198,7 +279,7 @@ func (t *Trie) get(origNode node, key []byte, pos int) (value []byte, gotValue b
 		if child == nil {
 			return nil, true
 		}
-		return t.get(child, key, pos+1)
+		return t.get(child, key, pos+1, incarnation)
 	case hashNode:
 		return n, false
 
@@ -207,6 +288,113 @@ func (t *Trie) get(origNode node, key []byte, pos int) (value []byte, gotValue b
 	}
 }
 
+// GetWithGen returns the value for key stored in the trie, together with the block number
+// at which this value was last materialized in the trie (inserted, updated or resolved from the database).
+// Higher layers can compare the generation with the current block number to detect stale cached values.
+// Generation 0 means that the value was not stamped (for example, it was never set after SetGeneration).
+func (t *Trie) GetWithGen(key []byte) (value []byte, gen uint64, gotValue bool) {
+	if t.root == nil {
+		return nil, 0, true
+	}
+
+	hex := keybytesToHex(key)
+	if t.binary {
+		hex = keyHexToBin(hex)
+	}
+	return t.getWithGen(t.root, hex, 0, 0)
+}
+
+// GetAccountWithGen is the same as GetWithGen, but for the accounts
+func (t *Trie) GetAccountWithGen(key []byte) (value *accounts.Account, gen uint64, gotValue bool) {
+	if t.root == nil {
+		return nil, 0, true
+	}
+
+	hex := keybytesToHex(key)
+	if t.binary {
+		hex = keyHexToBin(hex)
+	}
+	nd := t.root
+	pos := 0
+	for {
+		switch n := nd.(type) {
+		case nil:
+			return nil, 0, true
+		case *shortNode:
+			matchlen := prefixLen(hex[pos:], n.Key)
+			if matchlen != len(n.Key) {
+				return nil, 0, true
+			}
+			if accNode, ok := n.Val.(*accountNode); ok {
+				var acc accounts.Account
+				acc.Copy(&accNode.Account)
+				return &acc, n.gen, true
+			}
+			nd = n.Val
+			pos += matchlen
+		case *duoNode:
+			t.touchFunc(hex[:pos], false)
+			i1, i2 := n.childrenIdx()
+			switch hex[pos] {
+			case i1:
+				nd = n.child1
+			case i2:
+				nd = n.child2
+			default:
+				return nil, 0, true
+			}
+			pos++
+		case *fullNode:
+			t.touchFunc(hex[:pos], false)
+			nd = n.Children[hex[pos]]
+			pos++
+		case hashNode:
+			return nil, 0, false
+		case *accountNode:
+			var acc accounts.Account
+			acc.Copy(&n.Account)
+			return &acc, 0, true
+		default:
+			panic(fmt.Sprintf("%T: invalid node: %v", nd, nd))
+		}
+	}
+}
+
+func (t *Trie) getWithGen(origNode node, key []byte, pos int, gen uint64) (value []byte, valueGen uint64, gotValue bool) {
+	switch n := (origNode).(type) {
+	case nil:
+		return nil, 0, true
+	case valueNode:
+		return n, gen, true
+	case *accountNode:
+		return t.getWithGen(n.storage, key, pos, 0)
+	case *shortNode:
+		matchlen := prefixLen(key[pos:], n.Key)
+		if matchlen == len(n.Key) || n.Key[matchlen] == 16 {
+			return t.getWithGen(n.Val, key, pos+matchlen, n.gen)
+		}
+		return nil, 0, true
+	case *duoNode:
+		t.touchFunc(key[:pos], false)
+		i1, i2 := n.childrenIdx()
+		switch key[pos] {
+		case i1:
+			return t.getWithGen(n.child1, key, pos+1, 0)
+		case i2:
+			return t.getWithGen(n.child2, key, pos+1, 0)
+		default:
+			return nil, 0, true
+		}
+	case *fullNode:
+		t.touchFunc(key[:pos], false)
+		return t.getWithGen(n.Children[key[pos]], key, pos+1, 0)
+	case hashNode:
+		return n, 0, false
+	default:
+		panic(fmt.Sprintf("%T: invalid node: %v", origNode, origNode))
+	}
+}
+
 // Update associates key with value in the trie. Subsequent calls to
 // Get will return value. If value has length zero, any existing value
 // is deleted from the trie and calls to Get will return nil.
@@ -221,7 +409,7 @@ func (t *Trie) Update(key, value []byte, blockNr uint64) {
 	}
 
 	if t.root == nil {
-		newnode := &shortNode{Key: hex, Val: valueNode(value)}
+		newnode := &shortNode{Key: hex, Val: valueNode(value), gen: t.gen}
 		t.root = newnode
 	} else {
 		_, t.root = t.insert(t.root, hex, 0, valueNode(value))
@@ -240,9 +428,9 @@ func (t *Trie) UpdateAccount(key []byte, acc *accounts.Account) {
 	if t.root == nil {
 		var newnode node
 		if value.Root == EmptyRoot || value.Root == (common.Hash{}) {
-			newnode = &shortNode{Key: hex, Val: &accountNode{*value, nil, true}}
+			newnode = &shortNode{Key: hex, Val: &accountNode{*value, nil, true}, gen: t.gen}
 		} else {
-			newnode = &shortNode{Key: hex, Val: &accountNode{*value, hashNode(value.Root[:]), true}}
+			newnode = &shortNode{Key: hex, Val: &accountNode{*value, hashNode(value.Root[:]), true}, gen: t.gen}
 		}
 		t.root = newnode
 	} else {
@@ -274,6 +462,8 @@ type ResolveRequest struct {
 	resolveHash   hashNode // Expected hash of the resolved node (for correctness checking)
 	RequiresRLP   bool     // whether to output node's RLP
 	NodeRLP       []byte   // [OUT] RLP of the resolved node
+	Priority      int      // Requests with higher priority are resolved first, see Resolver.SetBudget
+	Subtree       bool     // Whether everything under resolveHex is to be resolved, see NewSubtreeResolveRequest
 }
 
 // NewResolveRequest creates a new ResolveRequest.
@@ -282,6 +472,20 @@ func (t *Trie) NewResolveRequest(contract []byte, hex []byte, pos int, resolveHa
 	return &ResolveRequest{t: t, contract: contract, resolveHex: hex, resolvePos: pos, resolveHash: hashNode(resolveHash)}
 }
 
+// NewSubtreeResolveRequest creates a new ResolveRequest for the node at hex[:pos], which resolves everything
+// under the prefix hex (in HEX encoding, without the terminator) rather than the path to a single key.
+// It is used to pre-resolve the subtrees before DeleteSubtree, and for the storage dumps
+func (t *Trie) NewSubtreeResolveRequest(contract []byte, hex []byte, pos int, resolveHash []byte) *ResolveRequest {
+	req := t.NewResolveRequest(contract, hex, pos, resolveHash)
+	req.Subtree = true
+	return req
+}
+
+// Prefix returns the path (in HEX encoding, for the storage items - including the address hash) of the node that needs to be resolved
+func (rr *ResolveRequest) Prefix() []byte {
+	return rr.resolveHex[:rr.resolvePos]
+}
+
 func (rr *ResolveRequest) String() string {
 	return fmt.Sprintf("rr{t:%x,resolveHex:%x,resolvePos:%d,resolveHash:%s}", rr.contract, rr.resolveHex, rr.resolvePos, rr.resolveHash)
 }
@@ -355,6 +559,106 @@ func (t *Trie) NeedResolution(contract []byte, storageKey []byte) (bool, *Resolv
 	}
 }
 
+// NeedResolutionBatch is the batch version of NeedResolution. It walks the trie once for the entire set
+// of keys, so that the shared prefixes are traversed only once, and returns ResolveRequests for all
+// the keys that require resolution.
+// keys must be sorted and be of the same encoding as storageKey in NeedResolution.
+// If contractLen is not 0, the first contractLen bytes of each key are taken as the contract
+// (address hash) for which the storage item is being resolved
+func (t *Trie) NeedResolutionBatch(contractLen int, keys [][]byte) []*ResolveRequest {
+	if len(keys) == 0 {
+		return nil
+	}
+	hexes := make([][]byte, len(keys))
+	for i, key := range keys {
+		hex := keybytesToHex(key)
+		if t.binary {
+			hex = keyHexToBin(hex)
+		}
+		hexes[i] = hex
+	}
+	var requests []*ResolveRequest
+	t.needResolutionBatch(t.root, keys, hexes, 0, 0, contractLen, &requests)
+	return requests
+}
+
+func (t *Trie) needResolutionBatch(nd node, keys [][]byte, hexes [][]byte, pos int, incarnation uint64, contractLen int, requests *[]*ResolveRequest) {
+	if len(hexes) == 0 {
+		return
+	}
+	switch n := nd.(type) {
+	case nil:
+		return
+	case valueNode:
+		return
+	case *shortNode:
+		// Keys are sorted, so the ones passing through this node (with the same match length) are adjacent
+		start, startMatch := -1, 0
+		for i, hex := range hexes {
+			matchlen := prefixLen(hex[pos:], n.Key)
+			passes := matchlen == len(n.Key) || n.Key[matchlen] == 16
+			if start >= 0 && (!passes || matchlen != startMatch) {
+				t.needResolutionBatch(n.Val, keys[start:i], hexes[start:i], pos+startMatch, incarnation, contractLen, requests)
+				start = -1
+			}
+			if passes && start < 0 {
+				start, startMatch = i, matchlen
+			}
+		}
+		if start >= 0 {
+			t.needResolutionBatch(n.Val, keys[start:], hexes[start:], pos+startMatch, incarnation, contractLen, requests)
+		}
+	case *duoNode:
+		i1, i2 := n.childrenIdx()
+		for start := 0; start < len(hexes); {
+			nibble := hexes[start][pos]
+			end := start + 1
+			for end < len(hexes) && hexes[end][pos] == nibble {
+				end++
+			}
+			switch nibble {
+			case i1:
+				t.needResolutionBatch(n.child1, keys[start:end], hexes[start:end], pos+1, incarnation, contractLen, requests)
+			case i2:
+				t.needResolutionBatch(n.child2, keys[start:end], hexes[start:end], pos+1, incarnation, contractLen, requests)
+			}
+			start = end
+		}
+	case *fullNode:
+		for start := 0; start < len(hexes); {
+			nibble := hexes[start][pos]
+			end := start + 1
+			for end < len(hexes) && hexes[end][pos] == nibble {
+				end++
+			}
+			t.needResolutionBatch(n.Children[nibble], keys[start:end], hexes[start:end], pos+1, incarnation, contractLen, requests)
+			start = end
+		}
+	case *accountNode:
+		// Keys terminating at the account node do not need resolution
+		start := 0
+		for start < len(hexes) && pos == len(hexes[start]) {
+			start++
+		}
+		t.needResolutionBatch(n.storage, keys[start:], hexes[start:], pos, n.Incarnation, contractLen, requests)
+	case hashNode:
+		for i, hex := range hexes {
+			if contractLen == 0 {
+				*requests = append(*requests, t.NewResolveRequest(nil, hex, pos, common.CopyBytes(n)))
+				continue
+			}
+			// 8 is IncarnationLength
+			prefix := make([]byte, contractLen+8)
+			copy(prefix, keys[i][:contractLen])
+			binary.BigEndian.PutUint64(prefix[contractLen:], incarnation^0xffffffffffffffff)
+			hexContractLen := 2 * contractLen // Length of 'contract' prefix in HEX encoding
+			*requests = append(*requests, t.NewResolveRequest(prefix, hex[hexContractLen:], pos-hexContractLen, common.CopyBytes(n)))
+		}
+	default:
+		panic(fmt.Sprintf("Unknown node: %T", n))
+	}
+}
+
 func (t *Trie) insert(origNode node, key []byte, pos int, value node) (updated bool, newNode node) {
 	//fmt.Printf("insert %T key %x %d\n", origNode, key, pos)
 
@@ -376,6 +680,11 @@ func (t *Trie) insert(origNode node, key []byte, pos int, value node) (updated b
 		if origNok && vnok {
 			updated = !origAccN.Equals(&vAccN.Account)
 			if updated {
+				if origAccN.Root != vAccN.Root {
+					// Memoized root of the storage sub-trie is not kept when the caller supplies a different one,
+					// it is computed from the storage sub-trie again
+					origAccN.hashCorrect = false
+				}
 				origAccN.Account.Copy(&vAccN.Account)
 			}
 			return updated, origAccN
@@ -389,7 +698,7 @@ func (t *Trie) insert(origNode node, key []byte, pos int, value node) (updated b
 
 	switch n := origNode.(type) {
 	case nil:
-		s := &shortNode{Key: common.CopyBytes(key[pos:]), Val: value}
+		s := &shortNode{Key: common.CopyBytes(key[pos:]), Val: value, gen: t.gen}
 		return true, s
 	case *accountNode:
 		updated, nn = t.insert(n.storage, key, pos, value)
@@ -406,6 +715,7 @@ func (t *Trie) insert(origNode node, key []byte, pos int, value node) (updated b
 			updated, nn = t.insert(n.Val, key, pos+matchlen, value)
 			if updated {
 				n.Val = nn
+				n.gen = t.gen
 			}
 			newNode = n
 		} else {
@@ -414,14 +724,14 @@ func (t *Trie) insert(origNode node, key []byte, pos int, value node) (updated b
 			if len(n.Key) == matchlen+1 {
 				c1 = n.Val
 			} else {
-				s1 := &shortNode{Key: common.CopyBytes(n.Key[matchlen+1:]), Val: n.Val}
+				s1 := &shortNode{Key: common.CopyBytes(n.Key[matchlen+1:]), Val: n.Val, gen: n.gen}
 				c1 = s1
 			}
 			var c2 node
 			if len(key) == pos+matchlen+1 {
 				c2 = value
 			} else {
-				s2 := &shortNode{Key: common.CopyBytes(key[pos+matchlen+1:]), Val: value}
+				s2 := &shortNode{Key: common.CopyBytes(key[pos+matchlen+1:]), Val: value, gen: t.gen}
 				c2 = s2
 			}
 			branch := &duoNode{}
@@ -473,7 +783,7 @@ func (t *Trie) insert(origNode node, key []byte, pos int, value node) (updated b
 			if len(key) == pos+1 {
 				child = value
 			} else {
-				short := &shortNode{Key: common.CopyBytes(key[pos+1:]), Val: value}
+				short := &shortNode{Key: common.CopyBytes(key[pos+1:]), Val: value, gen: t.gen}
 				child = short
 			}
 			newnode := &fullNode{}
@@ -494,7 +804,7 @@ func (t *Trie) insert(origNode node, key []byte, pos int, value node) (updated b
 			if len(key) == pos+1 {
 				n.Children[key[pos]] = value
 			} else {
-				short := &shortNode{Key: common.CopyBytes(key[pos+1:]), Val: value}
+				short := &shortNode{Key: common.CopyBytes(key[pos+1:]), Val: value, gen: t.gen}
 				n.Children[key[pos]] = short
 			}
 			updated = true
@@ -618,6 +928,7 @@ func (t *Trie) hook(hex []byte, n node) {
 		return
 	}
 	t.touchAll(n, hex, false)
+	stampGen(n, t.gen)
 	switch p := parent.(type) {
 	case nil:
 		t.root = n
@@ -639,6 +950,28 @@ func (t *Trie) hook(hex []byte, n node) {
 	}
 }
 
+// stampGen sets the generation of all the leaves in the given (freshly resolved) subtrie
+func stampGen(n node, gen uint64) {
+	switch n := n.(type) {
+	case *shortNode:
+		n.gen = gen
+		stampGen(n.Val, gen)
+	case *duoNode:
+		stampGen(n.child1, gen)
+		stampGen(n.child2, gen)
+	case *fullNode:
+		for _, child := range n.Children {
+			if child != nil {
+				stampGen(child, gen)
+			}
+		}
+	case *accountNode:
+		if n.storage != nil {
+			stampGen(n.storage, gen)
+		}
+	}
+}
+
 func (t *Trie) touchAll(n node, hex []byte, del bool) {
 	switch n := n.(type) {
 	case *shortNode:
@@ -700,7 +1033,7 @@ func (t *Trie) convertToShortNode(child node, pos uint) node {
 			k := make([]byte, len(short.Key)+1)
 			k[0] = byte(pos)
 			copy(k[1:], short.Key)
-			return &shortNode{Key: k, Val: short.Val}
+			return &shortNode{Key: k, Val: short.Val, gen: short.gen}
 		}
 	}
 	// Otherwise, n is replaced by a one-nibble short node
@@ -745,7 +1078,7 @@ func (t *Trie) delete(origNode node, key []byte, keyStart int) (updated bool, ne
 							// always creates a new slice) instead of append to
 							// avoid modifying n.Key since it might be shared with
 							// other nodes.
-							newNode = &shortNode{Key: concat(n.Key, shortChild.Key...), Val: shortChild.Val}
+							newNode = &shortNode{Key: concat(n.Key, shortChild.Key...), Val: shortChild.Val, gen: shortChild.gen}
 						} else {
 							n.Val = nn
 							newNode = n
@@ -932,7 +1265,7 @@ func (t *Trie) deleteSubtree(origNode node, key []byte, keyStart int, blockNr ui
 						// always creates a new slice) instead of append to
 						// avoid modifying n.Key since it might be shared with
 						// other nodes.
-						newNode = &shortNode{Key: concat(n.Key, shortChild.Key...), Val: shortChild.Val}
+						newNode = &shortNode{Key: concat(n.Key, shortChild.Key...), Val: shortChild.Val, gen: shortChild.gen}
 					} else {
 						n.Val = nn
 						newNode = n
@@ -1113,6 +1446,8 @@ func (t *Trie) Hash() common.Hash {
 // node, it will return the hash of a modified leaf node or extension node, where the
 // key prefix is removed from the key.
 // First returned value is `true` if the node with the specified prefix is found
+// Storage roots are memoized in the account nodes and only recomputed if the storage
+// sub-trie has been modified (by Update, Delete or DeleteSubtree) since the last computation
 func (t *Trie) DeepHash(keyPrefix []byte) (bool, common.Hash) {
 	hexPrefix := keybytesToHex(keyPrefix)
 	if t.binary {
@@ -1125,17 +1460,18 @@ func (t *Trie) DeepHash(keyPrefix []byte) (bool, common.Hash) {
 	//if accNode==nil {
 	//	return gotValue, common.Hash{}
 	//}
-	if accNode.hashCorrect {
-		return true, accNode.Root
-	}
 	if accNode.storage == nil {
 		accNode.Root = EmptyRoot
 		accNode.hashCorrect = true
-	} else {
-		h := t.newHasherFunc()
-		defer returnHasherToPool(h)
-		h.hash(accNode.storage, true, accNode.Root[:])
+		return true, accNode.Root
 	}
+	if accNode.hashCorrect {
+		return true, accNode.Root
+	}
+	h := t.newHasherFunc()
+	defer returnHasherToPool(h)
+	h.hash(accNode.storage, true, accNode.Root[:])
+	accNode.hashCorrect = true
 	return true, accNode.Root
 }
 
@@ -9,6 +9,16 @@ import (
 )
 
 func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, CodeMap, error) {
+	return BuildTrieFromWitnessWithCodeWindow(witness, isBinary, trace, nil)
+}
+
+// BuildTrieFromWitnessWithCodeWindow parses the witnesses produced in the code-by-reference mode (see WitnessBuilder.SetCodeWindow).
+// The codes referenced by hash are taken from the witness itself or from the window, and the codes of the witness are then added to it
+func BuildTrieFromWitnessWithCodeWindow(witness *Witness, isBinary bool, trace bool, window *CodeWindow) (*Trie, CodeMap, error) {
+	// The witnesses before the version 2 do not say which trie they are for, so only the explicit mismatch is detected
+	if witness.Header.IsBinary() && !isBinary {
+		return nil, nil, fmt.Errorf("witness of the binary trie cannot be used for the hexary trie")
+	}
 	codeMap := make(map[common.Hash][]byte)
 	hb := NewHashBuilder(false)
 	for _, operator := range witness.Operators {
@@ -54,6 +64,22 @@ func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, C
 				return nil, nil, err
 			}
 
+		case *OperatorCodeRef:
+			if trace {
+				fmt.Printf("CODEREF ")
+			}
+			code, ok := codeMap[op.Hash]
+			if !ok && window != nil {
+				code, ok = window.Get(op.Hash)
+			}
+			if !ok {
+				return nil, nil, fmt.Errorf("referenced code %x is not in the code window", op.Hash)
+			}
+			if _, err := hb.code(code); err != nil {
+				return nil, nil, err
+			}
+			codeMap[op.Hash] = code
+
 		case *OperatorLeafAccount:
 			if trace {
 				fmt.Printf("ACCOUNTLEAF(code=%v storage=%v) ", op.HasCode, op.HasStorage)
@@ -94,6 +120,9 @@ func BuildTrieFromWitness(witness *Witness, isBinary bool, trace bool) (*Trie, C
 		}
 		return New(EmptyRoot), nil, nil
 	}
+	if window != nil {
+		window.Add(codeMap)
+	}
 	r := hb.root()
 	var tr *Trie
 	if isBinary {
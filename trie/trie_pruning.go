@@ -203,6 +203,32 @@ func (tp *TriePruning) PruneTo(
 	return true
 }
 
+// OldestGeneration returns the timestamp of the oldest tracked nodes, from which PruneTo starts
+func (tp *TriePruning) OldestGeneration() uint64 {
+	return tp.oldestGeneration
+}
+
+// Timestamps returns the timestamps of the tracked nodes, keyed by their prefixes. Only the prefixes shorter
+// than maxDepth are returned, unless it is 0. Together with OldestGeneration, it allows restoring the pruning
+// state for a trie restored from a snapshot (see Trie.WriteSnapshot) with SetTimestamp
+func (tp *TriePruning) Timestamps(maxDepth int) map[string]uint64 {
+	timestamps := make(map[string]uint64, len(tp.accountTimestamps))
+	for hexS, ts := range tp.accountTimestamps {
+		if maxDepth == 0 || len(hexS) < maxDepth {
+			timestamps[hexS] = ts
+		}
+	}
+	return timestamps
+}
+
+// SetTimestamp starts tracking the node with the given prefix as if it was last touched at the timestamp
+func (tp *TriePruning) SetTimestamp(hex []byte, timestamp uint64) {
+	hexS := string(common.CopyBytes(hex))
+	prevTimestamp, exists := tp.accountTimestamps[hexS]
+	tp.accountTimestamps[hexS] = timestamp
+	tp.touch(hexS, exists, prevTimestamp, false, timestamp)
+}
+
 func (tp *TriePruning) NodeCount() int {
 	return tp.nodeCount
 }
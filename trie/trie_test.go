@@ -19,12 +19,16 @@ package trie
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"math/rand"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"testing/quick"
 
@@ -490,3 +494,200 @@ func TestDeepHash(t *testing.T) {
 		}
 	}
 }
+
+func TestDeepHashMemoized(t *testing.T) {
+	acc := accounts.NewAccount()
+	prefix := "prefix"
+	trie := New(common.Hash{})
+	trie.UpdateAccount([]byte(prefix), &acc)
+	trie.Update([]byte(prefix+"key1"), []byte("value1"), 0)
+	trie.Update([]byte(prefix+"key2"), []byte("value2"), 0)
+	_, hash1 := trie.DeepHash([]byte(prefix))
+
+	// Modification of the storage must invalidate the memoized root
+	trie.Update([]byte(prefix+"key3"), []byte("value3"), 0)
+	_, hash2 := trie.DeepHash([]byte(prefix))
+	expected := New(common.Hash{})
+	expected.Update([]byte("key1"), []byte("value1"), 0)
+	expected.Update([]byte("key2"), []byte("value2"), 0)
+	expected.Update([]byte("key3"), []byte("value3"), 0)
+	if hash2 != expected.Hash() {
+		t.Errorf("DeepHash mismatch after update: %x, expected %x", hash2, expected.Hash())
+	}
+
+	// Updating the account with a stale root must not override the memoized root
+	stale := accounts.NewAccount()
+	stale.Nonce = 1
+	stale.Root = hash1
+	trie.UpdateAccount([]byte(prefix), &stale)
+	if _, hash3 := trie.DeepHash([]byte(prefix)); hash3 != hash2 {
+		t.Errorf("DeepHash mismatch after account update: %x, expected %x", hash3, hash2)
+	}
+
+	trie.Delete([]byte(prefix+"key3"), 0)
+	if _, hash4 := trie.DeepHash([]byte(prefix)); hash4 != hash1 {
+		t.Errorf("DeepHash mismatch after delete: %x, expected %x", hash4, hash1)
+	}
+}
+
+func TestUpdateAccountMemoizedRoot(t *testing.T) {
+	acc := accounts.NewAccount()
+	prefix := "prefix"
+	trie := New(common.Hash{})
+	trie.UpdateAccount([]byte(prefix), &acc)
+	trie.Update([]byte(prefix+"key1"), []byte("value1"), 0)
+	_, root := trie.DeepHash([]byte(prefix))
+	accNode := func() *accountNode {
+		n, _ := trie.getAccount(trie.root, keybytesToHex([]byte(prefix)), 0)
+		return n
+	}
+
+	// The memoized root is kept when the caller supplies the same root
+	same := accounts.NewAccount()
+	same.Nonce = 1
+	same.Root = root
+	trie.UpdateAccount([]byte(prefix), &same)
+	if n := accNode(); !n.hashCorrect || n.Root != root {
+		t.Errorf("expected the memoized root %x to be kept, got %x (correct %t)", root, n.Root, n.hashCorrect)
+	}
+
+	// A different root invalidates the memoized one, which is then computed from the storage again
+	other := accounts.NewAccount()
+	other.Nonce = 2
+	other.Root = common.HexToHash("0xbad")
+	trie.UpdateAccount([]byte(prefix), &other)
+	if n := accNode(); n.hashCorrect || n.Root != other.Root {
+		t.Errorf("expected the supplied root %x without memoization, got %x (correct %t)", other.Root, n.Root, n.hashCorrect)
+	}
+	if _, h := trie.DeepHash([]byte(prefix)); h != root {
+		t.Errorf("DeepHash mismatch after account update: %x, expected %x", h, root)
+	}
+}
+
+func TestNeedResolutionBatch(t *testing.T) {
+	trie := newEmpty()
+	var keys [][]byte
+	for i := 0; i < 256; i++ {
+		key := crypto.Keccak256([]byte{byte(i)})
+		keys = append(keys, key)
+		trie.Update(key, []byte{byte(i + 1)}, 0)
+	}
+	// Roll some of the subtries into hashes, so that some of the keys require resolution
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+	trie.unload([]byte{0x3}, h)
+	trie.unload([]byte{0xa, 0x1}, h)
+	trie.unload([]byte{0xf}, h)
+
+	sort.Sort(sortable(keys))
+	var expected []string
+	for _, key := range keys {
+		if need, req := trie.NeedResolution(nil, key); need {
+			expected = append(expected, req.String())
+		}
+	}
+	if len(expected) == 0 {
+		t.Fatal("expected some keys to require resolution")
+	}
+	var got []string
+	for _, req := range trie.NeedResolutionBatch(0, keys) {
+		got = append(got, req.String())
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("batch resolution requests differ, expected %d requests, got %d", len(expected), len(got))
+	}
+}
+
+func TestGetWithGen(t *testing.T) {
+	trie := newEmpty()
+	k1 := common.FromHex("0x1000000000000000000000000000000000000000000000000000000000000000")
+	k2 := common.FromHex("0x1100000000000000000000000000000000000000000000000000000000000000")
+	k3 := common.FromHex("0x2000000000000000000000000000000000000000000000000000000000000000")
+	trie.SetGeneration(5)
+	trie.Update(k1, []byte("one"), 5)
+	trie.Update(k2, []byte("two"), 5)
+	trie.SetGeneration(7)
+	trie.Update(k3, []byte("three"), 7)
+	trie.Update(k2, []byte("two'"), 7)
+
+	for _, tc := range []struct {
+		key   []byte
+		value string
+		gen   uint64
+	}{{k1, "one", 5}, {k2, "two'", 7}, {k3, "three", 7}} {
+		value, gen, ok := trie.GetWithGen(tc.key)
+		if !ok {
+			t.Fatalf("expected value for %x to be resolved", tc.key)
+		}
+		if string(value) != tc.value || gen != tc.gen {
+			t.Errorf("key %x: got %q (gen %d), expected %q (gen %d)", tc.key, value, gen, tc.value, tc.gen)
+		}
+	}
+
+	// Deleting the sibling merges the short nodes, but must keep the generation of the remaining leaf
+	trie.SetGeneration(9)
+	trie.Delete(k2, 9)
+	if _, gen, _ := trie.GetWithGen(k1); gen != 5 {
+		t.Errorf("expected generation 5 after the merge, got %d", gen)
+	}
+}
+
+func TestExportTrie(t *testing.T) {
+	trie := newEmpty()
+	trie.SetGeneration(3)
+	trie.Update([]byte("doe"), []byte("reindeer"), 3)
+	trie.Update([]byte("dog"), []byte("puppy"), 3)
+	trie.Update([]byte("horse"), []byte("stallion"), 3)
+	trie.Hash()
+
+	var buf bytes.Buffer
+	if err := trie.ExportTrie(&buf, ExportJSON, nil); err != nil {
+		t.Fatal(err)
+	}
+	var root ExportedNode
+	if err := json.Unmarshal(buf.Bytes(), &root); err != nil {
+		t.Fatal(err)
+	}
+	if root.Type != "short" || len(root.Children) != 1 {
+		t.Errorf("unexpected root: %+v", root)
+	}
+
+	// Export only the subtrie for keys starting with "do"
+	buf.Reset()
+	if err := trie.ExportTrie(&buf, ExportDOT, keybytesToHex([]byte("do"))[:4]); err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph trie {") || !strings.Contains(dot, "gen 3") {
+		t.Errorf("unexpected DOT output: %s", dot)
+	}
+	if strings.Contains(dot, hex.EncodeToString([]byte("stallion"))) {
+		t.Errorf("expected \"horse\" to be outside of the exported subtrie: %s", dot)
+	}
+}
+
+func TestGetStorageIncarnation(t *testing.T) {
+	prefix := "prefix"
+	acc := accounts.NewAccount()
+	acc.Incarnation = 2
+	trie := New(common.Hash{})
+	trie.UpdateAccount([]byte(prefix), &acc)
+	trie.Update([]byte(prefix+"key1"), []byte("value1"), 0)
+
+	if v, ok := trie.GetStorage([]byte(prefix+"key1"), 2); !ok || string(v) != "value1" {
+		t.Errorf("expected value1 for the current incarnation, got %q (%t)", v, ok)
+	}
+	if _, ok := trie.GetStorage([]byte(prefix+"key1"), 1); ok {
+		t.Errorf("did not expect the value for another incarnation")
+	}
+	if v, ok := trie.Get([]byte(prefix + "key1")); !ok || string(v) != "value1" {
+		t.Errorf("expected value1 regardless of incarnation, got %q (%t)", v, ok)
+	}
+
+	// Incarnation of the account is unknown
+	acc.Incarnation = 0
+	trie.UpdateAccount([]byte(prefix), &acc)
+	if v, ok := trie.GetStorage([]byte(prefix+"key1"), 1); !ok || string(v) != "value1" {
+		t.Errorf("expected value1 for the account without incarnation, got %q (%t)", v, ok)
+	}
+}
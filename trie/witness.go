@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strings"
 )
 
 // WitnessStorage is an interface representing a single
@@ -13,17 +14,62 @@ type WitnessStorage interface {
 
 // WitnessVersion represents the current version of the block witness
 // in case of incompatible changes it should be updated and the code to migrate the
-// old witness format should be present
-const WitnessVersion = uint8(1)
+// old witness format should be present.
+// Version 1: the version byte only, the witness is always for the hexary trie, with the whole codes.
+// Version 2: the version byte followed by the byte of WitnessCapabilities.
+const WitnessVersion = uint8(2)
+
+// MinWitnessVersion is the oldest version of the witness that NewWitnessFromReader accepts
+const MinWitnessVersion = uint8(1)
+
+// WitnessCapabilities are the features of the witness format that the producer and the consumer
+// of the witness need to agree on, see NegotiateWitnessHeader. They are encoded in the header since version 2
+type WitnessCapabilities uint8
+
+const (
+	// WitnessBinaryTrie marks the witness of the binary trie, rather than of the hexary one
+	WitnessBinaryTrie WitnessCapabilities = 1 << iota
+	// WitnessCodeChunks marks the witness with the contract codes split into chunks. It is reserved,
+	// as this implementation always includes the whole codes
+	WitnessCodeChunks
+)
+
+// SupportedWitnessCapabilities is the set of the capabilities this implementation can produce and consume
+const SupportedWitnessCapabilities = WitnessBinaryTrie
+
+func (c WitnessCapabilities) String() string {
+	var names []string
+	if c&WitnessBinaryTrie != 0 {
+		names = append(names, "binary")
+	}
+	if c&WitnessCodeChunks != 0 {
+		names = append(names, "codeChunks")
+	}
+	if rest := c &^ (WitnessBinaryTrie | WitnessCodeChunks); rest != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint8(rest)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
 
 // WitnessHeader contains version information and maybe some future format bits
 // the version is always the 1st bit.
 type WitnessHeader struct {
-	Version uint8
+	Version      uint8
+	Capabilities WitnessCapabilities // Always empty for the version 1
 }
 
 func (h *WitnessHeader) WriteTo(out *OperatorMarshaller) error {
-	_, err := out.WithColumn(ColumnStructure).Write([]byte{h.Version})
+	if err := h.check(); err != nil {
+		return err
+	}
+	header := []byte{h.Version}
+	if h.Version >= 2 {
+		header = append(header, byte(h.Capabilities))
+	}
+	_, err := out.WithColumn(ColumnStructure).Write(header)
 	return err
 }
 
@@ -34,11 +80,78 @@ func (h *WitnessHeader) LoadFrom(input io.Reader) error {
 	}
 
 	h.Version = version[0]
+	h.Capabilities = 0
+	if h.Version < MinWitnessVersion || h.Version > WitnessVersion {
+		return fmt.Errorf("unexpected witness version: expected %d..%d, got %d", MinWitnessVersion, WitnessVersion, h.Version)
+	}
+	if h.Version >= 2 {
+		if _, err := io.ReadFull(input, version); err != nil {
+			return err
+		}
+		h.Capabilities = WitnessCapabilities(version[0])
+	}
+	return h.check()
+}
+
+// check verifies that the version of the header can express its capabilities, and that they are supported
+func (h *WitnessHeader) check() error {
+	if h.Version < 2 && h.Capabilities != 0 {
+		return fmt.Errorf("witness version %d does not support capabilities %s", h.Version, h.Capabilities)
+	}
+	if unsupported := h.Capabilities &^ SupportedWitnessCapabilities; unsupported != 0 {
+		return fmt.Errorf("unsupported witness capabilities: %s", unsupported)
+	}
 	return nil
 }
 
+// IsBinary reports whether the witness is for the binary trie. The witnesses of the version 1 are always hexary
+func (h *WitnessHeader) IsBinary() bool {
+	return h.Capabilities&WitnessBinaryTrie != 0
+}
+
 func defaultWitnessHeader() WitnessHeader {
-	return WitnessHeader{WitnessVersion}
+	return WitnessHeader{Version: WitnessVersion}
+}
+
+// WitnessFormat describes the range of the witness versions and the capabilities
+// that the producer or the consumer of the witnesses supports
+type WitnessFormat struct {
+	MinVersion   uint8
+	MaxVersion   uint8
+	Capabilities WitnessCapabilities
+}
+
+// LocalWitnessFormat returns the witness format supported by this implementation
+func LocalWitnessFormat() WitnessFormat {
+	return WitnessFormat{MinVersion: MinWitnessVersion, MaxVersion: WitnessVersion, Capabilities: SupportedWitnessCapabilities}
+}
+
+// NegotiateWitnessHeader chooses the header of the witnesses that the producer writes for the consumer:
+// the highest version both of them support, with the required capabilities (e.g. WitnessBinaryTrie after the
+// binary trie fork). It fails if there is no such version, or if either of them lacks a required capability
+func NegotiateWitnessHeader(producer, consumer WitnessFormat, required WitnessCapabilities) (WitnessHeader, error) {
+	maxVersion := producer.MaxVersion
+	if consumer.MaxVersion < maxVersion {
+		maxVersion = consumer.MaxVersion
+	}
+	minVersion := producer.MinVersion
+	if consumer.MinVersion > minVersion {
+		minVersion = consumer.MinVersion
+	}
+	if required != 0 && minVersion < 2 {
+		minVersion = 2
+	}
+	if maxVersion < minVersion {
+		return WitnessHeader{}, fmt.Errorf("no common witness version: producer %d..%d, consumer %d..%d, capabilities %s",
+			producer.MinVersion, producer.MaxVersion, consumer.MinVersion, consumer.MaxVersion, required)
+	}
+	if missing := required &^ producer.Capabilities; missing != 0 {
+		return WitnessHeader{}, fmt.Errorf("producer does not support witness capabilities %s", missing)
+	}
+	if missing := required &^ consumer.Capabilities; missing != 0 {
+		return WitnessHeader{}, fmt.Errorf("consumer does not support witness capabilities %s", missing)
+	}
+	return WitnessHeader{Version: maxVersion, Capabilities: required}, nil
 }
 
 type Witness struct {
@@ -74,10 +187,6 @@ func NewWitnessFromReader(input io.Reader, trace bool) (*Witness, error) {
 		return nil, err
 	}
 
-	if header.Version != WitnessVersion {
-		return nil, fmt.Errorf("unexpected witness version: expected %d, got %d", WitnessVersion, header.Version)
-	}
-
 	operatorLoader := NewOperatorUnmarshaller(input)
 
 	opcode := make([]byte, 1)
@@ -100,6 +209,8 @@ func NewWitnessFromReader(input io.Reader, trace bool) (*Witness, error) {
 			op = &OperatorLeafAccount{}
 		case OpCode:
 			op = &OperatorCode{}
+		case OpCodeRef:
+			op = &OperatorCodeRef{}
 		case OpBranch:
 			op = &OperatorBranch{}
 		case OpEmptyRoot:
@@ -26,6 +26,10 @@ type WitnessBuilder struct {
 	trace    bool
 	codeMap  CodeMap
 	operands []WitnessOperator
+	maxDepth int          // If not 0, branch nodes at this depth or deeper are replaced by their hashes
+	hashFunc HashNodeFunc // Used for the cut-off branches when no limiter is given
+	window   *CodeWindow  // If set, codes present in the window are referenced by hash rather than embedded
+	used     CodeMap      // Codes embedded or referenced by the witness being built, to be added to the window
 }
 
 func NewWitnessBuilder(root node, blockNr uint64, trace bool, codeMap CodeMap) *WitnessBuilder {
@@ -38,8 +42,43 @@ func NewWitnessBuilder(root node, blockNr uint64, trace bool, codeMap CodeMap) *
 	}
 }
 
+// SetMaxDepth makes the builder produce "summary witnesses" of bounded size: all branch nodes at the given depth
+// (in nibbles, counted from the root of the state trie, so that the storage tries start at depth 64) or deeper
+// are replaced by their hashes, even if they lie on the paths to the touched keys. 0 means no cut-off.
+// Such witnesses are still valid for checking the state root, but do not contain all the touched items
+func (b *WitnessBuilder) SetMaxDepth(depth int) {
+	b.maxDepth = depth
+}
+
+// SetCodeWindow enables the code-by-reference mode: the codes that were included into the last witnesses
+// tracked by the window (or earlier in the same witness) are referenced by their hashes rather than embedded. After each Build, the codes
+// of the new witness are added to the window. The consumer needs to parse the witnesses in the same order,
+// with its own window of the same size (see BuildTrieFromWitnessWithCodeWindow)
+func (b *WitnessBuilder) SetCodeWindow(window *CodeWindow) {
+	b.window = window
+}
+
+func (b *WitnessBuilder) cutOff(hex []byte) bool {
+	return b.maxDepth > 0 && len(hex) >= b.maxDepth
+}
+
 func (b *WitnessBuilder) Build(limiter *MerklePathLimiter) (*Witness, error) {
+	if limiter != nil {
+		b.hashFunc = limiter.HashFunc
+	} else if b.maxDepth > 0 {
+		hr := newHasher(false)
+		defer returnHasherToPool(hr)
+		b.hashFunc = hr.hash
+	}
+	if b.window != nil {
+		b.used = make(CodeMap)
+	}
 	err := b.makeBlockWitness(b.root, []byte{}, limiter, true)
+	b.hashFunc = nil
+	if b.window != nil && err == nil {
+		b.window.Add(b.used)
+	}
+	b.used = nil
 	witness := NewWitness(b.operands)
 	b.operands = nil
 	return witness, err
@@ -124,6 +163,18 @@ func (b *WitnessBuilder) addHashOp(n hashNode) error {
 	return nil
 }
 
+func (b *WitnessBuilder) addCodeRefOp(codeHash common.Hash) error {
+	if b.trace {
+		fmt.Printf("CODEREF: %x\n", codeHash)
+	}
+
+	var op OperatorCodeRef
+	op.Hash = codeHash
+
+	b.operands = append(b.operands, &op)
+	return nil
+}
+
 func (b *WitnessBuilder) addBranchOp(mask uint32) error {
 	if b.trace {
 		fmt.Printf("BRANCH: mask=%b\n", mask)
@@ -168,6 +219,13 @@ func (b *WitnessBuilder) processAccountCode(n *accountNode) error {
 		return b.addHashOp(hashNode(n.CodeHash[:]))
 	}
 
+	if b.window != nil {
+		if _, seen := b.used[n.CodeHash]; seen || b.window.Has(n.CodeHash) {
+			b.used[n.CodeHash] = code
+			return b.addCodeRefOp(n.CodeHash)
+		}
+		b.used[n.CodeHash] = code
+	}
 	return b.addCodeOp(code)
 }
 
@@ -224,12 +282,12 @@ func (b *WitnessBuilder) makeBlockWitness(
 			return b.addExtensionOp(n.Key)
 		}
 	case *duoNode:
-		hashOnly := limiter != nil && limiter.HashOnly.HashOnly(hex) // Save this because rs can move on to other keys during the recursive invocation
+		hashOnly := b.cutOff(hex) || limiter != nil && limiter.HashOnly.HashOnly(hex) // Save this because rs can move on to other keys during the recursive invocation
 		if b.trace {
 			fmt.Printf("b.hashOnly.HashOnly(%x) -> %v\n", hex, hashOnly)
 		}
 		if hashOnly {
-			hn, err := b.makeHashNode(n, force, limiter.HashFunc)
+			hn, err := b.makeHashNode(n, force, b.hashFunc)
 			if err != nil {
 				return err
 			}
@@ -247,9 +305,9 @@ func (b *WitnessBuilder) makeBlockWitness(
 		return b.addBranchOp(n.mask)
 
 	case *fullNode:
-		hashOnly := limiter != nil && limiter.HashOnly.HashOnly(hex) // Save this because rs can move on to other keys during the recursive invocation
+		hashOnly := b.cutOff(hex) || limiter != nil && limiter.HashOnly.HashOnly(hex) // Save this because rs can move on to other keys during the recursive invocation
 		if hashOnly {
-			hn, err := b.makeHashNode(n, force, limiter.HashFunc)
+			hn, err := b.makeHashNode(n, force, b.hashFunc)
 			if err != nil {
 				return err
 			}
@@ -268,7 +326,7 @@ func (b *WitnessBuilder) makeBlockWitness(
 		return b.addBranchOp(mask)
 
 	case hashNode:
-		hashOnly := limiter == nil || limiter.HashOnly.HashOnly(hex)
+		hashOnly := b.cutOff(hex) || limiter == nil || limiter.HashOnly.HashOnly(hex)
 		if !hashOnly {
 			if c := limiter.HashOnly.Current(); len(c) == len(hex)+1 && c[len(c)-1] == 16 {
 				hashOnly = true
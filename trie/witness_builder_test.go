@@ -6,6 +6,7 @@ import (
 
 	"github.com/ledgerwatch/turbo-geth/common"
 	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
 )
 
 func TestBlockWitnessBinary(t *testing.T) {
@@ -81,3 +82,91 @@ func TestBlockWitnessBinaryAccount(t *testing.T) {
 		t.Errorf("received account is not equal to the initial one")
 	}
 }
+
+func TestBlockWitnessMaxDepth(t *testing.T) {
+	tr := New(common.Hash{})
+	for i := 0; i < 1000; i++ {
+		key := crypto.Keccak256([]byte{byte(i >> 8), byte(i)})
+		tr.Update(key, bytes.Repeat([]byte{byte(i)}, 40), 0)
+	}
+
+	full, err := NewWitnessBuilder(tr.root, 1, false, nil).Build(nil)
+	if err != nil {
+		t.Fatalf("Could not make block witness: %v", err)
+	}
+	bwb := NewWitnessBuilder(tr.root, 1, false, nil)
+	bwb.SetMaxDepth(2)
+	summary, err := bwb.Build(nil)
+	if err != nil {
+		t.Fatalf("Could not make summary witness: %v", err)
+	}
+	if len(summary.Operators) >= len(full.Operators) {
+		t.Errorf("expected summary witness to be smaller than the full one: %d >= %d", len(summary.Operators), len(full.Operators))
+	}
+
+	tr1, _, err := BuildTrieFromWitness(summary, false /*is-binary*/, false /*trace*/)
+	if err != nil {
+		t.Fatalf("Could not restore trie from the summary witness: %v", err)
+	}
+	if tr.Hash() != tr1.Hash() {
+		t.Errorf("Reconstructed summary witness has different root hash than source trie")
+	}
+}
+
+func TestBlockWitnessCodeWindow(t *testing.T) {
+	code := bytes.Repeat([]byte{0x60}, 1000)
+	codeHash := crypto.Keccak256Hash(code)
+	tr := New(common.Hash{})
+	for i := 0; i < 3; i++ {
+		account := accounts.NewAccount()
+		account.Balance.SetInt64(int64(i + 1))
+		account.CodeHash = codeHash
+		tr.UpdateAccount(crypto.Keccak256([]byte{byte(i)}), &account)
+	}
+	codeMap := CodeMap{codeHash: code}
+
+	producer := NewCodeWindow(2)
+	consumer := NewCodeWindow(2)
+	var sizes []int
+	for block := 0; block < 2; block++ {
+		bwb := NewWitnessBuilder(tr.root, uint64(block), false, codeMap)
+		bwb.SetCodeWindow(producer)
+		w, err := bwb.Build(nil)
+		if err != nil {
+			t.Fatalf("Could not make block witness: %v", err)
+		}
+		var buf bytes.Buffer
+		if _, err = w.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, buf.Len())
+		w1, err := NewWitnessFromReader(&buf, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr1, codes, err := BuildTrieFromWitnessWithCodeWindow(w1, false, false, consumer)
+		if err != nil {
+			t.Fatalf("Could not restore trie from the block witness: %v", err)
+		}
+		if tr.Hash() != tr1.Hash() {
+			t.Errorf("Reconstructed block witness has different root hash than source trie")
+		}
+		if !bytes.Equal(codes[codeHash], code) {
+			t.Errorf("Code is not restored from block witness %d", block)
+		}
+	}
+	if sizes[1]+len(code)/2 > sizes[0] {
+		t.Errorf("expected the second witness to reference the code, sizes: %v", sizes)
+	}
+
+	// Without the window, the reference cannot be resolved
+	bwb := NewWitnessBuilder(tr.root, 2, false, codeMap)
+	bwb.SetCodeWindow(producer)
+	w, err := bwb.Build(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = BuildTrieFromWitness(w, false, false); err == nil {
+		t.Errorf("expected error when parsing referenced code without the window")
+	}
+}
@@ -0,0 +1,177 @@
+package trie
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+)
+
+// WitnessDiffPart counts the trie nodes and the codes in one part of WitnessDiffResult
+type WitnessDiffPart struct {
+	Nodes     int    // Nodes expanded in the witness
+	NodeBytes uint64 // Total size of the RLP encodings of the expanded nodes
+	Hashes    int    // Hashes of the subtries that are not expanded in the witness
+	Codes     int
+	CodeBytes uint64
+}
+
+// WitnessDiffResult is the comparison of two witnesses, see WitnessDiff
+type WitnessDiffResult struct {
+	Shared WitnessDiffPart // Present in both witnesses
+	OnlyA  WitnessDiffPart // Only present in the first witness
+	OnlyB  WitnessDiffPart // Only present in the second witness
+}
+
+func (r *WitnessDiffResult) String() string {
+	part := func(p WitnessDiffPart) string {
+		return fmt.Sprintf("nodes=%d (%d bytes) hashes=%d codes=%d (%d bytes)", p.Nodes, p.NodeBytes, p.Hashes, p.Codes, p.CodeBytes)
+	}
+	return fmt.Sprintf("shared: %s\nonly a: %s\nonly b: %s\n", part(r.Shared), part(r.OnlyA), part(r.OnlyB))
+}
+
+// witnessContent is the set of the nodes (by hash, with the sizes of their encodings), of the hashes
+// of the subtries that are not expanded, and of the codes (by hash, with their sizes) of one witness
+type witnessContent struct {
+	nodes  map[common.Hash]int
+	hashes map[common.Hash]struct{}
+	codes  map[common.Hash]int
+}
+
+// WitnessDiff parses two serialised witnesses (for example, of the competing blocks at the same height, or of
+// the different orderings of the transactions) and reports which trie nodes and codes they share, and which
+// are unique to either of them. The nodes are compared by their hashes, so the same node is matched even if
+// the witnesses lay it out differently. The witnesses referencing the codes by hash (see WitnessBuilder.SetCodeWindow)
+// cannot be compared, as the codes are not in them
+func WitnessDiff(a, b []byte) (*WitnessDiffResult, error) {
+	ca, err := readWitnessContent(a)
+	if err != nil {
+		return nil, fmt.Errorf("witness a: %w", err)
+	}
+	cb, err := readWitnessContent(b)
+	if err != nil {
+		return nil, fmt.Errorf("witness b: %w", err)
+	}
+	res := &WitnessDiffResult{}
+	for h, size := range ca.nodes {
+		if _, ok := cb.nodes[h]; ok {
+			res.Shared.Nodes++
+			res.Shared.NodeBytes += uint64(size)
+		} else {
+			res.OnlyA.Nodes++
+			res.OnlyA.NodeBytes += uint64(size)
+		}
+	}
+	for h, size := range cb.nodes {
+		if _, ok := ca.nodes[h]; !ok {
+			res.OnlyB.Nodes++
+			res.OnlyB.NodeBytes += uint64(size)
+		}
+	}
+	for h := range ca.hashes {
+		if _, ok := cb.hashes[h]; ok {
+			res.Shared.Hashes++
+		} else {
+			res.OnlyA.Hashes++
+		}
+	}
+	for h := range cb.hashes {
+		if _, ok := ca.hashes[h]; !ok {
+			res.OnlyB.Hashes++
+		}
+	}
+	for h, size := range ca.codes {
+		if _, ok := cb.codes[h]; ok {
+			res.Shared.Codes++
+			res.Shared.CodeBytes += uint64(size)
+		} else {
+			res.OnlyA.Codes++
+			res.OnlyA.CodeBytes += uint64(size)
+		}
+	}
+	for h, size := range cb.codes {
+		if _, ok := ca.codes[h]; !ok {
+			res.OnlyB.Codes++
+			res.OnlyB.CodeBytes += uint64(size)
+		}
+	}
+	return res, nil
+}
+
+func readWitnessContent(serialized []byte) (*witnessContent, error) {
+	w, err := NewWitnessFromReader(bytes.NewReader(serialized), false /* trace */)
+	if err != nil {
+		return nil, err
+	}
+	t, codeMap, err := BuildTrieFromWitness(w, w.Header.IsBinary(), false /* trace */)
+	if err != nil {
+		return nil, err
+	}
+	c := &witnessContent{
+		nodes:  make(map[common.Hash]int),
+		hashes: make(map[common.Hash]struct{}),
+		codes:  make(map[common.Hash]int, len(codeMap)),
+	}
+	for codeHash, code := range codeMap {
+		c.codes[codeHash] = len(code)
+	}
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+	if err = c.collect(h, t.root); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *witnessContent) collect(h *hasher, n node) error {
+	switch n := n.(type) {
+	case nil, valueNode:
+		return nil
+	case hashNode:
+		c.hashes[common.BytesToHash(n)] = struct{}{}
+		return nil
+	case *accountNode:
+		// The account is encoded in its leaf, only the storage is collected separately
+		return c.collect(h, n.storage)
+	case *shortNode:
+		if err := c.add(h, n); err != nil {
+			return err
+		}
+		return c.collect(h, n.Val)
+	case *duoNode:
+		if err := c.add(h, n); err != nil {
+			return err
+		}
+		if err := c.collect(h, n.child1); err != nil {
+			return err
+		}
+		return c.collect(h, n.child2)
+	case *fullNode:
+		if err := c.add(h, n); err != nil {
+			return err
+		}
+		for _, child := range n.Children {
+			if err := c.collect(h, child); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected node type %T in the witness", n)
+	}
+}
+
+// add records the node by its hash. The nodes shorter than the hash are hashed as well, so that they can be matched
+func (c *witnessContent) add(h *hasher, n node) error {
+	encoding, err := h.hashChildren(n, 0)
+	if err != nil {
+		return err
+	}
+	size := len(encoding)
+	var hash common.Hash
+	if _, err = h.hash(n, true, hash[:]); err != nil {
+		return err
+	}
+	c.nodes[hash] = size
+	return nil
+}
@@ -0,0 +1,69 @@
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+func TestWitnessDiff(t *testing.T) {
+	codes := map[int][]byte{0: []byte("code-a"), 2: []byte("code-shared"), 5: []byte("code-b")}
+	codeMap := CodeMap{}
+	tr := New(common.Hash{})
+	for i := 0; i < 16; i++ {
+		account := accounts.NewAccount()
+		account.Balance.SetInt64(int64(i + 1))
+		if code, ok := codes[i]; ok {
+			account.CodeHash = crypto.Keccak256Hash(code)
+			codeMap[account.CodeHash] = code
+		}
+		tr.UpdateAccount(crypto.Keccak256([]byte{byte(i)}), &account)
+	}
+	witness := func(from, to int) []byte {
+		rs := NewResolveSet(0)
+		for i := from; i <= to; i++ {
+			rs.AddKey(crypto.Keccak256([]byte{byte(i)}))
+		}
+		hr := newHasher(false)
+		defer returnHasherToPool(hr)
+		w, err := NewWitnessBuilder(tr.root, 1, false, codeMap).Build(&MerklePathLimiter{rs, hr.hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err = w.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	a, b := witness(0, 3), witness(2, 5)
+
+	res, err := WitnessDiff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Shared.Nodes == 0 || res.OnlyA.Nodes == 0 || res.OnlyB.Nodes == 0 {
+		t.Errorf("expected shared and unique nodes, got\n%s", res)
+	}
+	if res.Shared.Codes != 1 || res.OnlyA.Codes != 1 || res.OnlyB.Codes != 1 {
+		t.Errorf("expected one shared and one unique code in each witness, got\n%s", res)
+	}
+	if res.Shared.CodeBytes != uint64(len(codes[2])) {
+		t.Errorf("expected %d bytes of the shared code, got %d", len(codes[2]), res.Shared.CodeBytes)
+	}
+
+	res, err = WitnessDiff(a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OnlyA != (WitnessDiffPart{}) || res.OnlyB != (WitnessDiffPart{}) || res.Shared.Codes != 2 {
+		t.Errorf("expected the witness to be equal to itself, got\n%s", res)
+	}
+
+	if _, err = WitnessDiff(a, b[:1]); err == nil {
+		t.Errorf("expected the truncated witness to be rejected")
+	}
+}
@@ -34,6 +34,8 @@ const (
 	OpAccountLeaf
 	// OpEmptyRoot places nil onto the node stack, and empty root hash onto the hash stack.
 	OpEmptyRoot
+	// OpCodeRef has the code hash as the operand. It takes the code from the code window (see CodeWindow) and works as OpCode.
+	OpCodeRef
 
 	// OpNewTrie stops the processing, because another trie is encoded into the witness.
 	OpNewTrie = OperatorKindCode(0xBB)
@@ -244,6 +246,27 @@ func (o *OperatorEmptyRoot) LoadFrom(loader *OperatorUnmarshaller) error {
 	return nil
 }
 
+// OperatorCodeRef references the code that has been included into one of the previous witnesses, instead of embedding it
+type OperatorCodeRef struct {
+	Hash common.Hash
+}
+
+func (o *OperatorCodeRef) WriteTo(output *OperatorMarshaller) error {
+	if err := output.WriteOpCode(OpCodeRef); err != nil {
+		return err
+	}
+	return output.WriteHash(o.Hash)
+}
+
+func (o *OperatorCodeRef) LoadFrom(loader *OperatorUnmarshaller) error {
+	hash, err := loader.ReadHash()
+	if err != nil {
+		return err
+	}
+	o.Hash = hash
+	return nil
+}
+
 type OperatorExtension struct {
 	Key []byte
 }
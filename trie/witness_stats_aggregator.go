@@ -0,0 +1,134 @@
+package trie
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// WitnessStatsRow is one line of the witness statistics report: the sizes of the witness of a block,
+// with the shares of codes, hashes and leaves (keys and values) in the total size, as well
+// as the same figures averaged over the rolling window of blocks ending with this one
+type WitnessStatsRow struct {
+	BlockNumber  uint64  `json:"block"`
+	TotalSize    uint64  `json:"total_size"`
+	CodeShare    float64 `json:"code_share"`
+	HashShare    float64 `json:"hash_share"`
+	LeafShare    float64 `json:"leaf_share"`
+	AvgTotalSize float64 `json:"avg_total_size"`
+	AvgCodeShare float64 `json:"avg_code_share"`
+	AvgHashShare float64 `json:"avg_hash_share"`
+	AvgLeafShare float64 `json:"avg_leaf_share"`
+}
+
+type blockWitnessSizes struct {
+	blockNr uint64
+	total   uint64
+	codes   uint64
+	hashes  uint64
+	leaves  uint64
+}
+
+// WitnessStatsAggregator ingests BlockWitnessStats for a range of blocks and produces
+// per-block and rolling-average reports
+type WitnessStatsAggregator struct {
+	window int
+	blocks []blockWitnessSizes
+}
+
+// NewWitnessStatsAggregator creates an aggregator, window is the number of blocks
+// the rolling averages are computed over
+func NewWitnessStatsAggregator(window int) *WitnessStatsAggregator {
+	if window < 1 {
+		window = 1
+	}
+	return &WitnessStatsAggregator{window: window}
+}
+
+func (a *WitnessStatsAggregator) Add(blockNr uint64, s *BlockWitnessStats) {
+	a.blocks = append(a.blocks, blockWitnessSizes{
+		blockNr: blockNr,
+		total:   s.BlockWitnessSize(),
+		codes:   s.CodesSize(),
+		hashes:  s.HashesSize(),
+		leaves:  s.LeafKeysSize() + s.LeafValuesSize(),
+	})
+}
+
+func share(part, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
+
+// Rows returns the report, one row per block, in the order the blocks were added
+func (a *WitnessStatsAggregator) Rows() []WitnessStatsRow {
+	rows := make([]WitnessStatsRow, len(a.blocks))
+	var sum blockWitnessSizes
+	for i, b := range a.blocks {
+		sum.total += b.total
+		sum.codes += b.codes
+		sum.hashes += b.hashes
+		sum.leaves += b.leaves
+		if i >= a.window {
+			old := a.blocks[i-a.window]
+			sum.total -= old.total
+			sum.codes -= old.codes
+			sum.hashes -= old.hashes
+			sum.leaves -= old.leaves
+		}
+		n := i + 1
+		if n > a.window {
+			n = a.window
+		}
+		rows[i] = WitnessStatsRow{
+			BlockNumber:  b.blockNr,
+			TotalSize:    b.total,
+			CodeShare:    share(b.codes, b.total),
+			HashShare:    share(b.hashes, b.total),
+			LeafShare:    share(b.leaves, b.total),
+			AvgTotalSize: float64(sum.total) / float64(n),
+			AvgCodeShare: share(sum.codes, sum.total),
+			AvgHashShare: share(sum.hashes, sum.total),
+			AvgLeafShare: share(sum.leaves, sum.total),
+		}
+	}
+	return rows
+}
+
+// WriteCSV writes the report in CSV format, with the header line
+func (a *WitnessStatsAggregator) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{"BlockNumber", "TotalSize", "CodeShare", "HashShare", "LeafShare",
+		"AvgTotalSize", "AvgCodeShare", "AvgHashShare", "AvgLeafShare"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, r := range a.Rows() {
+		fields := []string{
+			fmt.Sprintf("%d", r.BlockNumber),
+			fmt.Sprintf("%d", r.TotalSize),
+			fmt.Sprintf("%.4f", r.CodeShare),
+			fmt.Sprintf("%.4f", r.HashShare),
+			fmt.Sprintf("%.4f", r.LeafShare),
+			fmt.Sprintf("%.1f", r.AvgTotalSize),
+			fmt.Sprintf("%.4f", r.AvgCodeShare),
+			fmt.Sprintf("%.4f", r.AvgHashShare),
+			fmt.Sprintf("%.4f", r.AvgLeafShare),
+		}
+		if err := cw.Write(fields); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes the report as a JSON array of rows
+func (a *WitnessStatsAggregator) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a.Rows())
+}
@@ -0,0 +1,50 @@
+package trie
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWitnessStatsAggregator(t *testing.T) {
+	a := NewWitnessStatsAggregator(2)
+	a.Add(10, &BlockWitnessStats{witnessSize: 100, stats: map[StatsColumn]uint64{ColumnCodes: 50, ColumnHashes: 30, ColumnLeafKeys: 10, ColumnLeafValues: 10}})
+	a.Add(11, &BlockWitnessStats{witnessSize: 300, stats: map[StatsColumn]uint64{ColumnCodes: 0, ColumnHashes: 150, ColumnLeafKeys: 50, ColumnLeafValues: 100}})
+	a.Add(12, &BlockWitnessStats{witnessSize: 100, stats: map[StatsColumn]uint64{ColumnCodes: 100}})
+
+	rows := a.Rows()
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if rows[0].CodeShare != 0.5 || rows[0].LeafShare != 0.2 || rows[0].AvgTotalSize != 100 {
+		t.Errorf("unexpected first row: %+v", rows[0])
+	}
+	if rows[1].AvgTotalSize != 200 || rows[1].AvgHashShare != 0.45 {
+		t.Errorf("unexpected second row: %+v", rows[1])
+	}
+	// Block 10 is out of the window by now
+	if rows[2].AvgTotalSize != 200 || rows[2].AvgCodeShare != 0.25 {
+		t.Errorf("unexpected third row: %+v", rows[2])
+	}
+
+	var csvBuf bytes.Buffer
+	if err := a.WriteCSV(&csvBuf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(csvBuf.String()), "\n"); len(lines) != 4 {
+		t.Errorf("expected header and 3 lines in CSV, got %d", len(lines))
+	}
+
+	var jsonBuf bytes.Buffer
+	if err := a.WriteJSON(&jsonBuf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []WitnessStatsRow
+	if err := json.Unmarshal(jsonBuf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 3 || decoded[1] != rows[1] {
+		t.Errorf("unexpected JSON report: %s", jsonBuf.String())
+	}
+}
@@ -90,3 +90,83 @@ func TestWitnessSerialization(t *testing.T) {
 		t.Errorf("witnesses not equal: expected %+v; got %+v", expectedWitness, decodedWitness)
 	}
 }
+
+func TestWitnessVersions(t *testing.T) {
+	operands := generateOperands()
+
+	// The witnesses of the version 1 have no capabilities byte
+	v1 := Witness{WitnessHeader{Version: 1}, operands}
+	var buffer bytes.Buffer
+	if _, err := v1.WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	v2 := Witness{WitnessHeader{Version: 2, Capabilities: WitnessBinaryTrie}, operands}
+	var buffer2 bytes.Buffer
+	if _, err := v2.WriteTo(&buffer2); err != nil {
+		t.Fatal(err)
+	}
+	if buffer2.Len() != buffer.Len()+1 {
+		t.Errorf("expected the version 2 to add one byte, got %d and %d", buffer.Len(), buffer2.Len())
+	}
+	for _, w := range []*Witness{&v1, &v2} {
+		var b bytes.Buffer
+		if _, err := w.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := NewWitnessFromReader(&b, false /* trace */)
+		if err != nil {
+			t.Fatalf("version %d: %v", w.Header.Version, err)
+		}
+		if decoded.Header != w.Header || !witnessesEqual(w, decoded) {
+			t.Errorf("version %d: witnesses not equal: expected %+v; got %+v", w.Header.Version, w, decoded)
+		}
+	}
+
+	if _, _, err := BuildTrieFromWitness(&v2, false /* is-binary */, false /* trace */); err == nil {
+		t.Errorf("expected the binary witness to be rejected for the hexary trie")
+	}
+	invalid := Witness{WitnessHeader{Version: 1, Capabilities: WitnessBinaryTrie}, operands}
+	if _, err := invalid.WriteTo(&buffer); err == nil {
+		t.Errorf("expected capabilities to be rejected for the version 1")
+	}
+	for _, header := range [][]byte{{0}, {WitnessVersion + 1}, {2, byte(WitnessCodeChunks)}} {
+		if _, err := NewWitnessFromReader(bytes.NewReader(header), false); err == nil {
+			t.Errorf("expected header %x to be rejected", header)
+		}
+	}
+}
+
+func TestNegotiateWitnessHeader(t *testing.T) {
+	local := LocalWitnessFormat()
+	legacy := WitnessFormat{MinVersion: 1, MaxVersion: 1}
+	chunked := WitnessFormat{MinVersion: 2, MaxVersion: 3, Capabilities: WitnessBinaryTrie | WitnessCodeChunks}
+
+	tests := []struct {
+		producer, consumer WitnessFormat
+		required           WitnessCapabilities
+		expected           WitnessHeader
+		fails              bool
+	}{
+		{producer: local, consumer: local, expected: WitnessHeader{Version: WitnessVersion}},
+		{producer: local, consumer: legacy, expected: WitnessHeader{Version: 1}},
+		{producer: local, consumer: legacy, required: WitnessBinaryTrie, fails: true},
+		{producer: local, consumer: local, required: WitnessBinaryTrie, expected: WitnessHeader{Version: 2, Capabilities: WitnessBinaryTrie}},
+		{producer: chunked, consumer: local, required: WitnessBinaryTrie, expected: WitnessHeader{Version: 2, Capabilities: WitnessBinaryTrie}},
+		{producer: chunked, consumer: local, required: WitnessCodeChunks, fails: true},
+		{producer: chunked, consumer: legacy, fails: true},
+	}
+	for i, tt := range tests {
+		header, err := NegotiateWitnessHeader(tt.producer, tt.consumer, tt.required)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("test %d: expected the negotiation to fail, got %+v", i, header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+		} else if header != tt.expected {
+			t.Errorf("test %d: expected %+v, got %+v", i, tt.expected, header)
+		}
+	}
+}